@@ -0,0 +1,93 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// AccessLogFormat is how access log entries are written
+type AccessLogFormat string
+
+const (
+	// Through the logger like other logs, with a field for everything recorded about the request
+	AccessLogStructured AccessLogFormat = "structured"
+
+	// One line per request on stdout in the Apache common or combined log format, for pipelines that parse them
+	AccessLogCommon   AccessLogFormat = "common"
+	AccessLogCombined AccessLogFormat = "combined"
+)
+
+// Time layout of the common log format, e.g. "10/Oct/2000:13:55:36 -0700"
+const commonLogTime = "02/Jan/2006:15:04:05 -0700"
+
+// Where common and combined access log lines are written, and a lock so concurrent requests don't interleave
+var (
+	accessLogOutput io.Writer = os.Stdout
+	accessLogMu     sync.Mutex
+)
+
+// newAccessLogger returns what writes a finished request to the access log, or nil when it isn't enabled
+func newAccessLogger(config LoggingConfig) func(*RequestRecord) {
+	if !config.AccessLog {
+		return nil
+	}
+	switch config.AccessLogFormat {
+	case AccessLogCommon, AccessLogCombined:
+		format := config.AccessLogFormat
+		return func(record *RequestRecord) {
+			line := formatCommonLog(record, format == AccessLogCombined)
+			accessLogMu.Lock()
+			defer accessLogMu.Unlock()
+			io.WriteString(accessLogOutput, line)
+		}
+	default:
+		return logAccess
+	}
+}
+
+// formatCommonLog writes a request in the common log format, with the referer and user agent as well when combined.
+// The client the proxy identified is the authenticated user, and quoted fields escape quotes and anything unprintable.
+func formatCommonLog(record *RequestRecord, combined bool) string {
+	host := record.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	bytes := "-"
+	if record.Bytes > 0 {
+		bytes = strconv.FormatInt(record.Bytes, 10)
+	}
+	request := fmt.Sprintf("%s %s %s", record.Method, record.RequestURI, record.Proto)
+	line := fmt.Sprintf("%s - %s [%s] %s %d %s", orDash(host), orDash(record.Client), record.Start.Format(commonLogTime),
+		strconv.Quote(request), record.Status, bytes)
+	if combined {
+		line += fmt.Sprintf(" %s %s", strconv.Quote(orDash(record.Referer)), strconv.Quote(orDash(record.UserAgent)))
+	}
+	return line + "\n"
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,57 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommonLogFormat(t *testing.T) {
+	var output bytes.Buffer
+	accessLogOutput = &output
+	defer func() { accessLogOutput = os.Stdout }()
+
+	start := time.Date(2024, time.March, 5, 13, 55, 36, 0, time.FixedZone("", -7*60*60))
+	handler := recordRequests(nil, newAccessLogger(LoggingConfig{AccessLog: true, AccessLogFormat: AccessLogCombined}), nil)(
+		func(w http.ResponseWriter, r *http.Request) {
+			record := recordFromContext(r.Context())
+			record.Start = start
+			record.Client = "team-a"
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte("slow down"))
+		})
+	r := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/chat/completions?x=1", nil)
+	r.RemoteAddr = "10.1.2.3:51234"
+	r.Header.Set("User-Agent", `curl/8.0 "test"`)
+	handler(httptest.NewRecorder(), r)
+	assert.Equal(t, `10.1.2.3 - team-a [05/Mar/2024:13:55:36 -0700] "POST /openai/v1/chat/completions?x=1 HTTP/1.1" 429 9 "-" "curl/8.0 \"test\""`+"\n", output.String())
+
+	// Common leaves out the referer and user agent, and empty responses have no size
+	record := &RequestRecord{Start: start, Method: "GET", RequestURI: "/models", Proto: "HTTP/1.1", RemoteAddr: "10.1.2.3", Status: 200}
+	assert.Equal(t, `10.1.2.3 - - [05/Mar/2024:13:55:36 -0700] "GET /models HTTP/1.1" 200 -`+"\n", formatCommonLog(record, false))
+
+	// Unknown formats are refused
+	assert.Panics(t, func() {
+		parseConfig([]byte(`{"logging": {"accessLogFormat": "xml"}, "routes": {}}`), "test")
+	})
+}
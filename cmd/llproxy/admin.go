@@ -0,0 +1,289 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// SchedulerStatus describes a scheduler's limits, current capacity and totals for the admin endpoints
+type SchedulerStatus struct {
+	Route           string         `json:"route"`
+	Provider        string         `json:"provider"`
+	Model           string         `json:"model"`
+	Scope           string         `json:"scope,omitempty"`
+	MaxQueueSize    int            `json:"maxQueueSize"`
+	MaxQueueWait    float64        `json:"maxQueueWait"`
+	ReqsPerMinute   float64        `json:"rpm"`
+	TokensPerMinute float64        `json:"tpm"`
+	RequestCapacity float64        `json:"requestCapacity"`
+	TokenCapacity   float64        `json:"tokenCapacity"`
+	QueuedRequests  int            `json:"queuedRequests"`
+	QueuedTokens    float64        `json:"queuedTokens"`
+	ResponseTokens  int            `json:"responseTokens"`
+	Admitted        uint64         `json:"admitted"`
+	Rejected        uint64         `json:"rejected"`
+	OverSoftLimit   uint64         `json:"overSoftLimit"`
+	AdmittedRPM     float64        `json:"admittedRpm"`
+	AdmittedTPM     float64        `json:"admittedTpm"`
+	Headroom        float64        `json:"headroom"`
+	State           SchedulerState `json:"state"`
+}
+
+// RouteUpstreamStatus is an upstream's health, along with the limits believed for each of its route's models
+type RouteUpstreamStatus struct {
+	Route  string  `json:"route"`
+	Weight float64 `json:"weight"`
+	UpstreamStatus
+	Models []ModelLimitStatus `json:"models"`
+}
+
+// RouteUpstreams replaces the upstreams of a route through the admin API
+type RouteUpstreams struct {
+	Route     string           `json:"route"`
+	Upstreams []UpstreamTarget `json:"upstreams"`
+}
+
+// ModelLimitStatus compares a model's configured limits with those it's enforcing and those the upstream last reported
+type ModelLimitStatus struct {
+	Model        string           `json:"model"`
+	Configured   SchedulerLimits  `json:"configured"`
+	Current      SchedulerLimits  `json:"current"`
+	Discovered   *SchedulerLimits `json:"discovered,omitempty"`
+	ProbeLatency float64          `json:"probeLatency,omitempty"`
+}
+
+func AdminStartup(c *Config, providers Providers) {
+	// The admin server exposes internal state, so it gets its own server whose listeners can be kept off the public network
+	router := newAdminRouter(providers)
+	router.Handle("/admin/explain", []string{http.MethodPost}, postExplain(providers, newClientKeys(c), c.DefaultPriority))
+	router.Handle("/admin/config", []string{http.MethodGet}, getEffectiveConfig(c, providers))
+	router.Handle("/admin/openapi.json", []string{http.MethodGet}, getOpenAPI(c))
+	router.Handle("/admin/selftest", []string{http.MethodGet}, getSelfTest(c, newUpstreamClient(c.Application.UpstreamConnections)))
+	if c.Application.AdminFaultInjection {
+		handleSetFaults(router, providers)
+	}
+	adminServer := &http.Server{
+		Handler: router,
+	}
+	ServeListeners(&c.Application, ServerAdmin, adminServer)
+}
+
+func newAdminRouter(providers Providers) *Router {
+	router := NewRouter()
+	router.Use(authenticateAdmin)
+	methods := []string{http.MethodGet}
+	router.Handle("/", methods, getDashboard())
+	router.Handle("/admin/schedulers", methods, getSchedulerStatus(providers))
+	router.Handle("/admin/schedulers/pause", []string{http.MethodPost}, setSchedulerState(providers, SchedulerPaused))
+	router.Handle("/admin/schedulers/drain", []string{http.MethodPost}, setSchedulerState(providers, SchedulerDraining))
+	router.Handle("/admin/schedulers/resume", []string{http.MethodPost}, setSchedulerState(providers, SchedulerRunning))
+	router.Handle("/admin/peers", methods, getPeerStatus())
+	router.Handle("/admin/peers/report", methods, getPeerReport(providers), requireAdminAuth)
+	router.Handle("/admin/upstreams", methods, getUpstreamStatus(providers))
+	router.Handle("/admin/upstreams/set", []string{http.MethodPost}, setUpstreams(providers), requireAdminAuth)
+	router.Handle("/admin/errors", methods, getRecentErrors())
+	router.Handle("/admin/errors/codes", methods, getRejectReasons())
+	router.Handle("/admin/usage", methods, getUsageRecords())
+	router.HandlePrefix("/admin/captures", methods, getCaptures(), requireAdminAuth)
+	router.Handle("/metrics", methods, getMetrics(providers))
+	router.Handle("/admin/maintenance", methods, getMaintenanceStatus(providers))
+	router.Handle("/admin/maintenance/disable", []string{http.MethodPost}, setMaintenance(providers, false))
+	router.Handle("/admin/maintenance/enable", []string{http.MethodPost}, setMaintenance(providers, true))
+	router.Handle("/admin/faults", methods, getFaultStatus(providers))
+	router.Handle("/admin/keys", methods, getKeyStatus(providers))
+	router.Handle("/admin/keys/set", []string{http.MethodPost}, setKeyDisabled(providers))
+	return router
+}
+
+func getDashboard() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(dashboardHTML)
+	}
+}
+
+func getSchedulerStatus(providers Providers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		statuses := []SchedulerStatus{}
+		for _, route := range sortedRoutes(providers) {
+			provider := providers[route]
+			for _, schedulers := range append([]SchedulerMap{provider.Schedulers()}, provider.ScopedSchedulers()...) {
+				statuses = append(statuses, schedulerStatuses(route, schedulers)...)
+			}
+		}
+		writeJSON(w, statuses)
+	}
+}
+
+func schedulerStatuses(route string, schedulers SchedulerMap) []SchedulerStatus {
+	models := make([]string, 0, len(schedulers))
+	for model := range schedulers {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+
+	statuses := make([]SchedulerStatus, 0, len(models))
+	for _, model := range models {
+		statuses = append(statuses, schedulerStatus(route, model, schedulers[model]))
+	}
+	return statuses
+}
+
+func schedulerStatus(route string, model string, scheduler *Scheduler) SchedulerStatus {
+	snapshot := scheduler.Snapshot()
+	limits := scheduler.Limits()
+	admitted, rejected := scheduler.Counts()
+	admittedRPM, admittedTPM := scheduler.throughput.PerMinute(scheduler.now())
+	return SchedulerStatus{
+		Route:           route,
+		Provider:        scheduler.Provider,
+		Model:           model,
+		Scope:           scheduler.Scope,
+		MaxQueueSize:    scheduler.Config.MaxQueueSize,
+		MaxQueueWait:    scheduler.Config.MaxQueueWait,
+		ReqsPerMinute:   limits.ReqsPerMinute,
+		TokensPerMinute: limits.TokensPerMinute,
+		RequestCapacity: snapshot.RequestCapacity,
+		TokenCapacity:   snapshot.TokenCapacity,
+		QueuedRequests:  snapshot.QueuedRequests,
+		QueuedTokens:    snapshot.QueuedTokens,
+		ResponseTokens:  scheduler.responseTokens.Tokens(),
+		Admitted:        admitted,
+		Rejected:        rejected,
+		OverSoftLimit:   scheduler.overSoftLimit.Load(),
+		AdmittedRPM:     admittedRPM,
+		AdmittedTPM:     admittedTPM,
+		Headroom:        scheduler.headroom(),
+		State:           scheduler.State(),
+	}
+}
+
+func getUpstreamStatus(providers Providers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		statuses := []RouteUpstreamStatus{}
+		for _, route := range sortedRoutes(providers) {
+			models := modelLimitStatuses(providers[route])
+			pool := providers[route].UpstreamPool()
+			for _, upstream := range pool.All() {
+				statuses = append(statuses, RouteUpstreamStatus{Route: route, Weight: pool.Weight(upstream), UpstreamStatus: upstream.Status(), Models: models})
+			}
+		}
+		writeJSON(w, statuses)
+	}
+}
+
+// setUpstreams replaces a route's upstreams and their weights, e.g. to shift traffic away from a provider during an incident
+func setUpstreams(providers Providers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request RouteUpstreams
+		if err := decodeJSON(r.Body, &request); err != nil {
+			writeError(w, http.StatusBadRequest, ErrTypeInvalidRequest, ErrCodeInvalidRequest, fmt.Sprintf("Invalid upstreams request: %s", err))
+			return
+		}
+		provider, ok := providers[request.Route]
+		if !ok {
+			writeError(w, http.StatusNotFound, ErrTypeInvalidRequest, ErrCodeInvalidRequest, fmt.Sprintf("No route '%s'", request.Route))
+			return
+		}
+
+		pool := provider.UpstreamPool()
+		previous := pool.Targets()
+		if err := pool.Set(request.Upstreams); err != nil {
+			writeError(w, http.StatusBadRequest, ErrTypeInvalidRequest, ErrCodeInvalidRequest, err.Error())
+			return
+		}
+		request.Upstreams = pool.Targets()
+		zap.S().Warnw("Changed upstreams", "route", request.Route, "from", formatTargets(previous), "to", formatTargets(request.Upstreams), "remoteAddr", r.RemoteAddr)
+		writeJSON(w, request)
+	}
+}
+
+// formatTargets lists upstreams for the audit log, e.g. "https://a.example.com=1,https://b.example.com=0"
+func formatTargets(targets []UpstreamTarget) string {
+	formatted := make([]string, len(targets))
+	for i, target := range targets {
+		formatted[i] = fmt.Sprintf("%s=%g", target.URL, target.weight())
+	}
+	return strings.Join(formatted, ",")
+}
+
+func modelLimitStatuses(provider Provider) []ModelLimitStatus {
+	schedulers := provider.Schedulers()
+	discovery := provider.LimitDiscovery()
+	statuses := []ModelLimitStatus{}
+	for _, model := range sortedModels(schedulers) {
+		scheduler := schedulers[model]
+		status := ModelLimitStatus{
+			Model:      model,
+			Configured: SchedulerLimits{ReqsPerMinute: scheduler.Config.ReqsPerMinute, TokensPerMinute: scheduler.Config.TokensPerMinute},
+			Current:    scheduler.Limits(),
+		}
+		if discovered, ok := discovery.Discovered(scheduler); ok {
+			status.Discovered = &discovered
+		}
+		if latency, ok := discovery.ProbeLatency(scheduler); ok {
+			status.ProbeLatency = latency.Seconds()
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func getRecentErrors() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, recentErrors.List())
+	}
+}
+
+func getRejectReasons() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, rejectReasons)
+	}
+}
+
+func getUsageRecords() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, usageRecords.List())
+	}
+}
+
+func sortedRoutes(providers Providers) []string {
+	routes := make([]string, 0, len(providers))
+	for route := range providers {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	return routes
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		zap.S().Errorw("Unable to encode admin response", "reason", err)
+	}
+}
@@ -0,0 +1,181 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminSchedulers(t *testing.T) {
+	openai := CreateOpenAI()
+	router := newAdminRouter(Providers{"openai": openai})
+
+	// One admitted and one rejected request
+	handler := openai.GetHandler()
+	for _, tokens := range []float64{60000, -1000} {
+		openai.schedulers[TEST_MODEL].setCapacity(60, tokens)
+		body := []byte(fmt.Sprintf(`{"model": "%s", "prompt": "test"}`, TEST_MODEL))
+		handler(httptest.NewRecorder(), httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewBuffer(body)))
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8082/admin/schedulers", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var statuses []SchedulerStatus
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &statuses))
+	assert.Len(t, statuses, 1)
+	assert.Equal(t, "openai", statuses[0].Route)
+	assert.Equal(t, TEST_MODEL, statuses[0].Model)
+	assert.Equal(t, 60000.0, statuses[0].TokensPerMinute)
+	assert.Equal(t, uint64(1), statuses[0].Admitted)
+	assert.Equal(t, uint64(1), statuses[0].Rejected)
+}
+
+func TestAdminUpstreamsAndErrors(t *testing.T) {
+	openai := CreateOpenAI()
+	router := newAdminRouter(Providers{"openai": openai})
+
+	// The mock client answers unknown paths with a 404, which is not an upstream failure
+	handler := openai.GetHandler()
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost:8080/openai/v1/unknown", nil))
+	writeError(httptest.NewRecorder(), http.StatusTooManyRequests, ErrTypeRequests, ErrCodeRateLimitExceeded, "admin test error")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8082/admin/upstreams", nil))
+	var upstreams []RouteUpstreamStatus
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &upstreams))
+	assert.Len(t, upstreams, 1)
+	assert.True(t, upstreams[0].Healthy)
+	assert.Equal(t, uint64(1), upstreams[0].Requests)
+	assert.Equal(t, uint64(0), upstreams[0].Failures)
+	assert.Equal(t, CircuitClosed, upstreams[0].Circuit)
+	assert.Greater(t, upstreams[0].LastLatency, 0.0)
+	assert.NotEmpty(t, upstreams[0].Models)
+	assert.Equal(t, upstreams[0].Models[0].Configured, upstreams[0].Models[0].Current)
+	assert.Nil(t, upstreams[0].Models[0].Discovered)
+
+	assert.Equal(t, 1.0, upstreams[0].Weight)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8082/admin/errors", nil))
+	var errors []RecentError
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &errors))
+	assert.NotEmpty(t, errors)
+	assert.Equal(t, "admin test error", errors[0].Message)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8082/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "/admin/schedulers")
+
+	// Upstreams can only be changed with a token, as requests are sent to them with the route's key
+	set := func(body string) int {
+		r := httptest.NewRequest("POST", "http://localhost:8082/admin/upstreams/set", bytes.NewBufferString(body))
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+	shift := fmt.Sprintf(`{"route": "openai", "upstreams": [{"url": "%s", "weight": 0}, {"url": "https://standby.example.com"}]}`, upstreams[0].URL)
+	assert.Equal(t, http.StatusForbidden, set(shift))
+	withAdminAuth(t, "secret")
+
+	// Only to the configured upstreams and the route's allowlist
+	assert.Equal(t, http.StatusBadRequest, set(shift))
+	assert.Equal(t, http.StatusBadRequest, set(`{"route": "openai", "upstreams": [{"url": "https://attacker.example.com"}]}`))
+	openai.upstreams.allowed["https://standby.example.com"] = true
+
+	// Traffic is shifted to another upstream while running, the kept one drained rather than removed
+	assert.Equal(t, http.StatusOK, set(shift))
+	assert.Equal(t, http.StatusBadRequest, set(`{"route": "openai", "upstreams": []}`))
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://localhost:8082/admin/upstreams", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	router.ServeHTTP(w, r)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &upstreams))
+	assert.Len(t, upstreams, 2)
+	assert.Equal(t, 0.0, upstreams[0].Weight)
+	assert.Equal(t, uint64(1), upstreams[0].Requests)
+	assert.Equal(t, "https://standby.example.com", upstreams[1].URL)
+}
+
+func TestUpstreamHealth(t *testing.T) {
+	upstream := NewUpstreamHealth("https://api.openai.com")
+	upstream.Record(http.StatusOK, nil)
+	assert.True(t, upstream.Status().Healthy)
+
+	upstream.Record(http.StatusBadGateway, nil)
+	status := upstream.Status()
+	assert.False(t, status.Healthy)
+	assert.Equal(t, uint64(2), status.Requests)
+	assert.Equal(t, uint64(1), status.Failures)
+	assert.Equal(t, "Bad Gateway", status.LastFailure)
+	assert.Equal(t, CircuitOpen, status.Circuit)
+	assert.Equal(t, 0.5, status.ErrorRate)
+
+	// The error rate only covers the most recent requests
+	for i := 0; i < upstreamErrorWindow; i++ {
+		upstream.Record(http.StatusOK, nil)
+	}
+	assert.Equal(t, 0.0, upstream.ErrorRate())
+}
+
+func TestErrorRing(t *testing.T) {
+	ring := &errorRing{}
+	for i := 0; i < maxRecentErrors+5; i++ {
+		ring.Add(RecentError{Status: i})
+	}
+	list := ring.List()
+	assert.Len(t, list, maxRecentErrors)
+	assert.Equal(t, maxRecentErrors+4, list[0].Status)
+	assert.Equal(t, 5, list[len(list)-1].Status)
+}
+
+func TestSchedulerMetrics(t *testing.T) {
+	openai := NewOpenAI(&RouteConfig{
+		Forward:  FAKE_BASE_URL,
+		Provider: "openai",
+		Models:   map[string]ModelConfig{TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 30, ReqsPerMinute: 60, TokensPerMinute: 60000}},
+	}, &MockHttpClient{})
+	router := newAdminRouter(Providers{"openai": openai})
+
+	// Two seconds behind on requests, a third of the way to maxQueueWait once a request waits behind another
+	openai.Schedulers()[TEST_MODEL].setCapacity(-8, 60000)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8082/metrics", nil))
+	assert.Contains(t, w.Body.String(), `llproxy_scheduler_queued_requests{route="openai",model="gpt-3.5-turbo",scope=""} 0`)
+	metric := func(series string) float64 {
+		var value float64
+		for _, line := range strings.Split(w.Body.String(), "\n") {
+			if strings.HasPrefix(line, series+" ") {
+				value, _ = strconv.ParseFloat(strings.TrimPrefix(line, series+" "), 64)
+			}
+		}
+		return value
+	}
+	assert.InDelta(t, 9, metric(`llproxy_scheduler_wait_seconds{route="openai",model="gpt-3.5-turbo",scope=""}`), 0.1)
+	assert.InDelta(t, 0.3, metric("llproxy_queue_pressure"), 0.01)
+}
@@ -0,0 +1,101 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// AdminAuthConfig requires a bearer token on every request to the admin server
+type AdminAuthConfig struct {
+	// Environment variable holding the token, sent as "Authorization: Bearer <token>"
+	TokenEnv string `json:"tokenEnv"`
+}
+
+func (c *AdminAuthConfig) validate() error {
+	if c.TokenEnv == "" || os.Getenv(c.TokenEnv) == "" {
+		return fmt.Errorf("adminAuth tokenEnv '%s' is not set", c.TokenEnv)
+	}
+	return nil
+}
+
+// adminAuthenticator checks admin requests for the configured token, and adds it to the requests sent to peers
+type adminAuthenticator struct {
+	token string
+	hash  [sha256.Size]byte
+}
+
+// The admin server's authentication, nil when adminAuth isn't configured and the server only listens on loopback
+var adminAuth *adminAuthenticator
+
+func newAdminAuth(config *AdminAuthConfig) *adminAuthenticator {
+	if config == nil {
+		return nil
+	}
+	token := os.Getenv(config.TokenEnv)
+	return &adminAuthenticator{token: token, hash: sha256.Sum256([]byte(token))}
+}
+
+// Allows is whether the request carries the token, compared by hash so the comparison doesn't leak its contents
+func (a *adminAuthenticator) Allows(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	hash := sha256.Sum256([]byte(strings.TrimSpace(token)))
+	return subtle.ConstantTimeCompare(hash[:], a.hash[:]) == 1
+}
+
+// Authorize adds the token to a request for another replica's admin server
+func (a *adminAuthenticator) Authorize(req *http.Request) {
+	if a != nil {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+}
+
+// authenticateAdmin turns away admin requests without the token once adminAuth is configured. The dashboard page
+// itself holds no data, so a browser can load it and send the token with the requests for its panels.
+func authenticateAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if auth := adminAuth; auth != nil && r.URL.Path != "/" && !auth.Allows(r) {
+			zap.S().Warnw("Unauthorized admin request", "url", r.URL, "remote", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="llproxy admin"`)
+			writeError(w, http.StatusUnauthorized, ErrTypeInvalidRequest, ErrCodeUnauthorized, "A valid admin token is required")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireAdminAuth keeps endpoints that expose bodies or change where and how traffic is sent switched off
+// unless adminAuth is configured, since loopback alone doesn't say who is calling
+func requireAdminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminAuth == nil {
+			writeError(w, http.StatusForbidden, ErrTypeInvalidRequest, ErrCodeUnauthorized, "This endpoint requires app.adminAuth to be configured")
+			return
+		}
+		next(w, r)
+	}
+}
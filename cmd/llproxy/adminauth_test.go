@@ -0,0 +1,62 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// withAdminAuth configures adminAuth with the token for the rest of the test
+func withAdminAuth(t *testing.T, token string) {
+	t.Setenv("LLPROXY_TEST_ADMIN_TOKEN", token)
+	adminAuth = newAdminAuth(&AdminAuthConfig{TokenEnv: "LLPROXY_TEST_ADMIN_TOKEN"})
+	t.Cleanup(func() { adminAuth = nil })
+}
+
+func TestAdminAuth(t *testing.T) {
+	assert.Error(t, (&AdminAuthConfig{TokenEnv: "LLPROXY_TEST_UNSET_TOKEN"}).validate())
+
+	router := newAdminRouter(Providers{})
+	get := func(path string, token string) int {
+		r := httptest.NewRequest("GET", "http://localhost:8082"+path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// Without a token configured the server is open, it only listens on loopback
+	assert.Equal(t, http.StatusOK, get("/admin/errors", ""))
+
+	// Once it is, every request has to carry it
+	withAdminAuth(t, "secret")
+	assert.Equal(t, http.StatusUnauthorized, get("/admin/errors", ""))
+	assert.Equal(t, http.StatusUnauthorized, get("/admin/errors", "wrong"))
+	assert.Equal(t, http.StatusOK, get("/admin/errors", "secret"))
+
+	// Apart from the dashboard page, which asks for the token to fetch its panels with
+	assert.Equal(t, http.StatusOK, get("/", ""))
+
+	req := httptest.NewRequest("GET", "http://10.0.0.2:8082/admin/peers/report", nil)
+	adminAuth.Authorize(req)
+	assert.Equal(t, "Bearer secret", req.Header.Get("Authorization"))
+}
@@ -0,0 +1,267 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Defaults for quota alerts, utilization as a fraction of a limit and durations in seconds
+const (
+	defaultAlertThreshold = 0.8
+	defaultAlertDuration  = 300
+	defaultAlertInterval  = 10
+)
+
+// Events a quota alert sends
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// QuotaAlertConfig warns when a scheduler's limits stay close to used up, before requests start being rejected
+type QuotaAlertConfig struct {
+	// Fraction of a limit in use, including what's queued for it, that's alerted on. 0.8 when unset.
+	Threshold float64 `json:"threshold"`
+
+	// Seconds utilization has to stay above the threshold before alerting, 300 when unset
+	Duration float64 `json:"duration"`
+
+	// Seconds between checks, 10 when unset
+	Interval float64 `json:"interval"`
+
+	// URL each alert is also POSTed to as JSON, optional
+	Webhook string `json:"webhook"`
+}
+
+func (c *QuotaAlertConfig) validate() error {
+	if c.Threshold < 0 || c.Duration < 0 || c.Interval < 0 {
+		return fmt.Errorf("quotaAlerts threshold, duration and interval can't be negative")
+	}
+	if c.Webhook != "" && !strings.HasPrefix(c.Webhook, "http://") && !strings.HasPrefix(c.Webhook, "https://") {
+		return fmt.Errorf("quotaAlerts webhook '%s' isn't an http(s) URL", c.Webhook)
+	}
+	return nil
+}
+
+// QuotaAlert is a limit of one route, model and scope that has stayed above the threshold, or has since recovered.
+// The scope names the tenant, or the upstream key as "key:" and its variable, when the limit is theirs alone.
+type QuotaAlert struct {
+	Event       string    `json:"event"`
+	Route       string    `json:"route"`
+	Model       string    `json:"model"`
+	Scope       string    `json:"scope,omitempty"`
+	Limit       string    `json:"limit"`
+	Utilization float64   `json:"utilization"`
+	Threshold   float64   `json:"threshold"`
+	Since       time.Time `json:"since"`
+}
+
+// quotaWatch is the state of one limit being watched
+type quotaWatch struct {
+	alert  QuotaAlert
+	above  time.Time
+	firing bool
+}
+
+// quotaAlerter checks the utilization of every scheduler's limits, logging and sending alerts as they start and stop
+type quotaAlerter struct {
+	threshold float64
+	duration  time.Duration
+	interval  time.Duration
+	webhook   string
+	client    HttpClient
+	providers Providers
+
+	mu      sync.Mutex
+	watches map[string]*quotaWatch
+}
+
+// The quota alerts, nil when disabled
+var quotaAlerts *quotaAlerter
+
+func newQuotaAlerter(config *QuotaAlertConfig, providers Providers) *quotaAlerter {
+	if config == nil {
+		return nil
+	}
+	alerter := &quotaAlerter{
+		threshold: config.Threshold,
+		duration:  time.Duration(config.Duration * float64(time.Second)),
+		interval:  time.Duration(config.Interval * float64(time.Second)),
+		webhook:   config.Webhook,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		providers: providers,
+		watches:   make(map[string]*quotaWatch),
+	}
+	if alerter.threshold == 0 {
+		alerter.threshold = defaultAlertThreshold
+	}
+	if alerter.duration == 0 {
+		alerter.duration = defaultAlertDuration * time.Second
+	}
+	if alerter.interval == 0 {
+		alerter.interval = defaultAlertInterval * time.Second
+	}
+	return alerter
+}
+
+func (a *quotaAlerter) Run() {
+	if a == nil {
+		return
+	}
+	for now := range time.Tick(a.interval) {
+		a.check(now)
+	}
+}
+
+// check samples every limit, alerting on those above the threshold for long enough and resolving those that recovered
+func (a *quotaAlerter) check(now time.Time) {
+	var alerts []QuotaAlert
+
+	a.mu.Lock()
+	for _, route := range sortedRoutes(a.providers) {
+		provider := a.providers[route]
+		for _, schedulers := range append([]SchedulerMap{provider.Schedulers()}, provider.ScopedSchedulers()...) {
+			for _, model := range sortedModels(schedulers) {
+				scheduler := schedulers[model]
+				requests, tokens := scheduler.utilization()
+				for i, limit := range []string{"rpm", "tpm"} {
+					utilization := []float64{requests, tokens}[i]
+					if alert, ok := a.observe(QuotaAlert{Route: route, Model: model, Scope: scheduler.Scope, Limit: limit, Utilization: utilization}, now); ok {
+						alerts = append(alerts, alert)
+					}
+				}
+			}
+		}
+	}
+	a.mu.Unlock()
+
+	for _, alert := range alerts {
+		a.send(alert)
+	}
+}
+
+// observe folds in one sample, returning the alert to send if the limit started or stopped alerting
+func (a *quotaAlerter) observe(sample QuotaAlert, now time.Time) (QuotaAlert, bool) {
+	key := strings.Join([]string{sample.Route, sample.Scope, sample.Model, sample.Limit}, "\x00")
+	watch, ok := a.watches[key]
+	if !ok {
+		watch = &quotaWatch{}
+		a.watches[key] = watch
+	}
+	watch.alert = sample
+	watch.alert.Threshold = a.threshold
+
+	if sample.Utilization < a.threshold {
+		resolved := watch.firing
+		watch.above, watch.firing = time.Time{}, false
+		if resolved {
+			watch.alert.Event = AlertResolved
+			watch.alert.Since = now
+			return watch.alert, true
+		}
+		return QuotaAlert{}, false
+	}
+	if watch.above.IsZero() {
+		watch.above = now
+	}
+	watch.alert.Since = watch.above
+	if watch.firing || now.Sub(watch.above) < a.duration {
+		return QuotaAlert{}, false
+	}
+	watch.firing = true
+	watch.alert.Event = AlertFiring
+	return watch.alert, true
+}
+
+// send logs an alert and posts it to the webhook, if any
+func (a *quotaAlerter) send(alert QuotaAlert) {
+	fields := []any{"route", alert.Route, "model", alert.Model, "scope", alert.Scope, "limit", alert.Limit,
+		"utilization", alert.Utilization, "threshold", alert.Threshold, "since", alert.Since}
+	if alert.Event == AlertFiring {
+		zap.S().Warnw("Quota threshold exceeded", fields...)
+	} else {
+		zap.S().Infow("Quota threshold recovered", fields...)
+	}
+	if a.webhook == "" {
+		return
+	}
+
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, a.webhook, bytes.NewReader(body))
+	if err != nil {
+		zap.S().Errorw("Unable to send quota alert", "webhook", a.webhook, "reason", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		zap.S().Errorw("Unable to send quota alert", "webhook", a.webhook, "reason", err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		zap.S().Errorw("Unable to send quota alert", "webhook", a.webhook, "status", resp.StatusCode)
+	}
+}
+
+// WriteMetrics writes whether each watched limit is alerting, along with its last utilization
+func (a *quotaAlerter) WriteMetrics(w io.Writer) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	keys := sortedModels(a.watches)
+	fmt.Fprintln(w, "# HELP llproxy_quota_utilization Fraction of a limit in use or queued for, as last checked for alerts.")
+	fmt.Fprintln(w, "# TYPE llproxy_quota_utilization gauge")
+	for _, key := range keys {
+		fmt.Fprintf(w, "llproxy_quota_utilization{%s} %g\n", a.watches[key].labels(), a.watches[key].alert.Utilization)
+	}
+	fmt.Fprintln(w, "# HELP llproxy_quota_alert Whether a limit has been above the alert threshold for the alert duration.")
+	fmt.Fprintln(w, "# TYPE llproxy_quota_alert gauge")
+	for _, key := range keys {
+		firing := 0
+		if a.watches[key].firing {
+			firing = 1
+		}
+		fmt.Fprintf(w, "llproxy_quota_alert{%s} %d\n", a.watches[key].labels(), firing)
+	}
+}
+
+func (w *quotaWatch) labels() string {
+	return strings.Join([]string{
+		metricLabel("route", w.alert.Route),
+		metricLabel("model", w.alert.Model),
+		metricLabel("scope", w.alert.Scope),
+		metricLabel("limit", w.alert.Limit),
+	}, ",")
+}
@@ -0,0 +1,81 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotaAlerts(t *testing.T) {
+	received := make(chan QuotaAlert, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert QuotaAlert
+		json.NewDecoder(r.Body).Decode(&alert)
+		received <- alert
+	}))
+	defer webhook.Close()
+
+	openai := NewOpenAI(&RouteConfig{
+		Forward:  FAKE_BASE_URL,
+		Provider: "openai",
+		Models:   map[string]ModelConfig{TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60, TokensPerMinute: 60000}},
+	}, &MockHttpClient{})
+	scheduler := openai.Schedulers()[TEST_MODEL]
+	alerter := newQuotaAlerter(&QuotaAlertConfig{Duration: 60, Webhook: webhook.URL}, Providers{"openai": openai})
+
+	// Nine tenths of the tokens are used, but the requests are still under the threshold
+	scheduler.setCapacity(30, 6000)
+	requests, tokens := scheduler.utilization()
+	assert.InDelta(t, 0.5, requests, 0.01)
+	assert.InDelta(t, 0.9, tokens, 0.01)
+
+	// Only once it's lasted the duration is it alerted on, and only the once
+	start := time.Now()
+	alerter.check(start)
+	alerter.check(start.Add(30 * time.Second))
+	assert.Empty(t, received)
+	alerter.check(start.Add(60 * time.Second))
+	alerter.check(start.Add(70 * time.Second))
+	require.Len(t, received, 1)
+	alert := <-received
+	assert.Equal(t, AlertFiring, alert.Event)
+	assert.Equal(t, "tpm", alert.Limit)
+	assert.Equal(t, TEST_MODEL, alert.Model)
+	assert.InDelta(t, 0.9, alert.Utilization, 0.01)
+	assert.True(t, alert.Since.Equal(start))
+
+	var metrics bytes.Buffer
+	alerter.WriteMetrics(&metrics)
+	assert.Contains(t, metrics.String(), `llproxy_quota_alert{route="openai",model="gpt-3.5-turbo",scope="",limit="tpm"} 1`)
+	assert.Contains(t, metrics.String(), `llproxy_quota_alert{route="openai",model="gpt-3.5-turbo",scope="",limit="rpm"} 0`)
+
+	// Recovering resolves it
+	scheduler.setCapacity(60, 60000)
+	alerter.check(start.Add(80 * time.Second))
+	require.Len(t, received, 1)
+	assert.Equal(t, AlertResolved, (<-received).Event)
+
+	assert.Nil(t, newQuotaAlerter(nil, nil))
+	assert.Error(t, (&QuotaAlertConfig{Webhook: "ftp://alerts"}).validate())
+}
@@ -0,0 +1,101 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Headers Anthropic's API is versioned and opted into beta features with
+const (
+	HeaderAnthropicVersion = "anthropic-version"
+	HeaderAnthropicBeta    = "anthropic-beta"
+)
+
+// AnthropicHeadersConfig manages the anthropic-version and anthropic-beta headers for a route, so enabling a
+// beta is a proxy config change rather than a change to every client
+type AnthropicHeadersConfig struct {
+	// Version is sent when the client doesn't send its own, or always with ForceVersion
+	Version      string `json:"version"`
+	ForceVersion bool   `json:"forceVersion"`
+
+	// Betas are added to every request
+	Betas []string `json:"betas"`
+
+	// AllowedBetas limits the betas clients may ask for, any are passed on when unset
+	AllowedBetas []string `json:"allowedBetas"`
+}
+
+// anthropicHeaders applies a route's AnthropicHeadersConfig, a nil anthropicHeaders leaves requests unchanged
+type anthropicHeaders struct {
+	config  AnthropicHeadersConfig
+	allowed map[string]bool
+}
+
+func newAnthropicHeaders(config *AnthropicHeadersConfig) *anthropicHeaders {
+	if config == nil {
+		return nil
+	}
+	headers := &anthropicHeaders{config: *config}
+	if config.AllowedBetas != nil {
+		headers.allowed = make(map[string]bool)
+		for _, beta := range config.AllowedBetas {
+			headers.allowed[beta] = true
+		}
+	}
+	return headers
+}
+
+// Apply sets the request's version and betas as configured
+func (a *anthropicHeaders) Apply(r *http.Request) {
+	if a == nil {
+		return
+	}
+
+	if a.config.Version != "" && (a.config.ForceVersion || r.Header.Get(HeaderAnthropicVersion) == "") {
+		r.Header.Set(HeaderAnthropicVersion, a.config.Version)
+	}
+
+	// Betas can be sent as one comma separated header or several, they are forwarded as one
+	var betas []string
+	seen := make(map[string]bool)
+	add := func(beta string) {
+		if beta != "" && !seen[beta] {
+			seen[beta] = true
+			betas = append(betas, beta)
+		}
+	}
+	for _, value := range r.Header.Values(HeaderAnthropicBeta) {
+		for _, beta := range strings.Split(value, ",") {
+			beta = strings.TrimSpace(beta)
+			if a.allowed != nil && beta != "" && !a.allowed[beta] {
+				routeLog(r.Context()).Debugw("Dropping anthropic beta", "url", r.URL, "beta", beta, "reason", "BetaNotAllowed")
+				continue
+			}
+			add(beta)
+		}
+	}
+	for _, beta := range a.config.Betas {
+		add(beta)
+	}
+
+	r.Header.Del(HeaderAnthropicBeta)
+	if len(betas) > 0 {
+		r.Header.Set(HeaderAnthropicBeta, strings.Join(betas, ","))
+	}
+}
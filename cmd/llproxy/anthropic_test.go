@@ -0,0 +1,51 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnthropicHeaders(t *testing.T) {
+	headers := newAnthropicHeaders(&AnthropicHeadersConfig{
+		Version:      "2023-06-01",
+		Betas:        []string{"prompt-caching-2024-07-31"},
+		AllowedBetas: []string{"max-tokens-3-5-sonnet-2024-07-15"},
+	})
+
+	// Defaults are added to a bare request
+	r := httptest.NewRequest("POST", "http://localhost:8080/anthropic/v1/messages", nil)
+	headers.Apply(r)
+	assert.Equal(t, "2023-06-01", r.Header.Get(HeaderAnthropicVersion))
+	assert.Equal(t, "prompt-caching-2024-07-31", r.Header.Get(HeaderAnthropicBeta))
+
+	// The client's version is kept, and only its allowed betas
+	r = httptest.NewRequest("POST", "http://localhost:8080/anthropic/v1/messages", nil)
+	r.Header.Set(HeaderAnthropicVersion, "2024-01-01")
+	r.Header.Add(HeaderAnthropicBeta, "max-tokens-3-5-sonnet-2024-07-15, computer-use-2024-10-22")
+	r.Header.Add(HeaderAnthropicBeta, "prompt-caching-2024-07-31")
+	headers.Apply(r)
+	assert.Equal(t, "2024-01-01", r.Header.Get(HeaderAnthropicVersion))
+	assert.Equal(t, []string{"max-tokens-3-5-sonnet-2024-07-15,prompt-caching-2024-07-31"}, r.Header.Values(HeaderAnthropicBeta))
+
+	// Forcing the version overrides the client's
+	headers = newAnthropicHeaders(&AnthropicHeadersConfig{Version: "2023-06-01", ForceVersion: true})
+	headers.Apply(r)
+	assert.Equal(t, "2023-06-01", r.Header.Get(HeaderAnthropicVersion))
+}
@@ -0,0 +1,82 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+
+	"go.uber.org/zap"
+)
+
+// Azure OpenAI requires every request to name the API version it was written against
+const QueryAPIVersion = "api-version"
+
+// APIVersionConfig manages the api-version query parameter for Azure OpenAI routes, so clients don't each hardcode one
+type APIVersionConfig struct {
+	// Default is added to requests without an api-version
+	Default string `json:"default"`
+
+	// Minimum replaces versions older than it with the default, versions are dates so they compare as strings
+	Minimum string `json:"minimum"`
+
+	// Rewrite replaces specific versions, e.g. a retired preview with its GA release
+	Rewrite map[string]string `json:"rewrite"`
+}
+
+// apiVersions applies a route's APIVersionConfig, a nil apiVersions leaves requests unchanged
+type apiVersions struct {
+	config APIVersionConfig
+}
+
+func newAPIVersions(config *APIVersionConfig) *apiVersions {
+	if config == nil {
+		return nil
+	}
+	return &apiVersions{config: *config}
+}
+
+// Apply returns the request with its api-version added or replaced as configured
+func (a *apiVersions) Apply(r *http.Request) *http.Request {
+	if a == nil {
+		return r
+	}
+
+	query := r.URL.Query()
+	requested := query.Get(QueryAPIVersion)
+	version := requested
+	if rewrite, ok := a.config.Rewrite[version]; ok {
+		version = rewrite
+	} else if version == "" || (a.config.Minimum != "" && version < a.config.Minimum) {
+		version = a.config.Default
+	}
+	if version == requested || version == "" {
+		return r
+	}
+	if requested != "" {
+		zap.S().Debugw("Replacing api-version", "url", r.URL, "requested", requested, "version", version)
+	}
+	query.Set(QueryAPIVersion, version)
+
+	// Shallow copy like pathRewriter.Rewrite, the original request is left untouched
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.RawQuery = query.Encode()
+	return r2
+}
@@ -0,0 +1,47 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIVersions(t *testing.T) {
+	versions := newAPIVersions(&APIVersionConfig{
+		Default: "2024-02-01",
+		Minimum: "2023-12-01",
+		Rewrite: map[string]string{"2024-02-15-preview": "2024-03-01-preview"},
+	})
+
+	apply := func(query string) string {
+		r := httptest.NewRequest("POST", "http://localhost:8080/azure/openai/deployments/gpt-4/chat/completions"+query, nil)
+		return versions.Apply(r).URL.RawQuery
+	}
+
+	// Added when missing, keeping the rest of the query
+	assert.Equal(t, "api-version=2024-02-01&x=1", apply("?x=1"))
+	assert.Equal(t, "api-version=2024-02-01", apply("?api-version=2023-05-15"))
+	assert.Equal(t, "api-version=2024-03-01-preview", apply("?api-version=2024-02-15-preview"))
+
+	// Recent enough versions are left as they are
+	assert.Equal(t, "api-version=2024-01-01", apply("?api-version=2024-01-01"))
+
+	r := httptest.NewRequest("POST", "http://localhost:8080/azure/chat/completions", nil)
+	assert.Same(t, r, (*apiVersions)(nil).Apply(r))
+}
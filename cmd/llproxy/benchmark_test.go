@@ -0,0 +1,118 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const BENCHMARK_MODEL = "text-embedding-ada-002"
+
+// Upstream that answers embeddings with a realistically sized body
+type benchmarkHttpClient struct {
+	response []byte
+}
+
+func (m *benchmarkHttpClient) Do(req *http.Request) (*http.Response, error) {
+	// Drain the request like a real transport would
+	io.Copy(io.Discard, req.Body)
+
+	// Hide bytes.Reader's WriterTo, a network body doesn't have one
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(struct{ io.Reader }{bytes.NewReader(m.response)}),
+		Header:     make(http.Header),
+	}, nil
+}
+
+// Response writer that throws the body away, so the benchmark measures the proxy rather than a recorder
+type discardResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (d *discardResponseWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *discardResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (d *discardResponseWriter) WriteHeader(status int) {
+	d.status = status
+}
+
+// BenchmarkEmbeddingHandler drives small embedding calls through the full handler, with
+// limits high enough that the scheduler never makes a request wait.
+func BenchmarkEmbeddingHandler(b *testing.B) {
+	ConfigureLogging(LogType("console"), LogLevel("error"))
+
+	embedding := strings.Repeat("0.0123456789,", 1535) + "0.0123456789"
+	client := &benchmarkHttpClient{
+		response: []byte(fmt.Sprintf(`{"object": "list", "data": [{"object": "embedding", "index": 0, "embedding": [%s]}], "model": "%s"}`, embedding, BENCHMARK_MODEL)),
+	}
+	config := &RouteConfig{
+		Forward:  FAKE_BASE_URL,
+		Provider: "openai",
+		Models: map[string]ModelConfig{
+			BENCHMARK_MODEL: {MaxQueueSize: 1000, ReqsPerMinute: 1e12, TokensPerMinute: 1e15},
+		},
+	}
+	handler := NewOpenAI(config, client).GetHandler()
+	body := []byte(fmt.Sprintf(`{"model": "%s", "input": "The food was delicious and the waiter was very friendly."}`, BENCHMARK_MODEL))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/embeddings", bytes.NewReader(body))
+			w := &discardResponseWriter{header: make(http.Header)}
+			handler(w, req)
+			if w.status != http.StatusOK {
+				b.Fatalf("unexpected status %d", w.status)
+			}
+		}
+	})
+}
+
+// BenchmarkSchedulerSubmit measures admitting requests when capacity is always available
+func BenchmarkSchedulerSubmit(b *testing.B) {
+	ConfigureLogging(LogType("console"), LogLevel("error"))
+
+	schedulers := initSchedulers("openai", map[string]ModelConfig{
+		BENCHMARK_MODEL: {MaxQueueSize: 1000, ReqsPerMinute: 1e12, TokensPerMinute: 1e15},
+	})
+	scheduler := schedulers[BENCHMARK_MODEL]
+	req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/embeddings", nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if scheduler.Submit(req, 100) != Ready {
+				b.Fatal("request was not admitted")
+			}
+		}
+	})
+}
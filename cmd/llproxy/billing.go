@@ -0,0 +1,387 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// How the billing export partitions its files
+const (
+	PartitionHourly = "hourly"
+	PartitionDaily  = "daily"
+)
+
+// The formats the billing export can be written in
+const (
+	BillingFormatCSV     = "csv"
+	BillingFormatParquet = "parquet"
+)
+
+// How often the billing export checks whether a period has ended
+const billingFlushInterval = time.Minute
+
+// Most rows kept for periods that couldn't be written, e.g. while the destination is down
+const maxBillingRows = 100000
+
+// BillingExportConfig writes the usage and cost of requests, rolled up by period, route, model and client
+type BillingExportConfig struct {
+	// Local directory the files are written under, partitioned as date=YYYY-MM-DD[/hour=HH]/usage.csv
+	Directory string `json:"directory"`
+
+	// S3 bucket the files are uploaded to instead
+	S3 *BillingS3Config `json:"s3"`
+
+	// "csv", the default, or "parquet"
+	Format string `json:"format"`
+
+	// "hourly" when unset, or "daily"
+	Partition string `json:"partition"`
+
+	// Only requests to these routes and from these clients are exported, all when unset
+	Routes  []string `json:"routes"`
+	Clients []string `json:"clients"`
+}
+
+func (c *BillingExportConfig) validate() error {
+	if (c.Directory == "") == (c.S3 == nil) {
+		return fmt.Errorf("billingExport requires either a directory or s3")
+	}
+	if c.S3 != nil {
+		if err := c.S3.validate(); err != nil {
+			return err
+		}
+	}
+	switch c.Format {
+	case "", BillingFormatCSV, BillingFormatParquet:
+	default:
+		return fmt.Errorf("billingExport has unknown format '%s', expected '%s' or '%s'", c.Format, BillingFormatCSV, BillingFormatParquet)
+	}
+	switch c.Partition {
+	case "", PartitionHourly, PartitionDaily:
+	default:
+		return fmt.Errorf("billingExport has unknown partition '%s', expected '%s' or '%s'", c.Partition, PartitionHourly, PartitionDaily)
+	}
+	return nil
+}
+
+// BillingRow is the usage of one route, model and client over a period
+type BillingRow struct {
+	Period           time.Time
+	Route            string
+	Model            string
+	Client           string
+	Requests         uint64
+	PromptTokens     uint64
+	CompletionTokens uint64
+	TotalTokens      uint64
+	Cost             float64
+}
+
+var billingColumns = []string{"period", "route", "model", "client", "requests", "prompt_tokens", "completion_tokens", "total_tokens", "cost"}
+
+// billingExporter rolls up finished requests for the current period. Each period's rows are written once it ends,
+// or when the proxy shuts down, so a restart within a period adds rows rather than replacing them. Local CSV files
+// are appended to, other formats and destinations get a new file each time. Rows that couldn't be written are kept
+// for the next attempt.
+type billingExporter struct {
+	config   BillingExportConfig
+	routes   map[string]bool
+	clients  map[string]bool
+	s3       *s3Uploader
+	interval time.Duration
+	stop     chan struct{}
+	stopped  sync.Once
+
+	mu     sync.Mutex
+	period time.Time
+	rows   map[string]*BillingRow
+}
+
+// The billing export, nil when disabled
+var billing *billingExporter
+
+func newBillingExporter(config *BillingExportConfig) *billingExporter {
+	if config == nil {
+		return nil
+	}
+	return &billingExporter{
+		config:   *config,
+		routes:   stringSet(config.Routes),
+		clients:  stringSet(config.Clients),
+		s3:       newS3Uploader(config.S3),
+		interval: billingFlushInterval,
+		stop:     make(chan struct{}),
+		rows:     make(map[string]*BillingRow),
+	}
+}
+
+func stringSet(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
+
+// periodOf is the start of the partition a time falls in, in UTC
+func (b *billingExporter) periodOf(t time.Time) time.Time {
+	if b.config.Partition == PartitionDaily {
+		return t.UTC().Truncate(24 * time.Hour)
+	}
+	return t.UTC().Truncate(time.Hour)
+}
+
+// Add counts a finished request with a model in the period it started in
+func (b *billingExporter) Add(record *RequestRecord) {
+	if b == nil || record.Model == "" {
+		return
+	}
+	if b.routes != nil && !b.routes[record.Route] {
+		return
+	}
+	if b.clients != nil && !b.clients[record.Client] {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	period := b.periodOf(record.Start)
+	if period.After(b.period) {
+		b.flushLocked()
+		b.period = period
+	} else if period.Before(b.period) {
+		// Requests spanning the end of a period are counted in the current one, the previous may already be written
+		period = b.period
+	}
+
+	key := billingKey(period, record.Route, record.Model, record.Client)
+	row, ok := b.rows[key]
+	if !ok {
+		row = &BillingRow{Period: period, Route: record.Route, Model: record.Model, Client: record.Client}
+		b.rows[key] = row
+	}
+	row.Requests++
+	row.Cost += record.Cost
+	if record.Usage != nil {
+		row.PromptTokens += uint64(record.Usage.PromptTokens)
+		row.CompletionTokens += uint64(record.Usage.CompletionTokens)
+		row.TotalTokens += uint64(record.Usage.TotalTokens)
+	}
+}
+
+func billingKey(period time.Time, route string, model string, client string) string {
+	return strings.Join([]string{period.Format(time.RFC3339), route, model, client}, "\x00")
+}
+
+// Run writes each period once it has ended, even if no request arrives to start the next, until Stop is called
+func (b *billingExporter) Run() {
+	if b == nil {
+		return
+	}
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			b.mu.Lock()
+			if period := b.periodOf(now); period.After(b.period) {
+				b.flushLocked()
+				b.period = period
+			}
+			b.mu.Unlock()
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// Stop ends Run and writes the rows of the current period so far, e.g. on shutdown
+func (b *billingExporter) Stop() {
+	if b == nil {
+		return
+	}
+	b.stopped.Do(func() { close(b.stop) })
+	b.Flush()
+}
+
+// Flush writes the rows of the current period so far
+func (b *billingExporter) Flush() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushLocked()
+}
+
+// flushLocked writes the rows of each period, keeping those of periods that couldn't be written
+func (b *billingExporter) flushLocked() {
+	if len(b.rows) == 0 {
+		return
+	}
+	periods := make(map[time.Time][]*BillingRow)
+	for _, row := range b.rows {
+		periods[row.Period] = append(periods[row.Period], row)
+	}
+	b.rows = make(map[string]*BillingRow)
+
+	for period, rows := range periods {
+		sort.Slice(rows, func(i, j int) bool {
+			if rows[i].Route != rows[j].Route {
+				return rows[i].Route < rows[j].Route
+			}
+			if rows[i].Model != rows[j].Model {
+				return rows[i].Model < rows[j].Model
+			}
+			return rows[i].Client < rows[j].Client
+		})
+		path, err := b.write(period, rows)
+		if err == nil {
+			zap.S().Debugw("Wrote billing export", "path", path, "rows", len(rows))
+			continue
+		}
+		if len(b.rows)+len(rows) > maxBillingRows {
+			zap.S().Errorw("Unable to write billing export, dropping rows", "path", path, "rows", len(rows), "reason", err)
+			continue
+		}
+		zap.S().Errorw("Unable to write billing export, keeping rows to retry", "path", path, "rows", len(rows), "reason", err)
+		for _, row := range rows {
+			b.rows[billingKey(row.Period, row.Route, row.Model, row.Client)] = row
+		}
+	}
+}
+
+// write writes a period's rows to the configured destination, returning where they went
+func (b *billingExporter) write(period time.Time, rows []*BillingRow) (string, error) {
+	if b.config.Format != BillingFormatParquet && b.s3 == nil {
+		path := b.path(period)
+		return path, appendBillingRows(path, rows)
+	}
+
+	var data []byte
+	contentType := "text/csv"
+	if b.config.Format == BillingFormatParquet {
+		data, contentType = encodeBillingParquet(rows), "application/vnd.apache.parquet"
+	} else {
+		var buf bytes.Buffer
+		if err := writeBillingCSV(&buf, rows, true); err != nil {
+			return "", err
+		}
+		data = buf.Bytes()
+	}
+
+	// Each write is a file of its own, named so files sort in the order they were written
+	name := b.partition(period) + "/" + fmt.Sprintf("usage-%d.%s", time.Now().UnixNano(), b.extension())
+	if b.s3 != nil {
+		return name, b.s3.Put(name, data, contentType)
+	}
+	path := filepath.Join(b.config.Directory, filepath.FromSlash(name))
+	return path, writeFileAtomic(path, data)
+}
+
+// partition is the directory, or S3 key prefix, of a period
+func (b *billingExporter) partition(period time.Time) string {
+	partition := "date=" + period.Format("2006-01-02")
+	if b.config.Partition != PartitionDaily {
+		partition += "/hour=" + period.Format("15")
+	}
+	return partition
+}
+
+func (b *billingExporter) extension() string {
+	if b.config.Format == BillingFormatParquet {
+		return BillingFormatParquet
+	}
+	return BillingFormatCSV
+}
+
+// path is the local CSV file a period is appended to
+func (b *billingExporter) path(period time.Time) string {
+	return filepath.Join(b.config.Directory, filepath.FromSlash(b.partition(period)), "usage.csv")
+}
+
+// writeFileAtomic writes a file through a temporary one, so readers never see it partly written
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	temp := path + ".tmp"
+	if err := os.WriteFile(temp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+// appendBillingRows appends rows to a CSV file, starting it with a header if it's new
+func appendBillingRows(path string, rows []*BillingRow) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := writeBillingCSV(file, rows, info.Size() == 0); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// writeBillingCSV writes rows as CSV, after a header if asked for
+func writeBillingCSV(w io.Writer, rows []*BillingRow, header bool) error {
+	writer := csv.NewWriter(w)
+	if header {
+		writer.Write(billingColumns)
+	}
+	for _, row := range rows {
+		writer.Write([]string{
+			row.Period.Format(time.RFC3339),
+			row.Route,
+			row.Model,
+			row.Client,
+			strconv.FormatUint(row.Requests, 10),
+			strconv.FormatUint(row.PromptTokens, 10),
+			strconv.FormatUint(row.CompletionTokens, 10),
+			strconv.FormatUint(row.TotalTokens, 10),
+			formatCost(row.Cost),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,254 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+// The billing export writes Parquet itself rather than taking on a library for it. Its files hold a single row group
+// of required, PLAIN encoded and uncompressed columns, which every Parquet reader understands.
+
+// Parquet physical and converted types, and the other enums of its metadata that the export uses
+const (
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+
+	parquetRequired     = 0
+	parquetPlain        = 0
+	parquetRLE          = 3
+	parquetUncompressed = 0
+	parquetDataPage     = 0
+)
+
+// parquetColumn is a column's type and its PLAIN encoded values
+type parquetColumn struct {
+	name      string
+	kind      int32
+	converted int32
+	values    bytes.Buffer
+}
+
+func (c *parquetColumn) addInt64(value int64) {
+	binary.Write(&c.values, binary.LittleEndian, value)
+}
+
+func (c *parquetColumn) addDouble(value float64) {
+	binary.Write(&c.values, binary.LittleEndian, math.Float64bits(value))
+}
+
+func (c *parquetColumn) addString(value string) {
+	binary.Write(&c.values, binary.LittleEndian, uint32(len(value)))
+	c.values.WriteString(value)
+}
+
+// encodeBillingParquet writes rows as a Parquet file with the same columns as the CSV export
+func encodeBillingParquet(rows []*BillingRow) []byte {
+	columns := []*parquetColumn{
+		{name: "period", kind: parquetInt64, converted: parquetTimestampMillis},
+		{name: "route", kind: parquetByteArray, converted: parquetUTF8},
+		{name: "model", kind: parquetByteArray, converted: parquetUTF8},
+		{name: "client", kind: parquetByteArray, converted: parquetUTF8},
+		{name: "requests", kind: parquetInt64, converted: -1},
+		{name: "prompt_tokens", kind: parquetInt64, converted: -1},
+		{name: "completion_tokens", kind: parquetInt64, converted: -1},
+		{name: "total_tokens", kind: parquetInt64, converted: -1},
+		{name: "cost", kind: parquetDouble, converted: -1},
+	}
+	for _, row := range rows {
+		columns[0].addInt64(row.Period.UnixMilli())
+		columns[1].addString(row.Route)
+		columns[2].addString(row.Model)
+		columns[3].addString(row.Client)
+		columns[4].addInt64(int64(row.Requests))
+		columns[5].addInt64(int64(row.PromptTokens))
+		columns[6].addInt64(int64(row.CompletionTokens))
+		columns[7].addInt64(int64(row.TotalTokens))
+		columns[8].addDouble(row.Cost)
+	}
+
+	var file bytes.Buffer
+	file.WriteString("PAR1")
+
+	// Each column chunk is a single data page, the values needing no levels since every column is required
+	chunks := make([]thriftCompact, len(columns))
+	var totalSize int64
+	for i, column := range columns {
+		offset := int64(file.Len())
+		var header thriftCompact
+		header.i32(1, parquetDataPage)
+		header.i32(2, int32(column.values.Len()))
+		header.i32(3, int32(column.values.Len()))
+		header.beginStruct(5)
+		header.i32(1, int32(len(rows)))
+		header.i32(2, parquetPlain)
+		header.i32(3, parquetRLE)
+		header.i32(4, parquetRLE)
+		header.endStruct()
+		header.stop()
+		file.Write(header.Bytes())
+		file.Write(column.values.Bytes())
+		size := int64(file.Len()) - offset
+		totalSize += size
+
+		chunk := &chunks[i]
+		chunk.i64(2, offset)
+		chunk.beginStruct(3)
+		chunk.i32(1, column.kind)
+		chunk.beginList(2, thriftI32, 2)
+		chunk.varint(int64(parquetPlain))
+		chunk.varint(int64(parquetRLE))
+		chunk.beginList(3, thriftBinary, 1)
+		chunk.rawString(column.name)
+		chunk.i32(4, parquetUncompressed)
+		chunk.i64(5, int64(len(rows)))
+		chunk.i64(6, size)
+		chunk.i64(7, size)
+		chunk.i64(9, offset)
+		chunk.endStruct()
+		chunk.stop()
+	}
+
+	var metadata thriftCompact
+	metadata.i32(1, 1)
+	metadata.beginList(2, thriftStruct, len(columns)+1)
+	var root thriftCompact
+	root.binary(4, "schema")
+	root.i32(5, int32(len(columns)))
+	root.stop()
+	metadata.Write(root.Bytes())
+	for _, column := range columns {
+		var element thriftCompact
+		element.i32(1, column.kind)
+		element.i32(3, parquetRequired)
+		element.binary(4, column.name)
+		if column.converted >= 0 {
+			element.i32(6, column.converted)
+		}
+		element.stop()
+		metadata.Write(element.Bytes())
+	}
+	metadata.i64(3, int64(len(rows)))
+	metadata.beginList(4, thriftStruct, 1)
+	var group thriftCompact
+	group.beginList(1, thriftStruct, len(chunks))
+	for i := range chunks {
+		group.Write(chunks[i].Bytes())
+	}
+	group.i64(2, totalSize)
+	group.i64(3, int64(len(rows)))
+	group.stop()
+	metadata.Write(group.Bytes())
+	metadata.binary(6, "llproxy")
+	metadata.stop()
+
+	file.Write(metadata.Bytes())
+	binary.Write(&file, binary.LittleEndian, uint32(metadata.Len()))
+	file.WriteString("PAR1")
+	return file.Bytes()
+}
+
+// Thrift compact protocol field types
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftCompact writes a struct in the Thrift compact protocol Parquet's metadata is encoded with.
+// Structs nested with beginStruct track their own field ids, each struct written on its own is ended with stop.
+type thriftCompact struct {
+	bytes.Buffer
+	last    int16
+	parents []int16
+}
+
+func (t *thriftCompact) field(id int16, kind byte) {
+	if delta := id - t.last; delta > 0 && delta <= 15 {
+		t.WriteByte(byte(delta)<<4 | kind)
+	} else {
+		t.WriteByte(kind)
+		t.varint(int64(id))
+	}
+	t.last = id
+}
+
+// varint writes a zigzag encoded integer, which is how i16, i32 and i64 values are sent
+func (t *thriftCompact) varint(value int64) {
+	t.uvarint(uint64(value<<1) ^ uint64(value>>63))
+}
+
+func (t *thriftCompact) uvarint(value uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	t.Write(buf[:binary.PutUvarint(buf[:], value)])
+}
+
+func (t *thriftCompact) i32(id int16, value int32) {
+	t.field(id, thriftI32)
+	t.varint(int64(value))
+}
+
+func (t *thriftCompact) i64(id int16, value int64) {
+	t.field(id, thriftI64)
+	t.varint(value)
+}
+
+func (t *thriftCompact) binary(id int16, value string) {
+	t.field(id, thriftBinary)
+	t.rawString(value)
+}
+
+// rawString writes a string without a field header, e.g. as a list element
+func (t *thriftCompact) rawString(value string) {
+	t.uvarint(uint64(len(value)))
+	t.WriteString(value)
+}
+
+// beginList starts a list field, its size elements being written straight after
+func (t *thriftCompact) beginList(id int16, kind byte, size int) {
+	t.field(id, thriftList)
+	if size < 15 {
+		t.WriteByte(byte(size)<<4 | kind)
+	} else {
+		t.WriteByte(0xf0 | kind)
+		t.uvarint(uint64(size))
+	}
+}
+
+func (t *thriftCompact) beginStruct(id int16) {
+	t.field(id, thriftStruct)
+	t.parents = append(t.parents, t.last)
+	t.last = 0
+}
+
+func (t *thriftCompact) endStruct() {
+	t.stop()
+	t.last = t.parents[len(t.parents)-1]
+	t.parents = t.parents[:len(t.parents)-1]
+}
+
+func (t *thriftCompact) stop() {
+	t.WriteByte(0)
+}
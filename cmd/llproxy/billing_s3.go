@@ -0,0 +1,164 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// BillingS3Config uploads the billing export to an S3 bucket rather than a local directory.
+// Credentials are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+type BillingS3Config struct {
+	Bucket string `json:"bucket"`
+	Region string `json:"region"`
+
+	// Prepended to the partitioned object keys, e.g. "llproxy/billing"
+	Prefix string `json:"prefix"`
+
+	// Defaults to the region's S3 endpoint, set for S3 compatible stores. Buckets are addressed by path.
+	Endpoint string `json:"endpoint"`
+}
+
+func (c *BillingS3Config) validate() error {
+	if c.Bucket == "" || c.Region == "" {
+		return fmt.Errorf("billingExport s3 requires a bucket and region")
+	}
+	if c.Endpoint != "" {
+		if _, err := url.Parse(c.Endpoint); err != nil {
+			return fmt.Errorf("billingExport s3 has an invalid endpoint '%s': %w", c.Endpoint, err)
+		}
+	}
+	return nil
+}
+
+// s3Uploader puts objects into a bucket, signing requests with AWS Signature Version 4
+type s3Uploader struct {
+	config BillingS3Config
+	client HttpClient
+	now    func() time.Time
+}
+
+func newS3Uploader(config *BillingS3Config) *s3Uploader {
+	if config == nil {
+		return nil
+	}
+	uploader := &s3Uploader{config: *config, client: http.DefaultClient, now: time.Now}
+	if uploader.config.Endpoint == "" {
+		uploader.config.Endpoint = "https://s3." + config.Region + ".amazonaws.com"
+	}
+	uploader.config.Endpoint = strings.TrimSuffix(uploader.config.Endpoint, "/")
+	return uploader
+}
+
+// Put uploads an object under the prefix
+func (s *s3Uploader) Put(key string, body []byte, contentType string) error {
+	if prefix := strings.Trim(s.config.Prefix, "/"); prefix != "" {
+		key = prefix + "/" + key
+	}
+	target, err := url.Parse(s.config.Endpoint + s3EscapePath("/"+s.config.Bucket+"/"+key))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	s.sign(req, body)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("s3 returned %d for %s: %s", resp.StatusCode, key, message)
+	}
+	return nil
+}
+
+// sign adds the headers of a Signature Version 4 signed request
+func (s *s3Uploader) sign(req *http.Request, body []byte) {
+	now := s.now().UTC()
+	date, timestamp := now.Format("20060102"), now.Format("20060102T150405Z")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", timestamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+
+	headers := []string{"content-type", "host", "x-amz-content-sha256", "x-amz-date"}
+	if req.Header.Get("X-Amz-Security-Token") != "" {
+		headers = append(headers, "x-amz-security-token")
+	}
+	var canonicalHeaders strings.Builder
+	for _, header := range headers {
+		value := req.Header.Get(header)
+		if header == "host" {
+			value = req.URL.Host
+		}
+		canonicalHeaders.WriteString(header + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signedHeaders := strings.Join(headers, ";")
+	canonicalRequest := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", timestamp, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+	key := hmacSHA256([]byte("AWS4"+os.Getenv("AWS_SECRET_ACCESS_KEY")), date)
+	for _, part := range []string{s.config.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", os.Getenv("AWS_ACCESS_KEY_ID"), scope, signedHeaders, signature))
+}
+
+// s3EscapePath escapes each segment of a path the way Signature Version 4 expects, keeping only unreserved characters
+func s3EscapePath(path string) string {
+	var escaped strings.Builder
+	for _, b := range []byte(path) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~', b == '/':
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
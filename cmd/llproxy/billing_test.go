@@ -0,0 +1,296 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBillingExport(t *testing.T) {
+	dir := t.TempDir()
+	exporter := newBillingExporter(&BillingExportConfig{Directory: dir, Clients: []string{"search", "chat"}})
+
+	hour := time.Date(2024, 3, 1, 13, 0, 0, 0, time.UTC)
+	add := func(start time.Time, client string, prompt int, completion int, cost float64) {
+		exporter.Add(&RequestRecord{
+			Start:  start,
+			Route:  "openai",
+			Model:  TEST_MODEL,
+			Client: client,
+			Usage:  &Usage{PromptTokens: prompt, CompletionTokens: completion, TotalTokens: prompt + completion},
+			Cost:   cost,
+		})
+	}
+	add(hour.Add(time.Minute), "search", 100, 20, 0.001)
+	add(hour.Add(2*time.Minute), "search", 50, 10, 0.0005)
+	add(hour.Add(3*time.Minute), "chat", 10, 5, 0.0001)
+	add(hour.Add(4*time.Minute), "batch", 1000, 1000, 1)
+
+	// The first request of the next hour writes the last
+	add(hour.Add(time.Hour), "chat", 10, 5, 0.0001)
+	data, err := os.ReadFile(filepath.Join(dir, "date=2024-03-01", "hour=13", "usage.csv"))
+	require.NoError(t, err)
+	assert.Equal(t, "period,route,model,client,requests,prompt_tokens,completion_tokens,total_tokens,cost\n"+
+		"2024-03-01T13:00:00Z,openai,gpt-3.5-turbo,chat,1,10,5,15,0.000100\n"+
+		"2024-03-01T13:00:00Z,openai,gpt-3.5-turbo,search,2,150,30,180,0.001500\n", string(data))
+
+	// Flushing twice within a period appends to its file
+	exporter.Flush()
+	add(hour.Add(time.Hour+time.Minute), "chat", 10, 5, 0.0001)
+	exporter.Flush()
+	data, err = os.ReadFile(filepath.Join(dir, "date=2024-03-01", "hour=14", "usage.csv"))
+	require.NoError(t, err)
+	assert.Equal(t, "period,route,model,client,requests,prompt_tokens,completion_tokens,total_tokens,cost\n"+
+		"2024-03-01T14:00:00Z,openai,gpt-3.5-turbo,chat,1,10,5,15,0.000100\n"+
+		"2024-03-01T14:00:00Z,openai,gpt-3.5-turbo,chat,1,10,5,15,0.000100\n", string(data))
+
+	// Daily partitions have no hour
+	daily := newBillingExporter(&BillingExportConfig{Directory: dir, Partition: PartitionDaily})
+	assert.Equal(t, filepath.Join(dir, "date=2024-03-01", "usage.csv"), daily.path(daily.periodOf(hour)))
+
+	assert.Nil(t, newBillingExporter(nil))
+	assert.NoError(t, (&BillingExportConfig{Directory: dir, Format: "parquet"}).validate())
+	assert.NoError(t, (&BillingExportConfig{S3: &BillingS3Config{Bucket: "bills", Region: "us-east-1"}}).validate())
+	assert.Error(t, (&BillingExportConfig{Directory: dir, Format: "avro"}).validate())
+	assert.Error(t, (&BillingExportConfig{Directory: dir, Partition: "weekly"}).validate())
+	assert.Error(t, (&BillingExportConfig{Directory: dir, S3: &BillingS3Config{Bucket: "bills", Region: "us-east-1"}}).validate())
+	assert.Error(t, (&BillingExportConfig{S3: &BillingS3Config{Bucket: "bills"}}).validate())
+	assert.Error(t, (&BillingExportConfig{}).validate())
+}
+
+func billingRecord(start time.Time, client string) *RequestRecord {
+	return &RequestRecord{
+		Start:  start,
+		Route:  "openai",
+		Model:  TEST_MODEL,
+		Client: client,
+		Usage:  &Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15},
+		Cost:   0.0001,
+	}
+}
+
+func TestBillingExportKeepsUnwritten(t *testing.T) {
+	// The directory can't be created while a file is in its place
+	dir := filepath.Join(t.TempDir(), "billing")
+	require.NoError(t, os.WriteFile(dir, nil, 0o644))
+	exporter := newBillingExporter(&BillingExportConfig{Directory: dir})
+
+	hour := time.Date(2024, 3, 1, 13, 0, 0, 0, time.UTC)
+	exporter.Add(billingRecord(hour, "chat"))
+	exporter.Add(billingRecord(hour.Add(time.Hour), "chat"))
+	exporter.Flush()
+	assert.Len(t, exporter.rows, 2)
+
+	// Both periods are written once the directory can be
+	require.NoError(t, os.Remove(dir))
+	exporter.Flush()
+	assert.Empty(t, exporter.rows)
+	for _, period := range []time.Time{hour, hour.Add(time.Hour)} {
+		data, err := os.ReadFile(exporter.path(period))
+		require.NoError(t, err)
+		assert.Contains(t, string(data), period.Format(time.RFC3339)+",openai,gpt-3.5-turbo,chat,1,10,5,15,0.000100\n")
+	}
+}
+
+func TestBillingExportRun(t *testing.T) {
+	exporter := newBillingExporter(&BillingExportConfig{Directory: t.TempDir()})
+	exporter.interval = 10 * time.Millisecond
+	lastHour := time.Now().Add(-time.Hour)
+	exporter.Add(billingRecord(lastHour, "chat"))
+
+	done := make(chan struct{})
+	go func() {
+		exporter.Run()
+		close(done)
+	}()
+
+	// The ended period is written without waiting for a request, and the next one begins
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(exporter.path(exporter.periodOf(lastHour)))
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	exporter.mu.Lock()
+	assert.Equal(t, exporter.periodOf(time.Now()), exporter.period)
+	exporter.mu.Unlock()
+
+	// A request that started before the write is counted in the current period
+	exporter.Add(billingRecord(lastHour, "chat"))
+	exporter.Stop()
+	<-done
+	_, err := os.Stat(exporter.path(exporter.periodOf(time.Now())))
+	assert.NoError(t, err)
+}
+
+func TestBillingExportParquet(t *testing.T) {
+	dir := t.TempDir()
+	exporter := newBillingExporter(&BillingExportConfig{Directory: dir, Format: BillingFormatParquet})
+	hour := time.Date(2024, 3, 1, 13, 0, 0, 0, time.UTC)
+	exporter.Add(billingRecord(hour, "search"))
+	exporter.Add(billingRecord(hour, "chat"))
+	exporter.Flush()
+
+	files, err := filepath.Glob(filepath.Join(dir, "date=2024-03-01", "hour=13", "usage-*.parquet"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	data, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+
+	// The footer holds the schema and where each column's page starts
+	require.Equal(t, "PAR1", string(data[:4]))
+	require.Equal(t, "PAR1", string(data[len(data)-4:]))
+	length := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	metadata := (&thriftReader{data: data[len(data)-8-length : len(data)-8]}).readStruct()
+	assert.Equal(t, int64(2), metadata[3])
+	var names []string
+	for _, element := range metadata[2].([]any)[1:] {
+		names = append(names, element.(map[int16]any)[4].(string))
+	}
+	assert.Equal(t, billingColumns, names)
+
+	columns := metadata[4].([]any)[0].(map[int16]any)[1].([]any)
+	client := columns[3].(map[int16]any)[3].(map[int16]any)
+	reader := &thriftReader{data: data, pos: int(client[9].(int64))}
+	header := reader.readStruct()
+	assert.Equal(t, int64(2), header[5].(map[int16]any)[1])
+	var clients []string
+	for i := 0; i < 2; i++ {
+		size := int(binary.LittleEndian.Uint32(data[reader.pos:]))
+		clients = append(clients, string(data[reader.pos+4:reader.pos+4+size]))
+		reader.pos += 4 + size
+	}
+	assert.Equal(t, []string{"chat", "search"}, clients)
+
+	cost := columns[8].(map[int16]any)[3].(map[int16]any)
+	reader = &thriftReader{data: data, pos: int(cost[9].(int64))}
+	reader.readStruct()
+	assert.Equal(t, 0.0001, math.Float64frombits(binary.LittleEndian.Uint64(data[reader.pos:])))
+}
+
+// thriftReader decodes Thrift compact structs into maps of field id to value, enough to check the Parquet footer
+type thriftReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	value, n := binary.Uvarint(r.data[r.pos:])
+	r.pos += n
+	return value
+}
+
+func (r *thriftReader) varint() int64 {
+	value := r.uvarint()
+	return int64(value>>1) ^ -int64(value&1)
+}
+
+func (r *thriftReader) readStruct() map[int16]any {
+	fields := make(map[int16]any)
+	var last int16
+	for {
+		header := r.data[r.pos]
+		r.pos++
+		if header == 0 {
+			return fields
+		}
+		id := last + int16(header>>4)
+		if header>>4 == 0 {
+			id = int16(r.varint())
+		}
+		fields[id] = r.readValue(header & 0x0f)
+		last = id
+	}
+}
+
+func (r *thriftReader) readValue(kind byte) any {
+	switch kind {
+	case 1, 2:
+		return kind == 1
+	case 4, 5, 6:
+		return r.varint()
+	case 7:
+		value := math.Float64frombits(binary.LittleEndian.Uint64(r.data[r.pos:]))
+		r.pos += 8
+		return value
+	case 8:
+		size := int(r.uvarint())
+		value := string(r.data[r.pos : r.pos+size])
+		r.pos += size
+		return value
+	case 9:
+		header := r.data[r.pos]
+		r.pos++
+		size := int(header >> 4)
+		if size == 15 {
+			size = int(r.uvarint())
+		}
+		values := make([]any, size)
+		for i := range values {
+			values[i] = r.readValue(header & 0x0f)
+		}
+		return values
+	case 12:
+		return r.readStruct()
+	}
+	panic(fmt.Sprintf("unexpected thrift type %d", kind))
+}
+
+func TestBillingExportS3(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+
+	var paths []string
+	var authorization, body string
+	status := http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+		paths = append(paths, r.URL.EscapedPath())
+		authorization = r.Header.Get("Authorization")
+		data, _ := io.ReadAll(r.Body)
+		body = string(data)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	exporter := newBillingExporter(&BillingExportConfig{S3: &BillingS3Config{Bucket: "bills", Region: "us-east-1", Prefix: "llproxy/", Endpoint: server.URL}})
+	exporter.s3.now = func() time.Time { return time.Date(2024, 3, 1, 14, 0, 0, 0, time.UTC) }
+	exporter.Add(billingRecord(time.Date(2024, 3, 1, 13, 0, 0, 0, time.UTC), "chat"))
+
+	// A failed upload is tried again
+	exporter.Flush()
+	assert.Len(t, exporter.rows, 1)
+	status = http.StatusOK
+	exporter.Flush()
+	assert.Empty(t, exporter.rows)
+
+	require.Len(t, paths, 2)
+	assert.Regexp(t, `^/bills/llproxy/date%3D2024-03-01/hour%3D13/usage-\d+\.csv$`, paths[1])
+	assert.Regexp(t, `^AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20240301/us-east-1/s3/aws4_request, SignedHeaders=content-type;host;x-amz-content-sha256;x-amz-date, Signature=[0-9a-f]{64}$`, authorization)
+	assert.Equal(t, "period,route,model,client,requests,prompt_tokens,completion_tokens,total_tokens,cost\n"+
+		"2024-03-01T13:00:00Z,openai,gpt-3.5-turbo,chat,1,10,5,15,0.000100\n", body)
+}
@@ -0,0 +1,129 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Matches the error encoding/json gives for an empty document, which json.Decoder reports as io.EOF
+var errEmptyBody = errors.New("unexpected end of JSON input")
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// bodyPeeker lets a request body be parsed without reading all of it. Whatever the parser reads
+// is remembered, and the body is reassembled as the peeked bytes followed by the unread remainder
+// which is streamed straight to the upstream.
+type bodyPeeker struct {
+	src    io.ReadCloser
+	peeked *bytes.Buffer
+}
+
+func newBodyPeeker(body io.ReadCloser) *bodyPeeker {
+	return &bodyPeeker{
+		src:    body,
+		peeked: getBuffer(),
+	}
+}
+
+// Reader reads from the body, remembering what was read
+func (p *bodyPeeker) Reader() io.Reader {
+	return &peekReader{p}
+}
+
+// Body returns the complete body, as if it had never been read. The peeked buffer
+// goes back to the pool once it has been replayed.
+func (p *bodyPeeker) Body() io.ReadCloser {
+	return readCloser{io.MultiReader(&pooledBufferReader{p.peeked}, p.src), p.src}
+}
+
+type peekReader struct {
+	p *bodyPeeker
+}
+
+func (r *peekReader) Read(b []byte) (int, error) {
+	n, err := r.p.src.Read(b)
+	r.p.peeked.Write(b[:n])
+	return n, err
+}
+
+// ReadAll reads the rest of the body straight into the peeked buffer and returns it without copying
+func (r *peekReader) ReadAll() ([]byte, error) {
+	start := r.p.peeked.Len()
+	_, err := r.p.peeked.ReadFrom(r.p.src)
+	return r.p.peeked.Bytes()[start:], err
+}
+
+// limitedBody fails the read that takes the body over limit bytes
+type limitedBody struct {
+	body  io.ReadCloser
+	read  int64
+	limit int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	n, err := l.body.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		return n, uploadTooLarge(l.read, l.limit)
+	}
+	return n, err
+}
+
+func (l *limitedBody) Close() error {
+	return l.body.Close()
+}
+
+func uploadTooLarge(size int64, limit int64) error {
+	return &RequestError{
+		Status:  http.StatusRequestEntityTooLarge,
+		Type:    ErrTypeInvalidRequest,
+		Code:    ErrCodeUploadTooLarge,
+		Reason:  RejectTooLarge,
+		Message: fmt.Sprintf("Upload of at least %d bytes exceeds the limit of %d bytes", size, limit),
+	}
+}
+
+// wholeReader is implemented by readers that can hand over the rest of their data in one piece
+type wholeReader interface {
+	ReadAll() ([]byte, error)
+}
+
+func decodeJSON(body io.Reader, v any) error {
+	// Unmarshal in place when we can, rather than json.Decoder copying into buffers of its own
+	if whole, ok := body.(wholeReader); ok {
+		data, err := whole.ReadAll()
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(data, v)
+	}
+
+	err := json.NewDecoder(body).Decode(v)
+	if err == io.EOF {
+		return errEmptyBody
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBodyPeeker_MultipartStopsEarly(t *testing.T) {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	writer.WriteField("model", "whisper-1")
+	file, _ := writer.CreateFormFile("file", "audio.mp3")
+	file.Write(bytes.Repeat([]byte("a"), 1<<20))
+	writer.Close()
+	original := body.Bytes()
+
+	peeker := newBodyPeeker(ioutil.NopCloser(bytes.NewReader(original)))
+	fields, ok, err := multipartFields(writer.FormDataContentType(), peeker.Reader(), "model")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "whisper-1", string(fields["model"]))
+
+	// Only the start of the upload was read to find the model
+	assert.Less(t, peeker.peeked.Len(), 64*1024)
+
+	// The reassembled body is identical to the original
+	replayed, err := ioutil.ReadAll(peeker.Body())
+	assert.NoError(t, err)
+	assert.Equal(t, original, replayed)
+}
+
+func TestBodyPeeker_JSON(t *testing.T) {
+	original := []byte(`{"model": "gpt-3.5-turbo", "prompt": "test"}`)
+	peeker := newBodyPeeker(ioutil.NopCloser(bytes.NewReader(original)))
+
+	var request CompletionRequest
+	assert.NoError(t, decodeJSON(peeker.Reader(), &request))
+	assert.Equal(t, "gpt-3.5-turbo", request.Model)
+
+	replayed, err := ioutil.ReadAll(peeker.Body())
+	assert.NoError(t, err)
+	assert.Equal(t, original, replayed)
+
+	// Empty bodies give the same error as json.Unmarshal
+	assert.Equal(t, errEmptyBody, decodeJSON(bytes.NewReader(nil), &request))
+}
+
+func TestLimitedBody(t *testing.T) {
+	body := &limitedBody{body: ioutil.NopCloser(bytes.NewReader(make([]byte, 2048))), limit: 1024}
+	_, err := ioutil.ReadAll(body)
+
+	var requestError *RequestError
+	assert.True(t, errors.As(err, &requestError))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, requestError.Status)
+
+	body = &limitedBody{body: ioutil.NopCloser(bytes.NewReader(make([]byte, 1024))), limit: 1024}
+	data, err := ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	assert.Len(t, data, 1024)
+}
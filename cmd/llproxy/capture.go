@@ -0,0 +1,383 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HeaderCaptureID names the capture a response's request was kept under, for /admin/captures/{id}
+const HeaderCaptureID = "X-LLProxy-Capture-Id"
+
+// CaptureConfig keeps the request and response bodies of a sample of requests in memory for debugging, compressed
+// and capped so they don't balloon like logging the payloads would. They're read back through /admin/captures.
+type CaptureConfig struct {
+	// Routes whose requests are captured, every route when empty
+	Routes []string `json:"routes"`
+
+	// Fraction of requests captured, 1 by default
+	SampleRate *float64 `json:"sampleRate"`
+
+	// Bytes kept of each request and response body before it's truncated, 64KiB by default
+	MaxBodyBytes int `json:"maxBodyBytes"`
+
+	// Captures kept, 100 by default, and the compressed bytes they may take together, 16MiB by default.
+	// The oldest are dropped first once either is reached.
+	MaxRecords int   `json:"maxRecords"`
+	MaxBytes   int64 `json:"maxBytes"`
+}
+
+func (c *CaptureConfig) validate() error {
+	if c.SampleRate != nil && (*c.SampleRate < 0 || *c.SampleRate > 1) {
+		return fmt.Errorf("capture sampleRate must be between 0 and 1")
+	}
+	if c.MaxBodyBytes < 0 || c.MaxRecords < 0 || c.MaxBytes < 0 {
+		return fmt.Errorf("capture maxBodyBytes, maxRecords and maxBytes can't be negative")
+	}
+	return nil
+}
+
+// Appended to a body that was cut off at maxBodyBytes
+const captureTruncatedMarker = "\n...[truncated %d bytes]"
+
+// CaptureSummary describes a captured request without its bodies, as /admin/captures lists them
+type CaptureSummary struct {
+	ID       string    `json:"id"`
+	Time     time.Time `json:"time"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Route    string    `json:"route,omitempty"`
+	Model    string    `json:"model,omitempty"`
+	Client   string    `json:"client,omitempty"`
+	Status   int       `json:"status"`
+	Duration float64   `json:"duration"`
+
+	// Full sizes of the bodies, and whether what was kept of them was cut short
+	RequestBytes      int64 `json:"requestBytes"`
+	ResponseBytes     int64 `json:"responseBytes"`
+	RequestTruncated  bool  `json:"requestTruncated,omitempty"`
+	ResponseTruncated bool  `json:"responseTruncated,omitempty"`
+
+	// Content-Encoding the bodies were sent with. Gzip bodies are decoded before they're kept, others kept as sent.
+	RequestEncoding  string `json:"requestEncoding,omitempty"`
+	ResponseEncoding string `json:"responseEncoding,omitempty"`
+
+	// What the capture takes in memory
+	StoredBytes int `json:"storedBytes"`
+}
+
+// Capture is a captured request with its bodies, as /admin/captures/{id} returns it
+type Capture struct {
+	CaptureSummary
+	Request  string `json:"request"`
+	Response string `json:"response"`
+}
+
+type storedCapture struct {
+	CaptureSummary
+	request  []byte
+	response []byte
+}
+
+// captureStore is a ring buffer of compressed captures, dropping the oldest once it's over either of its limits
+type captureStore struct {
+	routes       []string
+	sampleRate   float64
+	maxBodyBytes int
+	maxRecords   int
+	maxBytes     int64
+
+	mu       sync.Mutex
+	captures []*storedCapture
+	byID     map[string]*storedCapture
+	bytes    int64
+}
+
+// The proxy's captured requests, nil when nothing is captured
+var captures *captureStore
+
+func newCaptureStore(config *CaptureConfig) *captureStore {
+	if config == nil {
+		return nil
+	}
+	store := &captureStore{
+		routes:       config.Routes,
+		sampleRate:   1,
+		maxBodyBytes: 64 * 1024,
+		maxRecords:   100,
+		maxBytes:     16 * 1024 * 1024,
+		byID:         make(map[string]*storedCapture),
+	}
+	if config.SampleRate != nil {
+		store.sampleRate = *config.SampleRate
+	}
+	if config.MaxBodyBytes > 0 {
+		store.maxBodyBytes = config.MaxBodyBytes
+	}
+	if config.MaxRecords > 0 {
+		store.maxRecords = config.MaxRecords
+	}
+	if config.MaxBytes > 0 {
+		store.maxBytes = config.MaxBytes
+	}
+	return store
+}
+
+// Middleware captures a sample of the requests of the configured routes, once they're done
+func (s *captureStore) Middleware() Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		if s == nil {
+			return next
+		}
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !s.sampled(r) {
+				next(w, r)
+				return
+			}
+
+			id := newCaptureID()
+			w.Header().Set(HeaderCaptureID, id)
+			request := &captureBuffer{max: s.maxBodyBytes}
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = &captureBody{ReadCloser: r.Body, buffer: request}
+			}
+			response := &captureWriter{ResponseWriter: w, buffer: &captureBuffer{max: s.maxBodyBytes}}
+			start := time.Now()
+			next(response, r)
+
+			summary := CaptureSummary{
+				ID:       id,
+				Time:     start,
+				Method:   r.Method,
+				Path:     r.URL.Path,
+				Status:   response.status,
+				Duration: time.Since(start).Seconds(),
+			}
+			if summary.Status == 0 {
+				summary.Status = http.StatusOK
+			}
+			summary.RequestEncoding = r.Header.Get("Content-Encoding")
+			summary.ResponseEncoding = response.Header().Get("Content-Encoding")
+			request.encoding, response.buffer.encoding = summary.RequestEncoding, summary.ResponseEncoding
+			if record := recordFromContext(r.Context()); record != nil {
+				summary.Route, summary.Model, summary.Client = record.Route, record.Model, record.Client
+			}
+			s.add(summary, request, response.buffer)
+		}
+	}
+}
+
+func (s *captureStore) sampled(r *http.Request) bool {
+	if len(s.routes) > 0 && !containsString(s.routes, strings.Split(r.URL.Path, "/")[1]) {
+		return false
+	}
+	return s.sampleRate >= 1 || mathrand.Float64() < s.sampleRate
+}
+
+func (s *captureStore) add(summary CaptureSummary, request, response *captureBuffer) {
+	capture := &storedCapture{CaptureSummary: summary}
+	capture.RequestBytes, capture.RequestTruncated = request.total, request.truncated()
+	capture.ResponseBytes, capture.ResponseTruncated = response.total, response.truncated()
+	capture.request = request.compressed()
+	capture.response = response.compressed()
+	capture.StoredBytes = len(capture.request) + len(capture.response)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.captures = append(s.captures, capture)
+	s.byID[capture.ID] = capture
+	s.bytes += int64(capture.StoredBytes)
+	for len(s.captures) > s.maxRecords || (s.bytes > s.maxBytes && len(s.captures) > 1) {
+		oldest := s.captures[0]
+		s.captures = s.captures[1:]
+		delete(s.byID, oldest.ID)
+		s.bytes -= int64(oldest.StoredBytes)
+	}
+}
+
+// List returns the captures without their bodies, newest first
+func (s *captureStore) List() []CaptureSummary {
+	list := []CaptureSummary{}
+	if s == nil {
+		return list
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.captures) - 1; i >= 0; i-- {
+		list = append(list, s.captures[i].CaptureSummary)
+	}
+	return list
+}
+
+// Get decompresses a capture's bodies, or returns false if it isn't kept
+func (s *captureStore) Get(id string) (Capture, bool) {
+	if s == nil {
+		return Capture{}, false
+	}
+	s.mu.Lock()
+	stored, ok := s.byID[id]
+	s.mu.Unlock()
+	if !ok {
+		return Capture{}, false
+	}
+	return Capture{
+		CaptureSummary: stored.CaptureSummary,
+		Request:        decompressCapture(stored.request),
+		Response:       decompressCapture(stored.response),
+	}, true
+}
+
+func newCaptureID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func decompressCapture(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return ""
+	}
+	body, _ := io.ReadAll(reader)
+	return string(body)
+}
+
+// captureBuffer keeps up to max bytes of a body, counting the rest
+type captureBuffer struct {
+	max      int
+	data     []byte
+	total    int64
+	encoding string
+}
+
+func (b *captureBuffer) keep(p []byte) {
+	b.total += int64(len(p))
+	if room := b.max - len(b.data); room > 0 {
+		if len(p) > room {
+			p = p[:room]
+		}
+		b.data = append(b.data, p...)
+	}
+}
+
+func (b *captureBuffer) truncated() bool {
+	return b.total > int64(len(b.data))
+}
+
+// decoded is what was kept, decompressed up to max bytes if the body was gzipped. A body cut off at max bytes
+// decodes as far as it goes.
+func (b *captureBuffer) decoded() []byte {
+	switch strings.ToLower(b.encoding) {
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(bytes.NewReader(b.data))
+		if err != nil {
+			return b.data
+		}
+		decoded, _ := io.ReadAll(io.LimitReader(reader, int64(b.max)))
+		return decoded
+	}
+	return b.data
+}
+
+// compressed gzips what was kept, marking where it was cut off
+func (b *captureBuffer) compressed() []byte {
+	if b.total == 0 {
+		return nil
+	}
+	var out bytes.Buffer
+	writer := gzip.NewWriter(&out)
+	writer.Write(b.decoded())
+	if b.truncated() {
+		fmt.Fprintf(writer, captureTruncatedMarker, b.total-int64(len(b.data)))
+	}
+	writer.Close()
+	return out.Bytes()
+}
+
+// captureBody keeps what's read of a request body
+type captureBody struct {
+	io.ReadCloser
+	buffer *captureBuffer
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buffer.keep(p[:n])
+	return n, err
+}
+
+// captureWriter keeps what's written of a response body, and its status
+type captureWriter struct {
+	http.ResponseWriter
+	buffer *captureBuffer
+	status int
+}
+
+func (cw *captureWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *captureWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	n, err := cw.ResponseWriter.Write(p)
+	cw.buffer.keep(p[:n])
+	return n, err
+}
+
+func (cw *captureWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func (cw *captureWriter) Flush() {
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func getCaptures() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/captures"), "/")
+		if id == "" {
+			writeJSON(w, captures.List())
+			return
+		}
+		capture, ok := captures.Get(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, ErrTypeInvalidRequest, ErrCodeInvalidRequest, fmt.Sprintf("No capture with id '%s'", id))
+			return
+		}
+		writeJSON(w, capture)
+	}
+}
@@ -0,0 +1,115 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCaptureStore(t *testing.T) {
+	store := newCaptureStore(&CaptureConfig{Routes: []string{"openai"}, MaxBodyBytes: 10, MaxRecords: 2})
+	handler := store.Middleware()(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(strings.ToUpper(string(body))))
+	})
+	send := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "http://localhost:8080"+path, strings.NewReader(body)))
+		return w
+	}
+
+	// Bodies past the cap are cut off with a marker, the full sizes are kept
+	w := send("/openai/v1/completions", "hello world, again")
+	assert.Equal(t, "HELLO WORLD, AGAIN", w.Body.String())
+	id := w.Header().Get(HeaderCaptureID)
+	assert.NotEmpty(t, id)
+	capture, ok := store.Get(id)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusCreated, capture.Status)
+	assert.Equal(t, "hello worl\n...[truncated 8 bytes]", capture.Request)
+	assert.Equal(t, "HELLO WORL\n...[truncated 8 bytes]", capture.Response)
+	assert.Equal(t, int64(18), capture.RequestBytes)
+	assert.True(t, capture.RequestTruncated)
+
+	// Other routes aren't captured
+	w = send("/other/v1/completions", "hi")
+	assert.Empty(t, w.Header().Get(HeaderCaptureID))
+
+	// The oldest capture is dropped once there are too many
+	second := send("/openai/v1/completions", "hi").Header().Get(HeaderCaptureID)
+	third := send("/openai/v1/completions", "there").Header().Get(HeaderCaptureID)
+	_, ok = store.Get(id)
+	assert.False(t, ok)
+	list := store.List()
+	if assert.Len(t, list, 2) {
+		assert.Equal(t, third, list[0].ID)
+		assert.Equal(t, second, list[1].ID)
+		assert.False(t, list[1].RequestTruncated)
+	}
+
+	// The admin endpoint lists them and returns each by id, with the admin token
+	captures = store
+	defer func() { captures = nil }()
+	admin := newAdminRouter(Providers{})
+	get := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://localhost:8081"+path, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		return w
+	}
+	assert.Equal(t, http.StatusForbidden, get("/admin/captures").Code)
+	withAdminAuth(t, "secret")
+	w = get("/admin/captures/" + second)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &capture))
+	assert.Equal(t, "hi", capture.Request)
+	assert.Equal(t, "HI", capture.Response)
+
+	w = get("/admin/captures")
+	var summaries []CaptureSummary
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &summaries))
+	assert.Len(t, summaries, 2)
+
+	assert.Equal(t, http.StatusNotFound, get("/admin/captures/"+id).Code)
+}
+
+func TestCaptureGzip(t *testing.T) {
+	store := newCaptureStore(&CaptureConfig{})
+	handler := store.Middleware()(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		writer := gzip.NewWriter(w)
+		writer.Write([]byte(`{"choices": []}`))
+		writer.Close()
+	})
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", strings.NewReader("{}")))
+
+	// Compressed responses are kept decoded, so they can be read back
+	capture, ok := store.Get(w.Header().Get(HeaderCaptureID))
+	assert.True(t, ok)
+	assert.Equal(t, `{"choices": []}`, capture.Response)
+	assert.Equal(t, "gzip", capture.ResponseEncoding)
+}
@@ -0,0 +1,208 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"net/http"
+	"strconv"
+)
+
+// Headers read by the proxy, and never forwarded
+const (
+	HeaderClientKey  = "X-LLProxy-Key"
+	HeaderPriority   = "X-LLProxy-Priority"
+	HeaderMaxRetries = "X-LLProxy-Max-Retries"
+	HeaderNoQueue    = "X-LLProxy-No-Queue"
+	HeaderTimeout    = "X-LLProxy-Timeout"
+
+	// Tokens the request will use by the caller's count, only trusted from keys with a tokenEstimate policy
+	HeaderTokenEstimate = "X-LLProxy-Token-Estimate"
+)
+
+type clientContextKey struct{}
+
+// Client is the caller of a request, identified by its proxy key
+type Client struct {
+	Name       string
+	Priority   PriorityPolicy
+	Tags       map[string]string
+	MaxRetries *int
+
+	// Trusted to estimate its requests' tokens, nil when it isn't
+	TokenEstimate *TokenEstimatePolicy
+}
+
+// anonymousClient is used for callers without a known key, its priority can't be changed
+var anonymousClient = &Client{Name: "anonymous"}
+
+// clientKeys finds clients by the hash of their key, so lookups don't leak key contents through timing
+type clientKeys map[[sha256.Size]byte]*Client
+
+func newClientKeys(config *Config) clientKeys {
+	keys := make(clientKeys)
+	for _, clientConfig := range config.Clients {
+		client := &Client{Name: clientConfig.Name, Priority: config.DefaultPriority, Tags: clientConfig.Tags, MaxRetries: clientConfig.MaxRetries, TokenEstimate: clientConfig.TokenEstimate}
+		if clientConfig.Priority != nil {
+			client.Priority = *clientConfig.Priority
+		}
+		keys[sha256.Sum256([]byte(clientConfig.Key))] = client
+	}
+	return keys
+}
+
+// identifyClients attaches the calling Client to each request and removes the proxy's own headers before
+// anything can forward them. The priority header is only kept as far as the client's policy allows, and the
+// tags header is added to the client's own tags in the request's record. Clients with their own fallbacks can
+// opt out of queueing and upstream retries with the no queue and max retries headers, and say how long they'll
+// wait for a response with the timeout header. Trusted clients can estimate their request's tokens with the token
+// estimate header.
+func identifyClients(keys clientKeys, defaultPriority PriorityPolicy) Middleware {
+	anonymous := &Client{Name: anonymousClient.Name, Priority: defaultPriority}
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			client := anonymous
+			if key := r.Header.Get(HeaderClientKey); key != "" {
+				if known, ok := keys[sha256.Sum256([]byte(key))]; ok {
+					client = known
+				}
+			}
+			r.Header.Del(HeaderClientKey)
+
+			priority := client.Priority.Clamp(r.Header.Get(HeaderPriority))
+			r.Header.Del(HeaderPriority)
+
+			tags := mergeTags(client.Tags, parseTags(r.Header.Get(HeaderTags)))
+			r.Header.Del(HeaderTags)
+			if record := recordFromContext(r.Context()); record != nil {
+				record.Client, record.Tags = client.Name, tags
+			}
+
+			retries := -1
+			if value, err := strconv.Atoi(r.Header.Get(HeaderMaxRetries)); err == nil && value >= 0 {
+				retries = value
+			}
+			noQueue, _ := strconv.ParseBool(r.Header.Get(HeaderNoQueue))
+			timeout, err := strconv.ParseFloat(r.Header.Get(HeaderTimeout), 64)
+			if err != nil || timeout < 0 {
+				timeout = 0
+			}
+			tokenEstimate := client.TokenEstimate.Clamp(r.Header.Get(HeaderTokenEstimate))
+			r.Header.Del(HeaderMaxRetries)
+			r.Header.Del(HeaderNoQueue)
+			r.Header.Del(HeaderTimeout)
+			r.Header.Del(HeaderTokenEstimate)
+
+			ctx := context.WithValue(r.Context(), clientContextKey{}, &requestClient{client, priority, retries, noQueue, timeout, tokenEstimate})
+			next(w, r.WithContext(ctx))
+		}
+	}
+}
+
+type requestClient struct {
+	*Client
+	priority int
+
+	// Upstream retries asked for, -1 when the header wasn't sent
+	retries int
+	noQueue bool
+
+	// Seconds the client waits for a response, 0 when the header wasn't sent
+	timeout float64
+
+	// Tokens the client estimated for the request, 0 when it didn't or isn't trusted to
+	tokenEstimate int
+}
+
+// clientFromContext returns the request's client and its allowed priority, or the anonymous client
+func clientFromContext(ctx context.Context) (*Client, int) {
+	if rc, ok := ctx.Value(clientContextKey{}).(*requestClient); ok {
+		return rc.Client, rc.priority
+	}
+	return anonymousClient, anonymousClient.Priority.Default
+}
+
+// clientRetries returns how many times the request's upstream 429s may be retried, given the model's configured retries.
+// Clients may ask for fewer, or for more up to their key's maxRetries.
+func clientRetries(ctx context.Context, configured int) int {
+	rc, ok := ctx.Value(clientContextKey{}).(*requestClient)
+	if !ok || rc.retries < 0 {
+		return configured
+	}
+	limit := configured
+	if rc.MaxRetries != nil {
+		limit = *rc.MaxRetries
+	}
+	if rc.retries > limit {
+		return limit
+	}
+	return rc.retries
+}
+
+// clientTimeout returns the seconds the request's client said it waits for a response, 0 if it didn't say
+func clientTimeout(ctx context.Context) float64 {
+	if rc, ok := ctx.Value(clientContextKey{}).(*requestClient); ok {
+		return rc.timeout
+	}
+	return 0
+}
+
+// clientTokenEstimate returns the tokens the request's trusted client estimated for it, 0 if it didn't
+func clientTokenEstimate(ctx context.Context) int {
+	if rc, ok := ctx.Value(clientContextKey{}).(*requestClient); ok {
+		return rc.tokenEstimate
+	}
+	return 0
+}
+
+// clientNoQueue is true when the request's client asked to be rejected rather than queued if there's no capacity
+func clientNoQueue(ctx context.Context) bool {
+	rc, ok := ctx.Value(clientContextKey{}).(*requestClient)
+	return ok && rc.noQueue
+}
+
+// Clamp parses a token estimate and limits it to the policy. Without a policy, or for anything but a positive
+// whole number of tokens, it's 0 and the proxy's own estimate is used.
+func (p *TokenEstimatePolicy) Clamp(estimate string) int {
+	if p == nil || estimate == "" {
+		return 0
+	}
+	tokens, err := strconv.Atoi(estimate)
+	if err != nil || tokens < 1 {
+		return 0
+	}
+	if p.Max > 0 && tokens > p.Max {
+		return p.Max
+	}
+	return tokens
+}
+
+// Clamp parses a requested priority and limits it to the policy, falling back to the default when unset or invalid
+func (p PriorityPolicy) Clamp(requested string) int {
+	priority, err := strconv.Atoi(requested)
+	if err != nil {
+		return p.Default
+	}
+	if priority < p.Min {
+		return p.Min
+	}
+	if priority > p.Max {
+		return p.Max
+	}
+	return priority
+}
@@ -0,0 +1,251 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentifyClients(t *testing.T) {
+	config := &Config{
+		Clients: []ClientConfig{
+			{Name: "interactive", Key: "key-interactive", Priority: &PriorityPolicy{Default: 0, Min: -10, Max: 10}},
+			{Name: "batch", Key: "key-batch"},
+		},
+		// Unknown callers may only lower their priority
+		DefaultPriority: PriorityPolicy{Default: 0, Min: -10, Max: 0},
+	}
+
+	var client *Client
+	var priority int
+	var forwarded http.Header
+	handler := identifyClients(newClientKeys(config), config.DefaultPriority)(func(w http.ResponseWriter, r *http.Request) {
+		client, priority = clientFromContext(r.Context())
+		forwarded = r.Header
+	})
+
+	call := func(key string, requested string) {
+		req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", nil)
+		if key != "" {
+			req.Header.Set(HeaderClientKey, key)
+		}
+		req.Header.Set(HeaderPriority, requested)
+		handler(httptest.NewRecorder(), req)
+	}
+
+	call("key-interactive", "5")
+	assert.Equal(t, "interactive", client.Name)
+	assert.Equal(t, 5, priority)
+	assert.Empty(t, forwarded.Get(HeaderClientKey))
+	assert.Empty(t, forwarded.Get(HeaderPriority))
+
+	call("key-interactive", "50")
+	assert.Equal(t, 10, priority)
+
+	call("key-batch", "-5")
+	assert.Equal(t, "batch", client.Name)
+	assert.Equal(t, -5, priority)
+
+	call("key-batch", "5")
+	assert.Equal(t, 0, priority)
+
+	call("wrong-key", "5")
+	assert.Equal(t, "anonymous", client.Name)
+	assert.Equal(t, 0, priority)
+
+	call("", "not a number")
+	assert.Equal(t, 0, priority)
+}
+
+func TestClientRetryHeaders(t *testing.T) {
+	three := 3
+	config := &Config{
+		Clients: []ClientConfig{
+			{Name: "trusted", Key: "key-trusted", MaxRetries: &three},
+			{Name: "other", Key: "key-other"},
+		},
+	}
+
+	var retries int
+	var noQueue bool
+	var forwarded http.Header
+	handler := identifyClients(newClientKeys(config), config.DefaultPriority)(func(w http.ResponseWriter, r *http.Request) {
+		retries, noQueue = clientRetries(r.Context(), 1), clientNoQueue(r.Context())
+		forwarded = r.Header
+	})
+
+	call := func(key string, maxRetries string, noQueue string) {
+		req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", nil)
+		req.Header.Set(HeaderClientKey, key)
+		req.Header.Set(HeaderMaxRetries, maxRetries)
+		req.Header.Set(HeaderNoQueue, noQueue)
+		handler(httptest.NewRecorder(), req)
+	}
+
+	// Without the headers the model's configured retries apply, and requests queue
+	call("key-other", "", "")
+	assert.Equal(t, 1, retries)
+	assert.False(t, noQueue)
+
+	call("key-other", "0", "true")
+	assert.Equal(t, 0, retries)
+	assert.True(t, noQueue)
+	assert.Empty(t, forwarded.Get(HeaderMaxRetries))
+	assert.Empty(t, forwarded.Get(HeaderNoQueue))
+
+	// Only keys allowed more may raise the retries, and then only to their limit
+	call("key-other", "5", "")
+	assert.Equal(t, 1, retries)
+	call("key-trusted", "5", "")
+	assert.Equal(t, 3, retries)
+	call("key-trusted", "not a number", "")
+	assert.Equal(t, 1, retries)
+}
+
+func TestClientTokenEstimate(t *testing.T) {
+	config := &Config{
+		Clients: []ClientConfig{
+			{Name: "trusted", Key: "key-trusted", TokenEstimate: &TokenEstimatePolicy{Max: 1000}},
+			{Name: "other", Key: "key-other"},
+		},
+	}
+
+	var estimate int
+	var forwarded http.Header
+	handler := identifyClients(newClientKeys(config), config.DefaultPriority)(func(w http.ResponseWriter, r *http.Request) {
+		estimate, forwarded = clientTokenEstimate(r.Context()), r.Header
+	})
+
+	call := func(key string, tokens string) int {
+		req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", nil)
+		req.Header.Set(HeaderClientKey, key)
+		req.Header.Set(HeaderTokenEstimate, tokens)
+		handler(httptest.NewRecorder(), req)
+		assert.Empty(t, forwarded.Get(HeaderTokenEstimate))
+		return estimate
+	}
+
+	// Untrusted keys' estimates are ignored, trusted ones are bounded
+	assert.Equal(t, 0, call("key-other", "300"))
+	assert.Equal(t, 300, call("key-trusted", "300"))
+	assert.Equal(t, 1000, call("key-trusted", "50000"))
+	assert.Equal(t, 0, call("key-trusted", "0"))
+	assert.Equal(t, 0, call("key-trusted", "-5"))
+	assert.Equal(t, 0, call("key-trusted", "lots"))
+}
+
+func TestSchedulerSubmit_NoQueue(t *testing.T) {
+	schedulers := initSchedulers("openai", map[string]ModelConfig{
+		TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 30, ReqsPerMinute: 600.0, TokensPerMinute: 60000.0},
+	})
+	scheduler := schedulers[TEST_MODEL]
+	scheduler.setCapacity(0, 60000)
+
+	req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", nil)
+	response, reason := scheduler.SubmitWithReason(req, 100, SubmitOptions{NoQueue: true})
+	assert.Equal(t, Response(RateLimit), response)
+	assert.Equal(t, RejectRateLimited, reason)
+	assert.Equal(t, 0, scheduler.Snapshot().QueuedRequests)
+}
+
+func TestClientTimeoutBudget(t *testing.T) {
+	var maxWait float64
+	config := &ClientTimeoutConfig{UserAgents: map[string]float64{"OpenAI/": 600, "OpenAI/Python": 300}, Default: 60}
+	handler := identifyClients(clientKeys{}, PriorityPolicy{})(func(w http.ResponseWriter, r *http.Request) {
+		maxWait = config.MaxWait(r)
+		assert.Empty(t, r.Header.Get(HeaderTimeout))
+	})
+	call := func(timeout string, agent string) float64 {
+		req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", nil)
+		req.Header.Set(HeaderTimeout, timeout)
+		req.Header.Set("User-Agent", agent)
+		handler(httptest.NewRecorder(), req)
+		return maxWait
+	}
+
+	// The client's own timeout wins, then the most specific user agent, then the route's default
+	assert.InDelta(t, 8, call("10", "OpenAI/Python 1.3.0"), 0.001)
+	assert.InDelta(t, 240, call("", "OpenAI/Python 1.3.0"), 0.001)
+	assert.InDelta(t, 480, call("", "OpenAI/NodeJS 4.0.0"), 0.001)
+	assert.InDelta(t, 48, call("not a number", "curl/8.0"), 0.001)
+	config = nil
+	assert.Equal(t, 0.0, call("", "curl/8.0"))
+
+	// A request projected to wait longer than its budget is refused rather than queued
+	schedulers := initSchedulers("openai", map[string]ModelConfig{
+		TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 60, ReqsPerMinute: 6.0, TokensPerMinute: 60000.0},
+	})
+	scheduler := schedulers[TEST_MODEL]
+	scheduler.setCapacity(0, 60000)
+	req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", nil)
+	response, reason := scheduler.SubmitWithReason(req, 100, SubmitOptions{MaxWait: 5})
+	assert.Equal(t, Response(RateLimit), response)
+	assert.Equal(t, RejectDeadlineExceeded, reason)
+	assert.Equal(t, 0, scheduler.Snapshot().QueuedRequests)
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	schedulers := initSchedulers("openai", map[string]ModelConfig{
+		TEST_MODEL: {MaxQueueSize: 10, ReqsPerMinute: 120.0, TokensPerMinute: 60000.0},
+	})
+	scheduler := schedulers[TEST_MODEL]
+	scheduler.setCapacity(0, 60000)
+
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	submit := func(priority int) {
+		defer wg.Done()
+		req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", nil)
+		assert.Equal(t, Response(Ready), scheduler.SubmitWith(req, 100, SubmitOptions{Priority: priority}))
+		mu.Lock()
+		order = append(order, priority)
+		mu.Unlock()
+	}
+
+	// The low priority request is queued first, but the high priority one overtakes it
+	wg.Add(2)
+	go submit(-1)
+	time.Sleep(50 * time.Millisecond)
+	go submit(5)
+	wg.Wait()
+
+	assert.Equal(t, []int{5, -1}, order)
+}
+
+func TestSchedulerSubmit_MaxQueueSize(t *testing.T) {
+	schedulers := initSchedulers("openai", map[string]ModelConfig{
+		TEST_MODEL: {MaxQueueSize: 1, ReqsPerMinute: 600.0, TokensPerMinute: 60000.0},
+	})
+	scheduler := schedulers[TEST_MODEL]
+	scheduler.setCapacity(0, 60000)
+
+	done := make(chan Response)
+	go func() {
+		done <- scheduler.Submit(httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", nil), 100)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// The queue is full
+	assert.Equal(t, Response(RateLimit), scheduler.Submit(httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", nil), 100))
+	assert.Equal(t, Response(Ready), <-done)
+}
@@ -0,0 +1,53 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import "time"
+
+// monoTime is a reading of the monotonic clock, the time since the process started. Unlike the wall clock it only
+// moves forward, at a steady rate, whatever NTP or a VM migration does to the time of day, so capacity is accounted
+// on it rather than on time.Time values, which lose their monotonic reading once serialized, rounded or converted.
+type monoTime time.Duration
+
+// The wall clock and monotonic readings monoTime counts from
+var monoEpoch = time.Now()
+
+// monoNow reads the monotonic clock. Schedulers read it through their own now, which tests replace to step time
+// without sleeping.
+var monoNow = func() monoTime {
+	return monoTime(time.Since(monoEpoch))
+}
+
+// Sub returns the duration t-u
+func (t monoTime) Sub(u monoTime) time.Duration {
+	return time.Duration(t - u)
+}
+
+// Add returns t+d
+func (t monoTime) Add(d time.Duration) monoTime {
+	return t + monoTime(d)
+}
+
+// Before reports whether t is before u
+func (t monoTime) Before(u monoTime) bool {
+	return t < u
+}
+
+// Time returns the time of day t was, for display, by the monotonic clock's count back from now
+func (t monoTime) Time() time.Time {
+	return time.Now().Add(-monoNow().Sub(t))
+}
@@ -0,0 +1,78 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMonoClock(t *testing.T) {
+	first := monoNow()
+	time.Sleep(time.Millisecond)
+	assert.True(t, first.Before(monoNow()))
+	assert.Equal(t, 2*time.Second, first.Add(2*time.Second).Sub(first))
+	assert.WithinDuration(t, time.Now(), monoNow().Time(), 10*time.Millisecond)
+}
+
+// Capacity is accounted on the monotonic clock, so an NTP step or VM migration moving the wall clock, however far,
+// only ever shows up as the steady time elapsed between readings
+func TestCapacityClockSteps(t *testing.T) {
+	scheduler := NewScheduler("openai", TEST_MODEL, ModelConfig{MaxQueueSize: 10, ReqsPerMinute: 60, TokensPerMinute: 60000})
+	start := scheduler.started
+	now := start
+	scheduler.now = func() monoTime { return now }
+	drained := &CapacitySnapshot{updated: start}
+
+	// The wall clock stepping forward an hour in the second after the scheduler was drained refills a second's worth
+	state := scheduler.refill(drained, start.Add(time.Second))
+	assert.InDelta(t, 1, state.RequestCapacity, 0.001)
+	assert.InDelta(t, 1000, state.TokenCapacity, 0.001)
+
+	// A reading from before the last update, as the wall clock stepping back would have given, recovers nothing,
+	// and doesn't hold up what recovers after it
+	stale := scheduler.refill(&state, start)
+	assert.Equal(t, state, stale)
+	state = scheduler.refill(&stale, start.Add(3*time.Second))
+	assert.InDelta(t, 3, state.RequestCapacity, 0.001)
+
+	// Admissions count in the throughput window by the monotonic second too
+	var window throughputWindow
+	window.Add(start, 1, 100)
+	requests, tokens := window.PerMinute(start.Add(59 * time.Second))
+	assert.Equal(t, 1.0, requests)
+	assert.Equal(t, 100.0, tokens)
+	requests, _ = window.PerMinute(start.Add(61 * time.Second))
+	assert.Zero(t, requests)
+
+	// The scheduler itself reads its own clock, so stepping it shows up in what it admits and reports
+	scheduler.setCapacity(0, 0)
+	assert.False(t, scheduler.tryAcquire(100))
+	now = now.Add(time.Second)
+	assert.InDelta(t, 1, scheduler.Snapshot().RequestCapacity, 0.001)
+	assert.InDelta(t, 1000, scheduler.Snapshot().TokenCapacity, 0.001)
+	assert.True(t, scheduler.tryAcquire(100))
+	assert.False(t, scheduler.tryAcquire(100))
+
+	// A step back recovers nothing, nor gives back the capacity used
+	now = now.Add(-time.Hour)
+	snapshot := scheduler.Snapshot()
+	assert.InDelta(t, 0, snapshot.RequestCapacity, 0.001)
+	assert.InDelta(t, 900, snapshot.TokenCapacity, 0.001)
+	assert.False(t, scheduler.tryAcquire(100))
+}
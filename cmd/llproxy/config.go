@@ -16,9 +16,13 @@ limitations under the License.
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"strings"
+	"time"
 )
 
 type ModelConfig struct {
@@ -27,28 +31,338 @@ type ModelConfig struct {
 	ReqsPerMinute   float64 `json:"rpm"`
 	TokensPerMinute float64 `json:"tpm"`
 	CharsPerMinute  float64 `json:"cpm"`
+
+	// Thresholds below rpm and tpm that only warn, in a response header and the logs
+	SoftLimits *SoftLimitConfig `json:"softLimits"`
+
+	// Response tokens assumed per choice when a request doesn't set max_tokens, and whether to learn it from responses
+	ResponseTokens      int  `json:"responseTokens"`
+	LearnResponseTokens bool `json:"learnResponseTokens"`
+
+	// Disabled models answer with a 503, the message, Retry-After seconds, expected recovery time and docs link are optional
+	Disabled             bool       `json:"disabled"`
+	DisabledMessage      string     `json:"disabledMessage"`
+	DisabledRetryAfter   int        `json:"disabledRetryAfter"`
+	DisabledRecoveryTime *time.Time `json:"disabledRecoveryTime"`
+	DisabledDocsURL      string     `json:"disabledDocsUrl"`
+
+	// Space requests evenly over the minute as a leaky bucket, rather than letting a minute's capacity go in a burst
+	Pacing bool `json:"pacing"`
+
+	// What to do with requests there is no capacity for yet, "queue" when unset, "reject" or "shed-above-depth"
+	QueueMode string `json:"queueMode"`
+	ShedDepth int    `json:"shedDepth"`
+
+	// Fraction of capacity a scheduler starts with, full when unset, and seconds over which
+	// its recovery rate ramps up to the limits after starting
+	InitialFill *float64 `json:"initialFill"`
+	RampUp      float64  `json:"rampUp"`
+
+	// How many times a request the upstream rate limits is queued again rather than passing on the 429
+	UpstreamRateLimitRetries int `json:"upstreamRateLimitRetries"`
+
+	// Seconds between queue position keepalives sent to waiting streamed requests, 0 to disable
+	QueueKeepalive float64 `json:"queueKeepalive"`
+
+	// Fraction of tpm only requests of at most smallRequestTokens may use, so small calls keep
+	// flowing while large ones wait. Small requests may also be admitted ahead of a waiting large one.
+	SmallRequestReserve float64 `json:"smallRequestReserve"`
+	SmallRequestTokens  float64 `json:"smallRequestTokens"`
+
+	// Seconds a queued request waits for each step its priority is raised by, and seconds after which
+	// it goes to the head of the queue whatever its priority, 0 to disable either
+	PriorityAging   float64 `json:"priorityAging"`
+	MaxPriorityWait float64 `json:"maxPriorityWait"`
+
+	// Price of the model's tokens, for the cost headers
+	Price *PriceConfig `json:"price"`
+
+	// Tokens the model's context window holds, requests whose prompt and max_tokens won't fit are rejected
+	// before they are queued, 0 to leave it to the upstream
+	ContextWindow int `json:"contextWindow"`
+
+	// Drop a chat's oldest messages to fit its contextWindow, rather than rejecting it
+	TruncatePrompt bool `json:"truncatePrompt"`
+
+	// Split embeddings requests with more inputs than one upstream call takes
+	EmbeddingBatch *EmbeddingBatchConfig `json:"embeddingBatch"`
+
+	// Static headers, overriding the route's
+	RequestHeaders  map[string]string `json:"requestHeaders"`
+	ResponseHeaders map[string]string `json:"responseHeaders"`
+
+	// Environment variable holding the upstream API key for this model's requests, overriding the route's
+	APIKeyEnv string `json:"apiKeyEnv"`
+
+	// Endpoints the model may be requested on, further restricting the route's, any when empty
+	Endpoints []EndpointConfig `json:"endpoints"`
 }
 
 type RouteConfig struct {
-	Forward  string                 `json:"forward"`
-	Provider string                 `json:"provider"`
-	Models   map[string]ModelConfig `json:"models"`
+	Forward              string                     `json:"forward"`
+	Upstreams            []string                   `json:"upstreams"`
+	UpstreamAllowlist    []string                   `json:"upstreamAllowlist"`
+	SchedulerScope       []string                   `json:"schedulerScope"`
+	SchedulerScopeValues []string                   `json:"schedulerScopeValues"`
+	StickyHeader         string                     `json:"stickyHeader"`
+	Hosts                []string                   `json:"hosts"`
+	Provider             string                     `json:"provider"`
+	Models               map[string]ModelConfig     `json:"models"`
+	BatchModels          map[string]ModelConfig     `json:"batchModels"`
+	AssistantModel       string                     `json:"assistantModel"`
+	DefaultModelConfig   json.RawMessage            `json:"defaultModelConfig"`
+	InspectBatchFiles    bool                       `json:"inspectBatchFiles"`
+	FineTuning           *FineTuningConfig          `json:"fineTuning"`
+	MaxUploadBytes       int64                      `json:"maxUploadBytes"`
+	PathLimits           map[string]PathLimitConfig `json:"pathLimits"`
+	RouteLimit           *RouteLimitConfig          `json:"routeLimit"`
+	ClientTimeout        *ClientTimeoutConfig       `json:"clientTimeout"`
+	Paths                *PathConfig                `json:"paths"`
+	RequestTransform     *RequestTransformConfig    `json:"requestTransform"`
+	ResponseTransform    *ResponseTransformConfig   `json:"responseTransform"`
+	NormalizeErrors      *NormalizeErrorsConfig     `json:"normalizeErrors"`
+	LimitDiscovery       *LimitDiscoveryConfig      `json:"limitDiscovery"`
+	Disabled             bool                       `json:"disabled"`
+	DisabledMessage      string                     `json:"disabledMessage"`
+	DisabledRetryAfter   int                        `json:"disabledRetryAfter"`
+	DisabledRecoveryTime *time.Time                 `json:"disabledRecoveryTime"`
+	DisabledDocsURL      string                     `json:"disabledDocsUrl"`
+	RequestHeaders       map[string]string          `json:"requestHeaders"`
+	ResponseHeaders      map[string]string          `json:"responseHeaders"`
+
+	// Environment variable holding the upstream API key requests are forwarded with, instead of the client's
+	APIKeyEnv string `json:"apiKeyEnv"`
+
+	// APIKeyPool spreads requests across several upstream keys in place of apiKeyEnv
+	APIKeyPool *APIKeyPoolConfig `json:"apiKeyPool"`
+
+	// APIVersion adds and updates the api-version Azure OpenAI expects on every request
+	APIVersion *APIVersionConfig `json:"apiVersion"`
+
+	// Anthropic sets the anthropic-version and anthropic-beta headers for upstreams serving Anthropic's API
+	Anthropic *AnthropicHeadersConfig `json:"anthropic"`
+
+	// StreamShaping throttles streamed responses to each client
+	StreamShaping *StreamShapingConfig `json:"streamShaping"`
+
+	// ContentFilter redacts, replaces or withholds completion text matching its policies
+	ContentFilter *ContentFilterConfig `json:"contentFilter"`
+
+	// FaultInjection adds 429s, latency and dropped streams for testing clients, it can also be set through the admin API
+	FaultInjection *FaultInjectionConfig `json:"faultInjection"`
+
+	// IncludeStreamUsage sets stream_options.include_usage on streamed chat completions so their usage can be accounted,
+	// removing the usage chunk again for clients that didn't ask for it
+	IncludeStreamUsage bool `json:"includeStreamUsage"`
+
+	// RoutingRules send requests to another model or upstream by what they ask for, the first matching rule applying
+	RoutingRules []RoutingRuleConfig `json:"routingRules"`
+
+	// ScopeQuota splits the models' limits between the scheduler scopes, which may borrow from the rest while it's unused
+	ScopeQuota *ScopeQuotaConfig `json:"scopeQuota"`
+
+	// Endpoints requests may reach under the route, anything else is rejected with a 403, any when empty
+	Endpoints []EndpointConfig `json:"endpoints"`
+
+	// DuplicateStorm reports, and can throttle, clients sending the same request over and over
+	DuplicateStorm *DuplicateStormConfig `json:"duplicateStorm"`
+
+	// SamplingGuardrails clamp or reject n, temperature, top_p and logit_bias outside the route's bounds
+	SamplingGuardrails *SamplingGuardrailsConfig `json:"samplingGuardrails"`
+
+	// Deprecations warn the clients of deprecated models by name, and can block them once the models are retired
+	Deprecations map[string]DeprecationConfig `json:"deprecations"`
+
+	// Logging sets the level of the route's request logs, and whether they're access logged, apart from the process'
+	Logging *RouteLoggingConfig `json:"logging"`
+}
+
+// UnmarshalJSON starts each of the route's models and batch models from its defaultModelConfig,
+// so a model's own config only needs the fields that differ
+func (c *RouteConfig) UnmarshalJSON(data []byte) error {
+	type routeConfig RouteConfig
+	var raw struct {
+		routeConfig
+		Models      map[string]json.RawMessage `json:"models"`
+		BatchModels map[string]json.RawMessage `json:"batchModels"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*c = RouteConfig(raw.routeConfig)
+
+	var err error
+	if c.Models, err = inheritModelConfig(c.DefaultModelConfig, raw.Models); err != nil {
+		return err
+	}
+	c.BatchModels, err = inheritModelConfig(c.DefaultModelConfig, raw.BatchModels)
+	return err
+}
+
+// inheritModelConfig decodes each model's config over the defaults. Fields a model sets replace the default,
+// apart from headers which are merged.
+func inheritModelConfig(defaults json.RawMessage, models map[string]json.RawMessage) (map[string]ModelConfig, error) {
+	if models == nil {
+		return nil, nil
+	}
+	configs := make(map[string]ModelConfig, len(models))
+	for model, data := range models {
+		var config ModelConfig
+		if len(defaults) > 0 {
+			if err := json.Unmarshal(defaults, &config); err != nil {
+				return nil, fmt.Errorf("defaultModelConfig: %w", err)
+			}
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("model '%s': %w", model, err)
+		}
+		configs[model] = config
+	}
+	return configs, nil
+}
+
+// PathConfig maps the paths clients use under a route to the upstream's layout
+type PathConfig struct {
+	StripPrefix string        `json:"stripPrefix"`
+	AddPrefix   string        `json:"addPrefix"`
+	Rewrite     []PathRewrite `json:"rewrite"`
+}
+
+// RequestTransformConfig mutates top level fields of JSON request bodies, in the order the fields are listed
+type RequestTransformConfig struct {
+	Delete        []string                   `json:"delete"`
+	Default       map[string]json.RawMessage `json:"default"`
+	Set           map[string]json.RawMessage `json:"set"`
+	SetFromHeader map[string]string          `json:"setFromHeader"`
+	Max           map[string]float64         `json:"max"`
+}
+
+// ResponseTransformConfig mutates upstream responses. Fields are changed in whole JSON bodies only, not in streams.
+type ResponseTransformConfig struct {
+	DeleteHeaders []string          `json:"deleteHeaders"`
+	Delete        []string          `json:"delete"`
+	Rename        map[string]string `json:"rename"`
+	Envelope      string            `json:"envelope"`
+}
+
+type PathRewrite struct {
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+}
+
+type FineTuningConfig struct {
+	JobsPerDay           float64 `json:"jobsPerDay"`
+	MaxTrainingFileBytes int64   `json:"maxTrainingFileBytes"`
 }
 
 type LoggingConfig struct {
 	Level LogLevel `json:"level"`
 	Type  LogType  `json:"type"`
+
+	// AccessLog logs every request once it's done, with its client and tags, structured by default
+	AccessLog       bool            `json:"accessLog"`
+	AccessLogFormat AccessLogFormat `json:"accessLogFormat"`
+
+	// OTLP also exports logs to an OpenTelemetry collector
+	OTLP *OTLPConfig `json:"otlp"`
+
+	// Syslog also sends logs to the local syslog socket or a remote server
+	Syslog *SyslogConfig `json:"syslog"`
+
+	// Capture keeps the bodies of a sample of requests, compressed and capped, for /admin/captures
+	Capture *CaptureConfig `json:"capture"`
 }
 
 type AppConfig struct {
 	Port       int `json:"port"`
 	HealthPort int `json:"healthPort"`
+	AdminPort  int `json:"adminPort"`
+
+	// AdminAuth requires a bearer token on the admin server, which otherwise only listens on loopback
+	AdminAuth *AdminAuthConfig `json:"adminAuth"`
+
+	// AdminFaultInjection adds /admin/faults/set, to inject faults into a route while running, off by default
+	AdminFaultInjection bool `json:"adminFaultInjection"`
+
+	// Listeners replace the ports above for the servers they name
+	Listeners []ListenerConfig `json:"listeners"`
+
+	// UpstreamConnections recycles the connections requests are forwarded on
+	UpstreamConnections UpstreamConnectionConfig `json:"upstreamConnections"`
+
+	// Shutdown controls how requests are drained on SIGINT or SIGTERM
+	Shutdown ShutdownConfig `json:"shutdown"`
+
+	// MaxInflight caps the requests and request body bytes the proxy holds at once
+	MaxInflight InflightLimitConfig `json:"maxInflight"`
+
+	// TokenizerDir holds the tiktoken data files, e.g. cl100k_base.tiktoken, so they're never downloaded
+	TokenizerDir string `json:"tokenizerDir"`
+}
+
+// ClientConfig is a caller identified by the key it sends in X-LLProxy-Key
+type ClientConfig struct {
+	Name     string          `json:"name"`
+	Key      string          `json:"key"`
+	Priority *PriorityPolicy `json:"priority"`
+
+	// Tags are added to every request sent with the key, the X-LLProxy-Tags header overrides them
+	Tags map[string]string `json:"tags"`
+
+	// The most upstream retries the key may ask for with X-LLProxy-Max-Retries. Unset, the header can only
+	// lower a model's upstreamRateLimitRetries.
+	MaxRetries *int `json:"maxRetries"`
+
+	// Lets the key send X-LLProxy-Token-Estimate, which is scheduled on in place of the proxy's own estimate,
+	// e.g. for payloads the proxy can't count. Unset, the header is ignored.
+	TokenEstimate *TokenEstimatePolicy `json:"tokenEstimate"`
+}
+
+// TokenEstimatePolicy bounds the token estimates a trusted caller may send
+type TokenEstimatePolicy struct {
+	// Estimates above max are scheduled as max, 0 leaving them to the model's tpm
+	Max int `json:"max"`
+}
+
+// PriorityPolicy limits the X-LLProxy-Priority a caller may set, higher being more urgent.
+// The zero policy pins every request to priority 0.
+type PriorityPolicy struct {
+	Default int `json:"default"`
+	Min     int `json:"min"`
+	Max     int `json:"max"`
 }
 
 type Config struct {
-	Application AppConfig              `json:"app"`
-	Logging     LoggingConfig          `json:"logging"`
-	Routes      map[string]RouteConfig `json:"routes"`
+	Application     AppConfig              `json:"app"`
+	Logging         LoggingConfig          `json:"logging"`
+	Routes          map[string]RouteConfig `json:"routes"`
+	Clients         []ClientConfig         `json:"clients"`
+	DefaultPriority PriorityPolicy         `json:"defaultPriority"`
+
+	// DryRun logs what the schedulers would have done with each request but forwards every one straight away
+	DryRun bool `json:"dryRun"`
+
+	// BillingExport periodically writes usage and cost rolled up by hour or day to files for a data warehouse
+	BillingExport *BillingExportConfig `json:"billingExport"`
+
+	// QuotaAlerts warns when a limit stays nearly used up, before requests start being rejected
+	QuotaAlerts *QuotaAlertConfig `json:"quotaAlerts"`
+
+	// Peers shares the limits between replicas by polling each other, without external storage
+	Peers *PeerConfig `json:"peers"`
+
+	// SchedulerSnapshot keeps the schedulers' capacity in a file, so a restart doesn't reset it to full
+	SchedulerSnapshot *SchedulerSnapshotConfig `json:"schedulerSnapshot"`
+
+	// Rejections replaces the messages of rejected requests with templates by reason
+	Rejections *RejectionConfig `json:"rejections"`
+
+	// TagLabels are the request tags kept as metric labels and usage record columns, other tags only reach the access log
+	TagLabels []string `json:"tagLabels"`
+
+	// Where the config was loaded from and the sha256 of its contents, reported by /infoz
+	source   string
+	checksum string
 }
 
 func LoadConfig(configFilePath string) Config {
@@ -58,13 +372,20 @@ func LoadConfig(configFilePath string) Config {
 	if err != nil {
 		panic(fmt.Errorf("Failed to read config file: %v", err))
 	}
+	return parseConfig(data, configFilePath)
+}
+
+// parseConfig unmarshals and validates a config, filling in defaults. The source is where it came from, for /infoz.
+func parseConfig(data []byte, source string) Config {
 
 	// Unmarshal the JSON data into the rateLimitMap
 	var config Config
-	err = json.Unmarshal(data, &config)
+	err := json.Unmarshal(data, &config)
 	if err != nil {
 		panic(fmt.Errorf("Failed to parse config file: %v", err))
 	}
+	config.source = source
+	config.checksum = fmt.Sprintf("%x", sha256.Sum256(data))
 
 	// Set default values
 	if config.Logging.Level == "" {
@@ -73,12 +394,260 @@ func LoadConfig(configFilePath string) Config {
 	if config.Logging.Type == "" {
 		config.Logging.Type = "console"
 	}
+	if config.Logging.AccessLogFormat == "" {
+		config.Logging.AccessLogFormat = AccessLogStructured
+	}
+	switch config.Logging.AccessLogFormat {
+	case AccessLogStructured, AccessLogCommon, AccessLogCombined:
+	default:
+		panic(fmt.Errorf("Logging accessLogFormat '%s' isn't structured, common or combined", config.Logging.AccessLogFormat))
+	}
+	if config.Logging.OTLP != nil && config.Logging.OTLP.Endpoint == "" {
+		panic(fmt.Errorf("Logging otlp requires an endpoint"))
+	}
+	if syslog := config.Logging.Syslog; syslog != nil {
+		if err := syslog.validate(); err != nil {
+			panic(err)
+		}
+	}
+	if capture := config.Logging.Capture; capture != nil {
+		if err := capture.validate(); err != nil {
+			panic(err)
+		}
+	}
+	if alerts := config.QuotaAlerts; alerts != nil {
+		if err := alerts.validate(); err != nil {
+			panic(err)
+		}
+	}
+	if err := config.Application.MaxInflight.validate(); err != nil {
+		panic(err)
+	}
+	if _, err := newRejectionTemplates(config.Rejections); err != nil {
+		panic(err)
+	}
+	if peers := config.Peers; peers != nil {
+		if err := peers.validate(); err != nil {
+			panic(err)
+		}
+		if config.Application.AdminAuth == nil {
+			panic(fmt.Errorf("peers requires app.adminAuth, since they poll each other's admin servers"))
+		}
+	}
+	if snapshot := config.SchedulerSnapshot; snapshot != nil {
+		if err := snapshot.validate(); err != nil {
+			panic(err)
+		}
+	}
+	if export := config.BillingExport; export != nil {
+		if err := export.validate(); err != nil {
+			panic(err)
+		}
+	}
 	if config.Application.Port == 0 {
 		config.Application.Port = 8080
 	}
 	if config.Application.HealthPort == 0 {
 		config.Application.HealthPort = 8081
 	}
+	if config.Application.AdminPort == 0 {
+		config.Application.AdminPort = 8082
+	}
+	if auth := config.Application.AdminAuth; auth != nil {
+		if err := auth.validate(); err != nil {
+			panic(err)
+		}
+	}
+	if config.Application.Shutdown.DrainTimeout == 0 {
+		config.Application.Shutdown.DrainTimeout = defaultDrainTimeout
+	}
+	switch config.Application.Shutdown.SecondSignal {
+	case "":
+		config.Application.Shutdown.SecondSignal = SecondSignalExit
+	case SecondSignalExit, SecondSignalIgnore:
+	default:
+		panic(fmt.Errorf("Invalid shutdown secondSignal '%s', expected '%s' or '%s'", config.Application.Shutdown.SecondSignal, SecondSignalExit, SecondSignalIgnore))
+	}
+
+	// A priority policy has to contain its own default
+	policies := []PriorityPolicy{config.DefaultPriority}
+	for _, client := range config.Clients {
+		if client.Priority != nil {
+			policies = append(policies, *client.Priority)
+		}
+	}
+	for _, policy := range policies {
+		if policy.Default < policy.Min || policy.Default > policy.Max {
+			panic(fmt.Errorf("Priority default %d is outside of its range [%d, %d]", policy.Default, policy.Min, policy.Max))
+		}
+	}
+
+	for route, routeConfig := range config.Routes {
+		for _, models := range []map[string]ModelConfig{routeConfig.Models, routeConfig.BatchModels} {
+			for model, modelConfig := range models {
+				if fill := modelConfig.InitialFill; fill != nil && (*fill < 0 || *fill > 1) {
+					panic(fmt.Errorf("Model '%s' of route '%s' has initialFill %v outside of [0, 1]", model, route, *fill))
+				}
+				switch modelConfig.QueueMode {
+				case "", QueueModeQueue, QueueModeReject, QueueModeShed:
+				default:
+					panic(fmt.Errorf("Model '%s' of route '%s' has unknown queueMode '%s'", model, route, modelConfig.QueueMode))
+				}
+				if name := modelConfig.APIKeyEnv; name != "" && os.Getenv(name) == "" {
+					panic(fmt.Errorf("Model '%s' of route '%s' has apiKeyEnv '%s', which is not set", model, route, name))
+				}
+				if reserve := modelConfig.SmallRequestReserve; reserve < 0 || reserve >= 1 {
+					panic(fmt.Errorf("Model '%s' of route '%s' has smallRequestReserve %v outside of [0, 1)", model, route, reserve))
+				}
+				if modelConfig.SmallRequestReserve > 0 && modelConfig.SmallRequestTokens <= 0 {
+					panic(fmt.Errorf("Model '%s' of route '%s' has a smallRequestReserve without smallRequestTokens", model, route))
+				}
+				if modelConfig.PriorityAging < 0 || modelConfig.MaxPriorityWait < 0 {
+					panic(fmt.Errorf("Model '%s' of route '%s' has a negative priorityAging or maxPriorityWait", model, route))
+				}
+				if price := modelConfig.Price; price != nil && (price.Input < 0 || price.Output < 0) {
+					panic(fmt.Errorf("Model '%s' of route '%s' has a negative price", model, route))
+				}
+				if soft := modelConfig.SoftLimits; soft != nil {
+					if err := soft.validate(modelConfig); err != nil {
+						panic(fmt.Errorf("Model '%s' of route '%s' %v", model, route, err))
+					}
+				}
+				if modelConfig.ContextWindow < 0 {
+					panic(fmt.Errorf("Model '%s' of route '%s' has a negative contextWindow", model, route))
+				}
+				if batch := modelConfig.EmbeddingBatch; batch != nil && (batch.MaxInputs < 0 || batch.MaxTokens < 0) {
+					panic(fmt.Errorf("Model '%s' of route '%s' has a negative embeddingBatch limit", model, route))
+				}
+				for _, endpoint := range modelConfig.Endpoints {
+					if err := endpoint.validate(); err != nil {
+						panic(fmt.Errorf("Model '%s' of route '%s' %v", model, route, err))
+					}
+				}
+				if modelConfig.TruncatePrompt && modelConfig.ContextWindow == 0 {
+					panic(fmt.Errorf("Model '%s' of route '%s' has truncatePrompt without a contextWindow", model, route))
+				}
+				if modelConfig.ShedDepth > modelConfig.MaxQueueSize {
+					panic(fmt.Errorf("Model '%s' of route '%s' has shedDepth %d above its maxQueueSize %d", model, route, modelConfig.ShedDepth, modelConfig.MaxQueueSize))
+				}
+			}
+		}
+		if name := routeConfig.APIKeyEnv; name != "" && os.Getenv(name) == "" {
+			panic(fmt.Errorf("Route '%s' has apiKeyEnv '%s', which is not set", route, name))
+		}
+		if pool := routeConfig.APIKeyPool; pool != nil {
+			if routeConfig.APIKeyEnv != "" {
+				panic(fmt.Errorf("Route '%s' has both apiKeyEnv and apiKeyPool", route))
+			}
+			if err := pool.validate(); err != nil {
+				panic(fmt.Errorf("Route '%s': %v", route, err))
+			}
+		}
+		if version := routeConfig.APIVersion; version != nil && version.Minimum != "" && version.Default < version.Minimum {
+			panic(fmt.Errorf("Route '%s' has apiVersion default '%s' older than its minimum '%s'", route, version.Default, version.Minimum))
+		}
+		if filter := routeConfig.ContentFilter; filter != nil {
+			for _, policy := range filter.Policies {
+				switch policy.Action {
+				case ContentActionRedact, ContentActionReplace, ContentActionAbort:
+				default:
+					panic(fmt.Errorf("Content policy '%s' of route '%s' has unknown action '%s'", policy.Name, route, policy.Action))
+				}
+			}
+		}
+		if faults := routeConfig.FaultInjection; faults != nil {
+			if err := faults.validate(); err != nil {
+				panic(fmt.Errorf("Route '%s': %v", route, err))
+			}
+		}
+		for _, rule := range routeConfig.RoutingRules {
+			if err := rule.validate(routeConfig.Models); err != nil {
+				panic(fmt.Errorf("Route '%s': %v", route, err))
+			}
+		}
+		for class := range routeConfig.PathLimits {
+			if !isPathClass(class) {
+				panic(fmt.Errorf("Route '%s' limits unknown path class '%s', expected one of %v", route, class, pathClasses))
+			}
+		}
+		for _, endpoint := range routeConfig.Endpoints {
+			if err := endpoint.validate(); err != nil {
+				panic(fmt.Errorf("Route '%s': %v", route, err))
+			}
+		}
+		if storm := routeConfig.DuplicateStorm; storm != nil {
+			if err := storm.validate(); err != nil {
+				panic(fmt.Errorf("Route '%s': %v", route, err))
+			}
+		}
+		if guardrails := routeConfig.SamplingGuardrails; guardrails != nil {
+			if err := guardrails.validate(); err != nil {
+				panic(fmt.Errorf("Route '%s': %v", route, err))
+			}
+		}
+		for model, deprecation := range routeConfig.Deprecations {
+			if err := deprecation.validate(); err != nil {
+				panic(fmt.Errorf("Route '%s' model '%s': %v", route, model, err))
+			}
+		}
+		if logging := routeConfig.Logging; logging != nil {
+			if err := logging.validate(); err != nil {
+				panic(fmt.Errorf("Route '%s': %v", route, err))
+			}
+		}
+		if timeout := routeConfig.ClientTimeout; timeout != nil {
+			if err := timeout.validate(); err != nil {
+				panic(fmt.Errorf("Route '%s': %v", route, err))
+			}
+		}
+		if limit := routeConfig.RouteLimit; limit != nil {
+			if err := limit.validate(); err != nil {
+				panic(fmt.Errorf("Route '%s': %v", route, err))
+			}
+		}
+		if model := routeConfig.AssistantModel; model != "" {
+			if _, ok := routeConfig.Models[model]; !ok {
+				panic(fmt.Errorf("Route '%s': assistantModel '%s' isn't one of the route's models", route, model))
+			}
+		}
+		if quota := routeConfig.ScopeQuota; quota != nil {
+			if len(routeConfig.SchedulerScope) == 0 {
+				panic(fmt.Errorf("Route '%s': scopeQuota requires schedulerScope", route))
+			}
+			if err := quota.validate(); err != nil {
+				panic(fmt.Errorf("Route '%s': %v", route, err))
+			}
+		}
+	}
+
+	// A hostname can only select one route
+	hosts := make(map[string]string)
+	for route, routeConfig := range config.Routes {
+		for _, host := range routeConfig.Hosts {
+			host = strings.ToLower(host)
+			if other, ok := hosts[host]; ok {
+				panic(fmt.Errorf("Host '%s' is configured for both routes '%s' and '%s'", host, other, route))
+			}
+			hosts[host] = route
+		}
+	}
+
+	// Listeners serving a single route have to be the proxy's, and the route has to exist. Without a token the
+	// admin server's listeners have to be on loopback, anyone able to reach them could change how traffic is sent.
+	for _, listener := range config.Application.Listeners {
+		if listener.Server == ServerAdmin && listener.Address != "" && config.Application.AdminAuth == nil && !loopbackAddress(listener.Address) {
+			panic(fmt.Errorf("Listener '%s' of the admin server isn't on loopback, which requires app.adminAuth", listener.Address))
+		}
+		if listener.Route == "" {
+			continue
+		}
+		if listener.Server != ServerProxy {
+			panic(fmt.Errorf("Listener '%s' of the %s server can't serve route '%s', only proxy listeners can", listener.Address, listener.Server, listener.Route))
+		}
+		if _, ok := config.Routes[listener.Route]; !ok {
+			panic(fmt.Errorf("Listener '%s' serves route '%s', which isn't configured", listener.Address, listener.Route))
+		}
+	}
 
 	return config
 }
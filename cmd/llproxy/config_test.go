@@ -79,5 +79,85 @@ func TestLoadConfig(t *testing.T) {
 	require.Equal(main.LogType("console"), config.Logging.Type)
 	require.Equal(main.LogLevel("info"), config.Logging.Level)
 	require.Equal(8080, config.Application.Port)
+	require.Equal(8082, config.Application.AdminPort)
 
 }
+
+func TestLoadConfig_DefaultModelConfig(t *testing.T) {
+	require := require.New(t)
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	configContent := `{
+        "routes": {
+            "openai": {
+                "forward": "http://forward1.com",
+                "provider": "openai",
+                "defaultModelConfig": {"maxQueueSize": 50, "maxQueueWait": 2, "rpm": 100, "tpm": 10000, "requestHeaders": {"X-Team": "ml"}},
+                "models": {
+                    "gpt-4": {"tpm": 40000, "requestHeaders": {"X-Tier": "premium"}},
+                    "gpt-3.5-turbo": {}
+                },
+                "batchModels": {
+                    "gpt-4": {"maxQueueWait": 0}
+                }
+            }
+        }
+    }`
+	require.NoError(os.WriteFile(configPath, []byte(configContent), 0644))
+	route := main.LoadConfig(configPath).Routes["openai"]
+
+	// Models only set what differs from the defaults, headers are merged
+	gpt4 := route.Models["gpt-4"]
+	require.Equal(50, gpt4.MaxQueueSize)
+	require.Equal(2.0, gpt4.MaxQueueWait)
+	require.Equal(100.0, gpt4.ReqsPerMinute)
+	require.Equal(40000.0, gpt4.TokensPerMinute)
+	require.Equal(map[string]string{"X-Team": "ml", "X-Tier": "premium"}, gpt4.RequestHeaders)
+	require.Equal(10000.0, route.Models["gpt-3.5-turbo"].TokensPerMinute)
+	require.Equal(map[string]string{"X-Team": "ml"}, route.Models["gpt-3.5-turbo"].RequestHeaders)
+
+	// Explicit zero values override the defaults too
+	require.Equal(0.0, route.BatchModels["gpt-4"].MaxQueueWait)
+	require.Equal(50, route.BatchModels["gpt-4"].MaxQueueSize)
+}
+
+func TestLoadConfigFromEnv(t *testing.T) {
+	require := require.New(t)
+	t.Setenv("LLPROXY_CONFIG", `{"app": {"port": 9000}, "logging": {"level": "warn"}}`)
+	t.Setenv("LLPROXY_ADMIN_PORT", "9002")
+	t.Setenv("LLPROXY_ACCESS_LOG", "true")
+	t.Setenv("LLPROXY_ROUTES", `{"azure": {"forward": "http://azure.example.com", "provider": "openai", "models": {"gpt-4": {"rpm": 10, "tpm": 1000, "maxQueueSize": 5}}}}`)
+	t.Setenv("LLPROXY_ROUTE_0_NAME", "openai")
+	t.Setenv("LLPROXY_ROUTE_0_FORWARD", "http://openai.example.com")
+	t.Setenv("LLPROXY_ROUTE_0_DEFAULT_MODEL_CONFIG", `{"maxQueueSize": 50, "maxQueueWait": 2}`)
+	t.Setenv("LLPROXY_ROUTE_0_MODEL_0_NAME", "gpt-4")
+	t.Setenv("LLPROXY_ROUTE_0_MODEL_0_RPM", "500")
+	t.Setenv("LLPROXY_ROUTE_0_MODEL_0_TPM", "30000")
+	t.Setenv("LLPROXY_ROUTE_0_MODEL_1_NAME", "gpt-3.5-turbo")
+	t.Setenv("LLPROXY_ROUTE_0_MODEL_1_TPM", "90000")
+
+	config := main.LoadConfigFromEnv()
+	require.Equal(9000, config.Application.Port)
+	require.Equal(9002, config.Application.AdminPort)
+	require.Equal(8081, config.Application.HealthPort)
+	require.Equal(main.LogLevel("warn"), config.Logging.Level)
+	require.True(config.Logging.AccessLog)
+
+	// Routes from the JSON blob and the structured scheme are combined, the latter defaulting to the openai provider
+	require.Len(config.Routes, 2)
+	require.Equal(5, config.Routes["azure"].Models["gpt-4"].MaxQueueSize)
+	openai := config.Routes["openai"]
+	require.Equal("openai", openai.Provider)
+	require.Equal("http://openai.example.com", openai.Forward)
+	require.Equal(500.0, openai.Models["gpt-4"].ReqsPerMinute)
+	require.Equal(50, openai.Models["gpt-4"].MaxQueueSize)
+	require.Equal(90000.0, openai.Models["gpt-3.5-turbo"].TokensPerMinute)
+
+	// Admin listeners off loopback need a token
+	t.Setenv("LLPROXY_CONFIG", `{"app": {"port": 9000, "listeners": [{"server": "admin", "address": "0.0.0.0:9002"}]}}`)
+	require.Panics(func() { main.LoadConfigFromEnv() })
+	t.Setenv("LLPROXY_CONFIG", `{"app": {"port": 9000, "listeners": [{"server": "admin", "address": "127.0.0.1:9002"}]}}`)
+	require.NotPanics(func() { main.LoadConfigFromEnv() })
+
+	t.Setenv("LLPROXY_ROUTE_0_MODEL_0_RPM", "lots")
+	require.Panics(func() { main.LoadConfigFromEnv() })
+}
@@ -0,0 +1,225 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// UpstreamConnectionConfig controls how long connections to upstreams are kept, so traffic follows provider failovers
+type UpstreamConnectionConfig struct {
+	// MaxAge retires a connection once it has been open this many seconds, after its current request
+	MaxAge float64 `json:"maxAge"`
+
+	// ResolveInterval re-resolves upstream hostnames this often in seconds, retiring connections to addresses that
+	// are no longer returned
+	ResolveInterval float64 `json:"resolveInterval"`
+}
+
+// newUpstreamClient returns the client used to forward requests, recycling connections as configured
+func newUpstreamClient(config UpstreamConnectionConfig) *http.Client {
+	if config.MaxAge <= 0 && config.ResolveInterval <= 0 {
+		return &http.Client{}
+	}
+	recycler := newConnectionRecycler(config, net.DefaultResolver.LookupHost)
+	if recycler.resolveInterval > 0 {
+		go recycler.resolveLoop()
+	}
+	return &http.Client{Transport: recycler}
+}
+
+// connectionRecycler is a RoundTripper keeping track of every upstream connection it opens. Keep-alive connections
+// otherwise stay pinned to the backend they were opened to until it fails. Retired connections are sent their
+// next request with "Connection: close", so nothing in flight is cut off.
+type connectionRecycler struct {
+	transport       *http.Transport
+	maxAge          time.Duration
+	resolveInterval time.Duration
+	lookup          func(ctx context.Context, host string) ([]string, error)
+
+	mu    sync.Mutex
+	conns map[*agedConn]struct{}
+	hosts map[string][]string // the addresses each dialed host last resolved to
+}
+
+func newConnectionRecycler(config UpstreamConnectionConfig, lookup func(ctx context.Context, host string) ([]string, error)) *connectionRecycler {
+	recycler := &connectionRecycler{
+		transport:       http.DefaultTransport.(*http.Transport).Clone(),
+		maxAge:          time.Duration(config.MaxAge * float64(time.Second)),
+		resolveInterval: time.Duration(config.ResolveInterval * float64(time.Second)),
+		lookup:          lookup,
+		conns:           make(map[*agedConn]struct{}),
+		hosts:           make(map[string][]string),
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	recycler.transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		return recycler.track(conn, host), nil
+	}
+	return recycler
+}
+
+func (c *connectionRecycler) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The connection is only known once the transport has picked it, which is still before the request is written.
+	// By then the transport has copied requests with a body, so it's the header they share that asks for the close,
+	// which the upstream answers by closing the connection after its response.
+	var clone *http.Request
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if conn := asAgedConn(info.Conn); conn != nil && conn.expired(c.maxAge) {
+				clone.Close = true
+				clone.Header.Set("Connection", "close")
+			}
+		},
+	}
+	clone = req.Clone(httptrace.WithClientTrace(req.Context(), trace))
+	if clone.Header == nil {
+		clone.Header = make(http.Header)
+	}
+	return c.transport.RoundTrip(clone)
+}
+
+func (c *connectionRecycler) track(conn net.Conn, host string) *agedConn {
+	aged := &agedConn{Conn: conn, host: host, opened: time.Now(), recycler: c}
+	c.mu.Lock()
+	c.conns[aged] = struct{}{}
+	if _, ok := c.hosts[host]; !ok {
+		c.hosts[host] = nil
+	}
+	c.mu.Unlock()
+	return aged
+}
+
+func (c *connectionRecycler) forget(conn *agedConn) {
+	c.mu.Lock()
+	delete(c.conns, conn)
+	c.mu.Unlock()
+}
+
+func (c *connectionRecycler) resolveLoop() {
+	ticker := time.NewTicker(c.resolveInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.resolve()
+	}
+}
+
+// resolve looks up every host dialed so far, retiring connections to addresses the host no longer resolves to
+func (c *connectionRecycler) resolve() {
+	c.mu.Lock()
+	hosts := make([]string, 0, len(c.hosts))
+	for host := range c.hosts {
+		hosts = append(hosts, host)
+	}
+	c.mu.Unlock()
+
+	changed := false
+	for _, host := range hosts {
+		if net.ParseIP(host) != nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		addrs, err := c.lookup(ctx, host)
+		cancel()
+		if err != nil || len(addrs) == 0 {
+			// Keep the connections we have rather than act on a failed lookup
+			zap.S().Warnw("Unable to resolve upstream", "host", host, "reason", err)
+			continue
+		}
+		sort.Strings(addrs)
+
+		c.mu.Lock()
+		previous := c.hosts[host]
+		c.hosts[host] = addrs
+		if previous != nil && !equalStrings(previous, addrs) {
+			zap.S().Infow("Upstream addresses changed", "host", host, "previous", previous, "addresses", addrs)
+			changed = true
+			current := make(map[string]bool, len(addrs))
+			for _, addr := range addrs {
+				current[addr] = true
+			}
+			for conn := range c.conns {
+				if conn.host == host && !current[conn.remoteIP()] {
+					conn.retired.Store(true)
+				}
+			}
+		}
+		c.mu.Unlock()
+	}
+
+	// Idle connections can be closed straight away, busy ones are retired after their request
+	if changed {
+		c.transport.CloseIdleConnections()
+	}
+}
+
+// agedConn is an upstream connection that knows when it was opened and whether it has been retired
+type agedConn struct {
+	net.Conn
+	host     string
+	opened   time.Time
+	retired  atomic.Bool
+	recycler *connectionRecycler
+}
+
+func (a *agedConn) Close() error {
+	a.recycler.forget(a)
+	return a.Conn.Close()
+}
+
+func (a *agedConn) expired(maxAge time.Duration) bool {
+	return a.retired.Load() || (maxAge > 0 && time.Since(a.opened) > maxAge)
+}
+
+func (a *agedConn) remoteIP() string {
+	host, _, _ := net.SplitHostPort(a.RemoteAddr().String())
+	return host
+}
+
+func asAgedConn(conn net.Conn) *agedConn {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	aged, _ := conn.(*agedConn)
+	return aged
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
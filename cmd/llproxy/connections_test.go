@@ -0,0 +1,121 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingServer counts the connections opened to it
+func countingServer() (*httptest.Server, *atomic.Int32) {
+	var opened atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			opened.Add(1)
+		}
+	}
+	server.Start()
+	return server, &opened
+}
+
+func getDiscarding(t *testing.T, client HttpClient, url string) {
+	sendDiscarding(t, client, "GET", url, nil)
+}
+
+// postDiscarding sends a body the way proxied requests do, which the transport copies the request for
+func postDiscarding(t *testing.T, client HttpClient, url string) {
+	sendDiscarding(t, client, "POST", url, ioutil.NopCloser(strings.NewReader(`{"model": "gpt-3.5-turbo"}`)))
+}
+
+func sendDiscarding(t *testing.T, client HttpClient, method string, url string, body io.Reader) {
+	req, _ := http.NewRequest(method, url, body)
+	resp, err := client.Do(req)
+	if assert.NoError(t, err) {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+func TestConnectionMaxAge(t *testing.T) {
+	server, opened := countingServer()
+	defer server.Close()
+
+	client := newUpstreamClient(UpstreamConnectionConfig{MaxAge: 0.05})
+	getDiscarding(t, client, server.URL)
+	getDiscarding(t, client, server.URL)
+	assert.Equal(t, int32(1), opened.Load())
+
+	// The old connection carries one more request before it is closed
+	time.Sleep(100 * time.Millisecond)
+	getDiscarding(t, client, server.URL)
+	getDiscarding(t, client, server.URL)
+	assert.Equal(t, int32(2), opened.Load())
+
+	// Requests with a body retire it too
+	postDiscarding(t, client, server.URL)
+	time.Sleep(100 * time.Millisecond)
+	postDiscarding(t, client, server.URL)
+	postDiscarding(t, client, server.URL)
+	assert.Equal(t, int32(3), opened.Load())
+}
+
+func TestConnectionResolve(t *testing.T) {
+	server, opened := countingServer()
+	defer server.Close()
+	url := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+
+	addrs := []string{"127.0.0.1"}
+	recycler := newConnectionRecycler(UpstreamConnectionConfig{ResolveInterval: 60}, func(ctx context.Context, host string) ([]string, error) {
+		return addrs, nil
+	})
+	client := &http.Client{Transport: recycler}
+
+	getDiscarding(t, client, url)
+	recycler.resolve()
+	getDiscarding(t, client, url)
+	assert.Equal(t, int32(1), opened.Load())
+
+	// Once localhost resolves elsewhere the existing connection is dropped
+	addrs = []string{"10.0.0.1"}
+	recycler.resolve()
+	addrs = []string{"127.0.0.1"}
+	getDiscarding(t, client, url)
+	assert.Equal(t, int32(2), opened.Load())
+
+	// Busy connections are only marked retired by resolve, those carry one more request with a body before closing
+	recycler.mu.Lock()
+	for conn := range recycler.conns {
+		conn.retired.Store(true)
+	}
+	recycler.mu.Unlock()
+	postDiscarding(t, client, url)
+	postDiscarding(t, client, url)
+	assert.Equal(t, int32(3), opened.Load())
+}
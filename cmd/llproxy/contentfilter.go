@@ -0,0 +1,530 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+// What a content policy does to completion text it matches
+const (
+	ContentActionRedact  = "redact"
+	ContentActionReplace = "replace"
+	ContentActionAbort   = "abort"
+)
+
+// Choices whose text was replaced or withheld finish with this reason, as with OpenAI's own filtering
+const finishReasonContentFilter = "content_filter"
+
+// The replacement for redacted text when a policy doesn't set its own
+const defaultRedaction = "[redacted]"
+
+// Characters of streamed text held back for a policy whose matches have no bound, e.g. with a "*"
+const defaultContentTail = 256
+
+// ContentFilterConfig checks completion text returned by the upstream against policies before it reaches the client
+type ContentFilterConfig struct {
+	Policies []ContentPolicy `json:"policies"`
+}
+
+// ContentPolicy matches completion text with a regular expression. "redact" replaces the matched text,
+// "replace" replaces the whole completion and "abort" withholds it.
+type ContentPolicy struct {
+	Name        string `json:"name"`
+	Match       string `json:"match"`
+	Action      string `json:"action"`
+	Replacement string `json:"replacement"`
+}
+
+type contentPolicy struct {
+	ContentPolicy
+	match *regexp.Regexp
+}
+
+// contentFilter applies a route's ContentFilterConfig, a nil contentFilter passes responses through
+type contentFilter struct {
+	policies []contentPolicy
+
+	// Characters of each streamed choice's text held back, so a match can span chunks
+	tail int
+}
+
+// newContentFilter compiles a route's policies, panicking on an invalid expression like any other bad config
+func newContentFilter(config *ContentFilterConfig) *contentFilter {
+	if config == nil || len(config.Policies) == 0 {
+		return nil
+	}
+	filter := &contentFilter{}
+	for _, policy := range config.Policies {
+		compiled := contentPolicy{ContentPolicy: policy, match: regexp.MustCompile(policy.Match)}
+		if compiled.Action == ContentActionRedact && compiled.Replacement == "" {
+			compiled.Replacement = defaultRedaction
+		}
+		filter.policies = append(filter.policies, compiled)
+
+		length := defaultContentTail + 1
+		if parsed, err := syntax.Parse(policy.Match, syntax.Perl); err == nil {
+			if length = maxMatchLength(parsed.Simplify()); length < 0 {
+				length = defaultContentTail + 1
+			}
+		}
+		if length-1 > filter.tail {
+			filter.tail = length - 1
+		}
+	}
+	return filter
+}
+
+// filterResult is what the policies did to a piece of text
+type filterResult struct {
+	text     string
+	violated []string
+	finished bool // the text was replaced or withheld, the choice is over
+}
+
+// apply checks text against the policies whose action is in actions, in order
+func (f *contentFilter) apply(text string, actions ...string) filterResult {
+	result := filterResult{text: text}
+	for _, policy := range f.policies {
+		if !containsString(actions, policy.Action) || !policy.match.MatchString(result.text) {
+			continue
+		}
+		result.violated = append(result.violated, policy.Name)
+		switch policy.Action {
+		case ContentActionRedact:
+			result.text = policy.match.ReplaceAllString(result.text, policy.Replacement)
+		case ContentActionReplace:
+			result.text, result.finished = policy.Replacement, true
+			return result
+		case ContentActionAbort:
+			result.text, result.finished = "", true
+			return result
+		}
+	}
+	return result
+}
+
+// Hook returns a ResponseHook filtering the completion text of successful responses, or nil if there are no policies.
+// Whole JSON responses are filtered as they are, streams event by event. The client's Accept-Encoding is dropped so
+// the upstream's response can be read, gzip responses are decompressed anyway and any other encoding is withheld.
+func (f *contentFilter) Hook(r *http.Request, model string) ResponseHook {
+	if f == nil {
+		return nil
+	}
+	r.Header.Del("Accept-Encoding")
+	return func(resp *http.Response) {
+		if resp.StatusCode != http.StatusOK {
+			return
+		}
+		if !decodeResponse(resp) {
+			auditContentFilter(r, model, []string{"unreadable encoding " + resp.Header.Get("Content-Encoding")}, false)
+			replaceWithBadGateway(resp, "The upstream's response couldn't be checked by the content filter")
+			return
+		}
+		mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		switch mediaType {
+		case "application/json":
+			original, err := io.ReadAll(resp.Body)
+			if err != nil {
+				// A body cut short can't be checked, and passing on what was read could leak the part the filter missed
+				auditContentFilter(r, model, []string{"unreadable response"}, false)
+				replaceWithBadGateway(resp, "The upstream's response couldn't be checked by the content filter")
+				return
+			}
+			resp.Body.Close()
+			body := original
+			if filtered, violated := f.filterCompletion(original); len(violated) > 0 {
+				auditContentFilter(r, model, violated, false)
+				body = filtered
+			}
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+			resp.ContentLength = int64(len(body))
+			resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		case "text/event-stream":
+			resp.Body = &filteredStream{
+				filter: f,
+				source: bufio.NewReader(resp.Body),
+				body:   resp.Body,
+				held:   make(map[int]string),
+				audit: func(violated []string) {
+					auditContentFilter(r, model, violated, true)
+				},
+			}
+		}
+	}
+}
+
+// decodeResponse replaces a gzip response's body with its decompressed content, returning false if the response
+// has an encoding that can't be decoded
+func decodeResponse(resp *http.Response) bool {
+	switch encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return true
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return false
+		}
+		resp.Body = &decodedBody{Reader: reader, body: resp.Body}
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		resp.Uncompressed = true
+		return true
+	}
+	return false
+}
+
+// decodedBody reads a decompressed body, closing the upstream's
+type decodedBody struct {
+	io.Reader
+	body io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	return b.body.Close()
+}
+
+// filterCompletion filters the text of each choice of a chat completion or completion
+func (f *contentFilter) filterCompletion(body []byte) ([]byte, []string) {
+	var fields map[string]json.RawMessage
+	var choices []map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil || json.Unmarshal(fields["choices"], &choices) != nil {
+		return body, nil
+	}
+
+	var violated []string
+	for _, choice := range choices {
+		result, ok := f.filterChoice(choice, "message", ContentActionRedact, ContentActionReplace, ContentActionAbort)
+		if !ok {
+			continue
+		}
+		violated = append(violated, result.violated...)
+	}
+	if len(violated) == 0 {
+		return body, nil
+	}
+
+	fields["choices"], _ = json.Marshal(choices)
+	filtered, err := json.Marshal(fields)
+	if err != nil {
+		return body, nil
+	}
+	return filtered, violated
+}
+
+// filterChoice filters a choice's text, found under key for chat completions ("message" or "delta") or "text" for
+// completions, and writes it back if a policy matched
+func (f *contentFilter) filterChoice(choice map[string]json.RawMessage, key string, actions ...string) (filterResult, bool) {
+	var text string
+	var message map[string]json.RawMessage
+	if raw, ok := choice["text"]; ok {
+		if json.Unmarshal(raw, &text) != nil {
+			return filterResult{}, false
+		}
+	} else if json.Unmarshal(choice[key], &message) != nil || json.Unmarshal(message["content"], &text) != nil {
+		return filterResult{}, false
+	}
+
+	result := f.apply(text, actions...)
+	if len(result.violated) == 0 {
+		return result, true
+	}
+	encoded, _ := json.Marshal(result.text)
+	if message != nil {
+		message["content"] = encoded
+		choice[key], _ = json.Marshal(message)
+	} else {
+		choice["text"] = encoded
+	}
+	if result.finished {
+		choice["finish_reason"], _ = json.Marshal(finishReasonContentFilter)
+	}
+	return result, true
+}
+
+// filteredStream filters a server sent event stream of completion chunks. The end of each choice's text, as long
+// as the longest match a policy can make, is held back until the next chunk, so matches spanning chunks are caught
+// without scanning everything streamed so far again. Once a replace or abort policy matches, a final chunk with the
+// replacement is sent and the rest of the upstream's stream is dropped.
+type filteredStream struct {
+	filter  *contentFilter
+	source  *bufio.Reader
+	body    io.Closer
+	held    map[int]string
+	last    map[string]json.RawMessage
+	legacy  bool
+	audit   func(violated []string)
+	pending bytes.Buffer
+	done    bool
+	err     error
+}
+
+func (s *filteredStream) Read(p []byte) (int, error) {
+	for s.pending.Len() == 0 && s.err == nil {
+		if s.done {
+			s.err = io.EOF
+			break
+		}
+		line, err := s.source.ReadBytes('\n')
+		if len(line) > 0 {
+			s.filterLine(line)
+		}
+		if err != nil {
+			// Text still held back is sent even when the upstream ends without [DONE]
+			s.flush()
+			s.err = err
+		}
+	}
+	if s.pending.Len() > 0 {
+		return s.pending.Read(p)
+	}
+	return 0, s.err
+}
+
+func (s *filteredStream) Close() error {
+	return s.body.Close()
+}
+
+func (s *filteredStream) filterLine(line []byte) {
+	data := bytes.TrimSpace(bytes.TrimPrefix(line, []byte("data:")))
+	if !bytes.HasPrefix(line, []byte("data:")) {
+		s.pending.Write(line)
+		return
+	}
+	if bytes.Equal(data, []byte("[DONE]")) {
+		s.flush()
+		s.pending.Write(line)
+		return
+	}
+
+	var fields map[string]json.RawMessage
+	var choices []map[string]json.RawMessage
+	if json.Unmarshal(data, &fields) != nil || json.Unmarshal(fields["choices"], &choices) != nil {
+		s.pending.Write(line)
+		return
+	}
+	s.last = fields
+
+	var violated []string
+	changed := false
+	for _, choice := range choices {
+		var index int
+		json.Unmarshal(choice["index"], &index)
+		_, legacy := choice["text"]
+		s.legacy = s.legacy || legacy
+		text, ok := streamedText(choice)
+		if !ok {
+			continue
+		}
+
+		// The text held back from earlier chunks is checked again with this one's, and held back again unless the
+		// choice is finishing
+		result := s.filter.apply(s.held[index]+text, ContentActionRedact, ContentActionReplace, ContentActionAbort)
+		violated = append(violated, result.violated...)
+		if result.finished {
+			encoded, _ := json.Marshal(result.text)
+			choice["delta"], _ = json.Marshal(map[string]json.RawMessage{"content": encoded})
+			choice["finish_reason"], _ = json.Marshal(finishReasonContentFilter)
+			delete(s.held, index)
+			changed, s.done = true, true
+			continue
+		}
+		tail := s.filter.tail
+		if finishReason := choice["finish_reason"]; len(finishReason) > 0 && string(finishReason) != "null" {
+			tail = 0
+		}
+		send, held := splitTail(result.text, tail)
+		s.held[index] = held
+		if send != text {
+			setStreamedText(choice, send)
+			changed = true
+		}
+	}
+	if len(violated) > 0 {
+		s.audit(violated)
+	}
+	if !changed {
+		s.pending.Write(line)
+		return
+	}
+
+	fields["choices"], _ = json.Marshal(choices)
+	filtered, _ := json.Marshal(fields)
+	s.pending.WriteString("data: ")
+	s.pending.Write(filtered)
+	s.pending.WriteString("\n")
+	if s.done {
+		s.pending.WriteString("\ndata: [DONE]\n\n")
+	}
+}
+
+// flush sends the text still held back for each choice in a chunk of its own
+func (s *filteredStream) flush() {
+	if s.done {
+		return
+	}
+	indexes := make([]int, 0, len(s.held))
+	for index, text := range s.held {
+		if text != "" {
+			indexes = append(indexes, index)
+		}
+	}
+	if len(indexes) == 0 {
+		return
+	}
+	sort.Ints(indexes)
+
+	choices := make([]map[string]json.RawMessage, 0, len(indexes))
+	for _, index := range indexes {
+		choice := map[string]json.RawMessage{"finish_reason": json.RawMessage("null")}
+		choice["index"], _ = json.Marshal(index)
+		if !s.legacy {
+			choice["delta"] = json.RawMessage("{}")
+		}
+		setStreamedText(choice, s.held[index])
+		choices = append(choices, choice)
+		delete(s.held, index)
+	}
+
+	// The chunk looks like the upstream's last one, without its usage
+	fields := map[string]json.RawMessage{}
+	for key, value := range s.last {
+		if key != "usage" {
+			fields[key] = value
+		}
+	}
+	fields["choices"], _ = json.Marshal(choices)
+	filtered, _ := json.Marshal(fields)
+	s.pending.WriteString("data: ")
+	s.pending.Write(filtered)
+	s.pending.WriteString("\n\n")
+}
+
+// streamedText returns a streamed choice's text, under "delta" for chat completions or "text" for completions.
+// A delta without content, e.g. only finishing the choice, has empty text.
+func streamedText(choice map[string]json.RawMessage) (string, bool) {
+	var text string
+	if raw, ok := choice["text"]; ok {
+		return text, json.Unmarshal(raw, &text) == nil
+	}
+	var delta map[string]json.RawMessage
+	if json.Unmarshal(choice["delta"], &delta) != nil {
+		return "", false
+	}
+	if content, ok := delta["content"]; ok && string(content) != "null" {
+		return text, json.Unmarshal(content, &text) == nil
+	}
+	return "", true
+}
+
+func setStreamedText(choice map[string]json.RawMessage, text string) {
+	encoded, _ := json.Marshal(text)
+	if _, ok := choice["text"]; ok {
+		choice["text"] = encoded
+		return
+	}
+	var delta map[string]json.RawMessage
+	json.Unmarshal(choice["delta"], &delta)
+	if delta == nil {
+		delta = make(map[string]json.RawMessage)
+	}
+	delta["content"] = encoded
+	choice["delta"], _ = json.Marshal(delta)
+}
+
+// splitTail splits text before its last n characters
+func splitTail(text string, n int) (string, string) {
+	i := len(text)
+	for ; n > 0 && i > 0; n-- {
+		_, size := utf8.DecodeLastRuneInString(text[:i])
+		i -= size
+	}
+	return text[:i], text[i:]
+}
+
+// maxMatchLength is the most characters an expression can match, or -1 when it's unbounded
+func maxMatchLength(re *syntax.Regexp) int {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return len(re.Rune)
+	case syntax.OpCharClass, syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return 1
+	case syntax.OpCapture, syntax.OpQuest:
+		return maxMatchLength(re.Sub[0])
+	case syntax.OpRepeat:
+		sub := maxMatchLength(re.Sub[0])
+		if re.Max < 0 || sub < 0 {
+			return -1
+		}
+		return sub * re.Max
+	case syntax.OpStar, syntax.OpPlus:
+		return -1
+	case syntax.OpConcat:
+		total := 0
+		for _, sub := range re.Sub {
+			length := maxMatchLength(sub)
+			if length < 0 {
+				return -1
+			}
+			total += length
+		}
+		return total
+	case syntax.OpAlternate:
+		longest := 0
+		for _, sub := range re.Sub {
+			length := maxMatchLength(sub)
+			if length < 0 {
+				return -1
+			}
+			if length > longest {
+				longest = length
+			}
+		}
+		return longest
+	}
+	return 0
+}
+
+// auditContentFilter records that a response to a client was filtered
+func auditContentFilter(r *http.Request, model string, violated []string, stream bool) {
+	client, _ := clientFromContext(r.Context())
+	zap.S().Warnw("Content filtered", "url", r.URL, "model", model, "client", client.Name, "policies", violated, "stream", stream)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
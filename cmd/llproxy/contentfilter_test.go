@@ -0,0 +1,155 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp/syntax"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testContentFilter() *contentFilter {
+	return newContentFilter(&ContentFilterConfig{Policies: []ContentPolicy{
+		{Name: "card", Match: `\d{4}-\d{4}-\d{4}-\d{4}`, Action: ContentActionRedact},
+		{Name: "secret", Match: `(?i)project zeus`, Action: ContentActionReplace, Replacement: "I can't discuss that."},
+		{Name: "banned", Match: `forbidden`, Action: ContentActionAbort},
+	}})
+}
+
+func filterResponse(filter *contentFilter, contentType string, body string) string {
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{contentType}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}
+	filter.Hook(httptest.NewRequest("POST", "http://localhost:8080/openai/v1/chat/completions", nil), TEST_MODEL)(resp)
+	filtered, _ := io.ReadAll(resp.Body)
+	return string(filtered)
+}
+
+func TestContentFilter(t *testing.T) {
+	filter := testContentFilter()
+
+	body := filterResponse(filter, "application/json", `{"id": "1", "choices": [{"index": 0, "message": {"role": "assistant", "content": "Card 1234-5678-9012-3456 on file"}, "finish_reason": "stop"}]}`)
+	assert.JSONEq(t, `{"id": "1", "choices": [{"index": 0, "message": {"role": "assistant", "content": "Card [redacted] on file"}, "finish_reason": "stop"}]}`, body)
+
+	body = filterResponse(filter, "application/json", `{"choices": [{"index": 0, "text": "About Project Zeus...", "finish_reason": "stop"}]}`)
+	assert.JSONEq(t, `{"choices": [{"index": 0, "text": "I can't discuss that.", "finish_reason": "content_filter"}]}`, body)
+
+	body = filterResponse(filter, "application/json", `{"choices": [{"index": 0, "message": {"content": "something forbidden"}, "finish_reason": "stop"}]}`)
+	assert.JSONEq(t, `{"choices": [{"index": 0, "message": {"content": ""}, "finish_reason": "content_filter"}]}`, body)
+
+	// Responses without violations are passed on untouched
+	original := `{"choices": [{"index": 0, "message": {"content": "hello"}}],   "usage": {}}`
+	assert.Equal(t, original, filterResponse(filter, "application/json", original))
+}
+
+func TestContentFilterStream(t *testing.T) {
+	filter := newContentFilter(&ContentFilterConfig{Policies: []ContentPolicy{
+		{Name: "secret", Match: `secret`, Action: ContentActionRedact},
+		{Name: "banned", Match: `forbidden`, Action: ContentActionAbort},
+	}})
+	assert.Equal(t, 8, filter.tail)
+	chunk := func(content string) string {
+		return `data: {"choices":[{"delta":{"content":"` + content + `"},"index":0}]}` + "\n\n"
+	}
+
+	// The end of the text is held back, so the match spanning chunks is caught before any of it is sent
+	stream := chunk("Nothing to see here, ") + chunk("this is for") + chunk("bid") + chunk("den") + chunk(" text") + "data: [DONE]\n\n"
+	body := filterResponse(filter, "text/event-stream", stream)
+	assert.Equal(t, chunk("Nothing to se")+chunk("e here, thi")+chunk("s i")+
+		`data: {"choices":[{"delta":{"content":""},"finish_reason":"content_filter","index":0}]}`+"\n\ndata: [DONE]\n\n", body)
+
+	// Redactions span chunks too, and what's held back is sent once the choice finishes
+	stream = chunk("my sec") + chunk("ret is safe") + `data: {"choices":[{"delta":{},"finish_reason":"stop","index":0}]}` + "\n\ndata: [DONE]\n\n"
+	body = filterResponse(filter, "text/event-stream", stream)
+	assert.Equal(t, chunk("")+chunk("my [redacted]")+
+		`data: {"choices":[{"delta":{"content":" is safe"},"finish_reason":"stop","index":0}]}`+"\n\ndata: [DONE]\n\n", body)
+
+	// Or when the stream ends without finishing it
+	body = filterResponse(filter, "text/event-stream", chunk("hello there"))
+	assert.Equal(t, chunk("hel")+`data: {"choices":[{"delta":{"content":"lo there"},"finish_reason":null,"index":0}]}`+"\n\n", body)
+}
+
+func TestContentFilterEncoding(t *testing.T) {
+	filter := testContentFilter()
+
+	// The client can't ask for a response the filter can't read
+	r := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/chat/completions", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	hook := filter.Hook(r, TEST_MODEL)
+	assert.Empty(t, r.Header.Get("Accept-Encoding"))
+
+	// Gzip responses are filtered all the same
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte(`{"choices": [{"index": 0, "message": {"content": "something forbidden"}, "finish_reason": "stop"}]}`))
+	writer.Close()
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}, "Content-Encoding": []string{"gzip"}},
+		Body:       ioutil.NopCloser(&compressed),
+	}
+	hook(resp)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.JSONEq(t, `{"choices": [{"index": 0, "message": {"content": ""}, "finish_reason": "content_filter"}]}`, string(body))
+
+	// Anything else is withheld
+	resp = &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}, "Content-Encoding": []string{"br"}},
+		Body:       ioutil.NopCloser(strings.NewReader("...")),
+	}
+	hook(resp)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	// As is a response that can't be read in full
+	resp = &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(io.MultiReader(strings.NewReader(`{"choices": [{"index": 0, "message": {"content": "Card 1234-`), iotest.ErrReader(errors.New("connection reset")))),
+	}
+	hook(resp)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	body, _ = io.ReadAll(resp.Body)
+	assert.NotContains(t, string(body), "1234")
+}
+
+func TestMaxMatchLength(t *testing.T) {
+	for match, expected := range map[string]int{
+		`forbidden`:               9,
+		`(?i)project zeus`:        12,
+		`\d{4}-\d{4}-\d{4}-\d{4}`: 19,
+		`cat|horse`:               5,
+		`colou?r`:                 6,
+		`secret.*`:                -1,
+	} {
+		parsed, err := syntax.Parse(match, syntax.Perl)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, maxMatchLength(parsed.Simplify()), match)
+	}
+}
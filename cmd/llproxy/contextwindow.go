@@ -0,0 +1,93 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// OpenAI generates this many tokens for a completion that doesn't set max_tokens
+const completionDefaultMaxTokens = 16
+
+// contextLength returns the prompt tokens a request sends and the completion tokens it asks for,
+// ok is false for requests that don't fill a context window
+func contextLength(request Request) (prompt int, completion int, ok bool) {
+	switch request := request.(type) {
+	case *ChatCompletionRequest:
+		// Without max_tokens the model may use whatever the prompt leaves, so only the prompt has to fit
+		completion = request.MaxTokens
+		if completion < 0 {
+			completion = 0
+		}
+		total, err := request.tokensWithResponseEstimate(0)
+		if err != nil {
+			return 0, 0, false
+		}
+		n := request.N
+		if n < 1 {
+			n = 1
+		}
+		return total - n*completion, completion, true
+	case *CompletionRequest:
+		completion = request.MaxTokens
+		if completion < 1 {
+			completion = completionDefaultMaxTokens
+		}
+		return longestPromptTokens(request.Prompt), completion, true
+	}
+	return 0, 0, false
+}
+
+// longestPromptTokens approximates the tokens of the largest prompt in a batch, as each is completed on its own
+func longestPromptTokens(prompt any) int {
+	batch, ok := prompt.([]any)
+	if !ok || len(batch) == 0 {
+		tokens, _ := completionPromptTokens(prompt)
+		return tokens
+	}
+	if _, ok := batch[0].(float64); ok {
+		return len(batch)
+	}
+	longest := 0
+	for _, item := range batch {
+		if tokens, _ := completionPromptTokens(item); tokens > longest {
+			longest = tokens
+		}
+	}
+	return longest
+}
+
+// checkContextWindow returns the error OpenAI would give when a request won't fit a context window of the given size,
+// a window of 0 is never exceeded
+func checkContextWindow(request Request, window int) error {
+	if window <= 0 {
+		return nil
+	}
+	prompt, completion, ok := contextLength(request)
+	if !ok || prompt+completion <= window {
+		return nil
+	}
+	return &RequestError{
+		Status: http.StatusBadRequest,
+		Type:   ErrTypeInvalidRequest,
+		Code:   ErrCodeContextLengthExceeded,
+		Reason: RejectTooLarge,
+		Message: fmt.Sprintf("This model's maximum context length is %d tokens. However, you requested %d tokens (%d in the messages, %d in the completion). Please reduce the length of the messages or completion.",
+			window, prompt+completion, prompt, completion),
+	}
+}
@@ -0,0 +1,80 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContextLength(t *testing.T) {
+	prompt, completion, ok := contextLength(&CompletionRequest{Prompt: strings.Repeat("a", 400), MaxTokens: 50, N: 3})
+	assert.True(t, ok)
+	assert.Equal(t, 100, prompt)
+	assert.Equal(t, 50, completion)
+
+	// Each prompt of a batch has the window to itself, and completions default to 16 tokens
+	prompt, completion, _ = contextLength(&CompletionRequest{Prompt: []any{strings.Repeat("a", 40), strings.Repeat("a", 80)}})
+	assert.Equal(t, 20, prompt)
+	assert.Equal(t, completionDefaultMaxTokens, completion)
+
+	_, _, ok = contextLength(&EmbeddingRequest{})
+	assert.False(t, ok)
+
+	assert.NoError(t, checkContextWindow(&CompletionRequest{Prompt: strings.Repeat("a", 4000), MaxTokens: 1000}, 0))
+	assert.NoError(t, checkContextWindow(&CompletionRequest{Prompt: strings.Repeat("a", 4000), MaxTokens: 1000}, 2000))
+	assert.Error(t, checkContextWindow(&CompletionRequest{Prompt: strings.Repeat("a", 4000), MaxTokens: 1001}, 2000))
+}
+
+func TestContextWindowRejectsBeforeQueueing(t *testing.T) {
+	openai := NewOpenAI(&RouteConfig{
+		Forward:  FAKE_BASE_URL,
+		Provider: "openai",
+		Models: map[string]ModelConfig{
+			TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 30, ReqsPerMinute: 60, TokensPerMinute: 60000, ContextWindow: 4096},
+		},
+	}, &MockHttpClient{})
+	scheduler := openai.schedulers[TEST_MODEL]
+	scheduler.setCapacity(60, 60000)
+	handler := openai.GetHandler()
+
+	body := []byte(`{"model": "gpt-3.5-turbo", "prompt": "` + strings.Repeat("a", 16000) + `", "max_tokens": 100}`)
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewBuffer(body)))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	var response ErrorResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, ErrTypeInvalidRequest, response.Error.Type)
+	assert.Equal(t, ErrCodeContextLengthExceeded, response.Error.Code)
+	assert.Contains(t, response.Error.Message, "maximum context length is 4096 tokens. However, you requested 4100 tokens (4000 in the messages, 100 in the completion)")
+
+	// No capacity was taken for it
+	assert.InDelta(t, 60000, scheduler.Snapshot().TokenCapacity, 10)
+
+	// A request that fits is forwarded as usual
+	body = []byte(`{"model": "gpt-3.5-turbo", "prompt": "` + strings.Repeat("a", 16000) + `", "max_tokens": 96}`)
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewBuffer(body)))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
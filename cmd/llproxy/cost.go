@@ -0,0 +1,76 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Headers pricing a request with its model's price, so callers can attribute spend without a price table of their own.
+// The estimate is sent with every response, the cost once the upstream has reported the usage.
+const (
+	HeaderEstimatedCost = "X-LLProxy-Estimated-Cost"
+	HeaderCost          = "X-LLProxy-Cost"
+)
+
+// PriceConfig is what a model costs in USD per million tokens
+type PriceConfig struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+// Cost of the given prompt and completion tokens, 0 without a price
+func (p *PriceConfig) Cost(promptTokens int, completionTokens int) float64 {
+	if p == nil {
+		return 0
+	}
+	return (float64(promptTokens)*p.Input + float64(completionTokens)*p.Output) / 1e6
+}
+
+// estimatedCost prices the tokens a request was charged, those beyond its prompt at the output price
+func estimatedCost(request Request, tokens int, price *PriceConfig) float64 {
+	prompt := tokens
+	switch request := request.(type) {
+	case *ChatCompletionRequest:
+		if promptTokens, _, ok := contextLength(request); ok {
+			prompt = promptTokens
+		}
+	case *CompletionRequest:
+		prompt, _ = completionPromptTokens(request.Prompt)
+	}
+	if prompt > tokens {
+		prompt = tokens
+	}
+	return price.Cost(prompt, tokens-prompt)
+}
+
+// estimatedCostHook returns a ResponseHook setting the estimated cost header, nil for models without a price
+func estimatedCostHook(request Request, tokens int, price *PriceConfig) ResponseHook {
+	if price == nil {
+		return nil
+	}
+	cost := formatCost(estimatedCost(request, tokens, price))
+	return func(resp *http.Response) {
+		resp.Header.Set(HeaderEstimatedCost, cost)
+	}
+}
+
+// formatCost formats USD to a millionth of a dollar, enough for a single small request
+func formatCost(cost float64) string {
+	return strconv.FormatFloat(cost, 'f', 6, 64)
+}
@@ -0,0 +1,71 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// usageHttpClient answers every request with the usage of a completion
+type usageHttpClient struct{}
+
+func (c *usageHttpClient) Do(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(`{"usage": {"prompt_tokens": 400, "completion_tokens": 200, "total_tokens": 600}}`)),
+	}, nil
+}
+
+func TestEstimatedCost(t *testing.T) {
+	price := &PriceConfig{Input: 1.5, Output: 2}
+	assert.InDelta(t, 0.0035, price.Cost(1000, 1000), 1e-9)
+	assert.Equal(t, 0.0, (*PriceConfig)(nil).Cost(1000, 1000))
+
+	// Tokens beyond the prompt are priced as output, including those a small completion is charged at the least
+	request := &CompletionRequest{Prompt: strings.Repeat("a", 400), MaxTokens: 50}
+	assert.InDelta(t, (100*1.5+900*2)/1e6, estimatedCost(request, 1000, price), 1e-9)
+	assert.InDelta(t, 100*1.5/1e6, estimatedCost(&EmbeddingRequest{}, 100, price), 1e-9)
+
+	assert.Nil(t, estimatedCostHook(request, 1000, nil))
+}
+
+func TestCostHeaders(t *testing.T) {
+	openai := NewOpenAI(&RouteConfig{
+		Forward:  FAKE_BASE_URL,
+		Provider: "openai",
+		Models: map[string]ModelConfig{
+			TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60, TokensPerMinute: 60000, Price: &PriceConfig{Input: 0.5, Output: 1.5}},
+		},
+	}, &usageHttpClient{})
+	handler := openai.GetHandler()
+
+	body := []byte(`{"model": "gpt-3.5-turbo", "prompt": "` + strings.Repeat("a", 2000) + `", "max_tokens": 500}`)
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewBuffer(body)))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// 500 prompt and 500 completion tokens estimated, 400 and 200 used
+	assert.Equal(t, "0.001000", w.Header().Get(HeaderEstimatedCost))
+	assert.Equal(t, "0.000500", w.Header().Get(HeaderCost))
+}
@@ -0,0 +1,80 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"os"
+)
+
+// Azure OpenAI authenticates with this header rather than a bearer token
+const HeaderAzureAPIKey = "api-key"
+
+// upstreamCredentials are the API keys a route forwards requests with in place of the client's own,
+// read once at startup from the environment variables named in the config
+type upstreamCredentials struct {
+	route       string
+	models      map[string]string
+	batchModels map[string]string
+}
+
+func newUpstreamCredentials(config *RouteConfig) *upstreamCredentials {
+	credentials := &upstreamCredentials{
+		route:       os.Getenv(config.APIKeyEnv),
+		models:      credentialsFromEnv(config.Models),
+		batchModels: credentialsFromEnv(config.BatchModels),
+	}
+	if credentials.route == "" && len(credentials.models) == 0 && len(credentials.batchModels) == 0 {
+		return nil
+	}
+	return credentials
+}
+
+func credentialsFromEnv(models map[string]ModelConfig) map[string]string {
+	keys := make(map[string]string)
+	for model, config := range models {
+		if config.APIKeyEnv != "" {
+			keys[model] = os.Getenv(config.APIKeyEnv)
+		}
+	}
+	return keys
+}
+
+// For returns the key to forward a request for the model with, the route's unless the model has its own.
+// Empty when the client's credentials are forwarded as they are.
+func (c *upstreamCredentials) For(model string, batch bool) string {
+	if c == nil {
+		return ""
+	}
+	models := c.models
+	if batch {
+		models = c.batchModels
+	}
+	if key, ok := models[model]; ok {
+		return key
+	}
+	return c.route
+}
+
+// setCredential replaces the client's key with ours, in the api-key header if that's how the client authenticated
+func setCredential(header http.Header, key string) {
+	if header.Get(HeaderAzureAPIKey) != "" {
+		header.Set(HeaderAzureAPIKey, key)
+		return
+	}
+	header.Set("Authorization", "Bearer "+key)
+}
@@ -0,0 +1,223 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamCredentials(t *testing.T) {
+	t.Setenv("TEST_ROUTE_KEY", "route-key")
+	t.Setenv("TEST_MODEL_KEY", "model-key")
+
+	limits := ModelConfig{MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60.0, TokensPerMinute: 60000.0}
+	premium := limits
+	premium.APIKeyEnv = "TEST_MODEL_KEY"
+
+	client := &recordingHttpClient{}
+	openai := NewOpenAI(&RouteConfig{
+		Forward:   FAKE_BASE_URL,
+		Provider:  "openai",
+		APIKeyEnv: "TEST_ROUTE_KEY",
+		Models:    map[string]ModelConfig{TEST_MODEL: limits, "gpt-4": premium},
+	}, client)
+	handler := openai.GetHandler()
+
+	send := func(model string, header string, value string) {
+		body := []byte(fmt.Sprintf(`{"model": "%s", "prompt": "test"}`, model))
+		req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewBuffer(body))
+		req.Header.Set(header, value)
+		handler(httptest.NewRecorder(), req)
+	}
+
+	// The client's own key is replaced by the model's, or else the route's
+	send("gpt-4", "Authorization", "Bearer client-key")
+	send(TEST_MODEL, "Authorization", "Bearer client-key")
+	send(TEST_MODEL, HeaderAzureAPIKey, "client-key")
+	assert.Len(t, client.headers, 3)
+	assert.Equal(t, "Bearer model-key", client.headers[0].Get("Authorization"))
+	assert.Equal(t, "Bearer route-key", client.headers[1].Get("Authorization"))
+	assert.Equal(t, "route-key", client.headers[2].Get(HeaderAzureAPIKey))
+	assert.Empty(t, client.headers[2].Get("Authorization"))
+
+	// Without any configured the client's credentials are forwarded
+	assert.Nil(t, newUpstreamCredentials(&RouteConfig{Models: map[string]ModelConfig{TEST_MODEL: limits}}))
+}
+
+func TestAPIKeyPool(t *testing.T) {
+	t.Setenv("TEST_KEY_A", "key-a")
+	t.Setenv("TEST_KEY_B", "key-b")
+	t.Setenv("TEST_KEY_C", "key-c")
+	envs := []string{"TEST_KEY_A", "TEST_KEY_B", "TEST_KEY_C"}
+
+	acquire := func(pool *apiKeyPool, status int) string {
+		key := pool.Acquire()
+		pool.Release(key, status)
+		return key.env
+	}
+
+	// Round robin takes turns, passing over keys that were rate limited
+	pool := newAPIKeyPool(&RouteConfig{APIKeyPool: &APIKeyPoolConfig{KeyEnvs: envs}})
+	assert.Equal(t, "TEST_KEY_A", acquire(pool, http.StatusOK))
+	assert.Equal(t, "TEST_KEY_B", acquire(pool, http.StatusTooManyRequests))
+	assert.Equal(t, "TEST_KEY_C", acquire(pool, http.StatusOK))
+	assert.Equal(t, "TEST_KEY_A", acquire(pool, http.StatusOK))
+	assert.Equal(t, "TEST_KEY_C", acquire(pool, http.StatusOK))
+
+	// Failover sticks to the first key until the upstream turns it away
+	pool = newAPIKeyPool(&RouteConfig{APIKeyPool: &APIKeyPoolConfig{KeyEnvs: envs, Strategy: KeyStrategyFailover}})
+	assert.Equal(t, "TEST_KEY_A", acquire(pool, http.StatusOK))
+	assert.Equal(t, "TEST_KEY_A", acquire(pool, http.StatusUnauthorized))
+	assert.Equal(t, "TEST_KEY_B", acquire(pool, http.StatusOK))
+	assert.Equal(t, "TEST_KEY_B", acquire(pool, http.StatusOK))
+
+	// Least used picks the key with the fewest requests in flight
+	pool = newAPIKeyPool(&RouteConfig{APIKeyPool: &APIKeyPoolConfig{KeyEnvs: envs, Strategy: KeyStrategyLeastUsed}})
+	a, b := pool.Acquire(), pool.Acquire()
+	assert.Equal(t, "TEST_KEY_A", a.env)
+	assert.Equal(t, "TEST_KEY_B", b.env)
+	pool.Release(a, http.StatusOK)
+	assert.Equal(t, "TEST_KEY_A", acquire(pool, http.StatusOK))
+	pool.Release(b, http.StatusOK)
+
+	// Disabled keys are skipped, but the last enabled one can't be disabled
+	require.NoError(t, pool.SetDisabled("TEST_KEY_A", true))
+	require.NoError(t, pool.SetDisabled("TEST_KEY_B", true))
+	assert.Error(t, pool.SetDisabled("TEST_KEY_C", true))
+	assert.Error(t, pool.SetDisabled("TEST_KEY_D", true))
+	assert.Equal(t, "TEST_KEY_C", acquire(pool, http.StatusOK))
+
+	// When every key is cooling down the one that recovers first is used
+	pool = newAPIKeyPool(&RouteConfig{APIKeyPool: &APIKeyPoolConfig{KeyEnvs: envs[:2], Strategy: KeyStrategyFailover, Cooldown: 10}})
+	assert.Equal(t, "TEST_KEY_A", acquire(pool, http.StatusTooManyRequests))
+	time.Sleep(time.Millisecond)
+	assert.Equal(t, "TEST_KEY_B", acquire(pool, http.StatusTooManyRequests))
+	assert.Equal(t, "TEST_KEY_A", acquire(pool, http.StatusOK))
+	status := pool.Status()
+	assert.Equal(t, uint64(1), status[0].Failures)
+	assert.InDelta(t, 10, status[1].Cooldown, 1)
+
+	assert.Nil(t, newAPIKeyPool(&RouteConfig{}))
+	assert.Error(t, (&APIKeyPoolConfig{KeyEnvs: []string{"TEST_KEY_A", "TEST_KEY_UNSET"}}).validate())
+	assert.Error(t, (&APIKeyPoolConfig{KeyEnvs: envs, Strategy: "random"}).validate())
+}
+
+// rateLimitedKeyClient answers requests with the key it rate limits with a 429
+type rateLimitedKeyClient struct {
+	limited string
+	keys    []string
+}
+
+func (c *rateLimitedKeyClient) Do(req *http.Request) (*http.Response, error) {
+	key := req.Header.Get("Authorization")
+	c.keys = append(c.keys, key)
+	status := http.StatusOK
+	if key == "Bearer "+c.limited {
+		status = http.StatusTooManyRequests
+	}
+	return &http.Response{StatusCode: status, Body: ioutil.NopCloser(bytes.NewBufferString("{}")), Header: make(http.Header)}, nil
+}
+
+func TestAPIKeyPoolForwarding(t *testing.T) {
+	t.Setenv("TEST_KEY_A", "key-a")
+	t.Setenv("TEST_KEY_B", "key-b")
+
+	client := &rateLimitedKeyClient{limited: "key-a"}
+	openai := NewOpenAI(&RouteConfig{
+		Forward:    FAKE_BASE_URL,
+		Provider:   "openai",
+		APIKeyPool: &APIKeyPoolConfig{KeyEnvs: []string{"TEST_KEY_A", "TEST_KEY_B"}},
+		Models:     map[string]ModelConfig{TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60.0, TokensPerMinute: 60000.0}},
+	}, client)
+	handler := openai.GetHandler()
+
+	for i := 0; i < 3; i++ {
+		body := []byte(fmt.Sprintf(`{"model": "%s", "prompt": "test"}`, TEST_MODEL))
+		handler(httptest.NewRecorder(), httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewBuffer(body)))
+	}
+
+	// Once rate limited the first key cools down, leaving the second to take every request
+	assert.Equal(t, []string{"Bearer key-a", "Bearer key-b", "Bearer key-b"}, client.keys)
+	status := openai.KeyPool().Status()
+	assert.Equal(t, http.StatusTooManyRequests, status[0].LastStatus)
+	assert.Equal(t, 0, status[0].InFlight)
+	assert.Equal(t, uint64(2), status[1].Requests)
+
+	// The second key can be retired through the admin API, leaving the first however it's doing
+	admin := newAdminRouter(Providers{"openai": openai})
+	post := func(body string) int {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest("POST", "http://localhost:8082/admin/keys/set", bytes.NewBufferString(body)))
+		return w.Code
+	}
+	assert.Equal(t, http.StatusNotFound, post(`{"route": "other", "keyEnv": "TEST_KEY_B", "disabled": true}`))
+	assert.Equal(t, http.StatusBadRequest, post(`{"route": "openai", "keyEnv": "TEST_KEY_C", "disabled": true}`))
+	assert.Equal(t, http.StatusOK, post(`{"route": "openai", "keyEnv": "TEST_KEY_B", "disabled": true}`))
+	assert.Equal(t, http.StatusBadRequest, post(`{"route": "openai", "keyEnv": "TEST_KEY_A", "disabled": true}`))
+
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8082/admin/keys", nil))
+	assert.Contains(t, w.Body.String(), `"keyEnv":"TEST_KEY_B","disabled":true`)
+	assert.NotContains(t, w.Body.String(), "key-b")
+}
+
+func TestAPIKeyPoolPerKeyLimits(t *testing.T) {
+	t.Setenv("TEST_KEY_A", "key-a")
+	t.Setenv("TEST_KEY_B", "key-b")
+
+	client := &recordingHttpClient{}
+	openai := NewOpenAI(&RouteConfig{
+		Forward:    FAKE_BASE_URL,
+		Provider:   "openai",
+		APIKeyPool: &APIKeyPoolConfig{KeyEnvs: []string{"TEST_KEY_A", "TEST_KEY_B"}, Strategy: KeyStrategyFailover, PerKeyLimits: true},
+		Models:     map[string]ModelConfig{TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60.0, TokensPerMinute: 60000.0}},
+	}, client)
+	handler := openai.GetHandler()
+	send := func() int {
+		body := []byte(fmt.Sprintf(`{"model": "%s", "prompt": "test"}`, TEST_MODEL))
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewBuffer(body)))
+		return w.Code
+	}
+
+	// Every key has schedulers of its own, reported alongside the route's
+	scoped := openai.ScopedSchedulers()
+	require.Len(t, scoped, 2)
+	keyA, keyB := scoped[0][TEST_MODEL], scoped[1][TEST_MODEL]
+	assert.Equal(t, keyScope("TEST_KEY_A"), keyA.Scope)
+
+	// Failover prefers the first key while it has capacity, then moves on to the key that has
+	keyA.setCapacity(1, 60000)
+	assert.Equal(t, http.StatusOK, send())
+	assert.Equal(t, http.StatusOK, send())
+	require.Len(t, client.headers, 2)
+	assert.Equal(t, "Bearer key-a", client.headers[0].Get("Authorization"))
+	assert.Equal(t, "Bearer key-b", client.headers[1].Get("Authorization"))
+	assert.InDelta(t, 0, keyA.Snapshot().RequestCapacity, 0.1)
+	assert.InDelta(t, 59, keyB.Snapshot().RequestCapacity, 0.1)
+
+	// The route's own schedulers aren't used
+	assert.InDelta(t, 60, openai.Schedulers()[TEST_MODEL].Snapshot().RequestCapacity, 0.1)
+}
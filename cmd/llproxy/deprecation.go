@@ -0,0 +1,127 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Headers telling clients the model they asked for is deprecated, Sunset being when it's retired
+const (
+	HeaderDeprecation      = "Deprecation"
+	HeaderSunset           = "Sunset"
+	HeaderReplacementModel = "X-LLProxy-Replacement-Model"
+)
+
+// How often the use of a deprecated model is logged, for each client
+const deprecationWarningInterval = time.Hour
+
+// DeprecationConfig marks a model as deprecated, warning the clients still using it until it's retired
+type DeprecationConfig struct {
+	// When the upstream retires the model
+	Sunset time.Time `json:"sunset"`
+
+	// The model clients should move to, named in the warnings
+	Replacement string `json:"replacement"`
+
+	// Block rejects requests for the model once the sunset has passed, rather than forwarding them to fail upstream
+	Block bool `json:"block"`
+
+	// Link to the migration guide, sent with the warnings
+	DocsURL string `json:"docsUrl"`
+}
+
+func (c *DeprecationConfig) validate() error {
+	if c.Sunset.IsZero() {
+		return fmt.Errorf("deprecation requires a sunset")
+	}
+	return nil
+}
+
+// modelDeprecations warns about and blocks requests for deprecated models
+type modelDeprecations struct {
+	models map[string]DeprecationConfig
+
+	// When each client was last logged using each model
+	mu     sync.Mutex
+	warned map[string]time.Time
+}
+
+func newModelDeprecations(models map[string]DeprecationConfig) *modelDeprecations {
+	if len(models) == 0 {
+		return nil
+	}
+	return &modelDeprecations{models: models, warned: make(map[string]time.Time)}
+}
+
+// Check sets the deprecation headers on the response to a request for a deprecated model and logs its use,
+// returning false once it has rejected a request for a model that's been retired and is blocked
+func (d *modelDeprecations) Check(w http.ResponseWriter, r *http.Request, model string) bool {
+	if d == nil {
+		return true
+	}
+	deprecation, ok := d.models[model]
+	if !ok {
+		return true
+	}
+	now := time.Now()
+	retired := !now.Before(deprecation.Sunset)
+	if retired && deprecation.Block {
+		message := fmt.Sprintf("Model '%s' was retired on %s", model, deprecation.Sunset.UTC().Format(time.RFC3339))
+		if deprecation.Replacement != "" {
+			message += fmt.Sprintf(", use '%s' instead", deprecation.Replacement)
+		}
+		routeLog(r.Context()).Debugw("Rejecting request", "url", r.URL, "model", model, "reason", "ModelRetired")
+		d.setHeaders(w.Header(), deprecation)
+		writeRejection(w, http.StatusGone, ErrTypeInvalidRequest, ErrCodeModelRetired, RejectModelRetired, message)
+		return false
+	}
+
+	d.setHeaders(w.Header(), deprecation)
+	client, _ := clientFromContext(r.Context())
+	if d.shouldWarn(model, client.Name, now) {
+		routeLog(r.Context()).Warnw("Deprecated model requested", "url", r.URL, "model", model, "client", client.Name,
+			"sunset", deprecation.Sunset, "replacement", deprecation.Replacement, "retired", retired)
+	}
+	return true
+}
+
+func (d *modelDeprecations) setHeaders(header http.Header, deprecation DeprecationConfig) {
+	header.Set(HeaderDeprecation, "true")
+	header.Set(HeaderSunset, deprecation.Sunset.UTC().Format(http.TimeFormat))
+	if deprecation.Replacement != "" {
+		header.Set(HeaderReplacementModel, deprecation.Replacement)
+	}
+	if deprecation.DocsURL != "" {
+		header.Add("Link", fmt.Sprintf("<%s>; rel=\"deprecation\"", deprecation.DocsURL))
+	}
+}
+
+// shouldWarn is true when the client's use of the model hasn't been logged for a while
+func (d *modelDeprecations) shouldWarn(model string, client string, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := model + "\x00" + client
+	if last, ok := d.warned[key]; ok && now.Sub(last) < deprecationWarningInterval {
+		return false
+	}
+	d.warned[key] = now
+	return true
+}
@@ -0,0 +1,68 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModelDeprecations(t *testing.T) {
+	sunset := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	deprecations := newModelDeprecations(map[string]DeprecationConfig{
+		"gpt-4-0314":         {Sunset: sunset, Replacement: "gpt-4o", Block: true, DocsURL: "https://docs.example.com/migrate"},
+		"gpt-3.5-turbo-0301": {Sunset: time.Now().Add(-time.Hour), Replacement: "gpt-4o-mini", Block: true},
+		"text-davinci-003":   {Sunset: time.Now().Add(-time.Hour)},
+	})
+	check := func(model string) (*httptest.ResponseRecorder, bool) {
+		w := httptest.NewRecorder()
+		return w, deprecations.Check(w, httptest.NewRequest("POST", "http://localhost:8080/openai/v1/chat/completions", nil), model)
+	}
+
+	// Deprecated models are forwarded with a warning until their sunset
+	w, ok := check("gpt-4-0314")
+	assert.True(t, ok)
+	assert.Equal(t, "true", w.Header().Get(HeaderDeprecation))
+	assert.Equal(t, sunset.Format(http.TimeFormat), w.Header().Get(HeaderSunset))
+	assert.Equal(t, "gpt-4o", w.Header().Get(HeaderReplacementModel))
+	assert.Equal(t, `<https://docs.example.com/migrate>; rel="deprecation"`, w.Header().Get("Link"))
+
+	// Then blocked if configured to be
+	w, ok = check("gpt-3.5-turbo-0301")
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusGone, w.Code)
+	assert.Equal(t, string(RejectModelRetired), w.Header().Get(HeaderRejectReason))
+	assert.Contains(t, w.Body.String(), "use 'gpt-4o-mini' instead")
+
+	w, ok = check("text-davinci-003")
+	assert.True(t, ok)
+	assert.Equal(t, "true", w.Header().Get(HeaderDeprecation))
+
+	w, ok = check(TEST_MODEL)
+	assert.True(t, ok)
+	assert.Empty(t, w.Header().Get(HeaderDeprecation))
+	assert.Nil(t, newModelDeprecations(nil))
+
+	// Each client's use of a model is only logged once in a while
+	now := time.Now()
+	assert.True(t, deprecations.shouldWarn("gpt-4-0314", "team-a", now.Add(time.Hour)))
+	assert.False(t, deprecations.shouldWarn("gpt-4-0314", "team-a", now.Add(time.Hour+time.Minute)))
+	assert.True(t, deprecations.shouldWarn("gpt-4-0314", "team-b", now.Add(time.Hour+time.Minute)))
+}
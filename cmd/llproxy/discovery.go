@@ -0,0 +1,237 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Tokens a probe request is expected to use, it asks for a single response token
+const probeTokens = 10
+
+// LimitDiscoveryConfig reads the account's actual limits from the x-ratelimit-limit-* headers of upstream responses.
+// Azure OpenAI doesn't send those, only x-ratelimit-remaining-*, which is used to keep capacity within the deployment's.
+type LimitDiscoveryConfig struct {
+	// Send a minimal request for every model at startup, and every interval seconds if set, rather than
+	// only learning the limits from client traffic
+	Probe     bool    `json:"probe"`
+	Interval  float64 `json:"interval"`
+	APIKeyEnv string  `json:"apiKeyEnv"`
+
+	// Lower a scheduler's limits to the upstream's when they're below its config, or for upstreams that only report
+	// what's remaining its capacity to the upstream's remaining
+	Adjust bool `json:"adjust"`
+}
+
+// limitDiscovery reconciles the limits reported by the upstream with each scheduler's config
+type limitDiscovery struct {
+	config *LimitDiscoveryConfig
+
+	mu         sync.Mutex
+	discovered map[*Scheduler]SchedulerLimits
+	probes     map[*Scheduler]time.Duration
+}
+
+func newLimitDiscovery(config *LimitDiscoveryConfig) *limitDiscovery {
+	if config == nil {
+		return nil
+	}
+	return &limitDiscovery{config: config, discovered: make(map[*Scheduler]SchedulerLimits), probes: make(map[*Scheduler]time.Duration)}
+}
+
+// Hook returns a ResponseHook reading the upstream's limits for scheduler, it has to run before they are replaced with ours
+func (d *limitDiscovery) Hook(scheduler *Scheduler) ResponseHook {
+	if d == nil {
+		return nil
+	}
+	return func(resp *http.Response) {
+		d.Observe(scheduler, resp.Header)
+	}
+}
+
+// Observe reconciles the limits in an upstream response's headers with the scheduler, if there are any
+func (d *limitDiscovery) Observe(scheduler *Scheduler, header http.Header) {
+	requests, requestsErr := strconv.ParseFloat(header.Get(HeaderLimitRequests), 64)
+	tokens, tokensErr := strconv.ParseFloat(header.Get(HeaderLimitTokens), 64)
+	if header.Get(HeaderLimitRequests) == "" && header.Get(HeaderLimitTokens) == "" {
+		d.observeRemaining(scheduler, header)
+		return
+	}
+	if requestsErr != nil || tokensErr != nil || requests <= 0 || tokens <= 0 {
+		return
+	}
+	upstream := SchedulerLimits{ReqsPerMinute: requests, TokensPerMinute: tokens}
+
+	// Only report changes, every response carries the same headers
+	d.mu.Lock()
+	previous, seen := d.discovered[scheduler]
+	d.discovered[scheduler] = upstream
+	d.mu.Unlock()
+	if seen && previous == upstream {
+		return
+	}
+
+	configured := SchedulerLimits{ReqsPerMinute: scheduler.Config.ReqsPerMinute, TokensPerMinute: scheduler.Config.TokensPerMinute}
+	if configured == upstream {
+		zap.S().Infow("Configured limits match upstream", "provider", scheduler.Provider, "scheduler", scheduler.Name, "rpm", requests, "tpm", tokens)
+		return
+	}
+	zap.S().Warnw("Configured limits differ from upstream", "provider", scheduler.Provider, "scheduler", scheduler.Name,
+		"rpm", configured.ReqsPerMinute, "tpm", configured.TokensPerMinute, "upstreamRpm", requests, "upstreamTpm", tokens)
+
+	// Configured limits are often a share of the account, so they're only ever lowered
+	if d.config.Adjust {
+		adjusted := configured
+		if upstream.ReqsPerMinute < adjusted.ReqsPerMinute {
+			adjusted.ReqsPerMinute = upstream.ReqsPerMinute
+		}
+		if upstream.TokensPerMinute < adjusted.TokensPerMinute {
+			adjusted.TokensPerMinute = upstream.TokensPerMinute
+		}
+		if adjusted != *scheduler.limits.Load() {
+			zap.S().Warnw("Adjusting limits to upstream", "provider", scheduler.Provider, "scheduler", scheduler.Name, "rpm", adjusted.ReqsPerMinute, "tpm", adjusted.TokensPerMinute)
+			scheduler.SetLimits(adjusted)
+		}
+	}
+}
+
+// observeRemaining lowers the scheduler's capacity to what an upstream reporting only its remaining requests and
+// tokens, like Azure OpenAI, says is left, e.g. as other clients share the deployment. Azure counts requests over
+// windows of a few seconds, so this holds back bursts its per-minute limit would otherwise let through.
+func (d *limitDiscovery) observeRemaining(scheduler *Scheduler, header http.Header) {
+	if !d.config.Adjust {
+		return
+	}
+	requests, requestsErr := strconv.ParseFloat(header.Get(HeaderRemainingRequests), 64)
+	tokens, tokensErr := strconv.ParseFloat(header.Get(HeaderRemainingTokens), 64)
+	if requestsErr != nil {
+		requests = math.Inf(1)
+	}
+	if tokensErr != nil {
+		tokens = math.Inf(1)
+	}
+	if requestsErr == nil || tokensErr == nil {
+		scheduler.lowerCapacity(requests, tokens)
+	}
+}
+
+// Discovered returns the limits last reported by the upstream for a scheduler
+func (d *limitDiscovery) Discovered(scheduler *Scheduler) (SchedulerLimits, bool) {
+	if d == nil {
+		return SchedulerLimits{}, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	limits, ok := d.discovered[scheduler]
+	return limits, ok
+}
+
+// ProbeLatency returns how long the last probe for a scheduler took
+func (d *limitDiscovery) ProbeLatency(scheduler *Scheduler) (time.Duration, bool) {
+	if d == nil {
+		return 0, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	latency, ok := d.probes[scheduler]
+	return latency, ok
+}
+
+// probe sends a minimal request for every model, repeating every interval if one is configured
+func (d *limitDiscovery) probe(client HttpClient, urlBase string, schedulers SchedulerMap) {
+	names := make([]string, 0, len(schedulers))
+	for name := range schedulers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for {
+		for _, name := range names {
+			if err := d.probeModel(client, urlBase, schedulers[name]); err != nil {
+				zap.S().Warnw("Unable to probe upstream limits", "scheduler", name, "reason", err)
+			}
+		}
+		if d.config.Interval <= 0 {
+			return
+		}
+		time.Sleep(time.Duration(d.config.Interval * float64(time.Second)))
+	}
+}
+
+func (d *limitDiscovery) probeModel(client HttpClient, urlBase string, scheduler *Scheduler) error {
+	var path string
+	var body map[string]any
+	if strings.Contains(scheduler.Name, "embedding") {
+		path = "/v1/embeddings"
+		body = map[string]any{"model": scheduler.Name, "input": "ping"}
+	} else {
+		path = "/v1/chat/completions"
+		body = map[string]any{
+			"model":      scheduler.Name,
+			"messages":   []map[string]string{{"role": "user", "content": "ping"}},
+			"max_tokens": 1,
+		}
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(urlBase, "/")+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if d.config.APIKeyEnv != "" {
+		req.Header.Set("Authorization", "Bearer "+os.Getenv(d.config.APIKeyEnv))
+	}
+
+	// Probes are accounted like any other request
+	if scheduler.Submit(req, probeTokens) != Ready {
+		return fmt.Errorf("no capacity for probe")
+	}
+	sent := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	d.mu.Lock()
+	d.probes[scheduler] = time.Since(sent)
+	d.mu.Unlock()
+
+	d.Observe(scheduler, resp.Header)
+	if _, ok := d.Discovered(scheduler); !ok {
+		return fmt.Errorf("upstream responded %d without rate limit headers", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// HttpClientFunc adapts a function to HttpClient
+type HttpClientFunc func(req *http.Request) (*http.Response, error)
+
+func (f HttpClientFunc) Do(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestLimitDiscovery_Observe(t *testing.T) {
+	scheduler := NewScheduler("openai", TEST_MODEL, ModelConfig{MaxQueueSize: 1, ReqsPerMinute: 60, TokensPerMinute: 60000})
+	header := func(requests string, tokens string) http.Header {
+		header := make(http.Header)
+		header.Set(HeaderLimitRequests, requests)
+		header.Set(HeaderLimitTokens, tokens)
+		return header
+	}
+
+	// Without adjusting the mismatch is only reported
+	discovery := newLimitDiscovery(&LimitDiscoveryConfig{})
+	discovery.Observe(scheduler, header("30", "90000"))
+	discovered, ok := discovery.Discovered(scheduler)
+	assert.True(t, ok)
+	assert.Equal(t, SchedulerLimits{ReqsPerMinute: 30, TokensPerMinute: 90000}, discovered)
+	assert.Equal(t, SchedulerLimits{ReqsPerMinute: 60, TokensPerMinute: 60000}, scheduler.Limits())
+
+	// Adjusting only ever lowers the limits
+	discovery = newLimitDiscovery(&LimitDiscoveryConfig{Adjust: true})
+	discovery.Observe(scheduler, header("30", "90000"))
+	assert.Equal(t, SchedulerLimits{ReqsPerMinute: 30, TokensPerMinute: 60000}, scheduler.Limits())
+	assert.LessOrEqual(t, scheduler.Snapshot().RequestCapacity, 30.0)
+
+	// Responses without the headers are ignored
+	discovery.Observe(scheduler, http.Header{})
+	discovered, _ = discovery.Discovered(scheduler)
+	assert.Equal(t, 30.0, discovered.ReqsPerMinute)
+}
+
+func TestLimitDiscovery_AzureRemaining(t *testing.T) {
+	scheduler := NewScheduler("openai", TEST_MODEL, ModelConfig{MaxQueueSize: 1, ReqsPerMinute: 60, TokensPerMinute: 60000})
+	header := make(http.Header)
+	header.Set(HeaderRemainingRequests, "9")
+	header.Set(HeaderRemainingTokens, "1200")
+
+	// Only reported without adjusting
+	newLimitDiscovery(&LimitDiscoveryConfig{}).Observe(scheduler, header)
+	assert.InDelta(t, 60, scheduler.Snapshot().RequestCapacity, 0.1)
+
+	// Azure's remaining lowers the capacity, but never raises it or the limits
+	discovery := newLimitDiscovery(&LimitDiscoveryConfig{Adjust: true})
+	discovery.Observe(scheduler, header)
+	snapshot := scheduler.Snapshot()
+	assert.InDelta(t, 9, snapshot.RequestCapacity, 0.1)
+	assert.InDelta(t, 1200, snapshot.TokenCapacity, 10)
+	assert.Equal(t, SchedulerLimits{ReqsPerMinute: 60, TokensPerMinute: 60000}, scheduler.Limits())
+	_, ok := discovery.Discovered(scheduler)
+	assert.False(t, ok)
+
+	header.Set(HeaderRemainingRequests, "50")
+	header.Del(HeaderRemainingTokens)
+	discovery.Observe(scheduler, header)
+	assert.InDelta(t, 9, scheduler.Snapshot().RequestCapacity, 0.1)
+}
+
+func TestLimitDiscovery_Probe(t *testing.T) {
+	var requests []*http.Request
+	client := HttpClientFunc(func(req *http.Request) (*http.Response, error) {
+		requests = append(requests, req)
+		header := make(http.Header)
+		header.Set(HeaderLimitRequests, "500")
+		header.Set(HeaderLimitTokens, "1000000")
+		return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ioutil.NopCloser(bytes.NewBufferString("{}"))}, nil
+	})
+	t.Setenv("PROBE_KEY", "sk-probe")
+
+	schedulers := initSchedulers("openai", map[string]ModelConfig{
+		TEST_MODEL:      {MaxQueueSize: 1, ReqsPerMinute: 60, TokensPerMinute: 60000},
+		BENCHMARK_MODEL: {MaxQueueSize: 1, ReqsPerMinute: 60, TokensPerMinute: 60000},
+	})
+	discovery := newLimitDiscovery(&LimitDiscoveryConfig{Probe: true, APIKeyEnv: "PROBE_KEY"})
+	discovery.probe(client, FAKE_BASE_URL+"/", schedulers)
+
+	assert.Len(t, requests, 2)
+	assert.Equal(t, FAKE_BASE_URL+"/v1/chat/completions", requests[0].URL.String())
+	assert.Equal(t, FAKE_BASE_URL+"/v1/embeddings", requests[1].URL.String())
+	assert.Equal(t, "Bearer sk-probe", requests[0].Header.Get("Authorization"))
+	discovered, ok := discovery.Discovered(schedulers[TEST_MODEL])
+	assert.True(t, ok)
+	assert.Equal(t, 500.0, discovered.ReqsPerMinute)
+}
@@ -0,0 +1,86 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// dryRun is set to observe traffic without enforcing limits. Requests take the usual path, parsed, estimated and
+// accounted against every scheduler that admits them, and what would have happened to them is logged, but they are
+// never queued or rejected for the limits and are always forwarded straight away.
+var dryRun atomic.Bool
+
+// DryRun accounts for a request as Submit would without waiting or rejecting it, returning the response
+// Submit would have given and the seconds the request would have been queued for.
+// Requests that would have queued take their capacity straight away, leaving it negative for as long as they would have waited.
+func (scheduler *Scheduler) DryRun(tokens float64) (Response, float64) {
+	if scheduler.tryAcquire(tokens) {
+		scheduler.admitted.Add(1)
+		return Ready, 0
+	}
+
+	wait := scheduler.WaitEstimate(tokens)
+	rejected := false
+	switch scheduler.Config.QueueMode {
+	case QueueModeReject:
+		rejected = true
+	case QueueModeShed:
+		// Nothing is really queued, so the depth can't be judged
+	default:
+		rejected = scheduler.Config.MaxQueueWait > 0 && wait > scheduler.Config.MaxQueueWait
+	}
+	if rejected {
+		scheduler.rejected.Add(1)
+		return RateLimit, 0
+	}
+
+	scheduler.update(func(state *CapacitySnapshot) bool {
+		state.RequestCapacity -= 1
+		state.TokenCapacity -= tokens
+		return true
+	})
+	scheduler.admitted.Add(1)
+	return Ready, wait
+}
+
+// dryRunSubmit admits a request straight away in a dry run, logging what Submit would have done with it
+func (scheduler *Scheduler) dryRunSubmit(r *http.Request, tokens float64) (Response, RejectReason) {
+	response, wait := scheduler.DryRun(tokens)
+	scheduler.throughput.Add(scheduler.now(), 1, tokens)
+	switch {
+	case response == RateLimit:
+		routeLog(r.Context()).Infow("Dry run", "url", r.URL, "scheduler", scheduler.Name, "tokens", tokens, "outcome", "rejected", "reason", "RateLimit")
+	case wait > 0:
+		routeLog(r.Context()).Infow("Dry run", "url", r.URL, "scheduler", scheduler.Name, "tokens", tokens, "outcome", "queued", "wait", fmt.Sprintf("%.0fms", wait*1000))
+	default:
+		routeLog(r.Context()).Infow("Dry run", "url", r.URL, "scheduler", scheduler.Name, "tokens", tokens, "outcome", "admitted")
+	}
+	return Ready, ""
+}
+
+// dryRunIgnores logs a rejection the proxy would have made, returning true when it's a dry run and the request is
+// to be forwarded anyway
+func dryRunIgnores(r *http.Request, model string, tokens int, reason string) bool {
+	if !dryRun.Load() {
+		return false
+	}
+	routeLog(r.Context()).Infow("Dry run", "url", r.URL, "model", model, "tokens", tokens, "outcome", "rejected", "reason", reason)
+	return true
+}
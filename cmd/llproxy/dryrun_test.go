@@ -0,0 +1,104 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedulerDryRun(t *testing.T) {
+	scheduler := NewScheduler("openai", TEST_MODEL, ModelConfig{MaxQueueSize: 10, MaxQueueWait: 30, ReqsPerMinute: 60, TokensPerMinute: 60000})
+	scheduler.setCapacity(1, 60000)
+	response, wait := scheduler.DryRun(100)
+	assert.Equal(t, Response(Ready), response)
+	assert.Equal(t, 0.0, wait)
+
+	// Out of requests, the next would have waited about a second and its capacity is taken anyway
+	response, wait = scheduler.DryRun(100)
+	assert.Equal(t, Response(Ready), response)
+	assert.InDelta(t, 1.0, wait, 0.1)
+	assert.InDelta(t, -1, scheduler.Snapshot().RequestCapacity, 0.1)
+
+	// Which pushes later requests further back, until they would wait longer than maxQueueWait
+	scheduler.setCapacity(-40, 60000)
+	response, _ = scheduler.DryRun(100)
+	assert.Equal(t, Response(RateLimit), response)
+	admitted, rejected := scheduler.Counts()
+	assert.Equal(t, uint64(2), admitted)
+	assert.Equal(t, uint64(1), rejected)
+}
+
+func TestDryRunForwards(t *testing.T) {
+	dryRun.Store(true)
+	defer dryRun.Store(false)
+
+	openai := NewOpenAI(&RouteConfig{
+		Forward:  FAKE_BASE_URL,
+		Provider: "openai",
+		Models: map[string]ModelConfig{
+			TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60, TokensPerMinute: 60000},
+		},
+	}, &MockHttpClient{})
+	openai.schedulers[TEST_MODEL].setCapacity(0, 0)
+	handler := openai.GetHandler()
+
+	// Neither a request without capacity nor one for an unknown model is turned away
+	for _, model := range []string{TEST_MODEL, "unknown-model"} {
+		body := []byte(fmt.Sprintf(`{"model": "%s", "prompt": "test"}`, model))
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewBuffer(body)))
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+}
+
+func TestDryRunNormalPath(t *testing.T) {
+	dryRun.Store(true)
+	defer dryRun.Store(false)
+
+	openai := NewOpenAI(&RouteConfig{
+		Forward:        FAKE_BASE_URL,
+		Provider:       "openai",
+		SchedulerScope: []string{"OpenAI-Organization"},
+		Models:         map[string]ModelConfig{TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60, TokensPerMinute: 60000}},
+		ScopeQuota:     &ScopeQuotaConfig{Share: 0.5},
+		RouteLimit:     &RouteLimitConfig{MaxQueueSize: 1, MaxQueueWait: 0.1, ReqsPerMinute: 2, TokensPerMinute: 60000},
+	}, &MockHttpClient{})
+	handler := openai.GetHandler()
+
+	// Requests take the usual path without waiting, accounted by the scope, its pool and the route limit, and are
+	// sent the limits the proxy enforces, even once the route limit would have turned them away
+	for i := 0; i < 3; i++ {
+		body := []byte(fmt.Sprintf(`{"model": "%s", "prompt": "test"}`, TEST_MODEL))
+		r := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewBuffer(body))
+		r.Header.Set("OpenAI-Organization", "org-a")
+		w := httptest.NewRecorder()
+		handler(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "30", w.Header().Get(HeaderLimitRequests))
+	}
+	a, _ := openai.scopes.Get("org-a")
+	assert.InDelta(t, 27, a.schedulers[TEST_MODEL].Snapshot().RequestCapacity, 0.5)
+	assert.InDelta(t, 57, openai.schedulers[TEST_MODEL].Snapshot().RequestCapacity, 0.5)
+	admitted, rejected := openai.routeLimit.scheduler.Counts()
+	assert.Equal(t, uint64(2), admitted)
+	assert.Equal(t, uint64(1), rejected)
+}
@@ -0,0 +1,233 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for duplicate storm detection
+const (
+	defaultDuplicateWindow    = 10
+	defaultDuplicateThreshold = 5
+)
+
+// Most distinct requests counted at once, past which new ones aren't counted until the window frees some
+const maxDuplicateBursts = 100000
+
+// DuplicateStormConfig detects a client sending the same request over and over, e.g. retrying without backing off
+type DuplicateStormConfig struct {
+	// Seconds identical requests are counted over, 10 when unset
+	Window float64 `json:"window"`
+
+	// Identical requests from one client within the window allowed before it's a storm, 5 when unset
+	Threshold int `json:"threshold"`
+
+	// Reject the duplicates past the threshold with a 429 until the window passes, rather than only reporting them
+	Throttle bool `json:"throttle"`
+}
+
+func (c *DuplicateStormConfig) validate() error {
+	if c.Window < 0 || c.Threshold < 0 {
+		return fmt.Errorf("duplicateStorm window and threshold can't be negative")
+	}
+	return nil
+}
+
+// requestFingerprint identifies identical requests from one caller, the client and the upstream key it sent if any
+type requestFingerprint struct {
+	client string
+	caller [sha256.Size]byte
+	path   string
+	body   [sha256.Size]byte
+}
+
+// duplicateBurst counts the copies of a request seen since the first in the window
+type duplicateBurst struct {
+	first  time.Time
+	count  int
+	warned bool
+}
+
+// duplicateDetector counts identical requests by fingerprint, warning about and optionally throttling storms of them
+type duplicateDetector struct {
+	window    time.Duration
+	threshold int
+	throttle  bool
+
+	mu        sync.Mutex
+	bursts    map[requestFingerprint]*duplicateBurst
+	lastSweep time.Time
+}
+
+func newDuplicateDetector(config *DuplicateStormConfig) *duplicateDetector {
+	if config == nil {
+		return nil
+	}
+	d := &duplicateDetector{
+		window:    time.Duration(config.Window * float64(time.Second)),
+		threshold: config.Threshold,
+		throttle:  config.Throttle,
+		bursts:    make(map[requestFingerprint]*duplicateBurst),
+	}
+	if d.window == 0 {
+		d.window = defaultDuplicateWindow * time.Second
+	}
+	if d.threshold == 0 {
+		d.threshold = defaultDuplicateThreshold
+	}
+	return d
+}
+
+// Check counts the request against its caller's identical requests, returning false after writing the rejection
+// if it's a duplicate past the threshold and storms are throttled. Anonymous callers without a key of their own can't
+// be told apart, so their storms are only reported.
+func (d *duplicateDetector) Check(w http.ResponseWriter, r *http.Request) bool {
+	if d == nil || r.Method != http.MethodPost {
+		return true
+	}
+	body, ok := jsonBody(r)
+	if !ok {
+		return true
+	}
+	client, _ := clientFromContext(r.Context())
+	authorization, apiKey := r.Header.Get("Authorization"), r.Header.Get(HeaderAzureAPIKey)
+	identified := client.Name != anonymousClient.Name || authorization != "" || apiKey != ""
+	credential := authorization + "\n" + apiKey
+	fingerprint := requestFingerprint{client: client.Name, caller: sha256.Sum256([]byte(credential)), path: r.URL.Path, body: sha256.Sum256(body)}
+
+	count, warn, retryAfter := d.observe(fingerprint, time.Now())
+	if count <= d.threshold {
+		return true
+	}
+	route := ""
+	if record := recordFromContext(r.Context()); record != nil {
+		route = record.Route
+	}
+	if warn {
+		routeLog(r.Context()).Warnw("Duplicate request storm", "url", r.URL, "client", client.Name, "count", count, "window", d.window.Seconds())
+	}
+	duplicateMetrics.Add(route, client.Name, d.throttle && identified)
+	if !d.throttle || !identified {
+		return true
+	}
+
+	routeLog(r.Context()).Debugw("Rejecting request", "url", r.URL, "client", client.Name, "count", count, "reason", "DuplicateStorm")
+	w.Header().Set(HeaderRetryAfter, strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	writeRejection(w, http.StatusTooManyRequests, ErrTypeRequests, ErrCodeDuplicateStorm, RejectDuplicateStorm,
+		fmt.Sprintf("Sent the same request %d times in %gs", count, d.window.Seconds()))
+	return false
+}
+
+// observe counts a request with the fingerprint, returning how many have been seen in the window, whether the storm
+// should be warned about and how long until the window passes
+func (d *duplicateDetector) observe(fingerprint requestFingerprint, now time.Time) (int, bool, time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Bursts that have passed are only swept once a window, rather than on every request
+	if now.Sub(d.lastSweep) >= d.window {
+		for key, burst := range d.bursts {
+			if now.Sub(burst.first) >= d.window {
+				delete(d.bursts, key)
+			}
+		}
+		d.lastSweep = now
+	}
+
+	burst, ok := d.bursts[fingerprint]
+	if !ok && len(d.bursts) >= maxDuplicateBursts {
+		return 1, false, d.window
+	}
+	if !ok || now.Sub(burst.first) >= d.window {
+		burst = &duplicateBurst{first: now}
+		d.bursts[fingerprint] = burst
+	}
+	burst.count++
+	warn := burst.count > d.threshold && !burst.warned
+	if warn {
+		burst.warned = true
+	}
+	return burst.count, warn, burst.first.Add(d.window).Sub(now)
+}
+
+// jsonBody reads a JSON request's body, putting it back for the upstream. Retries are sent as they were the first
+// time, so the bytes are compared as sent rather than decoded.
+func jsonBody(r *http.Request) ([]byte, bool) {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return nil, false
+	}
+	return body, true
+}
+
+// duplicateRegistry keeps the duplicates past the threshold by route and client, written in the Prometheus text format
+type duplicateRegistry struct {
+	mu     sync.Mutex
+	series map[string]uint64
+}
+
+var duplicateMetrics = &duplicateRegistry{}
+
+// Add counts a duplicate past the threshold, and whether it was throttled
+func (m *duplicateRegistry) Add(route string, client string, throttled bool) {
+	key := strings.Join([]string{metricLabel("route", route), metricLabel("client", client), metricLabel("throttled", strconv.FormatBool(throttled))}, ",")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.series == nil {
+		m.series = make(map[string]uint64)
+	}
+	m.series[key]++
+}
+
+// Write writes the count of every series in the Prometheus text exposition format
+func (m *duplicateRegistry) Write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.series) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintln(w, "# HELP llproxy_duplicate_requests_total Identical requests from a client past the duplicate storm threshold.")
+	fmt.Fprintln(w, "# TYPE llproxy_duplicate_requests_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "llproxy_duplicate_requests_total{%s} %d\n", key, m.series[key])
+	}
+}
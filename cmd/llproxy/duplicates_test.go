@@ -0,0 +1,107 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDuplicateStorm(t *testing.T) {
+	openai := NewOpenAI(&RouteConfig{
+		Forward:        FAKE_BASE_URL,
+		Provider:       "openai",
+		Models:         map[string]ModelConfig{TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 1, ReqsPerMinute: 600, TokensPerMinute: 60000}},
+		DuplicateStorm: &DuplicateStormConfig{Window: 60, Threshold: 2, Throttle: true},
+	}, &MockHttpClient{})
+	handler := identifyClients(clientKeys{}, PriorityPolicy{})(openai.GetHandler())
+
+	send := func(body string, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewBufferString(body))
+		r.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			r.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+	body := fmt.Sprintf(`{"model": "%s", "prompt": "test"}`, TEST_MODEL)
+
+	// A caller sending the same request over and over is throttled
+	assert.Equal(t, http.StatusOK, send(body, "sk-a").Code)
+	assert.Equal(t, http.StatusOK, send(body, "sk-a").Code)
+	w := send(body, "sk-a")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, string(RejectDuplicateStorm), w.Header().Get(HeaderRejectReason))
+	assert.NotEmpty(t, w.Header().Get(HeaderRetryAfter))
+
+	// Other requests, and the same request from callers with other keys, aren't affected
+	assert.Equal(t, http.StatusOK, send(fmt.Sprintf(`{"model": "%s", "prompt": "other"}`, TEST_MODEL), "sk-a").Code)
+	assert.Equal(t, http.StatusOK, send(body, "sk-b").Code)
+
+	// Callers without a key can't be told apart, so they're only reported
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, send(body, "").Code)
+	}
+
+	metrics := &strings.Builder{}
+	duplicateMetrics.Write(metrics)
+	assert.Contains(t, metrics.String(), `llproxy_duplicate_requests_total{route="",client="anonymous",throttled="true"} 1`)
+	assert.Contains(t, metrics.String(), `llproxy_duplicate_requests_total{route="",client="anonymous",throttled="false"} 1`)
+}
+
+func TestDuplicateDetectorWindow(t *testing.T) {
+	detector := newDuplicateDetector(&DuplicateStormConfig{Window: 10})
+	fingerprint := requestFingerprint{client: "a", path: "/v1/completions"}
+	now := time.Now()
+
+	for i := 1; i <= defaultDuplicateThreshold; i++ {
+		count, warn, _ := detector.observe(fingerprint, now)
+		assert.Equal(t, i, count)
+		assert.False(t, warn)
+	}
+
+	// The storm is warned about once
+	count, warn, retryAfter := detector.observe(fingerprint, now.Add(4*time.Second))
+	assert.Equal(t, defaultDuplicateThreshold+1, count)
+	assert.True(t, warn)
+	assert.Equal(t, 6*time.Second, retryAfter)
+	_, warn, _ = detector.observe(fingerprint, now.Add(5*time.Second))
+	assert.False(t, warn)
+
+	// Counting starts again once the window has passed, and passed bursts are swept
+	count, _, _ = detector.observe(fingerprint, now.Add(10*time.Second))
+	assert.Equal(t, 1, count)
+	detector.observe(requestFingerprint{client: "b"}, now.Add(25*time.Second))
+	assert.Len(t, detector.bursts, 1)
+
+	// Past the most it keeps, new requests aren't counted until the window frees some
+	for i := len(detector.bursts); i < maxDuplicateBursts; i++ {
+		detector.bursts[requestFingerprint{client: strconv.Itoa(i)}] = &duplicateBurst{first: now.Add(25 * time.Second)}
+	}
+	count, _, _ = detector.observe(requestFingerprint{client: "c"}, now.Add(26*time.Second))
+	assert.Equal(t, 1, count)
+	assert.Len(t, detector.bursts, maxDuplicateBursts)
+}
@@ -0,0 +1,154 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// What a secret is replaced with in /admin/config
+const redacted = "REDACTED"
+
+// Config fields holding a secret as their value, and maps of headers whose values may be one
+var (
+	secretConfigFields = map[string]bool{"key": true, "webhook": true}
+	headerConfigFields = map[string]bool{"headers": true, "requestHeaders": true, "responseHeaders": true}
+)
+
+// EffectiveConfig is the config the proxy is running with, as /admin/config returns it
+type EffectiveConfig struct {
+	Source   string `json:"source"`
+	Checksum string `json:"checksum"`
+	Config   any    `json:"config"`
+}
+
+// getEffectiveConfig returns the config as loaded, with defaults filled in, and changed by what's been set at
+// runtime: maintenance switches, upstreams, discovered limits and dry run. Keys, webhooks, credential headers
+// and URL passwords are redacted.
+func getEffectiveConfig(c *Config, providers Providers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := effectiveConfig(*c, providers)
+		data, err := json.Marshal(config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var fields any
+		json.Unmarshal(data, &fields)
+		writeJSON(w, EffectiveConfig{Source: c.source, Checksum: c.checksum, Config: redactConfig("", fields)})
+	}
+}
+
+// effectiveConfig applies the runtime state of each route's provider to a copy of the config
+func effectiveConfig(config Config, providers Providers) Config {
+	config.DryRun = dryRun.Load()
+	routes := make(map[string]RouteConfig, len(config.Routes))
+	for route, routeConfig := range config.Routes {
+		provider, ok := providers[route]
+		if !ok {
+			routes[route] = routeConfig
+			continue
+		}
+		disabled := provider.Maintenance().List()
+		routeDisabled, ok := disabled[""]
+		routeConfig.Disabled = ok
+		routeConfig.DisabledMessage, routeConfig.DisabledRetryAfter = routeDisabled.Message, routeDisabled.RetryAfter
+		routeConfig.DisabledRecoveryTime, routeConfig.DisabledDocsURL = routeDisabled.RecoveryTime, routeDisabled.DocsURL
+
+		targets := provider.UpstreamPool().Targets()
+		routeConfig.Forward, routeConfig.Upstreams = "", make([]string, len(targets))
+		for i, target := range targets {
+			routeConfig.Upstreams[i] = target.URL
+		}
+		routeConfig.Models = effectiveModels(routeConfig.Models, provider.Schedulers(), disabled)
+		routeConfig.BatchModels = effectiveModels(routeConfig.BatchModels, nil, disabled)
+		routes[route] = routeConfig
+	}
+	config.Routes = routes
+	return config
+}
+
+func effectiveModels(models map[string]ModelConfig, schedulers SchedulerMap, disabled map[string]Disabled) map[string]ModelConfig {
+	effective := make(map[string]ModelConfig, len(models))
+	for model, modelConfig := range models {
+		if scheduler, ok := schedulers[model]; ok {
+			limits := *scheduler.limits.Load()
+			modelConfig.ReqsPerMinute, modelConfig.TokensPerMinute = limits.ReqsPerMinute, limits.TokensPerMinute
+		}
+		modelDisabled, ok := disabled[model]
+		modelConfig.Disabled = ok
+		modelConfig.DisabledMessage, modelConfig.DisabledRetryAfter = modelDisabled.Message, modelDisabled.RetryAfter
+		modelConfig.DisabledRecoveryTime, modelConfig.DisabledDocsURL = modelDisabled.RecoveryTime, modelDisabled.DocsURL
+		effective[model] = modelConfig
+	}
+	return effective
+}
+
+// redactConfig replaces the secrets in a config decoded from JSON, the field being the name it's under
+func redactConfig(field string, value any) any {
+	switch value := value.(type) {
+	case map[string]any:
+		for name, v := range value {
+			if headerConfigFields[name] {
+				if headers, ok := v.(map[string]any); ok {
+					for header := range headers {
+						if isCredentialHeader(header) {
+							headers[header] = redacted
+						}
+					}
+				}
+				continue
+			}
+			value[name] = redactConfig(name, v)
+		}
+		return value
+	case []any:
+		for i, v := range value {
+			value[i] = redactConfig(field, v)
+		}
+		return value
+	case string:
+		if value == "" {
+			return value
+		}
+		if secretConfigFields[field] {
+			return redacted
+		}
+		if parsed, err := url.Parse(value); err == nil && parsed.User != nil {
+			if _, ok := parsed.User.Password(); ok {
+				parsed.User = url.UserPassword(parsed.User.Username(), redacted)
+				return parsed.String()
+			}
+		}
+		return value
+	}
+	return value
+}
+
+// isCredentialHeader is true for headers that carry credentials, e.g. Authorization or api-key
+func isCredentialHeader(header string) bool {
+	header = strings.ToLower(header)
+	for _, word := range []string{"auth", "key", "token", "secret", "cookie", "password"} {
+		if strings.Contains(header, word) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,215 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// EmbeddingBatchConfig splits embeddings requests with too many inputs into several upstream calls
+type EmbeddingBatchConfig struct {
+	// Most inputs in one upstream call, OpenAI allows 2048
+	MaxInputs int `json:"maxInputs"`
+
+	// Most estimated tokens in one upstream call, 0 for no limit
+	MaxTokens int `json:"maxTokens"`
+}
+
+// embeddingChunks splits an embeddings input into runs of at most maxInputs inputs and maxTokens estimated tokens,
+// returning nil when it fits in one call. A single input is never split.
+func embeddingChunks(input any, config *EmbeddingBatchConfig) [][]any {
+	inputs, ok := input.([]any)
+	if config == nil || !ok || len(inputs) < 2 {
+		return nil
+	}
+	if _, ok := inputs[0].(float64); ok {
+		// A list of token ids is a single input
+		return nil
+	}
+
+	var chunks [][]any
+	start, tokens := 0, 0
+	for i, item := range inputs {
+		itemTokens, _ := completionPromptTokens(item)
+		full := config.MaxInputs > 0 && i-start >= config.MaxInputs
+		if config.MaxTokens > 0 && tokens+itemTokens > config.MaxTokens {
+			full = true
+		}
+		if full && i > start {
+			chunks = append(chunks, inputs[start:i])
+			start, tokens = i, 0
+		}
+		tokens += itemTokens
+	}
+	if start == 0 {
+		return nil
+	}
+	return append(chunks, inputs[start:])
+}
+
+// embeddingPartTokens shares a request's tokens between the parts of its input, by their estimated tokens, so that
+// together the parts are charged what the whole request would have been
+func embeddingPartTokens(chunks [][]any, tokens int) []int {
+	weights := make([]int, len(chunks))
+	total := 0
+	for i, chunk := range chunks {
+		weights[i], _ = completionPromptTokens(chunk)
+		total += weights[i]
+	}
+	if total == 0 {
+		for i, chunk := range chunks {
+			weights[i] = len(chunk)
+			total += weights[i]
+		}
+	}
+
+	parts := make([]int, len(chunks))
+	remaining := tokens
+	for i := range chunks[1:] {
+		parts[i+1] = tokens * weights[i+1] / total
+		remaining -= parts[i+1]
+	}
+	parts[0] = remaining
+	return parts
+}
+
+// embeddingSplitClient sends an embeddings request's input in several calls and merges their responses into one,
+// as though the upstream had answered the whole request. The first call was admitted with the request, charged only
+// its part's tokens, and each of the others waits for the schedulers in turn with its own.
+type embeddingSplitClient struct {
+	client    HttpClient
+	scheduler *Scheduler
+	options   SubmitOptions
+	chunks    [][]any
+	tokens    []int
+
+	// The scope's pool and the route limit, when the request was also admitted by them
+	shared []*Scheduler
+}
+
+// embeddingResponse is the part of an embeddings response that's merged, the embeddings themselves are passed on as they are
+type embeddingResponse struct {
+	Object string                       `json:"object"`
+	Data   []map[string]json.RawMessage `json:"data"`
+	Model  string                       `json:"model"`
+	Usage  struct {
+		PromptTokens int `json:"prompt_tokens"`
+		TotalTokens  int `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+func (c *embeddingSplitClient) Do(req *http.Request) (*http.Response, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+
+	var merged embeddingResponse
+	var header http.Header
+	offset := 0
+	for i, chunk := range c.chunks {
+		if i > 0 {
+			if resp := c.admit(req, i, float64(c.tokens[i])); resp != nil {
+				return resp, nil
+			}
+		}
+
+		resp, err := c.send(req, fields, chunk)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			return resp, err
+		}
+		var part embeddingResponse
+		err = json.NewDecoder(resp.Body).Decode(&part)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading part %d of the embeddings batch: %w", i, err)
+		}
+
+		// Each part numbers its embeddings from 0, they're numbered again by their place in the whole input
+		for _, embedding := range part.Data {
+			var index int
+			json.Unmarshal(embedding["index"], &index)
+			embedding["index"] = json.RawMessage(strconv.Itoa(offset + index))
+			merged.Data = append(merged.Data, embedding)
+		}
+		merged.Object, merged.Model = part.Object, part.Model
+		merged.Usage.PromptTokens += part.Usage.PromptTokens
+		merged.Usage.TotalTokens += part.Usage.TotalTokens
+		offset += len(chunk)
+		if header == nil {
+			header = resp.Header.Clone()
+		}
+	}
+
+	body, err = json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	header.Del("Content-Length")
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}, nil
+}
+
+// admit waits for the model's scheduler and those it shares limits with to have capacity for a part, returning the
+// rejection if one of them turns it away after giving back what the others were charged
+func (c *embeddingSplitClient) admit(req *http.Request, part int, tokens float64) *http.Response {
+	scheduler, reason := submitAll(req, append([]*Scheduler{c.scheduler}, c.shared...), tokens, c.options)
+	if scheduler == nil {
+		return nil
+	}
+	routeLog(req.Context()).Debugw("Rejecting request", "url", req.URL, "model", c.scheduler.Name, "part", part, "reason", "RateLimit")
+	resp := rejectionResponse(http.StatusTooManyRequests, ErrTypeRequests, ErrCodeRateLimitExceeded, reason,
+		fmt.Sprintf("RateLimit exceeded for model '%s' after %d of %d parts of the embeddings batch", c.scheduler.Name, part, len(c.chunks)))
+	setRetryAfter(resp.Header, scheduler, tokens)
+	return resp
+}
+
+// send forwards the request with only a chunk of its input
+func (c *embeddingSplitClient) send(req *http.Request, fields map[string]json.RawMessage, chunk []any) (*http.Response, error) {
+	input, err := json.Marshal(chunk)
+	if err != nil {
+		return nil, err
+	}
+	fields["input"] = input
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	part := req.Clone(req.Context())
+	part.Body = ioutil.NopCloser(bytes.NewReader(body))
+	part.ContentLength = int64(len(body))
+	part.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	// Parts are decoded to be merged, so they're asked for uncompressed
+	part.Header.Del("Accept-Encoding")
+	return c.client.Do(part)
+}
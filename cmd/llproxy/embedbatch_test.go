@@ -0,0 +1,178 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// embeddingHttpClient answers embeddings requests with each input's length as its embedding
+type embeddingHttpClient struct {
+	calls int
+}
+
+func (c *embeddingHttpClient) Do(req *http.Request) (*http.Response, error) {
+	c.calls++
+	var request struct {
+		Input []string `json:"input"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		return nil, err
+	}
+	data := []string{}
+	for i, input := range request.Input {
+		data = append(data, fmt.Sprintf(`{"object": "embedding", "index": %d, "embedding": [%d]}`, i, len(input)))
+	}
+	body := fmt.Sprintf(`{"object": "list", "data": [%s], "model": "text-embedding-ada-002", "usage": {"prompt_tokens": %d, "total_tokens": %d}}`,
+		strings.Join(data, ","), len(request.Input), len(request.Input))
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}, nil
+}
+
+func TestEmbeddingChunks(t *testing.T) {
+	inputs := []any{"a", "bb", "ccc", "dddd", "eeeee"}
+	assert.Nil(t, embeddingChunks(inputs, nil))
+	assert.Nil(t, embeddingChunks(inputs, &EmbeddingBatchConfig{MaxInputs: 5}))
+	assert.Nil(t, embeddingChunks("a single input", &EmbeddingBatchConfig{MaxInputs: 1}))
+	assert.Nil(t, embeddingChunks([]any{1.0, 2.0, 3.0}, &EmbeddingBatchConfig{MaxInputs: 1}))
+
+	assert.Equal(t, [][]any{{"a", "bb"}, {"ccc", "dddd"}, {"eeeee"}}, embeddingChunks(inputs, &EmbeddingBatchConfig{MaxInputs: 2}))
+
+	// Inputs are estimated at 4 characters a token, one larger than the limit goes on its own
+	long := strings.Repeat("a", 40)
+	assert.Equal(t, [][]any{{"a", "bb", "ccc"}, {long}, {"dddd"}}, embeddingChunks([]any{"a", "bb", "ccc", long, "dddd"}, &EmbeddingBatchConfig{MaxTokens: 5}))
+}
+
+func TestEmbeddingPartTokens(t *testing.T) {
+	assert.Equal(t, []int{400, 400, 200}, embeddingPartTokens([][]any{{"a", "bb"}, {"ccc", "dddd"}, {"e"}}, 1000))
+	assert.Equal(t, []int{334, 333, 333}, embeddingPartTokens([][]any{{1.0}, {2.0}, {3.0}}, 1000))
+}
+
+func TestEmbeddingBatchSplitting(t *testing.T) {
+	client := &embeddingHttpClient{}
+	openai := NewOpenAI(&RouteConfig{
+		Forward:  FAKE_BASE_URL,
+		Provider: "openai",
+		Models: map[string]ModelConfig{
+			"text-embedding-ada-002": {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60, TokensPerMinute: 60000, EmbeddingBatch: &EmbeddingBatchConfig{MaxInputs: 2}},
+		},
+	}, client)
+	handler := openai.GetHandler()
+
+	body := `{"model": "text-embedding-ada-002", "input": ["a", "bb", "ccc", "dddd", "eeeee"]}`
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "http://localhost:8080/openai/v1/embeddings", bytes.NewBufferString(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 3, client.calls)
+
+	// The client sees one response, its embeddings in the order of its inputs
+	var response struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+		Usage struct {
+			TotalTokens int `json:"total_tokens"`
+		} `json:"usage"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	require.Len(t, response.Data, 5)
+	for i, embedding := range response.Data {
+		assert.Equal(t, i, embedding.Index)
+		assert.Equal(t, []float64{float64(i + 1)}, embedding.Embedding)
+	}
+	assert.Equal(t, 5, response.Usage.TotalTokens)
+
+	// Each part took a request's capacity, and its share of the request's tokens once
+	admitted, _ := openai.schedulers["text-embedding-ada-002"].Counts()
+	assert.Equal(t, uint64(3), admitted)
+	assert.InDelta(t, 59000, openai.schedulers["text-embedding-ada-002"].Snapshot().TokenCapacity, 10)
+
+	// A part that can't be admitted fails the whole request
+	openai.schedulers["text-embedding-ada-002"].Config.QueueMode = QueueModeReject
+	openai.schedulers["text-embedding-ada-002"].setCapacity(1, 60000)
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "http://localhost:8080/openai/v1/embeddings", bytes.NewBufferString(body)))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, string(RejectRateLimited), w.Header().Get(HeaderRejectReason))
+}
+
+func TestEmbeddingBatchRouteLimit(t *testing.T) {
+	client := &embeddingHttpClient{}
+	openai := NewOpenAI(&RouteConfig{
+		Forward:  FAKE_BASE_URL,
+		Provider: "openai",
+		Models: map[string]ModelConfig{
+			"text-embedding-ada-002": {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60, TokensPerMinute: 60000, EmbeddingBatch: &EmbeddingBatchConfig{MaxInputs: 2}},
+		},
+		RouteLimit: &RouteLimitConfig{MaxQueueSize: 1, MaxQueueWait: 0.1, ReqsPerMinute: 2, TokensPerMinute: 60000},
+	}, client)
+	handler := openai.GetHandler()
+
+	// Each part is admitted by the route limit too, the third finding it out of requests
+	body := `{"model": "text-embedding-ada-002", "input": ["a", "bb", "ccc", "dddd", "eeeee"]}`
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "http://localhost:8080/openai/v1/embeddings", bytes.NewBufferString(body)))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), "after 2 of 3 parts")
+	assert.Equal(t, 2, client.calls)
+
+	admitted, rejected := openai.routeLimit.scheduler.Counts()
+	assert.Equal(t, uint64(2), admitted)
+	assert.Equal(t, uint64(1), rejected)
+}
+
+func TestEmbeddingBatchOverLimits(t *testing.T) {
+	client := &embeddingHttpClient{}
+	openai := NewOpenAI(&RouteConfig{
+		Forward:  FAKE_BASE_URL,
+		Provider: "openai",
+		Models: map[string]ModelConfig{
+			"text-embedding-ada-002": {MaxQueueSize: 10, MaxQueueWait: 0.1, ReqsPerMinute: 60, TokensPerMinute: 600, EmbeddingBatch: &EmbeddingBatchConfig{MaxInputs: 2}},
+		},
+	}, client)
+	handler := openai.GetHandler()
+
+	// A batch over the model's tpm isn't rejected as too large when each part fits, its parts are sent as there's
+	// capacity for them, here only for the first within the minute
+	body := `{"model": "text-embedding-ada-002", "input": ["a", "bb", "ccc", "dddd", "e"]}`
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "http://localhost:8080/openai/v1/embeddings", bytes.NewBufferString(body)))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), "after 1 of 3 parts")
+	assert.Equal(t, 1, client.calls)
+
+	// A part that doesn't fit on its own is still too large
+	client.calls = 0
+	body = fmt.Sprintf(`{"model": "text-embedding-ada-002", "input": ["a", "b", "%s", "c"]}`, strings.Repeat("x", 40))
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "http://localhost:8080/openai/v1/embeddings", bytes.NewBufferString(body)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, 0, client.calls)
+}
@@ -0,0 +1,108 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// EndpointConfig allows requests to the paths under a route matching Path, with one of Methods, or any method when
+// there are none. Path is matched like path.Match, so "*" stands for one segment, and a Path ending in "/**" also
+// matches every path below it.
+type EndpointConfig struct {
+	Path    string   `json:"path"`
+	Methods []string `json:"methods"`
+}
+
+func (c EndpointConfig) validate() error {
+	if !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("endpoint path '%s' must start with /", c.Path)
+	}
+	if _, err := path.Match(strings.TrimSuffix(c.Path, "/**"), ""); err != nil {
+		return fmt.Errorf("endpoint path '%s' is invalid: %v", c.Path, err)
+	}
+	return nil
+}
+
+// matches is whether the endpoint allows a request with the method to the cleaned path below the route segment
+func (c EndpointConfig) matches(method string, requestPath string) bool {
+	if len(c.Methods) > 0 {
+		allowed := false
+		for _, m := range c.Methods {
+			allowed = allowed || strings.EqualFold(m, method)
+		}
+		if !allowed {
+			return false
+		}
+	}
+
+	pattern := c.Path
+	if prefix := strings.TrimSuffix(pattern, "/**"); prefix != pattern {
+		// The prefix's own segments are matched against as many of the path's
+		segments := strings.Count(prefix, "/")
+		if parts := strings.Split(requestPath, "/"); len(parts) > segments+1 {
+			requestPath = strings.Join(parts[:segments+1], "/")
+		}
+		pattern = prefix
+	}
+	matched, _ := path.Match(pattern, requestPath)
+	return matched
+}
+
+// endpointAllowlist is the endpoints requests may reach, every one when it's empty
+type endpointAllowlist []EndpointConfig
+
+// Allows is whether the request's method and path, below the route segment, are allowed. Paths that aren't clean,
+// e.g. with ".." segments the upstream might resolve to somewhere else, are never allowed by a non-empty list.
+func (l endpointAllowlist) Allows(r *http.Request) bool {
+	if len(l) == 0 {
+		return true
+	}
+	requestPath := routeRelativePath(r.URL.Path)
+	cleaned := path.Clean(requestPath)
+	if cleaned != requestPath && cleaned+"/" != requestPath {
+		return false
+	}
+	for _, endpoint := range l {
+		if endpoint.matches(r.Method, cleaned) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeRelativePath is the path below the route segment, the layout endpoints are configured in
+func routeRelativePath(requestPath string) string {
+	segments := strings.SplitN(strings.TrimPrefix(requestPath, "/"), "/", 2)
+	if len(segments) < 2 {
+		return "/"
+	}
+	return "/" + segments[1]
+}
+
+// writeEndpointForbidden rejects a request to an endpoint the route, or the model, doesn't allow
+func writeEndpointForbidden(w http.ResponseWriter, r *http.Request, model string) {
+	routeLog(r.Context()).Debugw("Rejecting request", "url", r.URL, "method", r.Method, "model", model, "reason", "EndpointForbidden")
+	message := fmt.Sprintf("%s %s is not allowed on this route", r.Method, routeRelativePath(r.URL.Path))
+	if model != "" {
+		message = fmt.Sprintf("%s %s is not allowed for model '%s'", r.Method, routeRelativePath(r.URL.Path), model)
+	}
+	writeRejection(w, http.StatusForbidden, ErrTypeInvalidRequest, ErrCodeEndpointForbidden, RejectEndpointForbidden, message)
+}
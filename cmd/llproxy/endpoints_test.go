@@ -0,0 +1,85 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEndpointAllowlist(t *testing.T) {
+	allowlist := endpointAllowlist{
+		{Path: "/v1/chat/completions", Methods: []string{"POST"}},
+		{Path: "/v1/threads/*/runs"},
+		{Path: "/v1/batches/**"},
+	}
+	allows := func(method string, path string) bool {
+		return allowlist.Allows(httptest.NewRequest(method, "http://localhost:8080/openai"+path, nil))
+	}
+
+	assert.True(t, allows("POST", "/v1/chat/completions"))
+	assert.False(t, allows("GET", "/v1/chat/completions"))
+	assert.True(t, allows("GET", "/v1/threads/thread_1/runs"))
+	assert.False(t, allows("GET", "/v1/threads/thread_1/messages"))
+	assert.True(t, allows("GET", "/v1/batches"))
+	assert.True(t, allows("POST", "/v1/batches/batch_1/cancel"))
+	assert.False(t, allows("GET", "/v1/files"))
+	assert.False(t, allows("GET", "/v1/organization/users"))
+
+	// Paths that resolve elsewhere aren't allowed by their prefix
+	assert.False(t, allows("GET", "/v1/batches/../organization/users"))
+
+	assert.True(t, endpointAllowlist(nil).Allows(httptest.NewRequest("GET", "http://localhost:8080/openai/v1/files", nil)))
+	assert.Error(t, EndpointConfig{Path: "v1/files"}.validate())
+	assert.Error(t, EndpointConfig{Path: "/v1/[files"}.validate())
+}
+
+func TestEndpointForbidden(t *testing.T) {
+	openai := NewOpenAI(&RouteConfig{
+		Forward:  FAKE_BASE_URL,
+		Provider: "openai",
+		Models: map[string]ModelConfig{
+			TEST_MODEL:               {MaxQueueSize: 10, MaxQueueWait: 1, ReqsPerMinute: 60, TokensPerMinute: 60000},
+			"text-embedding-3-small": {MaxQueueSize: 10, MaxQueueWait: 1, ReqsPerMinute: 60, TokensPerMinute: 60000, Endpoints: []EndpointConfig{{Path: "/v1/embeddings"}}},
+		},
+		Endpoints: []EndpointConfig{{Path: "/v1/completions", Methods: []string{"POST"}}, {Path: "/v1/embeddings", Methods: []string{"POST"}}},
+	}, &MockHttpClient{})
+	handler := openai.GetHandler()
+
+	send := func(method string, path string, model string) *httptest.ResponseRecorder {
+		body := []byte(fmt.Sprintf(`{"model": "%s", "prompt": "test", "input": "test", "max_tokens": 10}`, model))
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(method, "http://localhost:8080/openai"+path, bytes.NewBuffer(body)))
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, send("POST", "/v1/completions", TEST_MODEL).Code)
+	w := send("GET", "/v1/files", "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, string(RejectEndpointForbidden), w.Header().Get(HeaderRejectReason))
+	assert.Contains(t, w.Body.String(), "GET /v1/files is not allowed on this route")
+
+	// A model's own endpoints restrict it further
+	assert.Equal(t, http.StatusOK, send("POST", "/v1/embeddings", "text-embedding-3-small").Code)
+	w = send("POST", "/v1/completions", "text-embedding-3-small")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "not allowed for model 'text-embedding-3-small'")
+}
@@ -0,0 +1,186 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Environment variables a config can be given in when there's no file, e.g. in serverless and minimal containers.
+// LLPROXY_CONFIG holds a whole config as JSON and LLPROXY_ROUTES the routes object, the other variables override them.
+const (
+	EnvConfig = "LLPROXY_CONFIG"
+	EnvRoutes = "LLPROXY_ROUTES"
+)
+
+// Variables for the app and logging sections, by their field in the config
+var envSettings = []struct {
+	env     string
+	section string
+	field   string
+	kind    string
+}{
+	{"LLPROXY_PORT", "app", "port", "number"},
+	{"LLPROXY_HEALTH_PORT", "app", "healthPort", "number"},
+	{"LLPROXY_ADMIN_PORT", "app", "adminPort", "number"},
+	{"LLPROXY_TOKENIZER_DIR", "app", "tokenizerDir", "string"},
+	{"LLPROXY_LOG_LEVEL", "logging", "level", "string"},
+	{"LLPROXY_LOG_TYPE", "logging", "type", "string"},
+	{"LLPROXY_ACCESS_LOG", "logging", "accessLog", "bool"},
+	{"LLPROXY_ACCESS_LOG_FORMAT", "logging", "accessLogFormat", "string"},
+}
+
+// Variables of the structured scheme, LLPROXY_ROUTE_<i>_<name> for routes and LLPROXY_ROUTE_<i>_MODEL_<j>_<name>
+// for their models. Routes and models are numbered from 0 and read until one has no NAME.
+var (
+	envRouteFields = map[string][2]string{
+		"FORWARD":              {"forward", "string"},
+		"PROVIDER":             {"provider", "string"},
+		"API_KEY_ENV":          {"apiKeyEnv", "string"},
+		"MODELS":               {"models", "json"},
+		"DEFAULT_MODEL_CONFIG": {"defaultModelConfig", "json"},
+	}
+	envModelFields = map[string][2]string{
+		"RPM":            {"rpm", "number"},
+		"TPM":            {"tpm", "number"},
+		"MAX_QUEUE_SIZE": {"maxQueueSize", "number"},
+		"MAX_QUEUE_WAIT": {"maxQueueWait", "number"},
+	}
+)
+
+// envConfigured is true when the environment holds a config
+func envConfigured() bool {
+	return os.Getenv(EnvConfig) != "" || os.Getenv(EnvRoutes) != "" || os.Getenv("LLPROXY_ROUTE_0_NAME") != ""
+}
+
+// LoadConfigFromEnv reads the config from the environment instead of a file
+func LoadConfigFromEnv() Config {
+	data, err := envConfigJSON()
+	if err != nil {
+		panic(fmt.Errorf("Failed to read config from the environment: %v", err))
+	}
+	return parseConfig(data, "environment")
+}
+
+// envConfigJSON assembles the config the environment describes, to be parsed like a file
+func envConfigJSON() ([]byte, error) {
+	config := make(map[string]any)
+	if err := unmarshalEnv(EnvConfig, &config); err != nil {
+		return nil, err
+	}
+	section := func(parent map[string]any, name string) map[string]any {
+		if child, ok := parent[name].(map[string]any); ok {
+			return child
+		}
+		child := make(map[string]any)
+		parent[name] = child
+		return child
+	}
+
+	for _, setting := range envSettings {
+		if err := setFromEnv(section(config, setting.section), setting.field, setting.env, setting.kind); err != nil {
+			return nil, err
+		}
+	}
+
+	routes := section(config, "routes")
+	var envRoutes map[string]any
+	if err := unmarshalEnv(EnvRoutes, &envRoutes); err != nil {
+		return nil, err
+	}
+	for name, route := range envRoutes {
+		routes[name] = route
+	}
+
+	for i := 0; ; i++ {
+		prefix := fmt.Sprintf("LLPROXY_ROUTE_%d_", i)
+		name := os.Getenv(prefix + "NAME")
+		if name == "" {
+			break
+		}
+		route := section(routes, name)
+		if _, ok := route["provider"]; !ok {
+			route["provider"] = "openai"
+		}
+		for suffix, field := range envRouteFields {
+			if err := setFromEnv(route, field[0], prefix+suffix, field[1]); err != nil {
+				return nil, err
+			}
+		}
+
+		for j := 0; ; j++ {
+			modelPrefix := fmt.Sprintf("%sMODEL_%d_", prefix, j)
+			model := os.Getenv(modelPrefix + "NAME")
+			if model == "" {
+				break
+			}
+			modelConfig := section(section(route, "models"), model)
+			for suffix, field := range envModelFields {
+				if err := setFromEnv(modelConfig, field[0], modelPrefix+suffix, field[1]); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return json.Marshal(config)
+}
+
+// unmarshalEnv unmarshals the JSON in an environment variable, leaving v alone if it isn't set
+func unmarshalEnv(name string, v any) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(value), v); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// setFromEnv sets a config field from an environment variable of the given kind, if it's set
+func setFromEnv(fields map[string]any, field string, name string, kind string) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	switch kind {
+	case "number":
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%s: '%s' isn't a number", name, value)
+		}
+		fields[field] = number
+	case "bool":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s: '%s' isn't true or false", name, value)
+		}
+		fields[field] = enabled
+	case "json":
+		var parsed any
+		if err := unmarshalEnv(name, &parsed); err != nil {
+			return err
+		}
+		fields[field] = parsed
+	default:
+		fields[field] = value
+	}
+	return nil
+}
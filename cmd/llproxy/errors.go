@@ -0,0 +1,263 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Error types as used by OpenAI
+const (
+	ErrTypeInvalidRequest = "invalid_request_error"
+	ErrTypeRequests       = "requests"
+	ErrTypeServer         = "server_error"
+)
+
+// Machine readable codes for errors generated by the proxy itself
+const (
+	ErrCodeInvalidRequest      = "invalid_request"
+	ErrCodeRateLimitExceeded   = "rate_limit_exceeded"
+	ErrCodeRequestTooLarge     = "request_too_large"
+	ErrCodeNoSchedulerForModel = "no_scheduler_for_model"
+	ErrCodeUpstreamError       = "upstream_error"
+	ErrCodeUploadTooLarge      = "upload_too_large"
+	ErrCodeRouteDisabled       = "route_disabled"
+	ErrCodeModelDisabled       = "model_disabled"
+	ErrCodeOverloaded          = "overloaded"
+	ErrCodeModelRetired        = "model_retired"
+	ErrCodeSamplingGuardrail   = "sampling_guardrail"
+	ErrCodeDuplicateStorm      = "duplicate_storm"
+	ErrCodeEndpointForbidden   = "endpoint_forbidden"
+	ErrCodeUnauthorized        = "unauthorized"
+
+	// As OpenAI reports it, so clients handle the proxy's check the same way
+	ErrCodeContextLengthExceeded = "context_length_exceeded"
+)
+
+// RejectReason is why the proxy turned a request away. Unlike messages these are stable, so clients can branch on them.
+type RejectReason string
+
+const (
+	RejectQueueFull         RejectReason = "queue_full"
+	RejectRateLimited       RejectReason = "rate_limited"
+	RejectOverBudget        RejectReason = "over_budget"
+	RejectModelForbidden    RejectReason = "model_forbidden"
+	RejectTooLarge          RejectReason = "too_large"
+	RejectDeadlineExceeded  RejectReason = "deadline_exceeded"
+	RejectOverloaded        RejectReason = "overloaded"
+	RejectModelRetired      RejectReason = "model_retired"
+	RejectDuplicateStorm    RejectReason = "duplicate_storm"
+	RejectEndpointForbidden RejectReason = "endpoint_forbidden"
+)
+
+// HeaderRejectReason is set to the RejectReason on responses the proxy rejected
+const HeaderRejectReason = "X-LLProxy-Reject-Reason"
+
+// RejectReasonDoc documents a RejectReason for the admin endpoint
+type RejectReasonDoc struct {
+	Reason      RejectReason `json:"reason"`
+	Retryable   bool         `json:"retryable"`
+	Description string       `json:"description"`
+}
+
+var rejectReasons = []RejectReasonDoc{
+	{RejectQueueFull, true, "The model's queue is at its maximum size. Retry after the Retry-After delay."},
+	{RejectRateLimited, true, "There is no capacity within the rate limits and the request wasn't queued. Retry after the Retry-After delay."},
+	{RejectOverBudget, false, "An allowance for the period has been used up, such as the route's fine-tuning jobs per day. Retrying won't succeed until the period resets."},
+	{RejectModelForbidden, false, "The model isn't served by this route. Retrying won't succeed, use a configured model."},
+	{RejectTooLarge, false, "The request can never be admitted, it exceeds the model's context window, its tokens per minute or a size limit. Make the request smaller."},
+	{RejectDeadlineExceeded, true, "The request would wait in the queue longer than the maximum allowed. Retry later, or with a smaller request."},
+	{RejectOverloaded, true, "The proxy is handling as many requests, or as many request body bytes, as it allows at once. Retry after the Retry-After delay."},
+	{RejectModelRetired, false, "The model has passed its sunset date and is blocked. Retrying won't succeed, use the replacement model the message names."},
+	{RejectDuplicateStorm, true, "The client sent the same request too many times in a short window, e.g. retrying without backing off. Retry after the Retry-After delay, once the response to an earlier copy has been handled."},
+	{RejectEndpointForbidden, false, "The route, or the model asked for, doesn't allow the endpoint or method. Retrying won't succeed, use an allowed endpoint."},
+}
+
+// rejectReasonFor is the reason for a scheduler's response when it doesn't give a more specific one
+func rejectReasonFor(response Response) RejectReason {
+	switch response {
+	case RateLimit:
+		return RejectRateLimited
+	case RequestTooLarge:
+		return RejectTooLarge
+	}
+	return ""
+}
+
+// ErrorResponse matches the shape of OpenAI error bodies so SDKs can parse proxy rejections
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    string  `json:"code"`
+
+	// Only set when the proxy rejected the request
+	Reason RejectReason `json:"reason,omitempty"`
+
+	// Only set when the route or model is disabled, for applications to show a maintenance message
+	Maintenance *Disabled `json:"maintenance,omitempty"`
+}
+
+// RequestError is returned while parsing a request when it should be rejected with something other than a 400
+type RequestError struct {
+	Status  int
+	Type    string
+	Code    string
+	Reason  RejectReason
+	Message string
+}
+
+func (e *RequestError) Error() string {
+	return e.Message
+}
+
+// writeRequestError writes err with its own status and code if it is a RequestError, otherwise as a 400
+func writeRequestError(w http.ResponseWriter, err error) {
+	var requestError *RequestError
+	if errors.As(err, &requestError) {
+		writeRejection(w, requestError.Status, requestError.Type, requestError.Code, requestError.Reason, requestError.Message)
+		return
+	}
+	writeError(w, http.StatusBadRequest, ErrTypeInvalidRequest, ErrCodeInvalidRequest, err.Error())
+}
+
+func writeError(w http.ResponseWriter, status int, errType string, code string, message string) {
+	writeRejection(w, status, errType, code, "", message)
+}
+
+// writeRejection is writeError for requests turned away by policy, reporting why in the body and HeaderRejectReason
+// The message may be replaced by the operator's template for the reason.
+func writeRejection(w http.ResponseWriter, status int, errType string, code string, reason RejectReason, message string) {
+	message = rejections.Message(w, status, reason, message)
+	writeErrorDetail(w, status, ErrorDetail{Message: message, Type: errType, Code: code, Reason: reason})
+}
+
+// writeErrorDetail is writeRejection for errors carrying more than a message, the message being prefixed here
+func writeErrorDetail(w http.ResponseWriter, status int, detail ErrorDetail) {
+	recentErrors.Add(RecentError{Time: time.Now(), Status: status, Type: detail.Type, Code: detail.Code, Reason: detail.Reason, Message: detail.Message})
+
+	message := detail.Message
+	detail.Message = "LLProxy: " + message
+	body, err := json.Marshal(ErrorResponse{Error: detail})
+	if err != nil {
+		// Should never happen, but fall back to plain text rather than an empty response
+		zap.S().Errorw("Unable to encode error response", "reason", err)
+		http.Error(w, "LLProxy: "+message, status)
+		return
+	}
+
+	if detail.Reason != "" {
+		w.Header().Set(HeaderRejectReason, string(detail.Reason))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// rejectionResponse is writeRejection as a response, for clients that turn a request away part way through sending it
+func rejectionResponse(status int, errType string, code string, reason RejectReason, message string) *http.Response {
+	message = rejections.Message(nil, status, reason, message)
+	recentErrors.Add(RecentError{Time: time.Now(), Status: status, Type: errType, Code: code, Reason: reason, Message: message})
+
+	body, _ := json.Marshal(ErrorResponse{
+		Error: ErrorDetail{
+			Message: "LLProxy: " + message,
+			Type:    errType,
+			Code:    code,
+			Reason:  reason,
+		},
+	})
+	header := http.Header{"Content-Type": []string{"application/json"}}
+	if reason != "" {
+		header.Set(HeaderRejectReason, string(reason))
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     header,
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+	}
+}
+
+// replaceWithBadGateway swaps an upstream response the proxy couldn't process for a 502, so nothing half read or
+// unchecked reaches the client
+func replaceWithBadGateway(resp *http.Response, message string) {
+	resp.Body.Close()
+	body, _ := json.Marshal(ErrorResponse{Error: ErrorDetail{Message: message, Type: ErrTypeServer, Code: ErrCodeUpstreamError}})
+	resp.StatusCode = http.StatusBadGateway
+	resp.Header = http.Header{"Content-Type": []string{"application/json"}}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// How many errors are kept for the admin endpoints
+const maxRecentErrors = 100
+
+// RecentError is an error the proxy returned to a client
+type RecentError struct {
+	Time    time.Time    `json:"time"`
+	Status  int          `json:"status"`
+	Type    string       `json:"type"`
+	Code    string       `json:"code"`
+	Reason  RejectReason `json:"reason,omitempty"`
+	Message string       `json:"message"`
+}
+
+// errorRing keeps the most recent errors, overwriting the oldest once full
+type errorRing struct {
+	mu      sync.Mutex
+	entries []RecentError
+	next    int
+}
+
+var recentErrors = &errorRing{}
+
+func (e *errorRing) Add(entry RecentError) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.entries) < maxRecentErrors {
+		e.entries = append(e.entries, entry)
+		return
+	}
+	e.entries[e.next] = entry
+	e.next = (e.next + 1) % maxRecentErrors
+}
+
+// List returns the recent errors, newest first
+func (e *errorRing) List() []RecentError {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	list := make([]RecentError, 0, len(e.entries))
+	for i := len(e.entries) - 1; i >= 0; i-- {
+		list = append(list, e.entries[(e.next+i)%len(e.entries)])
+	}
+	return list
+}
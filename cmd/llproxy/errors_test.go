@@ -0,0 +1,88 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRejectReasons(t *testing.T) {
+	openai := NewOpenAI(&RouteConfig{
+		Forward:  FAKE_BASE_URL,
+		Provider: "openai",
+		Models: map[string]ModelConfig{
+			TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 30, ReqsPerMinute: 60, TokensPerMinute: 60000},
+		},
+	}, &MockHttpClient{})
+	scheduler := openai.schedulers[TEST_MODEL]
+	handler := openai.GetHandler()
+
+	reject := func(body string) (int, RejectReason) {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewBufferString(body)))
+		var response ErrorResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, string(response.Error.Reason), w.Header().Get(HeaderRejectReason))
+		return w.Code, response.Error.Reason
+	}
+
+	status, reason := reject(`{"model": "gpt-4", "prompt": "Hello"}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, RejectModelForbidden, reason)
+
+	status, reason = reject(`{"model": "gpt-3.5-turbo", "prompt": "Hello", "max_tokens": 100000}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, RejectTooLarge, reason)
+
+	// Waiting out a deficit this deep would take longer than MaxQueueWait
+	scheduler.setCapacity(60, -100000)
+	status, reason = reject(`{"model": "gpt-3.5-turbo", "prompt": "Hello"}`)
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	assert.Equal(t, RejectDeadlineExceeded, reason)
+
+	scheduler.Config.QueueMode = QueueModeReject
+	status, reason = reject(`{"model": "gpt-3.5-turbo", "prompt": "Hello"}`)
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	assert.Equal(t, RejectRateLimited, reason)
+
+	// Errors that aren't rejections carry no reason
+	w := httptest.NewRecorder()
+	writeError(w, http.StatusBadRequest, ErrTypeInvalidRequest, ErrCodeInvalidRequest, "bad request")
+	assert.Empty(t, w.Header().Get(HeaderRejectReason))
+	assert.NotContains(t, w.Body.String(), `"reason"`)
+}
+
+func TestRejectReasonCodes(t *testing.T) {
+	w := httptest.NewRecorder()
+	newAdminRouter(Providers{}).ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8082/admin/errors/codes", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var docs []RejectReasonDoc
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &docs))
+	reasons := []RejectReason{}
+	for _, doc := range docs {
+		assert.NotEmpty(t, doc.Description)
+		reasons = append(reasons, doc.Reason)
+	}
+	assert.Equal(t, []RejectReason{RejectQueueFull, RejectRateLimited, RejectOverBudget, RejectModelForbidden, RejectTooLarge, RejectDeadlineExceeded, RejectOverloaded, RejectModelRetired, RejectDuplicateStorm, RejectEndpointForbidden}, reasons)
+}
@@ -0,0 +1,125 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"sync/atomic"
+)
+
+// When max_tokens is not set in the request and the model doesn't configure otherwise estimate 15
+// Based on openai cookbook:
+// https://github.com/openai/openai-cookbook/blob/main/examples/api_request_parallel_processor.py
+const defaultResponseTokens = 15
+
+// Learned estimates are an exponentially weighted average over roughly this many responses
+const responseTokenWindow = 100
+
+// responseTokenEstimate is how many tokens a model is expected to respond with when the request doesn't set max_tokens.
+// It starts at the configured value and, when learning, follows the completion tokens reported in responses.
+type responseTokenEstimate struct {
+	learn   bool
+	average atomic.Uint64 // math.Float64bits of the current estimate
+}
+
+func newResponseTokenEstimate(config ModelConfig) *responseTokenEstimate {
+	initial := config.ResponseTokens
+	if initial < 1 {
+		initial = defaultResponseTokens
+	}
+	estimate := &responseTokenEstimate{learn: config.LearnResponseTokens}
+	estimate.average.Store(math.Float64bits(float64(initial)))
+	return estimate
+}
+
+// Tokens is the current estimate for a single choice
+func (e *responseTokenEstimate) Tokens() int {
+	return int(math.Ceil(math.Float64frombits(e.average.Load())))
+}
+
+// Observe folds the completion tokens of one choice into the estimate
+func (e *responseTokenEstimate) Observe(tokens float64) {
+	for {
+		old := e.average.Load()
+		average := math.Float64frombits(old)
+		average += (tokens - average) / responseTokenWindow
+		if e.average.CompareAndSwap(old, math.Float64bits(average)) {
+			return
+		}
+	}
+}
+
+// Hook returns a ResponseHook learning from the usage reported for a request of n choices, or nil when not learning.
+// Streamed and compressed responses are ignored.
+func (e *responseTokenEstimate) Hook(n int) ResponseHook {
+	if !e.learn {
+		return nil
+	}
+	if n < 1 {
+		n = 1
+	}
+	return func(resp *http.Response) {
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" {
+			return
+		}
+		if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "application/json" {
+			return
+		}
+
+		// Read the body for the usage, then put it back so it can still be sent to the client
+		bodyRaw, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(bodyRaw))
+		if err != nil {
+			return
+		}
+
+		var response struct {
+			Usage *struct {
+				CompletionTokens int `json:"completion_tokens"`
+			} `json:"usage"`
+		}
+		if json.Unmarshal(bodyRaw, &response) != nil || response.Usage == nil {
+			return
+		}
+		e.Observe(float64(response.Usage.CompletionTokens) / float64(n))
+	}
+}
+
+// tokensForRequest estimates a request's tokens using the scheduler's response estimate where the request leaves it open
+func tokensForRequest(request Request, scheduler *Scheduler) (int, error) {
+	switch request := request.(type) {
+	case *ChatCompletionRequest:
+		return request.tokensWithResponseEstimate(scheduler.responseTokens.Tokens())
+	case *CompletionRequest:
+		return request.tokensWithResponseEstimate(scheduler.responseTokens.Tokens())
+	}
+	return request.TokensForRequest()
+}
+
+// responseTokenHook learns the scheduler's response estimate from requests that relied on it
+func responseTokenHook(request Request, scheduler *Scheduler) ResponseHook {
+	if chat, ok := request.(*ChatCompletionRequest); ok && chat.MaxTokens < 1 && !chat.Stream {
+		return scheduler.responseTokens.Hook(chat.N)
+	}
+	return nil
+}
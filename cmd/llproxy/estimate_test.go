@@ -0,0 +1,64 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponseTokenEstimate_Default(t *testing.T) {
+	assert.Equal(t, defaultResponseTokens, newResponseTokenEstimate(ModelConfig{}).Tokens())
+	assert.Equal(t, 400, newResponseTokenEstimate(ModelConfig{ResponseTokens: 400}).Tokens())
+
+	// Without learning there is nothing to hook
+	assert.Nil(t, newResponseTokenEstimate(ModelConfig{ResponseTokens: 400}).Hook(1))
+}
+
+func TestResponseTokenEstimate_Learn(t *testing.T) {
+	estimate := newResponseTokenEstimate(ModelConfig{ResponseTokens: 100, LearnResponseTokens: true})
+
+	respond := func(body string, contentType string) *http.Response {
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{contentType}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+		}
+		estimate.Hook(2)(resp)
+		return resp
+	}
+
+	// Two choices of 300 tokens each pull the estimate towards 300, and the body is still sent on
+	body := `{"usage": {"prompt_tokens": 10, "completion_tokens": 600, "total_tokens": 610}}`
+	resp := respond(body, "application/json")
+	sent, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, body, string(sent))
+	assert.Equal(t, 102, estimate.Tokens())
+
+	for i := 0; i < 1000; i++ {
+		respond(body, "application/json")
+	}
+	assert.InDelta(t, 300, estimate.Tokens(), 1)
+
+	// Responses without usage are ignored
+	respond(`{"usage": {"completion_tokens": 0}}`, "text/event-stream")
+	respond(`{"object": "list"}`, "application/json")
+	assert.InDelta(t, 300, estimate.Tokens(), 1)
+}
@@ -0,0 +1,264 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// What the proxy would do with an explained request
+const (
+	OutcomeAdmit   = "admit"
+	OutcomeQueue   = "queue"
+	OutcomeReject  = "reject"
+	OutcomeForward = "forward"
+)
+
+// ExplainRequest is a sample request to explain, as a client would send it to the route
+type ExplainRequest struct {
+	Route   string            `json:"route"`
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers"`
+	Body    json.RawMessage   `json:"body"`
+}
+
+// Explanation is how the proxy would handle a request right now, and which limits it would be held to
+type Explanation struct {
+	Route     string           `json:"route"`
+	Path      string           `json:"path"`
+	Model     string           `json:"model,omitempty"`
+	Tokens    float64          `json:"tokens"`
+	Client    string           `json:"client"`
+	Priority  int              `json:"priority"`
+	Scope     string           `json:"scope,omitempty"`
+	Scheduler *SchedulerStatus `json:"scheduler,omitempty"`
+	Outcome   string           `json:"outcome"`
+	Reason    string           `json:"reason,omitempty"`
+	Wait      float64          `json:"wait"`
+	Limits    []ExplainLimit   `json:"limits"`
+}
+
+// ExplainLimit is one of the limits that apply to an explained request
+type ExplainLimit struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Detail string `json:"detail"`
+}
+
+// postExplain answers an ExplainRequest with the Explanation from its route, without sending or scheduling anything.
+// The sample is identified like any other request, so a client key in its headers shows that client's limits.
+func postExplain(providers Providers, keys clientKeys, defaultPriority PriorityPolicy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var sample ExplainRequest
+		if err := decodeJSON(r.Body, &sample); err != nil {
+			writeError(w, http.StatusBadRequest, ErrTypeInvalidRequest, ErrCodeInvalidRequest, fmt.Sprintf("Invalid explain request: %s", err))
+			return
+		}
+		provider, ok := providers[sample.Route]
+		if !ok {
+			writeError(w, http.StatusNotFound, ErrTypeInvalidRequest, ErrCodeInvalidRequest, fmt.Sprintf("No route '%s'", sample.Route))
+			return
+		}
+		if sample.Method == "" {
+			sample.Method = http.MethodPost
+		}
+
+		req, err := http.NewRequestWithContext(r.Context(), sample.Method, "/"+sample.Route+sample.Path, bytes.NewReader(sample.Body))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, ErrTypeInvalidRequest, ErrCodeInvalidRequest, fmt.Sprintf("Invalid explain request: %s", err))
+			return
+		}
+		for name, value := range sample.Headers {
+			req.Header.Set(name, value)
+		}
+		if req.Header.Get("Content-Type") == "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		identifyClients(keys, defaultPriority)(func(w http.ResponseWriter, req *http.Request) {
+			explanation, err := provider.Explain(req)
+			if err != nil {
+				zap.S().Debugw("Bad Request", "url", req.URL, "reason", err.Error())
+				writeRequestError(w, err)
+				return
+			}
+			explanation.Route = sample.Route
+			if explanation.Scheduler != nil {
+				explanation.Scheduler.Route = sample.Route
+			}
+			writeJSON(w, explanation)
+		})(w, req)
+	}
+}
+
+// Explain works out what GetHandler would do with a request, without forwarding it or taking any capacity.
+// It decides with the handler's own checks and routing, up to the schedulers.
+func (o *OpenAIProvider) Explain(r *http.Request) (Explanation, error) {
+	client, priority := clientFromContext(r.Context())
+	r, allowed, err := o.prepareRequest(r)
+	if !allowed {
+		explanation := Explanation{Path: r.URL.Path, Client: client.Name, Priority: priority, Outcome: OutcomeReject, Reason: "EndpointForbidden"}
+		explanation.limit("endpoints", r.Method, "the route's endpoint allowlist")
+		return explanation, nil
+	}
+	if err != nil {
+		return Explanation{}, err
+	}
+	routed, err := o.routeRequest(r)
+	if err != nil {
+		return Explanation{}, err
+	}
+	model, request := routed.model, routed.request
+
+	explanation := Explanation{Path: r.URL.Path, Model: model, Client: client.Name, Priority: priority, Outcome: OutcomeForward}
+	explanation.limit("client", client.Name, fmt.Sprintf("priority %d, allowed %d to %d", priority, client.Priority.Min, client.Priority.Max))
+	if model != routed.requested {
+		explanation.limit("routing", routed.requested, fmt.Sprintf("sent to model '%s' by a routing rule", model))
+	}
+	if !routed.allowed {
+		explanation.limit("endpoints", model, "the model's endpoint allowlist")
+		explanation.Outcome, explanation.Reason = OutcomeReject, "EndpointForbidden"
+		return explanation, nil
+	}
+
+	if disabled, which, ok := o.maintenance.Check(model); ok {
+		explanation.limit("maintenance", which, disabled.Message)
+		explanation.Outcome, explanation.Reason = OutcomeReject, "Disabled"
+		return explanation, nil
+	}
+
+	if model == "" {
+		// Requests without a model can only be limited by their path
+		class := pathClass(r.URL.Path)
+		if scheduler, ok := o.pathLimits.Schedulers()[class]; ok {
+			explanation.limit("path", class, fmt.Sprintf("rpm %g, bytesPerMinute %g", scheduler.Limits().ReqsPerMinute, scheduler.Limits().TokensPerMinute))
+			explanation.schedule(class, scheduler, math.Max(0, float64(r.ContentLength)))
+		}
+		return explanation, nil
+	}
+
+	schedulers, scope, batch := o.schedulersFor(r, request, false)
+	if scope != "" {
+		explanation.Scope = scope
+		explanation.limit("scope", scope, "schedulers of its own for the scope")
+	}
+	scheduler, ok := schedulers[model]
+	if !ok {
+		explanation.Outcome, explanation.Reason = OutcomeReject, "NoSchedulerForModel"
+		return explanation, nil
+	}
+	tokens, err := tokensForRequest(request, scheduler)
+	if err != nil {
+		explanation.Outcome, explanation.Reason = OutcomeReject, "TokensForRequestError"
+		return explanation, nil
+	}
+
+	if scheduler.Config.ContextWindow > 0 {
+		explanation.limit("contextWindow", model, fmt.Sprintf("%d tokens of prompt and max_tokens", scheduler.Config.ContextWindow))
+		if checkContextWindow(request, scheduler.Config.ContextWindow) != nil {
+			explanation.Tokens = float64(tokens)
+			explanation.Outcome, explanation.Reason = OutcomeReject, "ContextLengthExceeded"
+			return explanation, nil
+		}
+	}
+
+	if !batch && o.credentials.For(model, batch) == "" {
+		if key := o.keyPool.Peek(model, float64(tokens)); key != nil {
+			explanation.limit("key", key.env, "the key with capacity soonest, whose own limits apply")
+			scheduler = key.schedulers[model]
+		}
+	}
+
+	limits := scheduler.Limits()
+	explanation.limit("model", model, fmt.Sprintf("rpm %g, tpm %g", limits.ReqsPerMinute, limits.TokensPerMinute))
+	if scheduler.Config.SmallRequestReserve > 0 {
+		explanation.limit("smallRequestReserve", model, fmt.Sprintf("%g of tpm kept for requests of at most %g tokens", scheduler.Config.SmallRequestReserve, scheduler.Config.SmallRequestTokens))
+	}
+	explanation.schedule(model, scheduler, float64(tokens))
+
+	// Admitted by its scope, the request then waits for the pool the scopes share
+	if pool := o.scopeQuota.Pool(scope, batch, model); pool != nil {
+		limits := pool.Limits()
+		explanation.limit("scopeQuota", model, fmt.Sprintf("rpm %g, tpm %g shared by the route's scopes", limits.ReqsPerMinute, limits.TokensPerMinute))
+		explanation.then(pool, float64(tokens), "Pool")
+	}
+
+	// Admitted by the model, the request then waits for the route's limit shared with its other models
+	if route := o.routeLimit.Schedulers()[routeLimitModel]; route != nil {
+		limits := route.Limits()
+		explanation.limit("route", routeLimitModel, fmt.Sprintf("rpm %g, tpm %g across the route's models", limits.ReqsPerMinute, limits.TokensPerMinute))
+		explanation.then(route, float64(tokens), "Route")
+	}
+	return explanation, nil
+}
+
+// then adds what a scheduler the request waits for after the first would do, unless it's already rejected
+func (e *Explanation) then(scheduler *Scheduler, tokens float64, prefix string) {
+	if e.Outcome == OutcomeReject {
+		return
+	}
+	if outcome, reason, wait := scheduler.predict(tokens); outcome == OutcomeReject {
+		e.Outcome, e.Reason, e.Wait = outcome, prefix+reason, 0
+	} else if wait > 0 {
+		e.Outcome, e.Wait = outcome, e.Wait+wait
+	}
+}
+
+func (e *Explanation) limit(kind string, name string, detail string) {
+	e.Limits = append(e.Limits, ExplainLimit{Kind: kind, Name: name, Detail: detail})
+}
+
+// schedule fills in the scheduler's state and what it would do with a request of the given size
+func (e *Explanation) schedule(name string, scheduler *Scheduler, tokens float64) {
+	status := schedulerStatus("", name, scheduler)
+	e.Scheduler, e.Tokens = &status, tokens
+	e.Outcome, e.Reason, e.Wait = scheduler.predict(tokens)
+}
+
+// predict is the outcome Submit would have for a request of the given size right now, its reason if rejected,
+// and the seconds it would wait if queued
+func (scheduler *Scheduler) predict(tokens float64) (string, string, float64) {
+	if tokens > scheduler.Limits().TokensPerMinute {
+		return OutcomeReject, "RequestTooLarge", 0
+	}
+	snapshot := scheduler.Snapshot()
+	if snapshot.QueuedRequests == 0 && snapshot.RequestCapacity >= 1 && snapshot.TokenCapacity >= scheduler.requiredCapacity(tokens) {
+		return OutcomeAdmit, "", 0
+	}
+
+	wait := scheduler.WaitEstimate(tokens)
+	switch scheduler.Config.QueueMode {
+	case QueueModeReject:
+		return OutcomeReject, "NoCapacity", 0
+	case QueueModeShed:
+	default:
+		if scheduler.Config.MaxQueueWait > 0 && wait > scheduler.Config.MaxQueueWait {
+			return OutcomeReject, "MaxQueueWait", wait
+		}
+	}
+	if snapshot.QueuedRequests >= scheduler.maxQueueDepth() {
+		return OutcomeReject, "MaxQueueSize", wait
+	}
+	return OutcomeQueue, "", wait
+}
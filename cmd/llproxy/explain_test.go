@@ -0,0 +1,128 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExplain(t *testing.T) {
+	openai := NewOpenAI(&RouteConfig{
+		Forward:  FAKE_BASE_URL,
+		Provider: "openai",
+		Models: map[string]ModelConfig{
+			TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 30, ReqsPerMinute: 60, TokensPerMinute: 60000},
+		},
+	}, &MockHttpClient{})
+	config := &Config{Clients: []ClientConfig{{Name: "chat-frontend", Key: "secret", Priority: &PriorityPolicy{Default: 1, Min: 0, Max: 5}}}}
+	handler := postExplain(Providers{"openai": openai}, newClientKeys(config), config.DefaultPriority)
+
+	explain := func(body string) (int, Explanation) {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "http://localhost:8082/admin/explain", bytes.NewBufferString(body)))
+		var explanation Explanation
+		json.Unmarshal(w.Body.Bytes(), &explanation)
+		return w.Code, explanation
+	}
+	sample := fmt.Sprintf(`{"route": "openai", "path": "/v1/completions", "headers": {"X-LLProxy-Key": "secret"}, "body": {"model": "%s", "prompt": "test", "max_tokens": 100}}`, TEST_MODEL)
+
+	code, explanation := explain(sample)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, TEST_MODEL, explanation.Model)
+	assert.Equal(t, "chat-frontend", explanation.Client)
+	assert.Equal(t, 1, explanation.Priority)
+	assert.Equal(t, OutcomeAdmit, explanation.Outcome)
+	assert.Equal(t, "openai", explanation.Scheduler.Route)
+	assert.Greater(t, explanation.Tokens, 100.0)
+	assert.Equal(t, []string{"client", "model"}, []string{explanation.Limits[0].Kind, explanation.Limits[1].Kind})
+
+	// Nothing was taken from the scheduler
+	assert.Equal(t, 60.0, openai.schedulers[TEST_MODEL].Snapshot().RequestCapacity)
+
+	openai.schedulers[TEST_MODEL].setCapacity(0, 60000)
+	_, explanation = explain(sample)
+	assert.Equal(t, OutcomeQueue, explanation.Outcome)
+	assert.InDelta(t, 1.0, explanation.Wait, 0.1)
+
+	openai.schedulers[TEST_MODEL].setCapacity(-60, 60000)
+	_, explanation = explain(sample)
+	assert.Equal(t, OutcomeReject, explanation.Outcome)
+	assert.Equal(t, "MaxQueueWait", explanation.Reason)
+
+	_, explanation = explain(`{"route": "openai", "path": "/v1/completions", "body": {"model": "unknown", "prompt": "test"}}`)
+	assert.Equal(t, "anonymous", explanation.Client)
+	assert.Equal(t, "NoSchedulerForModel", explanation.Reason)
+
+	_, explanation = explain(`{"route": "openai", "method": "GET", "path": "/v1/files"}`)
+	assert.Equal(t, OutcomeForward, explanation.Outcome)
+
+	code, _ = explain(`{"route": "other", "path": "/v1/completions"}`)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestExplainSharesHandlerDecisions(t *testing.T) {
+	openai := NewOpenAI(&RouteConfig{
+		Forward:        FAKE_BASE_URL,
+		Provider:       "openai",
+		SchedulerScope: []string{"OpenAI-Organization"},
+		Models: map[string]ModelConfig{
+			TEST_MODEL:               {MaxQueueSize: 10, MaxQueueWait: 30, ReqsPerMinute: 60, TokensPerMinute: 60000},
+			"text-embedding-3-small": {MaxQueueSize: 10, MaxQueueWait: 30, ReqsPerMinute: 60, TokensPerMinute: 60000, Endpoints: []EndpointConfig{{Path: "/v1/embeddings"}}},
+		},
+		ScopeQuota:   &ScopeQuotaConfig{Share: 0.5},
+		RoutingRules: []RoutingRuleConfig{{Match: RoutingMatch{Models: []string{"gpt-3.5-turbo-legacy"}}, Model: TEST_MODEL}},
+	}, &MockHttpClient{})
+	handler := postExplain(Providers{"openai": openai}, newClientKeys(&Config{}), PriorityPolicy{})
+
+	explain := func(body string) Explanation {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "http://localhost:8082/admin/explain", bytes.NewBufferString(body)))
+		var explanation Explanation
+		json.Unmarshal(w.Body.Bytes(), &explanation)
+		return explanation
+	}
+
+	// A routing rule's model is the one explained, and a scope's request is held to the pool the scopes share,
+	// without the scope being created
+	explanation := explain(`{"route": "openai", "path": "/v1/completions", "headers": {"OpenAI-Organization": "org-a"}, "body": {"model": "gpt-3.5-turbo-legacy", "prompt": "test"}}`)
+	assert.Equal(t, TEST_MODEL, explanation.Model)
+	assert.Equal(t, "org-a", explanation.Scope)
+	assert.Equal(t, 30.0, explanation.Scheduler.ReqsPerMinute)
+	kinds := []string{}
+	for _, limit := range explanation.Limits {
+		kinds = append(kinds, limit.Kind)
+	}
+	assert.Equal(t, []string{"client", "routing", "scope", "model", "scopeQuota"}, kinds)
+	assert.Empty(t, openai.scopes.All())
+
+	openai.schedulers[TEST_MODEL].setCapacity(0, 60000)
+	openai.schedulers[TEST_MODEL].Config.QueueMode = QueueModeReject
+	explanation = explain(`{"route": "openai", "path": "/v1/completions", "headers": {"OpenAI-Organization": "org-a"}, "body": {"model": "gpt-3.5-turbo-legacy", "prompt": "test"}}`)
+	assert.Equal(t, OutcomeReject, explanation.Outcome)
+	assert.Equal(t, "PoolNoCapacity", explanation.Reason)
+
+	// Models are held to their endpoint allowlist
+	explanation = explain(`{"route": "openai", "path": "/v1/completions", "body": {"model": "text-embedding-3-small", "prompt": "test"}}`)
+	assert.Equal(t, OutcomeReject, explanation.Outcome)
+	assert.Equal(t, "EndpointForbidden", explanation.Reason)
+}
@@ -0,0 +1,222 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// FaultInjectionConfig makes a route misbehave on purpose, so clients can test their retries and backoff against it.
+// It's meant for staging, never production.
+type FaultInjectionConfig struct {
+	// RateLimitPercent of requests are answered with a 429 before they're scheduled
+	RateLimitPercent float64 `json:"rateLimitPercent"`
+
+	// LatencyJitter is the most seconds of delay added to each request, chosen uniformly
+	LatencyJitter float64 `json:"latencyJitter"`
+
+	// DropStreamPercent of event stream responses have their connection closed part way through
+	DropStreamPercent float64 `json:"dropStreamPercent"`
+}
+
+func (c *FaultInjectionConfig) enabled() bool {
+	return c.RateLimitPercent > 0 || c.LatencyJitter > 0 || c.DropStreamPercent > 0
+}
+
+// A dropped stream is cut after a random number of events up to this
+const maxDropStreamEvents = 10
+
+// errStreamDropped ends a response body whose stream is being dropped
+var errStreamDropped = errors.New("stream dropped by fault injection")
+
+// faultInjector holds a route's fault injection settings, which can be changed while running through the admin API
+type faultInjector struct {
+	config atomic.Pointer[FaultInjectionConfig]
+	random func() float64
+}
+
+func newFaultInjector(config *FaultInjectionConfig) *faultInjector {
+	f := &faultInjector{random: rand.Float64}
+	if config != nil && config.enabled() {
+		zap.S().Warnw("Fault injection enabled", "rateLimitPercent", config.RateLimitPercent, "latencyJitter", config.LatencyJitter, "dropStreamPercent", config.DropStreamPercent)
+		f.Set(*config)
+	}
+	return f
+}
+
+// Set replaces the settings, turning fault injection off when none are set
+func (f *faultInjector) Set(config FaultInjectionConfig) {
+	if !config.enabled() {
+		f.config.Store(nil)
+		return
+	}
+	f.config.Store(&config)
+}
+
+// Get returns the current settings, zero when off
+func (f *faultInjector) Get() FaultInjectionConfig {
+	if config := f.config.Load(); config != nil {
+		return *config
+	}
+	return FaultInjectionConfig{}
+}
+
+// Inject delays the request and may answer it with a 429, returning false if it was answered or the client gave up
+func (f *faultInjector) Inject(w http.ResponseWriter, r *http.Request) bool {
+	config := f.config.Load()
+	if config == nil {
+		return true
+	}
+
+	if config.LatencyJitter > 0 {
+		delay := time.Duration(f.random() * config.LatencyJitter * float64(time.Second))
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return false
+		}
+	}
+
+	if f.random()*100 < config.RateLimitPercent {
+		zap.S().Debugw("Rejecting request", "url", r.URL, "reason", "FaultInjected")
+		w.Header().Set(HeaderRetryAfter, "1")
+		writeRejection(w, http.StatusTooManyRequests, ErrTypeRequests, ErrCodeRateLimitExceeded, RejectRateLimited, "RateLimit exceeded (injected fault)")
+		return false
+	}
+	return true
+}
+
+// Hook returns a ResponseHook cutting some event streams short, nil when streams aren't dropped
+func (f *faultInjector) Hook() ResponseHook {
+	config := f.config.Load()
+	if config == nil || config.DropStreamPercent <= 0 {
+		return nil
+	}
+	return func(resp *http.Response) {
+		if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/event-stream" {
+			return
+		}
+		if f.random()*100 >= config.DropStreamPercent {
+			return
+		}
+		resp.Body = &droppedStream{ReadCloser: resp.Body, events: 1 + int(f.random()*maxDropStreamEvents)}
+	}
+}
+
+// droppedStream passes on events until it has passed the given number, then fails with errStreamDropped
+type droppedStream struct {
+	io.ReadCloser
+	events  int
+	newline bool
+}
+
+func (d *droppedStream) Read(p []byte) (int, error) {
+	if d.events <= 0 {
+		return 0, errStreamDropped
+	}
+	n, err := d.ReadCloser.Read(p)
+
+	// Events end with a blank line, stop at the end of the last one we pass on
+	for i := 0; i < n; i++ {
+		if p[i] == '\n' {
+			if d.newline {
+				d.events--
+				if d.events == 0 {
+					return i + 1, nil
+				}
+			}
+			d.newline = true
+		} else if p[i] != '\r' {
+			d.newline = false
+		}
+	}
+	return n, err
+}
+
+// FaultStatus is a route's fault injection settings for the admin endpoints
+type FaultStatus struct {
+	Route string `json:"route"`
+	FaultInjectionConfig
+}
+
+func getFaultStatus(providers Providers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		statuses := []FaultStatus{}
+		for _, route := range sortedRoutes(providers) {
+			if config := providers[route].Faults().Get(); config.enabled() {
+				statuses = append(statuses, FaultStatus{Route: route, FaultInjectionConfig: config})
+			}
+		}
+		writeJSON(w, statuses)
+	}
+}
+
+// handleSetFaults adds the endpoint changing fault injection while running, which can break production traffic, so
+// it's only added when the config allows it and always needs the admin token
+func handleSetFaults(router *Router, providers Providers) {
+	router.Handle("/admin/faults/set", []string{http.MethodPost}, setFaults(providers), requireAdminAuth)
+}
+
+// setFaults replaces the fault injection settings of the route in a FaultStatus request body, all zero turns it off
+func setFaults(providers Providers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request FaultStatus
+		if err := decodeJSON(r.Body, &request); err != nil {
+			writeError(w, http.StatusBadRequest, ErrTypeInvalidRequest, ErrCodeInvalidRequest, fmt.Sprintf("Invalid fault injection request: %s", err))
+			return
+		}
+		provider, ok := providers[request.Route]
+		if !ok {
+			writeError(w, http.StatusNotFound, ErrTypeInvalidRequest, ErrCodeInvalidRequest, fmt.Sprintf("No route '%s'", request.Route))
+			return
+		}
+		if err := request.validate(); err != nil {
+			writeError(w, http.StatusBadRequest, ErrTypeInvalidRequest, ErrCodeInvalidRequest, err.Error())
+			return
+		}
+
+		zap.S().Warnw("Setting fault injection", "route", request.Route, "rateLimitPercent", request.RateLimitPercent, "latencyJitter", request.LatencyJitter, "dropStreamPercent", request.DropStreamPercent)
+		provider.Faults().Set(request.FaultInjectionConfig)
+		writeJSON(w, request)
+	}
+}
+
+func (c *FaultInjectionConfig) validate() error {
+	if c.RateLimitPercent < 0 || c.RateLimitPercent > 100 || c.DropStreamPercent < 0 || c.DropStreamPercent > 100 {
+		return fmt.Errorf("fault injection percentages must be within [0, 100]")
+	}
+	if c.LatencyJitter < 0 {
+		return fmt.Errorf("fault injection latencyJitter can't be negative")
+	}
+	return nil
+}
+
+// dropOnInjectedFault aborts the connection if err is a stream being dropped, so the client sees it cut rather than ended
+func dropOnInjectedFault(err error) {
+	if errors.Is(err, errStreamDropped) {
+		panic(http.ErrAbortHandler)
+	}
+}
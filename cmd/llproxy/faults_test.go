@@ -0,0 +1,96 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFaultInjection(t *testing.T) {
+	openai := NewOpenAI(&RouteConfig{
+		Forward:        FAKE_BASE_URL,
+		Provider:       "openai",
+		Models:         map[string]ModelConfig{TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60, TokensPerMinute: 60000}},
+		FaultInjection: &FaultInjectionConfig{RateLimitPercent: 100},
+	}, &MockHttpClient{})
+	handler := openai.GetHandler()
+	admin := newAdminRouter(Providers{"openai": openai})
+
+	send := func() *httptest.ResponseRecorder {
+		body := []byte(fmt.Sprintf(`{"model": "%s", "prompt": "test"}`, TEST_MODEL))
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewBuffer(body)))
+		return w
+	}
+
+	// Injected 429s take no capacity
+	w := send()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get(HeaderRetryAfter))
+	assert.Equal(t, 60.0, openai.schedulers[TEST_MODEL].Snapshot().RequestCapacity)
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8082/admin/faults", nil))
+	assert.JSONEq(t, `[{"route": "openai", "rateLimitPercent": 100, "latencyJitter": 0, "dropStreamPercent": 0}]`, w.Body.String())
+
+	// Turned off through the admin API, when it's allowed and with the token
+	post := func(body string) int {
+		r := httptest.NewRequest("POST", "http://localhost:8082/admin/faults/set", bytes.NewBufferString(body))
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusNotFound, post(`{"route": "openai"}`))
+	handleSetFaults(admin, Providers{"openai": openai})
+	assert.Equal(t, http.StatusForbidden, post(`{"route": "openai"}`))
+	withAdminAuth(t, "secret")
+	assert.Equal(t, http.StatusBadRequest, post(`{"route": "openai", "rateLimitPercent": 150}`))
+	assert.Equal(t, http.StatusNotFound, post(`{"route": "other"}`))
+	assert.Equal(t, http.StatusOK, post(`{"route": "openai"}`))
+	assert.Equal(t, http.StatusOK, send().Code)
+	assert.Nil(t, openai.Faults().Hook())
+}
+
+func TestFaultInjectionDropStream(t *testing.T) {
+	faults := newFaultInjector(&FaultInjectionConfig{DropStreamPercent: 50})
+	faults.random = func() float64 { return 0.15 }
+
+	stream := strings.Repeat("data: {\"choices\": []}\n\n", 5) + "data: [DONE]\n\n"
+	resp := &http.Response{Header: http.Header{"Content-Type": {"text/event-stream"}}, Body: io.NopCloser(strings.NewReader(stream))}
+	faults.Hook()(resp)
+
+	// Cut after 1 + 0.15 * 10 events
+	data, err := io.ReadAll(resp.Body)
+	assert.ErrorIs(t, err, errStreamDropped)
+	assert.Equal(t, strings.Repeat("data: {\"choices\": []}\n\n", 2), string(data))
+
+	// Other responses, and streams beyond the percentage, are left alone
+	faults.random = func() float64 { return 0.6 }
+	resp = &http.Response{Header: http.Header{"Content-Type": {"text/event-stream"}}, Body: io.NopCloser(strings.NewReader(stream))}
+	faults.Hook()(resp)
+	data, err = io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, stream, string(data))
+}
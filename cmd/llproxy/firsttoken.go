@@ -0,0 +1,124 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the time to first token histogram's buckets, in seconds
+var firstTokenBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// firstTokenSeries is the histogram of the time to first token of one route, model and upstream
+type firstTokenSeries struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// firstTokenRegistry keeps the time to first token of streamed responses, written in the Prometheus text format
+type firstTokenRegistry struct {
+	mu     sync.Mutex
+	series map[string]*firstTokenSeries
+}
+
+var firstTokenMetrics = &firstTokenRegistry{}
+
+// Observe counts the time a streamed response took to send its first chunk
+func (m *firstTokenRegistry) Observe(route string, model string, upstream string, seconds float64) {
+	key := strings.Join([]string{metricLabel("route", route), metricLabel("model", model), metricLabel("upstream", upstream)}, ",")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.series == nil {
+		m.series = make(map[string]*firstTokenSeries)
+	}
+	series, ok := m.series[key]
+	if !ok {
+		series = &firstTokenSeries{buckets: make([]uint64, len(firstTokenBuckets))}
+		m.series[key] = series
+	}
+	for i, bound := range firstTokenBuckets {
+		if seconds <= bound {
+			series.buckets[i]++
+		}
+	}
+	series.count++
+	series.sum += seconds
+}
+
+// Write writes the histogram of every series in the Prometheus text exposition format
+func (m *firstTokenRegistry) Write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintln(w, "# HELP llproxy_time_to_first_token_seconds Time from a streamed request arriving to its first chunk being sent to the client, including time queued.")
+	fmt.Fprintln(w, "# TYPE llproxy_time_to_first_token_seconds histogram")
+	for _, key := range keys {
+		series := m.series[key]
+		for i, bound := range firstTokenBuckets {
+			fmt.Fprintf(w, "llproxy_time_to_first_token_seconds_bucket{%s,le=\"%g\"} %d\n", key, bound, series.buckets[i])
+		}
+		fmt.Fprintf(w, "llproxy_time_to_first_token_seconds_bucket{%s,le=\"+Inf\"} %d\n", key, series.count)
+		fmt.Fprintf(w, "llproxy_time_to_first_token_seconds_sum{%s} %g\n", key, series.sum)
+		fmt.Fprintf(w, "llproxy_time_to_first_token_seconds_count{%s} %d\n", key, series.count)
+	}
+}
+
+// firstTokenHook notes when an event stream response's first chunk is passed on to the client, in the request's
+// record and the time to first token metrics of its model and upstream
+func firstTokenHook(record *RequestRecord, upstream string) ResponseHook {
+	if record == nil {
+		return nil
+	}
+	return func(resp *http.Response) {
+		if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/event-stream" {
+			return
+		}
+		resp.Body = &firstTokenBody{ReadCloser: resp.Body, record: record, upstream: upstream}
+	}
+}
+
+// firstTokenBody times the first read of a stream that returns anything
+type firstTokenBody struct {
+	io.ReadCloser
+	record   *RequestRecord
+	upstream string
+	seen     bool
+}
+
+func (b *firstTokenBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.seen {
+		b.seen = true
+		b.record.FirstToken = time.Since(b.record.Start)
+		firstTokenMetrics.Observe(b.record.Route, b.record.Model, b.upstream, b.record.FirstToken.Seconds())
+	}
+	return n, err
+}
@@ -0,0 +1,59 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFirstTokenHook(t *testing.T) {
+	firstTokenMetrics = &firstTokenRegistry{}
+	record := &RequestRecord{Start: time.Now().Add(-300 * time.Millisecond), Route: "openai", Model: TEST_MODEL}
+	stream := "data: {\"choices\": []}\n\ndata: [DONE]\n\n"
+
+	resp := &http.Response{
+		Header: http.Header{"Content-Type": []string{"text/event-stream; charset=utf-8"}},
+		Body:   ioutil.NopCloser(strings.NewReader(stream)),
+	}
+	firstTokenHook(record, "https://east.example.com")(resp)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, stream, string(body))
+	assert.GreaterOrEqual(t, record.FirstToken, 300*time.Millisecond)
+
+	// Other responses aren't timed
+	other := &RequestRecord{Start: time.Now(), Route: "openai", Model: TEST_MODEL}
+	resp = &http.Response{Header: http.Header{"Content-Type": []string{"application/json"}}, Body: ioutil.NopCloser(strings.NewReader("{}"))}
+	firstTokenHook(other, "https://east.example.com")(resp)
+	io.ReadAll(resp.Body)
+	assert.Zero(t, other.FirstToken)
+	assert.Nil(t, firstTokenHook(nil, ""))
+
+	var metrics bytes.Buffer
+	firstTokenMetrics.Write(&metrics)
+	labels := `route="openai",model="gpt-3.5-turbo",upstream="https://east.example.com"`
+	assert.Contains(t, metrics.String(), `llproxy_time_to_first_token_seconds_bucket{`+labels+`,le="0.25"} 0`)
+	assert.Contains(t, metrics.String(), `llproxy_time_to_first_token_seconds_bucket{`+labels+`,le="0.5"} 1`)
+	assert.Contains(t, metrics.String(), `llproxy_time_to_first_token_seconds_count{`+labels+`} 1`)
+}
@@ -0,0 +1,179 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// Guardrail actions, for parameters out of bounds
+const (
+	GuardrailClamp  = "clamp"
+	GuardrailReject = "reject"
+)
+
+// SamplingGuardrailsConfig bounds the sampling parameters of a route's requests, which can balloon cost or fail upstream
+type SamplingGuardrailsConfig struct {
+	// Most completions a request may ask for with n, unbounded when 0
+	MaxN int `json:"maxN"`
+
+	// Allowed ranges of temperature and top_p, unbounded when unset
+	Temperature *ParamRange `json:"temperature"`
+	TopP        *ParamRange `json:"topP"`
+
+	// Most tokens logit_bias may adjust, unbounded when 0. Larger biases are always rejected, as there's no
+	// telling which of their entries matter.
+	MaxLogitBias int `json:"maxLogitBias"`
+
+	// "clamp", the default, brings parameters within bounds, "reject" turns the request away with a 400
+	Action string `json:"action"`
+}
+
+// ParamRange is the inclusive range a numeric parameter may take
+type ParamRange struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+func (c *SamplingGuardrailsConfig) validate() error {
+	switch c.Action {
+	case "", GuardrailClamp, GuardrailReject:
+	default:
+		return fmt.Errorf("samplingGuardrails action '%s' isn't '%s' or '%s'", c.Action, GuardrailClamp, GuardrailReject)
+	}
+	if c.MaxN < 0 || c.MaxLogitBias < 0 {
+		return fmt.Errorf("samplingGuardrails maxN and maxLogitBias can't be negative")
+	}
+	for _, r := range []*ParamRange{c.Temperature, c.TopP} {
+		if r != nil && r.Min > r.Max {
+			return fmt.Errorf("samplingGuardrails range min %g is above its max %g", r.Min, r.Max)
+		}
+	}
+	return nil
+}
+
+// samplingGuardrails clamps or rejects the sampling parameters of JSON request bodies. A nil samplingGuardrails
+// leaves requests unchanged.
+type samplingGuardrails struct {
+	config SamplingGuardrailsConfig
+}
+
+func newSamplingGuardrails(config *SamplingGuardrailsConfig) *samplingGuardrails {
+	if config == nil {
+		return nil
+	}
+	return &samplingGuardrails{config: *config}
+}
+
+// Apply checks the parameters of a JSON POST, rewriting the body if any were clamped. Bodies that aren't a JSON
+// object are left for the parser to reject.
+func (g *samplingGuardrails) Apply(r *http.Request) error {
+	if g == nil || r.Method != http.MethodPost {
+		return nil
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		return nil
+	}
+
+	original, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(original))
+	if err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(original, &fields) != nil || fields == nil {
+		return nil
+	}
+
+	clamped, err := g.check(fields)
+	if err != nil {
+		return err
+	}
+	if len(clamped) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return nil
+	}
+	routeLog(r.Context()).Debugw("Clamped sampling parameters", "url", r.URL, "parameters", clamped)
+
+	// The length has changed, so it has to be set again for the upstream
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// check clamps the parameters out of bounds in fields, returning their names, or an error if they're to be rejected
+func (g *samplingGuardrails) check(fields map[string]json.RawMessage) ([]string, error) {
+	var biases map[string]json.RawMessage
+	if limit := g.config.MaxLogitBias; limit > 0 && json.Unmarshal(fields["logit_bias"], &biases) == nil && len(biases) > limit {
+		return nil, guardrailError(fmt.Sprintf("logit_bias adjusts %d tokens, more than the %d allowed", len(biases), limit))
+	}
+
+	var clamped []string
+	bound := func(name string, min float64, max float64) error {
+		var value float64
+		if json.Unmarshal(fields[name], &value) != nil || (value >= min && value <= max) {
+			return nil
+		}
+		if g.config.Action == GuardrailReject {
+			return guardrailError(fmt.Sprintf("%s of %g is outside the allowed range of %g to %g", name, value, min, max))
+		}
+		if value < min {
+			value = min
+		} else {
+			value = max
+		}
+		fields[name] = json.RawMessage(strconv.FormatFloat(value, 'f', -1, 64))
+		clamped = append(clamped, name)
+		return nil
+	}
+	if g.config.MaxN > 0 {
+		if err := bound("n", 1, float64(g.config.MaxN)); err != nil {
+			return nil, err
+		}
+	}
+	if r := g.config.Temperature; r != nil {
+		if err := bound("temperature", r.Min, r.Max); err != nil {
+			return nil, err
+		}
+	}
+	if r := g.config.TopP; r != nil {
+		if err := bound("top_p", r.Min, r.Max); err != nil {
+			return nil, err
+		}
+	}
+	return clamped, nil
+}
+
+func guardrailError(message string) error {
+	return &RequestError{
+		Status:  http.StatusBadRequest,
+		Type:    ErrTypeInvalidRequest,
+		Code:    ErrCodeSamplingGuardrail,
+		Message: message,
+	}
+}
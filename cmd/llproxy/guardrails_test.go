@@ -0,0 +1,71 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSamplingGuardrails(t *testing.T) {
+	config := &SamplingGuardrailsConfig{MaxN: 4, Temperature: &ParamRange{Min: 0, Max: 1.5}, TopP: &ParamRange{Min: 0.1, Max: 1}, MaxLogitBias: 2}
+	apply := func(guardrails *samplingGuardrails, body string) (map[string]any, error) {
+		r := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/chat/completions", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		if err := guardrails.Apply(r); err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(data)), r.ContentLength)
+		var fields map[string]any
+		require.NoError(t, json.Unmarshal(data, &fields))
+		return fields, nil
+	}
+
+	// Parameters out of bounds are clamped, the rest left alone
+	clamp := newSamplingGuardrails(config)
+	fields, err := apply(clamp, `{"model": "gpt-3.5-turbo", "n": 20, "temperature": 2, "top_p": 0.05, "logit_bias": {"50256": -100}}`)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"model": "gpt-3.5-turbo", "n": 4.0, "temperature": 1.5, "top_p": 0.1, "logit_bias": map[string]any{"50256": -100.0}}, fields)
+
+	fields, err = apply(clamp, `{"model": "gpt-3.5-turbo", "n": 2, "temperature": 0.7}`)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"model": "gpt-3.5-turbo", "n": 2.0, "temperature": 0.7}, fields)
+
+	// Too large a logit_bias is rejected either way
+	_, err = apply(clamp, `{"model": "gpt-3.5-turbo", "logit_bias": {"1": 1, "2": 2, "3": 3}}`)
+	var requestError *RequestError
+	require.ErrorAs(t, err, &requestError)
+	assert.Equal(t, http.StatusBadRequest, requestError.Status)
+	assert.Equal(t, ErrCodeSamplingGuardrail, requestError.Code)
+
+	reject := *config
+	reject.Action = GuardrailReject
+	_, err = apply(newSamplingGuardrails(&reject), `{"model": "gpt-3.5-turbo", "temperature": 2}`)
+	require.ErrorAs(t, err, &requestError)
+	assert.Equal(t, "temperature of 2 is outside the allowed range of 0 to 1.5", requestError.Message)
+
+	assert.Error(t, (&SamplingGuardrailsConfig{Action: "ignore"}).validate())
+	assert.Error(t, (&SamplingGuardrailsConfig{TopP: &ParamRange{Min: 1, Max: 0}}).validate())
+}
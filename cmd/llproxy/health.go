@@ -17,33 +17,56 @@
 package main
 
 import (
-	"fmt"
 	"net/http"
+	"sort"
 	"sync"
-
-	"go.uber.org/zap"
+	"time"
 )
 
 var (
 	isReady = &atomicBool{val: true}
+	started = time.Now()
 )
 
-func HealthStartup(c *Config) {
+// A scheduler loop that hasn't gone round for this long is reported as not alive
+const schedulerLivenessWindow = 10 * time.Second
+
+// InfoZ summarizes the config the proxy is running with, and whether its schedulers are running
+type InfoZ struct {
+	Started  time.Time   `json:"started"`
+	Config   string      `json:"config"`
+	Checksum string      `json:"checksum"`
+	Routes   []RouteInfo `json:"routes"`
+}
+
+type RouteInfo struct {
+	Route       string              `json:"route"`
+	Provider    string              `json:"provider"`
+	Upstreams   []string            `json:"upstreams"`
+	Models      []string            `json:"models"`
+	BatchModels []string            `json:"batchModels,omitempty"`
+	Schedulers  []SchedulerLiveness `json:"schedulers"`
+}
+
+type SchedulerLiveness struct {
+	Model    string    `json:"model"`
+	Scope    string    `json:"scope,omitempty"`
+	LastLoop time.Time `json:"lastLoop"`
+	Alive    bool      `json:"alive"`
+}
+
+func HealthStartup(c *Config, providers Providers) {
 	// We run our health endpoints on a different http server so that we can continue accepting requests
 	// while we are in the process of shutting down
-	livenessMux := http.NewServeMux()
-	livenessMux.HandleFunc("/healthz", getHealthZ())
-	livenessMux.HandleFunc("/readyz", getReadyZ())
+	livenessRouter := NewRouter()
+	probeMethods := []string{http.MethodGet, http.MethodHead}
+	livenessRouter.Handle("/healthz", probeMethods, getHealthZ())
+	livenessRouter.Handle("/readyz", probeMethods, getReadyZ())
+	livenessRouter.Handle("/infoz", []string{http.MethodGet}, getInfoZ(c, providers))
 	livenessServer := &http.Server{
-		Addr:    fmt.Sprintf(":%d", c.Application.HealthPort),
-		Handler: livenessMux,
+		Handler: livenessRouter,
 	}
-
-	go func() {
-		if err := livenessServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			zap.S().Fatal("Liveness server failed: ", err)
-		}
-	}()
+	ServeListeners(&c.Application, ServerHealth, livenessServer)
 }
 
 func HealthShutdown() {
@@ -69,6 +92,55 @@ func getReadyZ() func(http.ResponseWriter, *http.Request) {
 	}
 }
 
+func getInfoZ(c *Config, providers Providers) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, infoZ(c, providers, time.Now()))
+	}
+}
+
+func infoZ(c *Config, providers Providers, now time.Time) InfoZ {
+	info := InfoZ{Started: started, Config: c.source, Checksum: c.checksum, Routes: []RouteInfo{}}
+	for _, route := range sortedRoutes(providers) {
+		config := c.Routes[route]
+		routeInfo := RouteInfo{
+			Route:       route,
+			Provider:    config.Provider,
+			Upstreams:   upstreamURLs(&config),
+			Models:      sortedModels(config.Models),
+			BatchModels: sortedModels(config.BatchModels),
+			Schedulers:  []SchedulerLiveness{},
+		}
+
+		provider := providers[route]
+		for _, schedulers := range append([]SchedulerMap{provider.Schedulers()}, provider.ScopedSchedulers()...) {
+			for _, model := range sortedModels(schedulers) {
+				lastLoop := schedulers[model].LastLoop()
+				routeInfo.Schedulers = append(routeInfo.Schedulers, SchedulerLiveness{
+					Model:    model,
+					Scope:    schedulers[model].Scope,
+					LastLoop: lastLoop,
+					Alive:    now.Sub(lastLoop) < schedulerLivenessWindow,
+				})
+			}
+		}
+		info.Routes = append(info.Routes, routeInfo)
+	}
+	return info
+}
+
+// sortedModels returns the keys of a map of models in order
+func sortedModels[T any](models map[string]T) []string {
+	if len(models) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(models))
+	for name := range models {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 type atomicBool struct {
 	sync.RWMutex
 	val bool
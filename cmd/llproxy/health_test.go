@@ -0,0 +1,54 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInfoZ(t *testing.T) {
+	openai := CreateOpenAI()
+	config := &Config{
+		Routes: map[string]RouteConfig{"openai": {
+			Provider: "openai",
+			Forward:  FAKE_BASE_URL,
+			Models:   map[string]ModelConfig{TEST_MODEL: {}},
+		}},
+		source:   "config.json",
+		checksum: "abc",
+	}
+
+	// The scheduler loop goes round as soon as it starts
+	assert.Eventually(t, func() bool {
+		return !openai.schedulers[TEST_MODEL].LastLoop().IsZero()
+	}, time.Second, 10*time.Millisecond)
+
+	info := infoZ(config, Providers{"openai": openai}, time.Now())
+	assert.Equal(t, "config.json", info.Config)
+	assert.Len(t, info.Routes, 1)
+	assert.Equal(t, "openai", info.Routes[0].Route)
+	assert.Equal(t, []string{FAKE_BASE_URL}, info.Routes[0].Upstreams)
+	assert.Equal(t, []string{TEST_MODEL}, info.Routes[0].Models)
+	assert.Len(t, info.Routes[0].Schedulers, 1)
+	assert.True(t, info.Routes[0].Schedulers[0].Alive)
+
+	// A loop that has stopped going round is reported
+	info = infoZ(config, Providers{"openai": openai}, time.Now().Add(time.Minute))
+	assert.False(t, info.Routes[0].Schedulers[0].Alive)
+}
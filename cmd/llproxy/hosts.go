@@ -0,0 +1,77 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// routeHosts maps each configured hostname to the route it selects
+func routeHosts(routes map[string]RouteConfig) map[string]string {
+	hosts := make(map[string]string)
+	for route, routeConfig := range routes {
+		for _, host := range routeConfig.Hosts {
+			hosts[strings.ToLower(host)] = route
+		}
+	}
+	return hosts
+}
+
+// hostRouting sends requests for a route's hostname to that route, so e.g. openai.llm.internal/v1/chat/completions
+// is handled as /openai/v1/chat/completions. Requests for any other host are routed by path as usual.
+// Requests on a listener serving a single route go to that route whatever their host.
+func hostRouting(hosts map[string]string) Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			route := listenerRoute(r.Context())
+			if route == "" {
+				route = hosts[requestHost(r)]
+			}
+			if route == "" {
+				next(w, r)
+				return
+			}
+			next(w, withRoutePrefix(r, route))
+		}
+	}
+}
+
+// withRoutePrefix returns the request with its path under the route's prefix
+func withRoutePrefix(r *http.Request, route string) *http.Request {
+	// Shallow copy like http.StripPrefix, the original request is left untouched
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = "/" + route + r.URL.Path
+	if r.URL.RawPath != "" {
+		r2.URL.RawPath = "/" + route + r.URL.RawPath
+	}
+	return r2
+}
+
+// requestHost is the request's hostname, lowercased and without a port
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
@@ -0,0 +1,81 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostRouting(t *testing.T) {
+	var paths []string
+	router := NewRouter()
+	router.HandlePrefix("/openai", nil, func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+	})
+	router.Use(hostRouting(routeHosts(map[string]RouteConfig{
+		"openai": {Hosts: []string{"OpenAI.llm.internal"}},
+	})))
+
+	// The hostname selects the route, with or without a port
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "http://openai.llm.internal/v1/chat/completions", nil))
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "http://openai.llm.internal:8080/v1/embeddings", nil))
+
+	// Other hosts are still routed by path
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", nil))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "http://localhost:8080/v1/completions", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	assert.Equal(t, []string{"/openai/v1/chat/completions", "/openai/v1/embeddings", "/openai/v1/completions"}, paths)
+}
+
+func TestListenerRouting(t *testing.T) {
+	var paths []string
+	router := NewRouter()
+	router.HandlePrefix("/openai", nil, func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+	})
+	router.Use(hostRouting(routeHosts(map[string]RouteConfig{"openai": {}})))
+	server := &http.Server{Handler: router, ConnContext: listenerRouteContext}
+	defer server.Close()
+
+	// One listener serves the route at the provider's own paths, the other routes by path
+	routed, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go server.Serve(&routeListener{Listener: routed, route: "openai"})
+	plain, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go server.Serve(plain)
+
+	resp, err := http.Post("http://"+routed.Addr().String()+"/v1/chat/completions", "application/json", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp.Body.Close()
+	resp, err = http.Post("http://"+plain.Addr().String()+"/v1/chat/completions", "application/json", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp.Body.Close()
+	resp, err = http.Post("http://"+plain.Addr().String()+"/openai/v1/embeddings", "application/json", nil)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, []string{"/openai/v1/chat/completions", "/openai/v1/embeddings"}, paths)
+}
@@ -0,0 +1,145 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The stages a request passes through once the proxy knows what it's for
+const (
+	StageHandling = "handling"
+	StageQueued   = "queued"
+	StageUpstream = "upstream"
+)
+
+// requestStage is where a request is at, set by the handler and read by the in-flight report
+type requestStage struct {
+	Name   string
+	Model  string
+	Scope  string
+	Tokens float64
+	Since  time.Time
+}
+
+// SetStage notes the request has moved on to a stage, for a scheduler's model when it has one
+func (record *RequestRecord) SetStage(name string, scheduler *Scheduler, tokens float64) {
+	if record == nil {
+		return
+	}
+	stage := &requestStage{Name: name, Tokens: tokens, Since: time.Now()}
+	if scheduler != nil {
+		stage.Model, stage.Scope = scheduler.Name, scheduler.Scope
+	}
+	record.stage.Store(stage)
+}
+
+// inflightSet holds the record of every request that hasn't finished yet
+type inflightSet struct {
+	mu      sync.Mutex
+	records map[*RequestRecord]struct{}
+}
+
+var inflight = &inflightSet{records: make(map[*RequestRecord]struct{})}
+
+func (s *inflightSet) Add(record *RequestRecord) {
+	s.mu.Lock()
+	s.records[record] = struct{}{}
+	s.mu.Unlock()
+}
+
+func (s *inflightSet) Remove(record *RequestRecord) {
+	s.mu.Lock()
+	delete(s.records, record)
+	s.mu.Unlock()
+}
+
+// InflightGroup summarizes the unfinished requests of one route, model and scope that are at the same stage
+type InflightGroup struct {
+	Route         string  `json:"route"`
+	Model         string  `json:"model,omitempty"`
+	Scope         string  `json:"scope,omitempty"`
+	Stage         string  `json:"stage"`
+	Count         int     `json:"count"`
+	Tokens        float64 `json:"tokens"`
+	OldestSeconds float64 `json:"oldestSeconds"`
+	MeanSeconds   float64 `json:"meanSeconds"`
+	StageSeconds  float64 `json:"stageSeconds"` // the longest any of them has been at the stage
+}
+
+// Report groups the unfinished requests, ages are measured from when each request arrived
+func (s *inflightSet) Report(now time.Time) []InflightGroup {
+	groups := make(map[[4]string]*InflightGroup)
+	s.mu.Lock()
+	for record := range s.records {
+		stage := record.stage.Load()
+		if stage == nil {
+			stage = &requestStage{Name: StageHandling, Since: record.Start}
+		}
+		key := [4]string{record.Route, stage.Model, stage.Scope, stage.Name}
+		group, ok := groups[key]
+		if !ok {
+			group = &InflightGroup{Route: record.Route, Model: stage.Model, Scope: stage.Scope, Stage: stage.Name}
+			groups[key] = group
+		}
+		age := now.Sub(record.Start).Seconds()
+		group.Count++
+		group.Tokens += stage.Tokens
+		group.MeanSeconds += age
+		if age > group.OldestSeconds {
+			group.OldestSeconds = age
+		}
+		if stageAge := now.Sub(stage.Since).Seconds(); stageAge > group.StageSeconds {
+			group.StageSeconds = stageAge
+		}
+	}
+	s.mu.Unlock()
+
+	report := make([]InflightGroup, 0, len(groups))
+	for _, group := range groups {
+		group.MeanSeconds /= float64(group.Count)
+		report = append(report, *group)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		a, b := report[i], report[j]
+		if a.Route != b.Route {
+			return a.Route < b.Route
+		}
+		if a.Model != b.Model {
+			return a.Model < b.Model
+		}
+		if a.Scope != b.Scope {
+			return a.Scope < b.Scope
+		}
+		return a.Stage < b.Stage
+	})
+	return report
+}
+
+// logInflight writes the in-flight report to the log, e.g. on SIGUSR1 or when a shutdown starts
+func logInflight(reason string) {
+	report := inflight.Report(time.Now())
+	total := 0
+	for _, group := range report {
+		total += group.Count
+	}
+	zap.S().Infow("In-flight requests", "reason", reason, "total", total, "groups", report)
+}
@@ -0,0 +1,59 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInflightReport(t *testing.T) {
+	set := &inflightSet{records: make(map[*RequestRecord]struct{})}
+	scheduler := NewScheduler("openai", TEST_MODEL, ModelConfig{})
+	now := time.Now()
+
+	queued := []*RequestRecord{
+		{Route: "openai", Start: now.Add(-3 * time.Second)},
+		{Route: "openai", Start: now.Add(-1 * time.Second)},
+	}
+	for _, record := range queued {
+		record.SetStage(StageQueued, scheduler, 100)
+		set.Add(record)
+	}
+	handling := &RequestRecord{Route: "openai", Start: now.Add(-2 * time.Second)}
+	set.Add(handling)
+
+	report := set.Report(now)
+	assert.Len(t, report, 2)
+	assert.Equal(t, StageHandling, report[0].Stage)
+	assert.Equal(t, 1, report[0].Count)
+
+	assert.Equal(t, TEST_MODEL, report[1].Model)
+	assert.Equal(t, StageQueued, report[1].Stage)
+	assert.Equal(t, 2, report[1].Count)
+	assert.Equal(t, 200.0, report[1].Tokens)
+	assert.InDelta(t, 3.0, report[1].OldestSeconds, 0.001)
+	assert.InDelta(t, 2.0, report[1].MeanSeconds, 0.001)
+
+	set.Remove(handling)
+	assert.Len(t, set.Report(now), 1)
+
+	// Handlers used without recordRequests have no record to set the stage of
+	var record *RequestRecord
+	record.SetStage(StageUpstream, nil, 0)
+}
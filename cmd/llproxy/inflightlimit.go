@@ -0,0 +1,152 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// InflightLimitConfig caps what the proxy holds at once across every route, protecting the process from running
+// out of memory however the models are configured. Either limit may be left out.
+type InflightLimitConfig struct {
+	// Requests that haven't finished yet
+	Requests int64 `json:"requests"`
+
+	// Request bodies of those requests, by their Content-Length or, without one, as they're read
+	BodyBytes int64 `json:"bodyBytes"`
+}
+
+func (c *InflightLimitConfig) validate() error {
+	if c.Requests < 0 || c.BodyBytes < 0 {
+		return fmt.Errorf("maxInflight requests and bodyBytes can't be negative")
+	}
+	return nil
+}
+
+// Read from a body without a Content-Length that takes the bytes in flight over the limit
+var errInflightBytes = errors.New("too many request body bytes in flight")
+
+// inflightLimiter turns requests away with a 503 while the proxy is holding as much as it's allowed to
+type inflightLimiter struct {
+	maxRequests int64
+	maxBytes    int64
+	requests    atomic.Int64
+	bytes       atomic.Int64
+	rejected    atomic.Uint64
+}
+
+// The proxy's in-flight limit, nil when there is none
+var inflightLimit *inflightLimiter
+
+func newInflightLimiter(config InflightLimitConfig) *inflightLimiter {
+	if config.Requests == 0 && config.BodyBytes == 0 {
+		return nil
+	}
+	return &inflightLimiter{maxRequests: config.Requests, maxBytes: config.BodyBytes}
+}
+
+// Middleware admits a request if it fits within the limits, and lets go of what it held once it's done
+func (l *inflightLimiter) Middleware() Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		if l == nil {
+			return next
+		}
+		return func(w http.ResponseWriter, r *http.Request) {
+			requests := l.requests.Add(1)
+			defer l.requests.Add(-1)
+			if l.maxRequests > 0 && requests > l.maxRequests {
+				l.reject(w, r, "InflightRequests")
+				return
+			}
+
+			if l.maxBytes > 0 {
+				size := r.ContentLength
+				if size < 0 {
+					size = 0
+					if r.Body != nil && r.Body != http.NoBody {
+						body := &inflightBody{body: r.Body, limiter: l}
+						defer body.release()
+						r.Body = body
+					}
+				}
+				bytes := l.bytes.Add(size)
+				defer l.bytes.Add(-size)
+				if bytes > l.maxBytes {
+					l.reject(w, r, "InflightBytes")
+					return
+				}
+			}
+			next(w, r)
+		}
+	}
+}
+
+func (l *inflightLimiter) reject(w http.ResponseWriter, r *http.Request, reason string) {
+	l.rejected.Add(1)
+	zap.S().Debugw("Rejecting request", "url", r.URL, "reason", reason)
+	w.Header().Set(HeaderRetryAfter, "1")
+	writeRejection(w, http.StatusServiceUnavailable, ErrTypeServer, ErrCodeOverloaded, RejectOverloaded, "Too many requests in flight, try again shortly")
+}
+
+// WriteMetrics writes what's in flight against the limits, and how many requests they turned away
+func (l *inflightLimiter) WriteMetrics(w io.Writer) {
+	if l == nil {
+		return
+	}
+	fmt.Fprintln(w, "# HELP llproxy_inflight_requests Requests the proxy is handling.")
+	fmt.Fprintln(w, "# TYPE llproxy_inflight_requests gauge")
+	fmt.Fprintf(w, "llproxy_inflight_requests %d\n", l.requests.Load())
+	fmt.Fprintln(w, "# HELP llproxy_inflight_body_bytes Request body bytes of the requests the proxy is handling.")
+	fmt.Fprintln(w, "# TYPE llproxy_inflight_body_bytes gauge")
+	fmt.Fprintf(w, "llproxy_inflight_body_bytes %d\n", l.bytes.Load())
+	fmt.Fprintln(w, "# HELP llproxy_inflight_rejected_total Requests turned away by the in-flight limit.")
+	fmt.Fprintln(w, "# TYPE llproxy_inflight_rejected_total counter")
+	fmt.Fprintf(w, "llproxy_inflight_rejected_total %d\n", l.rejected.Load())
+}
+
+// inflightBody counts a body of unknown length against the limit as it's read, failing the read that goes over
+type inflightBody struct {
+	body    io.ReadCloser
+	limiter *inflightLimiter
+	read    int64
+}
+
+func (b *inflightBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if n > 0 {
+		b.read += int64(n)
+		if b.limiter.bytes.Add(int64(n)) > b.limiter.maxBytes {
+			return n, errInflightBytes
+		}
+	}
+	return n, err
+}
+
+func (b *inflightBody) Close() error {
+	return b.body.Close()
+}
+
+// release gives back the bytes read once the request is done
+func (b *inflightBody) release() {
+	b.limiter.bytes.Add(-b.read)
+}
@@ -0,0 +1,80 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInflightLimit(t *testing.T) {
+	limiter := newInflightLimiter(InflightLimitConfig{Requests: 2, BodyBytes: 100})
+	release := make(chan struct{})
+	entered := make(chan struct{}, 2)
+	handler := limiter.Middleware()(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if r.URL.Path == "/hold" {
+			entered <- struct{}{}
+			<-release
+		}
+	})
+	send := func(path string, body io.Reader) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "http://localhost:8080"+path, body))
+		return w
+	}
+
+	// Two requests held in flight, a third is turned away straight away
+	done := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go func() {
+			send("/hold", strings.NewReader("0123456789"))
+			done <- struct{}{}
+		}()
+	}
+	<-entered
+	<-entered
+	w := send("/", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, string(RejectOverloaded), w.Header().Get(HeaderRejectReason))
+	assert.Equal(t, "1", w.Header().Get(HeaderRetryAfter))
+	assert.Equal(t, int64(20), limiter.bytes.Load())
+	close(release)
+	<-done
+	<-done
+
+	// Bodies are counted by their Content-Length, or as they're read when there's none
+	assert.Equal(t, http.StatusOK, send("/", strings.NewReader(strings.Repeat("x", 100))).Code)
+	assert.Equal(t, http.StatusServiceUnavailable, send("/", strings.NewReader(strings.Repeat("x", 101))).Code)
+	body := &inflightBody{body: io.NopCloser(bytes.NewReader(make([]byte, 150))), limiter: limiter}
+	_, err := io.ReadAll(body)
+	assert.ErrorIs(t, err, errInflightBytes)
+	body.release()
+
+	// Everything is let go once requests finish
+	assert.Equal(t, int64(0), limiter.requests.Load())
+	assert.Equal(t, int64(0), limiter.bytes.Load())
+	assert.Equal(t, uint64(2), limiter.rejected.Load())
+
+	// Without limits requests pass straight through
+	assert.Nil(t, newInflightLimiter(InflightLimitConfig{}))
+}
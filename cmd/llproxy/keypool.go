@@ -0,0 +1,366 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// How a key is chosen from a route's pool
+const (
+	KeyStrategyRoundRobin = "round-robin"
+	KeyStrategyLeastUsed  = "least-used"
+	KeyStrategyFailover   = "failover"
+)
+
+// Seconds a key is passed over after the upstream answers it with a 401 or 429, unless configured
+const defaultKeyCooldown = 60
+
+// APIKeyPoolConfig spreads a route's requests across several upstream keys
+type APIKeyPoolConfig struct {
+	// Environment variables each holding one key
+	KeyEnvs []string `json:"keyEnvs"`
+
+	// "round-robin" when unset, "least-used" for the key with the fewest requests in flight,
+	// or "failover" to use the first key that isn't cooling down
+	Strategy string `json:"strategy"`
+
+	// Seconds a key is passed over after a 401 or 429, 60 when unset
+	Cooldown float64 `json:"cooldown"`
+
+	// Each key has the route's model limits to itself, and requests go to the key with capacity for them
+	// rather than sharing one set of schedulers
+	PerKeyLimits bool `json:"perKeyLimits"`
+}
+
+func (c *APIKeyPoolConfig) validate() error {
+	if len(c.KeyEnvs) == 0 {
+		return fmt.Errorf("apiKeyPool needs at least one of keyEnvs")
+	}
+	seen := make(map[string]bool)
+	for _, name := range c.KeyEnvs {
+		if os.Getenv(name) == "" {
+			return fmt.Errorf("apiKeyPool has keyEnv '%s', which is not set", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("apiKeyPool has keyEnv '%s' more than once", name)
+		}
+		seen[name] = true
+	}
+	switch c.Strategy {
+	case "", KeyStrategyRoundRobin, KeyStrategyLeastUsed, KeyStrategyFailover:
+	default:
+		return fmt.Errorf("apiKeyPool has unknown strategy '%s'", c.Strategy)
+	}
+	if c.Cooldown < 0 {
+		return fmt.Errorf("apiKeyPool cooldown can't be negative")
+	}
+	return nil
+}
+
+// pooledKey is one of a pool's keys along with how it's being used, identified by its environment variable
+// so the key itself is never logged or reported
+type pooledKey struct {
+	env        string
+	key        string
+	disabled   bool
+	coolUntil  time.Time
+	inFlight   int
+	requests   uint64
+	failures   uint64
+	lastStatus int
+
+	// With perKeyLimits, the key's own schedulers
+	schedulers SchedulerMap
+}
+
+// apiKeyPool hands out the route's keys by its strategy. Keys the upstream rejects or rate limits are passed over
+// for a while, and keys can be disabled through the admin API to retire them without dropping any requests.
+type apiKeyPool struct {
+	strategy string
+	cooldown time.Duration
+
+	mu   sync.Mutex
+	keys []*pooledKey
+	next int
+}
+
+// Scope of the schedulers of a key with limits of its own
+func keyScope(env string) string {
+	return "key:" + env
+}
+
+// newAPIKeyPool returns nil when the route doesn't have one
+func newAPIKeyPool(config *RouteConfig) *apiKeyPool {
+	if config.APIKeyPool == nil || len(config.APIKeyPool.KeyEnvs) == 0 {
+		return nil
+	}
+	pool := &apiKeyPool{strategy: config.APIKeyPool.Strategy, cooldown: defaultKeyCooldown * time.Second}
+	if config.APIKeyPool.Cooldown > 0 {
+		pool.cooldown = time.Duration(config.APIKeyPool.Cooldown * float64(time.Second))
+	}
+	for _, name := range config.APIKeyPool.KeyEnvs {
+		key := &pooledKey{env: name, key: os.Getenv(name)}
+		if config.APIKeyPool.PerKeyLimits {
+			key.schedulers = initScopedSchedulers(config.Provider, keyScope(name), config.Models)
+		}
+		pool.keys = append(pool.keys, key)
+	}
+	return pool
+}
+
+// Acquire picks the key to forward a request with, nil without a pool. Every key it returns must be released.
+func (p *apiKeyPool) Acquire() *pooledKey {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.acquire(p.choose(time.Now(), nil))
+}
+
+// AcquireFor picks the key whose own scheduler for the model could take a request of the given size soonest,
+// nil unless the pool has perKeyLimits. Every key it returns must be released.
+func (p *apiKeyPool) AcquireFor(model string, tokens float64) *pooledKey {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key := p.chooseFor(model, tokens); key != nil {
+		return p.acquire(key)
+	}
+	return nil
+}
+
+// Peek is the key AcquireFor would pick right now, without acquiring it
+func (p *apiKeyPool) Peek(model string, tokens float64) *pooledKey {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.chooseFor(model, tokens)
+}
+
+func (p *apiKeyPool) chooseFor(model string, tokens float64) *pooledKey {
+	if _, ok := p.keys[0].schedulers[model]; !ok {
+		return nil
+	}
+	return p.choose(time.Now(), func(key *pooledKey) float64 {
+		return key.schedulers[model].WaitEstimate(tokens)
+	})
+}
+
+func (p *apiKeyPool) acquire(key *pooledKey) *pooledKey {
+	key.inFlight++
+	key.requests++
+	return key
+}
+
+// choose picks from the keys that are enabled and not cooling down, or failing that the enabled key that recovers first.
+// Given the seconds a request would wait with each key, the keys it would wait least with are chosen from.
+func (p *apiKeyPool) choose(now time.Time, wait func(*pooledKey) float64) *pooledKey {
+	var chosen, recovering *pooledKey
+	chosenAt, chosenWait := 0, 0.0
+	for i := range p.keys {
+		// Round robin continues from the key after the last one used
+		index := i
+		if p.strategy == "" || p.strategy == KeyStrategyRoundRobin {
+			index = (p.next + i) % len(p.keys)
+		}
+		key := p.keys[index]
+		if key.disabled {
+			continue
+		}
+		if now.Before(key.coolUntil) {
+			if recovering == nil || key.coolUntil.Before(recovering.coolUntil) {
+				recovering = key
+			}
+			continue
+		}
+		keyWait := 0.0
+		if wait != nil {
+			keyWait = wait(key)
+		}
+		if chosen == nil || keyWait < chosenWait || (keyWait == chosenWait && p.strategy == KeyStrategyLeastUsed && key.inFlight < chosen.inFlight) {
+			chosen, chosenAt, chosenWait = key, index, keyWait
+		}
+	}
+	if chosen == nil {
+		// Every enabled key is cooling down, SetDisabled always leaves one enabled
+		return recovering
+	}
+	p.next = chosenAt + 1
+	return chosen
+}
+
+// Release returns a key once its request is done, with the upstream's status or 0 if it couldn't be reached
+func (p *apiKeyPool) Release(key *pooledKey, status int) {
+	if p == nil || key == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key.inFlight--
+	key.lastStatus = status
+	if status == http.StatusUnauthorized || status == http.StatusTooManyRequests {
+		key.failures++
+		key.coolUntil = time.Now().Add(p.cooldown)
+		zap.S().Infow("Cooling down upstream key", "keyEnv", key.env, "status", status, "cooldown", p.cooldown)
+	}
+}
+
+// SetDisabled takes a key out of rotation, or puts it back. Requests already using it finish as usual.
+func (p *apiKeyPool) SetDisabled(env string, disabled bool) error {
+	if p == nil {
+		return fmt.Errorf("route has no apiKeyPool")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var found *pooledKey
+	enabled := 0
+	for _, key := range p.keys {
+		if key.env == env {
+			found = key
+		}
+		if !key.disabled {
+			enabled++
+		}
+	}
+	if found == nil {
+		return fmt.Errorf("no key '%s' in the route's apiKeyPool", env)
+	}
+	if disabled && !found.disabled && enabled == 1 {
+		return fmt.Errorf("key '%s' is the last enabled key of the route's apiKeyPool", env)
+	}
+	found.disabled = disabled
+	return nil
+}
+
+// APIKeyStatus is how one of a pool's keys is being used, for the admin endpoints
+type APIKeyStatus struct {
+	KeyEnv     string  `json:"keyEnv"`
+	Disabled   bool    `json:"disabled"`
+	Cooldown   float64 `json:"cooldown,omitempty"`
+	InFlight   int     `json:"inFlight"`
+	Requests   uint64  `json:"requests"`
+	Failures   uint64  `json:"failures"`
+	LastStatus int     `json:"lastStatus,omitempty"`
+}
+
+// Schedulers returns the schedulers of every key with limits of its own
+func (p *apiKeyPool) Schedulers() []SchedulerMap {
+	if p == nil {
+		return nil
+	}
+	var schedulers []SchedulerMap
+	for _, key := range p.keys {
+		if key.schedulers != nil {
+			schedulers = append(schedulers, key.schedulers)
+		}
+	}
+	return schedulers
+}
+
+// Status reports every key in the pool, with the seconds left of any cooldown
+func (p *apiKeyPool) Status() []APIKeyStatus {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	statuses := make([]APIKeyStatus, len(p.keys))
+	for i, key := range p.keys {
+		statuses[i] = APIKeyStatus{
+			KeyEnv:     key.env,
+			Disabled:   key.disabled,
+			InFlight:   key.inFlight,
+			Requests:   key.requests,
+			Failures:   key.failures,
+			LastStatus: key.lastStatus,
+		}
+		if now.Before(key.coolUntil) {
+			statuses[i].Cooldown = key.coolUntil.Sub(now).Seconds()
+		}
+	}
+	return statuses
+}
+
+// RouteKeys is the state of a route's key pool, and the request body to disable or enable one of its keys
+type RouteKeys struct {
+	Route    string         `json:"route"`
+	Strategy string         `json:"strategy,omitempty"`
+	Keys     []APIKeyStatus `json:"keys,omitempty"`
+	KeyEnv   string         `json:"keyEnv,omitempty"`
+	Disabled bool           `json:"disabled"`
+}
+
+func getKeyStatus(providers Providers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		statuses := []RouteKeys{}
+		for _, route := range sortedRoutes(providers) {
+			pool := providers[route].KeyPool()
+			if pool == nil {
+				continue
+			}
+			strategy := pool.strategy
+			if strategy == "" {
+				strategy = KeyStrategyRoundRobin
+			}
+			statuses = append(statuses, RouteKeys{Route: route, Strategy: strategy, Keys: pool.Status()})
+		}
+		writeJSON(w, statuses)
+	}
+}
+
+// setKeyDisabled disables or enables the key of a RouteKeys request body, e.g. to retire a key before it's revoked
+func setKeyDisabled(providers Providers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request RouteKeys
+		if err := decodeJSON(r.Body, &request); err != nil {
+			writeError(w, http.StatusBadRequest, ErrTypeInvalidRequest, ErrCodeInvalidRequest, fmt.Sprintf("Invalid keys request: %s", err))
+			return
+		}
+		provider, ok := providers[request.Route]
+		if !ok {
+			writeError(w, http.StatusNotFound, ErrTypeInvalidRequest, ErrCodeInvalidRequest, fmt.Sprintf("No route '%s'", request.Route))
+			return
+		}
+		if err := provider.KeyPool().SetDisabled(request.KeyEnv, request.Disabled); err != nil {
+			writeError(w, http.StatusBadRequest, ErrTypeInvalidRequest, ErrCodeInvalidRequest, err.Error())
+			return
+		}
+
+		zap.S().Warnw("Changed upstream key", "route", request.Route, "keyEnv", request.KeyEnv, "disabled", request.Disabled, "remoteAddr", r.RemoteAddr)
+		request.Keys = provider.KeyPool().Status()
+		writeJSON(w, request)
+	}
+}
@@ -0,0 +1,247 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// The servers a listener can be attached to
+const (
+	ServerProxy  = "proxy"
+	ServerHealth = "health"
+	ServerAdmin  = "admin"
+)
+
+// File descriptors passed by systemd start after stdin, stdout and stderr
+const systemdFirstFD = 3
+
+var (
+	inheritedOnce    sync.Once
+	inheritedSockets map[string][]net.Listener
+)
+
+// ListenerConfig describes one socket a server accepts connections on
+type ListenerConfig struct {
+	Server      string `json:"server"`
+	Address     string `json:"address"`
+	Systemd     string `json:"systemd"`
+	TLSCertFile string `json:"tlsCertFile"`
+	TLSKeyFile  string `json:"tlsKeyFile"`
+
+	// Route serves one route on a proxy listener at the provider's own paths, e.g. /v1/chat/completions,
+	// for SDKs whose base URL can't carry the route prefix
+	Route string `json:"route"`
+}
+
+// ServeListeners starts server on every listener configured for it, exiting if any of them can't be opened.
+// Without configured listeners a socket inherited from systemd with the server's name is used, and otherwise the server's port.
+func ServeListeners(app *AppConfig, name string, server *http.Server) {
+	// Set before any listener is served, connections from listeners that route by path are passed through as they are
+	server.ConnContext = listenerRouteContext
+	for _, config := range listenerConfigs(app, name, inherited()) {
+		listener, err := openListener(config, inherited())
+		if err != nil {
+			zap.S().Fatalw("Unable to open listener", "server", name, "address", config.Address, "systemd", config.Systemd, "reason", err)
+		}
+		if name == ServerAdmin && app.AdminAuth == nil && !loopbackAddress(listener.Addr().String()) {
+			zap.S().Fatalw("The admin server only listens on loopback without app.adminAuth", "address", listener.Addr().String(), "systemd", config.Systemd)
+		}
+		zap.S().Infow("Listening", "server", name, "address", listener.Addr().String(), "tls", config.TLSCertFile != "", "route", config.Route)
+		if config.Route != "" {
+			listener = &routeListener{Listener: listener, route: config.Route}
+		}
+
+		go func(config ListenerConfig, listener net.Listener) {
+			var err error
+			if config.TLSCertFile != "" {
+				err = server.ServeTLS(listener, config.TLSCertFile, config.TLSKeyFile)
+			} else {
+				err = server.Serve(listener)
+			}
+			if err != http.ErrServerClosed {
+				zap.S().Fatalw("Server closed unexpectedly", "server", name, "address", listener.Addr().String(), "reason", err)
+			}
+		}(config, listener)
+	}
+}
+
+// routeListener marks the connections it accepts with the route its listener serves
+type routeListener struct {
+	net.Listener
+	route string
+}
+
+type routeConn struct {
+	net.Conn
+	route string
+}
+
+func (l *routeListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &routeConn{Conn: conn, route: l.route}, nil
+}
+
+type listenerRouteKey struct{}
+
+// listenerRouteContext is a server's ConnContext, carrying the route of the listener a connection came in on
+// to its requests, see listenerRoute
+func listenerRouteContext(ctx context.Context, conn net.Conn) context.Context {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if routed, ok := conn.(*routeConn); ok {
+		return context.WithValue(ctx, listenerRouteKey{}, routed.route)
+	}
+	return ctx
+}
+
+// listenerRoute is the route served by the listener a request came in on, empty for listeners that route by path
+func listenerRoute(ctx context.Context) string {
+	route, _ := ctx.Value(listenerRouteKey{}).(string)
+	return route
+}
+
+// loopbackAddress is whether a listener's host:port address only accepts connections from the same machine
+func loopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// listenerConfigs returns the listeners for the named server, falling back to an inherited socket or the server's port
+func listenerConfigs(app *AppConfig, name string, sockets map[string][]net.Listener) []ListenerConfig {
+	var configs []ListenerConfig
+	for _, config := range app.Listeners {
+		if config.Server == name {
+			configs = append(configs, config)
+		}
+	}
+	if len(configs) > 0 {
+		return configs
+	}
+
+	if len(sockets[name]) > 0 {
+		return []ListenerConfig{{Server: name, Systemd: name}}
+	}
+
+	port, host := app.Port, ""
+	switch name {
+	case ServerHealth:
+		port = app.HealthPort
+	case ServerAdmin:
+		// Without a token anyone who can reach the admin server can change how traffic is sent
+		port = app.AdminPort
+		if app.AdminAuth == nil {
+			host = "127.0.0.1"
+		}
+	}
+	return []ListenerConfig{{Server: name, Address: fmt.Sprintf("%s:%d", host, port)}}
+}
+
+func openListener(config ListenerConfig, sockets map[string][]net.Listener) (net.Listener, error) {
+	if config.Systemd == "" {
+		return net.Listen("tcp", config.Address)
+	}
+
+	// Each inherited socket can only be served once
+	listeners := sockets[config.Systemd]
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no socket named '%s' was passed by systemd", config.Systemd)
+	}
+	sockets[config.Systemd] = listeners[1:]
+	return listeners[0], nil
+}
+
+func inherited() map[string][]net.Listener {
+	inheritedOnce.Do(func() {
+		var err error
+		inheritedSockets, err = systemdListeners()
+		if err != nil {
+			zap.S().Fatalw("Unable to use sockets passed by systemd", "reason", err)
+		}
+	})
+	return inheritedSockets
+}
+
+// systemdListeners takes the sockets passed with systemd socket activation, keyed by their FileDescriptorName
+func systemdListeners() (map[string][]net.Listener, error) {
+	names, err := systemdSocketNames(os.Getpid(), os.Getenv)
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+
+	// Like sd_listen_fds, don't pass the sockets on to any child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	sockets := make(map[string][]net.Listener)
+	for i, name := range names {
+		file := os.NewFile(uintptr(systemdFirstFD+i), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d (%s): %w", systemdFirstFD+i, name, err)
+		}
+		sockets[name] = append(sockets[name], listener)
+	}
+	return sockets, nil
+}
+
+// systemdSocketNames returns the name of each socket passed to this process, in file descriptor order
+func systemdSocketNames(pid int, getenv func(string) string) ([]string, error) {
+	// The sockets were meant for another process, e.g. our parent
+	if getenv("LISTEN_PID") != strconv.Itoa(pid) {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS '%s'", getenv("LISTEN_FDS"))
+	}
+
+	names := make([]string, count)
+	given := strings.Split(getenv("LISTEN_FDNAMES"), ":")
+	for i := range names {
+		// systemd's default name when FileDescriptorName isn't set
+		names[i] = "unknown"
+		if i < len(given) && given[i] != "" {
+			names[i] = given[i]
+		}
+	}
+	return names, nil
+}
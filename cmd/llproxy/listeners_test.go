@@ -0,0 +1,85 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSystemdSocketNames(t *testing.T) {
+	env := map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "3", "LISTEN_FDNAMES": "proxy:admin"}
+	getenv := func(key string) string { return env[key] }
+
+	names, err := systemdSocketNames(42, getenv)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"proxy", "admin", "unknown"}, names)
+
+	// Sockets passed to another process are ignored
+	names, err = systemdSocketNames(7, getenv)
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+
+	env["LISTEN_FDS"] = "x"
+	_, err = systemdSocketNames(42, getenv)
+	assert.Error(t, err)
+}
+
+func TestListenerConfigs(t *testing.T) {
+	app := &AppConfig{
+		Port:       8080,
+		HealthPort: 8081,
+		AdminPort:  8082,
+		Listeners: []ListenerConfig{
+			{Server: ServerProxy, Address: "0.0.0.0:8080"},
+			{Server: ServerProxy, Address: "0.0.0.0:8443", TLSCertFile: "cert.pem", TLSKeyFile: "key.pem"},
+		},
+	}
+
+	// Configured listeners replace the port
+	assert.Len(t, listenerConfigs(app, ServerProxy, nil), 2)
+
+	// Otherwise an inherited socket with the server's name is used
+	inheritedAdmin, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer inheritedAdmin.Close()
+	sockets := map[string][]net.Listener{ServerAdmin: {inheritedAdmin}}
+	assert.Equal(t, []ListenerConfig{{Server: ServerAdmin, Systemd: ServerAdmin}}, listenerConfigs(app, ServerAdmin, sockets))
+
+	// And finally the server's port
+	assert.Equal(t, []ListenerConfig{{Server: ServerHealth, Address: ":8081"}}, listenerConfigs(app, ServerHealth, sockets))
+
+	// The admin server only listens on loopback unless it requires a token
+	assert.Equal(t, []ListenerConfig{{Server: ServerAdmin, Address: "127.0.0.1:8082"}}, listenerConfigs(app, ServerAdmin, nil))
+	app.AdminAuth = &AdminAuthConfig{TokenEnv: "LLPROXY_ADMIN_TOKEN"}
+	assert.Equal(t, []ListenerConfig{{Server: ServerAdmin, Address: ":8082"}}, listenerConfigs(app, ServerAdmin, nil))
+
+	assert.True(t, loopbackAddress("127.0.0.1:8082"))
+	assert.True(t, loopbackAddress("[::1]:8082"))
+	assert.True(t, loopbackAddress("localhost:8082"))
+	assert.False(t, loopbackAddress(":8082"))
+	assert.False(t, loopbackAddress("0.0.0.0:8082"))
+	assert.False(t, loopbackAddress("10.0.0.1:8082"))
+
+	// Inherited sockets are handed out once
+	listener, err := openListener(ListenerConfig{Systemd: ServerAdmin}, sockets)
+	assert.NoError(t, err)
+	assert.Equal(t, inheritedAdmin, listener)
+	_, err = openListener(ListenerConfig{Systemd: ServerAdmin}, sockets)
+	assert.Error(t, err)
+}
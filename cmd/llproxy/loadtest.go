@@ -0,0 +1,310 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type LoadTestConfig struct {
+	Target       string
+	APIKey       string
+	Models       []string
+	Requests     int
+	Duration     time.Duration
+	Concurrency  int
+	PromptTokens int
+	MaxTokens    int
+	StreamRatio  float64
+
+	// Mock runs an in-process proxy in front of a fake upstream instead of using Target
+	Mock        bool
+	MockRPM     float64
+	MockTPM     float64
+	MockLatency time.Duration
+}
+
+type LoadTestResult struct {
+	Requests  int
+	Succeeded int
+	Rejected  int
+	Failed    int
+	Elapsed   time.Duration
+
+	// Latencies of the succeeded requests, sorted
+	Latencies []time.Duration
+}
+
+// loadTestCommand implements `llproxy loadtest`, returning the process exit code
+func loadTestCommand(args []string) int {
+	flags := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	target := flags.String("target", "http://localhost:8080/openai", "base URL of the proxy route to load")
+	apiKey := flags.String("api-key", os.Getenv("OPENAI_API_KEY"), "API key sent with every request")
+	models := flags.String("models", "gpt-3.5-turbo,text-embedding-ada-002", "comma separated models to send traffic for")
+	requests := flags.Int("requests", 100, "total requests to send, 0 to run for -duration")
+	duration := flags.Duration("duration", 0, "how long to send traffic for, 0 to stop after -requests")
+	concurrency := flags.Int("concurrency", 10, "number of concurrent clients")
+	promptTokens := flags.Int("prompt-tokens", 100, "approximate tokens in each prompt or embedding input")
+	maxTokens := flags.Int("max-tokens", 100, "max_tokens requested for chat completions")
+	streamRatio := flags.Float64("stream-ratio", 0, "fraction of chat completions sent with stream enabled")
+	mock := flags.Bool("mock", false, "load an in-process proxy in front of a fake upstream instead of -target")
+	mockRPM := flags.Float64("mock-rpm", 600, "rpm configured for each model of the in-process proxy")
+	mockTPM := flags.Float64("mock-tpm", 1000000, "tpm configured for each model of the in-process proxy")
+	mockLatency := flags.Duration("mock-latency", 0, "time the fake upstream takes to answer")
+	logLevel := flags.String("log-level", "error", "proxy log level when running with -mock")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *requests <= 0 && *duration <= 0 {
+		fmt.Fprintln(os.Stderr, "loadtest: one of -requests or -duration is required")
+		return 2
+	}
+
+	ConfigureLogging(LogType("console"), LogLevel(*logLevel))
+
+	result := runLoadTest(LoadTestConfig{
+		Target:       *target,
+		APIKey:       *apiKey,
+		Models:       strings.Split(*models, ","),
+		Requests:     *requests,
+		Duration:     *duration,
+		Concurrency:  *concurrency,
+		PromptTokens: *promptTokens,
+		MaxTokens:    *maxTokens,
+		StreamRatio:  *streamRatio,
+		Mock:         *mock,
+		MockRPM:      *mockRPM,
+		MockTPM:      *mockTPM,
+		MockLatency:  *mockLatency,
+	})
+	result.Report(os.Stdout)
+	return 0
+}
+
+func runLoadTest(config LoadTestConfig) LoadTestResult {
+	if config.Concurrency < 1 {
+		config.Concurrency = 1
+	}
+
+	target := strings.TrimSuffix(config.Target, "/")
+	if config.Mock {
+		upstream := httptest.NewServer(mockUpstream(config.MockLatency))
+		defer upstream.Close()
+
+		routeConfig := &RouteConfig{
+			Forward:  upstream.URL,
+			Provider: "openai",
+			Models:   make(map[string]ModelConfig),
+		}
+		for _, model := range config.Models {
+			routeConfig.Models[model] = ModelConfig{
+				MaxQueueSize:    config.Concurrency,
+				MaxQueueWait:    1.0,
+				ReqsPerMinute:   config.MockRPM,
+				TokensPerMinute: config.MockTPM,
+			}
+		}
+		router := NewRouter()
+		router.HandlePrefix("/openai", nil, NewOpenAI(routeConfig, &http.Client{}).GetHandler())
+		proxy := httptest.NewServer(router)
+		defer proxy.Close()
+		target = proxy.URL + "/openai"
+	}
+
+	// Roughly one token per word
+	prompt := strings.TrimSpace(strings.Repeat("hello ", config.PromptTokens))
+
+	var remaining atomic.Int64
+	remaining.Store(int64(config.Requests))
+	var deadline time.Time
+	if config.Duration > 0 {
+		deadline = time.Now().Add(config.Duration)
+	}
+
+	var mu sync.Mutex
+	var result LoadTestResult
+	var wg sync.WaitGroup
+	client := &http.Client{}
+	start := time.Now()
+	for i := 0; i < config.Concurrency; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(int64(worker)))
+			for {
+				if config.Requests > 0 && remaining.Add(-1) < 0 {
+					return
+				}
+				if !deadline.IsZero() && time.Now().After(deadline) {
+					return
+				}
+
+				model := config.Models[random.Intn(len(config.Models))]
+				stream := random.Float64() < config.StreamRatio
+				status, latency, err := sendLoadTestRequest(client, target, config, model, prompt, stream)
+
+				mu.Lock()
+				result.Add(status, latency, err)
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	result.Elapsed = time.Since(start)
+
+	sort.Slice(result.Latencies, func(i, j int) bool { return result.Latencies[i] < result.Latencies[j] })
+	return result
+}
+
+// sendLoadTestRequest sends one synthetic request and reads the whole response, returning the status and total latency
+func sendLoadTestRequest(client *http.Client, target string, config LoadTestConfig, model string, prompt string, stream bool) (int, time.Duration, error) {
+	var path string
+	var body map[string]any
+	if strings.Contains(model, "embedding") {
+		path = "/v1/embeddings"
+		body = map[string]any{"model": model, "input": prompt}
+	} else {
+		path = "/v1/chat/completions"
+		body = map[string]any{
+			"model":      model,
+			"messages":   []map[string]string{{"role": "user", "content": prompt}},
+			"max_tokens": config.MaxTokens,
+			"stream":     stream,
+		}
+	}
+
+	return postJSON(client, target+path, config.APIKey, body)
+}
+
+// postJSON sends body to url and reads the whole response, returning the status and total latency
+func postJSON(client *http.Client, url string, apiKey string, body any) (int, time.Duration, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return 0, 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return resp.StatusCode, 0, err
+	}
+	return resp.StatusCode, time.Since(start), nil
+}
+
+// mockUpstream answers chat completions, streamed or not, and embeddings the way OpenAI would
+func mockUpstream(latency time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Model  string `json:"model"`
+			Stream bool   `json:"stream"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		time.Sleep(latency)
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/embeddings":
+			fmt.Fprintf(w, `{"object": "list", "data": [{"object": "embedding", "index": 0, "embedding": [0.1, 0.2, 0.3]}], "model": "%s", "usage": {"prompt_tokens": 8, "total_tokens": 8}}`, body.Model)
+		case "/v1/chat/completions":
+			if !body.Stream {
+				fmt.Fprintf(w, `{"id": "chatcmpl-mock", "object": "chat.completion", "model": "%s", "choices": [{"index": 0, "message": {"role": "assistant", "content": "Hello there."}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 8, "completion_tokens": 3, "total_tokens": 11}}`, body.Model)
+				return
+			}
+			w.Header().Set("Content-Type", "text/event-stream")
+			for _, token := range []string{"Hello", " there", "."} {
+				fmt.Fprintf(w, "data: {\"id\": \"chatcmpl-mock\", \"object\": \"chat.completion.chunk\", \"model\": \"%s\", \"choices\": [{\"index\": 0, \"delta\": {\"content\": \"%s\"}}]}\n\n", body.Model, token)
+				if flusher, ok := w.(http.Flusher); ok {
+					flusher.Flush()
+				}
+			}
+			fmt.Fprint(w, "data: [DONE]\n\n")
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// Add counts the outcome of one request
+func (result *LoadTestResult) Add(status int, latency time.Duration, err error) {
+	result.Requests++
+	switch {
+	case err == nil && status < 300:
+		result.Succeeded++
+		result.Latencies = append(result.Latencies, latency)
+	case err == nil && status == http.StatusTooManyRequests:
+		result.Rejected++
+	default:
+		result.Failed++
+	}
+}
+
+// percentile returns the p-th percentile (0-100) of sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	index := int(float64(len(sorted)-1) * p / 100.0)
+	return sorted[index]
+}
+
+func (result *LoadTestResult) Report(w io.Writer) {
+	rate := 0.0
+	if result.Elapsed > 0 {
+		rate = float64(result.Requests) / result.Elapsed.Seconds()
+	}
+	share := func(n int) float64 {
+		if result.Requests == 0 {
+			return 0
+		}
+		return 100.0 * float64(n) / float64(result.Requests)
+	}
+
+	fmt.Fprintf(w, "requests:  %d in %s (%.1f/s)\n", result.Requests, result.Elapsed.Round(time.Millisecond), rate)
+	fmt.Fprintf(w, "succeeded: %d (%.1f%%)\n", result.Succeeded, share(result.Succeeded))
+	fmt.Fprintf(w, "rejected:  %d (%.1f%%)\n", result.Rejected, share(result.Rejected))
+	fmt.Fprintf(w, "failed:    %d (%.1f%%)\n", result.Failed, share(result.Failed))
+	fmt.Fprintf(w, "latency:   p50 %s  p90 %s  p99 %s  max %s\n",
+		percentile(result.Latencies, 50).Round(time.Microsecond),
+		percentile(result.Latencies, 90).Round(time.Microsecond),
+		percentile(result.Latencies, 99).Round(time.Microsecond),
+		percentile(result.Latencies, 100).Round(time.Microsecond))
+}
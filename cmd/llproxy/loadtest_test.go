@@ -0,0 +1,71 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadTest_Mock(t *testing.T) {
+	ConfigureLogging(LogType("console"), LogLevel("error"))
+	result := runLoadTest(LoadTestConfig{
+		Models:       []string{BENCHMARK_MODEL},
+		Requests:     20,
+		Concurrency:  4,
+		PromptTokens: 10,
+		Mock:         true,
+		MockRPM:      600,
+		MockTPM:      1000000,
+	})
+
+	assert.Equal(t, 20, result.Requests)
+	assert.Equal(t, 20, result.Succeeded)
+	assert.Len(t, result.Latencies, 20)
+
+	var report bytes.Buffer
+	result.Report(&report)
+	assert.Contains(t, report.String(), "succeeded: 20 (100.0%)")
+}
+
+func TestLoadTest_MockRejects(t *testing.T) {
+	ConfigureLogging(LogType("console"), LogLevel("error"))
+	// Only two requests fit in the first minute, the rest would wait far longer than maxQueueWait
+	result := runLoadTest(LoadTestConfig{
+		Models:       []string{BENCHMARK_MODEL},
+		Requests:     10,
+		Concurrency:  1,
+		PromptTokens: 10,
+		Mock:         true,
+		MockRPM:      2,
+		MockTPM:      1000000,
+	})
+
+	assert.Equal(t, 2, result.Succeeded)
+	assert.Equal(t, 8, result.Rejected)
+	assert.Equal(t, 0, result.Failed)
+}
+
+func TestPercentile(t *testing.T) {
+	latencies := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	assert.Equal(t, time.Duration(1), percentile(latencies, 0))
+	assert.Equal(t, time.Duration(5), percentile(latencies, 50))
+	assert.Equal(t, time.Duration(10), percentile(latencies, 100))
+	assert.Equal(t, time.Duration(0), percentile(nil, 50))
+}
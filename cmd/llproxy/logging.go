@@ -16,8 +16,10 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"sync/atomic"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -26,6 +28,46 @@ import (
 type LogType string
 type LogLevel string
 
+// RouteLoggingConfig overrides the process' logging for requests to one route
+type RouteLoggingConfig struct {
+	// Level of the route's request logs, the process' level when unset
+	Level LogLevel `json:"level"`
+
+	// AccessLog logs the route's requests to the access log, or not, whether or not other routes' are
+	AccessLog *bool `json:"accessLog"`
+}
+
+func (c *RouteLoggingConfig) validate() error {
+	if c.Level == "" {
+		return nil
+	}
+	if _, err := zapcore.ParseLevel(string(c.Level)); err != nil {
+		return fmt.Errorf("logging level '%s' is unknown", c.Level)
+	}
+	return nil
+}
+
+// The logger writing to every configured output at every level, which the global and route loggers filter by level
+var logBase *zap.Logger
+
+// The process' log level, which routes without their own log at, and whether requests of routes that weren't
+// configured at startup are access logged
+var (
+	processLogLevel  = zap.NewAtomicLevel()
+	processAccessLog atomic.Bool
+)
+
+// routeLogging is a route's request logger and whether its requests are access logged, both changed on reload
+type routeLogging struct {
+	level     zap.AtomicLevel
+	inherit   atomic.Bool // the route has no level of its own, following the process' level
+	accessLog atomic.Bool
+	logger    *zap.SugaredLogger
+}
+
+// Logging by route, set up once at startup
+var routeLogs map[string]*routeLogging
+
 // configure logging or panic
 func ConfigureLogging(logType LogType, logLevel LogLevel) {
 	var cfg zap.Config
@@ -69,6 +111,124 @@ func ConfigureLogging(logType LogType, logLevel LogLevel) {
 	if err != nil {
 		panic(err)
 	}
-	cfg.Level = zap.NewAtomicLevelAt(level)
-	zap.ReplaceGlobals(zap.Must(cfg.Build()))
+	cfg.Level = zap.NewAtomicLevelAt(zapcore.DebugLevel)
+	setLogLevel(level)
+	logBase = zap.Must(cfg.Build())
+	zap.ReplaceGlobals(filterLogger(logBase, processLogLevel))
+}
+
+// setLogLevel changes the process' level, and that of routes without their own
+func setLogLevel(level zapcore.Level) {
+	processLogLevel.SetLevel(level)
+	for _, logging := range routeLogs {
+		if logging.inherit.Load() {
+			logging.level.SetLevel(level)
+		}
+	}
+}
+
+// addLogOutput tees every logger's entries into another core, e.g. to export them, as well as its encoder
+func addLogOutput(output func(core zapcore.Core) zapcore.Core) {
+	logBase = logBase.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return zapcore.NewTee(core, output(core))
+	}))
+	zap.ReplaceGlobals(filterLogger(logBase, processLogLevel))
+	for _, logging := range routeLogs {
+		logging.logger = filterLogger(logBase, logging.level).Sugar()
+	}
+}
+
+// filterLogger drops the entries of logger below the level
+func filterLogger(logger *zap.Logger, level zapcore.LevelEnabler) *zap.Logger {
+	return logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return &levelCore{Core: core, level: level}
+	}))
+}
+
+// levelCore is a zapcore.Core only writing entries at or above a level that can change while it's used
+type levelCore struct {
+	zapcore.Core
+	level zapcore.LevelEnabler
+}
+
+func (c *levelCore) Enabled(level zapcore.Level) bool {
+	return c.level.Enabled(level) && c.Core.Enabled(level)
+}
+
+func (c *levelCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelCore{Core: c.Core.With(fields), level: c.level}
+}
+
+func (c *levelCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !c.level.Enabled(entry.Level) {
+		return checked
+	}
+	return c.Core.Check(entry, checked)
+}
+
+// ConfigureRouteLogging gives each route a request logger at its own level, and whether its requests are access logged
+func ConfigureRouteLogging(config LoggingConfig, routes map[string]RouteConfig) {
+	routeLogs = make(map[string]*routeLogging, len(routes))
+	for route := range routes {
+		logging := &routeLogging{level: zap.NewAtomicLevel()}
+		logging.logger = filterLogger(logBase, logging.level).Sugar()
+		routeLogs[route] = logging
+	}
+	ApplyLogging(config, routes)
+}
+
+// ApplyLogging changes the process' and routes' log levels and access logging to the config's, e.g. on reload.
+// Routes that weren't configured at startup keep logging as the process does.
+func ApplyLogging(config LoggingConfig, routes map[string]RouteConfig) {
+	level, err := zapcore.ParseLevel(string(config.Level))
+	if err != nil {
+		level = zapcore.InfoLevel
+	}
+	for route, logging := range routeLogs {
+		routeConfig := routes[route].Logging
+		logging.inherit.Store(routeConfig == nil || routeConfig.Level == "")
+		if !logging.inherit.Load() {
+			routeLevel, _ := zapcore.ParseLevel(string(routeConfig.Level))
+			logging.level.SetLevel(routeLevel)
+		}
+		logging.accessLog.Store(config.AccessLog)
+		if routeConfig != nil && routeConfig.AccessLog != nil {
+			logging.accessLog.Store(*routeConfig.AccessLog)
+		}
+	}
+	processAccessLog.Store(config.AccessLog)
+	setLogLevel(level)
+}
+
+// reloadLogging applies the logging of a freshly loaded config, keeping the current logging if it doesn't load
+func reloadLogging(load func() Config) {
+	defer func() {
+		if r := recover(); r != nil {
+			zap.S().Errorw("Unable to reload logging config", "reason", r)
+		}
+	}()
+	config := load()
+	ApplyLogging(config.Logging, config.Routes)
+	zap.S().Infow("Reloaded logging config", "level", config.Logging.Level)
+}
+
+// routeLog returns the logger for a request, at its route's level
+func routeLog(ctx context.Context) *zap.SugaredLogger {
+	if record := recordFromContext(ctx); record != nil {
+		if logging, ok := routeLogs[record.Route]; ok {
+			return logging.logger
+		}
+	}
+	return zap.S()
+}
+
+// routeAccessLog is whether a route's requests are access logged, all of them until route logging is configured
+func routeAccessLog(route string) bool {
+	if routeLogs == nil {
+		return true
+	}
+	if logging, ok := routeLogs[route]; ok {
+		return logging.accessLog.Load()
+	}
+	return processAccessLog.Load()
 }
@@ -0,0 +1,76 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRouteLogging(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	logBase = zap.New(core)
+	defer func() {
+		routeLogs = nil
+		ConfigureLogging(LogType("console"), LogLevel("error"))
+	}()
+
+	off := false
+	routes := map[string]RouteConfig{
+		"anthropic":  {Logging: &RouteLoggingConfig{Level: "debug"}},
+		"embeddings": {Logging: &RouteLoggingConfig{Level: "warn", AccessLog: &off}},
+		"openai":     {},
+	}
+	ConfigureRouteLogging(LoggingConfig{Level: "info", AccessLog: true}, routes)
+	zap.ReplaceGlobals(filterLogger(logBase, processLogLevel))
+
+	logFor := func(route string) {
+		ctx := context.WithValue(context.Background(), recordContextKey{}, &RequestRecord{Route: route})
+		routeLog(ctx).Debugw("Rejecting request", "route", route)
+		routeLog(ctx).Infow("Handling request", "route", route)
+	}
+	logged := func() map[string]int {
+		counts := map[string]int{}
+		for _, entry := range logs.TakeAll() {
+			counts[entry.ContextMap()["route"].(string)]++
+		}
+		return counts
+	}
+
+	// Routes log at their own level, the rest at the process'
+	for _, route := range []string{"anthropic", "embeddings", "openai", "unknown"} {
+		logFor(route)
+	}
+	assert.Equal(t, map[string]int{"anthropic": 2, "openai": 1, "unknown": 1}, logged())
+	assert.True(t, routeAccessLog("anthropic"))
+	assert.False(t, routeAccessLog("embeddings"))
+	assert.True(t, routeAccessLog("unknown"))
+
+	// A reload changes the levels, routes without their own following the process
+	routes["anthropic"] = RouteConfig{}
+	ApplyLogging(LoggingConfig{Level: "debug"}, routes)
+	for _, route := range []string{"anthropic", "embeddings", "openai", "unknown"} {
+		logFor(route)
+	}
+	assert.Equal(t, map[string]int{"anthropic": 2, "openai": 2, "unknown": 2}, logged())
+	assert.False(t, routeAccessLog("anthropic"))
+	assert.False(t, routeAccessLog("embeddings"))
+}
@@ -19,62 +19,168 @@ package main
 import (
 	"context"
 	"flag"
-	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
 	"go.uber.org/zap"
 )
 
 func main() {
 
+	// Subcommands are dispatched before the server's own flags are parsed
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "loadtest":
+			os.Exit(loadTestCommand(os.Args[2:]))
+		case "replay":
+			os.Exit(replayCommand(os.Args[2:]))
+		}
+	}
+
 	// Define a string flag for the configuration file path with a default value
-	configFilePath := flag.String("config", "config.json", "path to the configuration file")
+	configFilePath := flag.String("config", "config.json", "path to the configuration file, unless configured by LLPROXY_* environment variables")
+	dryRunFlag := flag.Bool("dry-run", false, "log what rate limiting would do without enforcing it")
+	selfTestFlag := flag.Bool("selftest", false, "check the config, upstreams and tokenizers, print a report and exit, non-zero if any check failed")
 
 	// Parse the flags
 	flag.Parse()
 
-	// Load the configuration
-	config := LoadConfig(*configFilePath)
+	// Load the configuration, from the environment if it holds one and no file was named
+	configFileSet := false
+	flag.Visit(func(f *flag.Flag) {
+		configFileSet = configFileSet || f.Name == "config"
+	})
+	loadConfig := func() Config {
+		if !configFileSet && envConfigured() {
+			return LoadConfigFromEnv()
+		}
+		return LoadConfig(*configFilePath)
+	}
+
+	// The self-test checks the proxy could serve, e.g. as a Kubernetes init container, without serving
+	if *selfTestFlag {
+		os.Exit(selfTestCommand(loadConfig))
+	}
+	config := loadConfig()
 
 	// Setup Logging
 	ConfigureLogging(config.Logging.Type, config.Logging.Level)
+	if config.Logging.OTLP != nil {
+		ConfigureOTLP(config.Logging.OTLP)
+	}
+	if config.Logging.Syslog != nil {
+		ConfigureSyslog(config.Logging.Syslog)
+	}
+	ConfigureRouteLogging(config.Logging, config.Routes)
+
+	// Token counting reads its data from local files, if there are any, rather than downloading it
+	ConfigureTokenizer(config.Application.TokenizerDir, config.Routes)
+
+	// Rejected requests can be given the operator's guidance rather than the proxy's own message
+	rejections, _ = newRejectionTemplates(config.Rejections)
+
+	// Usage is rolled up for the billing export, if enabled
+	billing = newBillingExporter(config.BillingExport)
+	go billing.Run()
+
+	// Limits are only observed in a dry run, e.g. to calibrate them against production traffic
+	dryRun.Store(config.DryRun || *dryRunFlag)
+	if dryRun.Load() {
+		zap.S().Warn("Dry run, rate limits are logged but not enforced")
+	}
 
 	// In order to keep our health and readiness probes running while the server is shutting down we setup
 	// separate handlers for health and readiness from our main http server.
 
 	// Setup the providers and base routes
+	router := NewRouter()
 	providers := initProviders(&config)
-	for route, handler := range providers {
+	for route, provider := range providers {
 		zap.S().Infof("creating route for /%s/", route)
-		http.HandleFunc("/"+route, handler)
-		http.HandleFunc("/"+route+"/", handler)
+		router.HandlePrefix("/"+route, nil, provider.GetHandler())
+
+		// Model listing is answered by the proxy so clients only discover models we schedule
+		router.Handle("/"+route+"/v1/models", []string{http.MethodGet}, getModelsHandler(providers, route))
 	}
+	router.Handle("/models", []string{http.MethodGet}, getModelsHandler(providers))
+
+	// Clients can poll the queue position of requests they sent with an id
+	router.HandlePrefix("/llproxy/queue", []string{http.MethodGet}, getQueueStatusHandler("/llproxy/queue"))
+
+	// Routes can also be selected by hostname, giving each a base URL without the route prefix
+	router.Use(hostRouting(routeHosts(config.Routes)))
+
+	// Every request is recorded for the access log, metrics and usage records
+	// Routes can turn the access log on for themselves, or it can be turned on by a reload, so it's set up either way
+	accessLogging := config.Logging
+	accessLogging.AccessLog = true
+	router.Use(recordRequests(config.Routes, newAccessLogger(accessLogging), config.TagLabels))
+
+	// Past the proxy-wide in-flight limit requests are turned away straight away, whatever their model
+	inflightLimit = newInflightLimiter(config.Application.MaxInflight)
+	router.Use(inflightLimit.Middleware())
+
+	// Callers are identified by their proxy key, which decides what priority they may ask for
+	router.Use(identifyClients(newClientKeys(&config), config.DefaultPriority))
+
+	// A sample of requests can be kept with their bodies for debugging
+	captures = newCaptureStore(config.Logging.Capture)
+	router.Use(captures.Middleware())
+
+	// Limits that stay nearly used up are alerted on
+	quotaAlerts = newQuotaAlerter(config.QuotaAlerts, providers)
+	go quotaAlerts.Run()
+
+	// The admin server, and the peers polling it, use a token when one is configured
+	adminAuth = newAdminAuth(config.Application.AdminAuth)
+
+	// Replicas sharing limits take their share of them from how many peers answer
+	peers = newPeerCoordinator(config.Peers, providers)
+	go peers.Run()
+
+	// Capacity the previous process left is restored, and kept for the next one
+	snapshots = newSnapshotter(config.SchedulerSnapshot, providers)
+	snapshots.Restore()
+	go snapshots.Run()
 
 	// Create http servers
 	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", config.Application.Port),
-		Handler: http.DefaultServeMux,
+		Handler: router,
 	}
 
-	// Start server in a goroutine
-	go func() {
-		if err := server.ListenAndServe(); err != http.ErrServerClosed {
-			// Unexpected server shutdown
-			zap.S().Fatalf("Server closed unexpectedly: %v", err)
-		}
-	}()
+	// Start serving on each listener in its own goroutine
+	ServeListeners(&config.Application, ServerProxy, server)
 
 	// Setup health endpoints
-	HealthStartup(&config)
+	HealthStartup(&config, providers)
+
+	// Setup the admin endpoints and dashboard
+	AdminStartup(&config, providers)
 
 	// Channel for os signals
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 
+	// SIGUSR1 logs what the proxy is working on without stopping it
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		for range usr1 {
+			logInflight("SIGUSR1")
+		}
+	}()
+
+	// SIGHUP reloads the logging levels and access logging of the process and each route from the config
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadLogging(loadConfig)
+		}
+	}()
+
 	// Channel for server shutdown
 	serverShutdown := make(chan struct{})
 
@@ -83,6 +189,10 @@ func main() {
 	go func() {
 		for sigName := range sig {
 			if signalReceived {
+				if config.Application.Shutdown.SecondSignal == SecondSignalIgnore {
+					zap.S().Warnf("Received signal %v. Still draining requests.", sigName)
+					continue
+				}
 				zap.S().Fatal("Second signal received. Exiting immediately.")
 			} else {
 				signalReceived = true
@@ -90,10 +200,16 @@ func main() {
 
 				// Mark the server as not ready
 				HealthShutdown()
+				logInflight("shutdown")
+
+				// Requests still waiting for capacity can be turned away so the drain only waits on upstreams
+				if config.Application.Shutdown.RejectQueued {
+					closeQueues()
+				}
 
 				// Create a context for shutdown with timeout
-				// We give a fairly long timeout since requests can take a while to generate and we want to allow them time
-				ctx, cancel := context.WithTimeout(context.Background(), 45*time.Second)
+				// Requests can take a while to generate, so by default we give them a fairly long time
+				ctx, cancel := context.WithTimeout(context.Background(), config.Application.Shutdown.drainTimeout())
 				defer cancel()
 
 				go func() {
@@ -108,6 +224,10 @@ func main() {
 		}
 	}()
 
-	// Wait for server to shutdown
+	// Wait for server to shutdown, then write the usage of the current period, the schedulers' capacity, and send
+	// any logs still buffered for export
 	<-serverShutdown
+	billing.Stop()
+	snapshots.Save()
+	zap.L().Sync()
 }
@@ -0,0 +1,191 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Disabled describes why a route or model is switched off, and when clients should try again
+type Disabled struct {
+	Message      string     `json:"message,omitempty"`
+	RetryAfter   int        `json:"retryAfter,omitempty"`
+	RecoveryTime *time.Time `json:"recoveryTime,omitempty"`
+	DocsURL      string     `json:"docsUrl,omitempty"`
+}
+
+// maintenanceSwitch tracks which models of a route are disabled, the route itself being disabled under ""
+type maintenanceSwitch struct {
+	mu       sync.RWMutex
+	disabled map[string]Disabled
+}
+
+func newMaintenanceSwitch(config *RouteConfig) *maintenanceSwitch {
+	m := &maintenanceSwitch{disabled: make(map[string]Disabled)}
+	if config.Disabled {
+		m.disabled[""] = Disabled{
+			Message:      config.DisabledMessage,
+			RetryAfter:   config.DisabledRetryAfter,
+			RecoveryTime: config.DisabledRecoveryTime,
+			DocsURL:      config.DisabledDocsURL,
+		}
+	}
+	for _, models := range []map[string]ModelConfig{config.Models, config.BatchModels} {
+		for model, modelConfig := range models {
+			if modelConfig.Disabled {
+				m.disabled[model] = Disabled{
+					Message:      modelConfig.DisabledMessage,
+					RetryAfter:   modelConfig.DisabledRetryAfter,
+					RecoveryTime: modelConfig.DisabledRecoveryTime,
+					DocsURL:      modelConfig.DisabledDocsURL,
+				}
+			}
+		}
+	}
+	return m
+}
+
+// Disable switches off a model, or the whole route when model is empty
+func (m *maintenanceSwitch) Disable(model string, disabled Disabled) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.disabled[model] = disabled
+}
+
+// Enable switches a model, or the whole route when model is empty, back on
+func (m *maintenanceSwitch) Enable(model string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.disabled, model)
+}
+
+// Check returns why requests for model can't be served if the route or the model is disabled,
+// along with which of them it was, "" being the route
+func (m *maintenanceSwitch) Check(model string) (Disabled, string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if disabled, ok := m.disabled[""]; ok {
+		return disabled, "", true
+	}
+	if model == "" {
+		return Disabled{}, "", false
+	}
+	disabled, ok := m.disabled[model]
+	return disabled, model, ok
+}
+
+// List returns the disabled models by name, "" being the route
+func (m *maintenanceSwitch) List() map[string]Disabled {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	list := make(map[string]Disabled, len(m.disabled))
+	for model, disabled := range m.disabled {
+		list[model] = disabled
+	}
+	return list
+}
+
+// writeDisabled answers a request for a disabled route or model with a 503, its body carrying the message,
+// Retry-After, expected recovery time and docs link for applications to show; Retry-After defaults to the time
+// left until the recovery time
+func writeDisabled(w http.ResponseWriter, r *http.Request, model string, disabled Disabled) {
+	message := disabled.Message
+	code := ErrCodeModelDisabled
+	if model == "" {
+		code = ErrCodeRouteDisabled
+		if message == "" {
+			route := strings.Split(r.URL.Path, "/")[1]
+			if record := recordFromContext(r.Context()); record != nil && record.Route != "" {
+				route = record.Route
+			}
+			message = fmt.Sprintf("Route '%s' is disabled", route)
+		}
+	} else if message == "" {
+		message = fmt.Sprintf("Model '%s' is disabled", model)
+	}
+
+	routeLog(r.Context()).Debugw("Rejecting request", "url", r.URL, "model", model, "reason", "Disabled")
+	if disabled.RetryAfter <= 0 && disabled.RecoveryTime != nil {
+		disabled.RetryAfter = int(math.Ceil(time.Until(*disabled.RecoveryTime).Seconds()))
+	}
+	if disabled.RetryAfter > 0 {
+		w.Header().Set(HeaderRetryAfter, strconv.Itoa(disabled.RetryAfter))
+	} else {
+		disabled.RetryAfter = 0
+	}
+	disabled.Message = message
+	writeErrorDetail(w, http.StatusServiceUnavailable, ErrorDetail{Message: message, Type: ErrTypeServer, Code: code, Maintenance: &disabled})
+}
+
+// MaintenanceStatus is a disabled route or model for the admin endpoints
+type MaintenanceStatus struct {
+	Route string `json:"route"`
+	Model string `json:"model,omitempty"`
+	Disabled
+}
+
+func getMaintenanceStatus(providers Providers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		statuses := []MaintenanceStatus{}
+		for _, route := range sortedRoutes(providers) {
+			disabled := providers[route].Maintenance().List()
+			models := make([]string, 0, len(disabled))
+			for model := range disabled {
+				models = append(models, model)
+			}
+			sort.Strings(models)
+			for _, model := range models {
+				statuses = append(statuses, MaintenanceStatus{Route: route, Model: model, Disabled: disabled[model]})
+			}
+		}
+		writeJSON(w, statuses)
+	}
+}
+
+// setMaintenance disables, or with enable re-enables, the route or model in a MaintenanceStatus request body
+func setMaintenance(providers Providers, enable bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request MaintenanceStatus
+		if err := decodeJSON(r.Body, &request); err != nil {
+			writeError(w, http.StatusBadRequest, ErrTypeInvalidRequest, ErrCodeInvalidRequest, fmt.Sprintf("Invalid maintenance request: %s", err))
+			return
+		}
+		provider, ok := providers[request.Route]
+		if !ok {
+			writeError(w, http.StatusNotFound, ErrTypeInvalidRequest, ErrCodeInvalidRequest, fmt.Sprintf("No route '%s'", request.Route))
+			return
+		}
+
+		if enable {
+			zap.S().Infow("Enabling", "route", request.Route, "model", request.Model)
+			provider.Maintenance().Enable(request.Model)
+		} else {
+			zap.S().Warnw("Disabling", "route", request.Route, "model", request.Model, "message", request.Message)
+			provider.Maintenance().Disable(request.Model, request.Disabled)
+		}
+		writeJSON(w, request)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaintenance(t *testing.T) {
+	openai := NewOpenAI(&RouteConfig{
+		Forward:  FAKE_BASE_URL,
+		Provider: "openai",
+		Models: map[string]ModelConfig{
+			TEST_MODEL:      {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60, TokensPerMinute: 60000, Disabled: true, DisabledMessage: "Down for maintenance", DisabledRetryAfter: 120},
+			BENCHMARK_MODEL: {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60, TokensPerMinute: 60000},
+		},
+	}, &MockHttpClient{})
+	handler := openai.GetHandler()
+	admin := newAdminRouter(Providers{"openai": openai})
+
+	send := func(model string) *httptest.ResponseRecorder {
+		body := []byte(fmt.Sprintf(`{"model": "%s", "input": "test", "prompt": "test"}`, model))
+		path := "/v1/completions"
+		if model == BENCHMARK_MODEL {
+			path = "/v1/embeddings"
+		}
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "http://localhost:8080/openai"+path, bytes.NewBuffer(body)))
+		return w
+	}
+	post := func(path string, body string) int {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest("POST", "http://localhost:8082"+path, bytes.NewBufferString(body)))
+		return w.Code
+	}
+
+	// Disabled in config
+	w := send(TEST_MODEL)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "120", w.Header().Get(HeaderRetryAfter))
+	assert.Contains(t, w.Body.String(), "Down for maintenance")
+	assert.Contains(t, w.Body.String(), ErrCodeModelDisabled)
+	assert.Equal(t, http.StatusOK, send(BENCHMARK_MODEL).Code)
+
+	// Switched back on, then the whole route off, through the admin API
+	assert.Equal(t, http.StatusOK, post("/admin/maintenance/enable", fmt.Sprintf(`{"route": "openai", "model": "%s"}`, TEST_MODEL)))
+	assert.Equal(t, http.StatusOK, send(TEST_MODEL).Code)
+	assert.Equal(t, http.StatusOK, post("/admin/maintenance/disable", `{"route": "openai"}`))
+	w = send(BENCHMARK_MODEL)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "Route 'openai' is disabled")
+
+	// The route is named from the request record when the path doesn't start with it, e.g. host routed requests
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "http://localhost:8080/v1/completions", bytes.NewBufferString(`{"prompt": "test"}`))
+	writeDisabled(w, r.WithContext(context.WithValue(r.Context(), recordContextKey{}, &RequestRecord{Route: "openai"})), "", Disabled{})
+	assert.Contains(t, w.Body.String(), "Route 'openai' is disabled")
+	assert.Equal(t, http.StatusNotFound, post("/admin/maintenance/disable", `{"route": "other"}`))
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8082/admin/maintenance", nil))
+	var statuses []MaintenanceStatus
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &statuses))
+	assert.Equal(t, []MaintenanceStatus{{Route: "openai"}}, statuses)
+}
+
+func TestMaintenanceBody(t *testing.T) {
+	recovery := time.Now().Add(10 * time.Minute).Truncate(time.Second)
+	openai := NewOpenAI(&RouteConfig{
+		Forward:  FAKE_BASE_URL,
+		Provider: "openai",
+		Models: map[string]ModelConfig{
+			TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60, TokensPerMinute: 60000, Disabled: true,
+				DisabledMessage: "Upgrading", DisabledRecoveryTime: &recovery, DisabledDocsURL: "https://status.example.com"},
+		},
+	}, &MockHttpClient{})
+	handler := openai.GetHandler()
+
+	body := []byte(fmt.Sprintf(`{"model": "%s", "prompt": "test"}`, TEST_MODEL))
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewBuffer(body)))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	// Retry-After comes from the recovery time when it isn't set
+	retryAfter, err := strconv.Atoi(w.Header().Get(HeaderRetryAfter))
+	assert.NoError(t, err)
+	assert.InDelta(t, 600, retryAfter, 2)
+
+	var response ErrorResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, ErrCodeModelDisabled, response.Error.Code)
+	if assert.NotNil(t, response.Error.Maintenance) {
+		assert.Equal(t, "Upgrading", response.Error.Maintenance.Message)
+		assert.Equal(t, retryAfter, response.Error.Maintenance.RetryAfter)
+		assert.True(t, recovery.Equal(*response.Error.Maintenance.RecoveryTime))
+		assert.Equal(t, "https://status.example.com", response.Error.Maintenance.DocsURL)
+	}
+}
@@ -0,0 +1,226 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// requestSeries are the totals of one combination of metric labels
+type requestSeries struct {
+	requests         uint64
+	seconds          float64
+	promptTokens     uint64
+	completionTokens uint64
+}
+
+// metricsRegistry keeps request metrics by label set, written in the Prometheus text format
+type metricsRegistry struct {
+	mu     sync.Mutex
+	series map[string]*requestSeries
+	values labelValues
+}
+
+var requestMetrics = &metricsRegistry{}
+
+// Observe counts a finished request, the tags named by tagLabels become "tag_" labels
+func (m *metricsRegistry) Observe(record *RequestRecord, tagLabels []string) {
+	labels := []string{
+		metricLabel("route", record.Route),
+		metricLabel("model", record.Model),
+		metricLabel("status", strconv.Itoa(record.Status)),
+	}
+	for i, value := range selectTags(record.Tags, tagLabels) {
+		labels = append(labels, metricLabel("tag_"+metricName(tagLabels[i]), m.values.Value(tagLabels[i], value)))
+	}
+	key := strings.Join(labels, ",")
+	seconds := time.Since(record.Start).Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.series == nil {
+		m.series = make(map[string]*requestSeries)
+	}
+	series, ok := m.series[key]
+	if !ok {
+		series = &requestSeries{}
+		m.series[key] = series
+	}
+	series.requests++
+	series.seconds += seconds
+	if record.Usage != nil {
+		series.promptTokens += uint64(record.Usage.PromptTokens)
+		series.completionTokens += uint64(record.Usage.CompletionTokens)
+	}
+}
+
+// Write writes every series in the Prometheus text exposition format
+func (m *metricsRegistry) Write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintln(w, "# HELP llproxy_requests_total Requests handled by the proxy.")
+	fmt.Fprintln(w, "# TYPE llproxy_requests_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "llproxy_requests_total{%s} %d\n", key, m.series[key].requests)
+	}
+	fmt.Fprintln(w, "# HELP llproxy_request_duration_seconds Time taken to answer requests, including time queued.")
+	fmt.Fprintln(w, "# TYPE llproxy_request_duration_seconds summary")
+	for _, key := range keys {
+		fmt.Fprintf(w, "llproxy_request_duration_seconds_sum{%s} %g\n", key, m.series[key].seconds)
+		fmt.Fprintf(w, "llproxy_request_duration_seconds_count{%s} %d\n", key, m.series[key].requests)
+	}
+	fmt.Fprintln(w, "# HELP llproxy_tokens_total Tokens reported used by the upstream.")
+	fmt.Fprintln(w, "# TYPE llproxy_tokens_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "llproxy_tokens_total{%s,type=\"prompt\"} %d\n", key, m.series[key].promptTokens)
+		fmt.Fprintf(w, "llproxy_tokens_total{%s,type=\"completion\"} %d\n", key, m.series[key].completionTokens)
+	}
+}
+
+func getMetrics(providers Providers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		requestMetrics.Write(w)
+		firstTokenMetrics.Write(w)
+		scopeBorrowMetrics.Write(w)
+		duplicateMetrics.Write(w)
+		writeSchedulerMetrics(w, providers)
+		quotaAlerts.WriteMetrics(w)
+		peers.WriteMetrics(w)
+		inflightLimit.WriteMetrics(w)
+	}
+}
+
+// writeSchedulerMetrics writes the queue of every scheduler, and the queue pressure of the replica as a whole,
+// e.g. for a HorizontalPodAutoscaler to scale on through a custom metrics adapter
+func writeSchedulerMetrics(w io.Writer, providers Providers) {
+	type schedulerSeries struct {
+		labels string
+		queued CapacitySnapshot
+		wait   float64
+		state  SchedulerState
+		limits SchedulerLimits
+
+		// Admitted over the last minute, and the percentage of the limits left
+		admittedRequests float64
+		admittedTokens   float64
+		headroom         float64
+	}
+	var series []schedulerSeries
+	pressure := 0.0
+	for _, route := range sortedRoutes(providers) {
+		provider := providers[route]
+		for _, schedulers := range append([]SchedulerMap{provider.Schedulers()}, provider.ScopedSchedulers()...) {
+			for _, model := range sortedModels(schedulers) {
+				scheduler := schedulers[model]
+				labels := strings.Join([]string{metricLabel("route", route), metricLabel("model", model), metricLabel("scope", scheduler.Scope)}, ",")
+				wait := scheduler.WaitEstimate(0)
+				s := schedulerSeries{labels: labels, queued: scheduler.Snapshot(), wait: wait, state: scheduler.State(), limits: scheduler.Limits(), headroom: scheduler.headroom()}
+				s.admittedRequests, s.admittedTokens = scheduler.throughput.PerMinute(scheduler.now())
+				series = append(series, s)
+				if scheduler.Config.MaxQueueWait > 0 {
+					pressure = math.Max(pressure, wait/scheduler.Config.MaxQueueWait)
+				}
+			}
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP llproxy_scheduler_queued_requests Requests waiting for capacity.")
+	fmt.Fprintln(w, "# TYPE llproxy_scheduler_queued_requests gauge")
+	for _, s := range series {
+		fmt.Fprintf(w, "llproxy_scheduler_queued_requests{%s} %d\n", s.labels, s.queued.QueuedRequests)
+	}
+	fmt.Fprintln(w, "# HELP llproxy_scheduler_queued_tokens Estimated tokens of the requests waiting for capacity.")
+	fmt.Fprintln(w, "# TYPE llproxy_scheduler_queued_tokens gauge")
+	for _, s := range series {
+		fmt.Fprintf(w, "llproxy_scheduler_queued_tokens{%s} %g\n", s.labels, s.queued.QueuedTokens)
+	}
+	fmt.Fprintln(w, "# HELP llproxy_scheduler_wait_seconds Projected wait for a new request behind those queued.")
+	fmt.Fprintln(w, "# TYPE llproxy_scheduler_wait_seconds gauge")
+	for _, s := range series {
+		fmt.Fprintf(w, "llproxy_scheduler_wait_seconds{%s} %g\n", s.labels, s.wait)
+	}
+	fmt.Fprintln(w, "# HELP llproxy_scheduler_limit_rpm Requests per minute the scheduler admits at, its share when limits are shared with peers.")
+	fmt.Fprintln(w, "# TYPE llproxy_scheduler_limit_rpm gauge")
+	for _, s := range series {
+		fmt.Fprintf(w, "llproxy_scheduler_limit_rpm{%s} %g\n", s.labels, s.limits.ReqsPerMinute)
+	}
+	fmt.Fprintln(w, "# HELP llproxy_scheduler_limit_tpm Tokens per minute the scheduler admits at, its share when limits are shared with peers.")
+	fmt.Fprintln(w, "# TYPE llproxy_scheduler_limit_tpm gauge")
+	for _, s := range series {
+		fmt.Fprintf(w, "llproxy_scheduler_limit_tpm{%s} %g\n", s.labels, s.limits.TokensPerMinute)
+	}
+	fmt.Fprintln(w, "# HELP llproxy_scheduler_admitted_rpm Requests admitted over the last minute.")
+	fmt.Fprintln(w, "# TYPE llproxy_scheduler_admitted_rpm gauge")
+	for _, s := range series {
+		fmt.Fprintf(w, "llproxy_scheduler_admitted_rpm{%s} %g\n", s.labels, s.admittedRequests)
+	}
+	fmt.Fprintln(w, "# HELP llproxy_scheduler_admitted_tpm Estimated tokens of the requests admitted over the last minute.")
+	fmt.Fprintln(w, "# TYPE llproxy_scheduler_admitted_tpm gauge")
+	for _, s := range series {
+		fmt.Fprintf(w, "llproxy_scheduler_admitted_tpm{%s} %g\n", s.labels, s.admittedTokens)
+	}
+	fmt.Fprintln(w, "# HELP llproxy_scheduler_headroom_percent Percentage of the request or token limit, whichever is nearer, not used or queued for.")
+	fmt.Fprintln(w, "# TYPE llproxy_scheduler_headroom_percent gauge")
+	for _, s := range series {
+		fmt.Fprintf(w, "llproxy_scheduler_headroom_percent{%s} %g\n", s.labels, s.headroom)
+	}
+	fmt.Fprintln(w, "# HELP llproxy_scheduler_state Whether the scheduler is running, paused or draining, 1 for its current state.")
+	fmt.Fprintln(w, "# TYPE llproxy_scheduler_state gauge")
+	for _, s := range series {
+		for _, state := range schedulerStates {
+			value := 0
+			if s.state == state {
+				value = 1
+			}
+			fmt.Fprintf(w, "llproxy_scheduler_state{%s,%s} %d\n", s.labels, metricLabel("state", string(state)), value)
+		}
+	}
+	fmt.Fprintln(w, "# HELP llproxy_queue_pressure Largest projected wait of any scheduler as a fraction of its maxQueueWait, rejections start above 1.")
+	fmt.Fprintln(w, "# TYPE llproxy_queue_pressure gauge")
+	fmt.Fprintf(w, "llproxy_queue_pressure %g\n", pressure)
+}
+
+// metricLabel formats one label, escaping the value as the text format requires
+func metricLabel(name string, value string) string {
+	value = strings.NewReplacer(`\`, `\\`, "\"", `\"`, "\n", `\n`).Replace(value)
+	return name + "=\"" + value + "\""
+}
+
+// metricName replaces the characters a Prometheus label name can't contain
+func metricName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
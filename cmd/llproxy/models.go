@@ -0,0 +1,108 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ModelList mirrors the OpenAI list models response so SDKs can parse it unchanged
+type ModelList struct {
+	Object string       `json:"object"`
+	Data   []ModelEntry `json:"data"`
+}
+
+type ModelEntry struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+
+	// Extension field describing how the proxy schedules this model
+	LLProxy ModelLimits `json:"llproxy"`
+}
+
+type ModelLimits struct {
+	Route           string  `json:"route"`
+	Provider        string  `json:"provider"`
+	MaxQueueSize    int     `json:"maxQueueSize"`
+	MaxQueueWait    float64 `json:"maxQueueWait"`
+	ReqsPerMinute   float64 `json:"rpm"`
+	TokensPerMinute float64 `json:"tpm"`
+}
+
+// Models are reported as created when the proxy loaded them
+var modelsCreated = time.Now().Unix()
+
+func listModels(providers Providers, routes ...string) ModelList {
+	// With no routes given we list every route
+	if len(routes) == 0 {
+		for route := range providers {
+			routes = append(routes, route)
+		}
+	}
+	sort.Strings(routes)
+
+	list := ModelList{Object: "list", Data: []ModelEntry{}}
+	for _, route := range routes {
+		provider, ok := providers[route]
+		if !ok {
+			continue
+		}
+
+		schedulers := provider.Schedulers()
+		names := make([]string, 0, len(schedulers))
+		for name := range schedulers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			scheduler := schedulers[name]
+			list.Data = append(list.Data, ModelEntry{
+				ID:      name,
+				Object:  "model",
+				Created: modelsCreated,
+				OwnedBy: scheduler.Provider,
+				LLProxy: ModelLimits{
+					Route:           route,
+					Provider:        scheduler.Provider,
+					MaxQueueSize:    scheduler.Config.MaxQueueSize,
+					MaxQueueWait:    scheduler.Config.MaxQueueWait,
+					ReqsPerMinute:   scheduler.Limits().ReqsPerMinute,
+					TokensPerMinute: scheduler.Limits().TokensPerMinute,
+				},
+			})
+		}
+	}
+
+	return list
+}
+
+func getModelsHandler(providers Providers, routes ...string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(listModels(providers, routes...)); err != nil {
+			zap.S().Errorw("Unable to write model list", "url", r.URL, "reason", err)
+		}
+	}
+}
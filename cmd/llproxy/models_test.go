@@ -0,0 +1,59 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetModelsHandler(t *testing.T) {
+	providers := Providers{
+		"openai": CreateOpenAI(),
+	}
+
+	handler := getModelsHandler(providers, "openai")
+
+	req := httptest.NewRequest("GET", "http://localhost:8080/openai/v1/models", nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var list ModelList
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+	assert.Equal(t, "list", list.Object)
+	assert.Len(t, list.Data, 1)
+	assert.Equal(t, TEST_MODEL, list.Data[0].ID)
+	assert.Equal(t, "model", list.Data[0].Object)
+	assert.Equal(t, "openai", list.Data[0].LLProxy.Route)
+	assert.Equal(t, 60.0, list.Data[0].LLProxy.ReqsPerMinute)
+	assert.Equal(t, 60000.0, list.Data[0].LLProxy.TokensPerMinute)
+
+	// Unknown routes list nothing rather than failing
+	list = listModels(providers, "missing")
+	assert.Empty(t, list.Data)
+
+	// The global listing covers every route
+	list = listModels(providers)
+	assert.Len(t, list.Data, 1)
+}
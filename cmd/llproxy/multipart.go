@@ -0,0 +1,61 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+)
+
+// multipartFields reads the named fields out of a multipart/form-data body, skipping all others.
+// Reading stops as soon as every field has been found, so fields sent ahead of a large file are cheap.
+// ok is false when the body isn't multipart at all, so the caller can fall back to JSON.
+func multipartFields(contentType string, body io.Reader, names ...string) (fields map[string][]byte, ok bool, err error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "multipart/form-data" {
+		return nil, false, nil
+	}
+
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	fields = make(map[string][]byte)
+	reader := multipart.NewReader(body, params["boundary"])
+	for len(fields) < len(wanted) {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, true, err
+		}
+		if !wanted[part.FormName()] {
+			continue
+		}
+
+		value, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, true, err
+		}
+		fields[part.FormName()] = value
+	}
+	return fields, true, nil
+}
@@ -0,0 +1,187 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Error types used for upstream errors that don't carry one OpenAI would use
+const (
+	ErrTypeAuthentication = "authentication_error"
+	ErrTypePermission     = "permission_error"
+	ErrTypeNotFound       = "not_found_error"
+)
+
+// Non-JSON error bodies, e.g. from a load balancer, are cut down to this many bytes for the message
+const maxPlainErrorMessage = 1000
+
+// NormalizeErrorsConfig enables rewriting upstream error responses into the OpenAI error shape
+type NormalizeErrorsConfig struct {
+	// Keep the upstream's original body under "provider_error"
+	PreserveOriginal bool `json:"preserveOriginal"`
+}
+
+// UpstreamErrorResponse is an upstream error in the shape of OpenAI error bodies
+type UpstreamErrorResponse struct {
+	Error         ErrorDetail     `json:"error"`
+	ProviderError json.RawMessage `json:"provider_error,omitempty"`
+}
+
+// upstreamError holds the fields of the error shapes used by OpenAI, Azure and Anthropic
+//
+//	OpenAI:    {"error": {"message": "...", "type": "...", "param": null, "code": "..."}}
+//	Azure:     {"error": {"code": "429", "message": "...", "innererror": {...}}} or {"statusCode": 429, "message": "..."}
+//	Anthropic: {"type": "error", "error": {"type": "rate_limit_error", "message": "..."}}
+type upstreamError struct {
+	Type    string          `json:"type"`
+	Error   json.RawMessage `json:"error"`
+	Message string          `json:"message"`
+}
+
+type upstreamErrorDetail struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    any     `json:"code"`
+}
+
+type errorNormalizer struct {
+	config *NormalizeErrorsConfig
+}
+
+func newErrorNormalizer(config *NormalizeErrorsConfig) *errorNormalizer {
+	if config == nil {
+		return nil
+	}
+	return &errorNormalizer{config: config}
+}
+
+// Hook returns the ResponseHook rewriting upstream error responses, or nil if errors aren't normalized
+func (n *errorNormalizer) Hook() ResponseHook {
+	if n == nil {
+		return nil
+	}
+	return func(resp *http.Response) {
+		if resp.StatusCode < http.StatusBadRequest || resp.Header.Get("Content-Encoding") != "" {
+			return
+		}
+
+		original, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		body := original
+		if err == nil {
+			body = n.normalize(resp.StatusCode, original)
+		}
+
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		if err == nil {
+			resp.Header.Set("Content-Type", "application/json")
+		}
+	}
+}
+
+func (n *errorNormalizer) normalize(status int, original []byte) []byte {
+	detail := parseUpstreamError(original)
+	if detail.Message == "" {
+		detail.Message = http.StatusText(status)
+	}
+	if detail.Type == "" {
+		detail.Type = errorTypeForStatus(status)
+	}
+
+	response := UpstreamErrorResponse{Error: detail}
+	if n.config.PreserveOriginal && len(original) > 0 {
+		if json.Valid(original) {
+			response.ProviderError = original
+		} else {
+			response.ProviderError, _ = json.Marshal(string(original))
+		}
+	}
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		return original
+	}
+	return body
+}
+
+// parseUpstreamError picks the message, type and code out of whichever error shape the body has
+func parseUpstreamError(body []byte) ErrorDetail {
+	var envelope upstreamError
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		message := strings.TrimSpace(string(body))
+		if len(message) > maxPlainErrorMessage {
+			message = message[:maxPlainErrorMessage]
+		}
+		return ErrorDetail{Message: message}
+	}
+
+	var detail upstreamErrorDetail
+	var message string
+	if json.Unmarshal(envelope.Error, &detail) != nil {
+		// Some providers send the error as a plain string
+		json.Unmarshal(envelope.Error, &message)
+	}
+	if detail.Message != "" {
+		message = detail.Message
+	}
+	if message == "" {
+		message = envelope.Message
+	}
+
+	code := ""
+	switch value := detail.Code.(type) {
+	case string:
+		code = value
+	case float64:
+		code = strconv.FormatFloat(value, 'f', -1, 64)
+	}
+
+	// Anthropic only has a type, which is the closest thing to a code, and its types aren't OpenAI's
+	errType := detail.Type
+	if envelope.Type == "error" {
+		if code == "" {
+			code = errType
+		}
+		errType = ""
+	}
+	return ErrorDetail{Message: message, Type: errType, Param: detail.Param, Code: code}
+}
+
+func errorTypeForStatus(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return ErrTypeAuthentication
+	case status == http.StatusForbidden:
+		return ErrTypePermission
+	case status == http.StatusNotFound:
+		return ErrTypeNotFound
+	case status == http.StatusTooManyRequests:
+		return ErrTypeRequests
+	case status >= http.StatusInternalServerError:
+		return ErrTypeServer
+	}
+	return ErrTypeInvalidRequest
+}
@@ -0,0 +1,111 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUpstreamError(t *testing.T) {
+	// OpenAI
+	detail := parseUpstreamError([]byte(`{"error": {"message": "Rate limit reached", "type": "requests", "param": null, "code": "rate_limit_exceeded"}}`))
+	assert.Equal(t, ErrorDetail{Message: "Rate limit reached", Type: "requests", Code: "rate_limit_exceeded"}, detail)
+
+	// Azure
+	detail = parseUpstreamError([]byte(`{"error": {"code": "429", "message": "Requests have exceeded the rate limit"}}`))
+	assert.Equal(t, ErrorDetail{Message: "Requests have exceeded the rate limit", Code: "429"}, detail)
+	detail = parseUpstreamError([]byte(`{"statusCode": 401, "message": "Access denied due to invalid subscription key"}`))
+	assert.Equal(t, ErrorDetail{Message: "Access denied due to invalid subscription key"}, detail)
+
+	// Anthropic
+	detail = parseUpstreamError([]byte(`{"type": "error", "error": {"type": "overloaded_error", "message": "Overloaded"}}`))
+	assert.Equal(t, ErrorDetail{Message: "Overloaded", Code: "overloaded_error"}, detail)
+
+	// Plain text
+	detail = parseUpstreamError([]byte("upstream connect error\n"))
+	assert.Equal(t, ErrorDetail{Message: "upstream connect error"}, detail)
+}
+
+func TestErrorNormalizer(t *testing.T) {
+	assert.Nil(t, newErrorNormalizer(nil).Hook())
+
+	normalize := func(config *NormalizeErrorsConfig, status int, body string) (*http.Response, UpstreamErrorResponse) {
+		resp := &http.Response{
+			StatusCode: status,
+			Header:     http.Header{"Content-Type": []string{"text/plain"}},
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}
+		newErrorNormalizer(config).Hook()(resp)
+
+		var normalized UpstreamErrorResponse
+		data, _ := ioutil.ReadAll(resp.Body)
+		json.Unmarshal(data, &normalized)
+		return resp, normalized
+	}
+
+	original := `{"type": "error", "error": {"type": "rate_limit_error", "message": "Slow down"}}`
+	resp, normalized := normalize(&NormalizeErrorsConfig{}, http.StatusTooManyRequests, original)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, ErrorDetail{Message: "Slow down", Type: ErrTypeRequests, Code: "rate_limit_error"}, normalized.Error)
+	assert.Nil(t, normalized.ProviderError)
+
+	_, normalized = normalize(&NormalizeErrorsConfig{PreserveOriginal: true}, http.StatusTooManyRequests, original)
+	assert.JSONEq(t, original, string(normalized.ProviderError))
+
+	_, normalized = normalize(&NormalizeErrorsConfig{PreserveOriginal: true}, http.StatusBadGateway, "")
+	assert.Equal(t, ErrorDetail{Message: "Bad Gateway", Type: ErrTypeServer}, normalized.Error)
+
+	// Successful responses are left alone
+	resp, _ = normalize(&NormalizeErrorsConfig{}, http.StatusOK, "{}")
+	assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+}
+
+func TestUpstreamErrorsVerbatim(t *testing.T) {
+	body := []byte(`{"error": {"message": "Invalid 'max_tokens'", "type": "invalid_request_error", "param": "max_tokens", "code": null}}`)
+	client := HttpClientFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusBadRequest,
+			Header:     http.Header{"Content-Type": {"application/json"}, "X-Request-Id": {"req_123"}},
+			Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		}, nil
+	})
+	send := func(config *RouteConfig) *httptest.ResponseRecorder {
+		config.Forward, config.Provider = FAKE_BASE_URL, "openai"
+		config.Models = map[string]ModelConfig{TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60, TokensPerMinute: 60000}}
+		w := httptest.NewRecorder()
+		request := []byte(`{"model": "gpt-3.5-turbo", "prompt": "test", "max_tokens": -1}`)
+		NewOpenAI(config, client).GetHandler()(w, httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewBuffer(request)))
+		return w
+	}
+
+	// The status, headers and body reach the client untouched by the route's response transform
+	w := send(&RouteConfig{ResponseTransform: &ResponseTransformConfig{Envelope: "data"}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "req_123", w.Header().Get("X-Request-Id"))
+	assert.Equal(t, body, w.Body.Bytes())
+
+	// Routes normalizing errors get the proxy's shape instead
+	w = send(&RouteConfig{NormalizeErrors: &NormalizeErrorsConfig{}, ResponseTransform: &ResponseTransformConfig{Envelope: "data"}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `"data"`)
+}
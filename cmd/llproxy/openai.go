@@ -17,12 +17,12 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/pkoukk/tiktoken-go"
 	"github.com/sashabaranov/go-openai"
@@ -34,9 +34,42 @@ const GPT_3_5_DEFAULT = "gpt-3.5-turbo-0613"
 const GPT_4_DEFAULT = "gpt-4-0613"
 
 type OpenAIProvider struct {
-	client     HttpClient
-	urlBase    string
-	schedulers SchedulerMap
+	client            HttpClient
+	urlBase           string
+	schedulers        SchedulerMap
+	batchSchedulers   SchedulerMap
+	batchFiles        *IDTracker[*BatchFileUpload]
+	assistants        *IDTracker[string]
+	assistantModel    string
+	fineTuning        *fineTuningLimits
+	maxUploadBytes    int64
+	upstreams         *upstreamPool
+	paths             *pathRewriter
+	apiVersions       *apiVersions
+	anthropicHeaders  *anthropicHeaders
+	streamShaper      *streamShaper
+	contentFilter     *contentFilter
+	requestTransform  *requestTransformer
+	responseTransform *responseTransformer
+	routingRules      routingRules
+	requestHeaders    map[string]string
+	responseHeaders   map[string]string
+	scopes            *schedulerScopes
+	pathLimits        *pathLimits
+	routeLimit        *routeLimit
+	scopeQuota        *scopeQuota
+	duplicates        *duplicateDetector
+	endpoints         endpointAllowlist
+	clientTimeout     *ClientTimeoutConfig
+	normalizeErrors   *errorNormalizer
+	limitDiscovery    *limitDiscovery
+	maintenance       *maintenanceSwitch
+	faults            *faultInjector
+	credentials       *upstreamCredentials
+	keyPool           *apiKeyPool
+	deprecations      *modelDeprecations
+	guardrails        *samplingGuardrails
+	includeUsage      bool
 }
 
 // Wrap these so that we can define our Request interface
@@ -56,172 +89,671 @@ func NewOpenAI(config *RouteConfig, client HttpClient) *OpenAIProvider {
 	}
 
 	/*
-		TODO: May make more sense to read limits from https://api.openai.com/dashboard/rate_limits
-		Potential reason not to: this api is not documented and may change/go away
+		Limits come from config, and can be checked against the x-ratelimit-limit-* headers with limitDiscovery.
+		https://api.openai.com/dashboard/rate_limits isn't used since it's not documented and may change/go away
 	*/
-	return &OpenAIProvider{
-		client:     client,
-		schedulers: initSchedulers(config.Provider, config.Models),
-		urlBase:    config.Forward,
+	provider := &OpenAIProvider{
+		client:            client,
+		schedulers:        initSchedulers(config.Provider, config.Models),
+		batchSchedulers:   initSchedulers(config.Provider, config.BatchModels),
+		urlBase:           upstreamURLs(config)[0],
+		assistants:        NewIDTracker[string](),
+		assistantModel:    assistantModel(config),
+		fineTuning:        newFineTuningLimits(config.FineTuning),
+		maxUploadBytes:    config.MaxUploadBytes,
+		upstreams:         newUpstreamPool(upstreamURLs(config), config.StickyHeader, config.UpstreamAllowlist...),
+		paths:             newPathRewriter(config.Paths),
+		apiVersions:       newAPIVersions(config.APIVersion),
+		anthropicHeaders:  newAnthropicHeaders(config.Anthropic),
+		streamShaper:      newStreamShaper(config.StreamShaping),
+		contentFilter:     newContentFilter(config.ContentFilter),
+		requestTransform:  newRequestTransformer(config.RequestTransform),
+		responseTransform: newResponseTransformer(config.ResponseTransform, config.NormalizeErrors != nil),
+		routingRules:      newRoutingRules(config.RoutingRules, config.Models),
+		requestHeaders:    config.RequestHeaders,
+		responseHeaders:   config.ResponseHeaders,
+		scopes:            newSchedulerScopes(config),
+		pathLimits:        newPathLimits(config.Provider, config.PathLimits),
+		routeLimit:        newRouteLimit(config.Provider, config.RouteLimit),
+		clientTimeout:     config.ClientTimeout,
+		normalizeErrors:   newErrorNormalizer(config.NormalizeErrors),
+		limitDiscovery:    newLimitDiscovery(config.LimitDiscovery),
+		maintenance:       newMaintenanceSwitch(config),
+		faults:            newFaultInjector(config.FaultInjection),
+		credentials:       newUpstreamCredentials(config),
+		keyPool:           newAPIKeyPool(config),
+		deprecations:      newModelDeprecations(config.Deprecations),
+		guardrails:        newSamplingGuardrails(config.SamplingGuardrails),
+		duplicates:        newDuplicateDetector(config.DuplicateStorm),
+		endpoints:         config.Endpoints,
+		includeUsage:      config.IncludeStreamUsage,
 	}
+	// Scopes any header value can create are also held to the route's limits, so callers can't make up capacity
+	quota := config.ScopeQuota
+	if quota == nil && len(config.SchedulerScopeValues) == 0 {
+		quota = &ScopeQuotaConfig{Share: 1}
+	}
+	if provider.scopeQuota = newScopeQuota(quota, provider.schedulers, provider.batchSchedulers, provider.scopes); provider.scopeQuota != nil {
+		go provider.scopeQuota.Run()
+	}
+	if config.InspectBatchFiles {
+		provider.batchFiles = NewIDTracker[*BatchFileUpload]()
+	}
+	if config.LimitDiscovery != nil && config.LimitDiscovery.Probe {
+		go provider.limitDiscovery.probe(client, provider.paths.Base(provider.urlBase), provider.schedulers)
+	}
+	return provider
+}
+
+func (o *OpenAIProvider) Schedulers() SchedulerMap {
+	return o.schedulers
+}
+
+func (o *OpenAIProvider) ScopedSchedulers() []SchedulerMap {
+	scoped := o.scopes.All()
+	if schedulers := o.pathLimits.Schedulers(); schedulers != nil {
+		scoped = append(scoped, schedulers)
+	}
+	if schedulers := o.routeLimit.Schedulers(); schedulers != nil {
+		scoped = append(scoped, schedulers)
+	}
+	scoped = append(scoped, o.keyPool.Schedulers()...)
+	return scoped
+}
+
+func (o *OpenAIProvider) Maintenance() *maintenanceSwitch {
+	return o.maintenance
+}
+
+func (o *OpenAIProvider) LimitDiscovery() *limitDiscovery {
+	return o.limitDiscovery
+}
+
+func (o *OpenAIProvider) Faults() *faultInjector {
+	return o.faults
+}
+
+func (o *OpenAIProvider) Upstreams() []*UpstreamHealth {
+	return o.upstreams.All()
+}
+
+func (o *OpenAIProvider) UpstreamPool() *upstreamPool {
+	return o.upstreams
+}
+
+func (o *OpenAIProvider) KeyPool() *apiKeyPool {
+	return o.keyPool
 }
 
 func (o *OpenAIProvider) GetHandler() func(http.ResponseWriter, *http.Request) {
 	// Create the closure for the handler function with this Provider
 	return func(w http.ResponseWriter, r *http.Request) {
 
+		// The request is rewritten to be scheduled as it will be sent, or turned away if the route doesn't allow it
+		r, allowed, err := o.prepareRequest(r)
+		if !allowed {
+			writeEndpointForbidden(w, r, "")
+			return
+		}
+		if err != nil {
+			routeLog(r.Context()).Debugw("Bad Request", "url", r.URL, "reason", err.Error())
+			writeRequestError(w, err)
+			return
+		}
+
+		// Storms of identical requests from a client are reported, and throttled before they take any capacity
+		if !o.duplicates.Check(w, r) {
+			return
+		}
+
+		// Streams are asked for their usage, the client is only sent it if it asked too
+		stripUsage := false
+		if o.includeUsage {
+			var err error
+			if stripUsage, err = includeStreamUsage(r); err != nil {
+				routeLog(r.Context()).Debugw("Bad Request", "url", r.URL, "reason", err.Error())
+				writeRequestError(w, err)
+				return
+			}
+		}
+
 		// Find the model for the request
-		model, request, err := o.ParseRequest(r)
+		routed, err := o.routeRequest(r)
 		if err != nil {
-			zap.S().Debugw("Bad Request", "url", r.URL, "reason", err.Error())
-			http.Error(w, fmt.Sprintf("LLProxy: %s", err.Error()), http.StatusBadRequest)
+			routeLog(r.Context()).Debugw("Bad Request", "url", r.URL, "reason", err.Error())
+			writeRequestError(w, err)
+			return
+		}
+		model, request, rule := routed.model, routed.request, routed.rule
+		var hooks []ResponseHook
+		if model != routed.requested {
+			hooks = append(hooks, modelSubstitutionHook(routed.requested, model))
+		}
+
+		record := recordFromContext(r.Context())
+		if record != nil {
+			record.Model = model
+		}
+
+		if !routed.allowed {
+			writeEndpointForbidden(w, r, model)
+			return
+		}
+
+		// Disabled routes and models are switched off without removing their config
+		if disabled, which, ok := o.maintenance.Check(model); ok {
+			writeDisabled(w, r, which, disabled)
+			return
+		}
+
+		// Clients of deprecated models are warned, and turned away once the model is retired if it's blocked
+		if !o.deprecations.Check(w, r, model) {
 			return
 		}
 
+		// Injected faults come before scheduling, so an injected 429 takes no capacity
+		if !o.faults.Inject(w, r) {
+			return
+		}
+
+		// The key a request is forwarded with, if it's from the route's pool, and the upstream's status for it
+		var pooled *pooledKey
+		status := 0
+
+		// Uploaded batch files and assistants are remembered once the upstream has assigned them an id
+		switch request := request.(type) {
+		case *BatchFileUpload:
+			hooks = append(hooks, o.batchFiles.RecordResponseID(request))
+		case *AssistantRequest:
+			hooks = append(hooks, o.assistants.RecordResponseID(request.Model))
+		case *FineTuningRequest:
+			if !o.admitFineTuningJob(w, r, request) {
+				return
+			}
+			// Jobs the upstream didn't create don't count against the day's
+			defer func() { o.fineTuning.Done(status) }()
+		}
+
+		schedulers, scope, batch := o.schedulersFor(r, request, true)
+
+		client := o.client
+
+		// Static headers come from the route, and then the model's scheduler config
+		requestHeaders := []map[string]string{o.requestHeaders}
+		responseHeaders := []map[string]string{o.responseHeaders}
+
 		// If we have a model, pass the request to the matching scheduler
 		// otherwise we can skip the scheduler and forward directly
-		if model != "" {
+		if _, ok := schedulers[model]; model != "" && !ok && dryRunIgnores(r, model, 0, "NoSchedulerForModel") {
+			// Observing only, a model without a scheduler is forwarded unscheduled
+			hooks = append(hooks, usageHook(record, 0, nil))
+		} else if model != "" {
 
 			// Find the corresponding scheduler
-			scheduler, ok := o.schedulers[model]
+			scheduler, ok := schedulers[model]
 			if !ok {
-				zap.S().Debugw("Rejecting request", "url", r.URL, "model", model, "reason", "NoSchedulerForModel")
-				http.Error(w, fmt.Sprintf("LLMProxy: No scheduler found for model '%s'", model), http.StatusBadRequest)
+				routeLog(r.Context()).Debugw("Rejecting request", "url", r.URL, "model", model, "reason", "NoSchedulerForModel")
+				writeRejection(w, http.StatusBadRequest, ErrTypeInvalidRequest, ErrCodeNoSchedulerForModel, RejectModelForbidden, fmt.Sprintf("No scheduler found for model '%s'", model))
+				return
+			}
+
+			// Chats can lose their oldest context rather than be rejected for not fitting, if the model allows it
+			if scheduler.Config.TruncatePrompt {
+				dropped, err := truncatePrompt(r, request, scheduler.Config.ContextWindow)
+				if err != nil {
+					routeLog(r.Context()).Debugw("Bad Request", "url", r.URL, "reason", err.Error())
+					writeRequestError(w, err)
+					return
+				}
+				if dropped > 0 {
+					routeLog(r.Context()).Debugw("Truncated prompt", "url", r.URL, "model", model, "messages", dropped)
+					hooks = append(hooks, truncatedHook(dropped))
+				}
+			}
+
+			tokens, err := tokensForRequest(request, scheduler)
+
+			// Trusted clients can count the tokens of payloads the proxy can't
+			if estimate := clientTokenEstimate(r.Context()); estimate > 0 {
+				routeLog(r.Context()).Debugw("Using the client's token estimate", "url", r.URL, "model", model, "tokens", estimate, "estimated", tokens)
+				tokens, err = estimate, nil
+			}
+			if err != nil && !dryRunIgnores(r, model, 0, "TokensForRequestError") {
+				routeLog(r.Context()).Debugw("Rejecting request", "url", r.URL, "model", model, "reason", "TokensForRequestError")
+				writeError(w, http.StatusBadRequest, ErrTypeInvalidRequest, ErrCodeInvalidRequest, "could not extract tokens for request")
 				return
 			}
 
-			tokens, err := request.TokensForRequest()
-			if err != nil {
-				zap.S().Debugw("Rejecting request", "url", r.URL, "model", model, "reason", "TokensForRequestError")
-				http.Error(w, "LLMProxy: could not extract tokens for request", http.StatusBadRequest)
+			// Requests that can't fit the model's context are rejected before taking queue time or upstream quota
+			if err := checkContextWindow(request, scheduler.Config.ContextWindow); err != nil && !dryRunIgnores(r, model, tokens, "ContextLengthExceeded") {
+				routeLog(r.Context()).Debugw("Rejecting request", "url", r.URL, "model", model, "tokens", tokens, "reason", "ContextLengthExceeded")
+				writeRequestError(w, err)
 				return
 			}
 
+			// Keys with limits of their own are chosen by which has capacity for the request soonest, and it waits in that key's scheduler
+			if !batch && o.credentials.For(model, batch) == "" {
+				if pooled = o.keyPool.AcquireFor(model, float64(tokens)); pooled != nil {
+					defer func() { o.keyPool.Release(pooled, status) }()
+					scheduler = pooled.schedulers[model]
+				}
+			}
+
+			// Embeddings batches too large for one upstream call are sent in parts, each admitted in turn, so only the
+			// first part's share of the tokens is charged here and it's the parts that have to fit the model's limits
+			charged, largest := tokens, tokens
+			var chunks [][]any
+			var parts []int
+			if embedding, ok := request.(*EmbeddingRequest); ok {
+				if chunks = embeddingChunks(embedding.Input, scheduler.Config.EmbeddingBatch); chunks != nil {
+					parts = embeddingPartTokens(chunks, tokens)
+					charged, largest = parts[0], 0
+					for _, part := range parts {
+						if part > largest {
+							largest = part
+						}
+					}
+				}
+			}
+
 			// Ensure that the schedule is capable of handling a request of this size
-			if scheduler.Config.ReqsPerMinute < 1 || scheduler.Config.TokensPerMinute < float64(tokens) {
-				zap.S().Debugw("Rejecting request", "url", r.URL, "model", model, "tokens", tokens, "reason", "RequestTooLarge")
-				http.Error(w, fmt.Sprintf("LLProxy: Request too large for model '%s'", model), http.StatusBadRequest)
+			if limits := scheduler.Limits(); (limits.ReqsPerMinute < 1 || limits.TokensPerMinute < float64(largest)) && !dryRunIgnores(r, model, tokens, "RequestTooLarge") {
+				routeLog(r.Context()).Debugw("Rejecting request", "url", r.URL, "model", model, "tokens", tokens, "reason", "RequestTooLarge")
+				writeRejection(w, http.StatusBadRequest, ErrTypeInvalidRequest, ErrCodeRequestTooLarge, RejectTooLarge, fmt.Sprintf("Request too large for model '%s'", model))
 				return
 			}
 
-			// Create a ScheduledRequest and send it to the scheduler
-			responseChannel := make(chan Response)
-			scheduler.Requests <- ScheduledRequest{
-				Request:               r,
-				ResponseChannel:       responseChannel,
-				RequiredTokenCapacity: float64(tokens),
+			// Queued requests are admitted by the priority their client is allowed
+			_, priority := clientFromContext(r.Context())
+			options := SubmitOptions{Priority: priority, NoQueue: clientNoQueue(r.Context()), MaxWait: o.clientTimeout.MaxWait(r)}
+
+			// Streamed requests can be sent keepalives with their queue position while they wait
+			if scheduler.Config.QueueKeepalive > 0 && isStream(request) {
+				feedback := newQueueFeedbackWriter(w)
+				defer feedback.Finish()
+				w = feedback
+				options.Observer = feedback.observer(scheduler.Config.QueueKeepalive)
 			}
 
-			// Wait for the scheduler to signal that we can proceed
-			response := <-responseChannel
+			// Send the request to the scheduler and wait for it to signal that we can proceed
+			record.SetStage(StageQueued, scheduler, float64(charged))
+			response, reason := scheduler.SubmitWithReason(r, float64(charged), options)
 
-			// If we got a RateLimit response send that back to the client
+			// If we got a RateLimit response send that back to the client along with when to retry
 			if response == RateLimit {
-				zap.S().Debugw("Rejecting request", "url", r.URL, "model", model, "tokens", tokens, "reason", "RateLimit")
-				http.Error(w, fmt.Sprintf("LLMProxy: RateLimit exceeded for model '%s'", model), http.StatusTooManyRequests)
+				routeLog(r.Context()).Debugw("Rejecting request", "url", r.URL, "model", model, "tokens", tokens, "reason", "RateLimit")
+				setRateLimitHeaders(w.Header(), scheduler)
+				setRetryAfter(w.Header(), scheduler, float64(charged))
+				writeRejection(w, http.StatusTooManyRequests, ErrTypeRequests, ErrCodeRateLimitExceeded, reason, fmt.Sprintf("RateLimit exceeded for model '%s'", model))
 				return
 			} else if response == RequestTooLarge {
 				// We should detected this before we scheduled the request, this shouldn't occur with normal expectations.
-				zap.S().Debugw("Rejecting request", "url", r.URL, "model", model, "tokens", tokens, "reason", "RequestTooLarge")
-				http.Error(w, fmt.Sprintf("LLProxy: Request too large for model '%s'", model), http.StatusBadRequest)
+				routeLog(r.Context()).Debugw("Rejecting request", "url", r.URL, "model", model, "tokens", tokens, "reason", "RequestTooLarge")
+				writeRejection(w, http.StatusBadRequest, ErrTypeInvalidRequest, ErrCodeRequestTooLarge, RejectTooLarge, fmt.Sprintf("Request too large for model '%s'", model))
+				return
 			}
+
+			// Scopes splitting the model's limits are also admitted by the model's own scheduler, the pool they share
+			pool, ok := o.scopeQuota.Admit(w, r, scope, batch, scheduler, float64(charged), options)
+			if !ok {
+				return
+			}
+
+			// Models sharing account-level limits are also capped together
+			if !o.routeLimit.Admit(w, r, scheduler, float64(charged), options, pool) {
+				return
+			}
+
+			record.SetStage(StageUpstream, scheduler, float64(charged))
+			if hook := softLimitHook(r, scheduler); hook != nil {
+				hooks = append(hooks, hook)
+			}
+
+			// Parts of a split batch and requeued requests are admitted by the same schedulers again
+			shared := []*Scheduler{pool, o.routeLimit.Schedulers()[routeLimitModel]}
+			if chunks != nil {
+				routeLog(r.Context()).Debugw("Splitting embeddings batch", "url", r.URL, "model", model, "parts", len(chunks))
+				client = &embeddingSplitClient{client: client, scheduler: scheduler, shared: shared, options: options, chunks: chunks, tokens: parts}
+			}
+
+			// Upstream 429s can be absorbed by queueing the request again
+			if retries := clientRetries(r.Context(), scheduler.Config.UpstreamRateLimitRetries); retries > 0 {
+				requeue, err := newRequeueClient(client, scheduler, shared, r, float64(charged), options, retries)
+				if err != nil {
+					routeLog(r.Context()).Debugw("Bad Request", "url", r.URL, "reason", err.Error())
+					writeRequestError(w, err)
+					return
+				}
+				client = requeue
+			}
+
+			// The upstream's own limits are read before they're replaced. They're the limits of the pool when scopes share
+			// one, and reach the scopes as their shares of it.
+			discovered := scheduler
+			if pool != nil {
+				discovered = pool
+			}
+			if hook := o.limitDiscovery.Hook(discovered); hook != nil {
+				hooks = append(hooks, hook)
+			}
+
+			// Report the limits the proxy enforces rather than the upstream account-level limits
+			hooks = append(hooks, func(resp *http.Response) {
+				setRateLimitHeaders(resp.Header, scheduler)
+			})
+			if hook := responseTokenHook(request, scheduler); hook != nil {
+				hooks = append(hooks, hook)
+			}
+
+			// Usage is read before any response transform can change it, and priced if the model has a price
+			if hook := estimatedCostHook(request, tokens, scheduler.Config.Price); hook != nil {
+				hooks = append(hooks, hook)
+			}
+			hooks = append(hooks, usageHook(record, tokens, scheduler.Config.Price))
+
+			requestHeaders = append(requestHeaders, scheduler.Config.RequestHeaders)
+			responseHeaders = append(responseHeaders, scheduler.Config.ResponseHeaders)
+		} else if !o.pathLimits.Admit(w, r) {
+			// Requests we don't schedule by model can still be limited by their path
+			return
+		}
+
+		// Upstream errors are put in one shape before any other response mutations see them
+		if hook := o.normalizeErrors.Hook(); hook != nil {
+			hooks = append(hooks, hook)
+		}
+
+		// Completion text is filtered before any other mutation can move it
+		if hook := o.contentFilter.Hook(r, model); hook != nil {
+			hooks = append(hooks, hook)
+		}
+
+		// Configured response mutations see the upstream's response before anything is copied to the client
+		if hook := o.responseTransform.Hook(model); hook != nil {
+			hooks = append(hooks, hook)
+		}
+		if stripUsage {
+			hooks = append(hooks, stripUsageChunkHook())
+		}
+
+		// Injected stream drops cut the stream as the client would see it
+		if hook := o.faults.Hook(); hook != nil {
+			hooks = append(hooks, hook)
+		}
+
+		// Streamed output is passed on no faster than the route allows
+		if hook := o.streamShaper.Hook(r.Context()); hook != nil {
+			hooks = append(hooks, hook)
 		}
 
 		// Forward the request to the service
-		err = forwardRequest(o.client, o.urlBase, w, r)
+		if model == "" {
+			record.SetStage(StageUpstream, nil, 0)
+		}
+		upstream := rule.Upstream(o.upstreams.Select(r))
+		sent := time.Now()
+		if key := o.credentials.For(model, batch); key != "" {
+			setCredential(r.Header, key)
+		} else if pooled != nil {
+			setCredential(r.Header, pooled.key)
+		} else if pooled = o.keyPool.Acquire(); pooled != nil {
+			// Pooled keys learn from the upstream's answer whether to be passed over for a while
+			setCredential(r.Header, pooled.key)
+			defer func() { o.keyPool.Release(pooled, status) }()
+		}
+		o.anthropicHeaders.Apply(r)
+		setHeaders(r.Header, requestHeaders...)
+		hooks = append(hooks, func(resp *http.Response) {
+			status = resp.StatusCode
+			upstream.Record(resp.StatusCode, nil)
+			upstream.RecordLatency(time.Since(sent))
+			setHeaders(resp.Header, responseHeaders...)
+		})
+
+		// The first chunk of a stream is timed as the client receives it, after any shaping
+		if hook := firstTokenHook(record, upstream.URL); hook != nil {
+			hooks = append(hooks, hook)
+		}
+		err = forwardRequest(client, o.paths.Base(upstream.URL), w, r, hooks...)
+		var requestError *RequestError
+		if errors.As(err, &requestError) {
+			// The body was rejected while it was being streamed to the upstream
+			routeLog(r.Context()).Debugw("Rejecting request", "url", r.URL, "model", model, "reason", requestError.Code)
+			writeRequestError(w, err)
+			return
+		}
+		dropOnInjectedFault(err)
 		if err != nil {
 			// TODO: May be worth more details here like the request id and other identifiers from openai
-			zap.S().Infow("Provider Error", "url", r.URL, "model", model, "reason", err.Error())
-			http.Error(w, fmt.Sprintf("LLMProxy: Error forwarding request: %s", err.Error()), http.StatusServiceUnavailable)
+			routeLog(r.Context()).Infow("Provider Error", "url", r.URL, "model", model, "reason", err.Error())
+			upstream.Record(0, err)
+			writeError(w, http.StatusServiceUnavailable, ErrTypeServer, ErrCodeUpstreamError, fmt.Sprintf("Error forwarding request: %s", err.Error()))
 			return
 		}
 	}
 }
 
+// isStream is true for requests asking for a streamed response
+func isStream(request Request) bool {
+	switch request := request.(type) {
+	case *ChatCompletionRequest:
+		return request.Stream
+	case *CompletionRequest:
+		return request.Stream
+	}
+	return false
+}
+
+// prepareRequest maps a request to the upstream's layout and applies what comes before its model is known, returning
+// whether the route's endpoint allowlist lets it through. Configured body mutations are applied first, so the request is
+// scheduled as it will be sent, and extreme sampling parameters are clamped or rejected after any transform has set its own.
+// GetHandler and Explain both decide with it.
+func (o *OpenAIProvider) prepareRequest(r *http.Request) (*http.Request, bool, error) {
+	r = o.paths.Rewrite(r)
+	r = o.apiVersions.Apply(r)
+	if !o.endpoints.Allows(r) {
+		return r, false, nil
+	}
+	if err := o.requestTransform.Apply(r); err != nil {
+		return r, true, err
+	}
+	return r, true, o.guardrails.Apply(r)
+}
+
+// routedRequest is the model a request is scheduled by, after any routing rule
+type routedRequest struct {
+	model     string
+	request   Request
+	requested string
+	rule      *routingRule
+
+	// Models can be limited to some of the route's endpoints, e.g. embeddings models to /v1/embeddings
+	allowed bool
+}
+
+// routeRequest finds the model for a request. Routing rules can send it to another model, which is then scheduled as
+// if the client had asked for it. GetHandler and Explain both decide with it.
+func (o *OpenAIProvider) routeRequest(r *http.Request) (routedRequest, error) {
+	model, request, err := o.ParseRequest(r)
+	if err != nil {
+		return routedRequest{}, err
+	}
+	routed := routedRequest{model: model, request: request, requested: model, allowed: true}
+	rule, target, err := o.routingRules.Apply(r, model, request)
+	if err != nil {
+		return routedRequest{}, err
+	}
+	routed.rule = rule
+	if target != "" {
+		if routed.model, routed.request, err = o.ParseRequest(r); err != nil {
+			return routedRequest{}, err
+		}
+	}
+	if scheduler, ok := o.schedulers[routed.model]; ok && !endpointAllowlist(scheduler.Config.Endpoints).Allows(r) {
+		routed.allowed = false
+	}
+	return routed, nil
+}
+
+// schedulersFor returns the schedulers a request is accounted against, the scope they belong to and whether it's a batch.
+// Batches are accounted against their own tier of schedulers, and scoped routes have a set per scope. A scope that
+// doesn't exist yet is only created when create is set, otherwise what it would start with is returned.
+func (o *OpenAIProvider) schedulersFor(r *http.Request, request Request, create bool) (SchedulerMap, string, bool) {
+	schedulers, batchSchedulers, scope := o.schedulers, o.batchSchedulers, ""
+	if key := o.scopes.Key(r); key != "" {
+		get := o.scopes.Get
+		if !create {
+			get = o.scopes.Lookup
+		}
+		if scoped, ok := get(key); ok {
+			schedulers, batchSchedulers, scope = scoped.schedulers, scoped.batchSchedulers, key
+		}
+	}
+	_, batch := request.(*BatchRequest)
+	if batch {
+		schedulers = batchSchedulers
+	}
+	return schedulers, scope, batch
+}
+
 func (o *OpenAIProvider) ParseRequest(r *http.Request) (model string, request Request, err error) {
 
 	// Openai rate limits by Model:
 	// 1. Only POST methods have rate limits
 	// 2. `model` is mostly a body parameter of the same name.
 	// There are the following exceptions
-	// *  /v1/images/*  - does not have a model parameter, implied model is `DALL-E 2`
-	// *  /v1/files     - does not have a model, perhaps no rate limit?
-	// *  /v1/fine-tunes - has a model parameter, but it's usage of that is different
+	// *  /v1/images/*  - does not have a model parameter, implied model is `DALL-E 2` unless images are limited by path
+	// *  /v1/files     - does not have a model, perhaps no rate limit? Batch input files may be inspected
+	// *  /v1/batches   - model lives inside the uploaded input file
+	// *  /v1/threads/{id}/runs - model is optional, otherwise it's the model of the assistant, or the route's assistantModel
+	// *  /v1/threads, /v1/threads/{id}/messages - don't call the model
+	// *  /v1/fine-tunes, /v1/fine_tuning - has a model parameter, but it's usage of that is different. Job creation may be limited per day
 	// *  /v1/moderations - has a model parameter, but there is no rate limit
 
 	if r.Method != http.MethodPost {
 		return
 	}
 
-	// Read the body out of the request, then add it back to the message so we can read it later since ioutil will exhaust the buffer
-	bodyRaw, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return "", nil, fmt.Errorf("error reading request body: %w", err)
+	// Uploads may be limited in size, reading past the limit fails either here or while forwarding
+	if limit := o.uploadLimit(r); limit > 0 {
+		if r.ContentLength > limit {
+			return "", nil, uploadTooLarge(r.ContentLength, limit)
+		}
+		r.Body = &limitedBody{body: r.Body, limit: limit}
 	}
-	r.Body = ioutil.NopCloser(bytes.NewBuffer(bodyRaw))
+
+	// Only read as much of the body as we need to parse it, then put back what we read
+	// so the whole body can be streamed to the upstream
+	peeker := newBodyPeeker(r.Body)
+	defer func() {
+		r.Body = peeker.Body()
+	}()
+	body := peeker.Reader()
 
 	// Parse the body depending on what endpoint we are hitting
 	switch {
+	case strings.HasSuffix(r.URL.Path, "/v1/files"):
+		if o.batchFiles == nil {
+			return
+		}
+		return o.parseBatchFileUpload(r, body)
+
 	case strings.Contains(r.URL.Path, "/v1/files"):
 		return
 
-	case strings.Contains(r.URL.Path, "/v1/fine-tunes"):
-		return
+	case strings.HasSuffix(r.URL.Path, "/v1/batches"):
+		return o.parseBatchRequest(r, body)
+
+	case strings.HasSuffix(r.URL.Path, "/v1/assistants"), assistantPath.MatchString(r.URL.Path), runPath.MatchString(r.URL.Path), threadPath.MatchString(r.URL.Path):
+		return o.parseAssistantsRequest(r, body)
+
+	case strings.Contains(r.URL.Path, "/v1/fine-tunes"), strings.Contains(r.URL.Path, "/v1/fine_tuning"):
+		return o.parseFineTuningRequest(r, body)
 
 	case strings.Contains(r.URL.Path, "/v1/moderations"):
 		return
 
 	case strings.Contains(r.URL.Path, "/v1/images"):
+		if o.pathLimits.Limits(PathClassImages) {
+			return
+		}
 		// TODO: Could split this out into the three request types for parsing, but not currently import to us
 		return "DALL-E 2", nil, nil
 
 	case strings.Contains(r.URL.Path, "/v1/audio"):
 		request := new(AudioRequest)
-		err = json.Unmarshal(bodyRaw, request)
+
+		// Transcriptions and translations are uploads, speech is JSON
+		fields, ok, err := multipartFields(r.Header.Get("Content-Type"), body, "model")
+		if err != nil {
+			return "", nil, fmt.Errorf("error reading request body, %s: %w", r.URL.Path, err)
+		}
+		if ok {
+			request.Model = string(fields["model"])
+			return request.Model, request, nil
+		}
+
+		err = decodeJSON(body, request)
 		if err != nil {
 			return "", nil, fmt.Errorf("error reading request body, %s: %w", r.URL.Path, err)
 		}
 		return request.Model, request, nil
 
-	case strings.HasSuffix(r.URL.Path, "/v1/chat/completions"):
+	default:
+		return decodeRequest(r.URL.Path, body)
+	}
+}
+
+// decodeRequest parses the JSON body of the endpoints that carry a model and consume tokens
+func decodeRequest(path string, body io.Reader) (model string, request Request, err error) {
+	switch {
+	case strings.HasSuffix(path, "/v1/chat/completions"):
 		request := new(ChatCompletionRequest)
-		err = json.Unmarshal(bodyRaw, request)
+		err = decodeJSON(body, request)
 		if err != nil {
-			return "", nil, fmt.Errorf("error reading request body, %s: %w", r.URL.Path, err)
+			return "", nil, fmt.Errorf("error reading request body, %s: %w", path, err)
 		}
 		return request.Model, request, nil
 
-	case strings.HasSuffix(r.URL.Path, "/v1/completions"):
+	case strings.HasSuffix(path, "/v1/completions"):
 		request := new(CompletionRequest)
-		err = json.Unmarshal(bodyRaw, request)
+		err = decodeJSON(body, request)
 		if err != nil {
-			return "", nil, fmt.Errorf("error reading request body, %s: %w", r.URL.Path, err)
+			return "", nil, fmt.Errorf("error reading request body, %s: %w", path, err)
 		}
 		return request.Model, request, nil
 
-	case strings.HasSuffix(r.URL.Path, "/v1/embeddings"):
+	case strings.HasSuffix(path, "/v1/embeddings"):
 		request := new(EmbeddingRequest)
-		err = json.Unmarshal(bodyRaw, request)
+		err = decodeJSON(body, request)
 		if err != nil {
-			return "", nil, fmt.Errorf("error reading request body, %s: %w", r.URL.Path, err)
+			return "", nil, fmt.Errorf("error reading request body, %s: %w", path, err)
 		}
 		return request.Model.String(), request, nil
 
-	case strings.HasSuffix(r.URL.Path, "/v1/edits"):
-		zap.S().Warnw("deprecated OpenAI endpoint", "url", r.URL.Path)
+	case strings.HasSuffix(path, "/v1/edits"):
+		zap.S().Warnw("deprecated OpenAI endpoint", "url", path)
 		request := new(EditsRequest)
-		err = json.Unmarshal(bodyRaw, request)
+		err = decodeJSON(body, request)
 		if err != nil {
-			return "", nil, fmt.Errorf("error reading request body, %s: %w", r.URL.Path, err)
+			return "", nil, fmt.Errorf("error reading request body, %s: %w", path, err)
 		}
 		return *request.Model, request, nil
 
 	default:
-		zap.S().Warnw("unexpected OpenAI endpoint", "url", r.URL.Path)
+		zap.S().Warnw("unexpected OpenAI endpoint", "url", path)
 		return
 	}
 }
 
+// uploadLimit returns the maximum body size for the request, or 0 when it isn't limited
+func (o *OpenAIProvider) uploadLimit(r *http.Request) int64 {
+	if strings.Contains(r.URL.Path, "/v1/files") || strings.Contains(r.URL.Path, "/v1/audio") {
+		return o.maxUploadBytes
+	}
+	return 0
+}
+
 /*
 Token Counting is based on OpenAI Cookbooks:
 - https://github.com/openai/openai-cookbook/blob/main/examples/How_to_count_tokens_with_tiktoken.ipynb
@@ -232,6 +764,11 @@ func (r *AudioRequest) TokensForRequest() (numTokens int, err error) {
 }
 
 func (r *ChatCompletionRequest) TokensForRequest() (numTokens int, err error) {
+	return r.tokensWithResponseEstimate(defaultResponseTokens)
+}
+
+// tokensWithResponseEstimate counts the prompt, assuming responseTokens per choice when max_tokens isn't set
+func (r *ChatCompletionRequest) tokensWithResponseEstimate(responseTokens int) (numTokens int, err error) {
 	// ChatCompletion is more complicated logic
 
 	model := r.Model
@@ -295,19 +832,79 @@ func (r *ChatCompletionRequest) TokensForRequest() (numTokens int, err error) {
 		n = 1
 	}
 	if maxTokens < 1 {
-		// When maxTokens is not set in the request estimate 15
-		// Based on openai cookbook:
-		// https://github.com/openai/openai-cookbook/blob/main/examples/api_request_parallel_processor.py
-		maxTokens = 15
+		maxTokens = responseTokens
 	}
 	numTokens += n * maxTokens
 
 	return numTokens, nil
 }
 
+// Ordinary completions are charged a flat 1000 tokens, requests that can cost more are charged their estimate
+const completionMinimumTokens = 1000
+
+// Prompts aren't tokenized for completions, assume this many characters per token
+const charsPerToken = 4
+
 func (r *CompletionRequest) TokensForRequest() (numTokens int, err error) {
+	return r.tokensWithResponseEstimate(defaultResponseTokens)
+}
 
-	return 1000, nil
+// tokensWithResponseEstimate accounts for every generated sequence, not just those returned:
+// best_of generates best_of completions server side, echo returns the prompt with every choice
+// and logprobs adds that many alternatives for every token returned.
+func (r *CompletionRequest) tokensWithResponseEstimate(responseTokens int) (numTokens int, err error) {
+	promptTokens, prompts := completionPromptTokens(r.Prompt)
+
+	n := r.N
+	if n < 1 {
+		n = 1
+	}
+	generations := n
+	if r.BestOf > generations {
+		generations = r.BestOf
+	}
+	maxTokens := r.MaxTokens
+	if maxTokens < 1 {
+		maxTokens = responseTokens
+	}
+
+	// Every prompt is completed separately
+	numTokens = promptTokens + prompts*generations*maxTokens
+
+	// Tokens sent back across the returned choices
+	returned := n * prompts * maxTokens
+	if r.Echo {
+		numTokens += n * promptTokens
+		returned += n * promptTokens
+	}
+	numTokens += r.LogProbs * returned
+
+	if numTokens < completionMinimumTokens {
+		numTokens = completionMinimumTokens
+	}
+	return numTokens, nil
+}
+
+// completionPromptTokens approximates the tokens in a prompt, which may be a string, token ids, or a batch of either,
+// along with how many prompts there are
+func completionPromptTokens(prompt any) (tokens int, prompts int) {
+	switch prompt := prompt.(type) {
+	case string:
+		return (len(prompt) + charsPerToken - 1) / charsPerToken, 1
+	case []any:
+		// A list of token ids is a single prompt
+		if len(prompt) > 0 {
+			if _, ok := prompt[0].(float64); ok {
+				return len(prompt), 1
+			}
+		}
+		for _, item := range prompt {
+			itemTokens, _ := completionPromptTokens(item)
+			tokens += itemTokens
+		}
+		return tokens, len(prompt)
+	}
+	return 0, 1
 }
 
 func (r *EmbeddingRequest) TokensForRequest() (numTokens int, err error) {
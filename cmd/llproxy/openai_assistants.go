@@ -0,0 +1,130 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+
+	"go.uber.org/zap"
+)
+
+// A run can make several model calls, each re-reading the thread, so without explicit limits
+// on the run we assume a generous budget.
+const ASSISTANT_RUN_DEFAULT_TOKENS = 8000
+
+var (
+	assistantPath = regexp.MustCompile(`/v1/assistants/([^/]+)$`)
+	runPath       = regexp.MustCompile(`/v1/threads/(?:[^/]+/)?runs(?:/[^/]+/submit_tool_outputs)?$`)
+	threadPath    = regexp.MustCompile(`/v1/threads(?:/[^/]+(?:/messages(?:/[^/]+)?)?)?$`)
+)
+
+// assistantModel is the model runs are scheduled against when their assistant's model isn't known, e.g. it was created
+// before the proxy started. Unless configured, it's the route's model with the lowest token limit, so those runs are
+// held to the strictest limits rather than not limited at all.
+func assistantModel(config *RouteConfig) string {
+	if config.AssistantModel != "" {
+		return config.AssistantModel
+	}
+	model := ""
+	for _, name := range sortedModels(config.Models) {
+		if model == "" || config.Models[name].TokensPerMinute < config.Models[model].TokensPerMinute {
+			model = name
+		}
+	}
+	return model
+}
+
+// AssistantRequest is the body of creating or modifying an assistant
+type AssistantRequest struct {
+	Model string `json:"model"`
+}
+
+// RunRequest is the body of creating a run, or creating a thread and running it in one request
+type RunRequest struct {
+	AssistantID         string `json:"assistant_id"`
+	Model               string `json:"model"`
+	MaxPromptTokens     int    `json:"max_prompt_tokens"`
+	MaxCompletionTokens int    `json:"max_completion_tokens"`
+}
+
+// Creating an assistant doesn't call the model
+func (r *AssistantRequest) TokensForRequest() (numTokens int, err error) {
+	return 0, nil
+}
+
+func (r *RunRequest) TokensForRequest() (numTokens int, err error) {
+	if r.MaxPromptTokens > 0 && r.MaxCompletionTokens > 0 {
+		return r.MaxPromptTokens + r.MaxCompletionTokens, nil
+	}
+	return ASSISTANT_RUN_DEFAULT_TOKENS, nil
+}
+
+func (o *OpenAIProvider) parseAssistantsRequest(r *http.Request, body io.Reader) (model string, request Request, err error) {
+	switch {
+	case runPath.MatchString(r.URL.Path):
+		run := new(RunRequest)
+		err = decodeJSON(body, run)
+		if err != nil {
+			return "", nil, fmt.Errorf("error reading request body, %s: %w", r.URL.Path, err)
+		}
+
+		// The run uses the assistant's model unless it is overridden. Submitting tool outputs resumes a run whose
+		// assistant isn't sent, like runs of assistants we haven't seen created.
+		model = run.Model
+		if model == "" {
+			model, _ = o.assistants.Get(run.AssistantID)
+		}
+		if model == "" {
+			model = o.assistantModel
+			zap.S().Debugw("No model known for assistant, using the route's assistant model", "url", r.URL.Path, "assistant", run.AssistantID, "model", model)
+		}
+		if model == "" {
+			return "", nil, nil
+		}
+		return model, run, nil
+
+	case threadPath.MatchString(r.URL.Path):
+		// Threads and their messages are only stored, the model is called by runs
+		return "", nil, nil
+
+	case assistantPath.MatchString(r.URL.Path):
+		assistant := new(AssistantRequest)
+		err = decodeJSON(body, assistant)
+		if err != nil {
+			return "", nil, fmt.Errorf("error reading request body, %s: %w", r.URL.Path, err)
+		}
+
+		// Modifying an assistant may change its model, the id is already known
+		if assistant.Model != "" {
+			o.assistants.Set(assistantPath.FindStringSubmatch(r.URL.Path)[1], assistant.Model)
+		}
+		return "", nil, nil
+
+	default:
+		assistant := new(AssistantRequest)
+		err = decodeJSON(body, assistant)
+		if err != nil {
+			return "", nil, fmt.Errorf("error reading request body, %s: %w", r.URL.Path, err)
+		}
+
+		// The id is only known once the upstream has created the assistant
+		return "", assistant, nil
+	}
+}
@@ -0,0 +1,163 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// Batches and batch input files the proxy can't account for are rejected with this code
+const ErrCodeInvalidBatch = "invalid_batch"
+
+func invalidBatch(format string, args ...any) error {
+	return &RequestError{
+		Status:  http.StatusBadRequest,
+		Type:    ErrTypeInvalidRequest,
+		Code:    ErrCodeInvalidBatch,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// BatchRequest is the body of POST /v1/batches. The model and token usage come from the
+// input file, which we only know about if we inspected it when it was uploaded.
+type BatchRequest struct {
+	InputFileID      string `json:"input_file_id"`
+	Endpoint         string `json:"endpoint"`
+	CompletionWindow string `json:"completion_window"`
+	tokens           int
+}
+
+// BatchFileUpload is the token estimate for an uploaded batch input file
+type BatchFileUpload struct {
+	Model  string
+	URL    string
+	Tokens int
+	Lines  int
+}
+
+// A single line of a batch input file
+type batchLine struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+func (r *BatchRequest) TokensForRequest() (numTokens int, err error) {
+	return r.tokens, nil
+}
+
+func (r *BatchFileUpload) TokensForRequest() (numTokens int, err error) {
+	return r.Tokens, nil
+}
+
+// parseBatchFileUpload estimates the tokens of a multipart batch input file upload.
+// Uploads for any other purpose are passed through untouched.
+func (o *OpenAIProvider) parseBatchFileUpload(r *http.Request, body io.Reader) (model string, request Request, err error) {
+	fields, ok, err := multipartFields(r.Header.Get("Content-Type"), body, "purpose", "file")
+	if err != nil {
+		return "", nil, fmt.Errorf("error reading request body, %s: %w", r.URL.Path, err)
+	}
+	content, hasFile := fields["file"]
+	if !ok || string(fields["purpose"]) != "batch" || !hasFile {
+		return "", nil, nil
+	}
+
+	upload, err := estimateBatchFile(content)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Uploads are not scheduled, the tokens are consumed when the batch is created
+	return "", upload, nil
+}
+
+// estimateBatchFile totals the tokens of a batch input file. Files whose lines can't all be estimated, or that mix
+// models or endpoints, which the upstream would fail anyway, are rejected rather than let through unaccounted.
+func estimateBatchFile(content []byte) (*BatchFileUpload, error) {
+	upload := new(BatchFileUpload)
+	for i, raw := range bytes.Split(content, []byte("\n")) {
+		raw = bytes.TrimSpace(raw)
+		if len(raw) == 0 {
+			continue
+		}
+
+		var line batchLine
+		if err := json.Unmarshal(raw, &line); err != nil {
+			return nil, invalidBatch("Batch file line %d isn't valid JSON: %s", i+1, err)
+		}
+
+		model, request, err := decodeRequest(line.URL, bytes.NewReader(line.Body))
+		if err != nil {
+			return nil, invalidBatch("Batch file line %d has an invalid body: %s", i+1, err)
+		}
+		if request == nil || model == "" {
+			return nil, invalidBatch("Batch file line %d is for %s, whose tokens can't be estimated", i+1, line.URL)
+		}
+
+		tokens, err := request.TokensForRequest()
+		if err != nil {
+			return nil, invalidBatch("Batch file line %d can't be estimated: %s", i+1, err)
+		}
+
+		// OpenAI requires a single model and endpoint per batch file
+		if upload.Lines == 0 {
+			upload.Model, upload.URL = model, line.URL
+		} else if upload.URL != line.URL {
+			return nil, invalidBatch("Batch file line %d is for %s, earlier lines are for %s", i+1, line.URL, upload.URL)
+		} else if upload.Model != model {
+			return nil, invalidBatch("Batch file line %d is for model %s, earlier lines are for %s", i+1, model, upload.Model)
+		}
+		upload.Tokens += tokens
+		upload.Lines += 1
+	}
+	if upload.Lines == 0 {
+		return nil, invalidBatch("Batch file has no requests")
+	}
+	return upload, nil
+}
+
+func (o *OpenAIProvider) parseBatchRequest(r *http.Request, body io.Reader) (model string, request Request, err error) {
+	batch := new(BatchRequest)
+	err = decodeJSON(body, batch)
+	if err != nil {
+		return "", nil, fmt.Errorf("error reading request body, %s: %w", r.URL.Path, err)
+	}
+
+	if o.batchFiles == nil {
+		return "", nil, nil
+	}
+
+	// Batches of files we haven't estimated would bypass the batch schedulers
+	upload, ok := o.batchFiles.Get(batch.InputFileID)
+	if !ok {
+		zap.S().Debugw("No estimate for batch input file", "url", r.URL.Path, "file", batch.InputFileID)
+		return "", nil, invalidBatch("Input file %s wasn't uploaded through the proxy, so the batch's tokens can't be estimated", batch.InputFileID)
+	}
+	if batch.Endpoint != upload.URL {
+		return "", nil, invalidBatch("Batch is for %s, but input file %s is for %s", batch.Endpoint, batch.InputFileID, upload.URL)
+	}
+
+	batch.tokens = upload.Tokens
+	return upload.Model, batch, nil
+}
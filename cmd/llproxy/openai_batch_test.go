@@ -0,0 +1,162 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func CreateBatchOpenAI() *OpenAIProvider {
+	config := &RouteConfig{
+		Forward:  FAKE_BASE_URL,
+		Provider: "openai",
+		Models: map[string]ModelConfig{
+			TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60.0, TokensPerMinute: 60000.0},
+		},
+		BatchModels: map[string]ModelConfig{
+			TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60.0, TokensPerMinute: 1000000.0},
+		},
+		InspectBatchFiles: true,
+	}
+	return NewOpenAI(config, &MockHttpClient{})
+}
+
+func batchUploadRequest(t *testing.T, purpose string, content string) *http.Request {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	assert.NoError(t, writer.WriteField("purpose", purpose))
+	file, err := writer.CreateFormFile("file", "batch.jsonl")
+	assert.NoError(t, err)
+	file.Write([]byte(content))
+	assert.NoError(t, writer.Close())
+
+	req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/files", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func TestBatchWorkflow(t *testing.T) {
+	ConfigureLogging(LogType("console"), LogLevel("debug"))
+	openai := CreateBatchOpenAI()
+	handler := openai.GetHandler()
+
+	content := `{"custom_id": "1", "method": "POST", "url": "/v1/completions", "body": {"model": "gpt-3.5-turbo", "prompt": "a"}}
+{"custom_id": "2", "method": "POST", "url": "/v1/completions", "body": {"model": "gpt-3.5-turbo", "prompt": "b"}}
+`
+
+	// Upload the batch input file, the client still gets the upstream response
+	w := httptest.NewRecorder()
+	handler(w, batchUploadRequest(t, "batch", content))
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"id": "file-abc123", "object": "file"}`, string(body))
+
+	upload, ok := openai.batchFiles.Get("file-abc123")
+	assert.True(t, ok)
+	assert.Equal(t, TEST_MODEL, upload.Model)
+	assert.Equal(t, 2, upload.Lines)
+	assert.Equal(t, 2000, upload.Tokens)
+
+	// Creating the batch consumes the estimate from the batch tier only
+	req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/batches", bytes.NewBufferString(`{"input_file_id": "file-abc123", "endpoint": "/v1/completions", "completion_window": "24h"}`))
+	w = httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	assert.InDelta(t, 998000.0, openai.batchSchedulers[TEST_MODEL].Snapshot().TokenCapacity, 100.0)
+	assert.InDelta(t, 60000.0, openai.schedulers[TEST_MODEL].Snapshot().TokenCapacity, 1.0)
+}
+
+func TestBatchFileUpload_OtherPurpose(t *testing.T) {
+	ConfigureLogging(LogType("console"), LogLevel("debug"))
+	openai := CreateBatchOpenAI()
+	handler := openai.GetHandler()
+
+	// Files for other purposes aren't inspected, even if their content isn't valid batch input
+	w := httptest.NewRecorder()
+	handler(w, batchUploadRequest(t, "fine-tune", "not json"))
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	_, ok := openai.batchFiles.Get("file-abc123")
+	assert.False(t, ok)
+}
+
+func TestBatchFileUpload_Rejected(t *testing.T) {
+	ConfigureLogging(LogType("console"), LogLevel("debug"))
+	line := func(url string, model string) string {
+		return `{"custom_id": "1", "method": "POST", "url": "` + url + `", "body": {"model": "` + model + `", "prompt": "a", "input": "a"}}` + "\n"
+	}
+	tests := map[string]struct {
+		content string
+		message string
+	}{
+		"invalid json":     {"not json\n", "line 1 isn't valid JSON"},
+		"unknown endpoint": {line("/v1/unknown", TEST_MODEL), "line 1 is for /v1/unknown, whose tokens can't be estimated"},
+		"multiple models":  {line("/v1/completions", TEST_MODEL) + line("/v1/completions", "gpt-4"), "line 2 is for model gpt-4, earlier lines are for gpt-3.5-turbo"},
+		"multiple urls":    {line("/v1/completions", TEST_MODEL) + line("/v1/embeddings", "text-embedding-ada-002"), "line 2 is for /v1/embeddings, earlier lines are for /v1/completions"},
+		"no requests":      {"\n\n", "Batch file has no requests"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			openai := CreateBatchOpenAI()
+			w := httptest.NewRecorder()
+			openai.GetHandler()(w, batchUploadRequest(t, "batch", test.content))
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			assert.Contains(t, w.Body.String(), ErrCodeInvalidBatch)
+			assert.Contains(t, w.Body.String(), test.message)
+
+			_, ok := openai.batchFiles.Get("file-abc123")
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestBatchRequest_Rejected(t *testing.T) {
+	ConfigureLogging(LogType("console"), LogLevel("debug"))
+	createBatch := func(openai *OpenAIProvider, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		openai.GetHandler()(w, httptest.NewRequest("POST", "http://localhost:8080/openai/v1/batches", bytes.NewBufferString(body)))
+		return w
+	}
+
+	// A file the proxy never saw can't be accounted for
+	openai := CreateBatchOpenAI()
+	w := createBatch(openai, `{"input_file_id": "file-unknown", "endpoint": "/v1/completions", "completion_window": "24h"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Input file file-unknown wasn't uploaded through the proxy")
+
+	// The batch has to be for the endpoint the file's requests are for
+	openai.batchFiles.Set("file-abc123", &BatchFileUpload{Model: TEST_MODEL, URL: "/v1/completions", Tokens: 2000, Lines: 2})
+	w = createBatch(openai, `{"input_file_id": "file-abc123", "endpoint": "/v1/chat/completions", "completion_window": "24h"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Batch is for /v1/chat/completions, but input file file-abc123 is for /v1/completions")
+
+	// Models without a batch scheduler aren't let through unaccounted
+	openai.batchFiles.Set("file-gpt4", &BatchFileUpload{Model: "gpt-4", URL: "/v1/completions", Tokens: 2000, Lines: 2})
+	w = createBatch(openai, `{"input_file_id": "file-gpt4", "endpoint": "/v1/completions", "completion_window": "24h"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), ErrCodeNoSchedulerForModel)
+
+	assert.InDelta(t, 1000000.0, openai.batchSchedulers[TEST_MODEL].Snapshot().TokenCapacity, 1.0)
+}
@@ -0,0 +1,207 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const ErrCodeTrainingFileTooLarge = "training_file_too_large"
+
+// How long a training file lookup may take before the job is let through unchecked
+const fileLookupTimeout = 10 * time.Second
+
+// FineTuningRequest is the body of creating a fine-tuning job, on either the legacy or current endpoint
+type FineTuningRequest struct {
+	Model        string `json:"model"`
+	TrainingFile string `json:"training_file"`
+}
+
+// Fine-tuning is limited by jobs rather than tokens
+func (r *FineTuningRequest) TokensForRequest() (numTokens int, err error) {
+	return 0, nil
+}
+
+type fineTuningLimits struct {
+	config FineTuningConfig
+	jobs   *JobLimiter
+}
+
+func newFineTuningLimits(config *FineTuningConfig) *fineTuningLimits {
+	if config == nil {
+		return nil
+	}
+	limits := &fineTuningLimits{config: *config}
+	if config.JobsPerDay > 0 {
+		limits.jobs = NewJobLimiter(config.JobsPerDay)
+	}
+	return limits
+}
+
+// JobLimiter is a token bucket over a day. Jobs are rare and expensive, so rather than
+// queueing for hours we reject as soon as the bucket is empty.
+type JobLimiter struct {
+	mu         sync.Mutex
+	jobsPerDay float64
+	capacity   float64
+	lastUpdate time.Time
+}
+
+func NewJobLimiter(jobsPerDay float64) *JobLimiter {
+	return &JobLimiter{
+		jobsPerDay: jobsPerDay,
+		capacity:   jobsPerDay,
+		lastUpdate: time.Now(),
+	}
+}
+
+// Allow takes a job from the bucket, or returns how long until one is available
+func (l *JobLimiter) Allow() (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(l.lastUpdate).Hours() / 24
+	l.capacity = math.Min(l.jobsPerDay, l.capacity+elapsed*l.jobsPerDay)
+	l.lastUpdate = now
+
+	if l.capacity >= 1 {
+		l.capacity -= 1
+		return true, 0
+	}
+	days := (1 - l.capacity) / l.jobsPerDay
+	return false, time.Duration(days * 24 * float64(time.Hour))
+}
+
+// Release gives back a job taken from the bucket
+func (l *JobLimiter) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.capacity = math.Min(l.jobsPerDay, l.capacity+1)
+}
+
+// Done gives an admitted job's slot back unless the upstream answered with success, given its status, 0 when
+// the request didn't get an answer
+func (l *fineTuningLimits) Done(status int) {
+	if l != nil && l.jobs != nil && (status < 200 || status > 299) {
+		l.jobs.Release()
+	}
+}
+
+func (o *OpenAIProvider) parseFineTuningRequest(r *http.Request, body io.Reader) (model string, request Request, err error) {
+	// Only job creation is limited, cancelling and listing pass straight through
+	if o.fineTuning == nil || !(strings.HasSuffix(r.URL.Path, "/v1/fine_tuning/jobs") || strings.HasSuffix(r.URL.Path, "/v1/fine-tunes")) {
+		return "", nil, nil
+	}
+
+	job := new(FineTuningRequest)
+	err = decodeJSON(body, job)
+	if err != nil {
+		return "", nil, fmt.Errorf("error reading request body, %s: %w", r.URL.Path, err)
+	}
+	return "", job, nil
+}
+
+// admitFineTuningJob enforces the route's fine-tuning limits, writing the rejection if the job isn't allowed
+func (o *OpenAIProvider) admitFineTuningJob(w http.ResponseWriter, r *http.Request, job *FineTuningRequest) bool {
+	if max := o.fineTuning.config.MaxTrainingFileBytes; max > 0 {
+		size, err := o.fileSize(r, job.TrainingFile)
+		if err != nil {
+			zap.S().Warnw("Unable to look up training file", "url", r.URL, "file", job.TrainingFile, "reason", err)
+		} else if size > max {
+			zap.S().Debugw("Rejecting request", "url", r.URL, "file", job.TrainingFile, "bytes", size, "reason", "TrainingFileTooLarge")
+			writeRejection(w, http.StatusBadRequest, ErrTypeInvalidRequest, ErrCodeTrainingFileTooLarge, RejectTooLarge,
+				fmt.Sprintf("Training file '%s' is %d bytes, the limit is %d bytes", job.TrainingFile, size, max))
+			return false
+		}
+	}
+
+	if o.fineTuning.jobs != nil {
+		if ok, wait := o.fineTuning.jobs.Allow(); !ok {
+			zap.S().Debugw("Rejecting request", "url", r.URL, "model", job.Model, "reason", "FineTuningJobsPerDay")
+			w.Header().Set(HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeRejection(w, http.StatusTooManyRequests, ErrTypeRequests, ErrCodeRateLimitExceeded, RejectOverBudget, "Fine-tuning job limit exceeded")
+			return false
+		}
+	}
+	return true
+}
+
+// fileSize asks the upstream for the size of a file. The lookup is sent to the upstream and with the credentials
+// the job itself would be forwarded with.
+func (o *OpenAIProvider) fileSize(r *http.Request, fileID string) (int64, error) {
+	files := *r.URL
+	files.Path = "/" + strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0] + "/v1/files"
+	files.RawPath, files.RawQuery = "", ""
+	upstream := o.upstreams.Select(r)
+	target, err := upstreamURL(o.paths.Base(upstream.URL), &files)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), fileLookupTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String()+"/"+url.PathEscape(fileID), nil)
+	if err != nil {
+		return 0, err
+	}
+	for _, header := range []string{"Authorization", HeaderAzureAPIKey, "OpenAI-Organization", "OpenAI-Project"} {
+		if value := r.Header.Get(header); value != "" {
+			request.Header.Set(header, value)
+		}
+	}
+	status := 0
+	if key := o.credentials.For("", false); key != "" {
+		setCredential(request.Header, key)
+	} else if pooled := o.keyPool.Acquire(); pooled != nil {
+		setCredential(request.Header, pooled.key)
+		defer func() { o.keyPool.Release(pooled, status) }()
+	}
+	setHeaders(request.Header, o.requestHeaders)
+
+	resp, err := o.client.Do(request)
+	if err != nil {
+		upstream.Record(0, err)
+		return 0, err
+	}
+	defer resp.Body.Close()
+	status = resp.StatusCode
+	upstream.Record(resp.StatusCode, nil)
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var file struct {
+		Bytes int64 `json:"bytes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&file); err != nil {
+		return 0, err
+	}
+	return file.Bytes, nil
+}
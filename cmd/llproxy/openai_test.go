@@ -17,8 +17,10 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -44,6 +46,62 @@ func (m *MockHttpClient) Do(req *http.Request) (response *http.Response, err err
 			Body:       ioutil.NopCloser(bytes.NewBufferString("dummy response")),
 			Header:     make(http.Header),
 		}
+	case strings.HasSuffix(req.URL.Path, "/v1/completions"):
+		response = &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewBufferString("dummy completion")),
+			Header:     make(http.Header),
+		}
+		response.Header.Set("x-ratelimit-limit-requests", "10000")
+		response.Header.Set("x-ratelimit-remaining-requests", "9999")
+	case strings.Contains(req.URL.Path, "/v1/files/"):
+		response = &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"id": "file-abc123", "object": "file", "bytes": 2048}`)),
+			Header:     make(http.Header),
+		}
+	case strings.HasSuffix(req.URL.Path, "/v1/files"):
+		response = &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"id": "file-abc123", "object": "file"}`)),
+			Header:     make(http.Header),
+		}
+	case strings.HasSuffix(req.URL.Path, "/v1/batches"):
+		response = &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"id": "batch_abc123", "object": "batch"}`)),
+			Header:     make(http.Header),
+		}
+	case strings.HasSuffix(req.URL.Path, "/v1/assistants"):
+		response = &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"id": "asst_abc123", "object": "assistant"}`)),
+			Header:     make(http.Header),
+		}
+	case strings.HasSuffix(req.URL.Path, "/v1/threads"):
+		response = &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"id": "thread_abc123", "object": "thread"}`)),
+			Header:     make(http.Header),
+		}
+	case strings.HasSuffix(req.URL.Path, "/runs"), strings.HasSuffix(req.URL.Path, "/submit_tool_outputs"):
+		response = &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"id": "run_abc123", "object": "thread.run"}`)),
+			Header:     make(http.Header),
+		}
+	case strings.HasSuffix(req.URL.Path, "/v1/fine_tuning/jobs"):
+		response = &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"id": "ftjob-abc123", "object": "fine_tuning.job"}`)),
+			Header:     make(http.Header),
+		}
+	case strings.HasSuffix(req.URL.Path, "/v1/audio/transcriptions"):
+		response = &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"text": "dummy transcription"}`)),
+			Header:     make(http.Header),
+		}
 	case strings.HasSuffix(req.URL.Path, "/v1/embeddings"):
 		response = &http.Response{
 			StatusCode: http.StatusOK,
@@ -122,7 +180,8 @@ func TestGetChatHandler_NoBody(t *testing.T) {
 
 	// Here you can check the status code and body of the response
 	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
-	assert.Equal(t, "LLProxy: error reading request body, /openai/v1/chat/completions: unexpected end of JSON input\n", string(body))
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.JSONEq(t, `{"error": {"message": "LLProxy: error reading request body, /openai/v1/chat/completions: unexpected end of JSON input", "type": "invalid_request_error", "param": null, "code": "invalid_request"}}`, string(body))
 }
 
 func TestGetChatHandler_Good(t *testing.T) {
@@ -160,7 +219,8 @@ func TestGetEmbeddingHandler_NoBody(t *testing.T) {
 
 	// Here you can check the status code and body of the response
 	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
-	assert.Equal(t, "LLProxy: error reading request body, /openai/v1/embeddings: unexpected end of JSON input\n", string(body))
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.JSONEq(t, `{"error": {"message": "LLProxy: error reading request body, /openai/v1/embeddings: unexpected end of JSON input", "type": "invalid_request_error", "param": null, "code": "invalid_request"}}`, string(body))
 }
 
 func TestGetEmbeddingHandler_Good(t *testing.T) {
@@ -183,6 +243,214 @@ func TestGetEmbeddingHandler_Good(t *testing.T) {
 	assert.Equal(t, "dummy embedding", string(body))
 }
 
+func TestGetCompletionHandler_NoScheduler(t *testing.T) {
+	ConfigureLogging(LogType("console"), LogLevel("debug"))
+	openai := CreateOpenAI()
+
+	handler := openai.GetHandler()
+
+	var bodyStr = []byte(`{"model": "unknown-model", "prompt": "test"}`)
+
+	req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewBuffer(bodyStr))
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	// Rejections use the OpenAI error shape with a machine readable code
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.JSONEq(t, `{"error": {"message": "LLProxy: No scheduler found for model 'unknown-model'", "type": "invalid_request_error", "param": null, "code": "no_scheduler_for_model", "reason": "model_forbidden"}}`, string(body))
+}
+
+func TestGetCompletionHandler_Good(t *testing.T) {
+	ConfigureLogging(LogType("console"), LogLevel("debug"))
+	openai := CreateOpenAI()
+
+	handler := openai.GetHandler()
+
+	var bodyStr = []byte(fmt.Sprintf(`{"model": "%s", "prompt": "test"}`, TEST_MODEL))
+
+	req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewBuffer(bodyStr))
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "dummy completion", string(body))
+
+	// Upstream account-level limits are replaced with the proxy's limits for the model
+	assert.Equal(t, []string{"60"}, resp.Header.Values(HeaderLimitRequests))
+	assert.Equal(t, []string{"59"}, resp.Header.Values(HeaderRemainingRequests))
+	assert.Equal(t, "60000", resp.Header.Get(HeaderLimitTokens))
+	assert.Equal(t, "59000", resp.Header.Get(HeaderRemainingTokens))
+}
+
+func TestAssistantRunHandler(t *testing.T) {
+	ConfigureLogging(LogType("console"), LogLevel("debug"))
+	openai := CreateOpenAI()
+	scheduler := openai.schedulers[TEST_MODEL]
+
+	handler := openai.GetHandler()
+
+	// Creating the assistant doesn't consume capacity, but records its model
+	var bodyStr = []byte(fmt.Sprintf(`{"model": "%s", "instructions": "test"}`, TEST_MODEL))
+	req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/assistants", bytes.NewBuffer(bodyStr))
+	w := httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.InDelta(t, 60000.0, scheduler.Snapshot().TokenCapacity, 1.0)
+
+	model, ok := openai.assistants.Get("asst_abc123")
+	assert.True(t, ok)
+	assert.Equal(t, TEST_MODEL, model)
+
+	// Runs are scheduled against the assistant's model
+	req = httptest.NewRequest("POST", "http://localhost:8080/openai/v1/threads/thread_abc123/runs", bytes.NewBufferString(`{"assistant_id": "asst_abc123"}`))
+	w = httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.InDelta(t, 60000.0-ASSISTANT_RUN_DEFAULT_TOKENS, scheduler.Snapshot().TokenCapacity, 10.0)
+
+	// Creating a thread doesn't call the model
+	req = httptest.NewRequest("POST", "http://localhost:8080/openai/v1/threads", bytes.NewBufferString(`{"messages": [{"role": "user", "content": "test"}]}`))
+	w = httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.InDelta(t, 60000.0-ASSISTANT_RUN_DEFAULT_TOKENS, scheduler.Snapshot().TokenCapacity, 10.0)
+
+	// Runs of assistants created before the proxy started, and resumed runs, use the route's assistant model
+	req = httptest.NewRequest("POST", "http://localhost:8080/openai/v1/threads/thread_abc123/runs", bytes.NewBufferString(`{"assistant_id": "asst_unknown"}`))
+	w = httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.InDelta(t, 60000.0-2*ASSISTANT_RUN_DEFAULT_TOKENS, scheduler.Snapshot().TokenCapacity, 10.0)
+
+	req = httptest.NewRequest("POST", "http://localhost:8080/openai/v1/threads/thread_abc123/runs/run_abc123/submit_tool_outputs", bytes.NewBufferString(`{"tool_outputs": [{"tool_call_id": "call_abc123", "output": "42"}]}`))
+	w = httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.InDelta(t, 60000.0-3*ASSISTANT_RUN_DEFAULT_TOKENS, scheduler.Snapshot().TokenCapacity, 10.0)
+}
+
+func TestAssistantModel(t *testing.T) {
+	models := map[string]ModelConfig{"gpt-4": {TokensPerMinute: 10000}, TEST_MODEL: {TokensPerMinute: 60000}}
+	assert.Equal(t, "gpt-4", assistantModel(&RouteConfig{Models: models}))
+	assert.Equal(t, TEST_MODEL, assistantModel(&RouteConfig{Models: models, AssistantModel: TEST_MODEL}))
+	assert.Equal(t, "", assistantModel(&RouteConfig{}))
+}
+
+func TestFineTuningHandler(t *testing.T) {
+	ConfigureLogging(LogType("console"), LogLevel("debug"))
+
+	createJob := func(handler func(http.ResponseWriter, *http.Request)) *http.Response {
+		var bodyStr = []byte(`{"model": "gpt-3.5-turbo", "training_file": "file-abc123"}`)
+		req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/fine_tuning/jobs", bytes.NewBuffer(bodyStr))
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w.Result()
+	}
+
+	// The training file is 2048 bytes according to the upstream
+	config := &RouteConfig{Forward: FAKE_BASE_URL, Provider: "openai", FineTuning: &FineTuningConfig{MaxTrainingFileBytes: 1024}}
+	resp := createJob(NewOpenAI(config, &MockHttpClient{}).GetHandler())
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, string(body), ErrCodeTrainingFileTooLarge)
+
+	// Only one job per day is allowed
+	config = &RouteConfig{Forward: FAKE_BASE_URL, Provider: "openai", FineTuning: &FineTuningConfig{JobsPerDay: 1, MaxTrainingFileBytes: 4096}}
+	handler := NewOpenAI(config, &MockHttpClient{}).GetHandler()
+	resp = createJob(handler)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = createJob(handler)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get(HeaderRetryAfter))
+
+	// Jobs the upstream refuses don't use up the day's, and training file ids are escaped in the lookup
+	var lookups []string
+	status := http.StatusBadRequest
+	client := HttpClientFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Method == http.MethodGet {
+			lookups = append(lookups, req.URL.EscapedPath())
+			return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: ioutil.NopCloser(bytes.NewBufferString(`{"bytes": 1}`))}, nil
+		}
+		return &http.Response{StatusCode: status, Header: make(http.Header), Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+	})
+	handler = NewOpenAI(config, client).GetHandler()
+	assert.Equal(t, http.StatusBadRequest, createJob(handler).StatusCode)
+	status = http.StatusOK
+	assert.Equal(t, http.StatusOK, createJob(handler).StatusCode)
+	assert.Equal(t, http.StatusTooManyRequests, createJob(handler).StatusCode)
+
+	req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/fine_tuning/jobs", bytes.NewBufferString(`{"model": "gpt-3.5-turbo", "training_file": "../batches?x=1"}`))
+	handler(httptest.NewRecorder(), req)
+	assert.Equal(t, "/v1/files/..%2Fbatches%3Fx=1", lookups[len(lookups)-1])
+
+	// The lookup goes to the upstream the job would, with the route's key, and gives up after a while
+	t.Setenv("TEST_FINE_TUNING_KEY", "route-key")
+	var lookup *http.Request
+	client = HttpClientFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Method == http.MethodGet {
+			lookup = req
+			return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: ioutil.NopCloser(bytes.NewBufferString(`{"bytes": 8192}`))}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+	})
+	config = &RouteConfig{Forward: "https://example.com/base", Provider: "openai", APIKeyEnv: "TEST_FINE_TUNING_KEY", FineTuning: &FineTuningConfig{MaxTrainingFileBytes: 4096}}
+	assert.Equal(t, http.StatusBadRequest, createJob(NewOpenAI(config, client).GetHandler()).StatusCode)
+	if assert.NotNil(t, lookup) {
+		assert.Equal(t, "https://example.com/base/v1/files/file-abc123", lookup.URL.String())
+		assert.Equal(t, "Bearer route-key", lookup.Header.Get("Authorization"))
+		_, deadline := lookup.Context().Deadline()
+		assert.True(t, deadline)
+	}
+}
+
+func TestAudioHandler_Multipart(t *testing.T) {
+	ConfigureLogging(LogType("console"), LogLevel("debug"))
+	config := &RouteConfig{
+		Forward:  FAKE_BASE_URL,
+		Provider: "openai",
+		Models: map[string]ModelConfig{
+			"whisper-1": {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60.0, TokensPerMinute: 60000.0},
+		},
+		MaxUploadBytes: 1024,
+	}
+	openai := NewOpenAI(config, &MockHttpClient{})
+	handler := openai.GetHandler()
+
+	transcribe := func(audio []byte) *http.Response {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		writer.WriteField("model", "whisper-1")
+		file, _ := writer.CreateFormFile("file", "audio.mp3")
+		file.Write(audio)
+		writer.Close()
+
+		req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/audio/transcriptions", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w.Result()
+	}
+
+	// The model is read from the form and the upload is forwarded intact
+	resp := transcribe(make([]byte, 256))
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"text": "dummy transcription"}`, string(body))
+	assert.Less(t, openai.schedulers["whisper-1"].Snapshot().RequestCapacity, 60.0)
+
+	// Uploads over the limit are rejected
+	resp = transcribe(make([]byte, 2048))
+	body, _ = ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	assert.Contains(t, string(body), ErrCodeUploadTooLarge)
+}
+
 func TestChatCompletionRequestTokensForRequest(t *testing.T) {
 
 	request := &ChatCompletionRequest{
@@ -220,3 +488,57 @@ func TestChatCompletionRequestTokensForRequest(t *testing.T) {
 	assert.Equal(t, 87, tokens) // 18 tokens in message, 60 tokens in response, 9 tokens of overhead
 
 }
+
+func TestCompletionRequestTokensForRequest(t *testing.T) {
+	tokensFor := func(body string) int {
+		request := new(CompletionRequest)
+		assert.NoError(t, json.Unmarshal([]byte(body), request))
+		tokens, err := request.TokensForRequest()
+		assert.NoError(t, err)
+		return tokens
+	}
+
+	// Ordinary requests are charged the flat minimum
+	assert.Equal(t, 1000, tokensFor(`{"prompt": "test", "max_tokens": 100}`))
+
+	// best_of generates every candidate even though only n are returned
+	assert.Equal(t, 1+20*500, tokensFor(`{"prompt": "test", "max_tokens": 500, "best_of": 20}`))
+	assert.Equal(t, 2+3*2*500, tokensFor(`{"prompt": ["test", "test"], "max_tokens": 500, "n": 3}`))
+
+	// echo returns the prompt with every choice, and logprobs multiplies what is returned
+	prompt := strings.Repeat("abcd", 1000)
+	assert.Equal(t, 1000+500+1000, tokensFor(fmt.Sprintf(`{"prompt": "%s", "max_tokens": 500, "echo": true}`, prompt)))
+	assert.Equal(t, 1000+500+1000+5*1500, tokensFor(fmt.Sprintf(`{"prompt": "%s", "max_tokens": 500, "echo": true, "logprobs": 5}`, prompt)))
+
+	// Token id prompts count one token per id
+	assert.Equal(t, 3+2*600, tokensFor(`{"prompt": [[1, 2], [3]], "max_tokens": 600}`))
+}
+
+func TestGetHandler_StaticHeaders(t *testing.T) {
+	client := &recordingHttpClient{}
+	openai := NewOpenAI(&RouteConfig{
+		Forward:         FAKE_BASE_URL,
+		Provider:        "openai",
+		RequestHeaders:  map[string]string{"OpenAI-Organization": "org-route", "OpenAI-Project": "proj-route"},
+		ResponseHeaders: map[string]string{"X-Served-By": "llproxy"},
+		Models: map[string]ModelConfig{
+			TEST_MODEL: {
+				MaxQueueSize:    10,
+				ReqsPerMinute:   60.0,
+				TokensPerMinute: 60000.0,
+				RequestHeaders:  map[string]string{"OpenAI-Project": "proj-model"},
+			},
+		},
+	}, client)
+
+	var bodyStr = []byte(fmt.Sprintf(`{"model": "%s", "prompt": "test"}`, TEST_MODEL))
+	req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewBuffer(bodyStr))
+	req.Header.Set("OpenAI-Organization", "org-client")
+	w := httptest.NewRecorder()
+	openai.GetHandler()(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "org-route", client.headers[0].Get("OpenAI-Organization"))
+	assert.Equal(t, "proj-model", client.headers[0].Get("OpenAI-Project"))
+	assert.Equal(t, "llproxy", w.Header().Get("X-Served-By"))
+}
@@ -0,0 +1,246 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// openAPIOperation is one of the proxy's own endpoints, documented by example values of its request and response
+type openAPIOperation struct {
+	server   string
+	method   string
+	path     string
+	summary  string
+	request  any // nil without a body
+	response any // a string for text/plain
+}
+
+var openAPIOperations = []openAPIOperation{
+	{ServerProxy, http.MethodGet, "/models", "Lists the models of every route with their limits", nil, ModelList{}},
+	{ServerProxy, http.MethodGet, "/{route}/v1/models", "Lists the route's models with their limits", nil, ModelList{}},
+	{ServerProxy, http.MethodGet, "/llproxy/queue/{id}", "Reports where a request sent with X-LLProxy-Request-Id is in its queue", nil, QueueStatus{}},
+
+	{ServerHealth, http.MethodGet, "/healthz", "Liveness, OK while the process is up", nil, ""},
+	{ServerHealth, http.MethodGet, "/readyz", "Readiness, 503 once the proxy is shutting down", nil, ""},
+	{ServerHealth, http.MethodGet, "/infoz", "The config that was loaded, the routes and the liveness of each scheduler", nil, InfoZ{}},
+
+	{ServerAdmin, http.MethodGet, "/admin/schedulers", "Every scheduler's limits, capacity, queue and totals", nil, []SchedulerStatus{}},
+	{ServerAdmin, http.MethodPost, "/admin/schedulers/pause", "Stops schedulers admitting requests, queueing them instead", SchedulerStateChange{}, []SchedulerStatus{}},
+	{ServerAdmin, http.MethodPost, "/admin/schedulers/drain", "Rejects new requests to schedulers while those queued are served", SchedulerStateChange{}, []SchedulerStatus{}},
+	{ServerAdmin, http.MethodPost, "/admin/schedulers/resume", "Lets paused or draining schedulers admit requests again", SchedulerStateChange{}, []SchedulerStatus{}},
+	{ServerAdmin, http.MethodGet, "/admin/peers", "The replicas limits are shared with and this replica's share", nil, PeersStatus{}},
+	{ServerAdmin, http.MethodGet, "/admin/peers/report", "This replica's utilization, as polled by its peers", nil, PeerReport{}},
+	{ServerAdmin, http.MethodGet, "/admin/upstreams", "Every route's upstreams with their health and model limits", nil, []RouteUpstreamStatus{}},
+	{ServerAdmin, http.MethodPost, "/admin/upstreams/set", "Replaces a route's upstreams and their weights", RouteUpstreams{}, RouteUpstreams{}},
+	{ServerAdmin, http.MethodGet, "/admin/errors", "The most recent errors the proxy returned, newest first", nil, []RecentError{}},
+	{ServerAdmin, http.MethodGet, "/admin/errors/codes", "The reasons requests are rejected for, and whether retrying can succeed", nil, []RejectReasonDoc{}},
+	{ServerAdmin, http.MethodGet, "/admin/usage", "Requests, tokens and cost by route, model, client and tag labels", nil, []UsageRecord{}},
+	{ServerAdmin, http.MethodGet, "/admin/captures", "The captured requests, newest first, without their bodies", nil, []CaptureSummary{}},
+	{ServerAdmin, http.MethodGet, "/admin/captures/{id}", "A captured request with its bodies", nil, Capture{}},
+	{ServerAdmin, http.MethodGet, "/metrics", "Prometheus metrics", nil, ""},
+	{ServerAdmin, http.MethodGet, "/admin/maintenance", "The disabled routes and models", nil, []MaintenanceStatus{}},
+	{ServerAdmin, http.MethodPost, "/admin/maintenance/disable", "Disables a route or model", MaintenanceStatus{}, MaintenanceStatus{}},
+	{ServerAdmin, http.MethodPost, "/admin/maintenance/enable", "Enables a route or model again", MaintenanceStatus{}, MaintenanceStatus{}},
+	{ServerAdmin, http.MethodGet, "/admin/faults", "The faults injected into each route", nil, []FaultStatus{}},
+	{ServerAdmin, http.MethodPost, "/admin/faults/set", "Sets the faults injected into a route", FaultStatus{}, FaultStatus{}},
+	{ServerAdmin, http.MethodGet, "/admin/keys", "Every route's pooled upstream keys and their state", nil, []RouteKeys{}},
+	{ServerAdmin, http.MethodPost, "/admin/keys/set", "Disables or enables pooled upstream keys", RouteKeys{}, RouteKeys{}},
+	{ServerAdmin, http.MethodPost, "/admin/explain", "Explains how a sample request would be scheduled, without sending it", ExplainRequest{}, Explanation{}},
+	{ServerAdmin, http.MethodGet, "/admin/config", "The config the proxy is running with, secrets redacted", nil, EffectiveConfig{}},
+	{ServerAdmin, http.MethodGet, "/admin/selftest", "Checks the upstreams and tokenizers, answering 503 if any check failed", nil, SelfTestReport{}},
+	{ServerAdmin, http.MethodGet, "/admin/openapi.json", "This document", nil, map[string]any{}},
+}
+
+// getOpenAPI serves an OpenAPI document of the proxy's own endpoints, the servers being the configured ports
+func getOpenAPI(c *Config) http.HandlerFunc {
+	document := openAPIDocument(&c.Application)
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, document)
+	}
+}
+
+func openAPIDocument(app *AppConfig) map[string]any {
+	ports := map[string]int{ServerProxy: app.Port, ServerHealth: app.HealthPort, ServerAdmin: app.AdminPort}
+	schemas := map[string]any{}
+	paths := map[string]map[string]any{}
+	for _, op := range openAPIOperations {
+		if paths[op.path] == nil {
+			paths[op.path] = map[string]any{
+				"servers": []any{map[string]any{
+					"url":         fmt.Sprintf("http://{host}:%d", ports[op.server]),
+					"description": "The " + op.server + " server",
+					"variables":   map[string]any{"host": map[string]any{"default": "localhost"}},
+				}},
+			}
+		}
+
+		operation := map[string]any{
+			"operationId": openAPIOperationID(op.method, op.path),
+			"summary":     op.summary,
+			"tags":        []string{op.server},
+			"responses": map[string]any{
+				"200":     openAPIContent("OK", op.response, schemas),
+				"default": openAPIContent("Error", ErrorResponse{}, schemas),
+			},
+		}
+		if op.request != nil {
+			operation["requestBody"] = openAPIContent("", op.request, schemas)
+			operation["requestBody"].(map[string]any)["required"] = true
+		}
+		var parameters []any
+		for _, segment := range strings.Split(op.path, "/") {
+			if strings.HasPrefix(segment, "{") {
+				parameters = append(parameters, map[string]any{
+					"name":     strings.Trim(segment, "{}"),
+					"in":       "path",
+					"required": true,
+					"schema":   map[string]any{"type": "string"},
+				})
+			}
+		}
+		if parameters != nil {
+			operation["parameters"] = parameters
+		}
+		paths[op.path][strings.ToLower(op.method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "LLProxy",
+			"description": "The proxy's own endpoints. Requests to each route are forwarded to its upstream's API, which is documented by its provider.",
+			"version":     "1",
+		},
+		"paths":      paths,
+		"components": map[string]any{"schemas": schemas},
+	}
+}
+
+// openAPIOperationID names an operation after its method and path, e.g. postAdminSchedulersPause
+func openAPIOperationID(method string, path string) string {
+	id := strings.ToLower(method)
+	for _, word := range strings.FieldsFunc(path, func(r rune) bool { return strings.ContainsRune("/{}._-", r) }) {
+		id += strings.ToUpper(word[:1]) + word[1:]
+	}
+	return id
+}
+
+func openAPIContent(description string, example any, schemas map[string]any) map[string]any {
+	mediaType := "application/json"
+	if _, ok := example.(string); ok {
+		mediaType = "text/plain"
+	}
+	content := map[string]any{
+		"content": map[string]any{mediaType: map[string]any{"schema": openAPISchema(reflect.TypeOf(example), schemas)}},
+	}
+	if description != "" {
+		content["description"] = description
+	}
+	return content
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// openAPISchema describes a type as it's encoded to JSON, adding the named structs it uses to schemas
+func openAPISchema(t reflect.Type, schemas map[string]any) map[string]any {
+	switch {
+	case t == nil || t == rawMessageType || t.Kind() == reflect.Interface:
+		return map[string]any{}
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := openAPISchema(t.Elem(), schemas)
+		if _, ref := schema["$ref"]; !ref {
+			schema["nullable"] = true
+		}
+		return schema
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": openAPISchema(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": openAPISchema(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return openAPIObject(t, schemas)
+		}
+		if _, ok := schemas[t.Name()]; !ok {
+			// Registered before its fields so types that refer to themselves end
+			schemas[t.Name()] = map[string]any{}
+			schemas[t.Name()] = openAPIObject(t, schemas)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]any{}
+}
+
+// openAPIObject describes a struct's JSON fields, including those of the structs it embeds
+func openAPIObject(t reflect.Type, schemas map[string]any) map[string]any {
+	properties := map[string]any{}
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			if field.Anonymous && tag == "" {
+				embedded := field.Type
+				if embedded.Kind() == reflect.Pointer {
+					embedded = embedded.Elem()
+				}
+				if embedded.Kind() == reflect.Struct {
+					addFields(embedded)
+					continue
+				}
+			}
+			if !field.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(tag, ",")
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = openAPISchema(field.Type, schemas)
+		}
+	}
+	addFields(t)
+	return map[string]any{"type": "object", "properties": properties}
+}
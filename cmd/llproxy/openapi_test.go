@@ -0,0 +1,88 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenAPI(t *testing.T) {
+	config := &Config{Application: AppConfig{Port: 8080, HealthPort: 8081, AdminPort: 9000}}
+	w := httptest.NewRecorder()
+	getOpenAPI(config)(w, httptest.NewRequest("GET", "http://localhost:9000/admin/openapi.json", nil))
+
+	type operation struct {
+		OperationID string `json:"operationId"`
+		Parameters  []struct {
+			Name string `json:"name"`
+		} `json:"parameters"`
+		Responses map[string]struct {
+			Content map[string]struct {
+				Schema map[string]any `json:"schema"`
+			} `json:"content"`
+		} `json:"responses"`
+	}
+	var document struct {
+		OpenAPI string `json:"openapi"`
+		Paths   map[string]struct {
+			Servers []struct {
+				URL string `json:"url"`
+			} `json:"servers"`
+			Get  *operation `json:"get"`
+			Post *operation `json:"post"`
+		} `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]map[string]any `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &document))
+	assert.Equal(t, "3.0.3", document.OpenAPI)
+
+	// Every endpoint of the admin server is documented
+	router := newAdminRouter(Providers{})
+	for path := range router.exact {
+		if path != "/" {
+			assert.Contains(t, document.Paths, path)
+		}
+	}
+	for _, route := range router.prefixes {
+		assert.Contains(t, document.Paths, route.pattern+"/{id}")
+	}
+
+	schedulers := document.Paths["/admin/schedulers"].Get
+	assert.Equal(t, "getAdminSchedulers", schedulers.OperationID)
+	assert.Equal(t, "#/components/schemas/SchedulerStatus", schedulers.Responses["200"].Content["application/json"].Schema["items"].(map[string]any)["$ref"])
+	assert.Equal(t, "http://{host}:9000", document.Paths["/admin/schedulers"].Servers[0].URL)
+	assert.Equal(t, "http://{host}:8081", document.Paths["/healthz"].Servers[0].URL)
+	assert.Contains(t, document.Paths["/metrics"].Get.Responses["200"].Content, "text/plain")
+	assert.Equal(t, "id", document.Paths["/llproxy/queue/{id}"].Get.Parameters[0].Name)
+
+	// Structs are described by their JSON fields, embedded ones flattened
+	capture := document.Components.Schemas["Capture"].Properties
+	assert.Equal(t, "string", capture["request"]["type"])
+	assert.Equal(t, "date-time", capture["time"]["format"])
+	assert.Equal(t, "integer", capture["requestBytes"]["type"])
+	for name := range document.Components.Schemas {
+		assert.False(t, strings.HasPrefix(name, "openAPI"))
+	}
+}
@@ -0,0 +1,379 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// Defaults for exporting logs over OTLP
+const (
+	defaultOTLPServiceName = "llproxy"
+	defaultOTLPBatchSize   = 512
+	defaultOTLPInterval    = 5.0
+	maxOTLPBuffered        = 10000
+)
+
+// Log fields carrying the W3C trace context of a request, exported as the record's trace and span ids
+const (
+	logFieldTraceID = "traceId"
+	logFieldSpanID  = "spanId"
+)
+
+// OTLPConfig exports logs to an OpenTelemetry collector with OTLP over HTTP, alongside the configured encoder
+type OTLPConfig struct {
+	// Endpoint is the collector's base URL, logs are posted to its /v1/logs
+	Endpoint string `json:"endpoint"`
+
+	// Headers are sent with every export, e.g. for authentication
+	Headers map[string]string `json:"headers"`
+
+	// ServiceName is the service.name resource attribute, "llproxy" when unset
+	ServiceName string `json:"serviceName"`
+
+	// ResourceAttributes describe where the logs come from, e.g. {"k8s.pod.name": "${POD_NAME}"}.
+	// Environment variables in values are expanded.
+	ResourceAttributes map[string]string `json:"resourceAttributes"`
+
+	// Records are exported once BatchSize are waiting or every Interval seconds
+	BatchSize int     `json:"batchSize"`
+	Interval  float64 `json:"interval"`
+}
+
+// ConfigureOTLP adds an OTLP exporter to the global logger, in addition to its encoder
+func ConfigureOTLP(config *OTLPConfig) {
+	exporter := newOTLPExporter(config, &http.Client{Timeout: 10 * time.Second})
+	go exporter.run()
+	addLogOutput(func(core zapcore.Core) zapcore.Core {
+		return &otlpCore{LevelEnabler: core, exporter: exporter}
+	})
+}
+
+// otlpCore is a zapcore.Core handing every entry to an otlpExporter
+type otlpCore struct {
+	zapcore.LevelEnabler
+	exporter *otlpExporter
+	fields   []zapcore.Field
+}
+
+func (c *otlpCore) With(fields []zapcore.Field) zapcore.Core {
+	return &otlpCore{
+		LevelEnabler: c.LevelEnabler,
+		exporter:     c.exporter,
+		fields:       append(append([]zapcore.Field{}, c.fields...), fields...),
+	}
+}
+
+func (c *otlpCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *otlpCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	encoder := zapcore.NewMapObjectEncoder()
+	for _, field := range c.fields {
+		field.AddTo(encoder)
+	}
+	for _, field := range fields {
+		field.AddTo(encoder)
+	}
+	c.exporter.Add(newOTLPLogRecord(entry, encoder.Fields))
+	return nil
+}
+
+func (c *otlpCore) Sync() error {
+	return c.exporter.Flush()
+}
+
+// The OTLP/HTTP JSON encoding of logs, see opentelemetry-proto
+type otlpLogs struct {
+	ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+}
+
+type otlpResourceLogs struct {
+	Resource  otlpResource    `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeLogs struct {
+	Scope      otlpScope       `json:"scope"`
+	LogRecords []otlpLogRecord `json:"logRecords"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano   string         `json:"timeUnixNano"`
+	SeverityNumber int            `json:"severityNumber"`
+	SeverityText   string         `json:"severityText"`
+	Body           otlpAnyValue   `json:"body"`
+	Attributes     []otlpKeyValue `json:"attributes,omitempty"`
+	TraceID        string         `json:"traceId,omitempty"`
+	SpanID         string         `json:"spanId,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func newOTLPLogRecord(entry zapcore.Entry, fields map[string]any) otlpLogRecord {
+	record := otlpLogRecord{
+		TimeUnixNano:   strconv.FormatInt(entry.Time.UnixNano(), 10),
+		SeverityNumber: otlpSeverity(entry.Level),
+		SeverityText:   entry.Level.CapitalString(),
+		Body:           otlpString(entry.Message),
+	}
+	if traceID, ok := fields[logFieldTraceID].(string); ok {
+		record.TraceID = traceID
+		delete(fields, logFieldTraceID)
+	}
+	if spanID, ok := fields[logFieldSpanID].(string); ok {
+		record.SpanID = spanID
+		delete(fields, logFieldSpanID)
+	}
+	record.Attributes = otlpAttributes(fields)
+	return record
+}
+
+// otlpSeverity maps zap's levels onto the first severity number of OpenTelemetry's matching range
+func otlpSeverity(level zapcore.Level) int {
+	switch {
+	case level <= zapcore.DebugLevel:
+		return 5
+	case level == zapcore.InfoLevel:
+		return 9
+	case level == zapcore.WarnLevel:
+		return 13
+	case level == zapcore.ErrorLevel:
+		return 17
+	default:
+		return 21
+	}
+}
+
+// otlpAttributes converts fields to attributes sorted by key, values that aren't scalars are sent as JSON
+func otlpAttributes(fields map[string]any) []otlpKeyValue {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	attributes := make([]otlpKeyValue, 0, len(keys))
+	for _, key := range keys {
+		attributes = append(attributes, otlpKeyValue{Key: key, Value: otlpValue(fields[key])})
+	}
+	return attributes
+}
+
+func otlpValue(value any) otlpAnyValue {
+	switch value := value.(type) {
+	case string:
+		return otlpString(value)
+	case bool:
+		return otlpAnyValue{BoolValue: &value}
+	case int:
+		return otlpInt(int64(value))
+	case int32:
+		return otlpInt(int64(value))
+	case int64:
+		return otlpInt(value)
+	case uint64:
+		if value <= math.MaxInt64 {
+			return otlpInt(int64(value))
+		}
+	case float32:
+		double := float64(value)
+		return otlpAnyValue{DoubleValue: &double}
+	case float64:
+		if !math.IsNaN(value) && !math.IsInf(value, 0) {
+			return otlpAnyValue{DoubleValue: &value}
+		}
+	case fmt.Stringer:
+		return otlpString(value.String())
+	}
+	if encoded, err := json.Marshal(value); err == nil {
+		return otlpString(string(encoded))
+	}
+	return otlpString(fmt.Sprint(value))
+}
+
+func otlpString(s string) otlpAnyValue {
+	return otlpAnyValue{StringValue: &s}
+}
+
+func otlpInt(i int64) otlpAnyValue {
+	s := strconv.FormatInt(i, 10)
+	return otlpAnyValue{IntValue: &s}
+}
+
+// otlpExporter batches log records and posts them to the collector.
+// When the collector can't keep up the oldest records are dropped rather than holding up logging.
+type otlpExporter struct {
+	client    HttpClient
+	url       string
+	headers   map[string]string
+	resource  otlpResource
+	batchSize int
+	interval  time.Duration
+
+	mu      sync.Mutex
+	records []otlpLogRecord
+	dropped int
+	ready   chan struct{}
+}
+
+func newOTLPExporter(config *OTLPConfig, client HttpClient) *otlpExporter {
+	exporter := &otlpExporter{
+		client:    client,
+		url:       strings.TrimSuffix(config.Endpoint, "/") + "/v1/logs",
+		headers:   config.Headers,
+		batchSize: config.BatchSize,
+		interval:  time.Duration(config.Interval * float64(time.Second)),
+		ready:     make(chan struct{}, 1),
+	}
+	if exporter.batchSize <= 0 {
+		exporter.batchSize = defaultOTLPBatchSize
+	}
+	if exporter.interval <= 0 {
+		exporter.interval = time.Duration(defaultOTLPInterval * float64(time.Second))
+	}
+
+	attributes := map[string]any{"service.name": config.ServiceName}
+	if config.ServiceName == "" {
+		attributes["service.name"] = defaultOTLPServiceName
+	}
+	if host, err := os.Hostname(); err == nil {
+		attributes["host.name"] = host
+	}
+	for key, value := range config.ResourceAttributes {
+		attributes[key] = os.ExpandEnv(value)
+	}
+	exporter.resource = otlpResource{Attributes: otlpAttributes(attributes)}
+	return exporter
+}
+
+func (e *otlpExporter) Add(record otlpLogRecord) {
+	e.mu.Lock()
+	if len(e.records) >= maxOTLPBuffered {
+		e.records = e.records[1:]
+		e.dropped++
+	}
+	e.records = append(e.records, record)
+	full := len(e.records) >= e.batchSize
+	e.mu.Unlock()
+
+	if full {
+		select {
+		case e.ready <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (e *otlpExporter) run() {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-e.ready:
+		}
+		e.Flush()
+	}
+}
+
+// Flush exports everything waiting. Errors can't be logged without feeding back into the exporter, so they're
+// written to stderr.
+func (e *otlpExporter) Flush() error {
+	e.mu.Lock()
+	records, dropped := e.records, e.dropped
+	e.records, e.dropped = nil, 0
+	e.mu.Unlock()
+	if dropped > 0 {
+		fmt.Fprintf(os.Stderr, "llproxy: dropped %d log records the OTLP collector couldn't keep up with\n", dropped)
+	}
+
+	for len(records) > 0 {
+		batch := records
+		if len(batch) > e.batchSize {
+			batch = batch[:e.batchSize]
+		}
+		records = records[len(batch):]
+		if err := e.export(batch); err != nil {
+			fmt.Fprintf(os.Stderr, "llproxy: unable to export %d log records over OTLP: %v\n", len(batch), err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *otlpExporter) export(records []otlpLogRecord) error {
+	body, err := json.Marshal(otlpLogs{ResourceLogs: []otlpResourceLogs{{
+		Resource:  e.resource,
+		ScopeLogs: []otlpScopeLogs{{Scope: otlpScope{Name: defaultOTLPServiceName}, LogRecords: records}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
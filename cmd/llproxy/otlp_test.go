@@ -0,0 +1,87 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestOTLPExport(t *testing.T) {
+	var exported []otlpLogs
+	var headers http.Header
+	client := HttpClientFunc(func(req *http.Request) (*http.Response, error) {
+		headers = req.Header
+		var logs otlpLogs
+		body, _ := io.ReadAll(req.Body)
+		assert.NoError(t, json.Unmarshal(body, &logs))
+		exported = append(exported, logs)
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader(nil))}, nil
+	})
+
+	t.Setenv("TEST_POD", "llproxy-0")
+	exporter := newOTLPExporter(&OTLPConfig{
+		Endpoint:           "http://collector:4318",
+		Headers:            map[string]string{"Authorization": "Bearer token"},
+		ResourceAttributes: map[string]string{"k8s.pod.name": "${TEST_POD}"},
+		BatchSize:          2,
+	}, client)
+	logger := zap.New(&otlpCore{LevelEnabler: zapcore.InfoLevel, exporter: exporter}).Sugar()
+
+	logger.Debugw("Not exported")
+	logger.Infow("Access", "route", "openai", "status", 200, logFieldTraceID, "4bf92f3577b34da6a3ce929d0e0e4736", logFieldSpanID, "00f067aa0ba902b7")
+	logger.Warnw("Second")
+	logger.Errorw("Third")
+	assert.NoError(t, logger.Sync())
+
+	// Records are sent in batches of at most batchSize
+	assert.Len(t, exported, 2)
+	assert.Equal(t, "Bearer token", headers.Get("Authorization"))
+	resource := exported[0].ResourceLogs[0].Resource.Attributes
+	assert.Contains(t, resource, otlpKeyValue{Key: "k8s.pod.name", Value: otlpString("llproxy-0")})
+	assert.Contains(t, resource, otlpKeyValue{Key: "service.name", Value: otlpString("llproxy")})
+
+	records := exported[0].ResourceLogs[0].ScopeLogs[0].LogRecords
+	assert.Len(t, records, 2)
+	assert.Equal(t, "Access", *records[0].Body.StringValue)
+	assert.Equal(t, 9, records[0].SeverityNumber)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", records[0].TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", records[0].SpanID)
+	assert.Equal(t, []otlpKeyValue{
+		{Key: "route", Value: otlpString("openai")},
+		{Key: "status", Value: otlpInt(200)},
+	}, records[0].Attributes)
+	assert.Equal(t, 17, exported[1].ResourceLogs[0].ScopeLogs[0].LogRecords[0].SeverityNumber)
+}
+
+func TestParseTraceparent(t *testing.T) {
+	traceID, spanID := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", traceID)
+	assert.Equal(t, "00f067aa0ba902b7", spanID)
+
+	for _, invalid := range []string{"", "00-4bf92f-00f067aa0ba902b7-01", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01"} {
+		traceID, _ = parseTraceparent(invalid)
+		assert.Empty(t, traceID, invalid)
+	}
+}
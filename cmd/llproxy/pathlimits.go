@@ -0,0 +1,180 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Classes of requests that aren't scheduled by model, which can be limited by path instead
+const (
+	PathClassFiles       = "files"
+	PathClassFineTuning  = "fine-tuning"
+	PathClassModerations = "moderations"
+	PathClassImages      = "images"
+	PathClassAdmin       = "admin"
+	PathClassOther       = "other"
+)
+
+// Path limit schedulers are listed with this scope on the admin endpoints
+const pathLimitScope = "path"
+
+var pathClasses = []string{PathClassFiles, PathClassFineTuning, PathClassModerations, PathClassImages, PathClassAdmin, PathClassOther}
+
+func isPathClass(class string) bool {
+	for _, known := range pathClasses {
+		if class == known {
+			return true
+		}
+	}
+	return false
+}
+
+// PathLimitConfig limits the requests of a path class, counting their Content-Length against bytesPerMinute
+type PathLimitConfig struct {
+	MaxQueueSize   int     `json:"maxQueueSize"`
+	MaxQueueWait   float64 `json:"maxQueueWait"`
+	ReqsPerMinute  float64 `json:"rpm"`
+	BytesPerMinute float64 `json:"bytesPerMinute"`
+}
+
+// pathLimits holds a scheduler per limited path class, whose tokens are body bytes
+type pathLimits struct {
+	schedulers SchedulerMap
+}
+
+func newPathLimits(provider string, config map[string]PathLimitConfig) *pathLimits {
+	if len(config) == 0 {
+		return nil
+	}
+
+	models := make(map[string]ModelConfig, len(config))
+	for class, limit := range config {
+		// Either limit may be left out
+		model := ModelConfig{
+			MaxQueueSize:    limit.MaxQueueSize,
+			MaxQueueWait:    limit.MaxQueueWait,
+			ReqsPerMinute:   limit.ReqsPerMinute,
+			TokensPerMinute: limit.BytesPerMinute,
+		}
+		if model.ReqsPerMinute == 0 {
+			model.ReqsPerMinute = math.MaxFloat64
+		}
+		if model.TokensPerMinute == 0 {
+			model.TokensPerMinute = math.MaxFloat64
+		}
+		models[class] = model
+	}
+	return &pathLimits{schedulers: initScopedSchedulers(provider, pathLimitScope, models)}
+}
+
+// pathClass returns the class of a request path that wasn't scheduled by model
+func pathClass(path string) string {
+	switch {
+	case strings.Contains(path, "/v1/files"):
+		return PathClassFiles
+	case strings.Contains(path, "/v1/fine-tunes"), strings.Contains(path, "/v1/fine_tuning"):
+		return PathClassFineTuning
+	case strings.Contains(path, "/v1/moderations"):
+		return PathClassModerations
+	case strings.Contains(path, "/v1/images"):
+		return PathClassImages
+	case strings.Contains(path, "/v1/organization"):
+		// The administration API of users, projects, keys and audit logs
+		return PathClassAdmin
+	}
+	return PathClassOther
+}
+
+// Admit waits for the request's path class to have capacity, writing the error response and returning false if it doesn't
+func (p *pathLimits) Admit(w http.ResponseWriter, r *http.Request) bool {
+	if p == nil {
+		return true
+	}
+	class := pathClass(r.URL.Path)
+	scheduler, ok := p.schedulers[class]
+	if !ok {
+		return true
+	}
+
+	// Bodies of unknown length are counted once they've been sent
+	bytes := float64(r.ContentLength)
+	if r.ContentLength < 0 {
+		bytes = 0
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &countedBody{body: r.Body, scheduler: scheduler}
+		}
+	}
+
+	if bytes > scheduler.Limits().TokensPerMinute {
+		zap.S().Debugw("Rejecting request", "url", r.URL, "class", class, "bytes", bytes, "reason", "RequestTooLarge")
+		writeRejection(w, http.StatusRequestEntityTooLarge, ErrTypeInvalidRequest, ErrCodeRequestTooLarge, RejectTooLarge, fmt.Sprintf("Request too large for path class '%s'", class))
+		return false
+	}
+
+	if response, reason := scheduler.SubmitWithReason(r, bytes, SubmitOptions{}); response != Ready {
+		zap.S().Debugw("Rejecting request", "url", r.URL, "class", class, "bytes", bytes, "reason", "RateLimit")
+		setRetryAfter(w.Header(), scheduler, bytes)
+		writeRejection(w, http.StatusTooManyRequests, ErrTypeRequests, ErrCodeRateLimitExceeded, reason, fmt.Sprintf("RateLimit exceeded for path class '%s'", class))
+		return false
+	}
+	return true
+}
+
+// Limits returns whether a path class is limited
+func (p *pathLimits) Limits(class string) bool {
+	if p == nil {
+		return false
+	}
+	_, ok := p.schedulers[class]
+	return ok
+}
+
+func (p *pathLimits) Schedulers() SchedulerMap {
+	if p == nil {
+		return nil
+	}
+	return p.schedulers
+}
+
+// countedBody takes the bytes read from its scheduler's capacity when it's closed
+type countedBody struct {
+	body      io.ReadCloser
+	scheduler *Scheduler
+	read      int64
+	once      sync.Once
+}
+
+func (c *countedBody) Read(p []byte) (int, error) {
+	n, err := c.body.Read(p)
+	c.read += int64(n)
+	return n, err
+}
+
+func (c *countedBody) Close() error {
+	c.once.Do(func() {
+		c.scheduler.consume(float64(c.read))
+	})
+	return c.body.Close()
+}
@@ -0,0 +1,124 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathClass(t *testing.T) {
+	assert.Equal(t, PathClassFiles, pathClass("/openai/v1/files"))
+	assert.Equal(t, PathClassFiles, pathClass("/openai/v1/files/file-abc/content"))
+	assert.Equal(t, PathClassFineTuning, pathClass("/openai/v1/fine_tuning/jobs"))
+	assert.Equal(t, PathClassFineTuning, pathClass("/openai/v1/fine-tunes"))
+	assert.Equal(t, PathClassModerations, pathClass("/openai/v1/moderations"))
+	assert.Equal(t, PathClassImages, pathClass("/openai/v1/images/generations"))
+	assert.Equal(t, PathClassAdmin, pathClass("/openai/v1/organization/projects/proj_abc/api_keys"))
+	assert.Equal(t, PathClassOther, pathClass("/openai/v1/models"))
+}
+
+func TestGetHandler_PathLimits(t *testing.T) {
+	openai := NewOpenAI(&RouteConfig{
+		Forward:  FAKE_BASE_URL,
+		Provider: "openai",
+		PathLimits: map[string]PathLimitConfig{
+			PathClassFiles: {MaxQueueSize: 1, MaxQueueWait: 1.0, ReqsPerMinute: 60, BytesPerMinute: 6000},
+			PathClassOther: {MaxQueueSize: 1, MaxQueueWait: 1.0, ReqsPerMinute: 2},
+		},
+	}, &recordingHttpClient{})
+	handler := openai.GetHandler()
+
+	send := func(method string, path string, body string) *http.Response {
+		req := httptest.NewRequest(method, "http://localhost:8080/openai"+path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w.Result()
+	}
+
+	// Uploads larger than the class can take in a minute are never admitted
+	assert.Equal(t, http.StatusRequestEntityTooLarge, send(http.MethodPost, "/v1/files", strings.Repeat("x", 7000)).StatusCode)
+
+	// Uploads are counted by their size, leaving too little for the next to fit within the queue wait
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "/v1/files", strings.Repeat("x", 5000)).StatusCode)
+	resp := send(http.MethodPost, "/v1/files", strings.Repeat("x", 5000))
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+
+	// Other paths are only limited by request rate, and unlimited classes pass through
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, "/v1/models", "").StatusCode)
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, "/v1/models", "").StatusCode)
+	assert.Equal(t, http.StatusTooManyRequests, send(http.MethodGet, "/v1/models", "").StatusCode)
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, "/v1/fine_tuning/jobs", "").StatusCode)
+
+	assert.Len(t, openai.ScopedSchedulers(), 1)
+}
+
+func TestCountedBody(t *testing.T) {
+	limits := newPathLimits("openai", map[string]PathLimitConfig{PathClassFiles: {MaxQueueSize: 1, ReqsPerMinute: 60, BytesPerMinute: 6000}})
+	scheduler := limits.schedulers[PathClassFiles]
+
+	// Without a Content-Length the body is charged once it has been read
+	req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/openai/v1/files", io.NopCloser(bytes.NewReader(make([]byte, 4000))))
+	req.ContentLength = -1
+	assert.True(t, limits.Admit(httptest.NewRecorder(), req))
+	io.Copy(io.Discard, req.Body)
+	req.Body.Close()
+	req.Body.Close()
+
+	assert.InDelta(t, 2000, scheduler.Snapshot().TokenCapacity, 10)
+}
+
+func TestGetHandler_PathLimitClasses(t *testing.T) {
+	client := &recordingHttpClient{}
+	openai := NewOpenAI(&RouteConfig{
+		Forward:  FAKE_BASE_URL,
+		Provider: "openai",
+		PathLimits: map[string]PathLimitConfig{
+			PathClassModerations: {MaxQueueSize: 1, MaxQueueWait: 1.0, ReqsPerMinute: 2},
+			PathClassImages:      {MaxQueueSize: 1, MaxQueueWait: 1.0, ReqsPerMinute: 2},
+			PathClassAdmin:       {MaxQueueSize: 1, MaxQueueWait: 1.0, ReqsPerMinute: 2},
+		},
+	}, client)
+	handler := openai.GetHandler()
+
+	send := func(method string, path string, body string) int {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(method, "http://localhost:8080/openai"+path, strings.NewReader(body)))
+		return w.Code
+	}
+
+	// Each class has its own rate, images no longer needing a scheduler for their implied model
+	for _, request := range []struct{ method, path, body string }{
+		{http.MethodPost, "/v1/moderations", `{"input": "test"}`},
+		{http.MethodPost, "/v1/images/generations", `{"prompt": "a cat"}`},
+		{http.MethodGet, "/v1/organization/users", ""},
+	} {
+		assert.Equal(t, http.StatusOK, send(request.method, request.path, request.body), request.path)
+		assert.Equal(t, http.StatusOK, send(request.method, request.path, request.body), request.path)
+		assert.Equal(t, http.StatusTooManyRequests, send(request.method, request.path, request.body), request.path)
+	}
+	assert.Len(t, client.urls, 6)
+
+	// Paths of other classes pass through
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, "/v1/files", ""))
+}
@@ -0,0 +1,98 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+type pathRewrite struct {
+	match   *regexp.Regexp
+	replace string
+}
+
+// pathRewriter maps the path a client sends under a route to the path sent upstream.
+// A nil pathRewriter leaves paths unchanged.
+type pathRewriter struct {
+	stripPrefix string
+	addPrefix   string
+	rewrites    []pathRewrite
+}
+
+// newPathRewriter compiles a route's path rules, panicking on an invalid expression like any other bad config
+func newPathRewriter(config *PathConfig) *pathRewriter {
+	if config == nil {
+		return nil
+	}
+
+	rewriter := &pathRewriter{
+		stripPrefix: strings.TrimSuffix(config.StripPrefix, "/"),
+		addPrefix:   strings.TrimSuffix(config.AddPrefix, "/"),
+	}
+	for _, rewrite := range config.Rewrite {
+		rewriter.rewrites = append(rewriter.rewrites, pathRewrite{
+			match:   regexp.MustCompile(rewrite.Match),
+			replace: rewrite.Replace,
+		})
+	}
+	return rewriter
+}
+
+// Rewrite applies stripPrefix and then the first matching rewrite to the path below the route segment.
+// The result is the path requests are parsed and scheduled by, so rules should produce OpenAI's own layout.
+func (p *pathRewriter) Rewrite(r *http.Request) *http.Request {
+	if p == nil {
+		return r
+	}
+
+	// Keep the route segment, forwardRequest strips it
+	segments := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	route, path := "/"+segments[0], "/"
+	if len(segments) == 2 {
+		path = "/" + segments[1]
+	}
+
+	if p.stripPrefix != "" && (path == p.stripPrefix || strings.HasPrefix(path, p.stripPrefix+"/")) {
+		path = "/" + strings.TrimPrefix(strings.TrimPrefix(path, p.stripPrefix), "/")
+	}
+	for _, rewrite := range p.rewrites {
+		if rewrite.match.MatchString(path) {
+			path = rewrite.match.ReplaceAllString(path, rewrite.replace)
+			break
+		}
+	}
+
+	// Shallow copy like http.StripPrefix, the original request is left untouched
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = route + path
+	r2.URL.RawPath = ""
+	return r2
+}
+
+// Base returns the upstream base URL with addPrefix appended
+func (p *pathRewriter) Base(urlBase string) string {
+	if p == nil || p.addPrefix == "" {
+		return urlBase
+	}
+	return strings.TrimSuffix(urlBase, "/") + p.addPrefix
+}
@@ -0,0 +1,91 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Upstream that records the URL and headers of every request it is sent
+type recordingHttpClient struct {
+	urls    []string
+	headers []http.Header
+}
+
+func (c *recordingHttpClient) Do(req *http.Request) (*http.Response, error) {
+	c.urls = append(c.urls, req.URL.String())
+	c.headers = append(c.headers, req.Header.Clone())
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewBufferString("{}")),
+		Header:     make(http.Header),
+	}, nil
+}
+
+func TestPathRewriter(t *testing.T) {
+	rewriter := newPathRewriter(&PathConfig{
+		StripPrefix: "/api",
+		Rewrite:     []PathRewrite{{Match: `^/(chat/completions|embeddings)$`, Replace: "/v1/$1"}},
+	})
+
+	rewrite := func(path string) string {
+		return rewriter.Rewrite(httptest.NewRequest("POST", "http://localhost:8080"+path, nil)).URL.Path
+	}
+	assert.Equal(t, "/openai/v1/chat/completions", rewrite("/openai/api/chat/completions"))
+	assert.Equal(t, "/openai/v1/embeddings", rewrite("/openai/embeddings"))
+	assert.Equal(t, "/openai/v1/models", rewrite("/openai/v1/models"))
+	assert.Equal(t, "/openai/apix/embeddings", rewrite("/openai/apix/embeddings"))
+
+	// No rules leaves requests alone
+	var none *pathRewriter
+	req := httptest.NewRequest("POST", "http://localhost:8080/openai/embeddings", nil)
+	assert.Equal(t, req, none.Rewrite(req))
+	assert.Equal(t, FAKE_BASE_URL, none.Base(FAKE_BASE_URL))
+}
+
+func TestGetHandler_PathRewrite(t *testing.T) {
+	client := &recordingHttpClient{}
+	openai := NewOpenAI(&RouteConfig{
+		Forward:  FAKE_BASE_URL + "/",
+		Provider: "openai",
+		Models: map[string]ModelConfig{
+			TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60.0, TokensPerMinute: 60000.0},
+		},
+		Paths: &PathConfig{
+			AddPrefix: "/openai/deployments/test",
+			Rewrite:   []PathRewrite{{Match: `^/completions$`, Replace: "/v1/completions"}},
+		},
+	}, client)
+
+	var bodyStr = []byte(fmt.Sprintf(`{"model": "%s", "prompt": "test"}`, TEST_MODEL))
+	req := httptest.NewRequest("POST", "http://localhost:8080/openai/completions?x=1", bytes.NewBuffer(bodyStr))
+	w := httptest.NewRecorder()
+	openai.GetHandler()(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{FAKE_BASE_URL + "/openai/deployments/test/v1/completions?x=1"}, client.urls)
+
+	// The rewritten path was recognized and scheduled
+	admitted, _ := openai.schedulers[TEST_MODEL].Counts()
+	assert.Equal(t, uint64(1), admitted)
+}
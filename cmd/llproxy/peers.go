@@ -0,0 +1,389 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Defaults for peer coordination, in seconds
+const (
+	defaultPeerInterval = 5
+	defaultPeerTimeout  = 15
+)
+
+// PeerConfig shares the configured limits between replicas without external storage. Each replica polls the
+// others' admin endpoints and takes a share of every scheduler's limits, 1/N when they're equally busy, N being itself
+// and the peers that answered recently. Busier replicas take more of a scheduler's limits than idle ones.
+type PeerConfig struct {
+	// Admin base URLs of the other replicas, e.g. "http://10.0.0.2:8082"
+	Peers []string `json:"peers"`
+
+	// An admin base URL whose hostname resolves to every replica, e.g. a headless service, looked up every interval
+	DNS string `json:"dns"`
+
+	// Seconds between polls, 5 when unset, and since a peer last answered before it's taken to be gone, 15 when unset
+	Interval float64 `json:"interval"`
+	Timeout  float64 `json:"timeout"`
+}
+
+func (c *PeerConfig) validate() error {
+	if c.Interval < 0 || c.Timeout < 0 {
+		return fmt.Errorf("peers interval and timeout can't be negative")
+	}
+	if len(c.Peers) == 0 && c.DNS == "" {
+		return fmt.Errorf("peers needs a list of peers or a dns name")
+	}
+	for _, peer := range append([]string{c.DNS}, c.Peers...) {
+		if peer != "" && !strings.HasPrefix(peer, "http://") && !strings.HasPrefix(peer, "https://") {
+			return fmt.Errorf("peer '%s' isn't an http(s) URL", peer)
+		}
+	}
+	return nil
+}
+
+// PeerReport is what a replica tells its peers, the consumption of each of its schedulers
+type PeerReport struct {
+	Replica    string               `json:"replica"`
+	Time       time.Time            `json:"time"`
+	Schedulers []PeerSchedulerUsage `json:"schedulers"`
+}
+
+// PeerSchedulerUsage is the utilization of one scheduler's limits on a replica, as a fraction of its share
+type PeerSchedulerUsage struct {
+	Route    string  `json:"route"`
+	Model    string  `json:"model"`
+	Scope    string  `json:"scope,omitempty"`
+	Requests float64 `json:"requests"`
+	Tokens   float64 `json:"tokens"`
+	Share    float64 `json:"share"`
+}
+
+// demand is the fraction of the scheduler's whole limits the replica is using or waiting for, taking its busier
+// limit and the equal share for replicas that don't report theirs
+func (u PeerSchedulerUsage) demand(equal float64) float64 {
+	share := u.Share
+	if share <= 0 {
+		share = equal
+	}
+	return math.Min(1, math.Max(u.Requests, u.Tokens)) * share
+}
+
+func (u PeerSchedulerUsage) key() string {
+	return u.Route + "\x00" + u.Model + "\x00" + u.Scope
+}
+
+// PeerStatus is a peer as last seen, for the admin endpoints
+type PeerStatus struct {
+	URL      string      `json:"url"`
+	Replica  string      `json:"replica,omitempty"`
+	Alive    bool        `json:"alive"`
+	LastSeen *time.Time  `json:"lastSeen,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Report   *PeerReport `json:"report,omitempty"`
+}
+
+// PeersStatus is this replica's view of its peers and the equal share of the limits, which schedulers start from
+type PeersStatus struct {
+	Replica string       `json:"replica"`
+	Share   float64      `json:"share"`
+	Peers   []PeerStatus `json:"peers"`
+}
+
+// This replica's id, random per process, so a replica finding itself through DNS can skip itself
+var replicaID = newReplicaID()
+
+func newReplicaID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		// Unlikely, but the id only has to differ from the other replicas'
+		zap.S().Warnw("Unable to generate a random replica id, using the time and process", "reason", err)
+		return fmt.Sprintf("%x-%d", time.Now().UnixNano(), os.Getpid())
+	}
+	return hex.EncodeToString(id)
+}
+
+// peerCoordinator polls the peers and sets every scheduler's share of its limits from how many are alive
+type peerCoordinator struct {
+	config    *PeerConfig
+	interval  time.Duration
+	timeout   time.Duration
+	client    HttpClient
+	providers Providers
+	lookup    func(host string) ([]string, error)
+
+	mu    sync.Mutex
+	peers map[string]*PeerStatus
+	share float64
+}
+
+// The peer coordination, nil when disabled
+var peers *peerCoordinator
+
+func newPeerCoordinator(config *PeerConfig, providers Providers) *peerCoordinator {
+	if config == nil {
+		return nil
+	}
+	c := &peerCoordinator{
+		config:    config,
+		interval:  time.Duration(config.Interval * float64(time.Second)),
+		timeout:   time.Duration(config.Timeout * float64(time.Second)),
+		client:    &http.Client{Timeout: 2 * time.Second},
+		providers: providers,
+		lookup:    net.LookupHost,
+		peers:     make(map[string]*PeerStatus),
+		share:     1,
+	}
+	if c.interval == 0 {
+		c.interval = defaultPeerInterval * time.Second
+	}
+	if c.timeout == 0 {
+		c.timeout = defaultPeerTimeout * time.Second
+	}
+	return c
+}
+
+func (c *peerCoordinator) Run() {
+	if c == nil {
+		return
+	}
+	c.poll(time.Now())
+	for now := range time.Tick(c.interval) {
+		c.poll(now)
+	}
+}
+
+// poll asks every peer for its report, then shares the limits between this replica and the peers still alive
+func (c *peerCoordinator) poll(now time.Time) {
+	urls := c.discover()
+
+	var wg sync.WaitGroup
+	results := make([]PeerStatus, len(urls))
+	for i, peer := range urls {
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			results[i] = c.fetch(peer)
+		}(i, peer)
+	}
+	wg.Wait()
+
+	c.mu.Lock()
+	for _, result := range results {
+		status, ok := c.peers[result.URL]
+		if !ok {
+			status = &PeerStatus{URL: result.URL}
+			c.peers[result.URL] = status
+		}
+		status.Error = result.Error
+		if result.Error == "" {
+			seen := now
+			status.Replica, status.LastSeen, status.Report = result.Replica, &seen, result.Report
+		}
+	}
+
+	// Peers no longer listed or resolved are forgotten once they've timed out, as are answers from ourselves
+	alive := 1
+	for peer, status := range c.peers {
+		status.Alive = status.LastSeen != nil && now.Sub(*status.LastSeen) < c.timeout && status.Replica != replicaID
+		if status.Alive {
+			alive++
+		} else if status.Replica == replicaID || !containsString(urls, peer) {
+			delete(c.peers, peer)
+		}
+	}
+	share := 1 / float64(alive)
+	changed := share != c.share
+	c.share = share
+
+	// What the peers alive are using of each scheduler
+	demand := make(map[string]float64)
+	for _, status := range c.peers {
+		if status.Alive && status.Report != nil {
+			for _, usage := range status.Report.Schedulers {
+				demand[usage.key()] += usage.demand(share)
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	if changed {
+		zap.S().Infow("Sharing limits with peers", "replicas", alive, "share", share)
+	}
+
+	// Each replica takes the equal share plus what it's using, scaled so that the replicas' shares add up to the whole
+	// when they see the same reports. Equally busy replicas take the equal share.
+	forEachScheduler(c.providers, func(route string, scheduler *Scheduler) {
+		requests, tokens := scheduler.utilization()
+		own := PeerSchedulerUsage{Route: route, Model: scheduler.Name, Scope: scheduler.Scope, Requests: requests, Tokens: tokens, Share: scheduler.Share()}
+		mine := own.demand(share)
+		scheduler.SetShare((share + mine) / (1 + mine + demand[own.key()]))
+	})
+}
+
+// Apply gives schedulers created between polls, e.g. for a new scope, the equal share of their limits
+func (c *peerCoordinator) Apply(schedulers SchedulerMap) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	share := c.share
+	c.mu.Unlock()
+	for _, scheduler := range schedulers {
+		scheduler.SetShare(share)
+	}
+}
+
+// discover returns the URLs of the configured peers and of those the DNS name resolves to
+func (c *peerCoordinator) discover() []string {
+	urls := append([]string{}, c.config.Peers...)
+	if c.config.DNS != "" {
+		base, err := url.Parse(c.config.DNS)
+		if err != nil {
+			zap.S().Errorw("Unable to parse peer dns URL", "url", c.config.DNS, "reason", err)
+			return urls
+		}
+		addresses, err := c.lookup(base.Hostname())
+		if err != nil {
+			zap.S().Warnw("Unable to resolve peers", "host", base.Hostname(), "reason", err)
+		}
+		sort.Strings(addresses)
+		for _, address := range addresses {
+			peer := *base
+			peer.Host = address
+			if port := base.Port(); port != "" {
+				peer.Host = net.JoinHostPort(address, port)
+			}
+			if !containsString(urls, peer.String()) {
+				urls = append(urls, peer.String())
+			}
+		}
+	}
+	return urls
+}
+
+// fetch asks one peer for its report
+func (c *peerCoordinator) fetch(peer string) PeerStatus {
+	status := PeerStatus{URL: peer}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(peer, "/")+"/admin/peers/report", nil)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	adminAuth.Authorize(req)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		status.Error = fmt.Sprintf("status %d", resp.StatusCode)
+		return status
+	}
+	var report PeerReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Replica, status.Report = report.Replica, &report
+	return status
+}
+
+// Status returns the peers as last polled
+func (c *peerCoordinator) Status() PeersStatus {
+	if c == nil {
+		return PeersStatus{Replica: replicaID, Share: 1, Peers: []PeerStatus{}}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := PeersStatus{Replica: replicaID, Share: c.share, Peers: make([]PeerStatus, 0, len(c.peers))}
+	for _, peer := range sortedModels(c.peers) {
+		status.Peers = append(status.Peers, *c.peers[peer])
+	}
+	return status
+}
+
+// WriteMetrics writes the number of peers alive and the share of the limits this replica takes
+func (c *peerCoordinator) WriteMetrics(w io.Writer) {
+	if c == nil {
+		return
+	}
+	status := c.Status()
+	alive := 0
+	for _, peer := range status.Peers {
+		if peer.Alive {
+			alive++
+		}
+	}
+	fmt.Fprintln(w, "# HELP llproxy_peers Peers that answered within the peer timeout.")
+	fmt.Fprintln(w, "# TYPE llproxy_peers gauge")
+	fmt.Fprintf(w, "llproxy_peers %d\n", alive)
+	fmt.Fprintln(w, "# HELP llproxy_peer_share Share of the configured limits this replica takes.")
+	fmt.Fprintln(w, "# TYPE llproxy_peer_share gauge")
+	fmt.Fprintf(w, "llproxy_peer_share %g\n", status.Share)
+}
+
+// peerReport returns the consumption of every scheduler of this replica
+func peerReport(providers Providers) PeerReport {
+	report := PeerReport{Replica: replicaID, Time: time.Now(), Schedulers: []PeerSchedulerUsage{}}
+	forEachScheduler(providers, func(route string, scheduler *Scheduler) {
+		requests, tokens := scheduler.utilization()
+		report.Schedulers = append(report.Schedulers, PeerSchedulerUsage{Route: route, Model: scheduler.Name, Scope: scheduler.Scope, Requests: requests, Tokens: tokens, Share: scheduler.Share()})
+	})
+	return report
+}
+
+func getPeerReport(providers Providers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, peerReport(providers))
+	}
+}
+
+func getPeerStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, peers.Status())
+	}
+}
+
+// forEachScheduler calls f with every scheduler of every route, in order
+func forEachScheduler(providers Providers, f func(route string, scheduler *Scheduler)) {
+	for _, route := range sortedRoutes(providers) {
+		provider := providers[route]
+		for _, schedulers := range append([]SchedulerMap{provider.Schedulers()}, provider.ScopedSchedulers()...) {
+			for _, model := range sortedModels(schedulers) {
+				f(route, schedulers[model])
+			}
+		}
+	}
+}
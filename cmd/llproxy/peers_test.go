@@ -0,0 +1,112 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerSharing(t *testing.T) {
+	t.Setenv("LLPROXY_TEST_ADMIN_TOKEN", "peer-token")
+	adminAuth = newAdminAuth(&AdminAuthConfig{TokenEnv: "LLPROXY_TEST_ADMIN_TOKEN"})
+	t.Cleanup(func() { adminAuth = nil })
+
+	openai := NewOpenAI(&RouteConfig{
+		Forward:        FAKE_BASE_URL,
+		Provider:       "openai",
+		SchedulerScope: []string{"OpenAI-Organization"},
+		Models: map[string]ModelConfig{
+			TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60, TokensPerMinute: 60000},
+		},
+	}, &MockHttpClient{})
+	providers := Providers{"openai": openai}
+	scheduler := openai.Schedulers()[TEST_MODEL]
+
+	// A peer reporting as another replica, and this replica found again through DNS
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/admin/peers/report", r.URL.Path)
+		assert.Equal(t, "Bearer peer-token", r.Header.Get("Authorization"))
+		writeJSON(w, PeerReport{Replica: "peer", Schedulers: []PeerSchedulerUsage{{Route: "openai", Model: TEST_MODEL, Requests: 0.5, Share: 0.5}}})
+	}))
+	self := httptest.NewServer(newAdminRouter(providers))
+	defer self.Close()
+
+	selfURL := strings.Replace(self.URL, "127.0.0.1", "self.local", 1)
+	coordinator := newPeerCoordinator(&PeerConfig{Peers: []string{peer.URL, "http://127.0.0.1:1"}, DNS: selfURL}, providers)
+	coordinator.lookup = func(host string) ([]string, error) {
+		assert.Equal(t, "self.local", host)
+		return []string{"127.0.0.1"}, nil
+	}
+	peers = coordinator
+	t.Cleanup(func() { peers = nil })
+
+	// Two replicas alive, the unreachable peer and this one aside. The peer is using a quarter of the limits and this
+	// replica none, so it takes less than half of them.
+	now := time.Now()
+	coordinator.poll(now)
+	assert.InDelta(t, 0.5/1.25, scheduler.Share(), 1e-9)
+	assert.InDelta(t, 24, scheduler.Limits().ReqsPerMinute, 1e-6)
+	assert.LessOrEqual(t, scheduler.Snapshot().TokenCapacity, 24000.0+1e-6)
+
+	status := coordinator.Status()
+	assert.Equal(t, 0.5, status.Share)
+	assert.Len(t, status.Peers, 2)
+	for _, p := range status.Peers {
+		assert.Equal(t, p.URL == peer.URL, p.Alive, p.URL)
+	}
+	if assert.NotNil(t, status.Peers[1].Report) {
+		assert.Equal(t, "peer", status.Peers[1].Report.Replica)
+	}
+
+	// Scopes created between polls start from the equal share rather than the whole limits
+	scoped, _ := openai.scopes.Get("org-a")
+	assert.Equal(t, SchedulerLimits{ReqsPerMinute: 30, TokensPerMinute: 30000}, scoped.schedulers[TEST_MODEL].Limits())
+
+	// Once busy, this replica takes more than half
+	scheduler.setCapacity(0, 0)
+	coordinator.poll(now.Add(time.Second))
+	assert.InDelta(t, (0.5+0.4)/(1+0.4+0.25), scheduler.Share(), 1e-4)
+
+	// The peer stays counted until it hasn't answered for the timeout
+	peer.Close()
+	coordinator.poll(now.Add(5 * time.Second))
+	assert.Equal(t, 0.5, coordinator.Status().Share)
+	coordinator.poll(now.Add(20 * time.Second))
+	assert.Equal(t, 1.0, coordinator.Status().Share)
+	assert.Equal(t, SchedulerLimits{ReqsPerMinute: 60, TokensPerMinute: 60000}, scheduler.Limits())
+
+	// This replica's own report
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://localhost:8082/admin/peers/report", nil)
+	adminAuth.Authorize(r)
+	newAdminRouter(providers).ServeHTTP(w, r)
+	var report PeerReport
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, replicaID, report.Replica)
+	assert.Len(t, report.Schedulers, 2)
+
+	// The report isn't served without the admin token
+	w = httptest.NewRecorder()
+	newAdminRouter(providers).ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8082/admin/peers/report", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
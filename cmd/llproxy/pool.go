@@ -0,0 +1,77 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Buffers that grew beyond this are left for the GC, so one huge upload doesn't pin memory in the pool
+const maxPooledBufferSize = 1 << 20
+
+const copyBufferSize = 32 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
+var copyBufferPool = sync.Pool{
+	New: func() any {
+		buffer := make([]byte, copyBufferSize)
+		return &buffer
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buffer *bytes.Buffer) {
+	if buffer.Cap() > maxPooledBufferSize {
+		return
+	}
+	buffer.Reset()
+	bufferPool.Put(buffer)
+}
+
+// copyPooled is io.Copy using a pooled buffer
+func copyPooled(dst io.Writer, src io.Reader) (int64, error) {
+	buffer := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(buffer)
+	return io.CopyBuffer(dst, src, *buffer)
+}
+
+// pooledBufferReader reads a pooled buffer and returns it to the pool once it has been read to the end
+type pooledBufferReader struct {
+	buffer *bytes.Buffer
+}
+
+func (p *pooledBufferReader) Read(b []byte) (int, error) {
+	if p.buffer == nil {
+		return 0, io.EOF
+	}
+	n, err := p.buffer.Read(b)
+	if err == io.EOF {
+		putBuffer(p.buffer)
+		p.buffer = nil
+	}
+	return n, err
+}
@@ -18,7 +18,6 @@ package main
 
 import (
 	"fmt"
-	"io"
 	"net/http"
 	"net/url"
 	"strings"
@@ -31,62 +30,61 @@ type HttpClient interface {
 	Do(req *http.Request) (*http.Response, error)
 }
 
-type Handlers map[string]func(http.ResponseWriter, *http.Request)
+// Providers maps a route name to the provider serving it
+type Providers map[string]Provider
 
 type Provider interface {
 	GetHandler() func(http.ResponseWriter, *http.Request)
+	Schedulers() SchedulerMap
+	ScopedSchedulers() []SchedulerMap
+	Maintenance() *maintenanceSwitch
+	Faults() *faultInjector
+	LimitDiscovery() *limitDiscovery
+	Upstreams() []*UpstreamHealth
+	UpstreamPool() *upstreamPool
+	KeyPool() *apiKeyPool
+	Explain(r *http.Request) (Explanation, error)
 }
 
-func initProviders(config *Config) Handlers {
+func initProviders(config *Config) Providers {
 	// A provider is a single service such as OpenAI
 	// A single provider may have multiple models/schedulers backing it
 	// Determining how to identify which scheduler to use within a provider
 	// is provider specific and needs to be coded for each provider specifically
-	var handlers = make(Handlers)
-	var client = &http.Client{}
+	var providers = make(Providers)
+	var client = newUpstreamClient(config.Application.UpstreamConnections)
 
 	// Initialize the queue state for each scheduler
 	for route, routeConfig := range config.Routes {
 		zap.S().Infow("Initializing Provider", "provider", routeConfig.Provider)
 		switch routeConfig.Provider {
 		case "openai":
-			openai := NewOpenAI(&routeConfig, client)
-			handlers[route] = openai.GetHandler()
+			providers[route] = NewOpenAI(&routeConfig, client)
 		default:
 			zap.S().Fatalf("Unexpected Provider: '%s'\nCurrently supported providers: [openai]", routeConfig.Provider)
 		}
 	}
 
-	return handlers
+	return providers
 }
 
-func forwardRequest(client HttpClient, URLBase string, w http.ResponseWriter, r *http.Request) error {
-	// The main Proxy code, used by all Providers
-
-	// Create a new URL from the raw r.URL to modify it
-	url, err := url.Parse(r.URL.String())
-	if err != nil {
-		zap.S().Errorw("URL parse error", "url", r.URL, "reason", err)
-		return err
+// upstreamURLs returns a route's upstreams, which default to just the forward URL
+func upstreamURLs(config *RouteConfig) []string {
+	if len(config.Upstreams) > 0 {
+		return config.Upstreams
 	}
+	return []string{config.Forward}
+}
 
-	// Split the path into segments and strip off the first segment
-	segments := strings.Split(url.Path, "/")
-	if len(segments) < 2 {
-		zap.S().Errorw("URL parse error", "url", url, "reason", "expected provider path")
-		return fmt.Errorf("Invalid URL: %s", url)
-	}
-	newPath := strings.Join(segments[2:], "/")
+// ResponseHook can inspect or modify an upstream response before it is written back to the client
+type ResponseHook func(resp *http.Response)
 
-	// Modify the URL's scheme and host to the target URL's
-	targetURL, err := url.Parse(URLBase)
+func forwardRequest(client HttpClient, URLBase string, w http.ResponseWriter, r *http.Request, hooks ...ResponseHook) error {
+	// The main Proxy code, used by all Providers
+	url, err := upstreamURL(URLBase, r.URL)
 	if err != nil {
-		zap.S().Errorw("Base URL parse error", "url", URLBase, "reason", "Bad Provider Base URL")
 		return err
 	}
-	url.Scheme = targetURL.Scheme
-	url.Host = targetURL.Host
-	url.Path = newPath
 
 	// Create a new request using http
 	request, err := http.NewRequest(r.Method, url.String(), r.Body)
@@ -95,6 +93,11 @@ func forwardRequest(client HttpClient, URLBase string, w http.ResponseWriter, r
 		return err
 	}
 
+	// The body is streamed, so carry over the original length rather than falling back to chunked encoding
+	if r.ContentLength > 0 {
+		request.ContentLength = r.ContentLength
+	}
+
 	// Copy the headers from the original request
 	copyHeader(request.Header, r.Header)
 
@@ -105,14 +108,55 @@ func forwardRequest(client HttpClient, URLBase string, w http.ResponseWriter, r
 	}
 	defer resp.Body.Close()
 
+	for _, hook := range hooks {
+		hook(resp)
+	}
+
 	// Write the response back to the original writer
 	copyHeader(w.Header(), resp.Header)
 	w.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(w, resp.Body)
+	_, err = copyPooled(w, resp.Body)
+
+	// Trailers are only known once the body has been read
+	for k, vv := range resp.Trailer {
+		for _, v := range vv {
+			w.Header().Add(http.TrailerPrefix+k, v)
+		}
+	}
 
 	return err
 }
 
+// upstreamURL maps a URL under a route to the upstream's, replacing the route segment with the base URL
+func upstreamURL(URLBase string, requestURL *url.URL) (*url.URL, error) {
+	// Create a new URL from the raw URL to modify it
+	url, err := url.Parse(requestURL.String())
+	if err != nil {
+		zap.S().Errorw("URL parse error", "url", requestURL, "reason", err)
+		return nil, err
+	}
+
+	// Split the path into segments and strip off the first segment
+	segments := strings.Split(url.Path, "/")
+	if len(segments) < 2 {
+		zap.S().Errorw("URL parse error", "url", url, "reason", "expected provider path")
+		return nil, fmt.Errorf("Invalid URL: %s", url)
+	}
+	newPath := strings.Join(segments[2:], "/")
+
+	// Modify the URL's scheme and host to the target URL's
+	targetURL, err := url.Parse(URLBase)
+	if err != nil {
+		zap.S().Errorw("Base URL parse error", "url", URLBase, "reason", "Bad Provider Base URL")
+		return nil, err
+	}
+	url.Scheme = targetURL.Scheme
+	url.Host = targetURL.Host
+	url.Path = strings.TrimSuffix(targetURL.Path, "/") + "/" + newPath
+	url.RawPath = ""
+	return url, nil
+}
+
 func copyHeader(dst, src http.Header) {
 	for k, vv := range src {
 		for _, v := range vv {
@@ -120,3 +164,12 @@ func copyHeader(dst, src http.Header) {
 		}
 	}
 }
+
+// setHeaders sets every header from each map in turn, so later maps override earlier ones
+func setHeaders(dst http.Header, headers ...map[string]string) {
+	for _, h := range headers {
+		for k, v := range h {
+			dst.Set(k, v)
+		}
+	}
+}
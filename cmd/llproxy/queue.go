@@ -0,0 +1,119 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Clients that want to poll the queue status of a request send their own id for it in this header
+const HeaderQueueRequestID = "X-LLProxy-Request-Id"
+
+// queueFeedbackWriter lets a streamed request hear about its queue position before the upstream has answered.
+// The first keepalive commits a 200 event stream, so a later error status can't be sent and the error body is
+// framed as an SSE error event instead.
+type queueFeedbackWriter struct {
+	http.ResponseWriter
+	started bool
+	failed  bool
+	framing bool
+}
+
+func newQueueFeedbackWriter(w http.ResponseWriter) *queueFeedbackWriter {
+	return &queueFeedbackWriter{ResponseWriter: w}
+}
+
+// Unwrap returns the writer underneath, for http.ResponseController and finding the request's record
+func (q *queueFeedbackWriter) Unwrap() http.ResponseWriter {
+	return q.ResponseWriter
+}
+
+// Keepalive sends the queue status as an SSE comment, which clients ignore but which keeps the connection alive
+func (q *queueFeedbackWriter) Keepalive(status QueueStatus) {
+	if !q.started {
+		q.started = true
+		q.Header().Set("Content-Type", "text/event-stream")
+		q.Header().Set("Cache-Control", "no-cache")
+		q.ResponseWriter.WriteHeader(http.StatusOK)
+	}
+	fmt.Fprintf(q.ResponseWriter, ": queued position=%d eta=%.1fs\n\n", status.Position, status.ETA)
+	q.Flush()
+}
+
+func (q *queueFeedbackWriter) WriteHeader(status int) {
+	if !q.started {
+		q.ResponseWriter.WriteHeader(status)
+		return
+	}
+	q.failed = status >= http.StatusMultipleChoices
+}
+
+func (q *queueFeedbackWriter) Write(b []byte) (int, error) {
+	if !q.failed {
+		return q.ResponseWriter.Write(b)
+	}
+
+	// JSON error bodies only contain newlines as whitespace, so dropping them keeps the event on one data line
+	if !q.framing {
+		q.framing = true
+		if _, err := q.ResponseWriter.Write([]byte("event: error\ndata: ")); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := q.ResponseWriter.Write(bytes.ReplaceAll(b, []byte("\n"), nil)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (q *queueFeedbackWriter) Flush() {
+	if flusher, ok := q.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Finish terminates an error event, if one was started
+func (q *queueFeedbackWriter) Finish() {
+	if q.framing {
+		q.ResponseWriter.Write([]byte("\n\n"))
+	}
+}
+
+// observer returns the observer sending keepalives to w every interval seconds
+func (q *queueFeedbackWriter) observer(interval float64) *QueueObserver {
+	return &QueueObserver{
+		Interval: time.Duration(interval * float64(time.Second)),
+		Observe:  q.Keepalive,
+	}
+}
+
+// getQueueStatusHandler reports the queue status of a waiting request by the id in the path
+func getQueueStatusHandler(prefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, prefix+"/")
+		status, ok := QueuedRequestStatus(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, ErrTypeInvalidRequest, ErrCodeInvalidRequest, fmt.Sprintf("No queued request with id '%s'", id))
+			return
+		}
+		writeJSON(w, status)
+	}
+}
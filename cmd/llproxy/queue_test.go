@@ -0,0 +1,141 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueuedRequestStatus(t *testing.T) {
+	schedulers := initSchedulers("openai", map[string]ModelConfig{
+		TEST_MODEL: {MaxQueueSize: 10, ReqsPerMinute: 60.0, TokensPerMinute: 60000.0},
+	})
+	scheduler := schedulers[TEST_MODEL]
+	scheduler.setCapacity(0.5, 60000)
+
+	done := make(chan Response)
+	go func() {
+		req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", nil)
+		req.Header.Set(HeaderQueueRequestID, "request-1")
+		done <- scheduler.Submit(req, 100)
+	}()
+
+	// Wait for the request to be queued
+	var status QueueStatus
+	var ok bool
+	for i := 0; i < 100 && !ok; i++ {
+		time.Sleep(time.Millisecond)
+		status, ok = QueuedRequestStatus("request-1")
+	}
+	assert.True(t, ok)
+	assert.Equal(t, TEST_MODEL, status.Model)
+	assert.Equal(t, 1, status.Position)
+	assert.InDelta(t, 0.5, status.ETA, 0.1)
+
+	// The status endpoint reports the same
+	w := httptest.NewRecorder()
+	getQueueStatusHandler("/llproxy/queue")(w, httptest.NewRequest("GET", "http://localhost:8080/llproxy/queue/request-1", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, 1, status.Position)
+
+	assert.Equal(t, Response(Ready), <-done)
+	_, ok = QueuedRequestStatus("request-1")
+	assert.False(t, ok)
+}
+
+func TestQueuedRequestStatusPriority(t *testing.T) {
+	schedulers := initSchedulers("openai", map[string]ModelConfig{
+		TEST_MODEL: {MaxQueueSize: 10, ReqsPerMinute: 60.0, TokensPerMinute: 60000.0},
+	})
+	scheduler := schedulers[TEST_MODEL]
+	scheduler.setCapacity(0.5, 60000)
+
+	done := make(chan Response, 2)
+	submit := func(id string, priority int) {
+		req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", nil)
+		req.Header.Set(HeaderQueueRequestID, id)
+		done <- scheduler.SubmitWith(req, 100, SubmitOptions{Priority: priority})
+	}
+	waitFor := func(id string, position int) QueueStatus {
+		var status QueueStatus
+		for i := 0; i < 100 && status.Position != position; i++ {
+			time.Sleep(time.Millisecond)
+			status, _ = QueuedRequestStatus(id)
+		}
+		return status
+	}
+
+	go submit("request-low", 0)
+	assert.Equal(t, 1, waitFor("request-low", 1).Position)
+
+	// A more urgent request that arrives later goes ahead of it
+	go submit("request-high", 1)
+	assert.Equal(t, 1, waitFor("request-high", 1).Position)
+	assert.Equal(t, 2, waitFor("request-low", 2).Position)
+
+	assert.Equal(t, Response(Ready), <-done)
+	assert.Equal(t, Response(Ready), <-done)
+}
+
+func TestGetHandler_QueueKeepalive(t *testing.T) {
+	openai := NewOpenAI(&RouteConfig{
+		Forward:  FAKE_BASE_URL,
+		Provider: "openai",
+		Models: map[string]ModelConfig{
+			TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60.0, TokensPerMinute: 60000.0, QueueKeepalive: 0.1},
+		},
+	}, &MockHttpClient{})
+
+	// The completion has to wait about half a second for tokens
+	openai.schedulers[TEST_MODEL].setCapacity(60, 500)
+
+	var bodyStr = []byte(fmt.Sprintf(`{"model": "%s", "prompt": "test", "stream": true}`, TEST_MODEL))
+	req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewBuffer(bodyStr))
+	w := httptest.NewRecorder()
+	openai.GetHandler()(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	assert.True(t, strings.HasPrefix(body, ": queued position=1 eta="), body)
+	assert.True(t, strings.HasSuffix(body, "dummy completion"), body)
+}
+
+func TestQueueFeedbackWriter_Error(t *testing.T) {
+	w := httptest.NewRecorder()
+	feedback := newQueueFeedbackWriter(w)
+	feedback.Keepalive(QueueStatus{Position: 2, ETA: 1.5})
+
+	writeError(feedback, http.StatusBadRequest, ErrTypeInvalidRequest, ErrCodeRequestTooLarge, "too large")
+	feedback.Finish()
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	lines := strings.Split(w.Body.String(), "\n")
+	assert.Equal(t, ": queued position=2 eta=1.5s", lines[0])
+	assert.Equal(t, "event: error", lines[2])
+	assert.True(t, strings.HasPrefix(lines[3], `data: {"error":`), lines[3])
+	assert.True(t, strings.HasSuffix(w.Body.String(), "}\n\n"))
+}
@@ -0,0 +1,74 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Header names follow OpenAI's so that SDK retry logic understands them
+const (
+	HeaderRetryAfter        = "Retry-After"
+	HeaderLimitRequests     = "x-ratelimit-limit-requests"
+	HeaderLimitTokens       = "x-ratelimit-limit-tokens"
+	HeaderRemainingRequests = "x-ratelimit-remaining-requests"
+	HeaderRemainingTokens   = "x-ratelimit-remaining-tokens"
+	HeaderResetRequests     = "x-ratelimit-reset-requests"
+	HeaderResetTokens       = "x-ratelimit-reset-tokens"
+)
+
+const minimumRetryAfterSeconds = 1
+
+// setRateLimitHeaders describes the proxy-side limits and remaining capacity for a scheduler
+func setRateLimitHeaders(header http.Header, scheduler *Scheduler) {
+	snapshot := scheduler.Snapshot()
+	limits := scheduler.Limits()
+
+	remainingRequests := math.Max(0, math.Floor(snapshot.RequestCapacity))
+	remainingTokens := math.Max(0, math.Floor(snapshot.TokenCapacity))
+
+	// Reset is the time until capacity has fully recovered
+	resetRequests := (limits.ReqsPerMinute - snapshot.RequestCapacity) / limits.ReqsPerMinute
+	resetTokens := (limits.TokensPerMinute - snapshot.TokenCapacity) / limits.TokensPerMinute
+
+	header.Set(HeaderLimitRequests, strconv.FormatFloat(math.Floor(limits.ReqsPerMinute), 'f', 0, 64))
+	header.Set(HeaderLimitTokens, strconv.FormatFloat(math.Floor(limits.TokensPerMinute), 'f', 0, 64))
+	header.Set(HeaderRemainingRequests, strconv.FormatFloat(remainingRequests, 'f', 0, 64))
+	header.Set(HeaderRemainingTokens, strconv.FormatFloat(remainingTokens, 'f', 0, 64))
+	header.Set(HeaderResetRequests, formatReset(resetRequests))
+	header.Set(HeaderResetTokens, formatReset(resetTokens))
+}
+
+// setRetryAfter tells the client how many whole seconds to wait before retrying a request of this size
+func setRetryAfter(header http.Header, scheduler *Scheduler, tokens float64) {
+	seconds := int(math.Ceil(scheduler.WaitEstimate(tokens)))
+	if seconds < minimumRetryAfterSeconds {
+		seconds = minimumRetryAfterSeconds
+	}
+	header.Set(HeaderRetryAfter, strconv.Itoa(seconds))
+}
+
+// formatReset renders minutes in the duration format OpenAI uses, e.g. "1.5s" or "6m0s"
+func formatReset(minutes float64) string {
+	if minutes < 0 {
+		minutes = 0
+	}
+	return time.Duration(minutes * float64(time.Minute)).Round(time.Millisecond).String()
+}
@@ -0,0 +1,194 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RequestRecord describes a request as it's handled, for access logs, metrics and usage records
+type RequestRecord struct {
+	Start  time.Time
+	Method string
+	Path   string
+	Route  string
+	Model  string
+	Client string
+	Tags   map[string]string
+
+	// What the access log needs in the common and combined formats
+	RequestURI string
+	Proto      string
+	RemoteAddr string
+	Referer    string
+	UserAgent  string
+
+	// The W3C trace context the client sent, so logs can be correlated with its traces
+	TraceID string
+	SpanID  string
+
+	Status int
+	Bytes  int64
+	Usage  *Usage
+	Cost   float64
+
+	// How long a streamed response took to send its first chunk, 0 for other responses
+	FirstToken time.Duration
+
+	// Where the request is at, see SetStage
+	stage atomic.Pointer[requestStage]
+}
+
+type recordContextKey struct{}
+
+// recordFromContext returns the request's record, or nil when requests aren't being recorded
+func recordFromContext(ctx context.Context) *RequestRecord {
+	record, _ := ctx.Value(recordContextKey{}).(*RequestRecord)
+	return record
+}
+
+// recordRequests keeps a RequestRecord for every request, which handlers fill in as they learn about it.
+// Once the request is done it's written to the access log, if there is one, and counted in the metrics and usage records
+// under the tags named by tagLabels.
+func recordRequests(routes map[string]RouteConfig, accessLog func(*RequestRecord), tagLabels []string) Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			record := &RequestRecord{
+				Start:      time.Now(),
+				Method:     r.Method,
+				Path:       r.URL.Path,
+				RequestURI: r.URL.RequestURI(),
+				Proto:      r.Proto,
+				RemoteAddr: r.RemoteAddr,
+				Referer:    r.Referer(),
+				UserAgent:  r.UserAgent(),
+			}
+			record.TraceID, record.SpanID = parseTraceparent(r.Header.Get(HeaderTraceparent))
+			if route := strings.Split(r.URL.Path, "/")[1]; route != "" {
+				if _, ok := routes[route]; ok {
+					record.Route = route
+				}
+			}
+
+			// Deferred so requests whose handler aborts the connection are still recorded
+			inflight.Add(record)
+			defer func() {
+				inflight.Remove(record)
+				if record.Status == 0 {
+					record.Status = http.StatusOK
+				}
+
+				if accessLog != nil && routeAccessLog(record.Route) {
+					accessLog(record)
+				}
+				requestMetrics.Observe(record, tagLabels)
+				usageRecords.Add(record, tagLabels)
+				billing.Add(record)
+			}()
+			recorder := &recordingWriter{ResponseWriter: w, record: record}
+			next(recorder, r.WithContext(context.WithValue(r.Context(), recordContextKey{}, record)))
+		}
+	}
+}
+
+func logAccess(record *RequestRecord) {
+	fields := []any{
+		"method", record.Method,
+		"path", record.Path,
+		"status", record.Status,
+		"bytes", record.Bytes,
+		"duration", time.Since(record.Start).Seconds(),
+		"route", record.Route,
+		"model", record.Model,
+		"client", record.Client,
+	}
+	if record.TraceID != "" {
+		fields = append(fields, logFieldTraceID, record.TraceID, logFieldSpanID, record.SpanID)
+	}
+	if len(record.Tags) > 0 {
+		fields = append(fields, "tags", record.Tags)
+	}
+	if record.FirstToken > 0 {
+		fields = append(fields, "firstToken", record.FirstToken.Seconds())
+	}
+	if record.Usage != nil {
+		fields = append(fields, "promptTokens", record.Usage.PromptTokens, "completionTokens", record.Usage.CompletionTokens)
+	}
+	zap.S().Infow("Access", fields...)
+}
+
+// HeaderTraceparent carries the W3C trace context, e.g. "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+const HeaderTraceparent = "traceparent"
+
+// parseTraceparent returns the trace and parent span ids of a traceparent header, or nothing if it isn't valid
+func parseTraceparent(value string) (string, string) {
+	parts := strings.Split(value, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return "", ""
+	}
+	if !isHex(parts[1]) || !isHex(parts[2]) || strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return "", ""
+	}
+	return parts[1], parts[2]
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// recordingWriter notes the status and size of the response in its record
+type recordingWriter struct {
+	http.ResponseWriter
+	record *RequestRecord
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	if rw.record.Status == 0 {
+		rw.record.Status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	if rw.record.Status == 0 {
+		rw.record.Status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(p)
+	rw.record.Bytes += int64(n)
+	return n, err
+}
+
+func (rw *recordingWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+func (rw *recordingWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,132 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"go.uber.org/zap"
+)
+
+// RejectionConfig replaces the message of requests turned away for a reason with a template, so users see
+// actionable guidance, e.g. {"over_budget": "{{.Client}}'s {{.Model}} allowance is used up, see {{.Contact}}"}
+type RejectionConfig struct {
+	// Templates by RejectReason, executed with RejectionData
+	Messages map[RejectReason]string `json:"messages"`
+
+	// Contact is given to every template, e.g. where to ask for more quota
+	Contact string `json:"contact"`
+}
+
+// RejectionData is what a rejection message template can use. Values the proxy doesn't know for a request are empty.
+type RejectionData struct {
+	Reason  RejectReason
+	Status  int
+	Message string // The proxy's own message
+	Route   string
+	Model   string
+	Client  string
+	Tags    map[string]string
+	Contact string
+
+	// Seconds until the request could succeed, and the limits it was held to, as sent in the response headers
+	RetryAfter string
+	RPM        string
+	TPM        string
+}
+
+// rejectionTemplates renders the configured messages
+type rejectionTemplates struct {
+	templates map[RejectReason]*template.Template
+	contact   string
+}
+
+// The rejection message templates, nil when the proxy's own messages are used
+var rejections *rejectionTemplates
+
+func newRejectionTemplates(config *RejectionConfig) (*rejectionTemplates, error) {
+	if config == nil {
+		return nil, nil
+	}
+	t := &rejectionTemplates{templates: make(map[RejectReason]*template.Template), contact: config.Contact}
+	for reason, message := range config.Messages {
+		if !isRejectReason(reason) {
+			return nil, fmt.Errorf("Rejection message for unknown reason '%s'", reason)
+		}
+		parsed, err := template.New(string(reason)).Option("missingkey=zero").Parse(message)
+		if err != nil {
+			return nil, fmt.Errorf("Rejection message for '%s': %v", reason, err)
+		}
+		t.templates[reason] = parsed
+	}
+	return t, nil
+}
+
+func isRejectReason(reason RejectReason) bool {
+	for _, doc := range rejectReasons {
+		if doc.Reason == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// Message returns the message for a rejection, the proxy's own unless there's a template for its reason.
+// A template that fails is logged and the proxy's message used instead.
+func (t *rejectionTemplates) Message(w http.ResponseWriter, status int, reason RejectReason, message string) string {
+	if t == nil || reason == "" {
+		return message
+	}
+	tmpl, ok := t.templates[reason]
+	if !ok {
+		return message
+	}
+
+	data := RejectionData{Reason: reason, Status: status, Message: message, Contact: t.contact}
+	if w != nil {
+		data.RetryAfter = w.Header().Get(HeaderRetryAfter)
+		data.RPM = w.Header().Get(HeaderLimitRequests)
+		data.TPM = w.Header().Get(HeaderLimitTokens)
+		if record := recordFromWriter(w); record != nil {
+			data.Route, data.Model, data.Client, data.Tags = record.Route, record.Model, record.Client, record.Tags
+		}
+	}
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		zap.S().Errorw("Unable to render rejection message", "reason", reason, "error", err)
+		return message
+	}
+	return rendered.String()
+}
+
+// recordFromWriter returns the record of the request a response is written for, unwrapping the writers around it
+func recordFromWriter(w http.ResponseWriter) *RequestRecord {
+	for w != nil {
+		if recorder, ok := w.(*recordingWriter); ok {
+			return recorder.record
+		}
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = unwrapper.Unwrap()
+	}
+	return nil
+}
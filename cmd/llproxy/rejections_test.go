@@ -0,0 +1,78 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRejectionTemplates(t *testing.T) {
+	templates, err := newRejectionTemplates(&RejectionConfig{
+		Messages: map[RejectReason]string{
+			RejectRateLimited: "{{.Client}}'s {{.Model}} TPM of {{.TPM}} is exhausted, retry in {{.RetryAfter}}s or see {{.Contact}}",
+		},
+		Contact: "https://wiki.example.com/llm-quota",
+	})
+	require.NoError(t, err)
+	rejections = templates
+	defer func() { rejections = nil }()
+
+	config := &Config{Clients: []ClientConfig{{Name: "team-a", Key: "key-a"}}}
+	routes := map[string]RouteConfig{"openai": {}}
+	openai := NewOpenAI(&RouteConfig{
+		Forward:  FAKE_BASE_URL,
+		Provider: "openai",
+		Models: map[string]ModelConfig{
+			TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60, TokensPerMinute: 60000},
+		},
+	}, &MockHttpClient{})
+	openai.Schedulers()[TEST_MODEL].setCapacity(0, 0)
+	handler := recordRequests(routes, nil, nil)(identifyClients(newClientKeys(config), config.DefaultPriority)(openai.GetHandler()))
+
+	send := func() ErrorResponse {
+		body := []byte(fmt.Sprintf(`{"model": "%s", "prompt": "test", "max_tokens": 10}`, TEST_MODEL))
+		req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewBuffer(body))
+		req.Header.Set(HeaderClientKey, "key-a")
+		req.Header.Set(HeaderNoQueue, "true")
+		w := httptest.NewRecorder()
+		handler(w, req)
+		var response ErrorResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response
+	}
+
+	// The template is given the request's client and model, and the limits and wait sent in the headers
+	response := send()
+	assert.Equal(t, RejectRateLimited, response.Error.Reason)
+	assert.Regexp(t, `^LLProxy: team-a's gpt-3.5-turbo TPM of 60000 is exhausted, retry in \d+s or see https://wiki.example.com/llm-quota$`, response.Error.Message)
+
+	// Reasons without a template keep the proxy's message
+	assert.Equal(t, "LLProxy: RateLimit exceeded", rejections.Message(nil, http.StatusTooManyRequests, RejectQueueFull, "LLProxy: RateLimit exceeded"))
+
+	// Templates that don't parse, or are for unknown reasons, are refused
+	_, err = newRejectionTemplates(&RejectionConfig{Messages: map[RejectReason]string{RejectRateLimited: "{{.Client"}})
+	assert.Error(t, err)
+	_, err = newRejectionTemplates(&RejectionConfig{Messages: map[RejectReason]string{"slow_down": "Slow down"}})
+	assert.Error(t, err)
+}
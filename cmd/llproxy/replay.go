@@ -0,0 +1,231 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplayRecord is a request read from a JSON access log, as much of it as is needed to send one like it again
+type ReplayRecord struct {
+	Start            time.Time
+	Method           string
+	Path             string
+	Route            string
+	Model            string
+	Status           int
+	PromptTokens     int
+	CompletionTokens int
+}
+
+type ReplayConfig struct {
+	Target string
+	APIKey string
+
+	// Speed scales the gaps between requests, 2 replays the traffic in half the time
+	Speed float64
+}
+
+// replayCommand implements `llproxy replay`, returning the process exit code
+func replayCommand(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	target := flags.String("target", "http://localhost:8080", "base URL of the proxy, recorded paths are appended to it")
+	apiKey := flags.String("api-key", os.Getenv("OPENAI_API_KEY"), "API key sent with every request")
+	speed := flags.Float64("speed", 1, "how many times faster than recorded to send the requests")
+	configPath := flags.String("config", "", "replay against an in-process proxy with this config, in front of a fake upstream, instead of -target")
+	mockLatency := flags.Duration("mock-latency", 0, "time the fake upstream takes to answer when running with -config")
+	logLevel := flags.String("log-level", "error", "proxy log level when running with -config")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 || *speed <= 0 {
+		fmt.Fprintln(os.Stderr, "usage: llproxy replay [flags] <access log>, with a positive -speed")
+		return 2
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %s\n", err)
+		return 1
+	}
+	defer file.Close()
+	records, err := readReplayRecords(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %s\n", err)
+		return 1
+	}
+
+	ConfigureLogging(LogType("console"), LogLevel(*logLevel))
+
+	config := ReplayConfig{Target: *target, APIKey: *apiKey, Speed: *speed}
+	if *configPath != "" {
+		proxy, closeProxy := startReplayProxy(LoadConfig(*configPath), *mockLatency)
+		defer closeProxy()
+		config.Target = proxy
+	}
+
+	result := runReplay(config, records)
+	result.Report(os.Stdout)
+	if len(records) > 0 {
+		rejected := recordedRejections(records)
+		fmt.Fprintf(os.Stdout, "recorded:  %d rejected (%.1f%%)\n", rejected, 100.0*float64(rejected)/float64(len(records)))
+	}
+	return 0
+}
+
+// readReplayRecords reads the access log lines of a JSON log, in the order their requests started.
+// Only requests for a model are kept, since the others can't be reconstructed.
+func readReplayRecords(r io.Reader) ([]ReplayRecord, error) {
+	var records []ReplayRecord
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var line struct {
+			Message          string    `json:"message"`
+			Timestamp        time.Time `json:"timestamp"`
+			Method           string    `json:"method"`
+			Path             string    `json:"path"`
+			Route            string    `json:"route"`
+			Model            string    `json:"model"`
+			Status           int       `json:"status"`
+			Duration         float64   `json:"duration"`
+			PromptTokens     int       `json:"promptTokens"`
+			CompletionTokens int       `json:"completionTokens"`
+		}
+		// Other log lines, and anything that isn't JSON, are skipped
+		if json.Unmarshal(scanner.Bytes(), &line) != nil || line.Message != "Access" {
+			continue
+		}
+		if line.Method != http.MethodPost || line.Model == "" {
+			continue
+		}
+
+		// Access lines are logged once a request is done
+		records = append(records, ReplayRecord{
+			Start:            line.Timestamp.Add(-time.Duration(line.Duration * float64(time.Second))),
+			Method:           line.Method,
+			Path:             line.Path,
+			Route:            line.Route,
+			Model:            line.Model,
+			Status:           line.Status,
+			PromptTokens:     line.PromptTokens,
+			CompletionTokens: line.CompletionTokens,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Start.Before(records[j].Start) })
+	return records, nil
+}
+
+// runReplay sends a request like each record at the same offset from the first as it was recorded at, divided by the speed
+func runReplay(config ReplayConfig, records []ReplayRecord) LoadTestResult {
+	target := strings.TrimSuffix(config.Target, "/")
+
+	var mu sync.Mutex
+	var result LoadTestResult
+	var wg sync.WaitGroup
+	client := &http.Client{}
+	start := time.Now()
+	for _, record := range records {
+		offset := time.Duration(float64(record.Start.Sub(records[0].Start)) / config.Speed)
+		time.Sleep(time.Until(start.Add(offset)))
+
+		wg.Add(1)
+		go func(record ReplayRecord) {
+			defer wg.Done()
+			status, latency, err := postJSON(client, target+record.Path, config.APIKey, replayBody(record))
+
+			mu.Lock()
+			result.Add(status, latency, err)
+			mu.Unlock()
+		}(record)
+	}
+	wg.Wait()
+	result.Elapsed = time.Since(start)
+
+	sort.Slice(result.Latencies, func(i, j int) bool { return result.Latencies[i] < result.Latencies[j] })
+	return result
+}
+
+// replayBody makes a request body of about the recorded size, roughly one token per word
+func replayBody(record ReplayRecord) map[string]any {
+	// Usage isn't recorded for every request, e.g. those that were rejected
+	promptTokens, completionTokens := record.PromptTokens, record.CompletionTokens
+	if promptTokens < 1 {
+		promptTokens = 1
+	}
+	if completionTokens < 1 {
+		completionTokens = 1
+	}
+
+	prompt := strings.TrimSpace(strings.Repeat("hello ", promptTokens))
+	switch {
+	case strings.HasSuffix(record.Path, "/embeddings"):
+		return map[string]any{"model": record.Model, "input": prompt}
+	case strings.HasSuffix(record.Path, "/chat/completions"):
+		return map[string]any{
+			"model":      record.Model,
+			"messages":   []map[string]string{{"role": "user", "content": prompt}},
+			"max_tokens": completionTokens,
+		}
+	}
+	return map[string]any{"model": record.Model, "prompt": prompt, "max_tokens": completionTokens}
+}
+
+func recordedRejections(records []ReplayRecord) int {
+	rejected := 0
+	for _, record := range records {
+		if record.Status == http.StatusTooManyRequests {
+			rejected++
+		}
+	}
+	return rejected
+}
+
+// startReplayProxy serves config's routes in-process with every route forwarding to a fake upstream,
+// returning the proxy's URL and a function to stop it
+func startReplayProxy(config Config, latency time.Duration) (string, func()) {
+	upstream := httptest.NewServer(mockUpstream(latency))
+	for route, routeConfig := range config.Routes {
+		routeConfig.Forward, routeConfig.Upstreams = upstream.URL, nil
+		config.Routes[route] = routeConfig
+	}
+
+	router := NewRouter()
+	for route, provider := range initProviders(&config) {
+		router.HandlePrefix("/"+route, nil, provider.GetHandler())
+	}
+	proxy := httptest.NewServer(router)
+	return proxy.URL, func() {
+		proxy.Close()
+		upstream.Close()
+	}
+}
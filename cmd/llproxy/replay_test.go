@@ -0,0 +1,62 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const replayLog = `{"severity":"INFO","timestamp":"2026-03-01T12:00:02Z","message":"Access","method":"POST","path":"/openai/v1/embeddings","status":200,"duration":1.5,"route":"openai","model":"text-embedding-ada-002","promptTokens":8}
+{"severity":"INFO","timestamp":"2026-03-01T12:00:01Z","message":"Scheduler Start"}
+not json at all
+{"severity":"INFO","timestamp":"2026-03-01T12:00:01Z","message":"Access","method":"GET","path":"/openai/v1/models","status":200,"duration":0.01,"route":"openai"}
+{"severity":"INFO","timestamp":"2026-03-01T12:00:01Z","message":"Access","method":"POST","path":"/openai/v1/embeddings","status":429,"duration":0,"route":"openai","model":"text-embedding-ada-002"}
+`
+
+func TestReadReplayRecords(t *testing.T) {
+	records, err := readReplayRecords(strings.NewReader(replayLog))
+	assert.NoError(t, err)
+	assert.Len(t, records, 2)
+
+	// Ordered by when the requests started rather than finished
+	start, _ := time.Parse(time.RFC3339, "2026-03-01T12:00:00.5Z")
+	assert.Equal(t, start, records[0].Start)
+	assert.Equal(t, 8, records[0].PromptTokens)
+	assert.Equal(t, 429, records[1].Status)
+	assert.Equal(t, 1, recordedRejections(records))
+}
+
+func TestReplay(t *testing.T) {
+	ConfigureLogging(LogType("console"), LogLevel("error"))
+	records, _ := readReplayRecords(strings.NewReader(replayLog))
+
+	proxy, closeProxy := startReplayProxy(Config{Routes: map[string]RouteConfig{
+		"openai": {Forward: "http://unused", Provider: "openai", Models: map[string]ModelConfig{
+			BENCHMARK_MODEL: {MaxQueueSize: 10, MaxQueueWait: 1, ReqsPerMinute: 600, TokensPerMinute: 100000},
+		}},
+	}}, 0)
+	defer closeProxy()
+
+	// Half a second apart when recorded, a twentieth at ten times the speed
+	result := runReplay(ReplayConfig{Target: proxy, Speed: 10}, records)
+	assert.Equal(t, 2, result.Requests)
+	assert.Equal(t, 2, result.Succeeded)
+	assert.Less(t, result.Elapsed, 500*time.Millisecond)
+}
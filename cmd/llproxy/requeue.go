@@ -0,0 +1,141 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Sent by OpenAI and Azure alongside Retry-After, with millisecond precision
+const HeaderRetryAfterMs = "retry-after-ms"
+
+// How long to back off when an upstream 429 doesn't say
+const defaultUpstreamRetryDelay = time.Second
+
+// requeueClient absorbs upstream 429s for a scheduled request. The scheduler is backed off for the delay the upstream
+// asked for, the request waits its turn in the queue again and is resent, up to retries times. It's admitted again by
+// the scope's shared pool and the route limit too when it went through them the first time.
+// If it can't be admitted again the upstream's 429 is passed on.
+type requeueClient struct {
+	client    HttpClient
+	scheduler *Scheduler
+	shared    []*Scheduler
+	tokens    float64
+	options   SubmitOptions
+	retries   int
+	body      []byte
+}
+
+// newRequeueClient buffers r's body so the request can be sent again
+func newRequeueClient(client HttpClient, scheduler *Scheduler, shared []*Scheduler, r *http.Request, tokens float64, options SubmitOptions, retries int) (*requeueClient, error) {
+	requeue := &requeueClient{
+		client:    client,
+		scheduler: scheduler,
+		shared:    shared,
+		tokens:    tokens,
+		options:   options,
+		retries:   retries,
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		requeue.body = body
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return requeue, nil
+}
+
+func (c *requeueClient) Do(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := c.client.Do(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || attempt >= c.retries {
+			return resp, err
+		}
+
+		// Hold on to the 429 in case the request can't be admitted again
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		delay := upstreamRetryDelay(resp.Header, body)
+		zap.S().Infow("Upstream rate limited, requeueing", "url", req.URL, "model", c.scheduler.Name, "attempt", attempt+1, "delay", delay)
+		c.scheduler.backOff(delay)
+		if rejected, _ := submitAll(req, append([]*Scheduler{c.scheduler}, c.shared...), c.tokens, c.options); rejected != nil {
+			return resp, nil
+		}
+
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(c.body))
+	}
+}
+
+// Azure OpenAI API versions that don't send Retry-After only say how long to wait in the message, e.g.
+// "... exceeded token rate limit of your current OpenAI S0 pricing tier. Please retry after 6 seconds."
+var azureRetryAfterMessage = regexp.MustCompile(`(?i)retry after (\d+(?:\.\d+)?) seconds?`)
+
+// upstreamRetryDelay reads how long an upstream asked us to wait before retrying, from the headers of its 429
+// or, failing those, the message in its body
+func upstreamRetryDelay(header http.Header, body []byte) time.Duration {
+	if ms, err := strconv.ParseFloat(header.Get(HeaderRetryAfterMs), 64); err == nil && ms > 0 {
+		return time.Duration(ms * float64(time.Millisecond))
+	}
+	if value := header.Get(HeaderRetryAfter); value != "" {
+		// Azure may send fractional seconds
+		if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+			return time.Duration(seconds * float64(time.Second))
+		}
+		if date, err := http.ParseTime(value); err == nil && time.Until(date) > 0 {
+			return time.Until(date)
+		}
+	}
+
+	// OpenAI's reset headers say when the exhausted limit recovers, as a duration like "6m0s" or, behind
+	// Azure API Management, in seconds
+	var delay time.Duration
+	for _, name := range []string{HeaderResetRequests, HeaderResetTokens} {
+		value := header.Get(name)
+		if reset, err := time.ParseDuration(value); err == nil && reset > delay {
+			delay = reset
+		} else if seconds, err := strconv.ParseFloat(value, 64); err == nil && time.Duration(seconds*float64(time.Second)) > delay {
+			delay = time.Duration(seconds * float64(time.Second))
+		}
+	}
+	if delay > 0 {
+		return delay
+	}
+
+	if match := azureRetryAfterMessage.FindSubmatch(body); match != nil {
+		if seconds, err := strconv.ParseFloat(string(match[1]), 64); err == nil && seconds > 0 {
+			return time.Duration(seconds * float64(time.Second))
+		}
+	}
+	return defaultUpstreamRetryDelay
+}
@@ -0,0 +1,129 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rateLimitedHttpClient answers with a 429 for the first limited requests
+type rateLimitedHttpClient struct {
+	limited int
+	bodies  []string
+}
+
+func (c *rateLimitedHttpClient) Do(req *http.Request) (*http.Response, error) {
+	body, _ := ioutil.ReadAll(req.Body)
+	c.bodies = append(c.bodies, string(body))
+	if len(c.bodies) <= c.limited {
+		return &http.Response{
+			StatusCode: http.StatusTooManyRequests,
+			Header:     http.Header{"Retry-After-Ms": []string{"200"}},
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"error": {"code": "rate_limit_exceeded"}}`)),
+		}, nil
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(bytes.NewBufferString("dummy completion")),
+	}, nil
+}
+
+func TestGetHandler_RequeueUpstreamRateLimit(t *testing.T) {
+	send := func(retries int, limited int) (*http.Response, *rateLimitedHttpClient, time.Duration) {
+		client := &rateLimitedHttpClient{limited: limited}
+		openai := NewOpenAI(&RouteConfig{
+			Forward:  FAKE_BASE_URL,
+			Provider: "openai",
+			Models: map[string]ModelConfig{
+				TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 600, TokensPerMinute: 600000, UpstreamRateLimitRetries: retries},
+			},
+		}, client)
+
+		body := fmt.Sprintf(`{"model": "%s", "prompt": "test"}`, TEST_MODEL)
+		req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/openai/v1/completions", bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		start := time.Now()
+		openai.GetHandler()(w, req)
+		return w.Result(), client, time.Since(start)
+	}
+
+	// Without retries the 429 is passed straight on
+	resp, client, _ := send(0, 1)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Len(t, client.bodies, 1)
+
+	// The request is sent again in full once the scheduler has backed off
+	resp, client, elapsed := send(2, 2)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, client.bodies, 3)
+	assert.Equal(t, client.bodies[0], client.bodies[2])
+	assert.GreaterOrEqual(t, elapsed, 400*time.Millisecond)
+
+	// Once the retries are used up the upstream's 429 is returned
+	resp, client, _ = send(1, 2)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Contains(t, string(body), "rate_limit_exceeded")
+	assert.Len(t, client.bodies, 2)
+}
+
+func TestGetHandler_RequeueRouteLimit(t *testing.T) {
+	client := &rateLimitedHttpClient{limited: 2}
+	openai := NewOpenAI(&RouteConfig{
+		Forward:  FAKE_BASE_URL,
+		Provider: "openai",
+		Models: map[string]ModelConfig{
+			TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 600, TokensPerMinute: 600000, UpstreamRateLimitRetries: 2},
+		},
+		RouteLimit: &RouteLimitConfig{MaxQueueSize: 1, MaxQueueWait: 0.1, ReqsPerMinute: 2, TokensPerMinute: 600000},
+	}, client)
+
+	// Requeued requests are admitted by the route limit again, which only has room for one retry
+	body := fmt.Sprintf(`{"model": "%s", "prompt": "test"}`, TEST_MODEL)
+	w := httptest.NewRecorder()
+	openai.GetHandler()(w, httptest.NewRequest(http.MethodPost, "http://localhost:8080/openai/v1/completions", bytes.NewBufferString(body)))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), "rate_limit_exceeded")
+	assert.Len(t, client.bodies, 2)
+
+	admitted, rejected := openai.routeLimit.scheduler.Counts()
+	assert.Equal(t, uint64(2), admitted)
+	assert.Equal(t, uint64(1), rejected)
+}
+
+func TestUpstreamRetryDelay(t *testing.T) {
+	assert.Equal(t, defaultUpstreamRetryDelay, upstreamRetryDelay(http.Header{}, nil))
+	assert.Equal(t, 3*time.Second, upstreamRetryDelay(http.Header{HeaderRetryAfter: []string{"3"}}, nil))
+	assert.Equal(t, 1500*time.Millisecond, upstreamRetryDelay(http.Header{HeaderRetryAfter: []string{"3"}, "Retry-After-Ms": []string{"1500"}}, nil))
+	assert.Equal(t, 6*time.Second, upstreamRetryDelay(http.Header{"X-Ratelimit-Reset-Requests": []string{"1s"}, "X-Ratelimit-Reset-Tokens": []string{"6s"}}, nil))
+}
+
+func TestUpstreamRetryDelay_Azure(t *testing.T) {
+	assert.Equal(t, 2500*time.Millisecond, upstreamRetryDelay(http.Header{HeaderRetryAfter: []string{"2.5"}}, nil))
+	assert.Equal(t, 12*time.Second, upstreamRetryDelay(http.Header{"X-Ratelimit-Reset-Tokens": []string{"12"}}, nil))
+	body := []byte(`{"error":{"code":"429","message":"Requests to the ChatCompletions_Create Operation under Azure OpenAI API version 2023-05-15 have exceeded token rate limit of your current OpenAI S0 pricing tier. Please retry after 7 seconds."}}`)
+	assert.Equal(t, 7*time.Second, upstreamRetryDelay(http.Header{}, body))
+	assert.Equal(t, 3*time.Second, upstreamRetryDelay(http.Header{HeaderRetryAfter: []string{"3"}}, body))
+}
@@ -0,0 +1,106 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// The route limit's scheduler is listed with this scope and model on the admin endpoints
+const (
+	routeLimitScope = "route"
+	routeLimitModel = "*"
+)
+
+// RouteLimitConfig caps the requests and tokens of all a route's models together, for providers whose
+// account-level limits are shared across models
+type RouteLimitConfig struct {
+	MaxQueueSize    int     `json:"maxQueueSize"`
+	MaxQueueWait    float64 `json:"maxQueueWait"`
+	ReqsPerMinute   float64 `json:"rpm"`
+	TokensPerMinute float64 `json:"tpm"`
+}
+
+func (c *RouteLimitConfig) validate() error {
+	if c.ReqsPerMinute <= 1 || c.TokensPerMinute <= 1 {
+		return fmt.Errorf("routeLimit needs rpm and tpm above 1")
+	}
+	if c.MaxQueueSize < 0 || c.MaxQueueWait < 0 {
+		return fmt.Errorf("routeLimit maxQueueSize and maxQueueWait can't be negative")
+	}
+	return nil
+}
+
+// routeLimit is a scheduler every request scheduled by model also has to be admitted by
+type routeLimit struct {
+	scheduler *Scheduler
+}
+
+func newRouteLimit(provider string, config *RouteLimitConfig) *routeLimit {
+	if config == nil {
+		return nil
+	}
+	schedulers := initScopedSchedulers(provider, routeLimitScope, map[string]ModelConfig{
+		routeLimitModel: {
+			MaxQueueSize:    config.MaxQueueSize,
+			MaxQueueWait:    config.MaxQueueWait,
+			ReqsPerMinute:   config.ReqsPerMinute,
+			TokensPerMinute: config.TokensPerMinute,
+		},
+	})
+	return &routeLimit{scheduler: schedulers[routeLimitModel]}
+}
+
+// Admit waits for the route to have capacity for a request its model's scheduler admitted, writing the error
+// response and returning false if it doesn't. The model's capacity, and that of any other schedulers that already
+// admitted the request, is given back when the route turns it away.
+func (l *routeLimit) Admit(w http.ResponseWriter, r *http.Request, model *Scheduler, tokens float64, options SubmitOptions, admitted ...*Scheduler) bool {
+	if l == nil {
+		return true
+	}
+	refund := func() {
+		model.refund(tokens)
+		for _, scheduler := range admitted {
+			if scheduler != nil {
+				scheduler.refund(tokens)
+			}
+		}
+	}
+	if tokens > l.scheduler.Limits().TokensPerMinute && !dryRunIgnores(r, model.Name, int(tokens), "RouteRequestTooLarge") {
+		refund()
+		routeLog(r.Context()).Debugw("Rejecting request", "url", r.URL, "model", model.Name, "tokens", tokens, "reason", "RouteRequestTooLarge")
+		writeRejection(w, http.StatusBadRequest, ErrTypeInvalidRequest, ErrCodeRequestTooLarge, RejectTooLarge, "Request too large for the route's limit")
+		return false
+	}
+	if response, reason := l.scheduler.SubmitWithReason(r, tokens, options); response != Ready {
+		refund()
+		routeLog(r.Context()).Debugw("Rejecting request", "url", r.URL, "model", model.Name, "tokens", tokens, "reason", "RouteRateLimit")
+		setRateLimitHeaders(w.Header(), l.scheduler)
+		setRetryAfter(w.Header(), l.scheduler, tokens)
+		writeRejection(w, http.StatusTooManyRequests, ErrTypeRequests, ErrCodeRateLimitExceeded, reason, "RateLimit exceeded for the route")
+		return false
+	}
+	return true
+}
+
+func (l *routeLimit) Schedulers() SchedulerMap {
+	if l == nil {
+		return nil
+	}
+	return SchedulerMap{routeLimitModel: l.scheduler}
+}
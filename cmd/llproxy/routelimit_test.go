@@ -0,0 +1,75 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteLimit(t *testing.T) {
+	openai := NewOpenAI(&RouteConfig{
+		Forward:  FAKE_BASE_URL,
+		Provider: "openai",
+		Models: map[string]ModelConfig{
+			TEST_MODEL:       {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60, TokensPerMinute: 60000},
+			"text-davinci-3": {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60, TokensPerMinute: 60000},
+		},
+		RouteLimit: &RouteLimitConfig{MaxQueueSize: 1, MaxQueueWait: 0.1, ReqsPerMinute: 2, TokensPerMinute: 60000},
+	}, &MockHttpClient{})
+	handler := openai.GetHandler()
+
+	send := func(model string) *httptest.ResponseRecorder {
+		body := []byte(fmt.Sprintf(`{"model": "%s", "prompt": "test", "max_tokens": 10}`, model))
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewBuffer(body)))
+		return w
+	}
+
+	// The route's rpm is shared by its models, each well within its own
+	assert.Equal(t, http.StatusOK, send(TEST_MODEL).Code)
+	assert.Equal(t, http.StatusOK, send("text-davinci-3").Code)
+	w := send(TEST_MODEL)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), "RateLimit exceeded for the route")
+	assert.NotEmpty(t, w.Header().Get(HeaderRetryAfter))
+
+	// The model's capacity for the rejected request was given back
+	assert.InDelta(t, 59, openai.Schedulers()[TEST_MODEL].Snapshot().RequestCapacity, 0.5)
+	admitted, _ := openai.Schedulers()[TEST_MODEL].Counts()
+	assert.Equal(t, uint64(1), admitted)
+
+	// Explanations show the route's limit turning the request away
+	explanation, err := openai.Explain(httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions",
+		bytes.NewBufferString(fmt.Sprintf(`{"model": "%s", "prompt": "test", "max_tokens": 10}`, TEST_MODEL))))
+	assert.NoError(t, err)
+	assert.Equal(t, OutcomeReject, explanation.Outcome)
+	assert.Equal(t, "RouteMaxQueueWait", explanation.Reason)
+
+	// The route's scheduler is listed with the others
+	var scoped []string
+	for _, schedulers := range openai.ScopedSchedulers() {
+		for model, scheduler := range schedulers {
+			scoped = append(scoped, scheduler.Scope+"/"+model)
+		}
+	}
+	assert.Equal(t, []string{"route/*"}, scoped)
+}
@@ -0,0 +1,132 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Middleware wraps a handler to add behavior before and/or after it runs
+type Middleware func(http.HandlerFunc) http.HandlerFunc
+
+type route struct {
+	pattern string
+	prefix  bool
+	methods map[string]bool
+	handler http.HandlerFunc
+}
+
+// Router is a small explicit router owned by a server. Unlike http.DefaultServeMux nothing can
+// register on it implicitly, and every route can carry its own method filter and middleware.
+type Router struct {
+	exact      map[string]*route
+	prefixes   []*route
+	middleware []Middleware
+}
+
+func NewRouter() *Router {
+	return &Router{
+		exact: make(map[string]*route),
+	}
+}
+
+// Use adds middleware that is applied to every route, including ones registered before the call
+func (rt *Router) Use(middleware ...Middleware) {
+	rt.middleware = append(rt.middleware, middleware...)
+}
+
+// Handle registers a handler for an exact path. A nil or empty methods list allows every method.
+func (rt *Router) Handle(pattern string, methods []string, handler http.HandlerFunc, middleware ...Middleware) {
+	rt.exact[pattern] = newRoute(pattern, false, methods, handler, middleware)
+}
+
+// HandlePrefix registers a handler for the path itself and every path beneath it, so
+// "/openai" matches "/openai" and "/openai/v1/chat/completions" but not "/openaiv1".
+func (rt *Router) HandlePrefix(prefix string, methods []string, handler http.HandlerFunc, middleware ...Middleware) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	rt.prefixes = append(rt.prefixes, newRoute(prefix, true, methods, handler, middleware))
+
+	// Longest prefix wins, so keep the most specific routes first
+	sort.SliceStable(rt.prefixes, func(i, j int) bool {
+		return len(rt.prefixes[i].pattern) > len(rt.prefixes[j].pattern)
+	})
+}
+
+func newRoute(pattern string, prefix bool, methods []string, handler http.HandlerFunc, middleware []Middleware) *route {
+	// Apply middleware in reverse so the first one listed is the outermost
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+
+	r := &route{
+		pattern: pattern,
+		prefix:  prefix,
+		handler: handler,
+	}
+	if len(methods) > 0 {
+		r.methods = make(map[string]bool)
+		for _, method := range methods {
+			r.methods[method] = true
+		}
+	}
+	return r
+}
+
+func (rt *Router) match(path string) *route {
+	if r, ok := rt.exact[path]; ok {
+		return r
+	}
+	for _, r := range rt.prefixes {
+		if path == r.pattern || strings.HasPrefix(path, r.pattern+"/") {
+			return r
+		}
+	}
+	return nil
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handler := rt.dispatch
+
+	// Apply the global middleware in reverse so the first one listed is the outermost
+	for i := len(rt.middleware) - 1; i >= 0; i-- {
+		handler = rt.middleware[i](handler)
+	}
+	handler(w, r)
+}
+
+func (rt *Router) dispatch(w http.ResponseWriter, r *http.Request) {
+	route := rt.match(r.URL.Path)
+	if route == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if route.methods != nil && !route.methods[r.Method] {
+		allowed := make([]string, 0, len(route.methods))
+		for method := range route.methods {
+			allowed = append(allowed, method)
+		}
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	route.handler(w, r)
+}
@@ -0,0 +1,107 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func respondWith(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}
+}
+
+func routeRequest(router *Router, method string, path string) (int, string, http.Header) {
+	req := httptest.NewRequest(method, "http://localhost:8080"+path, nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body), resp.Header
+}
+
+func TestRouter_PrefixMatching(t *testing.T) {
+	router := NewRouter()
+	router.HandlePrefix("/openai", nil, respondWith("openai"))
+	router.HandlePrefix("/openai/v1/special", nil, respondWith("special"))
+	router.Handle("/models", nil, respondWith("models"))
+
+	status, body, _ := routeRequest(router, "POST", "/openai")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "openai", body)
+
+	_, body, _ = routeRequest(router, "POST", "/openai/v1/chat/completions")
+	assert.Equal(t, "openai", body)
+
+	_, body, _ = routeRequest(router, "POST", "/openai/v1/special/thing")
+	assert.Equal(t, "special", body)
+
+	_, body, _ = routeRequest(router, "GET", "/models")
+	assert.Equal(t, "models", body)
+
+	status, _, _ = routeRequest(router, "POST", "/openaiv1/chat/completions")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, _, _ = routeRequest(router, "GET", "/models/extra")
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestRouter_MethodFiltering(t *testing.T) {
+	router := NewRouter()
+	router.Handle("/healthz", []string{http.MethodGet, http.MethodHead}, respondWith("OK"))
+
+	status, body, _ := routeRequest(router, "GET", "/healthz")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "OK", body)
+
+	status, _, header := routeRequest(router, "POST", "/healthz")
+	assert.Equal(t, http.StatusMethodNotAllowed, status)
+	assert.Equal(t, "GET, HEAD", header.Get("Allow"))
+}
+
+func TestRouter_Middleware(t *testing.T) {
+	tag := func(name string) Middleware {
+		return func(next http.HandlerFunc) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("X-Order", name)
+				next(w, r)
+			}
+		}
+	}
+
+	router := NewRouter()
+	router.Use(tag("global"))
+	router.HandlePrefix("/a", nil, respondWith("a"), tag("first"), tag("second"))
+	router.HandlePrefix("/b", nil, respondWith("b"))
+
+	_, _, header := routeRequest(router, "GET", "/a/path")
+	assert.Equal(t, []string{"global", "first", "second"}, header.Values("X-Order"))
+
+	_, _, header = routeRequest(router, "GET", "/b")
+	assert.Equal(t, []string{"global"}, header.Values("X-Order"))
+
+	// Global middleware also sees requests that don't match any route
+	status, _, header := routeRequest(router, "GET", "/missing")
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, []string{"global"}, header.Values("X-Order"))
+}
@@ -0,0 +1,221 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// HeaderModelSubstitution tells the client its request was sent to another model, e.g. "gpt-4 -> gpt-4-32k"
+const HeaderModelSubstitution = "X-LLProxy-Model-Substitution"
+
+// RoutingRuleConfig sends requests matching its conditions to another model, upstream, or both
+type RoutingRuleConfig struct {
+	Match    RoutingMatch `json:"match"`
+	Model    string       `json:"model"`
+	Upstream string       `json:"upstream"`
+
+	// Variants of a model with different context windows, cheapest first. Requests for any of them are sent to
+	// the first whose contextWindow they fit, or the last if none does.
+	ContextVariants []string `json:"contextVariants"`
+}
+
+// RoutingMatch holds the conditions of a rule, all of those set must hold for it to match
+type RoutingMatch struct {
+	// Models the request asks for, any when empty
+	Models []string `json:"models"`
+
+	// Prompts of at least this many tokens, the longest counting for a batch of prompts
+	MinPromptTokens int `json:"minPromptTokens"`
+
+	// Whether the request offers the model tools or functions to call
+	Tools *bool `json:"tools"`
+
+	Stream *bool `json:"stream"`
+}
+
+func (c *RoutingRuleConfig) validate(models map[string]ModelConfig) error {
+	if len(c.ContextVariants) > 0 {
+		if c.Model != "" || len(c.ContextVariants) < 2 {
+			return fmt.Errorf("routing rule needs at least two contextVariants, and no model")
+		}
+		for i, variant := range c.ContextVariants {
+			config, ok := models[variant]
+			if !ok {
+				return fmt.Errorf("routing rule has context variant '%s', which isn't configured", variant)
+			}
+			if i < len(c.ContextVariants)-1 && config.ContextWindow <= 0 {
+				return fmt.Errorf("routing rule has context variant '%s' without a contextWindow", variant)
+			}
+		}
+		return nil
+	}
+	if c.Model == "" && c.Upstream == "" {
+		return fmt.Errorf("routing rule has neither a model nor an upstream")
+	}
+	if _, ok := models[c.Model]; c.Model != "" && !ok {
+		return fmt.Errorf("routing rule sends requests to model '%s', which isn't configured", c.Model)
+	}
+	return nil
+}
+
+// routingRule is a rule along with the upstream it sends requests to, nil to keep the route's
+type routingRule struct {
+	config   RoutingRuleConfig
+	upstream *UpstreamHealth
+
+	// Context windows of the rule's variants
+	windows []int
+}
+
+// routingRules picks where requests go by what they ask for, the first matching rule applying.
+// A nil routingRules leaves requests where they are.
+type routingRules []*routingRule
+
+func newRoutingRules(config []RoutingRuleConfig, models map[string]ModelConfig) routingRules {
+	if len(config) == 0 {
+		return nil
+	}
+	rules := make(routingRules, 0, len(config))
+	for _, ruleConfig := range config {
+		rule := &routingRule{config: ruleConfig}
+		if ruleConfig.Upstream != "" {
+			rule.upstream = NewUpstreamHealth(ruleConfig.Upstream)
+		}
+		for _, variant := range ruleConfig.ContextVariants {
+			rule.windows = append(rule.windows, models[variant].ContextWindow)
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// Apply finds the first rule the request matches, returning nil if there is none. If the rule sends it to another model
+// the request's body is rewritten to ask for it and that model is returned, and the request has to be parsed again.
+func (rules routingRules) Apply(r *http.Request, model string, request Request) (*routingRule, string, error) {
+	if rules == nil || model == "" {
+		return nil, "", nil
+	}
+	switch request.(type) {
+	case *ChatCompletionRequest, *CompletionRequest, *EmbeddingRequest:
+	default:
+		return nil, "", nil
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, "", err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil || fields == nil {
+		return nil, "", nil
+	}
+
+	for i, rule := range rules {
+		if !rule.matches(model, request, fields) {
+			continue
+		}
+		target := rule.model(request)
+		zap.S().Debugw("Routing request", "url", r.URL, "model", model, "rule", i, "to", target, "upstream", rule.config.Upstream)
+		if target == "" || target == model {
+			return rule, "", nil
+		}
+
+		fields["model"], _ = json.Marshal(target)
+		if body, err = json.Marshal(fields); err != nil {
+			return nil, "", err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		return rule, target, nil
+	}
+	return nil, "", nil
+}
+
+// model returns the model the rule sends the request to, empty to keep the one it asked for
+func (rule *routingRule) model(request Request) string {
+	if len(rule.config.ContextVariants) == 0 {
+		return rule.config.Model
+	}
+	last := len(rule.config.ContextVariants) - 1
+	prompt, completion, ok := contextLength(request)
+	if !ok {
+		return ""
+	}
+	for i, window := range rule.windows[:last] {
+		if prompt+completion <= window {
+			return rule.config.ContextVariants[i]
+		}
+	}
+	return rule.config.ContextVariants[last]
+}
+
+// modelSubstitutionHook tells the client which model its request was sent to in place of the one it asked for
+func modelSubstitutionHook(requested string, model string) ResponseHook {
+	substitution := requested + " -> " + model
+	return func(resp *http.Response) {
+		resp.Header.Set(HeaderModelSubstitution, substitution)
+	}
+}
+
+func (rule *routingRule) matches(model string, request Request, fields map[string]json.RawMessage) bool {
+	match := rule.config.Match
+	if len(rule.config.ContextVariants) > 0 && !containsString(rule.config.ContextVariants, model) {
+		return false
+	}
+	if len(match.Models) > 0 && !containsString(match.Models, model) {
+		return false
+	}
+	if match.Tools != nil {
+		if *match.Tools != (offersList(fields["tools"]) || offersList(fields["functions"])) {
+			return false
+		}
+	}
+	if match.Stream != nil && *match.Stream != isStream(request) {
+		return false
+	}
+	if match.MinPromptTokens > 0 {
+		if prompt, _, ok := contextLength(request); !ok || prompt < match.MinPromptTokens {
+			return false
+		}
+	}
+	return true
+}
+
+// offersList is whether a field is a non-empty array, clients sending `"tools": []` or null offering none
+func offersList(field json.RawMessage) bool {
+	var list []json.RawMessage
+	return json.Unmarshal(field, &list) == nil && len(list) > 0
+}
+
+// Upstream returns the upstream the rule sends requests to, or the route's choice when it doesn't name one
+func (rule *routingRule) Upstream(selected *UpstreamHealth) *UpstreamHealth {
+	if rule == nil || rule.upstream == nil {
+		return selected
+	}
+	return rule.upstream
+}
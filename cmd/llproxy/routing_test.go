@@ -0,0 +1,125 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// routedHttpClient records where each request was sent and what it asked for
+type routedHttpClient struct {
+	urls   []string
+	bodies []string
+}
+
+func (c *routedHttpClient) Do(req *http.Request) (*http.Response, error) {
+	body, _ := ioutil.ReadAll(req.Body)
+	c.urls = append(c.urls, req.URL.String())
+	c.bodies = append(c.bodies, string(body))
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(bytes.NewBufferString("{}")),
+	}, nil
+}
+
+func TestRoutingRules(t *testing.T) {
+	yes := true
+	limits := ModelConfig{MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60, TokensPerMinute: 60000}
+	config := &RouteConfig{
+		Forward:  FAKE_BASE_URL,
+		Provider: "openai",
+		Models:   map[string]ModelConfig{TEST_MODEL: limits, "gpt-3.5-turbo-16k": limits},
+		RoutingRules: []RoutingRuleConfig{
+			{Match: RoutingMatch{Models: []string{TEST_MODEL}, MinPromptTokens: 1000}, Model: "gpt-3.5-turbo-16k"},
+			{Match: RoutingMatch{Tools: &yes}, Upstream: "https://tools.example.com"},
+		},
+	}
+	require.NoError(t, config.RoutingRules[0].validate(config.Models))
+	assert.Error(t, (&RoutingRuleConfig{Model: "gpt-4"}).validate(config.Models))
+	assert.Error(t, (&RoutingRuleConfig{}).validate(config.Models))
+
+	client := &routedHttpClient{}
+	openai := NewOpenAI(config, client)
+	handler := openai.GetHandler()
+	send := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewBufferString(body)))
+		assert.Equal(t, http.StatusOK, w.Code)
+		return w
+	}
+
+	// Short prompts without tools stay where they are
+	w := send(`{"model": "gpt-3.5-turbo", "prompt": "Hello"}`)
+	assert.Equal(t, FAKE_BASE_URL+"/v1/completions", client.urls[0])
+	assert.Contains(t, client.bodies[0], `"model": "gpt-3.5-turbo"`)
+	assert.Empty(t, w.Header().Get(HeaderModelSubstitution))
+
+	// Long prompts are sent to the long context model, and scheduled against it
+	w = send(`{"model": "gpt-3.5-turbo", "prompt": "` + strings.Repeat("a", 4000) + `"}`)
+	assert.Contains(t, client.bodies[1], `"model":"gpt-3.5-turbo-16k"`)
+	assert.Equal(t, "gpt-3.5-turbo -> gpt-3.5-turbo-16k", w.Header().Get(HeaderModelSubstitution))
+	admitted, _ := openai.schedulers["gpt-3.5-turbo-16k"].Counts()
+	assert.Equal(t, uint64(1), admitted)
+
+	// Requests with tools go to the upstream that supports them
+	send(`{"model": "gpt-3.5-turbo", "prompt": "Hello", "tools": [{"type": "function", "function": {"name": "lookup"}}]}`)
+	assert.Equal(t, "https://tools.example.com/v1/completions", client.urls[2])
+	assert.Contains(t, client.bodies[2], `"model": "gpt-3.5-turbo"`)
+
+	// An empty or null list offers none
+	send(`{"model": "gpt-3.5-turbo", "prompt": "Hello", "tools": [], "functions": null}`)
+	assert.Equal(t, FAKE_BASE_URL+"/v1/completions", client.urls[3])
+}
+
+func TestRoutingContextVariants(t *testing.T) {
+	limits := ModelConfig{MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60, TokensPerMinute: 60000}
+	small, large := limits, limits
+	small.ContextWindow, large.ContextWindow = 1000, 16000
+	config := &RouteConfig{
+		Forward:      FAKE_BASE_URL,
+		Provider:     "openai",
+		Models:       map[string]ModelConfig{TEST_MODEL: small, "gpt-3.5-turbo-16k": large},
+		RoutingRules: []RoutingRuleConfig{{ContextVariants: []string{TEST_MODEL, "gpt-3.5-turbo-16k"}}},
+	}
+	require.NoError(t, config.RoutingRules[0].validate(config.Models))
+	assert.Error(t, (&RoutingRuleConfig{ContextVariants: []string{"gpt-3.5-turbo-16k", TEST_MODEL}}).validate(map[string]ModelConfig{TEST_MODEL: small, "gpt-3.5-turbo-16k": limits}))
+
+	client := &routedHttpClient{}
+	handler := NewOpenAI(config, client).GetHandler()
+	send := func(model string, promptChars int) string {
+		w := httptest.NewRecorder()
+		body := `{"model": "` + model + `", "prompt": "` + strings.Repeat("a", promptChars) + `", "max_tokens": 100}`
+		handler(w, httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewBufferString(body)))
+		assert.Equal(t, http.StatusOK, w.Code)
+		return w.Header().Get(HeaderModelSubstitution)
+	}
+
+	// Requests are moved up to the long context model only when they don't fit, and back down when they do
+	assert.Empty(t, send(TEST_MODEL, 3600))
+	assert.Equal(t, "gpt-3.5-turbo -> gpt-3.5-turbo-16k", send(TEST_MODEL, 4000))
+	assert.Equal(t, "gpt-3.5-turbo-16k -> gpt-3.5-turbo", send("gpt-3.5-turbo-16k", 400))
+	assert.Empty(t, send("gpt-3.5-turbo-16k", 40000))
+	assert.Contains(t, client.bodies[1], `"model":"gpt-3.5-turbo-16k"`)
+}
@@ -16,9 +16,12 @@ limitations under the License.
 package main
 
 import (
+	"container/heap"
 	"math"
 	"net/http"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -32,44 +35,193 @@ const (
 	RequestTooLarge
 )
 
+// What a scheduler does with a request when there is no capacity for it right now
+const (
+	// Queue it unless the wait would exceed maxQueueWait or the queue is full
+	QueueModeQueue = "queue"
+	// Reject it straight away, so clients can fall back quickly
+	QueueModeReject = "reject"
+	// Queue it unless shedDepth requests are already queued, however long the wait
+	QueueModeShed = "shed-above-depth"
+)
+
 type ScheduledRequest struct {
 	Request               *http.Request
 	ResponseChannel       chan Response
 	RequiredTokenCapacity float64
+
+	// Higher priority requests are admitted first, and requests of equal priority in arrival order
+	Priority int
+	ticket   uint64
+
+	// Requests gain priority as they wait, and once overdue go ahead of everything but earlier overdue requests
+	queued  monoTime
+	boost   int
+	overdue bool
+}
+
+// SubmitOptions are the optional parts of submitting a request
+type SubmitOptions struct {
+	Priority int
+	Observer *QueueObserver
+
+	// Reject rather than queue when there's no capacity right now
+	NoQueue bool
+
+	// Reject rather than queue when the projected wait is longer, in seconds, e.g. most of the client's timeout
+	MaxWait float64
+}
+
+// requestQueue is a heap of waiting requests, most urgent first
+type requestQueue []*ScheduledRequest
+
+func (q requestQueue) Len() int { return len(q) }
+
+func (q requestQueue) Less(i, j int) bool {
+	if q[i].overdue != q[j].overdue {
+		return q[i].overdue
+	}
+	if !q[i].overdue {
+		if pi, pj := q[i].Priority+q[i].boost, q[j].Priority+q[j].boost; pi != pj {
+			return pi > pj
+		}
+	}
+	return q[i].ticket < q[j].ticket
+}
+
+func (q requestQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *requestQueue) Push(x any) { *q = append(*q, x.(*ScheduledRequest)) }
+
+func (q *requestQueue) Pop() any {
+	old := *q
+	request := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return request
 }
 
+// QueueStatus is where a waiting request is in its scheduler's queue, position 1 being the next to be admitted
+type QueueStatus struct {
+	Model    string  `json:"model"`
+	Position int     `json:"position"`
+	ETA      float64 `json:"eta"`
+}
+
+// QueueObserver is told a queued request's status every Interval while it waits
+type QueueObserver struct {
+	Interval time.Duration
+	Observe  func(QueueStatus)
+}
+
+// Clients can look up the status of their queued requests by the id they sent in HeaderQueueRequestID
+var queuedRequests sync.Map
+
+// A Scheduler admits requests for a single model. Capacity is a token bucket for requests and tokens,
+// held in an immutable CapacitySnapshot that is replaced with compare-and-swap. When capacity is
+// available and nothing is queued a request is admitted immediately by the caller's goroutine,
+// otherwise it joins the queue which the scheduler's own goroutine serves by priority and then in order.
 type Scheduler struct {
-	Config          ModelConfig
-	Provider        string
-	Name            string
-	Requests        chan ScheduledRequest
-	Mu              sync.Mutex
-	LastReqTime     time.Time
+	Config   ModelConfig
+	Provider string
+	Name     string
+	Scope    string
+	Requests chan ScheduledRequest
+	state    atomic.Pointer[CapacitySnapshot]
+	limits   atomic.Pointer[SchedulerLimits]
+	share    atomic.Pointer[float64] // of the limits this replica takes when sharing them with peers, all of them when nil
+	started  monoTime
+	now      func() monoTime // the clock capacity is accounted on, monoNow unless a test steps its own
+	lastLoop atomic.Int64    // monoTime of the run loop's last iteration
+
+	// Expected response tokens for requests that don't set max_tokens
+	responseTokens *responseTokenEstimate
+
+	// Totals since startup, for the admin endpoints
+	admitted atomic.Uint64
+	rejected atomic.Uint64
+
+	// What was admitted over the last minute
+	throughput throughputWindow
+
+	// Admitted requests that were over a soft limit
+	overSoftLimit atomic.Uint64
+
+	// Whether the scheduler is paused or draining, and a signal to its run loop when that changes
+	admission atomic.Value
+	wake      chan struct{}
+
+	// The last ticket handed to a queued request, and the queued tickets in the order they'll be admitted
+	tickets atomic.Uint64
+	order   atomic.Pointer[[]uint64]
+}
+
+// CapacitySnapshot is a consistent copy of a scheduler's capacity state
+type CapacitySnapshot struct {
 	RequestCapacity float64
 	TokenCapacity   float64
+	QueuedRequests  int
+	QueuedTokens    float64
+	updated         monoTime
+
+	// When pacing, the earliest the next request may be admitted
+	paced monoTime
+}
+
+// SchedulerLimits are the rates a scheduler's capacity recovers at, starting from its config
+type SchedulerLimits struct {
+	ReqsPerMinute   float64 `json:"rpm"`
+	TokensPerMinute float64 `json:"tpm"`
 }
 
 type SchedulerMap map[string]*Scheduler
 
+// While ramping up capacity recovers at no less than this fraction of the limits
+const minimumRampRate = 0.05
+
 func initSchedulers(provider string, config map[string]ModelConfig) SchedulerMap {
+	return initScopedSchedulers(provider, "", config)
+}
+
+// initScopedSchedulers starts schedulers with capacity of their own for a scope, such as an OpenAI organization
+func initScopedSchedulers(provider string, scope string, config map[string]ModelConfig) SchedulerMap {
 	var schedulers = make(SchedulerMap)
 
 	for name, schedulerConfig := range config {
-		schedulers[name] = &Scheduler{
-			Config:          schedulerConfig,
-			Provider:        provider,
-			Name:            name,
-			Requests:        make(chan ScheduledRequest, schedulerConfig.MaxQueueSize),
-			LastReqTime:     time.Now(),
-			RequestCapacity: schedulerConfig.ReqsPerMinute,
-			TokenCapacity:   schedulerConfig.TokensPerMinute,
-		}
+		schedulers[name] = NewScheduler(provider, name, schedulerConfig)
+		schedulers[name].Scope = scope
 		go schedulers[name].run()
 	}
 
 	return schedulers
 }
 
+func NewScheduler(provider string, name string, config ModelConfig) *Scheduler {
+	scheduler := &Scheduler{
+		Config:   config,
+		Provider: provider,
+		Name:     name,
+		Requests: make(chan ScheduledRequest, config.MaxQueueSize),
+		wake:     make(chan struct{}, 1),
+
+		responseTokens: newResponseTokenEstimate(config),
+	}
+	scheduler.limits.Store(&SchedulerLimits{ReqsPerMinute: config.ReqsPerMinute, TokensPerMinute: config.TokensPerMinute})
+
+	// Starting with less than full capacity avoids sending a burst upstream after a restart
+	fill := 1.0
+	if config.InitialFill != nil {
+		fill = *config.InitialFill
+	}
+	scheduler.now = monoNow
+	scheduler.started = scheduler.now()
+	scheduler.state.Store(&CapacitySnapshot{
+		RequestCapacity: config.ReqsPerMinute * fill,
+		TokenCapacity:   config.TokensPerMinute * fill,
+		updated:         scheduler.started,
+	})
+	return scheduler
+}
+
 func (scheduler *Scheduler) run() {
 
 	// Don't allow startup if a config is too low for the scheduler to operate
@@ -91,74 +243,606 @@ func (scheduler *Scheduler) run() {
 	// A scheduler's task is to rate limit incoming calls
 	zap.S().Infow("Scheduler Start", "provider", scheduler.Provider, "scheduler", scheduler.Name, "rpm", scheduler.Config.ReqsPerMinute, "tpm", scheduler.Config.TokensPerMinute)
 
+	const epsilon = 0.1
+	queue := &requestQueue{}
 	for {
-		// Wait for the next active request to come in
-		var request *ScheduledRequest
-		select {
-		case req := <-scheduler.Requests:
-			request = &req
+		scheduler.lastLoop.Store(int64(scheduler.now()))
+
+		// With nothing waiting, block until a request comes in
+		if queue.Len() == 0 {
+			scheduler.publishOrder(nil)
+			select {
+			case req := <-scheduler.Requests:
+				heap.Push(queue, &req)
+
+			case <-time.After(time.Second * 2.0):
+				// If there's no request after 2 seconds report our capacity, then resume waiting
+				snapshot := scheduler.Snapshot()
+				zap.S().Debugw("Scheduler Capacity", "provider", scheduler.Provider, "scheduler", scheduler.Name, "tokens", snapshot.TokenCapacity, "requests", snapshot.RequestCapacity)
+				continue
+			}
+		}
+
+		// Take in everything else that has arrived, so the most urgent request is served next
+		scheduler.drain(queue)
+		scheduler.age(queue, scheduler.now())
+		scheduler.publishOrder(*queue)
 
-		case <-time.After(time.Second * 2.0):
-			// If there's no request after 2 seconds go ahead and update our capacity, then resume waiting
-			scheduler.updateCapacity()
+		// While shutting down queued requests may be turned away rather than waited for
+		if queuesClosed.Load() {
+			for queue.Len() > 0 {
+				request := heap.Pop(queue).(*ScheduledRequest)
+				routeLog(request.Request.Context()).Debugw("Rejecting request", "url", request.Request.URL, "tokens", request.RequiredTokenCapacity, "reason", "ShuttingDown")
+				scheduler.addQueued(-1, -request.RequiredTokenCapacity)
+				request.ResponseChannel <- RateLimit
+			}
 			continue
 		}
 
+		// Paused schedulers hold on to their queue until they're resumed
+		if scheduler.State() == SchedulerPaused {
+			select {
+			case req := <-scheduler.Requests:
+				heap.Push(queue, &req)
+			case <-scheduler.wake:
+			case <-time.After(2 * time.Second):
+			}
+			continue
+		}
+		request := (*queue)[0]
+
 		// Requests that are too large should have been filtered out before now, but this ensures we'll never wait forever
-		if request.RequiredTokenCapacity > scheduler.Config.TokensPerMinute {
-			zap.S().Debugw("Rejecting request", "url", request.Request.URL, "tokens", request.RequiredTokenCapacity, "reason", "RequestTooLarge")
+		if request.RequiredTokenCapacity > scheduler.Limits().TokensPerMinute {
+			heap.Pop(queue)
+			routeLog(request.Request.Context()).Debugw("Rejecting request", "url", request.Request.URL, "tokens", request.RequiredTokenCapacity, "reason", "RequestTooLarge")
+			scheduler.addQueued(-1, -request.RequiredTokenCapacity)
 			request.ResponseChannel <- RequestTooLarge
 			continue
 		}
 
-		// We have a request, wait until we have sufficient capacity
-		scheduler.waitForCapacity(request)
+		// If there's capacity allocate it to the request and send a signal back to the caller that it can proceed
+		capacityTime := scheduler.acquireQueued(request)
+		if capacityTime == 0 {
+			heap.Pop(queue)
+			routeLog(request.Request.Context()).Infow("Handling request", "url", request.Request.URL, "tokens", request.RequiredTokenCapacity, "priority", request.Priority)
+			request.ResponseChannel <- Ready
+			continue
+		}
 
-		// Allocate capacity to our request and prepare for our next request
-		zap.S().Infow("Handling request", "url", request.Request.URL, "tokens", request.RequiredTokenCapacity)
-		scheduler.TokenCapacity -= request.RequiredTokenCapacity
-		scheduler.RequestCapacity -= 1
+		// A large request waiting for capacity outside the reserve mustn't hold up small ones that fit now
+		if scheduler.admitSmall(queue) {
+			continue
+		}
 
-		// Send a signal back to the caller that the request can proceed
-		request.ResponseChannel <- Ready
+		// Otherwise sleep for between epsilon and 2 seconds, depending on how much capacity we need
+		// This keeps the capacity numbers close to actual capacity for our metrics
+		// A new arrival wakes us early, since it may be more urgent than the current head of the queue
+		var sleepTime = time.Duration(math.Min(2.0, capacityTime*60.0+epsilon) * float64(time.Second))
+		select {
+		case req := <-scheduler.Requests:
+			heap.Push(queue, &req)
+		case <-time.After(sleepTime):
+		}
 	}
 }
 
-func (scheduler *Scheduler) updateCapacity() {
-	now := time.Now()
-	if scheduler.TokenCapacity < scheduler.Config.TokensPerMinute || scheduler.RequestCapacity < scheduler.Config.ReqsPerMinute {
-		elapsed := now.Sub(scheduler.LastReqTime).Minutes()
-		tokenCapacity := scheduler.TokenCapacity + elapsed*float64(scheduler.Config.TokensPerMinute)
-		requestCapacity := scheduler.RequestCapacity + elapsed*float64(scheduler.Config.ReqsPerMinute)
+// LastLoop is when the scheduler's run loop last went round, the zero time if it hasn't started.
+// An idle loop still goes round every two seconds.
+func (scheduler *Scheduler) LastLoop() time.Time {
+	if nanos := scheduler.lastLoop.Load(); nanos != 0 {
+		return monoTime(nanos).Time()
+	}
+	return time.Time{}
+}
 
-		scheduler.TokenCapacity = math.Min(tokenCapacity, scheduler.Config.TokensPerMinute)
-		scheduler.RequestCapacity = math.Min(requestCapacity, scheduler.Config.ReqsPerMinute)
+// publishOrder records the queued requests' tickets, most urgent first, for queueStatus
+func (scheduler *Scheduler) publishOrder(queue requestQueue) {
+	ordered := append(requestQueue(nil), queue...)
+	sort.Sort(ordered)
+	order := make([]uint64, len(ordered))
+	for i, request := range ordered {
+		order[i] = request.ticket
+	}
+	scheduler.order.Store(&order)
+}
 
-		zap.S().Debugw("Scheduler Capacity", "provider", scheduler.Provider, "scheduler", scheduler.Name, "tokens", scheduler.TokenCapacity, "requests", scheduler.RequestCapacity)
+// drain moves every request waiting in the channel onto the queue without blocking
+func (scheduler *Scheduler) drain(queue *requestQueue) {
+	for {
+		select {
+		case req := <-scheduler.Requests:
+			heap.Push(queue, &req)
+		default:
+			return
+		}
 	}
-	scheduler.LastReqTime = now
+}
 
+// Submit admits a request, blocking until it may proceed or is rejected.
+// Requests are rejected with RateLimit when the queue is full, or when the projected wait exceeds MaxQueueWait.
+func (scheduler *Scheduler) Submit(r *http.Request, tokens float64) Response {
+	return scheduler.SubmitWith(r, tokens, SubmitOptions{})
 }
 
-func (scheduler *Scheduler) waitForCapacity(request *ScheduledRequest) {
-	const epsilon = 0.1
+// SubmitWith is Submit with a priority, and optionally reporting the request's queue status to an observer while it waits
+func (scheduler *Scheduler) SubmitWith(r *http.Request, tokens float64, options SubmitOptions) Response {
+	response, _ := scheduler.SubmitWithReason(r, tokens, options)
+	return response
+}
+
+// SubmitWithReason is SubmitWith also returning why the request was rejected, empty when it's Ready
+func (scheduler *Scheduler) SubmitWithReason(r *http.Request, tokens float64, options SubmitOptions) (Response, RejectReason) {
+	if dryRun.Load() {
+		return scheduler.dryRunSubmit(r, tokens)
+	}
+	response, reason := scheduler.submit(r, tokens, options)
+	if response == Ready {
+		scheduler.admitted.Add(1)
+		scheduler.throughput.Add(scheduler.now(), 1, tokens)
+	} else {
+		scheduler.rejected.Add(1)
+	}
+	return response, reason
+}
+
+func (scheduler *Scheduler) submit(r *http.Request, tokens float64, options SubmitOptions) (Response, RejectReason) {
+	state := scheduler.State()
+	if state == SchedulerDraining {
+		routeLog(r.Context()).Debugw("Rejecting request", "url", r.URL, "scheduler", scheduler.Name, "tokens", tokens, "reason", "Draining")
+		return RateLimit, RejectRateLimited
+	}
+
+	// Fast path, nothing is queued ahead of us and there is capacity now
+	if state != SchedulerPaused && scheduler.tryAcquire(tokens) {
+		routeLog(r.Context()).Infow("Handling request", "url", r.URL, "tokens", tokens)
+		return Ready, ""
+	}
+
+	if options.NoQueue {
+		routeLog(r.Context()).Debugw("Rejecting request", "url", r.URL, "scheduler", scheduler.Name, "tokens", tokens, "reason", "NoQueue")
+		return RateLimit, RejectRateLimited
+	}
+
+	switch scheduler.Config.QueueMode {
+	case QueueModeReject:
+		routeLog(r.Context()).Debugw("Rejecting request", "url", r.URL, "scheduler", scheduler.Name, "tokens", tokens, "reason", "NoCapacity")
+		return RateLimit, RejectRateLimited
+	case QueueModeShed:
+		// Only the queue's depth decides, however long the wait
+	default:
+		if scheduler.Config.MaxQueueWait > 0 && scheduler.WaitEstimate(tokens) > scheduler.Config.MaxQueueWait {
+			routeLog(r.Context()).Debugw("Rejecting request", "url", r.URL, "scheduler", scheduler.Name, "tokens", tokens, "reason", "MaxQueueWait")
+			return RateLimit, RejectDeadlineExceeded
+		}
+	}
+	if options.MaxWait > 0 && scheduler.WaitEstimate(tokens) > options.MaxWait {
+		routeLog(r.Context()).Debugw("Rejecting request", "url", r.URL, "scheduler", scheduler.Name, "tokens", tokens, "reason", "ClientTimeout")
+		return RateLimit, RejectDeadlineExceeded
+	}
+
+	if queuesClosed.Load() {
+		routeLog(r.Context()).Debugw("Rejecting request", "url", r.URL, "scheduler", scheduler.Name, "tokens", tokens, "reason", "ShuttingDown")
+		return RateLimit, RejectRateLimited
+	}
+
+	// Count ourselves as queued before joining the queue, so the fast path can't overtake us
+	if !scheduler.joinQueue(tokens) {
+		routeLog(r.Context()).Debugw("Rejecting request", "url", r.URL, "scheduler", scheduler.Name, "tokens", tokens, "reason", "MaxQueueSize")
+		return RateLimit, RejectQueueFull
+	}
+	responseChannel := make(chan Response)
+	ticket := scheduler.tickets.Add(1)
+	select {
+	case scheduler.Requests <- ScheduledRequest{
+		Request:               r,
+		ResponseChannel:       responseChannel,
+		RequiredTokenCapacity: tokens,
+		Priority:              options.Priority,
+		ticket:                ticket,
+		queued:                scheduler.now(),
+	}:
+	default:
+		scheduler.addQueued(-1, -tokens)
+		routeLog(r.Context()).Debugw("Rejecting request", "url", r.URL, "scheduler", scheduler.Name, "tokens", tokens, "reason", "MaxQueueSize")
+		return RateLimit, RejectQueueFull
+	}
+
+	if id := r.Header.Get(HeaderQueueRequestID); id != "" {
+		queuedRequests.Store(id, func() QueueStatus { return scheduler.queueStatus(ticket) })
+		defer queuedRequests.Delete(id)
+	}
+
+	// Wait for the scheduler to signal that we can proceed
+	observer := options.Observer
+	if observer == nil || observer.Interval <= 0 {
+		response := <-responseChannel
+		return response, rejectReasonFor(response)
+	}
+	ticker := time.NewTicker(observer.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case response := <-responseChannel:
+			return response, rejectReasonFor(response)
+		case <-ticker.C:
+			observer.Observe(scheduler.queueStatus(ticket))
+		}
+	}
+}
+
+// queueStatus estimates the position and wait of the queued request holding ticket,
+// assuming the requests ahead of it are of average size
+func (scheduler *Scheduler) queueStatus(ticket uint64) QueueStatus {
+	// A request the run loop hasn't taken in yet goes behind those it has
+	position := 1
+	if order := scheduler.order.Load(); order != nil {
+		position = len(*order) + 1
+		for i, queued := range *order {
+			if queued == ticket {
+				position = i + 1
+				break
+			}
+		}
+	}
+
+	snapshot := scheduler.Snapshot()
+	averageTokens := snapshot.QueuedTokens / math.Max(1, float64(snapshot.QueuedRequests))
+	return QueueStatus{
+		Model:    scheduler.Name,
+		Position: position,
+		ETA:      60.0 * scheduler.timeUntilCapacity(&snapshot, float64(position), averageTokens*float64(position)),
+	}
+}
+
+// QueuedRequestStatus returns the status of a queued request by the id its client sent
+func QueuedRequestStatus(id string) (QueueStatus, bool) {
+	status, ok := queuedRequests.Load(id)
+	if !ok {
+		return QueueStatus{}, false
+	}
+	return status.(func() QueueStatus)(), true
+}
+
+// Counts returns how many requests have been admitted and rejected since startup
+func (scheduler *Scheduler) Counts() (admitted uint64, rejected uint64) {
+	return scheduler.admitted.Load(), scheduler.rejected.Load()
+}
+
+// Snapshot returns the current capacity, refilled up to now, along with the queue state
+func (scheduler *Scheduler) Snapshot() CapacitySnapshot {
+	return scheduler.refill(scheduler.state.Load(), scheduler.now())
+}
+
+// WaitEstimate returns how many seconds a new request of the given size would wait for capacity,
+// assuming everything already queued is served first. Small requests that may use the reserve
+// can be admitted ahead of the queue, so only their own size counts.
+func (scheduler *Scheduler) WaitEstimate(tokens float64) float64 {
+	snapshot := scheduler.Snapshot()
+	if scheduler.isSmall(tokens) {
+		return 60.0 * scheduler.timeUntilCapacity(&snapshot, 1, tokens)
+	}
+	requests := float64(snapshot.QueuedRequests) + 1
+	tokens += snapshot.QueuedTokens
+	return 60.0 * scheduler.timeUntilCapacity(&snapshot, requests, scheduler.requiredCapacity(tokens))
+}
+
+// utilization is the fraction of the request and token limits in use or queued for, above 1 when more is queued than a minute allows
+func (scheduler *Scheduler) utilization() (requests float64, tokens float64) {
+	snapshot, limits := scheduler.Snapshot(), scheduler.Limits()
+	if limits.ReqsPerMinute > 0 {
+		requests = math.Max(0, limits.ReqsPerMinute-snapshot.RequestCapacity+float64(snapshot.QueuedRequests)) / limits.ReqsPerMinute
+	}
+	if limits.TokensPerMinute > 0 {
+		tokens = math.Max(0, limits.TokensPerMinute-snapshot.TokenCapacity+snapshot.QueuedTokens) / limits.TokensPerMinute
+	}
+	return requests, tokens
+}
+
+// isSmall is true for requests that may use the capacity reserved for small requests
+func (scheduler *Scheduler) isSmall(tokens float64) bool {
+	return scheduler.Config.SmallRequestReserve > 0 && tokens <= scheduler.Config.SmallRequestTokens
+}
+
+// requiredCapacity is the token capacity that must be available before a request of the given size is admitted.
+// Large requests must leave the small request reserve untouched, though one that only fits in a full bucket still can.
+func (scheduler *Scheduler) requiredCapacity(tokens float64) float64 {
+	if scheduler.Config.SmallRequestReserve <= 0 || scheduler.isSmall(tokens) {
+		return tokens
+	}
+	limit := scheduler.Limits().TokensPerMinute
+	return math.Max(tokens, math.Min(tokens+scheduler.Config.SmallRequestReserve*limit, limit))
+}
+
+// timeUntilCapacity returns the minutes until the given requests and tokens are available
+func (scheduler *Scheduler) timeUntilCapacity(state *CapacitySnapshot, requests float64, tokens float64) float64 {
+	rates := scheduler.rates(scheduler.now())
+	var requestTime = math.Max(0.0, (requests-state.RequestCapacity)/rates.ReqsPerMinute)
+	var tokensTime = math.Max(0.0, (tokens-state.TokenCapacity)/rates.TokensPerMinute)
+	if scheduler.Config.Pacing {
+		// Requests ahead are spaced out at least by the request rate, after the next slot
+		var pacingTime = math.Max(0.0, state.paced.Sub(scheduler.now()).Minutes()) + (requests-1)/rates.ReqsPerMinute
+		return math.Max(math.Max(requestTime, tokensTime), pacingTime)
+	}
+	return math.Max(requestTime, tokensTime)
+}
+
+// rates returns how fast capacity recovers at now, which ramps up to the limits over the configured rampUp after start
+func (scheduler *Scheduler) rates(now monoTime) SchedulerLimits {
+	limits := scheduler.Limits()
+	if rampUp := scheduler.Config.RampUp; rampUp > 0 {
+		if elapsed := now.Sub(scheduler.started).Seconds(); elapsed < rampUp {
+			factor := math.Max(minimumRampRate, elapsed/rampUp)
+			limits.ReqsPerMinute *= factor
+			limits.TokensPerMinute *= factor
+		}
+	}
+	return limits
+}
+
+// refill returns a copy of state with the capacity recovered since it was last updated
+func (scheduler *Scheduler) refill(state *CapacitySnapshot, now monoTime) CapacitySnapshot {
+	next := *state
+	elapsed := now.Sub(state.updated).Minutes()
+	if elapsed > 0 {
+		limits := scheduler.Limits()
+		rates := scheduler.rates(now)
+		next.TokenCapacity = math.Min(state.TokenCapacity+elapsed*rates.TokensPerMinute, limits.TokensPerMinute)
+		next.RequestCapacity = math.Min(state.RequestCapacity+elapsed*rates.ReqsPerMinute, limits.ReqsPerMinute)
+		next.updated = now
+	}
+	return next
+}
+
+// update applies change to a refilled copy of the state and swaps it in, retrying if another
+// goroutine got there first. Returning false from change leaves the state untouched.
+func (scheduler *Scheduler) update(change func(state *CapacitySnapshot) bool) bool {
 	for {
+		current := scheduler.state.Load()
+		next := scheduler.refill(current, scheduler.now())
+		if !change(&next) {
+			return false
+		}
+		if scheduler.state.CompareAndSwap(current, &next) {
+			return true
+		}
+	}
+}
+
+// tryAcquire takes capacity for a request if nothing is queued and there is enough capacity right now
+func (scheduler *Scheduler) tryAcquire(tokens float64) bool {
+	return scheduler.update(func(state *CapacitySnapshot) bool {
+		if state.QueuedRequests > 0 || state.RequestCapacity < 1 || state.TokenCapacity < scheduler.requiredCapacity(tokens) {
+			return false
+		}
+		if scheduler.Config.Pacing && scheduler.now().Before(state.paced) {
+			return false
+		}
+		state.RequestCapacity -= 1
+		state.TokenCapacity -= tokens
+		scheduler.pace(state, tokens)
+		return true
+	})
+}
+
+// pace holds back the next request after one of the given size is admitted, by the request's share of the minute's
+// requests or tokens, so requests are forwarded evenly over the minute rather than in a burst as capacity allows
+func (scheduler *Scheduler) pace(state *CapacitySnapshot, tokens float64) {
+	if !scheduler.Config.Pacing {
+		return
+	}
+	now := scheduler.now()
+	rates := scheduler.rates(now)
+	interval := math.Max(1/rates.ReqsPerMinute, tokens/rates.TokensPerMinute)
+	if state.paced.Before(now) {
+		state.paced = now
+	}
+	state.paced = state.paced.Add(time.Duration(interval * float64(time.Minute)))
+}
 
-		// Check if we have capacity for the request
-		scheduler.updateCapacity()
+func (scheduler *Scheduler) addQueued(requests int, tokens float64) {
+	scheduler.update(func(state *CapacitySnapshot) bool {
+		state.QueuedRequests += requests
+		state.QueuedTokens += tokens
+		return true
+	})
+}
+
+// consume takes tokens that were used without being acquired, which can leave capacity negative
+func (scheduler *Scheduler) consume(tokens float64) {
+	scheduler.update(func(state *CapacitySnapshot) bool {
+		state.TokenCapacity -= tokens
+		return true
+	})
+}
+
+// refund gives back the capacity of a request that was admitted but then not sent
+func (scheduler *Scheduler) refund(tokens float64) {
+	limits := scheduler.Limits()
+	scheduler.throughput.Add(scheduler.now(), -1, -tokens)
+	scheduler.admitted.Add(^uint64(0)) // it no longer counts as admitted
+	scheduler.update(func(state *CapacitySnapshot) bool {
+		state.RequestCapacity = math.Min(state.RequestCapacity+1, limits.ReqsPerMinute)
+		state.TokenCapacity = math.Min(state.TokenCapacity+tokens, limits.TokensPerMinute)
+		return true
+	})
+}
+
+// submitAll submits a request to each scheduler in turn, skipping nil ones, and gives back what the others were
+// charged if one turns it away. It returns the scheduler that did and why, nil when they all admitted it.
+func submitAll(r *http.Request, schedulers []*Scheduler, tokens float64, options SubmitOptions) (*Scheduler, RejectReason) {
+	var admitted []*Scheduler
+	for _, scheduler := range schedulers {
+		if scheduler == nil {
+			continue
+		}
+		if response, reason := scheduler.SubmitWithReason(r, tokens, options); response != Ready {
+			for _, charged := range admitted {
+				charged.refund(tokens)
+			}
+			return scheduler, reason
+		}
+		admitted = append(admitted, scheduler)
+	}
+	return nil, ""
+}
+
+// Limits returns the rates the scheduler currently admits at, its share of them when they're shared with peers
+func (scheduler *Scheduler) Limits() SchedulerLimits {
+	limits := *scheduler.limits.Load()
+	if share := scheduler.share.Load(); share != nil {
+		limits.ReqsPerMinute *= *share
+		limits.TokensPerMinute *= *share
+	}
+	return limits
+}
+
+// SetLimits changes the rates the scheduler admits at, e.g. to match limits discovered from the upstream.
+// Capacity above the new limits is dropped.
+func (scheduler *Scheduler) SetLimits(limits SchedulerLimits) {
+	scheduler.limits.Store(&limits)
+	scheduler.clampCapacity()
+}
+
+// Share is the fraction of its limits the scheduler admits at, 1 unless they're shared with peers
+func (scheduler *Scheduler) Share() float64 {
+	if share := scheduler.share.Load(); share != nil {
+		return *share
+	}
+	return 1
+}
+
+// SetShare changes the fraction of its limits the scheduler admits at, when this replica shares them with peers.
+// Capacity above the new share is dropped.
+func (scheduler *Scheduler) SetShare(share float64) {
+	if previous := scheduler.share.Load(); previous != nil && *previous == share {
+		return
+	}
+	scheduler.share.Store(&share)
+	scheduler.clampCapacity()
+}
+
+// clampCapacity drops capacity above the current limits
+func (scheduler *Scheduler) clampCapacity() {
+	limits := scheduler.Limits()
+	scheduler.update(func(state *CapacitySnapshot) bool {
+		state.RequestCapacity = math.Min(state.RequestCapacity, limits.ReqsPerMinute)
+		state.TokenCapacity = math.Min(state.TokenCapacity, limits.TokensPerMinute)
+		return true
+	})
+}
+
+// backOff takes away capacity so that nothing more is admitted until delay has passed, e.g. after the upstream rate limited us.
+// Capacity then recovers at the usual rate.
+func (scheduler *Scheduler) backOff(delay time.Duration) {
+	minutes := delay.Minutes()
+	limits := scheduler.Limits()
+	scheduler.update(func(state *CapacitySnapshot) bool {
+		state.RequestCapacity = math.Min(state.RequestCapacity, 1-minutes*limits.ReqsPerMinute)
+		state.TokenCapacity = math.Min(state.TokenCapacity, -minutes*limits.TokensPerMinute)
+		return true
+	})
+}
 
+// lowerCapacity brings the current capacity down to at most the given requests and tokens, e.g. to what the upstream
+// says is left
+func (scheduler *Scheduler) lowerCapacity(requests float64, tokens float64) {
+	scheduler.update(func(state *CapacitySnapshot) bool {
+		if state.RequestCapacity <= requests && state.TokenCapacity <= tokens {
+			return false
+		}
+		state.RequestCapacity = math.Min(state.RequestCapacity, requests)
+		state.TokenCapacity = math.Min(state.TokenCapacity, tokens)
+		return true
+	})
+}
+
+// setCapacity overrides the current capacity, e.g. to start a scheduler partially drained
+func (scheduler *Scheduler) setCapacity(requests float64, tokens float64) {
+	scheduler.update(func(state *CapacitySnapshot) bool {
+		state.RequestCapacity = requests
+		state.TokenCapacity = tokens
+		return true
+	})
+}
+
+// maxQueueDepth is how many requests can be queued at once
+func (scheduler *Scheduler) maxQueueDepth() int {
+	if scheduler.Config.QueueMode == QueueModeShed && scheduler.Config.ShedDepth > 0 {
+		return scheduler.Config.ShedDepth
+	}
+	return scheduler.Config.MaxQueueSize
+}
+
+// joinQueue counts a request as queued, unless the queue is already full
+func (scheduler *Scheduler) joinQueue(tokens float64) bool {
+	depth := scheduler.maxQueueDepth()
+	return scheduler.update(func(state *CapacitySnapshot) bool {
+		if state.QueuedRequests >= depth {
+			return false
+		}
+		state.QueuedRequests += 1
+		state.QueuedTokens += tokens
+		return true
+	})
+}
+
+// acquireQueued allocates capacity to a queued request and removes it from the queue counts if it fits now,
+// returning 0, or otherwise returns the minutes until it will fit
+func (scheduler *Scheduler) acquireQueued(request *ScheduledRequest) float64 {
+	var capacityTime float64
+	scheduler.update(func(state *CapacitySnapshot) bool {
 		// Time until we have a free request, sufficient tokens, both
-		var requestTime = math.Max(0.0, (1-scheduler.RequestCapacity)/scheduler.Config.ReqsPerMinute)
-		var tokensTime = math.Max(0.0, (request.RequiredTokenCapacity-scheduler.TokenCapacity)/scheduler.Config.TokensPerMinute)
-		var capacityTime = math.Max(requestTime, tokensTime)
-		if capacityTime <= 0.0 {
-			// We have capacity now
-			return
+		capacityTime = scheduler.timeUntilCapacity(state, 1, scheduler.requiredCapacity(request.RequiredTokenCapacity))
+		if capacityTime > 0.0 {
+			return false
 		}
 
-		// Otherwise sleep for between epsilon and 2 seconds, depending on how much capacity we need
-		// This keeps the capacity numbers close to actual capacity for our metrics
-		var sleepTime = time.Duration(math.Min(2.0, capacityTime+epsilon) * float64(time.Second))
-		time.Sleep(sleepTime)
+		// We have capacity now
+		state.RequestCapacity -= 1
+		state.TokenCapacity -= request.RequiredTokenCapacity
+		scheduler.pace(state, request.RequiredTokenCapacity)
+		state.QueuedRequests -= 1
+		state.QueuedTokens -= request.RequiredTokenCapacity
+		return true
+	})
+	return capacityTime
+}
+
+// admitSmall admits the most urgent queued small request if it fits now, returning whether it did.
+func (scheduler *Scheduler) admitSmall(queue *requestQueue) bool {
+	if scheduler.Config.SmallRequestReserve <= 0 {
+		return false
+	}
+	index := -1
+	for i, request := range *queue {
+		if scheduler.isSmall(request.RequiredTokenCapacity) && (index < 0 || queue.Less(i, index)) {
+			index = i
+		}
+	}
+	if index < 0 || scheduler.acquireQueued((*queue)[index]) > 0 {
+		return false
+	}
+
+	request := heap.Remove(queue, index).(*ScheduledRequest)
+	routeLog(request.Request.Context()).Infow("Handling request", "url", request.Request.URL, "tokens", request.RequiredTokenCapacity, "priority", request.Priority, "reason", "SmallRequestReserve")
+	request.ResponseChannel <- Ready
+	return true
+}
+
+// age raises the priority of requests by one for every priorityAging seconds they have waited, and marks
+// those that have waited maxPriorityWait seconds overdue, so a stream of more urgent requests can't starve them.
+// The queue is reordered to match.
+func (scheduler *Scheduler) age(queue *requestQueue, now monoTime) {
+	aging, maxWait := scheduler.Config.PriorityAging, scheduler.Config.MaxPriorityWait
+	if aging <= 0 && maxWait <= 0 {
+		return
+	}
+	for _, request := range *queue {
+		waited := now.Sub(request.queued).Seconds()
+		if aging > 0 {
+			request.boost = int(waited / aging)
+		}
+		request.overdue = maxWait > 0 && waited >= maxWait
 	}
+	heap.Init(queue)
 }
@@ -0,0 +1,425 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedulerSubmit_Ready(t *testing.T) {
+	schedulers := initSchedulers("openai", map[string]ModelConfig{
+		TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60.0, TokensPerMinute: 60000.0},
+	})
+	scheduler := schedulers[TEST_MODEL]
+
+	req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", nil)
+	assert.Equal(t, Response(Ready), scheduler.Submit(req, 1000))
+
+	snapshot := scheduler.Snapshot()
+	assert.InDelta(t, 59000.0, snapshot.TokenCapacity, 10.0)
+	assert.InDelta(t, 59.0, snapshot.RequestCapacity, 0.1)
+	assert.Equal(t, 0, snapshot.QueuedRequests)
+}
+
+func TestSchedulerSubmit_MaxQueueWait(t *testing.T) {
+	schedulers := initSchedulers("openai", map[string]ModelConfig{
+		TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60.0, TokensPerMinute: 60000.0},
+	})
+	scheduler := schedulers[TEST_MODEL]
+
+	// Drain the tokens so the request would have to wait ~2 seconds
+	scheduler.setCapacity(60, -1000)
+
+	req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", nil)
+	assert.Equal(t, Response(RateLimit), scheduler.Submit(req, 1000))
+	assert.InDelta(t, 2.0, scheduler.WaitEstimate(1000), 0.1)
+}
+
+func TestSchedulerTryAcquire_Concurrent(t *testing.T) {
+	ConfigureLogging(LogType("console"), LogLevel("error"))
+	schedulers := initSchedulers("openai", map[string]ModelConfig{
+		TEST_MODEL: {MaxQueueSize: 100, ReqsPerMinute: 60.0, TokensPerMinute: 60000.0},
+	})
+	scheduler := schedulers[TEST_MODEL]
+
+	// Only 10 requests fit right now, the rest have to queue or be turned away
+	scheduler.setCapacity(10, 60000)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	admitted := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if scheduler.tryAcquire(100) {
+				mu.Lock()
+				admitted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 10, admitted)
+	snapshot := scheduler.Snapshot()
+	assert.InDelta(t, 0.0, snapshot.RequestCapacity, 0.1)
+	assert.InDelta(t, 59000.0, snapshot.TokenCapacity, 10.0)
+}
+
+func TestSchedulerSubmit_Queued(t *testing.T) {
+	schedulers := initSchedulers("openai", map[string]ModelConfig{
+		TEST_MODEL: {MaxQueueSize: 10, ReqsPerMinute: 600.0, TokensPerMinute: 60000.0},
+	})
+	scheduler := schedulers[TEST_MODEL]
+
+	// No requests left, so these have to go through the queue and wait ~0.1s each for capacity
+	scheduler.setCapacity(0, 60000)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", nil)
+			assert.Equal(t, Response(Ready), scheduler.Submit(req, 100))
+		}()
+	}
+	wg.Wait()
+
+	snapshot := scheduler.Snapshot()
+	assert.Equal(t, 0, snapshot.QueuedRequests)
+	assert.InDelta(t, 0.0, snapshot.QueuedTokens, 0.001)
+}
+
+func TestSchedulerPacing(t *testing.T) {
+	schedulers := initSchedulers("openai", map[string]ModelConfig{
+		TEST_MODEL: {MaxQueueSize: 10, ReqsPerMinute: 600.0, TokensPerMinute: 60000.0, Pacing: true},
+	})
+	scheduler := schedulers[TEST_MODEL]
+
+	// A full minute of capacity is available, but only one request goes straight away
+	assert.True(t, scheduler.tryAcquire(100))
+	assert.False(t, scheduler.tryAcquire(100))
+	assert.InDelta(t, 0.1, scheduler.WaitEstimate(100), 0.02)
+
+	// The rest are spaced ~0.1s apart by the request rate
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", nil)
+			assert.Equal(t, Response(Ready), scheduler.Submit(req, 100))
+		}()
+	}
+	wg.Wait()
+	assert.GreaterOrEqual(t, time.Since(start), 250*time.Millisecond)
+
+	// A large request holds back the next by its share of the tokens instead
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, scheduler.tryAcquire(30000))
+	assert.InDelta(t, 30.0, scheduler.WaitEstimate(100), 0.1)
+}
+
+func TestGetCompletionHandler_RateLimitHeaders(t *testing.T) {
+	ConfigureLogging(LogType("console"), LogLevel("debug"))
+	openai := CreateOpenAI()
+	scheduler := openai.schedulers[TEST_MODEL]
+
+	scheduler.setCapacity(60, -1000)
+
+	handler := openai.GetHandler()
+
+	var bodyStr = []byte(fmt.Sprintf(`{"model": "%s", "prompt": "test"}`, TEST_MODEL))
+	req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewBuffer(bodyStr))
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get(HeaderRetryAfter))
+	assert.Equal(t, "60", resp.Header.Get(HeaderLimitRequests))
+	assert.Equal(t, "60000", resp.Header.Get(HeaderLimitTokens))
+	assert.Equal(t, "0", resp.Header.Get(HeaderRemainingTokens))
+	assert.NotEmpty(t, resp.Header.Get(HeaderResetTokens))
+}
+
+func TestFormatReset(t *testing.T) {
+	assert.Equal(t, "0s", formatReset(-1))
+	assert.Equal(t, "1.5s", formatReset(0.025))
+	assert.Equal(t, "6m0s", formatReset(6))
+}
+
+func TestSchedulerScopes(t *testing.T) {
+	openai := NewOpenAI(&RouteConfig{
+		Forward:        "https://api.openai.com",
+		Provider:       "openai",
+		SchedulerScope: []string{"OpenAI-Organization", "OpenAI-Project"},
+		Models:         map[string]ModelConfig{TEST_MODEL: {MaxQueueSize: 1, MaxQueueWait: 1, ReqsPerMinute: 60, TokensPerMinute: 60000}},
+	}, &MockHttpClient{})
+	scopes := openai.scopes
+
+	r := httptest.NewRequest(http.MethodPost, "/openai/v1/completions", nil)
+	assert.Equal(t, "", scopes.Key(r))
+
+	r.Header.Set("OpenAI-Organization", "org-a")
+	assert.Equal(t, "org-a/", scopes.Key(r))
+	r.Header.Set("OpenAI-Project", "proj-1")
+	assert.Equal(t, "org-a/proj-1", scopes.Key(r))
+
+	a, ok := scopes.Get("org-a/proj-1")
+	assert.True(t, ok)
+	again, _ := scopes.Get("org-a/proj-1")
+	assert.Same(t, a, again)
+	b, _ := scopes.Get("org-b/")
+
+	// Each scope has capacity of its own
+	assert.NotSame(t, a.schedulers[TEST_MODEL], b.schedulers[TEST_MODEL])
+	assert.NotSame(t, openai.schedulers[TEST_MODEL], a.schedulers[TEST_MODEL])
+	a.schedulers[TEST_MODEL].setCapacity(0, 0)
+	assert.Equal(t, Response(RateLimit), a.schedulers[TEST_MODEL].Submit(r, 10000))
+	assert.Equal(t, Response(Ready), b.schedulers[TEST_MODEL].Submit(r, 1))
+	assert.Equal(t, "org-a/proj-1", a.schedulers[TEST_MODEL].Scope)
+	assert.Len(t, openai.ScopedSchedulers(), 2)
+}
+
+func TestSchedulerScopesShareRouteBudget(t *testing.T) {
+	models := map[string]ModelConfig{TEST_MODEL: {MaxQueueSize: 1, MaxQueueWait: 0.1, ReqsPerMinute: 2, TokensPerMinute: 60000}}
+	openai := NewOpenAI(&RouteConfig{
+		Forward:        FAKE_BASE_URL,
+		Provider:       "openai",
+		SchedulerScope: []string{"OpenAI-Organization"},
+		Models:         models,
+	}, &MockHttpClient{})
+	handler := openai.GetHandler()
+
+	send := func(organization string) int {
+		body := []byte(fmt.Sprintf(`{"model": "%s", "prompt": "test", "max_tokens": 10}`, TEST_MODEL))
+		r := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewBuffer(body))
+		r.Header.Set("OpenAI-Organization", organization)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	// Making up header values doesn't add capacity past the route's own
+	assert.Equal(t, http.StatusOK, send("org-a"))
+	assert.Equal(t, http.StatusOK, send("org-b"))
+	assert.Equal(t, http.StatusTooManyRequests, send("org-c"))
+
+	// Only configured values get scopes of their own
+	openai = NewOpenAI(&RouteConfig{
+		Forward:              FAKE_BASE_URL,
+		Provider:             "openai",
+		SchedulerScope:       []string{"OpenAI-Organization"},
+		SchedulerScopeValues: []string{"org-a"},
+		Models:               models,
+	}, &MockHttpClient{})
+	r := httptest.NewRequest(http.MethodPost, "/openai/v1/completions", nil)
+	r.Header.Set("OpenAI-Organization", "org-a")
+	assert.Equal(t, "org-a", openai.scopes.Key(r))
+	r.Header.Set("OpenAI-Organization", "org-b")
+	assert.Equal(t, "", openai.scopes.Key(r))
+	assert.Nil(t, openai.scopeQuota)
+}
+
+func TestSchedulerWarmStart(t *testing.T) {
+	half := 0.5
+	scheduler := NewScheduler("openai", TEST_MODEL, ModelConfig{MaxQueueSize: 1, ReqsPerMinute: 60, TokensPerMinute: 60000, InitialFill: &half, RampUp: 60})
+	snapshot := scheduler.Snapshot()
+	assert.InDelta(t, 30, snapshot.RequestCapacity, 1)
+	assert.InDelta(t, 30000, snapshot.TokenCapacity, 100)
+
+	// Capacity recovers slowly at first, reaching the full rate once rampUp has passed
+	assert.InDelta(t, 60*minimumRampRate, scheduler.rates(scheduler.started).ReqsPerMinute, 0.001)
+	assert.InDelta(t, 30, scheduler.rates(scheduler.started.Add(30*time.Second)).ReqsPerMinute, 0.001)
+	assert.Equal(t, scheduler.Limits(), scheduler.rates(scheduler.started.Add(time.Minute)))
+
+	empty := 0.0
+	scheduler = NewScheduler("openai", TEST_MODEL, ModelConfig{MaxQueueSize: 1, ReqsPerMinute: 60, TokensPerMinute: 60000, InitialFill: &empty})
+	assert.InDelta(t, 0, scheduler.Snapshot().RequestCapacity, 1)
+	assert.InDelta(t, 1.0, scheduler.WaitEstimate(0), 0.1)
+}
+
+func TestSchedulerQueueMode(t *testing.T) {
+	req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", nil)
+
+	// Rejecting never waits, even when capacity is only a moment away
+	schedulers := initSchedulers("openai", map[string]ModelConfig{
+		TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 10, ReqsPerMinute: 600, TokensPerMinute: 60000, QueueMode: QueueModeReject},
+	})
+	scheduler := schedulers[TEST_MODEL]
+	assert.Equal(t, Response(Ready), scheduler.Submit(req, 100))
+	scheduler.setCapacity(0, 60000)
+	assert.Equal(t, Response(RateLimit), scheduler.Submit(req, 100))
+
+	// Shedding queues regardless of the wait until shedDepth requests are waiting
+	schedulers = initSchedulers("openai", map[string]ModelConfig{
+		TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 0.01, ReqsPerMinute: 600, TokensPerMinute: 60000, QueueMode: QueueModeShed, ShedDepth: 1},
+	})
+	scheduler = schedulers[TEST_MODEL]
+	scheduler.setCapacity(0, 60000)
+
+	done := make(chan Response)
+	go func() {
+		done <- scheduler.Submit(req, 100)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, Response(RateLimit), scheduler.Submit(req, 100))
+	assert.Equal(t, Response(Ready), <-done)
+}
+
+func TestSchedulerCloseQueues(t *testing.T) {
+	defer queuesClosed.Store(false)
+	req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", nil)
+
+	schedulers := initSchedulers("openai", map[string]ModelConfig{
+		TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 20, ReqsPerMinute: 6, TokensPerMinute: 60000},
+	})
+	scheduler := schedulers[TEST_MODEL]
+	scheduler.setCapacity(0, 60000)
+
+	done := make(chan Response)
+	go func() {
+		done <- scheduler.Submit(req, 100)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// Once shutting down the queued request is turned away rather than waiting ten seconds, as are new ones
+	closeQueues()
+	select {
+	case response := <-done:
+		assert.Equal(t, Response(RateLimit), response)
+	case <-time.After(3 * time.Second):
+		t.Fatal("queued request was not rejected")
+	}
+	assert.Equal(t, Response(RateLimit), scheduler.Submit(req, 100))
+	assert.Equal(t, 0, scheduler.Snapshot().QueuedRequests)
+}
+
+func TestSchedulerSmallRequestReserve(t *testing.T) {
+	req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/chat/completions", nil)
+	schedulers := initSchedulers("openai", map[string]ModelConfig{
+		TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 60, ReqsPerMinute: 600, TokensPerMinute: 60000, SmallRequestReserve: 0.2, SmallRequestTokens: 1000},
+	})
+	scheduler := schedulers[TEST_MODEL]
+
+	// Large requests must leave 12000 tokens behind, unless they only fit in a full bucket
+	assert.Equal(t, 17000.0, scheduler.requiredCapacity(5000))
+	assert.Equal(t, 500.0, scheduler.requiredCapacity(500))
+	assert.Equal(t, 60000.0, scheduler.requiredCapacity(55000))
+
+	scheduler.setCapacity(600, 10000)
+	large := make(chan Response, 1)
+	go func() {
+		large <- scheduler.Submit(req, 5000)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// The small request is served from the reserve while the large one keeps waiting
+	small := make(chan Response, 1)
+	go func() {
+		small <- scheduler.Submit(req, 500)
+	}()
+	select {
+	case response := <-small:
+		assert.Equal(t, Response(Ready), response)
+	case <-time.After(time.Second):
+		t.Fatal("small request was held up by the large one")
+	}
+	assert.Empty(t, large)
+	assert.Equal(t, 1, scheduler.Snapshot().QueuedRequests)
+
+	scheduler.setCapacity(600, 60000)
+	select {
+	case response := <-large:
+		assert.Equal(t, Response(Ready), response)
+	case <-time.After(3 * time.Second):
+		t.Fatal("large request was not admitted")
+	}
+}
+
+func TestSchedulerAging(t *testing.T) {
+	scheduler := NewScheduler("openai", TEST_MODEL, ModelConfig{MaxQueueSize: 10, ReqsPerMinute: 60, TokensPerMinute: 60000, PriorityAging: 10, MaxPriorityWait: 60})
+	now := monoNow()
+	old := &ScheduledRequest{Priority: 0, ticket: 1, queued: now.Add(-25 * time.Second)}
+	urgent := &ScheduledRequest{Priority: 2, ticket: 2, queued: now}
+	fresh := &ScheduledRequest{Priority: 0, ticket: 3, queued: now}
+	queue := &requestQueue{}
+	for _, request := range []*ScheduledRequest{fresh, urgent, old} {
+		heap.Push(queue, request)
+	}
+
+	// Having waited 25 seconds the old request has gained two steps, drawing level with the urgent one which arrived later
+	scheduler.age(queue, now)
+	assert.Equal(t, old, heap.Pop(queue))
+	assert.Equal(t, urgent, heap.Pop(queue))
+
+	// Once overdue a request goes ahead of any priority
+	heap.Push(queue, &ScheduledRequest{Priority: 100, ticket: 4, queued: now})
+	scheduler.age(queue, now.Add(time.Minute))
+	assert.Equal(t, fresh, heap.Pop(queue))
+}
+
+func TestSchedulerBoundedWait(t *testing.T) {
+	req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", nil)
+	schedulers := initSchedulers("openai", map[string]ModelConfig{
+		TEST_MODEL: {MaxQueueSize: 50, ReqsPerMinute: 300, TokensPerMinute: 60000, MaxPriorityWait: 1},
+	})
+	scheduler := schedulers[TEST_MODEL]
+	scheduler.setCapacity(0, 60000)
+
+	// Keep the queue full of high priority requests, arriving faster than the five a second admitted
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(20 * time.Millisecond):
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					scheduler.SubmitWith(req, 10, SubmitOptions{Priority: 10})
+				}()
+			}
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	start := time.Now()
+	assert.Equal(t, Response(Ready), scheduler.SubmitWith(req, 10, SubmitOptions{Priority: 0}))
+	assert.Less(t, time.Since(start), 3*time.Second)
+
+	// Stop the flood and let what's still queued through before returning
+	close(stop)
+	scheduler.setCapacity(300, 60000)
+	wg.Wait()
+}
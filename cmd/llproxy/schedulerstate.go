@@ -0,0 +1,94 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// SchedulerState is whether a scheduler is admitting requests, changed through the admin API e.g. around upstream maintenance
+type SchedulerState string
+
+const (
+	SchedulerRunning SchedulerState = "running"
+
+	// Paused schedulers queue requests, but admit none until they're resumed
+	SchedulerPaused SchedulerState = "paused"
+
+	// Draining schedulers admit the requests already queued, but reject new ones
+	SchedulerDraining SchedulerState = "draining"
+)
+
+var schedulerStates = []SchedulerState{SchedulerRunning, SchedulerPaused, SchedulerDraining}
+
+// SchedulerStateChange pauses, drains or resumes the schedulers of a route's model, or of all its models if none is given
+type SchedulerStateChange struct {
+	Route string `json:"route"`
+	Model string `json:"model"`
+}
+
+// State returns whether the scheduler is running, paused or draining
+func (scheduler *Scheduler) State() SchedulerState {
+	if state, ok := scheduler.admission.Load().(SchedulerState); ok {
+		return state
+	}
+	return SchedulerRunning
+}
+
+// SetState pauses, drains or resumes the scheduler, waking its run loop so a resumed queue is served straight away
+func (scheduler *Scheduler) SetState(state SchedulerState) {
+	scheduler.admission.Store(state)
+	select {
+	case scheduler.wake <- struct{}{}:
+	default:
+	}
+}
+
+func setSchedulerState(providers Providers, state SchedulerState) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request SchedulerStateChange
+		if err := decodeJSON(r.Body, &request); err != nil {
+			writeError(w, http.StatusBadRequest, ErrTypeInvalidRequest, ErrCodeInvalidRequest, fmt.Sprintf("Invalid scheduler request: %s", err))
+			return
+		}
+		provider, ok := providers[request.Route]
+		if !ok {
+			writeError(w, http.StatusNotFound, ErrTypeInvalidRequest, ErrCodeInvalidRequest, fmt.Sprintf("No route '%s'", request.Route))
+			return
+		}
+
+		// Scoped and per-key schedulers of the model change along with it
+		statuses := []SchedulerStatus{}
+		for _, schedulers := range append([]SchedulerMap{provider.Schedulers()}, provider.ScopedSchedulers()...) {
+			for _, model := range sortedModels(schedulers) {
+				if request.Model == "" || request.Model == model {
+					schedulers[model].SetState(state)
+					statuses = append(statuses, schedulerStatus(request.Route, model, schedulers[model]))
+				}
+			}
+		}
+		if len(statuses) == 0 {
+			writeError(w, http.StatusNotFound, ErrTypeInvalidRequest, ErrCodeInvalidRequest, fmt.Sprintf("No scheduler for model '%s' on route '%s'", request.Model, request.Route))
+			return
+		}
+		zap.S().Warnw("Scheduler state changed", "route", request.Route, "model", request.Model, "state", state)
+		writeJSON(w, statuses)
+	}
+}
@@ -0,0 +1,80 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchedulerPauseAndDrain(t *testing.T) {
+	openai := CreateOpenAI()
+	scheduler := openai.schedulers[TEST_MODEL]
+	router := newAdminRouter(Providers{"openai": openai})
+	change := func(action string) []SchedulerStatus {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "http://localhost:8082/admin/schedulers/"+action, bytes.NewBufferString(`{"route": "openai", "model": "gpt-3.5-turbo"}`)))
+		require.Equal(t, http.StatusOK, w.Code)
+		var statuses []SchedulerStatus
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &statuses))
+		return statuses
+	}
+
+	// Paused, requests wait in the queue even though there's capacity
+	statuses := change("pause")
+	require.Len(t, statuses, 1)
+	assert.Equal(t, SchedulerPaused, statuses[0].State)
+
+	done := make(chan Response)
+	go func() {
+		done <- scheduler.Submit(httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", nil), 100)
+	}()
+	select {
+	case <-done:
+		t.Fatal("request admitted while paused")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Equal(t, 1, scheduler.Snapshot().QueuedRequests)
+
+	w := httptest.NewRecorder()
+	getMetrics(Providers{"openai": openai})(w, httptest.NewRequest("GET", "http://localhost:8082/metrics", nil))
+	assert.Contains(t, w.Body.String(), `llproxy_scheduler_state{route="openai",model="gpt-3.5-turbo",scope="",state="paused"} 1`)
+
+	// Resumed, the queue is served straight away
+	assert.Equal(t, SchedulerRunning, change("resume")[0].State)
+	select {
+	case response := <-done:
+		assert.Equal(t, Response(Ready), response)
+	case <-time.After(time.Second):
+		t.Fatal("request not admitted after resuming")
+	}
+
+	// Draining, new requests are turned away
+	change("drain")
+	assert.Equal(t, Response(RateLimit), scheduler.Submit(httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", nil), 100))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "http://localhost:8082/admin/schedulers/pause", strings.NewReader(`{"route": "openai", "model": "gpt-4"}`)))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,248 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for scope quotas
+const (
+	defaultScopeBorrowBelow   = 0.5
+	defaultScopeQuotaInterval = 5
+)
+
+// ScopeQuotaConfig gives each of a route's scheduler scopes a share of every model's limits, rather than limits of
+// its own, so tenants split one upstream quota. A scope may borrow beyond its share while the model is underused.
+type ScopeQuotaConfig struct {
+	// Fraction of each model's rpm and tpm a scope's schedulers get
+	Share float64 `json:"share"`
+
+	// Most a scope may borrow on top of its share, as a fraction of the model's limits, 0 for strict partitions
+	Borrow float64 `json:"borrow"`
+
+	// Scopes borrow while the model's requests or tokens in use, by every scope together, are below this fraction
+	// of its limits, 0.5 when unset
+	BorrowBelow float64 `json:"borrowBelow"`
+
+	// Seconds between checks of the model's use, 5 when unset
+	Interval float64 `json:"interval"`
+}
+
+func (c *ScopeQuotaConfig) validate() error {
+	if c.Share <= 0 || c.Share > 1 {
+		return fmt.Errorf("scopeQuota share must be above 0 and at most 1")
+	}
+	if c.Borrow < 0 || c.Share+c.Borrow > 1 {
+		return fmt.Errorf("scopeQuota borrow can't be negative or take a scope over the model's limits")
+	}
+	if c.BorrowBelow < 0 || c.BorrowBelow > 1 || c.Interval < 0 {
+		return fmt.Errorf("scopeQuota borrowBelow must be between 0 and 1, and interval can't be negative")
+	}
+	return nil
+}
+
+// scaled returns the models' configs with their limits cut to a scope's share
+func (c *ScopeQuotaConfig) scaled(models map[string]ModelConfig) map[string]ModelConfig {
+	if c == nil || models == nil {
+		return models
+	}
+	scaled := make(map[string]ModelConfig, len(models))
+	for model, config := range models {
+		config.ReqsPerMinute *= c.Share
+		config.TokensPerMinute *= c.Share
+		scaled[model] = config
+	}
+	return scaled
+}
+
+// scopeQuota admits scoped requests against the model's scheduler too, the pool every scope shares, and raises
+// the scopes' limits by what they may borrow while the pool is underused
+type scopeQuota struct {
+	config    ScopeQuotaConfig
+	interval  time.Duration
+	pool      SchedulerMap
+	batchPool SchedulerMap
+	scopes    *schedulerScopes
+}
+
+func newScopeQuota(config *ScopeQuotaConfig, pool SchedulerMap, batchPool SchedulerMap, scopes *schedulerScopes) *scopeQuota {
+	if config == nil || scopes == nil {
+		return nil
+	}
+	q := &scopeQuota{
+		config:    *config,
+		interval:  time.Duration(config.Interval * float64(time.Second)),
+		pool:      pool,
+		batchPool: batchPool,
+		scopes:    scopes,
+	}
+	if q.config.BorrowBelow == 0 {
+		q.config.BorrowBelow = defaultScopeBorrowBelow
+	}
+	if q.interval == 0 {
+		q.interval = defaultScopeQuotaInterval * time.Second
+	}
+	return q
+}
+
+// Run rebalances the scopes' limits every interval, also carrying limits the upstream reported for the pool over
+// to its scopes
+func (q *scopeQuota) Run() {
+	if q == nil {
+		return
+	}
+	for range time.Tick(q.interval) {
+		q.rebalance()
+	}
+}
+
+// rebalance lets every scope borrow up to its cap from models whose pool is underused, and takes the loan back,
+// dropping capacity above the share, from models whose pool is busy. Shares are taken of the pool's current
+// limits, which is where limitDiscovery keeps what the upstream reported for scoped requests.
+func (q *scopeQuota) rebalance() {
+	q.rebalanceScopes(q.scopes.All(), q.pool)
+	q.rebalanceScopes(q.scopes.AllBatch(), q.batchPool)
+}
+
+func (q *scopeQuota) rebalanceScopes(scopes []SchedulerMap, pools SchedulerMap) {
+	for _, scoped := range scopes {
+		for model, scheduler := range scoped {
+			pool, ok := pools[model]
+			if !ok {
+				continue
+			}
+			fraction := q.config.Share
+			if requests, tokens := pool.utilization(); math.Max(requests, tokens) < q.config.BorrowBelow {
+				fraction += q.config.Borrow
+			}
+			limits := *pool.limits.Load()
+			scheduler.SetLimits(SchedulerLimits{
+				ReqsPerMinute:   limits.ReqsPerMinute * fraction,
+				TokensPerMinute: limits.TokensPerMinute * fraction,
+			})
+		}
+	}
+}
+
+// Pool returns the scheduler requests of a scope are also admitted by for a model, nil when there's none
+func (q *scopeQuota) Pool(scope string, batch bool, model string) *Scheduler {
+	if q == nil || scope == "" {
+		return nil
+	}
+	pools := q.pool
+	if batch {
+		pools = q.batchPool
+	}
+	return pools[model]
+}
+
+// Admit waits for the pool to have capacity for a request its scope's scheduler admitted, writing the error
+// response and returning false if it doesn't, and counts what the scope was admitted beyond its share as borrowed.
+// The scope's capacity is given back when the pool turns the request away. The pool the request was admitted by
+// is returned, nil when it didn't need one, so it can be given back its capacity too when a later check fails.
+func (q *scopeQuota) Admit(w http.ResponseWriter, r *http.Request, scope string, batch bool, model *Scheduler, tokens float64, options SubmitOptions) (*Scheduler, bool) {
+	pool := q.Pool(scope, batch, model.Name)
+	if pool == nil {
+		return nil, true
+	}
+	if response, reason := pool.SubmitWithReason(r, tokens, options); response != Ready {
+		model.refund(tokens)
+		routeLog(r.Context()).Debugw("Rejecting request", "url", r.URL, "model", model.Name, "scope", scope, "tokens", tokens, "reason", "PoolRateLimit")
+		setRateLimitHeaders(w.Header(), pool)
+		setRetryAfter(w.Header(), pool, tokens)
+		writeRejection(w, http.StatusTooManyRequests, ErrTypeRequests, ErrCodeRateLimitExceeded, reason, "RateLimit exceeded for the model's shared quota")
+		return nil, false
+	}
+
+	// The scope's admissions over the last minute, this one included, past its share were borrowed
+	limits := *pool.limits.Load()
+	requests, admittedTokens := model.throughput.PerMinute(model.now())
+	if requests > limits.ReqsPerMinute*q.config.Share || admittedTokens > limits.TokensPerMinute*q.config.Share {
+		route := ""
+		if record := recordFromContext(r.Context()); record != nil {
+			route = record.Route
+		}
+		scopeBorrowMetrics.Add(route, model.Name, scope, tokens)
+	}
+	return pool, true
+}
+
+// scopeBorrowRegistry keeps the requests and tokens scopes were admitted with borrowed capacity, written in the
+// Prometheus text format
+type scopeBorrowRegistry struct {
+	mu     sync.Mutex
+	series map[string]*borrowedUsage
+}
+
+// borrowedUsage is what one route, model and scope was admitted with borrowed capacity
+type borrowedUsage struct {
+	requests uint64
+	tokens   float64
+}
+
+var scopeBorrowMetrics = &scopeBorrowRegistry{}
+
+// Add counts a request admitted with borrowed capacity
+func (m *scopeBorrowRegistry) Add(route string, model string, scope string, tokens float64) {
+	key := strings.Join([]string{metricLabel("route", route), metricLabel("model", model), metricLabel("scope", scope)}, ",")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.series == nil {
+		m.series = make(map[string]*borrowedUsage)
+	}
+	usage, ok := m.series[key]
+	if !ok {
+		usage = &borrowedUsage{}
+		m.series[key] = usage
+	}
+	usage.requests++
+	usage.tokens += tokens
+}
+
+// Write writes the borrowed requests and tokens of every series in the Prometheus text exposition format
+func (m *scopeBorrowRegistry) Write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.series) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintln(w, "# HELP llproxy_scope_borrowed_requests_total Requests scopes were admitted with capacity borrowed beyond their share.")
+	fmt.Fprintln(w, "# TYPE llproxy_scope_borrowed_requests_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "llproxy_scope_borrowed_requests_total{%s} %d\n", key, m.series[key].requests)
+	}
+	fmt.Fprintln(w, "# HELP llproxy_scope_borrowed_tokens_total Tokens scopes were admitted with capacity borrowed beyond their share.")
+	fmt.Fprintln(w, "# TYPE llproxy_scope_borrowed_tokens_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "llproxy_scope_borrowed_tokens_total{%s} %g\n", key, m.series[key].tokens)
+	}
+}
@@ -0,0 +1,120 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScopeQuota(t *testing.T) {
+	openai := NewOpenAI(&RouteConfig{
+		Forward:        FAKE_BASE_URL,
+		Provider:       "openai",
+		SchedulerScope: []string{"OpenAI-Organization"},
+		Models:         map[string]ModelConfig{TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 0.1, ReqsPerMinute: 10, TokensPerMinute: 60000}},
+		ScopeQuota:     &ScopeQuotaConfig{Share: 0.4, Borrow: 0.4},
+	}, &MockHttpClient{})
+	handler := openai.GetHandler()
+
+	send := func(org string) *httptest.ResponseRecorder {
+		body := []byte(fmt.Sprintf(`{"model": "%s", "prompt": "test", "max_tokens": 10}`, TEST_MODEL))
+		r := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewBuffer(body))
+		r.Header.Set("OpenAI-Organization", org)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	// A scope gets its share of the model's limits, and uses up the model's capacity as it's admitted
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, http.StatusOK, send("org-a").Code)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, send("org-a").Code)
+	a, _ := openai.scopes.Get("org-a")
+	scoped := a.schedulers[TEST_MODEL]
+	assert.Equal(t, 4.0, scoped.Limits().ReqsPerMinute)
+	assert.InDelta(t, 6, openai.schedulers[TEST_MODEL].Snapshot().RequestCapacity, 0.5)
+
+	// While the model's underused the scope borrows beyond its share, reported separately
+	openai.scopeQuota.rebalance()
+	assert.Equal(t, 8.0, scoped.Limits().ReqsPerMinute)
+	scoped.setCapacity(4, 60000)
+	assert.Equal(t, http.StatusOK, send("org-a").Code)
+	metrics := &strings.Builder{}
+	scopeBorrowMetrics.Write(metrics)
+	assert.Contains(t, metrics.String(), `llproxy_scope_borrowed_requests_total{route="",model="`+TEST_MODEL+`",scope="org-a"} 1`)
+
+	// Once it's busy the loan is taken back
+	openai.schedulers[TEST_MODEL].setCapacity(1, 60000)
+	openai.scopeQuota.rebalance()
+	assert.Equal(t, 4.0, scoped.Limits().ReqsPerMinute)
+
+	// Other scopes are turned away by the pool when it runs out, getting their own capacity back
+	assert.Equal(t, http.StatusOK, send("org-b").Code)
+	w := send("org-b")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), "shared quota")
+	b, _ := openai.scopes.Get("org-b")
+	assert.InDelta(t, 3, b.schedulers[TEST_MODEL].Snapshot().RequestCapacity, 0.5)
+}
+
+func TestScopeQuotaRouteLimitAndBatch(t *testing.T) {
+	models := map[string]ModelConfig{TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 0.1, ReqsPerMinute: 10, TokensPerMinute: 60000}}
+	openai := NewOpenAI(&RouteConfig{
+		Forward:        FAKE_BASE_URL,
+		Provider:       "openai",
+		SchedulerScope: []string{"OpenAI-Organization"},
+		Models:         models,
+		BatchModels:    models,
+		ScopeQuota:     &ScopeQuotaConfig{Share: 0.5, Borrow: 0.5},
+		RouteLimit:     &RouteLimitConfig{MaxQueueSize: 1, MaxQueueWait: 0.1, ReqsPerMinute: 2, TokensPerMinute: 60000},
+	}, &MockHttpClient{})
+	handler := openai.GetHandler()
+
+	send := func() int {
+		body := []byte(fmt.Sprintf(`{"model": "%s", "prompt": "test", "max_tokens": 10}`, TEST_MODEL))
+		r := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewBuffer(body))
+		r.Header.Set("OpenAI-Organization", "org-a")
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	// A request the route turns away gives back the capacity of the scope and of the pool it shares
+	assert.Equal(t, http.StatusOK, send())
+	assert.Equal(t, http.StatusOK, send())
+	assert.Equal(t, http.StatusTooManyRequests, send())
+	a, _ := openai.scopes.Get("org-a")
+	assert.InDelta(t, 3, a.schedulers[TEST_MODEL].Snapshot().RequestCapacity, 0.5)
+	assert.InDelta(t, 8, openai.schedulers[TEST_MODEL].Snapshot().RequestCapacity, 0.5)
+
+	// Batch scopes borrow from the batch pool too
+	openai.scopeQuota.rebalance()
+	assert.Equal(t, 10.0, a.batchSchedulers[TEST_MODEL].Limits().ReqsPerMinute)
+
+	// Limits the upstream reports for the pool are carried over to the scopes' shares
+	openai.schedulers[TEST_MODEL].SetLimits(SchedulerLimits{ReqsPerMinute: 4, TokensPerMinute: 60000})
+	openai.schedulers[TEST_MODEL].setCapacity(0, 60000)
+	openai.scopeQuota.rebalance()
+	assert.Equal(t, 2.0, a.schedulers[TEST_MODEL].Limits().ReqsPerMinute)
+}
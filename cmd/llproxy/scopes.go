@@ -0,0 +1,176 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Scopes are created from request headers, so cap how many schedulers a caller can make us start
+const maxSchedulerScopes = 100
+
+// schedulerScopes gives each combination of the scope headers, e.g. OpenAI-Organization and OpenAI-Project,
+// its own schedulers configured like the route's models, so separately billed quotas aren't merged into one bucket.
+// Requests without any of the headers use the route's own schedulers, as do those whose scope isn't one of the
+// configured values when there are any.
+type schedulerScopes struct {
+	provider    string
+	headers     []string
+	values      map[string]bool
+	models      map[string]ModelConfig
+	batchModels map[string]ModelConfig
+
+	mu     sync.Mutex
+	scopes map[string]*scopedSchedulers
+}
+
+type scopedSchedulers struct {
+	schedulers      SchedulerMap
+	batchSchedulers SchedulerMap
+}
+
+// newSchedulerScopes returns nil when the route isn't scoped
+func newSchedulerScopes(config *RouteConfig) *schedulerScopes {
+	if len(config.SchedulerScope) == 0 {
+		return nil
+	}
+	var values map[string]bool
+	if len(config.SchedulerScopeValues) > 0 {
+		values = make(map[string]bool, len(config.SchedulerScopeValues))
+		for _, value := range config.SchedulerScopeValues {
+			values[value] = true
+		}
+	}
+	return &schedulerScopes{
+		provider:    config.Provider,
+		headers:     config.SchedulerScope,
+		values:      values,
+		models:      config.ScopeQuota.scaled(config.Models),
+		batchModels: config.ScopeQuota.scaled(config.BatchModels),
+		scopes:      make(map[string]*scopedSchedulers),
+	}
+}
+
+// Key identifies the request's scope, it's empty when none of the headers were sent or the scope isn't configured
+func (s *schedulerScopes) Key(r *http.Request) string {
+	if s == nil {
+		return ""
+	}
+	values := make([]string, len(s.headers))
+	empty := true
+	for i, header := range s.headers {
+		values[i] = r.Header.Get(header)
+		empty = empty && values[i] == ""
+	}
+	if empty {
+		return ""
+	}
+	key := strings.Join(values, "/")
+	if s.values != nil && !s.values[key] {
+		return ""
+	}
+	return key
+}
+
+// Get returns the schedulers for a scope, starting them on first use
+func (s *schedulerScopes) Get(key string) (*scopedSchedulers, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if scoped, ok := s.scopes[key]; ok {
+		return scoped, true
+	}
+	if len(s.scopes) >= maxSchedulerScopes {
+		zap.S().Warnw("Too many scheduler scopes, using the route's schedulers", "scope", key, "limit", maxSchedulerScopes)
+		return nil, false
+	}
+
+	zap.S().Infow("Creating scheduler scope", "provider", s.provider, "scope", key)
+	scoped := &scopedSchedulers{
+		schedulers:      initScopedSchedulers(s.provider, key, s.models),
+		batchSchedulers: initScopedSchedulers(s.provider, key, s.batchModels),
+	}
+	peers.Apply(scoped.schedulers)
+	peers.Apply(scoped.batchSchedulers)
+	s.scopes[key] = scoped
+	return scoped, true
+}
+
+// Lookup returns the schedulers for a scope without creating it. A scope that hasn't been used yet is given
+// schedulers that aren't started, showing what it would start with.
+func (s *schedulerScopes) Lookup(key string) (*scopedSchedulers, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if scoped, ok := s.scopes[key]; ok {
+		return scoped, true
+	}
+	if len(s.scopes) >= maxSchedulerScopes {
+		return nil, false
+	}
+	scoped := &scopedSchedulers{schedulers: make(SchedulerMap), batchSchedulers: make(SchedulerMap)}
+	for name, config := range s.models {
+		scoped.schedulers[name] = NewScheduler(s.provider, name, config)
+		scoped.schedulers[name].Scope = key
+	}
+	for name, config := range s.batchModels {
+		scoped.batchSchedulers[name] = NewScheduler(s.provider, name, config)
+		scoped.batchSchedulers[name].Scope = key
+	}
+	peers.Apply(scoped.schedulers)
+	peers.Apply(scoped.batchSchedulers)
+	return scoped, true
+}
+
+// All returns the schedulers of every scope created so far, by scope
+func (s *schedulerScopes) All() []SchedulerMap {
+	return s.all(false)
+}
+
+// AllBatch returns the batch schedulers of every scope created so far, by scope
+func (s *schedulerScopes) AllBatch() []SchedulerMap {
+	return s.all(true)
+}
+
+func (s *schedulerScopes) all(batch bool) []SchedulerMap {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.scopes))
+	for key := range s.scopes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	all := make([]SchedulerMap, 0, len(keys))
+	for _, key := range keys {
+		if batch {
+			all = append(all, s.scopes[key].batchSchedulers)
+		} else {
+			all = append(all, s.scopes[key].schedulers)
+		}
+	}
+	return all
+}
@@ -0,0 +1,194 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkoukk/tiktoken-go"
+)
+
+// How long each of the self-test's lookups and probes may take
+const selfTestTimeout = 10 * time.Second
+
+// SelfTestCheck is one thing the self-test verified, e.g. that an upstream's host resolves
+type SelfTestCheck struct {
+	Check    string  `json:"check"`
+	Route    string  `json:"route,omitempty"`
+	Target   string  `json:"target,omitempty"`
+	Passed   bool    `json:"passed"`
+	Message  string  `json:"message,omitempty"`
+	Duration float64 `json:"duration"`
+}
+
+// SelfTestReport is whether every check passed, and each of them
+type SelfTestReport struct {
+	Passed bool            `json:"passed"`
+	Checks []SelfTestCheck `json:"checks"`
+}
+
+func (r *SelfTestReport) add(check SelfTestCheck, start time.Time) {
+	check.Duration = time.Since(start).Seconds()
+	r.Checks = append(r.Checks, check)
+	r.Passed = r.Passed && check.Passed
+}
+
+// selfTestCommand loads the config the server would, checks it can serve with it and prints the report,
+// returning the exit code: 0 when every check passed, 1 otherwise
+func selfTestCommand(load func() Config) int {
+	report := SelfTestReport{Passed: true, Checks: []SelfTestCheck{}}
+	config, ok := selfTestConfig(&report, load)
+	if ok {
+		ConfigureTokenizer(config.Application.TokenizerDir, config.Routes)
+		report = runSelfTest(context.Background(), &config, report, newUpstreamClient(config.Application.UpstreamConnections), net.DefaultResolver)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+	if !report.Passed {
+		return 1
+	}
+	return 0
+}
+
+// selfTestConfig loads the config, recording the panic of one that isn't valid as a failed check
+func selfTestConfig(report *SelfTestReport, load func() Config) (config Config, ok bool) {
+	start := time.Now()
+	defer func() {
+		if err := recover(); err != nil {
+			report.add(SelfTestCheck{Check: "config", Message: fmt.Sprint(err)}, start)
+			ok = false
+		}
+	}()
+	config = load()
+	report.add(SelfTestCheck{Check: "config", Target: config.source, Passed: true}, start)
+	return config, true
+}
+
+// runSelfTest resolves and probes every route's upstreams and loads the tokenizer of every model, adding what
+// it found to the report
+func runSelfTest(ctx context.Context, config *Config, report SelfTestReport, client HttpClient, resolver *net.Resolver) SelfTestReport {
+	for _, route := range sortedModels(config.Routes) {
+		routeConfig := config.Routes[route]
+		for _, upstream := range upstreamURLs(&routeConfig) {
+			start := time.Now()
+			if err := selfTestResolve(ctx, resolver, upstream); err != nil {
+				report.add(SelfTestCheck{Check: "dns", Route: route, Target: upstream, Message: err.Error()}, start)
+				continue
+			}
+			report.add(SelfTestCheck{Check: "dns", Route: route, Target: upstream, Passed: true}, start)
+
+			start = time.Now()
+			message, err := selfTestProbe(ctx, client, &routeConfig, upstream)
+			check := SelfTestCheck{Check: "upstream", Route: route, Target: upstream, Passed: err == nil, Message: message}
+			if err != nil {
+				check.Message = err.Error()
+			}
+			report.add(check, start)
+		}
+
+		for _, model := range sortedModels(routeConfig.Models) {
+			encoding, ok := tiktokenEncoding(model)
+			if !ok {
+				continue
+			}
+			start := time.Now()
+			check := SelfTestCheck{Check: "tokenizer", Route: route, Target: model, Passed: true, Message: encoding}
+			if _, err := tiktoken.GetEncoding(encoding); err != nil {
+				check.Passed, check.Message = false, fmt.Sprintf("%s: %v", encoding, err)
+			}
+			report.add(check, start)
+		}
+	}
+	return report
+}
+
+// selfTestResolve looks up the upstream's host, unless it's an address already
+func selfTestResolve(ctx context.Context, resolver *net.Resolver, upstream string) error {
+	parsed, err := url.Parse(upstream)
+	if err != nil {
+		return err
+	}
+	host := parsed.Hostname()
+	if host == "" {
+		return fmt.Errorf("no host in upstream '%s'", upstream)
+	}
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+	_, err = resolver.LookupHost(ctx, host)
+	return err
+}
+
+// selfTestProbe lists the upstream's models with the route's own key. Without one clients' keys are forwarded,
+// so all it can show is that the upstream answers.
+func selfTestProbe(ctx context.Context, client HttpClient, config *RouteConfig, upstream string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(newPathRewriter(config.Paths).Base(upstream), "/")+"/v1/models", nil)
+	if err != nil {
+		return "", err
+	}
+	req = newAPIVersions(config.APIVersion).Apply(req)
+	newAnthropicHeaders(config.Anthropic).Apply(req)
+	key := newUpstreamCredentials(config).For("", false)
+	if key == "" && config.APIKeyPool != nil && len(config.APIKeyPool.KeyEnvs) > 0 {
+		key = os.Getenv(config.APIKeyPool.KeyEnvs[0])
+	}
+	if key != "" {
+		setCredential(req.Header, key)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	switch {
+	case key == "" && resp.StatusCode < http.StatusInternalServerError:
+		return fmt.Sprintf("answered %d, not authenticated as the route has no key of its own", resp.StatusCode), nil
+	case resp.StatusCode >= http.StatusMultipleChoices:
+		return "", fmt.Errorf("answered %d", resp.StatusCode)
+	}
+	return fmt.Sprintf("answered %d", resp.StatusCode), nil
+}
+
+// getSelfTest runs the self-test against the running config, answering 503 if any check failed
+func getSelfTest(c *Config, client HttpClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := SelfTestReport{Passed: true, Checks: []SelfTestCheck{{Check: "config", Target: c.source, Passed: true}}}
+		report = runSelfTest(r.Context(), c, report, client, net.DefaultResolver)
+		if !report.Passed {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		writeJSON(w, report)
+	}
+}
@@ -0,0 +1,71 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelfTest(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/models" || r.Header.Get("Authorization") != "Bearer sk-good" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer upstream.Close()
+	t.Setenv("SELFTEST_GOOD_KEY", "sk-good")
+	t.Setenv("SELFTEST_BAD_KEY", "sk-bad")
+
+	config := &Config{Routes: map[string]RouteConfig{
+		"good":        {Forward: upstream.URL, APIKeyEnv: "SELFTEST_GOOD_KEY", Models: map[string]ModelConfig{"claude-2": {}}},
+		"bad":         {Forward: upstream.URL, APIKeyEnv: "SELFTEST_BAD_KEY"},
+		"passthrough": {Forward: upstream.URL},
+		"unresolved":  {Forward: "https://upstream.example.com"},
+	}}
+	resolver := &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, errors.New("no DNS here")
+	}}
+	report := runSelfTest(context.Background(), config, SelfTestReport{Passed: true}, http.DefaultClient, resolver)
+	assert.False(t, report.Passed)
+
+	results := map[string]bool{}
+	for _, check := range report.Checks {
+		results[check.Route+" "+check.Check] = check.Passed
+	}
+	assert.Equal(t, map[string]bool{
+		"bad dns":              true,
+		"bad upstream":         false,
+		"good dns":             true,
+		"good upstream":        true,
+		"passthrough dns":      true,
+		"passthrough upstream": true,
+		"unresolved dns":       false,
+	}, results)
+
+	// A config that doesn't load fails the self-test without going further
+	report = SelfTestReport{Passed: true}
+	_, ok := selfTestConfig(&report, func() Config { panic("Route 'openai': invalid") })
+	assert.False(t, ok)
+	assert.False(t, report.Passed)
+	assert.Equal(t, "Route 'openai': invalid", report.Checks[0].Message)
+}
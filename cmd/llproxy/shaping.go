@@ -0,0 +1,148 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"time"
+)
+
+// StreamShapingConfig throttles how fast streamed responses are passed on to each client, so one client reading
+// a very fast backend can't monopolize bandwidth, and bursty delivery is smoothed out
+type StreamShapingConfig struct {
+	// TokensPerSecond limits the events of an event stream, each of which carries about one token
+	TokensPerSecond float64 `json:"tokensPerSecond"`
+
+	// BytesPerSecond limits the bytes of the stream
+	BytesPerSecond float64 `json:"bytesPerSecond"`
+
+	// Burst is how many seconds worth of output can be sent at once, 1 when unset
+	Burst float64 `json:"burst"`
+}
+
+// streamShaper applies a route's StreamShapingConfig, a nil streamShaper doesn't throttle
+type streamShaper struct {
+	config StreamShapingConfig
+}
+
+func newStreamShaper(config *StreamShapingConfig) *streamShaper {
+	if config == nil || (config.TokensPerSecond <= 0 && config.BytesPerSecond <= 0) {
+		return nil
+	}
+	shaper := &streamShaper{config: *config}
+	if shaper.config.Burst <= 0 {
+		shaper.config.Burst = 1
+	}
+	return shaper
+}
+
+// Hook returns a ResponseHook throttling event stream responses, until ctx is done
+func (s *streamShaper) Hook(ctx context.Context) ResponseHook {
+	if s == nil {
+		return nil
+	}
+	return func(resp *http.Response) {
+		if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/event-stream" {
+			return
+		}
+		now := time.Now()
+		resp.Body = &shapedBody{
+			ReadCloser: resp.Body,
+			ctx:        ctx,
+			events:     newPacer(s.config.TokensPerSecond, s.config.Burst, now),
+			bytes:      newPacer(s.config.BytesPerSecond, s.config.Burst, now),
+		}
+	}
+}
+
+// pacer is a token bucket, a nil pacer never waits
+type pacer struct {
+	rate      float64
+	burst     float64
+	available float64
+	updated   time.Time
+}
+
+func newPacer(rate float64, burstSeconds float64, now time.Time) *pacer {
+	if rate <= 0 {
+		return nil
+	}
+	burst := math.Max(1, rate*burstSeconds)
+	return &pacer{rate: rate, burst: burst, available: burst, updated: now}
+}
+
+// Take uses n and returns how long to wait before the bucket is no longer in debt
+func (p *pacer) Take(n float64, now time.Time) time.Duration {
+	if p == nil {
+		return 0
+	}
+	p.available = math.Min(p.burst, p.available+now.Sub(p.updated).Seconds()*p.rate)
+	p.updated = now
+	p.available -= n
+	if p.available >= 0 {
+		return 0
+	}
+	return time.Duration(-p.available / p.rate * float64(time.Second))
+}
+
+// shapedBody delays each read of a stream until it's within the configured rates
+type shapedBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	events *pacer
+	bytes  *pacer
+	last   byte
+}
+
+func (s *shapedBody) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	if n == 0 {
+		return n, err
+	}
+
+	// Events end with a blank line, which may be split across reads
+	events := 0
+	for _, b := range p[:n] {
+		if b == '\r' {
+			continue
+		}
+		if b == '\n' && s.last == '\n' {
+			events++
+		}
+		s.last = b
+	}
+
+	now := time.Now()
+	wait := s.events.Take(float64(events), now)
+	if bytesWait := s.bytes.Take(float64(n), now); bytesWait > wait {
+		wait = bytesWait
+	}
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-s.ctx.Done():
+			return n, s.ctx.Err()
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,66 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPacer(t *testing.T) {
+	now := time.Now()
+	p := newPacer(10, 1, now)
+	assert.Equal(t, time.Duration(0), p.Take(10, now))
+	assert.Equal(t, 500*time.Millisecond, p.Take(5, now))
+
+	// Debt is paid back at the rate
+	assert.Equal(t, time.Duration(0), p.Take(0, now.Add(500*time.Millisecond)))
+	assert.Nil(t, newPacer(0, 1, now))
+}
+
+func TestStreamShaping(t *testing.T) {
+	shaper := newStreamShaper(&StreamShapingConfig{TokensPerSecond: 100, Burst: 0.05})
+	stream := strings.Repeat("data: {\"choices\": []}\r\n\r\n", 10)
+
+	resp := &http.Response{
+		Header: http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body:   ioutil.NopCloser(iotest.HalfReader(strings.NewReader(stream))),
+	}
+	shaper.Hook(context.Background())(resp)
+
+	// Five events are sent straight away and the other five at 100 a second
+	start := time.Now()
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, stream, string(body))
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// Other responses aren't throttled
+	resp = &http.Response{Header: http.Header{"Content-Type": []string{"application/json"}}, Body: ioutil.NopCloser(strings.NewReader("{}"))}
+	shaper.Hook(context.Background())(resp)
+	_, ok := resp.Body.(*shapedBody)
+	assert.False(t, ok)
+	assert.Nil(t, newStreamShaper(&StreamShapingConfig{}))
+}
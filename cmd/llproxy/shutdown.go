@@ -0,0 +1,54 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// What to do with a second signal while draining
+const (
+	SecondSignalExit   = "exit"
+	SecondSignalIgnore = "ignore"
+)
+
+// The drain timeout when none is configured
+const defaultDrainTimeout = 45
+
+// ShutdownConfig controls how the proxy drains once it's asked to stop
+type ShutdownConfig struct {
+	// DrainTimeout is how many seconds in flight requests are given to finish
+	DrainTimeout float64 `json:"drainTimeout"`
+
+	// SecondSignal is "exit" to stop immediately on a second signal, or "ignore" to keep draining
+	SecondSignal string `json:"secondSignal"`
+
+	// RejectQueued answers requests still waiting for capacity with a 429 rather than waiting for them
+	RejectQueued bool `json:"rejectQueued"`
+}
+
+func (c ShutdownConfig) drainTimeout() time.Duration {
+	return time.Duration(c.DrainTimeout * float64(time.Second))
+}
+
+// queuesClosed is set while shutting down to turn away queued requests, and any that would have to queue
+var queuesClosed atomic.Bool
+
+func closeQueues() {
+	queuesClosed.Store(true)
+}
@@ -0,0 +1,201 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Defaults for scheduler snapshots, in seconds
+const (
+	defaultSnapshotInterval = 10
+	defaultSnapshotMaxAge   = 300
+)
+
+// SchedulerSnapshotConfig keeps the schedulers' capacity in a file across restarts, so a quick restart doesn't
+// start with full capacity and overrun upstream limits the previous process had nearly used up
+type SchedulerSnapshotConfig struct {
+	// File the capacity is written to and restored from, e.g. on a volume that outlives the container
+	Path string `json:"path"`
+
+	// Seconds between writes, 10 when unset, and the oldest snapshot still restored, 300 when unset
+	Interval float64 `json:"interval"`
+	MaxAge   float64 `json:"maxAge"`
+}
+
+func (c *SchedulerSnapshotConfig) validate() error {
+	if c.Path == "" {
+		return fmt.Errorf("schedulerSnapshot requires a path")
+	}
+	if c.Interval < 0 || c.MaxAge < 0 {
+		return fmt.Errorf("schedulerSnapshot interval and maxAge can't be negative")
+	}
+	return nil
+}
+
+// SchedulerSnapshot is the capacity of every scheduler at a point in time, as written to the snapshot file
+type SchedulerSnapshot struct {
+	Time       time.Time           `json:"time"`
+	Schedulers []SchedulerCapacity `json:"schedulers"`
+}
+
+// SchedulerCapacity is the capacity one scheduler had left
+type SchedulerCapacity struct {
+	Route    string  `json:"route"`
+	Model    string  `json:"model"`
+	Scope    string  `json:"scope,omitempty"`
+	Requests float64 `json:"requests"`
+	Tokens   float64 `json:"tokens"`
+}
+
+// snapshotter periodically writes the schedulers' capacity to a file and restores it on startup
+type snapshotter struct {
+	config    SchedulerSnapshotConfig
+	interval  time.Duration
+	maxAge    time.Duration
+	providers Providers
+}
+
+// The scheduler snapshots, nil when disabled
+var snapshots *snapshotter
+
+func newSnapshotter(config *SchedulerSnapshotConfig, providers Providers) *snapshotter {
+	if config == nil {
+		return nil
+	}
+	s := &snapshotter{
+		config:    *config,
+		interval:  time.Duration(config.Interval * float64(time.Second)),
+		maxAge:    time.Duration(config.MaxAge * float64(time.Second)),
+		providers: providers,
+	}
+	if s.interval == 0 {
+		s.interval = defaultSnapshotInterval * time.Second
+	}
+	if s.maxAge == 0 {
+		s.maxAge = defaultSnapshotMaxAge * time.Second
+	}
+	return s
+}
+
+func (s *snapshotter) Run() {
+	if s == nil {
+		return
+	}
+	for range time.Tick(s.interval) {
+		s.Save()
+	}
+}
+
+// take returns the current capacity of every scheduler
+func (s *snapshotter) take(now time.Time) SchedulerSnapshot {
+	snapshot := SchedulerSnapshot{Time: now, Schedulers: []SchedulerCapacity{}}
+	forEachScheduler(s.providers, func(route string, scheduler *Scheduler) {
+		state := scheduler.Snapshot()
+		snapshot.Schedulers = append(snapshot.Schedulers, SchedulerCapacity{
+			Route:    route,
+			Model:    scheduler.Name,
+			Scope:    scheduler.Scope,
+			Requests: state.RequestCapacity,
+			Tokens:   state.TokenCapacity,
+		})
+	})
+	return snapshot
+}
+
+// Save writes the schedulers' capacity, replacing the previous snapshot only once the new one is complete
+func (s *snapshotter) Save() {
+	if s == nil {
+		return
+	}
+	data, err := json.Marshal(s.take(time.Now()))
+	if err != nil {
+		zap.S().Errorw("Unable to encode scheduler snapshot", "reason", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(s.config.Path), 0o755); err != nil {
+		zap.S().Errorw("Unable to create scheduler snapshot directory", "path", s.config.Path, "reason", err)
+		return
+	}
+	temp := s.config.Path + ".tmp"
+	if err := os.WriteFile(temp, data, 0o644); err != nil {
+		zap.S().Errorw("Unable to write scheduler snapshot", "path", temp, "reason", err)
+		return
+	}
+	if err := os.Rename(temp, s.config.Path); err != nil {
+		zap.S().Errorw("Unable to replace scheduler snapshot", "path", s.config.Path, "reason", err)
+	}
+}
+
+// Restore lowers every scheduler's capacity to what it had in the last snapshot, plus what it would have recovered
+// since. Schedulers never start with more than they would have without a snapshot, and snapshots older than maxAge,
+// by which time every scheduler would have recovered anyway, are ignored.
+func (s *snapshotter) Restore() {
+	if s == nil {
+		return
+	}
+	data, err := os.ReadFile(s.config.Path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		zap.S().Warnw("Unable to read scheduler snapshot", "path", s.config.Path, "reason", err)
+		return
+	}
+	var snapshot SchedulerSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		zap.S().Warnw("Unable to parse scheduler snapshot", "path", s.config.Path, "reason", err)
+		return
+	}
+	s.restore(snapshot, time.Now())
+}
+
+func (s *snapshotter) restore(snapshot SchedulerSnapshot, now time.Time) {
+	// A snapshot from the future, written by a host whose clock is ahead or before the wall clock stepped back,
+	// is taken as just written
+	age := now.Sub(snapshot.Time)
+	if age < 0 {
+		age = 0
+	}
+	if age > s.maxAge {
+		zap.S().Infow("Ignoring stale scheduler snapshot", "path", s.config.Path, "age", age)
+		return
+	}
+	saved := make(map[SchedulerCapacity]SchedulerCapacity, len(snapshot.Schedulers))
+	for _, capacity := range snapshot.Schedulers {
+		saved[SchedulerCapacity{Route: capacity.Route, Model: capacity.Model, Scope: capacity.Scope}] = capacity
+	}
+
+	restored := 0
+	minutes := age.Minutes()
+	forEachScheduler(s.providers, func(route string, scheduler *Scheduler) {
+		capacity, ok := saved[SchedulerCapacity{Route: route, Model: scheduler.Name, Scope: scheduler.Scope}]
+		if !ok {
+			return
+		}
+		limits := scheduler.Limits()
+		scheduler.lowerCapacity(capacity.Requests+minutes*limits.ReqsPerMinute, capacity.Tokens+minutes*limits.TokensPerMinute)
+		restored++
+	})
+	zap.S().Infow("Restored scheduler snapshot", "path", s.config.Path, "age", age, "schedulers", restored)
+}
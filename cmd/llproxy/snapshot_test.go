@@ -0,0 +1,75 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedulerSnapshot(t *testing.T) {
+	newProviders := func() (Providers, *Scheduler) {
+		openai := NewOpenAI(&RouteConfig{
+			Forward:  FAKE_BASE_URL,
+			Provider: "openai",
+			Models: map[string]ModelConfig{
+				TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60, TokensPerMinute: 60000},
+			},
+		}, &MockHttpClient{})
+		return Providers{"openai": openai}, openai.Schedulers()[TEST_MODEL]
+	}
+	config := &SchedulerSnapshotConfig{Path: filepath.Join(t.TempDir(), "state", "schedulers.json")}
+
+	// Nothing to restore before the first snapshot is written
+	providers, scheduler := newProviders()
+	newSnapshotter(config, providers).Restore()
+	assert.InDelta(t, 60000, scheduler.Snapshot().TokenCapacity, 100)
+
+	scheduler.setCapacity(10, 1000)
+	newSnapshotter(config, providers).Save()
+
+	// A restarted process starts with what was left, plus what has recovered since
+	providers, scheduler = newProviders()
+	newSnapshotter(config, providers).Restore()
+	assert.InDelta(t, 10, scheduler.Snapshot().RequestCapacity, 1)
+	assert.InDelta(t, 1000, scheduler.Snapshot().TokenCapacity, 100)
+
+	providers, scheduler = newProviders()
+	snapshots := newSnapshotter(config, providers)
+	snapshot := SchedulerSnapshot{Time: time.Now().Add(-30 * time.Second), Schedulers: []SchedulerCapacity{
+		{Route: "openai", Model: TEST_MODEL, Requests: 10, Tokens: 1000},
+		{Route: "gone", Model: TEST_MODEL, Requests: 0, Tokens: 0},
+	}}
+	snapshots.restore(snapshot, time.Now())
+	assert.InDelta(t, 40, scheduler.Snapshot().RequestCapacity, 1)
+	assert.InDelta(t, 31000, scheduler.Snapshot().TokenCapacity, 100)
+
+	// Snapshots from the future restore what was saved, not less
+	providers, scheduler = newProviders()
+	snapshot.Time = time.Now().Add(10 * time.Minute)
+	newSnapshotter(config, providers).restore(snapshot, time.Now())
+	assert.InDelta(t, 10, scheduler.Snapshot().RequestCapacity, 1)
+	assert.InDelta(t, 1000, scheduler.Snapshot().TokenCapacity, 100)
+
+	// Stale snapshots are ignored
+	providers, scheduler = newProviders()
+	snapshot.Time = time.Now().Add(-time.Hour)
+	newSnapshotter(config, providers).restore(snapshot, time.Now())
+	assert.InDelta(t, 60000, scheduler.Snapshot().TokenCapacity, 100)
+}
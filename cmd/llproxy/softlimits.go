@@ -0,0 +1,83 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// HeaderLimitWarning lists the soft limits a request was admitted over, e.g. "tpm=52000/50000"
+const HeaderLimitWarning = "X-LLProxy-Limit-Warning"
+
+// SoftLimitConfig sets thresholds below a model's rpm and tpm. Requests over them are still admitted,
+// with a warning header and log, so a new limit can be watched in "warn" mode before it is enforced.
+type SoftLimitConfig struct {
+	ReqsPerMinute   float64 `json:"rpm"`
+	TokensPerMinute float64 `json:"tpm"`
+}
+
+func (c *SoftLimitConfig) validate(config ModelConfig) error {
+	if c.ReqsPerMinute < 0 || c.TokensPerMinute < 0 {
+		return fmt.Errorf("has a negative soft limit")
+	}
+	if c.ReqsPerMinute > config.ReqsPerMinute || c.TokensPerMinute > config.TokensPerMinute {
+		return fmt.Errorf("has a soft limit above its rpm or tpm, which would never be reached")
+	}
+	return nil
+}
+
+// softLimitWarnings returns the soft limits the scheduler's use over the last minute is above, the admitted request included
+func (scheduler *Scheduler) softLimitWarnings() []string {
+	soft := scheduler.Config.SoftLimits
+	if soft == nil {
+		return nil
+	}
+	snapshot, limits := scheduler.Snapshot(), scheduler.Limits()
+
+	var warnings []string
+	if soft.ReqsPerMinute > 0 {
+		if used := limits.ReqsPerMinute - snapshot.RequestCapacity; used > soft.ReqsPerMinute {
+			warnings = append(warnings, fmt.Sprintf("rpm=%.0f/%.0f", math.Ceil(used), soft.ReqsPerMinute))
+		}
+	}
+	if soft.TokensPerMinute > 0 {
+		if used := limits.TokensPerMinute - snapshot.TokenCapacity; used > soft.TokensPerMinute {
+			warnings = append(warnings, fmt.Sprintf("tpm=%.0f/%.0f", math.Ceil(used), soft.TokensPerMinute))
+		}
+	}
+	return warnings
+}
+
+// softLimitHook warns an admitted request's client when the scheduler is over its soft limits, nil when it isn't
+func softLimitHook(r *http.Request, scheduler *Scheduler) func(*http.Response) {
+	warnings := scheduler.softLimitWarnings()
+	if len(warnings) == 0 {
+		return nil
+	}
+	scheduler.overSoftLimit.Add(1)
+	zap.S().Warnw("Soft limit exceeded", "url", r.URL, "scheduler", scheduler.Name, "scope", scheduler.Scope, "limits", warnings)
+
+	warning := strings.Join(warnings, ", ")
+	return func(resp *http.Response) {
+		resp.Header.Set(HeaderLimitWarning, warning)
+	}
+}
@@ -0,0 +1,59 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSoftLimits(t *testing.T) {
+	config := ModelConfig{ReqsPerMinute: 60, TokensPerMinute: 60000}
+	assert.NoError(t, (&SoftLimitConfig{TokensPerMinute: 50000}).validate(config))
+	assert.Error(t, (&SoftLimitConfig{TokensPerMinute: 70000}).validate(config))
+	assert.Error(t, (&SoftLimitConfig{ReqsPerMinute: -1}).validate(config))
+
+	openai := NewOpenAI(&RouteConfig{
+		Forward:  FAKE_BASE_URL,
+		Provider: "openai",
+		Models: map[string]ModelConfig{
+			TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60, TokensPerMinute: 60000, SoftLimits: &SoftLimitConfig{TokensPerMinute: 1000}},
+		},
+	}, &MockHttpClient{})
+	scheduler := openai.schedulers[TEST_MODEL]
+	scheduler.setCapacity(60, 60000)
+	handler := openai.GetHandler()
+
+	// Under the soft limit nothing is said
+	body := []byte(`{"model": "gpt-3.5-turbo", "prompt": "` + strings.Repeat("a", 2000) + `", "max_tokens": 100}`)
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewBuffer(body)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get(HeaderLimitWarning))
+
+	// Over it the request is still served, with a warning
+	body = []byte(`{"model": "gpt-3.5-turbo", "prompt": "` + strings.Repeat("a", 2000) + `", "max_tokens": 500}`)
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewBuffer(body)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Regexp(t, `^tpm=\d+/1000$`, w.Header().Get(HeaderLimitWarning))
+	assert.Equal(t, uint64(1), scheduler.overSoftLimit.Load())
+}
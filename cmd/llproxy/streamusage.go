@@ -0,0 +1,142 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// includeStreamUsage asks for the usage of a streamed chat completion, if the request didn't already,
+// returning true when the usage chunk will have to be removed again for the client.
+// Bodies that aren't a JSON object are left for the parser to reject.
+func includeStreamUsage(r *http.Request) (bool, error) {
+	if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, "/chat/completions") {
+		return false, nil
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		return false, nil
+	}
+
+	original, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(original))
+	if err != nil {
+		return false, err
+	}
+
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(original, &fields) != nil || fields == nil {
+		return false, nil
+	}
+	var stream bool
+	if json.Unmarshal(fields["stream"], &stream) != nil || !stream {
+		return false, nil
+	}
+	var options map[string]json.RawMessage
+	json.Unmarshal(fields["stream_options"], &options)
+	var requested bool
+	if json.Unmarshal(options["include_usage"], &requested) == nil && requested {
+		return false, nil
+	}
+
+	// Any other stream options the client set are kept
+	if options == nil {
+		options = make(map[string]json.RawMessage)
+	}
+	options["include_usage"] = json.RawMessage("true")
+	fields["stream_options"], _ = json.Marshal(options)
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return false, nil
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return true, nil
+}
+
+// stripUsageChunkHook returns a ResponseHook removing the usage chunk from event streams, for clients that didn't ask for it.
+// It has to come after the usage hook, which still sees the chunk.
+func stripUsageChunkHook() ResponseHook {
+	return func(resp *http.Response) {
+		if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/event-stream" {
+			return
+		}
+		resp.Body = &usageChunkStripper{ReadCloser: resp.Body, reader: bufio.NewReader(resp.Body)}
+	}
+}
+
+// usageChunkStripper passes an event stream on an event at a time, leaving out the chunk carrying the usage
+type usageChunkStripper struct {
+	io.ReadCloser
+	reader *bufio.Reader
+	event  []byte
+	out    []byte
+	err    error
+}
+
+func (s *usageChunkStripper) Read(p []byte) (int, error) {
+	for len(s.out) == 0 && s.err == nil {
+		line, err := s.reader.ReadBytes('\n')
+		s.event = append(s.event, line...)
+		if err != nil {
+			// Whatever is left of an unfinished event is passed on as it is
+			s.out, s.event, s.err = s.event, nil, err
+			break
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			if !isUsageChunk(s.event) {
+				s.out = s.event
+			}
+			s.event = nil
+		}
+	}
+
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	if len(s.out) == 0 && s.err != nil {
+		return n, s.err
+	}
+	return n, nil
+}
+
+// isUsageChunk is true for the event include_usage adds, which has usage and no choices
+func isUsageChunk(event []byte) bool {
+	for _, line := range bytes.Split(event, []byte("\n")) {
+		data := bytes.TrimPrefix(bytes.TrimRight(line, "\r"), []byte("data:"))
+		if len(data) == len(line) || !bytes.Contains(data, []byte(`"usage"`)) {
+			continue
+		}
+		var chunk struct {
+			Choices []json.RawMessage `json:"choices"`
+			Usage   *Usage            `json:"usage"`
+		}
+		if json.Unmarshal(data, &chunk) == nil && chunk.Usage != nil && len(chunk.Choices) == 0 {
+			return true
+		}
+	}
+	return false
+}
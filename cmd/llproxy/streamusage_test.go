@@ -0,0 +1,86 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIncludeStreamUsage(t *testing.T) {
+	send := func(path string, body string) (bool, string) {
+		r := httptest.NewRequest("POST", "http://localhost:8080/openai"+path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		strip, err := includeStreamUsage(r)
+		require.NoError(t, err)
+		sent, _ := io.ReadAll(r.Body)
+		assert.Equal(t, int64(len(sent)), r.ContentLength)
+		return strip, string(sent)
+	}
+
+	// Streams are asked for their usage, keeping any other stream options
+	strip, body := send("/v1/chat/completions", `{"model": "gpt-4", "stream": true, "stream_options": {"other": 1}}`)
+	assert.True(t, strip)
+	assert.JSONEq(t, `{"model": "gpt-4", "stream": true, "stream_options": {"other": 1, "include_usage": true}}`, body)
+
+	// Clients that asked for it keep it, and other requests are left alone
+	original := `{"model": "gpt-4", "stream": true, "stream_options": {"include_usage": true}}`
+	strip, body = send("/v1/chat/completions", original)
+	assert.False(t, strip)
+	assert.Equal(t, original, body)
+	for path, original := range map[string]string{
+		"/v1/chat/completions": `{"model": "gpt-4"}`,
+		"/v1/completions":      `{"model": "gpt-3.5-turbo-instruct", "stream": true}`,
+	} {
+		strip, body = send(path, original)
+		assert.False(t, strip)
+		assert.Equal(t, original, body)
+	}
+}
+
+func TestStripUsageChunk(t *testing.T) {
+	stream := "data: {\"choices\": [{\"delta\": {\"content\": \"Hi\"}}], \"usage\": null}\n\n" +
+		"data: {\"choices\": [], \"usage\": {\"prompt_tokens\": 8, \"completion_tokens\": 1, \"total_tokens\": 9}}\n\n" +
+		"data: [DONE]\n\n"
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body:       io.NopCloser(strings.NewReader(stream)),
+	}
+
+	// The usage is still recorded, but the client doesn't see the chunk it came in
+	record := &RequestRecord{}
+	usageHook(record, 10, nil)(resp)
+	stripUsageChunkHook()(resp)
+	sent, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "data: {\"choices\": [{\"delta\": {\"content\": \"Hi\"}}], \"usage\": null}\n\ndata: [DONE]\n\n", string(sent))
+	assert.Equal(t, &Usage{PromptTokens: 8, CompletionTokens: 1, TotalTokens: 9}, record.Usage)
+	assert.Equal(t, "8", resp.Trailer.Get(HeaderPromptTokens))
+
+	// Other responses aren't touched
+	resp = &http.Response{Header: http.Header{"Content-Type": []string{"application/json"}}, Body: io.NopCloser(bytes.NewBufferString("{}"))}
+	body := resp.Body
+	stripUsageChunkHook()(resp)
+	assert.Equal(t, body, resp.Body)
+}
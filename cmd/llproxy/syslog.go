@@ -0,0 +1,322 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// Networks syslog messages can be sent over
+const (
+	SyslogUnix = "unix"
+	SyslogUDP  = "udp"
+	SyslogTCP  = "tcp"
+	SyslogTLS  = "tls"
+)
+
+// Defaults for sending logs to syslog
+const (
+	defaultSyslogFacility = "local0"
+	defaultSyslogAppName  = "llproxy"
+	syslogTimeout         = 2 * time.Second
+	syslogRetryDelay      = 5 * time.Second
+	syslogQueueSize       = 1024
+)
+
+// errSyslogRetryDelay is returned for messages dropped while waiting to connect again
+var errSyslogRetryDelay = errors.New("waiting to connect to syslog again")
+
+// Local sockets tried in turn when no address is given for the unix network
+var syslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// Syslog facilities by name, see RFC 5424 section 6.2.1
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// SyslogConfig also sends logs to syslog as RFC 5424 messages, alongside the configured encoder
+type SyslogConfig struct {
+	// Network is "unix" for the local socket, the default, or "udp", "tcp" or "tls" for a remote server
+	Network string `json:"network"`
+
+	// Address is the remote server's host:port, or the path of the local socket which is looked for when unset
+	Address string `json:"address"`
+
+	// Facility messages are sent with, "local0" when unset, and the APP-NAME they carry, "llproxy" when unset
+	Facility string `json:"facility"`
+	AppName  string `json:"appName"`
+
+	// CAFile holds the PEM certificates a "tls" server is verified with, the system's when unset
+	CAFile string `json:"caFile"`
+}
+
+func (c *SyslogConfig) validate() error {
+	switch c.Network {
+	case "", SyslogUnix:
+	case SyslogUDP, SyslogTCP, SyslogTLS:
+		if _, _, err := net.SplitHostPort(c.Address); err != nil {
+			return fmt.Errorf("Logging syslog address '%s' isn't a host:port: %v", c.Address, err)
+		}
+	default:
+		return fmt.Errorf("Logging syslog network '%s' isn't unix, udp, tcp or tls", c.Network)
+	}
+	if _, ok := syslogFacilities[c.Facility]; c.Facility != "" && !ok {
+		return fmt.Errorf("Logging syslog facility '%s' is unknown", c.Facility)
+	}
+	return nil
+}
+
+// ConfigureSyslog adds a syslog writer to the global logger, in addition to its encoder
+func ConfigureSyslog(config *SyslogConfig) {
+	writer, err := newSyslogWriter(config)
+	if err != nil {
+		panic(err)
+	}
+	addLogOutput(func(core zapcore.Core) zapcore.Core {
+		return newSyslogCore(core, writer)
+	})
+}
+
+// syslogCore is a zapcore.Core encoding every entry as JSON and handing it to a syslogWriter.
+// The time and level go in the syslog header, so the message only carries the log message and fields.
+type syslogCore struct {
+	zapcore.LevelEnabler
+	encoder zapcore.Encoder
+	writer  *syslogWriter
+}
+
+func newSyslogCore(enabler zapcore.LevelEnabler, writer *syslogWriter) *syslogCore {
+	encoder := zapcore.NewJSONEncoder(zapcore.EncoderConfig{
+		MessageKey:     "message",
+		LineEnding:     "\n",
+		EncodeDuration: zapcore.SecondsDurationEncoder,
+	})
+	return &syslogCore{LevelEnabler: enabler, encoder: encoder, writer: writer}
+}
+
+func (c *syslogCore) With(fields []zapcore.Field) zapcore.Core {
+	encoder := c.encoder.Clone()
+	for _, field := range fields {
+		field.AddTo(encoder)
+	}
+	return &syslogCore{LevelEnabler: c.LevelEnabler, encoder: encoder, writer: c.writer}
+}
+
+func (c *syslogCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *syslogCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	buffer, err := c.encoder.EncodeEntry(entry, fields)
+	if err != nil {
+		return err
+	}
+	defer buffer.Free()
+	message := buffer.Bytes()
+	if n := len(message); n > 0 && message[n-1] == '\n' {
+		message = message[:n-1]
+	}
+	return c.writer.Write(entry.Level, entry.Time, message)
+}
+
+func (c *syslogCore) Sync() error {
+	return nil
+}
+
+// syslogWriter sends messages to a syslog server from a queue, so logging never waits on the network, connecting
+// again after a failure. Messages are dropped when the queue is full, and for a while after it couldn't connect,
+// so an unreachable or slow server doesn't hold up requests.
+type syslogWriter struct {
+	network  string
+	address  string
+	facility int
+	appName  string
+	hostname string
+	tls      *tls.Config
+	framing  bool
+
+	queue   chan []byte
+	dropped atomic.Uint64
+
+	// Only used by the goroutine sending the queue
+	conn   net.Conn
+	failed time.Time
+}
+
+func newSyslogWriter(config *SyslogConfig) (*syslogWriter, error) {
+	w := &syslogWriter{
+		network:  config.Network,
+		address:  config.Address,
+		facility: syslogFacilities[defaultSyslogFacility],
+		appName:  config.AppName,
+		hostname: "-",
+		queue:    make(chan []byte, syslogQueueSize),
+	}
+	if w.network == "" {
+		w.network = SyslogUnix
+	}
+	if config.Facility != "" {
+		w.facility = syslogFacilities[config.Facility]
+	}
+	if w.appName == "" {
+		w.appName = defaultSyslogAppName
+	}
+	if host, err := os.Hostname(); err == nil && host != "" {
+		w.hostname = host
+	}
+
+	// Stream transports need each message framed with its length, see RFC 6587 and RFC 5425
+	w.framing = w.network == SyslogTCP || w.network == SyslogTLS
+	if w.network == SyslogTLS {
+		w.tls = &tls.Config{}
+		if config.CAFile != "" {
+			pem, err := os.ReadFile(config.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("Logging syslog caFile: %v", err)
+			}
+			w.tls.RootCAs = x509.NewCertPool()
+			if !w.tls.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("Logging syslog caFile '%s' holds no certificates", config.CAFile)
+			}
+		}
+	}
+	go w.run()
+	return w, nil
+}
+
+// connect opens a connection to the server, or the first local socket that accepts one
+func (w *syslogWriter) connect() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: syslogTimeout}
+	switch w.network {
+	case SyslogTLS:
+		return tls.DialWithDialer(dialer, "tcp", w.address, w.tls)
+	case SyslogUnix:
+		sockets := syslogSockets
+		if w.address != "" {
+			sockets = []string{w.address}
+		}
+		var err error
+		for _, socket := range sockets {
+			for _, network := range []string{"unixgram", "unix"} {
+				var conn net.Conn
+				if conn, err = dialer.Dial(network, socket); err == nil {
+					return conn, nil
+				}
+			}
+		}
+		return nil, err
+	default:
+		return dialer.Dial(w.network, w.address)
+	}
+}
+
+// Write queues a message with the syslog header for its level and time, dropping it if the queue is full
+func (w *syslogWriter) Write(level zapcore.Level, t time.Time, message []byte) error {
+	select {
+	case w.queue <- w.format(level, t, message):
+	default:
+		w.dropped.Add(1)
+	}
+	return nil
+}
+
+// run sends the queued messages, reporting how many were dropped once it's able to send again
+func (w *syslogWriter) run() {
+	for packet := range w.queue {
+		if err := w.send(packet); err != nil {
+			if err != errSyslogRetryDelay {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			continue
+		}
+		if dropped := w.dropped.Swap(0); dropped > 0 {
+			message := fmt.Sprintf(`{"message": "Dropped syslog messages", "dropped": %d}`, dropped)
+			w.send(w.format(zapcore.WarnLevel, time.Now(), []byte(message)))
+		}
+	}
+}
+
+// send writes a message to the server, connecting first if needed
+func (w *syslogWriter) send(packet []byte) error {
+	for attempt := 0; attempt < 2; attempt++ {
+		if w.conn == nil {
+			if time.Since(w.failed) < syslogRetryDelay {
+				w.dropped.Add(1)
+				return errSyslogRetryDelay
+			}
+			conn, err := w.connect()
+			if err != nil {
+				w.failed = time.Now()
+				w.dropped.Add(1)
+				return fmt.Errorf("Unable to connect to syslog: %v", err)
+			}
+			w.conn = conn
+		}
+		w.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+		if _, err := w.conn.Write(packet); err == nil {
+			return nil
+		}
+
+		// The server may have gone away, so connect again once before dropping the message
+		w.conn.Close()
+		w.conn = nil
+	}
+	w.dropped.Add(1)
+	return fmt.Errorf("Unable to write to syslog")
+}
+
+// format returns an RFC 5424 message, framed by its length on stream transports
+func (w *syslogWriter) format(level zapcore.Level, t time.Time, message []byte) []byte {
+	header := fmt.Sprintf("<%d>1 %s %s %s %d - - ", w.facility*8+syslogSeverity(level),
+		t.Format("2006-01-02T15:04:05.000000Z07:00"), w.hostname, w.appName, os.Getpid())
+	packet := append([]byte(header), message...)
+	if w.framing {
+		packet = append([]byte(strconv.Itoa(len(packet))+" "), packet...)
+	}
+	return packet
+}
+
+// syslogSeverity maps zap's levels to syslog severities, see RFC 5424 section 6.2.1
+func syslogSeverity(level zapcore.Level) int {
+	switch {
+	case level >= zapcore.DPanicLevel:
+		return 2
+	case level >= zapcore.ErrorLevel:
+		return 3
+	case level >= zapcore.WarnLevel:
+		return 4
+	case level >= zapcore.InfoLevel:
+		return 6
+	default:
+		return 7
+	}
+}
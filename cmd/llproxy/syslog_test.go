@@ -0,0 +1,131 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestSyslogUDP(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer server.Close()
+
+	writer, err := newSyslogWriter(&SyslogConfig{Network: SyslogUDP, Address: server.LocalAddr().String(), Facility: "local3"})
+	require.NoError(t, err)
+	logger := zap.New(newSyslogCore(zapcore.InfoLevel, writer)).Sugar().With("route", "openai")
+	logger.Debugw("Not sent")
+	logger.Warnw("Rejecting request", "status", 429)
+
+	packet := make([]byte, 2048)
+	server.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := server.ReadFrom(packet)
+	require.NoError(t, err)
+
+	// local3 is facility 19 and warnings severity 4, so the priority is 19*8+4
+	pattern := fmt.Sprintf(`^<156>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}\S+ \S+ llproxy %d - - (\{.*\})$`, os.Getpid())
+	match := regexp.MustCompile(pattern).FindSubmatch(packet[:n])
+	require.NotNil(t, match, string(packet[:n]))
+	assert.JSONEq(t, `{"message": "Rejecting request", "route": "openai", "status": 429}`, string(match[1]))
+}
+
+func TestSyslogTCP(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer server.Close()
+	received := make(chan string, 2)
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			// Messages are framed by their length
+			length, err := reader.ReadString(' ')
+			if err != nil {
+				return
+			}
+			size, _ := strconv.Atoi(strings.TrimSpace(length))
+			message := make([]byte, size)
+			if _, err := io.ReadFull(reader, message); err != nil {
+				return
+			}
+			received <- string(message)
+		}
+	}()
+
+	writer, err := newSyslogWriter(&SyslogConfig{Network: SyslogTCP, Address: server.Addr().String(), AppName: "proxy"})
+	require.NoError(t, err)
+	logger := zap.New(newSyslogCore(zapcore.DebugLevel, writer)).Sugar()
+	logger.Errorw("First")
+	logger.Infow("Second")
+	for _, expected := range []string{`<131>1 `, `<134>1 `} {
+		select {
+		case message := <-received:
+			assert.True(t, strings.HasPrefix(message, expected), message)
+			assert.Contains(t, message, " proxy ")
+		case <-time.After(2 * time.Second):
+			t.Fatal("No message received")
+		}
+	}
+
+	// Unknown networks and facilities are refused
+	assert.Error(t, (&SyslogConfig{Network: "http"}).validate())
+	assert.Error(t, (&SyslogConfig{Facility: "local9"}).validate())
+	assert.Error(t, (&SyslogConfig{Network: SyslogTLS}).validate())
+	assert.NoError(t, (&SyslogConfig{}).validate())
+}
+
+func TestSyslogQueue(t *testing.T) {
+	// Messages past a full queue are dropped rather than waited for
+	writer := &syslogWriter{hostname: "-", appName: "llproxy", queue: make(chan []byte, 1)}
+	assert.NoError(t, writer.Write(zapcore.InfoLevel, time.Now(), []byte("{}")))
+	assert.NoError(t, writer.Write(zapcore.InfoLevel, time.Now(), []byte("{}")))
+	assert.Equal(t, uint64(1), writer.dropped.Load())
+
+	// And reported once messages are sent again
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer server.Close()
+	writer, err = newSyslogWriter(&SyslogConfig{Network: SyslogUDP, Address: server.LocalAddr().String()})
+	require.NoError(t, err)
+	writer.dropped.Store(3)
+	zap.New(newSyslogCore(zapcore.InfoLevel, writer)).Sugar().Infow("Sent")
+
+	packet := make([]byte, 2048)
+	for _, expected := range []string{`"Sent"`, `"dropped": 3`} {
+		server.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, _, err := server.ReadFrom(packet)
+		require.NoError(t, err)
+		assert.Contains(t, string(packet[:n]), expected)
+	}
+}
@@ -0,0 +1,112 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// HeaderTags carries comma separated key=value tags describing a request, e.g. "feature=search,job=nightly"
+const HeaderTags = "X-LLProxy-Tags"
+
+// Limits on what a client can tag a request with
+const (
+	maxTags        = 10
+	maxTagLength   = 64
+	tagsHeaderSize = 1024
+)
+
+// Most distinct values a client or tag label takes in metrics and usage records, later ones are counted as otherLabelValue
+const (
+	maxLabelValues  = 100
+	otherLabelValue = "other"
+)
+
+// labelValues caps the values each label is recorded with, since clients choose their tags and names
+type labelValues struct {
+	mu   sync.Mutex
+	seen map[string]map[string]bool
+}
+
+// Value returns value if it's one of the first maxLabelValues seen for label, and otherLabelValue if not
+func (l *labelValues) Value(label string, value string) string {
+	if value == "" {
+		return value
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.seen == nil {
+		l.seen = make(map[string]map[string]bool)
+	}
+	values := l.seen[label]
+	if values == nil {
+		values = make(map[string]bool)
+		l.seen[label] = values
+	}
+	if !values[value] {
+		if len(values) >= maxLabelValues {
+			return otherLabelValue
+		}
+		values[value] = true
+	}
+	return value
+}
+
+// parseTags reads the tags header, skipping malformed or oversized tags
+func parseTags(value string) map[string]string {
+	if value == "" || len(value) > tagsHeaderSize {
+		return nil
+	}
+	tags := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		key, tagValue, ok := strings.Cut(pair, "=")
+		key, tagValue = strings.TrimSpace(key), strings.TrimSpace(tagValue)
+		if !ok || key == "" || len(key) > maxTagLength || len(tagValue) > maxTagLength {
+			continue
+		}
+		if len(tags) >= maxTags {
+			break
+		}
+		tags[key] = tagValue
+	}
+	return tags
+}
+
+// mergeTags returns the client's default tags overridden by the request's own
+func mergeTags(defaults map[string]string, tags map[string]string) map[string]string {
+	if len(defaults) == 0 {
+		return tags
+	}
+	merged := make(map[string]string, len(defaults)+len(tags))
+	for key, value := range defaults {
+		merged[key] = value
+	}
+	for key, value := range tags {
+		merged[key] = value
+	}
+	return merged
+}
+
+// selectTags returns the values of the given tag keys, empty for those the request wasn't tagged with
+func selectTags(tags map[string]string, keys []string) []string {
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		values[i] = tags[key]
+	}
+	return values
+}
@@ -0,0 +1,134 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTags(t *testing.T) {
+	assert.Nil(t, parseTags(""))
+	assert.Equal(t, map[string]string{"feature": "search", "job": "nightly"}, parseTags("feature=search, job=nightly"))
+
+	// Malformed and oversized tags are skipped
+	assert.Equal(t, map[string]string{"feature": "search"}, parseTags("feature=search,broken,=empty,long="+strings.Repeat("x", maxTagLength+1)))
+
+	assert.Equal(t, map[string]string{"team": "ml", "feature": "chat"}, mergeTags(map[string]string{"team": "ml", "feature": "search"}, map[string]string{"feature": "chat"}))
+}
+
+func TestRequestTags(t *testing.T) {
+	config := &Config{
+		Clients:   []ClientConfig{{Name: "tagged", Key: "key-tagged", Tags: map[string]string{"team": "ml", "feature": "default"}}},
+		TagLabels: []string{"feature", "team"},
+	}
+	routes := map[string]RouteConfig{"tagroute": {}}
+
+	var forwarded http.Header
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header
+		record := recordFromContext(r.Context())
+		record.Model = "tag-model"
+		record.Usage = &Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("done"))
+	}
+	handler = recordRequests(routes, nil, config.TagLabels)(identifyClients(newClientKeys(config), config.DefaultPriority)(handler))
+
+	req := httptest.NewRequest("POST", "http://localhost:8080/tagroute/v1/chat/completions", nil)
+	req.Header.Set(HeaderClientKey, "key-tagged")
+	req.Header.Set(HeaderTags, "feature=search,user=42")
+	handler(httptest.NewRecorder(), req)
+	assert.Empty(t, forwarded.Get(HeaderTags))
+
+	var usage []UsageRecord
+	for _, record := range usageRecords.List() {
+		if record.Route == "tagroute" {
+			usage = append(usage, record)
+		}
+	}
+	// Only the configured tags are kept as columns
+	assert.Equal(t, []UsageRecord{{
+		Route: "tagroute", Model: "tag-model", Client: "tagged",
+		Tags:     map[string]string{"feature": "search", "team": "ml"},
+		Requests: 1, PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15,
+	}}, usage)
+
+	var metrics bytes.Buffer
+	requestMetrics.Write(&metrics)
+	assert.Contains(t, metrics.String(), `llproxy_requests_total{route="tagroute",model="tag-model",status="201",tag_feature="search",tag_team="ml"} 1`)
+	assert.Contains(t, metrics.String(), `llproxy_tokens_total{route="tagroute",model="tag-model",status="201",tag_feature="search",tag_team="ml",type="completion"} 5`)
+}
+
+func TestLabelValuesCapped(t *testing.T) {
+	metrics, ledger := &metricsRegistry{}, &usageLedger{}
+	for i := 0; i <= maxLabelValues; i++ {
+		record := &RequestRecord{Route: "route", Model: "model", Client: fmt.Sprintf("client-%d", i), Status: 200, Start: time.Now(), Tags: map[string]string{"user": strconv.Itoa(i)}}
+		metrics.Observe(record, []string{"user"})
+		ledger.Add(record, []string{"user"})
+	}
+
+	// Values past the cap are counted together rather than each getting a series
+	var written bytes.Buffer
+	metrics.Write(&written)
+	assert.Contains(t, written.String(), `llproxy_requests_total{route="route",model="model",status="200",tag_user="0"} 1`)
+	assert.Contains(t, written.String(), `llproxy_requests_total{route="route",model="model",status="200",tag_user="other"} 1`)
+	assert.Len(t, metrics.series, maxLabelValues+1)
+
+	records := ledger.List()
+	assert.Len(t, records, maxLabelValues+1)
+	assert.Contains(t, records, UsageRecord{Route: "route", Model: "model", Client: otherLabelValue, Tags: map[string]string{"user": otherLabelValue}, Requests: 1})
+}
+
+func TestUsageHook(t *testing.T) {
+	record := &RequestRecord{}
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(`{"usage": {"prompt_tokens": 8, "completion_tokens": 3, "total_tokens": 11}}`)),
+	}
+	usageHook(record, 15, nil)(resp)
+	assert.Equal(t, &Usage{PromptTokens: 8, CompletionTokens: 3, TotalTokens: 11}, record.Usage)
+	assert.Equal(t, "8", resp.Header.Get(HeaderPromptTokens))
+	assert.Equal(t, "3", resp.Header.Get(HeaderCompletionTokens))
+	assert.Equal(t, "-4", resp.Header.Get(HeaderEstimateDelta))
+
+	// The body is still there for the client
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Contains(t, string(body), "completion_tokens")
+
+	// Streams report usage in their last event, which is only seen once the body has been read
+	resp = &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body: ioutil.NopCloser(strings.NewReader("data: {\"choices\": [{\"delta\": {\"content\": \"Hi\"}}]}\n\n" +
+			"data: {\"choices\": [], \"usage\": {\"prompt_tokens\": 8, \"completion_tokens\": 1, \"total_tokens\": 9}}\n\ndata: [DONE]\n\n")),
+	}
+	usageHook(nil, 10, nil)(resp)
+	assert.Empty(t, resp.Trailer.Get(HeaderPromptTokens))
+	ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "8", resp.Trailer.Get(HeaderPromptTokens))
+	assert.Equal(t, "-1", resp.Trailer.Get(HeaderEstimateDelta))
+}
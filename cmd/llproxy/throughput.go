@@ -0,0 +1,76 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Seconds of admissions a throughputWindow adds up
+const throughputSeconds = 60
+
+// throughputWindow counts the requests and tokens a scheduler admitted over the last minute, in one second buckets
+type throughputWindow struct {
+	mu       sync.Mutex
+	requests [throughputSeconds]float64
+	tokens   [throughputSeconds]float64
+	last     int64 // Second of the newest bucket, on the monotonic clock
+}
+
+// Add counts an admission at now, or takes one back with negative amounts
+func (t *throughputWindow) Add(now monoTime, requests float64, tokens float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	second := int64(now.Sub(0) / time.Second)
+	t.advance(second)
+	i := second % throughputSeconds
+	t.requests[i] += requests
+	t.tokens[i] += tokens
+}
+
+// PerMinute returns the requests and tokens admitted in the minute up to now
+func (t *throughputWindow) PerMinute(now monoTime) (requests float64, tokens float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.advance(int64(now.Sub(0) / time.Second))
+	for i := range t.requests {
+		requests += t.requests[i]
+		tokens += t.tokens[i]
+	}
+	return math.Max(0, requests), math.Max(0, tokens)
+}
+
+// advance clears the buckets of the seconds since the newest one, which belonged to the previous minute
+func (t *throughputWindow) advance(second int64) {
+	if second <= t.last {
+		return
+	}
+	for s := t.last + 1; s <= second && s-t.last <= throughputSeconds; s++ {
+		t.requests[s%throughputSeconds] = 0
+		t.tokens[s%throughputSeconds] = 0
+	}
+	t.last = second
+}
+
+// headroom is the percentage of the scheduler's limits left to use, by whichever of requests and tokens is nearer
+// its limit, counting what's queued as used
+func (scheduler *Scheduler) headroom() float64 {
+	requests, tokens := scheduler.utilization()
+	return 100 * math.Max(0, 1-math.Max(requests, tokens))
+}
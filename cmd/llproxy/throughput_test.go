@@ -0,0 +1,69 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThroughputWindow(t *testing.T) {
+	var window throughputWindow
+	start := monoTime(1700000000 * time.Second)
+	window.Add(start, 1, 100)
+	window.Add(start.Add(30*time.Second), 2, 300)
+	window.Add(start.Add(30*time.Second), -1, -100)
+
+	requests, tokens := window.PerMinute(start.Add(59 * time.Second))
+	assert.Equal(t, 2.0, requests)
+	assert.Equal(t, 300.0, tokens)
+
+	// Admissions drop out a minute after they were counted
+	requests, tokens = window.PerMinute(start.Add(60 * time.Second))
+	assert.Equal(t, 1.0, requests)
+	assert.Equal(t, 200.0, tokens)
+	requests, tokens = window.PerMinute(start.Add(10 * time.Minute))
+	assert.Equal(t, 0.0, requests)
+	assert.Equal(t, 0.0, tokens)
+}
+
+func TestThroughputMetrics(t *testing.T) {
+	openai := NewOpenAI(&RouteConfig{
+		Forward:  FAKE_BASE_URL,
+		Provider: "openai",
+		Models:   map[string]ModelConfig{TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 30, ReqsPerMinute: 60, TokensPerMinute: 10000}},
+	}, &MockHttpClient{})
+	scheduler := openai.Schedulers()[TEST_MODEL]
+	req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", nil)
+	assert.Equal(t, Response(Ready), scheduler.Submit(req, 1000))
+	assert.Equal(t, Response(Ready), scheduler.Submit(req, 1500))
+	scheduler.refund(500)
+
+	w := httptest.NewRecorder()
+	newAdminRouter(Providers{"openai": openai}).ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8082/metrics", nil))
+	labels := `{route="openai",model="gpt-3.5-turbo",scope=""}`
+	assert.Contains(t, w.Body.String(), "llproxy_scheduler_admitted_rpm"+labels+" 1\n")
+	assert.Contains(t, w.Body.String(), "llproxy_scheduler_admitted_tpm"+labels+" 2000\n")
+	assert.Contains(t, w.Body.String(), "llproxy_scheduler_limit_tpm"+labels+" 10000\n")
+
+	// A fifth of the tokens are in use, the nearer of the two limits
+	status := schedulerStatus("openai", TEST_MODEL, scheduler)
+	assert.InDelta(t, 80, status.Headroom, 0.5)
+	assert.Equal(t, 2000.0, status.AdmittedTPM)
+}
@@ -0,0 +1,77 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Fraction of a client's timeout the projected queue wait may take when unset, leaving the rest for the upstream
+const defaultTimeoutBudgetFraction = 0.8
+
+// ClientTimeoutConfig infers how long clients of a route wait for a response when they don't send HeaderTimeout,
+// so a request that would spend most of that in the queue is refused straight away and its retry can land on a
+// less loaded replica
+type ClientTimeoutConfig struct {
+	// Fraction of the timeout the projected queue wait may take, 0.8 when unset
+	Fraction float64 `json:"fraction"`
+
+	// Seconds assumed for clients whose User-Agent starts with a key, e.g. {"OpenAI/Python": 600} for an SDK's default
+	UserAgents map[string]float64 `json:"userAgents"`
+
+	// Seconds assumed for other clients, none when unset
+	Default float64 `json:"default"`
+}
+
+func (c *ClientTimeoutConfig) validate() error {
+	if c.Fraction < 0 || c.Fraction > 1 {
+		return fmt.Errorf("clientTimeout fraction has to be between 0 and 1")
+	}
+	if c.Default < 0 {
+		return fmt.Errorf("clientTimeout default can't be negative")
+	}
+	for agent, timeout := range c.UserAgents {
+		if timeout <= 0 {
+			return fmt.Errorf("clientTimeout for user agent '%s' has to be positive", agent)
+		}
+	}
+	return nil
+}
+
+// MaxWait returns the seconds a request may be projected to wait in the queue within its client's timeout,
+// 0 when the timeout isn't known. The timeout the client sent wins over one inferred from the route's config.
+func (c *ClientTimeoutConfig) MaxWait(r *http.Request) float64 {
+	fraction := defaultTimeoutBudgetFraction
+	if c != nil && c.Fraction > 0 {
+		fraction = c.Fraction
+	}
+	timeout := clientTimeout(r.Context())
+	if timeout == 0 && c != nil {
+		timeout = c.Default
+
+		// The longest matching prefix is the most specific
+		agent, matched := r.UserAgent(), ""
+		for prefix, value := range c.UserAgents {
+			if strings.HasPrefix(agent, prefix) && len(prefix) > len(matched) {
+				timeout, matched = value, prefix
+			}
+		}
+	}
+	return timeout * fraction
+}
@@ -0,0 +1,122 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkoukk/tiktoken-go"
+	"go.uber.org/zap"
+)
+
+// The .tiktoken files built into the binary with the tiktoken_embed build tag, nil without it
+var embeddedTokenizerData fs.FS
+
+// fsBpeLoader loads the BPE ranks tiktoken counts tokens with from local files, named as they are upstream,
+// e.g. cl100k_base.tiktoken, instead of downloading them the first time each encoding is used
+type fsBpeLoader struct {
+	sources []fs.FS
+}
+
+func (l *fsBpeLoader) LoadTiktokenBpe(tiktokenBpeFile string) (map[string]int, error) {
+	name := path.Base(tiktokenBpeFile)
+	for _, source := range l.sources {
+		data, err := fs.ReadFile(source, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("reading tokenizer data %s: %v", name, err)
+		}
+		return parseTiktokenBpe(data)
+	}
+	return nil, fmt.Errorf("no tokenizer data %s, it isn't downloaded when a tokenizer directory is set", name)
+}
+
+// parseTiktokenBpe reads the lines of a .tiktoken file, each a base64 token and its rank
+func parseTiktokenBpe(data []byte) (map[string]int, error) {
+	ranks := make(map[string]int)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		token, rank, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("invalid tokenizer data line '%s'", line)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tokenizer data token '%s': %v", token, err)
+		}
+		n, err := strconv.Atoi(rank)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tokenizer data rank '%s': %v", rank, err)
+		}
+		ranks[string(decoded)] = n
+	}
+	return ranks, nil
+}
+
+// ConfigureTokenizer loads the tokenizer data from dir, if set, or from what's built into the binary, so counting
+// tokens never reaches out to the network in air-gapped clusters. The encodings of the configured models are then
+// loaded straight away, so missing data shows up at startup rather than on the first request for a model.
+func ConfigureTokenizer(dir string, routes map[string]RouteConfig) {
+	var sources []fs.FS
+	if dir != "" {
+		sources = append(sources, os.DirFS(dir))
+	}
+	if embeddedTokenizerData != nil {
+		sources = append(sources, embeddedTokenizerData)
+	}
+	if len(sources) == 0 {
+		return
+	}
+	tiktoken.SetBpeLoader(&fsBpeLoader{sources: sources})
+
+	loaded := map[string]bool{}
+	for _, route := range sortedModels(routes) {
+		for _, model := range sortedModels(routes[route].Models) {
+			encoding, ok := tiktokenEncoding(model)
+			if !ok || loaded[encoding] {
+				continue
+			}
+			loaded[encoding] = true
+			if _, err := tiktoken.GetEncoding(encoding); err != nil {
+				zap.S().Warnw("Unable to load tokenizer data, requests for the model will fail to count tokens", "route", route, "model", model, "encoding", encoding, "reason", err)
+			}
+		}
+	}
+}
+
+// tiktokenEncoding returns the name of the encoding tiktoken counts a model's tokens with
+func tiktokenEncoding(model string) (string, bool) {
+	if encoding, ok := tiktoken.MODEL_TO_ENCODING[model]; ok {
+		return encoding, true
+	}
+	for prefix, encoding := range tiktoken.MODEL_PREFIX_TO_ENCODING {
+		if strings.HasPrefix(model, prefix) {
+			return encoding, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,34 @@
+//go:build tiktoken_embed
+
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// The .tiktoken files in the tiktoken directory, e.g. cl100k_base.tiktoken, downloaded before building with
+// -tags tiktoken_embed so the binary counts tokens without the network or a tokenizer directory
+//
+//go:embed tiktoken/*.tiktoken
+var tiktokenFiles embed.FS
+
+func init() {
+	embeddedTokenizerData, _ = fs.Sub(tiktokenFiles, "tiktoken")
+}
@@ -0,0 +1,54 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenizerLoader(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "cl100k_base.tiktoken"), []byte("IQ== 0\nIg== 1\n"), 0o644))
+	embedded := fstest.MapFS{
+		"cl100k_base.tiktoken": {Data: []byte("invalid")},
+		"p50k_base.tiktoken":   {Data: []byte("aGVsbG8= 7\n")},
+	}
+	loader := &fsBpeLoader{sources: []fs.FS{os.DirFS(dir), embedded}}
+
+	// Files are found by the name of the URL tiktoken would download, the directory before what's embedded
+	ranks, err := loader.LoadTiktokenBpe("https://openaipublic.blob.core.windows.net/encodings/cl100k_base.tiktoken")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"!": 0, "\"": 1}, ranks)
+	ranks, err = loader.LoadTiktokenBpe("https://openaipublic.blob.core.windows.net/encodings/p50k_base.tiktoken")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"hello": 7}, ranks)
+
+	// Missing data is an error rather than a download
+	_, err = loader.LoadTiktokenBpe("https://openaipublic.blob.core.windows.net/encodings/r50k_base.tiktoken")
+	assert.ErrorContains(t, err, "no tokenizer data r50k_base.tiktoken")
+
+	encoding, ok := tiktokenEncoding("gpt-4-0613")
+	assert.True(t, ok)
+	assert.Equal(t, "cl100k_base", encoding)
+	_, ok = tiktokenEncoding("claude-2")
+	assert.False(t, ok)
+}
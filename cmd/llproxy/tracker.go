@@ -0,0 +1,92 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Upper bound on remembered objects so a tracker can't grow without limit
+const maxTrackedIDs = 10000
+
+// IDTracker remembers what we learned from a request about an object (file, assistant, ...)
+// under the id the upstream assigned to it, so later requests referencing the id can be scheduled.
+type IDTracker[T any] struct {
+	mu      sync.Mutex
+	objects map[string]T
+}
+
+func NewIDTracker[T any]() *IDTracker[T] {
+	return &IDTracker[T]{
+		objects: make(map[string]T),
+	}
+}
+
+func (t *IDTracker[T]) Get(id string) (T, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	value, ok := t.objects[id]
+	return value, ok
+}
+
+func (t *IDTracker[T]) Set(id string, value T) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Drop an arbitrary entry when full, old objects are the least likely to be referenced again anyway
+	if _, exists := t.objects[id]; !exists && len(t.objects) >= maxTrackedIDs {
+		for old := range t.objects {
+			delete(t.objects, old)
+			break
+		}
+	}
+	t.objects[id] = value
+}
+
+// RecordResponseID returns a hook that stores value under the id in a successful upstream response body
+func (t *IDTracker[T]) RecordResponseID(value T) ResponseHook {
+	return func(resp *http.Response) {
+		if resp.StatusCode != http.StatusOK {
+			return
+		}
+
+		// Read the body for the id, then put it back so it can still be sent to the client
+		bodyRaw, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			zap.S().Warnw("Unable to read response for id", "reason", err)
+			return
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewBuffer(bodyRaw))
+
+		var object struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(bodyRaw, &object); err != nil || object.ID == "" {
+			zap.S().Warnw("Unable to find id in response", "reason", err)
+			return
+		}
+
+		zap.S().Debugw("Recorded object", "id", object.ID, "value", value)
+		t.Set(object.ID, value)
+	}
+}
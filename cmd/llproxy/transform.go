@@ -0,0 +1,186 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// requestTransformer applies a route's configured mutations to JSON request bodies before they are parsed and forwarded.
+// A nil requestTransformer leaves requests unchanged.
+type requestTransformer struct {
+	config *RequestTransformConfig
+}
+
+func newRequestTransformer(config *RequestTransformConfig) *requestTransformer {
+	if config == nil {
+		return nil
+	}
+	return &requestTransformer{config: config}
+}
+
+// Apply rewrites the body of a JSON POST. Bodies that aren't a JSON object are left for the parser to reject.
+func (t *requestTransformer) Apply(r *http.Request) error {
+	if t == nil || r.Method != http.MethodPost {
+		return nil
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		return nil
+	}
+
+	original, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	body := original
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(original, &fields) == nil && fields != nil {
+		t.transform(r, fields)
+		if transformed, err := json.Marshal(fields); err == nil {
+			body = transformed
+		}
+	}
+
+	// The length has changed, so it has to be set again for the upstream
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+func (t *requestTransformer) transform(r *http.Request, fields map[string]json.RawMessage) {
+	for _, name := range t.config.Delete {
+		delete(fields, name)
+	}
+	for name, value := range t.config.Default {
+		if _, ok := fields[name]; !ok {
+			fields[name] = value
+		}
+	}
+	for name, value := range t.config.Set {
+		fields[name] = value
+	}
+	for name, header := range t.config.SetFromHeader {
+		if value := r.Header.Get(header); value != "" {
+			encoded, _ := json.Marshal(value)
+			fields[name] = encoded
+		}
+	}
+	for name, max := range t.config.Max {
+		var value float64
+		if json.Unmarshal(fields[name], &value) == nil && value > max {
+			fields[name] = json.RawMessage(strconv.FormatFloat(max, 'f', -1, 64))
+		}
+	}
+}
+
+// responseTransformer applies a route's configured mutations to upstream responses before they reach the client.
+// A nil responseTransformer leaves responses unchanged. The bodies of upstream errors are passed on verbatim,
+// as SDKs depend on their exact shape, unless the route normalizes them into the proxy's own.
+type responseTransformer struct {
+	config          *ResponseTransformConfig
+	transformErrors bool
+}
+
+// ResponseEnvelope wraps an upstream response when an envelope is configured
+type ResponseEnvelope struct {
+	Status int    `json:"status"`
+	Model  string `json:"model,omitempty"`
+}
+
+func newResponseTransformer(config *ResponseTransformConfig, normalizeErrors bool) *responseTransformer {
+	if config == nil {
+		return nil
+	}
+	return &responseTransformer{config: config, transformErrors: normalizeErrors}
+}
+
+// Hook returns the ResponseHook applying the transformations to the response for model, or nil if there are none
+func (t *responseTransformer) Hook(model string) ResponseHook {
+	if t == nil {
+		return nil
+	}
+	return func(resp *http.Response) {
+		for _, header := range t.config.DeleteHeaders {
+			resp.Header.Del(header)
+		}
+
+		// Only whole JSON bodies are rewritten, streams, compressed bodies and upstream errors pass through
+		if resp.StatusCode >= http.StatusBadRequest && !t.transformErrors {
+			return
+		}
+		if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "application/json" {
+			return
+		}
+		if resp.Header.Get("Content-Encoding") != "" {
+			return
+		}
+
+		original, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			zap.S().Warnw("Unable to read the response to transform", "model", model, "reason", err)
+			replaceWithBadGateway(resp, "The upstream's response couldn't be read")
+			return
+		}
+		resp.Body.Close()
+		body := original
+		if transformed, ok := t.transform(original, resp.StatusCode, model); ok {
+			body = transformed
+		}
+
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+}
+
+func (t *responseTransformer) transform(original []byte, status int, model string) ([]byte, bool) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(original, &fields) != nil || fields == nil {
+		return nil, false
+	}
+
+	for _, name := range t.config.Delete {
+		delete(fields, name)
+	}
+	for from, to := range t.config.Rename {
+		if value, ok := fields[from]; ok {
+			delete(fields, from)
+			fields[to] = value
+		}
+	}
+
+	var body any = fields
+	if t.config.Envelope != "" {
+		body = map[string]any{
+			t.config.Envelope: fields,
+			"llproxy":         ResponseEnvelope{Status: status, Model: model},
+		}
+	}
+
+	transformed, err := json.Marshal(body)
+	return transformed, err == nil
+}
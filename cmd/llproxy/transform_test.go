@@ -0,0 +1,144 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestTransformer(t *testing.T) {
+	transformer := newRequestTransformer(&RequestTransformConfig{
+		Delete:        []string{"logit_bias"},
+		Default:       map[string]json.RawMessage{"seed": json.RawMessage(`42`), "n": json.RawMessage(`1`)},
+		Set:           map[string]json.RawMessage{"user": json.RawMessage(`"unknown"`)},
+		SetFromHeader: map[string]string{"user": "X-User-Id"},
+		Max:           map[string]float64{"temperature": 1.0},
+	})
+
+	body := []byte(`{"model": "gpt-3.5-turbo", "n": 2, "temperature": 1.7, "logit_bias": {"50256": -100}}`)
+	req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/chat/completions", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("X-User-Id", "user-123")
+	assert.NoError(t, transformer.Apply(req))
+
+	transformed, _ := ioutil.ReadAll(req.Body)
+	assert.Equal(t, int64(len(transformed)), req.ContentLength)
+
+	var fields map[string]any
+	assert.NoError(t, json.Unmarshal(transformed, &fields))
+	assert.Equal(t, map[string]any{
+		"model":       "gpt-3.5-turbo",
+		"n":           2.0,
+		"seed":        42.0,
+		"temperature": 1.0,
+		"user":        "user-123",
+	}, fields)
+}
+
+func TestRequestTransformer_Skipped(t *testing.T) {
+	transformer := newRequestTransformer(&RequestTransformConfig{
+		Set: map[string]json.RawMessage{"user": json.RawMessage(`"proxy"`)},
+	})
+
+	// Multipart uploads aren't touched
+	body := []byte("--boundary--")
+	req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/files", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "multipart/form-data; boundary=boundary")
+	assert.NoError(t, transformer.Apply(req))
+	unchanged, _ := ioutil.ReadAll(req.Body)
+	assert.Equal(t, body, unchanged)
+
+	// Neither are bodies that aren't a JSON object
+	body = []byte(`[1, 2]`)
+	req = httptest.NewRequest("POST", "http://localhost:8080/openai/v1/completions", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	assert.NoError(t, transformer.Apply(req))
+	unchanged, _ = ioutil.ReadAll(req.Body)
+	assert.Equal(t, body, unchanged)
+}
+
+func TestResponseTransformer(t *testing.T) {
+	transformer := newResponseTransformer(&ResponseTransformConfig{
+		DeleteHeaders: []string{"Openai-Organization"},
+		Delete:        []string{"system_fingerprint"},
+		Rename:        map[string]string{"usage": "token_usage"},
+		Envelope:      "data",
+	}, false)
+
+	body := []byte(`{"id": "chatcmpl-1", "system_fingerprint": "fp_1", "usage": {"total_tokens": 3}}`)
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}, "Openai-Organization": {"org-1"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+	}
+	transformer.Hook(TEST_MODEL)(resp)
+
+	assert.Empty(t, resp.Header.Get("Openai-Organization"))
+	transformed, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, strconv.Itoa(len(transformed)), resp.Header.Get("Content-Length"))
+	assert.JSONEq(t, `{"data": {"id": "chatcmpl-1", "token_usage": {"total_tokens": 3}}, "llproxy": {"status": 200, "model": "gpt-3.5-turbo"}}`, string(transformed))
+
+	// Streams only have their headers changed
+	stream := []byte("data: {\"system_fingerprint\": \"fp_1\"}\n\n")
+	resp = &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/event-stream"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(stream)),
+	}
+	transformer.Hook(TEST_MODEL)(resp)
+	unchanged, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, stream, unchanged)
+
+	// Upstream errors keep their exact body, unless the route normalizes them
+	errorBody := []byte(`{"error": {"message": "Rate limit reached", "type": "requests", "param": null, "code": "rate_limit_exceeded"}}`)
+	for _, normalized := range []bool{false, true} {
+		resp = &http.Response{
+			StatusCode: http.StatusTooManyRequests,
+			Header:     http.Header{"Content-Type": {"application/json"}, "Openai-Organization": {"org-1"}},
+			Body:       ioutil.NopCloser(bytes.NewReader(errorBody)),
+		}
+		newResponseTransformer(&ResponseTransformConfig{DeleteHeaders: []string{"Openai-Organization"}, Envelope: "data"}, normalized).Hook(TEST_MODEL)(resp)
+		returned, _ := ioutil.ReadAll(resp.Body)
+		assert.Empty(t, resp.Header.Get("Openai-Organization"))
+		assert.Equal(t, normalized, !bytes.Equal(errorBody, returned))
+	}
+
+	// A body that can't be read in full is turned into an error rather than passed on cut short and untransformed
+	resp = &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(io.MultiReader(bytes.NewReader(body[:10]), iotest.ErrReader(errors.New("connection reset")))),
+	}
+	transformer.Hook(TEST_MODEL)(resp)
+	returned, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Equal(t, strconv.Itoa(len(returned)), resp.Header.Get("Content-Length"))
+	assert.Contains(t, string(returned), ErrCodeUpstreamError)
+
+	var none *responseTransformer
+	assert.Nil(t, none.Hook(TEST_MODEL))
+}
@@ -0,0 +1,144 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// HeaderTruncatedMessages is how many of a chat's oldest messages were dropped to fit the model's context window
+const HeaderTruncatedMessages = "X-LLProxy-Truncated-Messages"
+
+// truncateContextLength counts the chats truncatePrompt works with, tests replace it to run without tiktoken's data
+var truncateContextLength = contextLength
+
+// toolCallMessage is the part of a raw chat message that ties tool replies to the assistant message that called them
+type toolCallMessage struct {
+	Role         string            `json:"role"`
+	ToolCalls    []json.RawMessage `json:"tool_calls"`
+	FunctionCall json.RawMessage   `json:"function_call"`
+}
+
+// truncatePrompt drops a chat's oldest messages until it fits the context window along with its max_tokens, keeping
+// system messages and everything from the latest user message on. An assistant message calling tools is dropped
+// together with the tool replies that follow it, since the upstream rejects replies to calls it can't see. The body is
+// rewritten to match, and the number of messages dropped returned. A chat that can't be made to fit is left whole,
+// for the context window check to reject.
+func truncatePrompt(r *http.Request, request Request, window int) (int, error) {
+	chat, ok := request.(*ChatCompletionRequest)
+	if !ok || window <= 0 {
+		return 0, nil
+	}
+	prompt, completion, ok := truncateContextLength(chat)
+	if !ok || prompt+completion <= window {
+		return 0, nil
+	}
+
+	// The raw messages are kept, so fields the parsed request doesn't know about are forwarded as sent
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return 0, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	var fields map[string]json.RawMessage
+	var messages []json.RawMessage
+	if json.Unmarshal(body, &fields) != nil || json.Unmarshal(fields["messages"], &messages) != nil || len(messages) != len(chat.Messages) {
+		return 0, nil
+	}
+	calls := make([]toolCallMessage, len(messages))
+	for i := range messages {
+		json.Unmarshal(messages[i], &calls[i])
+	}
+
+	latestUser := len(chat.Messages)
+	for i := len(chat.Messages) - 1; i >= 0; i-- {
+		if chat.Messages[i].Role == openai.ChatMessageRoleUser {
+			latestUser = i
+			break
+		}
+	}
+
+	// Each message is counted once, as the tokens a chat of only that message has over an empty one
+	empty, _, ok := truncateContextLength(&ChatCompletionRequest{Model: chat.Model})
+	if !ok {
+		return 0, nil
+	}
+	drop := make(map[int]bool)
+	for i := 0; i < latestUser && prompt+completion > window; i++ {
+		if chat.Messages[i].Role == openai.ChatMessageRoleSystem {
+			continue
+		}
+		end := i + 1
+		if calls[i].Role == openai.ChatMessageRoleAssistant {
+			reply := ""
+			if len(calls[i].ToolCalls) > 0 {
+				reply = "tool"
+			} else if len(calls[i].FunctionCall) > 0 && string(calls[i].FunctionCall) != "null" {
+				reply = openai.ChatMessageRoleFunction
+			}
+			for reply != "" && end < len(calls) && calls[end].Role == reply {
+				end++
+			}
+		}
+		for j := i; j < end; j++ {
+			tokens, _, ok := truncateContextLength(&ChatCompletionRequest{Model: chat.Model, Messages: chat.Messages[j : j+1]})
+			if !ok {
+				return 0, nil
+			}
+			prompt -= tokens - empty
+			drop[j] = true
+		}
+		i = end - 1
+	}
+	if prompt+completion > window {
+		return 0, nil
+	}
+
+	kept := make([]json.RawMessage, 0, len(messages)-len(drop))
+	keptMessages := make([]openai.ChatCompletionMessage, 0, len(messages)-len(drop))
+	for i := range messages {
+		if !drop[i] {
+			kept = append(kept, messages[i])
+			keptMessages = append(keptMessages, chat.Messages[i])
+		}
+	}
+	if fields["messages"], err = json.Marshal(kept); err != nil {
+		return 0, err
+	}
+	if body, err = json.Marshal(fields); err != nil {
+		return 0, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	chat.Messages = keptMessages
+	return len(drop), nil
+}
+
+// truncatedHook tells the client how many of its messages were dropped
+func truncatedHook(dropped int) ResponseHook {
+	return func(resp *http.Response) {
+		resp.Header.Set(HeaderTruncatedMessages, strconv.Itoa(dropped))
+	}
+}
@@ -0,0 +1,115 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pkoukk/tiktoken-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTruncatePrompt(t *testing.T) {
+	// Chats are counted with tiktoken, whose encodings are downloaded on first use
+	if _, err := tiktoken.EncodingForModel(TEST_MODEL); err != nil {
+		t.Skipf("tiktoken encoding unavailable: %v", err)
+	}
+
+	client := &routedHttpClient{}
+	openai := NewOpenAI(&RouteConfig{
+		Forward:  FAKE_BASE_URL,
+		Provider: "openai",
+		Models: map[string]ModelConfig{
+			TEST_MODEL: {MaxQueueSize: 10, MaxQueueWait: 1.0, ReqsPerMinute: 60, TokensPerMinute: 60000, ContextWindow: 500, TruncatePrompt: true},
+		},
+	}, client)
+	handler := openai.GetHandler()
+
+	long := strings.Repeat("hello ", 300)
+	body := `{"model": "gpt-3.5-turbo", "max_tokens": 100, "messages": [
+		{"role": "system", "content": "` + long + `"},
+		{"role": "user", "content": "` + long + `"},
+		{"role": "assistant", "content": "` + long + `"},
+		{"role": "user", "content": "And now?", "name": "latest"}]}`
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "http://localhost:8080/openai/v1/chat/completions", bytes.NewBufferString(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Header().Get(HeaderTruncatedMessages))
+
+	// The system message and the latest user message are kept as they were sent
+	var sent struct {
+		Messages []map[string]string `json:"messages"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(client.bodies[0]), &sent))
+	require.Len(t, sent.Messages, 2)
+	assert.Equal(t, "system", sent.Messages[0]["role"])
+	assert.Equal(t, "latest", sent.Messages[1]["name"])
+
+	// A chat that can't fit however much is dropped is still rejected
+	body = `{"model": "gpt-3.5-turbo", "max_tokens": 100, "messages": [{"role": "user", "content": "` + strings.Repeat(long, 4) + `"}]}`
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "http://localhost:8080/openai/v1/chat/completions", bytes.NewBufferString(body)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Empty(t, w.Header().Get(HeaderTruncatedMessages))
+}
+
+func TestTruncatePromptToolCalls(t *testing.T) {
+	// Every message counts a token per word, so the test doesn't need tiktoken's data
+	count := truncateContextLength
+	defer func() { truncateContextLength = count }()
+	truncateContextLength = func(request Request) (int, int, bool) {
+		chat := request.(*ChatCompletionRequest)
+		prompt := 1
+		for _, message := range chat.Messages {
+			prompt += len(strings.Fields(message.Content)) + 1
+		}
+		return prompt, chat.MaxTokens, true
+	}
+
+	long := strings.Repeat("hello ", 50)
+	body := `{"model": "gpt-3.5-turbo", "max_tokens": 10, "messages": [
+		{"role": "system", "content": "be brief"},
+		{"role": "user", "content": "` + long + `"},
+		{"role": "assistant", "content": null, "tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "lookup", "arguments": "{}"}}]},
+		{"role": "tool", "tool_call_id": "call_1", "content": "` + long + `"},
+		{"role": "tool", "tool_call_id": "call_2", "content": "found"},
+		{"role": "assistant", "content": "done"},
+		{"role": "user", "content": "And now?"}]}`
+	r := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/chat/completions", bytes.NewBufferString(body))
+	_, request, err := (&OpenAIProvider{}).ParseRequest(r)
+	require.NoError(t, err)
+
+	// Dropping the first user message isn't enough, and the assistant's tool calls go with both their replies
+	dropped, err := truncatePrompt(r, request, 40)
+	require.NoError(t, err)
+	assert.Equal(t, 4, dropped)
+	var sent struct {
+		Messages []map[string]any `json:"messages"`
+	}
+	require.NoError(t, json.NewDecoder(r.Body).Decode(&sent))
+	roles := []string{}
+	for _, message := range sent.Messages {
+		roles = append(roles, message["role"].(string))
+	}
+	assert.Equal(t, []string{"system", "assistant", "user"}, roles)
+	assert.Equal(t, "done", sent.Messages[1]["content"])
+}
@@ -0,0 +1,403 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The error rate of an upstream is over this many of its most recent requests
+const upstreamErrorWindow = 100
+
+// How long an upstream is avoided after a failure before a request is let through to probe it
+const upstreamCooldown = 30 * time.Second
+
+// Circuit states of an upstream. An open circuit is avoided while another upstream is healthy, until the cooldown
+// has passed and it's half-open, when a single request probes it, closing the circuit if it succeeds.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// UpstreamHealth tracks how a provider's upstream has been answering forwarded requests
+type UpstreamHealth struct {
+	URL         string
+	requests    atomic.Uint64
+	failures    atomic.Uint64
+	lastFailed  atomic.Bool
+	lastFailure atomic.Pointer[upstreamFailure]
+	lastLatency atomic.Int64 // nanoseconds until the last response's headers arrived
+	probing     atomic.Int64 // unix nanoseconds a half-open upstream was sent its probe, 0 when it's waiting for one
+
+	// Outcomes of the most recent requests, true for failures
+	mu     sync.Mutex
+	recent [upstreamErrorWindow]bool
+	count  int
+	next   int
+}
+
+type upstreamFailure struct {
+	Time   time.Time
+	Status int
+	Error  string
+}
+
+// UpstreamStatus is a point in time view of an UpstreamHealth
+type UpstreamStatus struct {
+	URL             string     `json:"url"`
+	Healthy         bool       `json:"healthy"`
+	Circuit         string     `json:"circuit"`
+	Requests        uint64     `json:"requests"`
+	Failures        uint64     `json:"failures"`
+	ErrorRate       float64    `json:"errorRate"`
+	LastLatency     float64    `json:"lastLatency,omitempty"`
+	LastFailureTime *time.Time `json:"lastFailureTime,omitempty"`
+	LastFailure     string     `json:"lastFailure,omitempty"`
+}
+
+func NewUpstreamHealth(url string) *UpstreamHealth {
+	return &UpstreamHealth{URL: url}
+}
+
+// Record notes the outcome of a forwarded request, server errors and transport errors count as failures
+func (u *UpstreamHealth) Record(status int, err error) {
+	u.requests.Add(1)
+	failed := err != nil || status >= http.StatusInternalServerError
+	u.mu.Lock()
+	u.recent[u.next] = failed
+	u.next = (u.next + 1) % upstreamErrorWindow
+	if u.count < upstreamErrorWindow {
+		u.count++
+	}
+	u.mu.Unlock()
+	u.probing.Store(0)
+
+	if !failed {
+		u.lastFailed.Store(false)
+		return
+	}
+
+	failure := &upstreamFailure{Time: time.Now(), Status: status}
+	if err != nil {
+		failure.Error = err.Error()
+	} else {
+		failure.Error = http.StatusText(status)
+	}
+	u.failures.Add(1)
+	u.lastFailed.Store(true)
+	u.lastFailure.Store(failure)
+}
+
+// RecordLatency notes how long the upstream took to start answering a request
+func (u *UpstreamHealth) RecordLatency(latency time.Duration) {
+	u.lastLatency.Store(int64(latency))
+}
+
+// ErrorRate is the fraction of the most recent requests that failed
+func (u *UpstreamHealth) ErrorRate() float64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.count == 0 {
+		return 0
+	}
+	failures := 0
+	for _, failed := range u.recent[:u.count] {
+		if failed {
+			failures++
+		}
+	}
+	return float64(failures) / float64(u.count)
+}
+
+// Healthy is true unless the upstream's most recent request failed
+func (u *UpstreamHealth) Healthy() bool {
+	return !u.lastFailed.Load()
+}
+
+// Circuit is the upstream's circuit state, open for the cooldown after a failure and then half-open
+func (u *UpstreamHealth) Circuit() string {
+	if u.Healthy() {
+		return CircuitClosed
+	}
+	if failure := u.lastFailure.Load(); failure != nil && time.Since(failure.Time) < upstreamCooldown {
+		return CircuitOpen
+	}
+	return CircuitHalfOpen
+}
+
+// available is whether the upstream can be picked alongside the healthy ones, as it is when half-open and its
+// probe hasn't been sent, or was sent longer than the cooldown ago without an answer
+func (u *UpstreamHealth) available() bool {
+	switch u.Circuit() {
+	case CircuitClosed:
+		return true
+	case CircuitHalfOpen:
+		probe := u.probing.Load()
+		return probe == 0 || time.Since(time.Unix(0, probe)) >= upstreamCooldown
+	}
+	return false
+}
+
+// picked notes that a request is being sent to the upstream, the probe if it's half-open
+func (u *UpstreamHealth) picked() {
+	if u.Circuit() == CircuitHalfOpen {
+		u.probing.Store(time.Now().UnixNano())
+	}
+}
+
+// Status is a snapshot of the upstream's health and totals
+func (u *UpstreamHealth) Status() UpstreamStatus {
+	status := UpstreamStatus{
+		URL:         u.URL,
+		Healthy:     u.Healthy(),
+		Circuit:     u.Circuit(),
+		Requests:    u.requests.Load(),
+		Failures:    u.failures.Load(),
+		ErrorRate:   u.ErrorRate(),
+		LastLatency: time.Duration(u.lastLatency.Load()).Seconds(),
+	}
+	if failure := u.lastFailure.Load(); failure != nil {
+		status.LastFailureTime = &failure.Time
+		status.LastFailure = failure.Error
+	}
+	return status
+}
+
+// upstreamPool picks which of a route's upstreams each request is forwarded to. Requests carrying the sticky
+// header always go to the same upstream for the same value, others are spread by smooth weighted round robin.
+// Upstreams whose last request failed are avoided while any other is healthy, until their cooldown has passed and
+// a single request probes them, and those weighted 0 get no requests.
+// The upstreams and their weights can be replaced while running.
+type upstreamPool struct {
+	stickyHeader string
+
+	// URLs the upstreams may be changed to while running, the configured upstreams and the route's allowlist
+	allowed map[string]bool
+
+	mu        sync.Mutex
+	upstreams []*UpstreamHealth
+	weights   map[*UpstreamHealth]float64
+	current   map[*UpstreamHealth]float64
+}
+
+// UpstreamTarget is an upstream to forward to and its share of requests, 1 when the weight is left out
+type UpstreamTarget struct {
+	URL    string   `json:"url"`
+	Weight *float64 `json:"weight,omitempty"`
+}
+
+func newUpstreamPool(urls []string, stickyHeader string, allowlist ...string) *upstreamPool {
+	pool := &upstreamPool{stickyHeader: stickyHeader, allowed: make(map[string]bool), weights: make(map[*UpstreamHealth]float64), current: make(map[*UpstreamHealth]float64)}
+	for _, address := range urls {
+		upstream := NewUpstreamHealth(address)
+		pool.upstreams = append(pool.upstreams, upstream)
+		pool.weights[upstream] = 1
+		pool.allowed[normalizeUpstreamURL(address)] = true
+	}
+	for _, address := range allowlist {
+		pool.allowed[normalizeUpstreamURL(address)] = true
+	}
+	return pool
+}
+
+// normalizeUpstreamURL lets an allowlisted URL match with or without a trailing slash
+func normalizeUpstreamURL(address string) string {
+	return strings.TrimSuffix(address, "/")
+}
+
+func (p *upstreamPool) Select(r *http.Request) *UpstreamHealth {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.upstreams) == 1 {
+		return p.upstreams[0]
+	}
+
+	var upstream *UpstreamHealth
+	if key := r.Header.Get(p.stickyHeader); p.stickyHeader != "" && key != "" {
+		upstream = p.sticky(key)
+	} else if upstream = p.weighted(true); upstream == nil {
+		upstream = p.weighted(false)
+	}
+	if upstream != nil {
+		upstream.picked()
+	}
+	return upstream
+}
+
+// weighted is smooth weighted round robin, as in nginx, over the upstreams with weight and optionally only the
+// available ones, those that are healthy or due a probe
+func (p *upstreamPool) weighted(healthyOnly bool) *UpstreamHealth {
+	var best *UpstreamHealth
+	total := 0.0
+	for _, upstream := range p.upstreams {
+		weight := p.weights[upstream]
+		if weight <= 0 || (healthyOnly && !upstream.available()) {
+			continue
+		}
+		total += weight
+		p.current[upstream] += weight
+		if best == nil || p.current[upstream] > p.current[best] {
+			best = upstream
+		}
+	}
+	if best != nil {
+		p.current[best] -= total
+	}
+	return best
+}
+
+// sticky picks by weighted rendezvous hashing, so adding or removing an upstream only moves the keys it gains or loses
+func (p *upstreamPool) sticky(key string) *UpstreamHealth {
+	var best, bestHealthy *UpstreamHealth
+	var bestScore, bestHealthyScore float64
+	keyHash := hash64(key)
+	for _, upstream := range p.upstreams {
+		weight := p.weights[upstream]
+		if weight <= 0 {
+			continue
+		}
+
+		// -weight / ln(u) for u uniform in (0, 1), which keeps the order of the hashes when weights are equal
+		u := (float64(mix64(keyHash^hash64(upstream.URL))>>11) + 0.5) / (1 << 53)
+		score := -weight / math.Log(u)
+
+		if best == nil || score > bestScore {
+			best, bestScore = upstream, score
+		}
+		if upstream.available() && (bestHealthy == nil || score > bestHealthyScore) {
+			bestHealthy, bestHealthyScore = upstream, score
+		}
+	}
+	if bestHealthy != nil {
+		return bestHealthy
+	}
+	return best
+}
+
+func (p *upstreamPool) All() []*UpstreamHealth {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*UpstreamHealth(nil), p.upstreams...)
+}
+
+// Weight is the upstream's share of requests, 0 once it has been removed
+func (p *upstreamPool) Weight(upstream *UpstreamHealth) float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.weights[upstream]
+}
+
+// Targets returns the upstreams and their weights
+func (p *upstreamPool) Targets() []UpstreamTarget {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	targets := make([]UpstreamTarget, 0, len(p.upstreams))
+	for _, upstream := range p.upstreams {
+		weight := p.weights[upstream]
+		targets = append(targets, UpstreamTarget{URL: upstream.URL, Weight: &weight})
+	}
+	return targets
+}
+
+// Set replaces the upstreams and their weights. Upstreams that are kept keep their health. Only the configured
+// upstreams and the route's allowlist can be set, as requests are forwarded with the route's credentials.
+func (p *upstreamPool) Set(targets []UpstreamTarget) error {
+	if err := validateUpstreamTargets(targets); err != nil {
+		return err
+	}
+	for _, target := range targets {
+		if !p.allowed[normalizeUpstreamURL(target.URL)] {
+			return fmt.Errorf("upstream '%s' is neither configured nor in the route's upstreamAllowlist", target.URL)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	existing := make(map[string]*UpstreamHealth, len(p.upstreams))
+	for _, upstream := range p.upstreams {
+		existing[upstream.URL] = upstream
+	}
+
+	p.upstreams = make([]*UpstreamHealth, 0, len(targets))
+	p.weights = make(map[*UpstreamHealth]float64, len(targets))
+	p.current = make(map[*UpstreamHealth]float64, len(targets))
+	for _, target := range targets {
+		upstream, ok := existing[target.URL]
+		if !ok {
+			upstream = NewUpstreamHealth(target.URL)
+		}
+		p.upstreams = append(p.upstreams, upstream)
+		p.weights[upstream] = target.weight()
+	}
+	return nil
+}
+
+func (t UpstreamTarget) weight() float64 {
+	if t.Weight == nil {
+		return 1
+	}
+	return *t.Weight
+}
+
+// validateUpstreamTargets requires absolute http or https URLs, each listed once, and at least one with weight
+func validateUpstreamTargets(targets []UpstreamTarget) error {
+	seen := make(map[string]bool, len(targets))
+	weighted := false
+	for _, target := range targets {
+		parsed, err := url.Parse(target.URL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("upstream '%s' is not an http or https URL", target.URL)
+		}
+		if seen[target.URL] {
+			return fmt.Errorf("upstream '%s' is listed more than once", target.URL)
+		}
+		seen[target.URL] = true
+		if target.weight() < 0 || math.IsNaN(target.weight()) || math.IsInf(target.weight(), 0) {
+			return fmt.Errorf("upstream '%s' has invalid weight %v", target.URL, target.weight())
+		}
+		weighted = weighted || target.weight() > 0
+	}
+	if !weighted {
+		return fmt.Errorf("at least one upstream needs a weight above 0")
+	}
+	return nil
+}
+
+func hash64(s string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(s))
+	return hash.Sum64()
+}
+
+// mix64 is the splitmix64 finalizer, FNV alone barely changes the order of scores between keys
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
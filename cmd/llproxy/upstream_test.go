@@ -0,0 +1,129 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamPool_Sticky(t *testing.T) {
+	pool := newUpstreamPool([]string{"https://a.example.com", "https://b.example.com", "https://c.example.com"}, "X-Conversation-Id")
+
+	request := func(conversation string) *http.Request {
+		req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/chat/completions", nil)
+		req.Header.Set("X-Conversation-Id", conversation)
+		return req
+	}
+
+	// The same key always picks the same upstream, and keys are spread across all of them
+	picked := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("conversation-%d", i)
+		upstream := pool.Select(request(key))
+		assert.Equal(t, upstream, pool.Select(request(key)))
+		picked[upstream.URL] = true
+	}
+	assert.Len(t, picked, 3)
+
+	// A failing upstream is avoided, and used again once it recovers
+	upstream := pool.Select(request("conversation-1"))
+	upstream.Record(http.StatusBadGateway, nil)
+	assert.NotEqual(t, upstream, pool.Select(request("conversation-1")))
+	upstream.Record(http.StatusOK, nil)
+	assert.Equal(t, upstream, pool.Select(request("conversation-1")))
+}
+
+func TestUpstreamPool_RoundRobin(t *testing.T) {
+	pool := newUpstreamPool([]string{"https://a.example.com", "https://b.example.com"}, "X-Conversation-Id")
+	req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/chat/completions", nil)
+
+	first := pool.Select(req)
+	second := pool.Select(req)
+	assert.NotEqual(t, first, second)
+	assert.Equal(t, first, pool.Select(req))
+
+	// Requests skip an upstream whose last request failed
+	first.Record(0, fmt.Errorf("connection refused"))
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, second, pool.Select(req))
+	}
+	assert.Equal(t, CircuitOpen, first.Status().Circuit)
+
+	// Once the cooldown has passed a single request probes it, and a failed probe opens the circuit again
+	first.lastFailure.Store(&upstreamFailure{Time: time.Now().Add(-upstreamCooldown)})
+	assert.Equal(t, CircuitHalfOpen, first.Status().Circuit)
+	picked := 0
+	for i := 0; i < 4; i++ {
+		if pool.Select(req) == first {
+			picked++
+		}
+	}
+	assert.Equal(t, 1, picked)
+	first.Record(http.StatusBadGateway, nil)
+	assert.Equal(t, CircuitOpen, first.Status().Circuit)
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, second, pool.Select(req))
+	}
+
+	// A successful probe closes it
+	first.lastFailure.Store(&upstreamFailure{Time: time.Now().Add(-upstreamCooldown)})
+	if pool.Select(req) != first {
+		assert.Equal(t, first, pool.Select(req))
+	}
+	first.Record(http.StatusOK, nil)
+	assert.Equal(t, CircuitClosed, first.Status().Circuit)
+	assert.NotEqual(t, pool.Select(req), pool.Select(req))
+}
+
+func TestUpstreamPool_Set(t *testing.T) {
+	pool := newUpstreamPool([]string{"https://a.example.com", "https://b.example.com"}, "X-Conversation-Id", "https://c.example.com/")
+	req := httptest.NewRequest("POST", "http://localhost:8080/openai/v1/chat/completions", nil)
+	a := pool.All()[0]
+	a.Record(http.StatusOK, nil)
+
+	weight := func(w float64) *float64 { return &w }
+	assert.Error(t, pool.Set([]UpstreamTarget{{URL: "not a url"}}))
+	assert.Error(t, pool.Set([]UpstreamTarget{{URL: "https://a.example.com", Weight: weight(0)}}))
+	assert.Error(t, pool.Set([]UpstreamTarget{{URL: "https://a.example.com"}, {URL: "https://a.example.com"}}))
+	assert.Error(t, pool.Set([]UpstreamTarget{{URL: "https://a.example.com", Weight: weight(-1)}}))
+
+	// Only configured or allowlisted upstreams can be set
+	assert.Error(t, pool.Set([]UpstreamTarget{{URL: "https://attacker.example.com"}}))
+
+	// Requests are shared by weight, and an upstream that is kept keeps its health
+	assert.NoError(t, pool.Set([]UpstreamTarget{{URL: "https://a.example.com", Weight: weight(3)}, {URL: "https://c.example.com"}}))
+	assert.Equal(t, a, pool.All()[0])
+	assert.Equal(t, uint64(1), a.Status().Requests)
+	counts := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		counts[pool.Select(req).URL]++
+	}
+	assert.Equal(t, map[string]int{"https://a.example.com": 6, "https://c.example.com": 2}, counts)
+
+	// Weighted 0 an upstream is drained, sticky requests included
+	assert.NoError(t, pool.Set([]UpstreamTarget{{URL: "https://a.example.com", Weight: weight(0)}, {URL: "https://c.example.com"}}))
+	req.Header.Set("X-Conversation-Id", "conversation-1")
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, "https://c.example.com", pool.Select(req).URL)
+		req.Header.Set("X-Conversation-Id", fmt.Sprintf("conversation-%d", i))
+	}
+}
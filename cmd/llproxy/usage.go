@@ -0,0 +1,215 @@
+/*
+   Copyright 2023 Definitive Intelligence, Inc
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Usage is the token usage an upstream reported for a request
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// Headers reporting the usage of a request, so clients can record it without parsing bodies
+const (
+	HeaderPromptTokens     = "X-LLProxy-Prompt-Tokens"
+	HeaderCompletionTokens = "X-LLProxy-Completion-Tokens"
+	HeaderEstimateDelta    = "X-LLProxy-Estimate-Delta"
+)
+
+// Longest event stream line scanned for usage, longer lines are passed on without being looked at
+const maxUsageLineSize = 1 << 20
+
+// usageHook returns a ResponseHook reading the usage reported in a response into the request's record, if any,
+// and the usage headers. The delta is how many more tokens were used than the scheduler was charged.
+// Streams only report usage in their last events, so for those the headers are sent as trailers.
+// The cost is only reported for models with a price.
+func usageHook(record *RequestRecord, estimate int, price *PriceConfig) ResponseHook {
+	return func(resp *http.Response) {
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" {
+			return
+		}
+		mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		switch mediaType {
+		case "application/json":
+			// Read the body for the usage, then put it back so it can still be sent to the client
+			bodyRaw, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			resp.Body = ioutil.NopCloser(bytes.NewReader(bodyRaw))
+			if err != nil {
+				return
+			}
+			if usage := parseUsage(bodyRaw); usage != nil {
+				setUsageHeaders(resp.Header, usage, estimate, price)
+				if record != nil {
+					record.Usage, record.Cost = usage, price.Cost(usage.PromptTokens, usage.CompletionTokens)
+				}
+			}
+		case "text/event-stream":
+			if resp.Trailer == nil {
+				resp.Trailer = make(http.Header)
+			}
+			resp.Body = &usageStream{ReadCloser: resp.Body, resp: resp, record: record, estimate: estimate, price: price}
+		}
+	}
+}
+
+// parseUsage returns the usage in a response body or stream event, nil if there isn't any
+func parseUsage(body []byte) *Usage {
+	var response struct {
+		Usage *Usage `json:"usage"`
+	}
+	if json.Unmarshal(body, &response) != nil {
+		return nil
+	}
+	return response.Usage
+}
+
+func setUsageHeaders(header http.Header, usage *Usage, estimate int, price *PriceConfig) {
+	header.Set(HeaderPromptTokens, strconv.Itoa(usage.PromptTokens))
+	header.Set(HeaderCompletionTokens, strconv.Itoa(usage.CompletionTokens))
+	header.Set(HeaderEstimateDelta, strconv.Itoa(usage.TotalTokens-estimate))
+	if price != nil {
+		header.Set(HeaderCost, formatCost(price.Cost(usage.PromptTokens, usage.CompletionTokens)))
+	}
+}
+
+// usageStream passes an event stream through, looking for usage in its events.
+// Once the stream ends the usage is set as trailers of the response.
+type usageStream struct {
+	io.ReadCloser
+	resp     *http.Response
+	record   *RequestRecord
+	estimate int
+	price    *PriceConfig
+	line     []byte
+	usage    *Usage
+}
+
+func (u *usageStream) Read(p []byte) (int, error) {
+	n, err := u.ReadCloser.Read(p)
+	for _, b := range p[:n] {
+		if b != '\n' {
+			if len(u.line) < maxUsageLineSize {
+				u.line = append(u.line, b)
+			}
+			continue
+		}
+		if data := bytes.TrimPrefix(u.line, []byte("data:")); len(data) < len(u.line) && bytes.Contains(data, []byte(`"usage"`)) {
+			if usage := parseUsage(data); usage != nil {
+				u.usage = usage
+			}
+		}
+		u.line = u.line[:0]
+	}
+
+	if err == io.EOF && u.usage != nil {
+		setUsageHeaders(u.resp.Trailer, u.usage, u.estimate, u.price)
+		if u.record != nil {
+			u.record.Usage, u.record.Cost = u.usage, u.price.Cost(u.usage.PromptTokens, u.usage.CompletionTokens)
+		}
+		u.usage = nil
+	}
+	return n, err
+}
+
+// UsageRecord totals the requests and tokens of one route, model, client and set of tag values
+type UsageRecord struct {
+	Route            string            `json:"route"`
+	Model            string            `json:"model"`
+	Client           string            `json:"client"`
+	Tags             map[string]string `json:"tags,omitempty"`
+	Requests         uint64            `json:"requests"`
+	PromptTokens     uint64            `json:"promptTokens"`
+	CompletionTokens uint64            `json:"completionTokens"`
+	TotalTokens      uint64            `json:"totalTokens"`
+}
+
+// usageLedger keeps the usage totals of every request sent for a model since startup
+type usageLedger struct {
+	mu      sync.Mutex
+	records map[string]*UsageRecord
+	values  labelValues
+}
+
+var usageRecords = &usageLedger{}
+
+// Add counts a finished request, only the tags named by tagLabels are kept as columns
+func (l *usageLedger) Add(record *RequestRecord, tagLabels []string) {
+	if record.Model == "" {
+		return
+	}
+	client := l.values.Value("client", record.Client)
+	tagValues := selectTags(record.Tags, tagLabels)
+	for i, label := range tagLabels {
+		tagValues[i] = l.values.Value("tag_"+label, tagValues[i])
+	}
+	key := strings.Join(append([]string{record.Route, record.Model, client}, tagValues...), "\x00")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.records == nil {
+		l.records = make(map[string]*UsageRecord)
+	}
+	usage, ok := l.records[key]
+	if !ok {
+		usage = &UsageRecord{Route: record.Route, Model: record.Model, Client: client}
+		for i, label := range tagLabels {
+			if tagValues[i] != "" {
+				if usage.Tags == nil {
+					usage.Tags = make(map[string]string)
+				}
+				usage.Tags[label] = tagValues[i]
+			}
+		}
+		l.records[key] = usage
+	}
+	usage.Requests++
+	if record.Usage != nil {
+		usage.PromptTokens += uint64(record.Usage.PromptTokens)
+		usage.CompletionTokens += uint64(record.Usage.CompletionTokens)
+		usage.TotalTokens += uint64(record.Usage.TotalTokens)
+	}
+}
+
+// List returns a copy of the usage records ordered by route, model and client
+func (l *usageLedger) List() []UsageRecord {
+	l.mu.Lock()
+	keys := make([]string, 0, len(l.records))
+	for key := range l.records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	records := make([]UsageRecord, 0, len(keys))
+	for _, key := range keys {
+		records = append(records, *l.records[key])
+	}
+	l.mu.Unlock()
+	return records
+}